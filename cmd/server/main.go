@@ -12,12 +12,16 @@ import (
 	"furviogest/internal/database"
 	"furviogest/internal/handlers"
 	"furviogest/internal/middleware"
+	"furviogest/internal/segreti"
 )
 
 func main() {
 	// Flag per configurazione
 	port := flag.Int("port", 8080, "Porta del server")
 	dbPath := flag.String("db", "", "Percorso del database SQLite")
+	chiavePath := flag.String("chiave", "", "Percorso del file con la chiave di cifratura delle credenziali")
+	cifraCredenziali := flag.Bool("cifra-credenziali", false, "Cifra le credenziali ancora in chiaro nel database ed esce")
+	ruotaChiave := flag.Bool("ruota-chiave", false, "Genera una nuova chiave, ricifra le credenziali ed esce")
 	flag.Parse()
 
 	// Determina la directory base del progetto
@@ -37,7 +41,21 @@ func main() {
 		*dbPath = filepath.Join(baseDir, "data", "furviogest.db")
 	}
 
-	// Inizializza il database
+	// Sottocomando migrate: aggiorna lo schema (o con "status" lo mostra soltanto) ed esce
+	if flag.Arg(0) == "migrate" {
+		os.Exit(migra(*dbPath, flag.Arg(1)))
+	}
+
+	// Chiave di cifratura delle credenziali: fuori dal database e fuori da data/,
+	// che e servita via HTTP e inclusa nei backup
+	if *chiavePath == "" {
+		*chiavePath = filepath.Join(baseDir, "furviogest.key")
+	}
+	if err := segreti.Inizializza(*chiavePath); err != nil {
+		log.Fatal("Errore caricamento chiave di cifratura:", err)
+	}
+
+	// Inizializza il database e applica le migrazioni in attesa
 	log.Println("Inizializzazione database:", *dbPath)
 	if err := database.InitDB(*dbPath); err != nil {
 		log.Fatal("Errore inizializzazione database:", err)
@@ -49,24 +67,43 @@ func main() {
 		log.Println("Attenzione: errore creazione admin predefinito:", err)
 	}
 
-	// Crea tabelle calendario trasferte
-	if err := database.AddCalendarioTables(); err != nil {
-		log.Println("Attenzione: errore creazione tabelle calendario:", err)
+	// Cambio obbligatorio se l'admin usa ancora la password predefinita
+	if auth.ImponiCambioPasswordPredefinita() {
+		log.Println("ATTENZIONE: l'utente admin usa la password predefinita, il cambio sara richiesto al primo accesso")
 	}
 
-	// Crea tabelle monitoraggio rete
-	if err := database.AddMonitoringTables(); err != nil {
-		log.Println("Attenzione: errore creazione tabelle monitoraggio:", err)
+	// Ruoli di sistema e autorizzazioni predefinite
+	if err := auth.InizializzaRuoli(); err != nil {
+		log.Println("Attenzione: errore inizializzazione ruoli:", err)
 	}
 
-	// Crea tabella clienti
-	if err := database.AddClientiTable(); err != nil {
-		log.Println("Attenzione: errore creazione tabella clienti:", err)
+	// Migrazione e rotazione della chiave delle credenziali
+	if *ruotaChiave {
+		if os.Getenv(segreti.VariabileChiave) != "" {
+			log.Fatalf("Chiavi lette da %s: anteporre la nuova chiave nella variabile e usare -cifra-credenziali", segreti.VariabileChiave)
+		}
+		if _, err := segreti.AggiungiChiave(*chiavePath); err != nil {
+			log.Fatal("Errore generazione nuova chiave:", err)
+		}
+		if err := segreti.Inizializza(*chiavePath); err != nil {
+			log.Fatal("Errore caricamento chiave di cifratura:", err)
+		}
+		log.Println("Nuova chiave aggiunta in testa a", *chiavePath)
+		*cifraCredenziali = true
 	}
-
-	// Crea tabelle DDT uscita
-	if err := database.AddDDTUscitaTable(); err != nil {
-		log.Println("Attenzione: errore creazione tabelle DDT uscita:", err)
+	if *cifraCredenziali {
+		n, err := database.CifraCredenziali()
+		if err != nil {
+			log.Fatal("Errore cifratura credenziali:", err)
+		}
+		log.Printf("Credenziali cifrate con la chiave attiva: %d", n)
+		if *ruotaChiave {
+			log.Println("Le chiavi precedenti possono essere rimosse dal file dopo aver verificato il funzionamento")
+		}
+		return
+	}
+	if n, err := database.ContaCredenzialiDaCifrare(); err == nil && n > 0 {
+		log.Printf("Attenzione: %d credenziali in chiaro o con una chiave precedente, eseguire con -cifra-credenziali", n)
 	}
 
 	// Inizializza i template
@@ -82,6 +119,12 @@ func main() {
 	// Avvia scheduler monitoraggio rete
 	handlers.StartMonitoringScheduler()
 
+	// Avvia riepilogo giornaliero guasti
+	handlers.StartNotificheScheduler()
+
+	// Avvia backup automatico giornaliero
+	handlers.StartBackupScheduler()
+
 	// Configura il router
 	mux := http.NewServeMux()
 
@@ -90,16 +133,12 @@ func main() {
 	fs := http.FileServer(http.Dir(staticDir))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 	
-	// Directory uploads (root level)
+	// Directory uploads (root level): foto dei rapporti e PDF dei DDT, solo per chi puo
+	// vedere la sezione. La directory data (database, chiavi, backup) non e servita.
 	uploadsRoot := filepath.Join(baseDir, "uploads")
 	os.MkdirAll(uploadsRoot, 0755)
 	uploadsFs := http.FileServer(http.Dir(uploadsRoot))
-	mux.Handle("/uploads/", http.StripPrefix("/uploads/", uploadsFs))
-
-	// Directory data (per logo e altri files)
-	dataDir := filepath.Join(baseDir, "data")
-	dataFs := http.FileServer(http.Dir(dataDir))
-	mux.Handle("/data/", http.StripPrefix("/data/", dataFs))
+	mux.Handle("/uploads/", middleware.RequireAuth(http.StripPrefix("/uploads/", uploadsFs)))
 
 	// Directory uploads
 	uploadsDir := filepath.Join(baseDir, "web", "static", "uploads")
@@ -109,142 +148,165 @@ func main() {
 
 	// Route pubbliche (login/logout)
 	mux.HandleFunc("/login", handlers.LoginPage)
+	mux.HandleFunc("/login/verifica", handlers.VerificaLogin)
 	mux.HandleFunc("/logout", handlers.Logout)
 
 	// Route protette (richiedono autenticazione)
 	mux.Handle("/", middleware.RequireAuth(http.HandlerFunc(handlers.Dashboard)))
 	mux.Handle("/cambio-password", middleware.RequireAuth(http.HandlerFunc(handlers.CambioPassword)))
+	mux.Handle("/sessioni", middleware.RequireAuth(http.HandlerFunc(handlers.SessioniAttive)))
+	mux.Handle("/due-fattori", middleware.RequireAuth(http.HandlerFunc(handlers.DueFattori)))
 
 	// Anagrafica Tecnici
 	mux.Handle("/tecnici", middleware.RequireAuth(http.HandlerFunc(handlers.ListaTecnici)))
-	mux.Handle("/tecnici/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoTecnico))))
-	mux.Handle("/tecnici/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaTecnico))))
-	mux.Handle("/tecnici/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaTecnico))))
+	mux.Handle("/tecnici/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoTecnico)))
+	mux.Handle("/tecnici/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaTecnico)))
+	mux.Handle("/tecnici/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaTecnico)))
+	mux.Handle("/tecnici/disconnetti/", middleware.RequireAuth(http.HandlerFunc(handlers.DisconnettiTecnico)))
+	mux.Handle("/sicurezza", middleware.RequireAuth(http.HandlerFunc(handlers.Sicurezza)))
+	mux.Handle("/audit", middleware.RequireAuth(http.HandlerFunc(handlers.RegistroModifiche)))
+	mux.Handle("/audit/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportRegistroModificheCSV)))
+	mux.Handle("/tecnici/reimposta-2fa/", middleware.RequireAuth(http.HandlerFunc(handlers.ReimpostaDueFattoriTecnico)))
+	mux.Handle("/ruoli", middleware.RequireAuth(http.HandlerFunc(handlers.ListaRuoli)))
+	mux.Handle("/ruoli/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoRuolo)))
+	mux.Handle("/ruoli/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaRuolo)))
+	mux.Handle("/ruoli/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaRuolo)))
 
 	// Anagrafica Fornitori
 	mux.Handle("/fornitori", middleware.RequireAuth(http.HandlerFunc(handlers.ListaFornitori)))
-	mux.Handle("/fornitori/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoFornitore))))
-	mux.Handle("/fornitori/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaFornitore))))
-	mux.Handle("/fornitori/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaFornitore))))
+	mux.Handle("/fornitori/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoFornitore)))
+	mux.Handle("/fornitori/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaFornitore)))
+	mux.Handle("/fornitori/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaFornitore)))
 	mux.Handle("/api/verifica-piva", middleware.RequireAuth(http.HandlerFunc(handlers.APIVerificaPIVA)))
 	mux.Handle("/api/fornitore/info-eliminazione", middleware.RequireAuth(http.HandlerFunc(handlers.APIInfoEliminazioneFornitore)))
 
 	// Anagrafica Porti
 	mux.Handle("/porti", middleware.RequireAuth(http.HandlerFunc(handlers.ListaPorti)))
-	mux.Handle("/porti/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoPorto))))
-	mux.Handle("/porti/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaPorto))))
-	mux.Handle("/porti/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaPorto))))
+	mux.Handle("/porti/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoPorto)))
+	mux.Handle("/porti/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaPorto)))
+	mux.Handle("/porti/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaPorto)))
 
 	// Anagrafica Automezzi
 	mux.Handle("/automezzi", middleware.RequireAuth(http.HandlerFunc(handlers.ListaAutomezzi)))
-	mux.Handle("/automezzi/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoAutomezzo))))
-	mux.Handle("/automezzi/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaAutomezzo))))
-	mux.Handle("/automezzi/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaAutomezzo))))
+	mux.Handle("/automezzi/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoAutomezzo)))
+	mux.Handle("/automezzi/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaAutomezzo)))
+	mux.Handle("/automezzi/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaAutomezzo)))
 
 	// Anagrafica Compagnie
 	mux.Handle("/compagnie", middleware.RequireAuth(http.HandlerFunc(handlers.ListaCompagnie)))
-	mux.Handle("/compagnie/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovaCompagnia))))
-	mux.Handle("/compagnie/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaCompagnia))))
-	mux.Handle("/compagnie/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaCompagnia))))
+	mux.Handle("/compagnie/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaCompagnia)))
+	mux.Handle("/compagnie/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaCompagnia)))
+	mux.Handle("/compagnie/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaCompagnia)))
 	mux.Handle("/compagnie/logo/", http.HandlerFunc(handlers.ServeCompagniaLogo))
 	mux.Handle("/navi/foto/", http.HandlerFunc(handlers.ServeNaveFoto))
 
 	// Anagrafica Navi
 	// Anagrafica Clienti
 	mux.Handle("/clienti", middleware.RequireAuth(http.HandlerFunc(handlers.ListaClienti)))
-	mux.Handle("/clienti/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoCliente))))
-	mux.Handle("/clienti/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaCliente))))
-	mux.Handle("/clienti/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaCliente))))
+	mux.Handle("/clienti/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoCliente)))
+	mux.Handle("/clienti/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaCliente)))
+	mux.Handle("/clienti/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaCliente)))
 	mux.Handle("/navi", middleware.RequireAuth(http.HandlerFunc(handlers.ListaNavi)))
-	mux.Handle("/navi/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovaNave))))
-	mux.Handle("/navi/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaNave))))
-	mux.Handle("/navi/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaNave))))
+	mux.Handle("/navi/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaNave)))
+	mux.Handle("/navi/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaNave)))
+	mux.Handle("/navi/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaNave)))
 
 	// Magazzino Prodotti
 	mux.Handle("/magazzino", middleware.RequireAuth(http.HandlerFunc(handlers.ListaProdotti)))
-	mux.Handle("/magazzino/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoProdotto))))
-	mux.Handle("/magazzino/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaProdotto))))
-	mux.Handle("/magazzino/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaProdotto))))
+	mux.Handle("/magazzino/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoProdotto)))
+	mux.Handle("/magazzino/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaProdotto)))
+	mux.Handle("/magazzino/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaProdotto)))
 	mux.Handle("/magazzino/movimenti/", middleware.RequireAuth(http.HandlerFunc(handlers.ListaMovimenti)))
+	mux.Handle("/magazzino/riconciliazione", middleware.RequireAuth(http.HandlerFunc(handlers.RiconciliazioneMagazzino)))
 	// DDT Entrata
-	mux.Handle("/magazzino/movimento/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoMovimento))))
+	mux.Handle("/magazzino/movimento/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoMovimento)))
 	// DDT/Fatture (registro documenti acquisto)
 	mux.Handle("/ddt-fatture", middleware.RequireAuth(http.HandlerFunc(handlers.ListaDDTFatture)))
-	mux.Handle("/ddt-fatture/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoDDTFattura))))
-	mux.Handle("/ddt-fatture/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaDDTFattura))))
-	mux.Handle("/ddt-fatture/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaDDTFattura))))
+	mux.Handle("/ddt-fatture/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoDDTFattura)))
+	mux.Handle("/ddt-fatture/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaDDTFattura)))
+	mux.Handle("/ddt-fatture/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaDDTFattura)))
 	mux.Handle("/api/ddt-fatture/info-eliminazione", middleware.RequireAuth(http.HandlerFunc(handlers.APIInfoEliminazioneDDTFattura)))
 	mux.Handle("/api/ddt-fatture/cerca", middleware.RequireAuth(http.HandlerFunc(handlers.APICercaDDTFatture)))
 	// Movimenti acquisto
-	mux.Handle("/magazzino/movimento-acquisto/aggiungi", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AggiungiMovimentoAcquisto))))
-	mux.Handle("/magazzino/movimento-acquisto/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaMovimentoAcquisto))))
+	mux.Handle("/magazzino/movimento-acquisto/aggiungi", middleware.RequireAuth(http.HandlerFunc(handlers.AggiungiMovimentoAcquisto)))
+	mux.Handle("/magazzino/movimento-acquisto/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaMovimentoAcquisto)))
 	mux.Handle("/api/prodotto/dettaglio", middleware.RequireAuth(http.HandlerFunc(handlers.APIDettaglioProdotto)))
 	// Archivio PDF
 	mux.Handle("/archivio-pdf", middleware.RequireAuth(http.HandlerFunc(handlers.ListaArchivioPDF)))
-	mux.Handle("/archivio-pdf/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoArchivioPDF))))
+	mux.Handle("/archivio-pdf/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoArchivioPDF)))
 	mux.Handle("/archivio-pdf/download/", middleware.RequireAuth(http.HandlerFunc(handlers.DownloadArchivioPDF)))
 	mux.Handle("/archivio-pdf/visualizza/", middleware.RequireAuth(http.HandlerFunc(handlers.VisualizzaArchivioPDF)))
-	mux.Handle("/archivio-pdf/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaArchivioPDF))))
+	mux.Handle("/archivio-pdf/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaArchivioPDF)))
 
 	// Impostazioni Azienda
-	mux.Handle("/impostazioni", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ImpostazioniAziendaHandler))))
-	mux.Handle("/impostazioni/elimina-logo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaLogo))))
-	mux.Handle("/impostazioni/elimina-firma", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaFirmaEmail))))
+	mux.Handle("/impostazioni", middleware.RequireAuth(http.HandlerFunc(handlers.ImpostazioniAziendaHandler)))
+	mux.Handle("/impostazioni/elimina-logo", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaLogo)))
+	mux.Handle("/impostazioni/elimina-firma", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaFirmaEmail)))
 
 	// Backup e Ripristino
-	mux.Handle("/backup", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.BackupPage))))
-	mux.Handle("/backup/esegui", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EseguiBackup))))
-	mux.Handle("/backup/ripristina", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.RipristinaBackup))))
-	mux.Handle("/backup/upload", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.UploadBackup))))
-	mux.Handle("/backup/config", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.SalvaConfigBackup))))
-	mux.Handle("/backup/test-nas", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.TestNAS))))
-	mux.Handle("/backup/test-and-save", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.TestAndSaveNAS))))
-	mux.Handle("/backup/disable-nas", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.DisableNAS))))
-	mux.Handle("/backup/config-nas", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.SalvaConfigBackupNAS))))
-	mux.Handle("/backup/config-nas-disable", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.DisabilitaConfigBackupNAS))))
-	mux.Handle("/backup/download/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.DownloadBackup))))
-	mux.Handle("/api/backup/automatico", http.HandlerFunc(handlers.APIBackupAutomatico))
+	mux.Handle("/backup", middleware.RequireAuth(http.HandlerFunc(handlers.BackupPage)))
+	mux.Handle("/backup/esegui", middleware.RequireAuth(http.HandlerFunc(handlers.EseguiBackup)))
+	mux.Handle("/backup/ripristina", middleware.RequireAuth(http.HandlerFunc(handlers.RipristinaBackup)))
+	mux.Handle("/backup/verifica", middleware.RequireAuth(http.HandlerFunc(handlers.VerificaBackup)))
+	mux.Handle("/backup/anteprima", middleware.RequireAuth(http.HandlerFunc(handlers.AnteprimaRipristino)))
+	mux.Handle("/backup/upload", middleware.RequireAuth(http.HandlerFunc(handlers.UploadBackup)))
+	mux.Handle("/backup/config", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaConfigBackup)))
+	mux.Handle("/backup/cifratura", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaCifraturaBackup)))
+	mux.Handle("/backup/destinazioni/nuova", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaDestinazioneBackup)))
+	mux.Handle("/backup/destinazioni/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaDestinazioneBackup)))
+	mux.Handle("/backup/destinazioni/prova/", middleware.RequireAuth(http.HandlerFunc(handlers.ProvaDestinazioneBackup)))
+	mux.Handle("/backup/destinazioni/abilita/", middleware.RequireAuth(http.HandlerFunc(handlers.AbilitaDestinazioneBackup)))
+	mux.Handle("/backup/destinazioni/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaDestinazioneBackup)))
+	mux.Handle("/backup/config-nas", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaConfigBackupNAS)))
+	mux.Handle("/backup/config-nas-disable", middleware.RequireAuth(http.HandlerFunc(handlers.DisabilitaConfigBackupNAS)))
+	mux.Handle("/backup/download/", middleware.RequireAuth(http.HandlerFunc(handlers.DownloadBackup)))
 	mux.Handle("/azienda/logo", middleware.RequireAuth(http.HandlerFunc(handlers.ServeLogoAzienda)))
 	mux.Handle("/azienda/firma", middleware.RequireAuth(http.HandlerFunc(handlers.ServeFirmaEmail)))
 
 	// Permessi Accesso Porto
 	mux.Handle("/permessi", middleware.RequireAuth(http.HandlerFunc(handlers.ListaPermessi)))
-	mux.Handle("/permessi/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoPermesso))))
-	mux.Handle("/permessi/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaPermesso))))
-	mux.Handle("/permessi/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaPermesso))))
-	mux.Handle("/permessi/segna-inviata/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.SegnaEmailInviata))))
+	mux.Handle("/permessi/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoPermesso)))
+	mux.Handle("/permessi/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaPermesso)))
+	mux.Handle("/permessi/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaPermesso)))
+	mux.Handle("/permessi/segna-inviata/", middleware.RequireAuth(http.HandlerFunc(handlers.SegnaEmailInviata)))
 	mux.Handle("/permessi/dettaglio/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioPermesso)))
-	mux.Handle("/permessi/anteprima-email/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AnteprimaEmailPermesso))))
-	mux.Handle("/permessi/invia-email/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.InviaEmailPermesso))))
-	mux.Handle("/permessi/download-eml/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.DownloadEMLPermesso))))
+	mux.Handle("/permessi/anteprima-email/", middleware.RequireAuth(http.HandlerFunc(handlers.AnteprimaEmailPermesso)))
+	mux.Handle("/permessi/invia-email/", middleware.RequireAuth(http.HandlerFunc(handlers.InviaEmailPermesso)))
+	mux.Handle("/permessi/download-eml/", middleware.RequireAuth(http.HandlerFunc(handlers.DownloadEMLPermesso)))
 
 	// Dettaglio Nave e Orari
 	mux.Handle("/navi/dettaglio/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioNave)))
-	mux.Handle("/navi/piantina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.UploadPiantinaNave))))
-	mux.Handle("/navi/elimina-disegno/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaDisegnoNave))))
-	mux.Handle("/navi/server/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AggiungiServerNave))))
-	mux.Handle("/navi/elimina-server/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaServerNave))))
-	mux.Handle("/navi/modifica-server/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaServerNave))))
-	mux.Handle("/navi/orario/nuovo/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoOrario))))
-	mux.Handle("/navi/orario/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaOrario))))
-	mux.Handle("/navi/sosta/nuovo/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovaSosta))))
-	mux.Handle("/navi/sosta/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaSosta))))
+	mux.Handle("/navi/piantina/", middleware.RequireAuth(http.HandlerFunc(handlers.UploadPiantinaNave)))
+	mux.Handle("/navi/elimina-disegno/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaDisegnoNave)))
+	mux.Handle("/navi/server/", middleware.RequireAuth(http.HandlerFunc(handlers.AggiungiServerNave)))
+	mux.Handle("/navi/elimina-server/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaServerNave)))
+	mux.Handle("/navi/modifica-server/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaServerNave)))
+	mux.Handle("/navi/orario/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoOrario)))
+	mux.Handle("/navi/orario/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaOrario)))
+	mux.Handle("/navi/sosta/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaSosta)))
+	mux.Handle("/navi/sosta/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaSosta)))
 	
 	// Upload Orari Corsica Ferries
-	mux.Handle("/orari/upload", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.UploadOrariPage))))
+	mux.Handle("/orari/upload", middleware.RequireAuth(http.HandlerFunc(handlers.UploadOrariPage)))
 
 	// Gestione Rete Nave (AC, Switch, AP)
 	mux.Handle("/navi/rete/", middleware.RequireAuth(http.HandlerFunc(handlers.GestioneReteNave)))
-	mux.Handle("/navi/ac/salva/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.SalvaAccessController))))
-	mux.Handle("/navi/ac/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaAccessController))))
-	mux.Handle("/navi/switch/nuovo/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoSwitch))))
-	mux.Handle("/navi/switch/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaSwitch))))
-	mux.Handle("/navi/switch/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaSwitch))))
+	mux.Handle("/navi/snmp/", middleware.RequireAuth(http.HandlerFunc(handlers.SNMPNave)))
+	mux.Handle("/navi/topologia/", middleware.RequireAuth(http.HandlerFunc(handlers.TopologiaNave)))
+	mux.Handle("/navi/piantina-rete/", middleware.RequireAuth(http.HandlerFunc(handlers.PiantinaReteNave)))
+	mux.Handle("/navi/ac/salva/", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaAccessController)))
+	mux.Handle("/navi/ac/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaAccessController)))
+	mux.Handle("/navi/switch/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoSwitch)))
+	mux.Handle("/navi/switch/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaSwitch)))
+	mux.Handle("/navi/switch/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaSwitch)))
 	
 	// API Monitoraggio Rete
 	mux.Handle("/api/rete/scan-ap", middleware.RequireAuth(http.HandlerFunc(handlers.APIScanAccessPoints)))
 	mux.Handle("/api/rete/backup-config", middleware.RequireAuth(http.HandlerFunc(handlers.APIBackupConfig)))
 	mux.Handle("/api/rete/scan-lldp", middleware.RequireAuth(http.HandlerFunc(handlers.APIScanLLDP)))
+	mux.Handle("/api/rete/topologia", middleware.RequireAuth(http.HandlerFunc(handlers.APITopologiaNave)))
+	mux.Handle("/api/rete/piantina", middleware.RequireAuth(http.HandlerFunc(handlers.APIPiantinaNave)))
+	mux.Handle("/api/rete/piantina-posizione", middleware.RequireAuth(http.HandlerFunc(handlers.APIPosizionePiantina)))
 	mux.Handle("/api/rete/scan-ports", middleware.RequireAuth(http.HandlerFunc(handlers.APIScanPorts)))
 	mux.Handle("/api/guasti-nave", middleware.RequireAuth(http.HandlerFunc(handlers.APIGuastiNave)))
 	mux.Handle("/api/rete/switch-version", middleware.RequireAuth(http.HandlerFunc(handlers.APIGetSwitchVersion)))
@@ -252,30 +314,42 @@ func main() {
 	mux.Handle("/api/rete/ac-version", middleware.RequireAuth(http.HandlerFunc(handlers.APIGetACVersion)))
 	mux.Handle("/api/rete/ac-licenze", middleware.RequireAuth(http.HandlerFunc(handlers.APIRilevaLicenzeAC)))
 	mux.Handle("/api/rete/download-config/", middleware.RequireAuth(http.HandlerFunc(handlers.APIDownloadConfig)))
+	mux.Handle("/rete/storico-config", middleware.RequireAuth(http.HandlerFunc(handlers.StoricoConfig)))
+	mux.Handle("/rete/ripristino-config", middleware.RequireAuth(http.HandlerFunc(handlers.RipristinoConfig)))
 	mux.Handle("/api/rete/test-ssh", middleware.RequireAuth(http.HandlerFunc(handlers.APITestSSH)))
 	mux.Handle("/api/rete/export-ap-csv", middleware.RequireAuth(http.HandlerFunc(handlers.APIExportAPCSV)))
 
+	// Pianificazione job monitoraggio
+	mux.Handle("/monitoraggio/scheduler", middleware.RequireAuth(http.HandlerFunc(handlers.SchedulerMonitoraggio)))
+	mux.Handle("/monitoraggio/esecuzioni", middleware.RequireAuth(http.HandlerFunc(handlers.EsecuzioniMonitoraggio)))
+	mux.Handle("/monitoraggio/regole-guasti", middleware.RequireAuth(http.HandlerFunc(handlers.RegoleGuasti)))
+	mux.Handle("/monitoraggio/notifiche", middleware.RequireAuth(http.HandlerFunc(handlers.NotificheGuasti)))
+
+	// Report disponibilita AP (SLA)
+	mux.Handle("/monitoraggio/disponibilita", middleware.RequireAuth(http.HandlerFunc(handlers.DisponibilitaAP)))
+	mux.Handle("/monitoraggio/disponibilita/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportDisponibilitaAP)))
+
 	// Uffici
 	mux.Handle("/uffici", middleware.RequireAuth(http.HandlerFunc(handlers.ListaUffici)))
-	mux.Handle("/uffici/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoUfficio))))
-	mux.Handle("/uffici/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaUfficio))))
-	mux.Handle("/uffici/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaUfficio))))
+	mux.Handle("/uffici/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoUfficio)))
+	mux.Handle("/uffici/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaUfficio)))
+	mux.Handle("/uffici/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaUfficio)))
 	mux.Handle("/uffici/rete/", middleware.RequireAuth(http.HandlerFunc(handlers.GestioneReteUfficio)))
-	mux.Handle("/uffici/ac/salva/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.SalvaACUfficio))))
-	mux.Handle("/uffici/ac/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaACUfficio))))
-	mux.Handle("/uffici/switch/nuovo/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoSwitchUfficio))))
-	mux.Handle("/uffici/switch/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaSwitchUfficio))))
-	mux.Handle("/uffici/switch/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaSwitchUfficio))))
+	mux.Handle("/uffici/ac/salva/", middleware.RequireAuth(http.HandlerFunc(handlers.SalvaACUfficio)))
+	mux.Handle("/uffici/ac/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaACUfficio)))
+	mux.Handle("/uffici/switch/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoSwitchUfficio)))
+	mux.Handle("/uffici/switch/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaSwitchUfficio)))
+	mux.Handle("/uffici/switch/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaSwitchUfficio)))
 
 	// Sale Server
 	mux.Handle("/sale-server", middleware.RequireAuth(http.HandlerFunc(handlers.ListaSaleServer)))
-	mux.Handle("/sale-server/nuova", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovaSalaServer))))
-	mux.Handle("/sale-server/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaSalaServer))))
-	mux.Handle("/sale-server/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaSalaServer))))
+	mux.Handle("/sale-server/nuova", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaSalaServer)))
+	mux.Handle("/sale-server/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaSalaServer)))
+	mux.Handle("/sale-server/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaSalaServer)))
 	mux.Handle("/sale-server/rete/", middleware.RequireAuth(http.HandlerFunc(handlers.GestioneReteSalaServer)))
-	mux.Handle("/sale-server/switch/nuovo/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoSwitchSalaServer))))
-	mux.Handle("/sale-server/switch/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaSwitchSalaServer))))
-	mux.Handle("/sale-server/switch/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaSwitchSalaServer))))
+	mux.Handle("/sale-server/switch/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoSwitchSalaServer)))
+	mux.Handle("/sale-server/switch/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaSwitchSalaServer)))
+	mux.Handle("/sale-server/switch/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaSwitchSalaServer)))
 
 	// API Backup Uffici e Sale Server
 	mux.Handle("/api/rete/backup-config-ufficio", middleware.RequireAuth(http.HandlerFunc(handlers.APIBackupConfigUfficio)))
@@ -287,70 +361,70 @@ func main() {
 
 	// Attrezzi e Consumabili
 	mux.Handle("/attrezzi", middleware.RequireAuth(http.HandlerFunc(handlers.ListaAttrezzi)))
-	mux.Handle("/attrezzi/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoAttrezzo))))
-	mux.Handle("/attrezzi/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaAttrezzo))))
-	mux.Handle("/attrezzi/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaAttrezzo))))
-	mux.Handle("/attrezzi/movimento/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.MovimentoAttrezzoHandler))))
+	mux.Handle("/attrezzi/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoAttrezzo)))
+	mux.Handle("/attrezzi/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaAttrezzo)))
+	mux.Handle("/attrezzi/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaAttrezzo)))
+	mux.Handle("/attrezzi/movimento/", middleware.RequireAuth(http.HandlerFunc(handlers.MovimentoAttrezzoHandler)))
 	mux.Handle("/attrezzi/storico/", middleware.RequireAuth(http.HandlerFunc(handlers.StoricoAttrezzo)))
 
 	// Route Amministrazione
-	mux.Handle("/amministrazione", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.DashboardAmministrazione))))
-	mux.Handle("/amministrazione/magazzino", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.GiacenzaMagazzino))))
-	mux.Handle("/amministrazione/magazzino/export", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.ExportMagazzinoCSV))))
-	mux.Handle("/amministrazione/rapporti", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.ListaRapportiAmministrazione))))
-	mux.Handle("/amministrazione/note-spese", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.NoteSpeseAmministrazione))))
-	mux.Handle("/amministrazione/note-spese/export", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.ExportNoteSpeseCSV))))
-	mux.Handle("/amministrazione/trasferte", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.RiepilogoTrasferteAmministrazione))))
-	mux.Handle("/amministrazione/trasferte/export", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.ExportTrasferteCSV))))
-	mux.Handle("/amministrazione/riepilogo", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.RiepilogoMensile))))
-	mux.Handle("/amministrazione/ddt", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.DDTAmministrazione))))
-	mux.Handle("/amministrazione/ddt/export", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.ExportDDTCSV))))
-	mux.Handle("/amministrazione/ddt/", middleware.RequireAuth(middleware.RequireTecnicoOrAmministrazione(http.HandlerFunc(handlers.DettaglioDDTAmministrazione))))
+	mux.Handle("/amministrazione", middleware.RequireAuth(http.HandlerFunc(handlers.DashboardAmministrazione)))
+	mux.Handle("/amministrazione/magazzino", middleware.RequireAuth(http.HandlerFunc(handlers.GiacenzaMagazzino)))
+	mux.Handle("/amministrazione/magazzino/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportMagazzinoCSV)))
+	mux.Handle("/amministrazione/rapporti", middleware.RequireAuth(http.HandlerFunc(handlers.ListaRapportiAmministrazione)))
+	mux.Handle("/amministrazione/note-spese", middleware.RequireAuth(http.HandlerFunc(handlers.NoteSpeseAmministrazione)))
+	mux.Handle("/amministrazione/note-spese/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportNoteSpeseCSV)))
+	mux.Handle("/amministrazione/trasferte", middleware.RequireAuth(http.HandlerFunc(handlers.RiepilogoTrasferteAmministrazione)))
+	mux.Handle("/amministrazione/trasferte/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportTrasferteCSV)))
+	mux.Handle("/amministrazione/riepilogo", middleware.RequireAuth(http.HandlerFunc(handlers.RiepilogoMensile)))
+	mux.Handle("/amministrazione/ddt", middleware.RequireAuth(http.HandlerFunc(handlers.DDTAmministrazione)))
+	mux.Handle("/amministrazione/ddt/export", middleware.RequireAuth(http.HandlerFunc(handlers.ExportDDTCSV)))
+	mux.Handle("/amministrazione/ddt/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioDDTAmministrazione)))
 
 	// Rapporti Intervento
 	mux.Handle("/rapporti", middleware.RequireAuth(http.HandlerFunc(handlers.ListaRapporti)))
-	mux.Handle("/rapporti/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoRapporto))))
-	mux.Handle("/rapporti/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaRapporto))))
-	mux.Handle("/rapporti/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaRapportoDefinitivo))))
+	mux.Handle("/rapporti/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoRapporto)))
+	mux.Handle("/rapporti/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaRapporto)))
+	mux.Handle("/rapporti/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaRapportoDefinitivo)))
 	mux.Handle("/rapporti/dettaglio/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioRapporto)))
 	mux.Handle("/rapporti/pdf/", middleware.RequireAuth(http.HandlerFunc(handlers.RapportoPDF)))
 	mux.Handle("/rapporti/download-pdf/", middleware.RequireAuth(http.HandlerFunc(handlers.RapportoDownloadPDF)))
-	mux.Handle("/rapporti/foto/upload", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.UploadFotoRapporto))))
-	mux.Handle("/rapporti/foto/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaFotoRapporto))))
+	mux.Handle("/rapporti/foto/upload", middleware.RequireAuth(http.HandlerFunc(handlers.UploadFotoRapporto)))
+	mux.Handle("/rapporti/foto/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaFotoRapporto)))
 	mux.Handle("/navi/storico/", middleware.RequireAuth(http.HandlerFunc(handlers.StoricoInterventiNave)))
 
 	// Trasferte
 	mux.Handle("/trasferte", middleware.RequireAuth(http.HandlerFunc(handlers.ListaTrasferte)))
 	mux.Handle("/trasferte/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaTrasferta)))
 	mux.Handle("/trasferte/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaTrasferta)))
-	mux.Handle("/trasferte/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaTrasferta))))
+	mux.Handle("/trasferte/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaTrasferta)))
 
 	// Note Spese Tecnici
 	mux.Handle("/note-spese", middleware.RequireAuth(http.HandlerFunc(handlers.ListaNoteSpese)))
 	mux.Handle("/note-spese/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovaNotaSpesa)))
 	mux.Handle("/note-spese/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaNotaSpesa)))
-	mux.Handle("/note-spese/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaNotaSpesa))))
+	mux.Handle("/note-spese/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaNotaSpesa)))
 
 	// DDT Uscita Magazzino
 	mux.Handle("/ddt-uscita", middleware.RequireAuth(http.HandlerFunc(handlers.ListaDDTUscita)))
-	mux.Handle("/ddt-uscita/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoDDTUscita))))
+	mux.Handle("/ddt-uscita/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoDDTUscita)))
 	mux.Handle("/ddt-uscita/dettaglio/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioDDTUscita)))
-	mux.Handle("/ddt-uscita/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaDDTUscita))))
-	mux.Handle("/ddt-uscita/annulla/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AnnullaDDTUscita))))
-	mux.Handle("/ddt-uscita/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaDDTUscita))))
-	mux.Handle("/ddt-uscita/riga/aggiungi", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AggiungiRigaDDTUscita))))
-	mux.Handle("/ddt-uscita/riga/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.RimuoviRigaDDTUscita))))
+	mux.Handle("/ddt-uscita/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaDDTUscita)))
+	mux.Handle("/ddt-uscita/annulla/", middleware.RequireAuth(http.HandlerFunc(handlers.AnnullaDDTUscita)))
+	mux.Handle("/ddt-uscita/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaDDTUscita)))
+	mux.Handle("/ddt-uscita/riga/aggiungi", middleware.RequireAuth(http.HandlerFunc(handlers.AggiungiRigaDDTUscita)))
+	mux.Handle("/ddt-uscita/riga/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.RimuoviRigaDDTUscita)))
 	mux.Handle("/api/ddt-uscita/cerca-prodotti", middleware.RequireAuth(http.HandlerFunc(handlers.APICercaProdottiDDT)))
 	mux.Handle("/ddt-uscita/pdf/", middleware.RequireAuth(http.HandlerFunc(handlers.PDFDDTUscita)))
 
 	// DDT Tecnici
 	mux.Handle("/ddt", middleware.RequireAuth(http.HandlerFunc(handlers.ListaDDT)))
-	mux.Handle("/ddt/nuovo", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.NuovoDDT))))
-	mux.Handle("/ddt/modifica/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.ModificaDDT))))
+	mux.Handle("/ddt/nuovo", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoDDT)))
+	mux.Handle("/ddt/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaDDT)))
 	mux.Handle("/ddt/dettaglio/", middleware.RequireAuth(http.HandlerFunc(handlers.DettaglioDDT)))
-	mux.Handle("/ddt/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaDDT))))
-	mux.Handle("/ddt/riga/aggiungi", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.AggiungiRigaDDT))))
-	mux.Handle("/ddt/riga/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.RimuoviRigaDDT))))
+	mux.Handle("/ddt/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaDDT)))
+	mux.Handle("/ddt/riga/aggiungi", middleware.RequireAuth(http.HandlerFunc(handlers.AggiungiRigaDDT)))
+	mux.Handle("/ddt/riga/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.RimuoviRigaDDT)))
 	mux.Handle("/ddt/genera-numero", middleware.RequireAuth(http.HandlerFunc(handlers.GeneraNumDDT)))
 
 	// Foglio Mensile
@@ -375,14 +449,12 @@ func main() {
 	mux.Handle("/guasti-nave/", middleware.RequireAuth(http.HandlerFunc(handlers.GuastiNave)))
 	mux.Handle("/guasti-nave/nuovo/", middleware.RequireAuth(http.HandlerFunc(handlers.NuovoGuasto)))
 	mux.Handle("/guasti-nave/modifica/", middleware.RequireAuth(http.HandlerFunc(handlers.ModificaGuasto)))
-	mux.Handle("/guasti-nave/elimina/", middleware.RequireAuth(middleware.RequireTecnico(http.HandlerFunc(handlers.EliminaGuasto))))
+	mux.Handle("/guasti-nave/elimina/", middleware.RequireAuth(http.HandlerFunc(handlers.EliminaGuasto)))
 	mux.Handle("/guasti-nave/storico", middleware.RequireAuth(http.HandlerFunc(handlers.StoricoGuasti)))
 
 	// Avvia il server
 	addr := fmt.Sprintf(":%d", *port)
 	log.Printf("Server FurvioGest avviato su http://localhost%s", addr)
-	log.Println("Credenziali predefinite: admin / admin")
-	log.Println("IMPORTANTE: Cambiare la password al primo accesso!")
 
 	if err := http.ListenAndServe(addr, mux); err != nil {
 		log.Fatal("Errore avvio server:", err)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"furviogest/internal/database"
+)
+
+// migra esegue il sottocomando migrate e restituisce il codice di uscita.
+// Senza argomenti applica le migrazioni in attesa, con "status" mostra soltanto lo stato.
+func migra(dbPath, azione string) int {
+	if azione != "" && azione != "status" {
+		fmt.Fprintf(os.Stderr, "Uso: %s [flag] migrate [status]\n", os.Args[0])
+		return 2
+	}
+
+	if err := database.Apri(dbPath); err != nil {
+		log.Println("Errore apertura database:", err)
+		return 1
+	}
+	defer database.CloseDB()
+
+	if azione == "" {
+		n, err := database.Migra()
+		if err != nil {
+			log.Println("Errore migrazione schema:", err)
+			return 1
+		}
+		log.Printf("Migrazioni applicate: %d", n)
+	}
+
+	stato, err := database.StatoMigrazioni()
+	if err != nil {
+		log.Println("Errore lettura stato migrazioni:", err)
+		return 1
+	}
+
+	fmt.Println("Database:", dbPath)
+	inAttesa := 0
+	for _, s := range stato {
+		switch {
+		case s.Sconosciuta:
+			fmt.Printf("  %3d  %-10s  %s  (sconosciuta a questa versione del programma)\n",
+				s.Versione, "?", s.ApplicataIl.Local().Format("02/01/2006 15:04"))
+		case s.Applicata:
+			fmt.Printf("  %3d  %-10s  %s  %s\n", s.Versione, "applicata",
+				s.ApplicataIl.Local().Format("02/01/2006 15:04"), s.Descrizione)
+		default:
+			inAttesa++
+			fmt.Printf("  %3d  %-10s  %-16s  %s\n", s.Versione, "in attesa", "", s.Descrizione)
+		}
+	}
+	if inAttesa > 0 {
+		fmt.Printf("Migrazioni in attesa: %d (eseguire migrate senza status per applicarle)\n", inAttesa)
+	} else {
+		fmt.Println("Schema aggiornato")
+	}
+	return 0
+}
@@ -4,6 +4,7 @@ go 1.25.4
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/xuri/excelize/v2 v2.10.0
 	golang.org/x/crypto v0.45.0
 )
 
@@ -12,7 +13,6 @@ require (
 	github.com/richardlehane/msoleps v1.0.4 // indirect
 	github.com/tiendc/go-deepcopy v1.7.1 // indirect
 	github.com/xuri/efp v0.0.1 // indirect
-	github.com/xuri/excelize/v2 v2.10.0 // indirect
 	github.com/xuri/nfp v0.0.2-0.20250530014748-2ddeb826f9a9 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
@@ -0,0 +1,535 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"furviogest/internal/database"
+)
+
+// Azioni registrate nel log
+const (
+	AzioneCrea     = "crea"
+	AzioneModifica = "modifica"
+	AzioneElimina  = "elimina"
+
+	// AzioneRichiesta e una richiesta di scrittura che nessun handler ha tracciato: la
+	// voce riporta i campi inviati invece delle differenze sui record
+	AzioneRichiesta = "richiesta"
+)
+
+// lunghezzaMassimaCampo limita i valori dei campi inviati copiati in una voce generica
+const lunghezzaMassimaCampo = 200
+
+// formatoData e il formato delle date salvate nel log (UTC, come le altre tabelle)
+const formatoData = "2006-01-02 15:04:05"
+
+// campiIgnorati cambiano a ogni salvataggio o sono aggiornati dai job in background:
+// non dicono nulla della modifica fatta dall'utente
+var campiIgnorati = map[string]bool{
+	"updated_at":        true,
+	"ultima_esecuzione": true,
+	"ultimo_esito":      true,
+	"ultimo_messaggio":  true,
+}
+
+// nomiRiservati identificano le colonne il cui valore non va mai copiato nel log: la
+// colonna si chiama cosi o finisce con "_" seguito dal nome (es. ssh_pass, totp_segreto)
+var nomiRiservati = []string{"password", "pass", "segreto", "token", "token_hash", "community", "chiave"}
+
+// Figlio e una tabella collegata che fa parte del record (es. le righe di un DDT):
+// le sue righe vengono confrontate insieme al record padre
+type Figlio struct {
+	Tabella string
+	Colonna string // colonna che punta all'ID del padre
+}
+
+// Riga e una riga letta dal database, colonna -> valore
+type Riga map[string]interface{}
+
+// Modifica e il valore di un campo prima e dopo l'operazione (nil se il record non esisteva)
+type Modifica struct {
+	Prima interface{} `json:"prima"`
+	Dopo  interface{} `json:"dopo"`
+}
+
+// Autore identifica chi ha eseguito l'operazione
+type Autore struct {
+	UtenteID int64
+	Username string
+	IP       string
+	Percorso string
+
+	tracciata bool // un handler ha concluso una Traccia per la richiesta
+}
+
+// Tracciata indica se un handler ha registrato con Traccia le modifiche della richiesta
+func (a *Autore) Tracciata() bool {
+	return a.tracciata
+}
+
+// Voce e una riga del log delle modifiche
+type Voce struct {
+	ID        int64
+	CreatedAt time.Time
+	UtenteID  int64
+	Username  string
+	IP        string
+	Entita    string
+	EntitaID  int64
+	Azione    string
+	Modifiche string // JSON {campo: {prima, dopo}}
+	Percorso  string
+}
+
+// Campo e una modifica pronta per la visualizzazione
+type Campo struct {
+	Nome  string
+	Prima string
+	Dopo  string
+}
+
+// Campi restituisce le modifiche della voce ordinate per nome del campo
+func (v Voce) Campi() []Campo {
+	var modifiche map[string]Modifica
+	if err := json.Unmarshal([]byte(v.Modifiche), &modifiche); err != nil {
+		return nil
+	}
+	campi := make([]Campo, 0, len(modifiche))
+	for nome, m := range modifiche {
+		campi = append(campi, Campo{Nome: nome, Prima: Testo(m.Prima), Dopo: Testo(m.Dopo)})
+	}
+	sort.Slice(campi, func(i, j int) bool { return campi[i].Nome < campi[j].Nome })
+	return campi
+}
+
+// Testo rende leggibile un valore del log: i record collegati restano in JSON
+func Testo(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+// riservato indica se la colonna contiene credenziali o segreti
+func riservato(colonna string) bool {
+	colonna = strings.ToLower(colonna)
+	for _, n := range nomiRiservati {
+		if colonna == n || strings.HasSuffix(colonna, "_"+n) {
+			return true
+		}
+	}
+	return false
+}
+
+// campoRiservato indica se un campo inviato contiene credenziali: basta che una parte
+// del nome lo sia (es. password_attuale)
+func campoRiservato(nome string) bool {
+	for _, parte := range strings.Split(nome, "_") {
+		if riservato(parte) {
+			return true
+		}
+	}
+	return riservato(nome)
+}
+
+// normalizza converte i valori del driver in valori confrontabili e serializzabili
+func normalizza(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		if utf8.Valid(t) {
+			return string(t)
+		}
+		return fmt.Sprintf("<%d byte>", len(t))
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+			return t.Format("2006-01-02") // colonne DATE
+		}
+		return t.UTC().Format(formatoData)
+	default:
+		return v
+	}
+}
+
+// Esecutore e la connessione o la transazione in cui l'handler scrive
+type Esecutore interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// leggiRighe esegue la query e restituisce le righe come mappe colonna -> valore
+func leggiRighe(tx Esecutore, query string, args ...interface{}) ([]Riga, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	colonne, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var righe []Riga
+	for rows.Next() {
+		valori := make([]interface{}, len(colonne))
+		puntatori := make([]interface{}, len(colonne))
+		for i := range valori {
+			puntatori[i] = &valori[i]
+		}
+		if err := rows.Scan(puntatori...); err != nil {
+			return nil, err
+		}
+		riga := make(Riga, len(colonne))
+		for i, c := range colonne {
+			riga[c] = normalizza(valori[i])
+		}
+		righe = append(righe, riga)
+	}
+	return righe, rows.Err()
+}
+
+// fotografia legge i record della tabella che soddisfano la condizione, con le righe
+// delle tabelle figlie, indicizzati per rowid (l'ID, o la chiave interna per le tabelle
+// con chiave testuale come regole_guasti)
+func fotografia(tx Esecutore, tabella, dove string, args []interface{}, figli []Figlio) (map[int64]Riga, error) {
+	righe, err := leggiRighe(tx, "SELECT rowid AS rowid_audit, * FROM "+tabella+" WHERE "+dove, args...)
+	if err != nil {
+		return nil, err
+	}
+	record := make(map[int64]Riga, len(righe))
+	for _, riga := range righe {
+		id, _ := riga["rowid_audit"].(int64)
+		delete(riga, "rowid_audit")
+		for _, f := range figli {
+			collegate, err := leggiRighe(tx, "SELECT * FROM "+f.Tabella+" WHERE "+f.Colonna+" = ? ORDER BY rowid", id)
+			if err != nil {
+				return nil, err
+			}
+			riga[f.Tabella] = collegate
+		}
+		record[id] = riga
+	}
+	return record, nil
+}
+
+// ============================================
+// TRACCIA DELLE MODIFICHE DI UNA RICHIESTA
+// ============================================
+
+// chiaveAutore e la chiave del contesto con l'autore della richiesta
+type chiaveAutore struct{}
+
+// ConAutore restituisce il contesto della richiesta con l'autore delle modifiche
+func ConAutore(ctx context.Context, autore *Autore) context.Context {
+	return context.WithValue(ctx, chiaveAutore{}, autore)
+}
+
+// AutoreRichiesta restituisce l'autore della richiesta, nil fuori da una richiesta autenticata
+func AutoreRichiesta(r *http.Request) *Autore {
+	autore, _ := r.Context().Value(chiaveAutore{}).(*Autore)
+	return autore
+}
+
+// gruppo sono i record di una tabella seguiti dalla traccia: quelli con gli ID indicati
+// o quelli che soddisfano la condizione (le configurazioni con poche righe)
+type gruppo struct {
+	tabella string
+	figli   []Figlio
+	azione  string // da registrare se il record esiste ancora dopo la scrittura
+	dove    string
+	args    []interface{}
+	prima   map[int64]Riga
+}
+
+// Traccia raccoglie i record che un handler sta per toccare e, a scrittura avvenuta,
+// registra le differenze nella stessa transazione: fotografie e voci del log sono
+// coerenti con la modifica e spariscono con essa se la transazione viene annullata.
+// I record creati sono quelli indicati dall'handler con l'ID di LastInsertId.
+type Traccia struct {
+	tx     Esecutore
+	autore *Autore
+	gruppi []*gruppo
+}
+
+// Nuova prepara la traccia delle modifiche che la richiesta esegue in tx. Fuori da una
+// richiesta autenticata (es. job in background) la traccia non registra nulla.
+func Nuova(r *http.Request, tx Esecutore) *Traccia {
+	return &Traccia{tx: tx, autore: AutoreRichiesta(r)}
+}
+
+// aggiungi fotografa i record del gruppo prima della scrittura
+func (t *Traccia) aggiungi(g *gruppo) error {
+	g.prima = map[int64]Riga{}
+	if t.autore != nil && g.dove != "" {
+		prima, err := fotografia(t.tx, g.tabella, g.dove, g.args, g.figli)
+		if err != nil {
+			return fmt.Errorf("audit %s: %w", g.tabella, err)
+		}
+		g.prima = prima
+	}
+	t.gruppi = append(t.gruppi, g)
+	return nil
+}
+
+// Modifica fotografa il record prima di modificarlo
+func (t *Traccia) Modifica(tabella string, id int64, figli ...Figlio) error {
+	return t.aggiungi(&gruppo{tabella: tabella, figli: figli, dove: "id = ?", args: []interface{}{id}})
+}
+
+// Elimina fotografa il record prima di eliminarlo. Se il record resta (eliminazione
+// logica con deleted_at) la voce e comunque un'eliminazione.
+func (t *Traccia) Elimina(tabella string, id int64, figli ...Figlio) error {
+	return t.aggiungi(&gruppo{tabella: tabella, figli: figli, azione: AzioneElimina, dove: "id = ?", args: []interface{}{id}})
+}
+
+// Righe fotografa i record che soddisfano la condizione: dopo la scrittura quelli nuovi
+// risultano creati, quelli spariti eliminati
+func (t *Traccia) Righe(tabella, dove string, args ...interface{}) error {
+	return t.aggiungi(&gruppo{tabella: tabella, dove: dove, args: args})
+}
+
+// Crea annota il record creato dall'handler, con l'ID restituito da LastInsertId
+func (t *Traccia) Crea(tabella string, id int64, figli ...Figlio) {
+	t.gruppi = append(t.gruppi, &gruppo{tabella: tabella, figli: figli, dove: "id = ?", args: []interface{}{id}, prima: map[int64]Riga{}})
+}
+
+// Inserisci esegue l'INSERT nella transazione e annota il record creato
+func (t *Traccia) Inserisci(tabella, query string, args ...interface{}) (int64, error) {
+	res, err := t.tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	t.Crea(tabella, id)
+	return id, nil
+}
+
+// Concludi rilegge i record nella transazione, li confronta con le fotografie e
+// registra una voce per ogni record creato, modificato o eliminato
+func (t *Traccia) Concludi() error {
+	if t.autore == nil {
+		return nil
+	}
+	t.autore.tracciata = true
+	for _, g := range t.gruppi {
+		dopo, err := fotografia(t.tx, g.tabella, g.dove, g.args, g.figli)
+		if err != nil {
+			return fmt.Errorf("audit %s: %w", g.tabella, err)
+		}
+
+		ids := make([]int64, 0, len(dopo)+len(g.prima))
+		for id := range g.prima {
+			ids = append(ids, id)
+		}
+		for id := range dopo {
+			if _, ok := g.prima[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for _, id := range ids {
+			prima, dopo := g.prima[id], dopo[id]
+			modifiche := Differenze(prima, dopo)
+			if len(modifiche) == 0 {
+				continue
+			}
+			azione := g.azione
+			switch {
+			case prima == nil:
+				azione = AzioneCrea
+			case dopo == nil:
+				azione = AzioneElimina
+			case azione == "":
+				azione = AzioneModifica
+			}
+			if err := Registra(t.tx, *t.autore, g.tabella, id, azione, modifiche); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Differenze restituisce i campi cambiati tra due versioni di un record; una versione
+// nil indica un record creato o eliminato. I valori riservati sono oscurati.
+func Differenze(prima, dopo Riga) map[string]Modifica {
+	modifiche := make(map[string]Modifica)
+	campi := make(map[string]bool)
+	for c := range prima {
+		campi[c] = true
+	}
+	for c := range dopo {
+		campi[c] = true
+	}
+	for c := range campi {
+		if c == "id" || campiIgnorati[c] {
+			continue
+		}
+		a, b := prima[c], dopo[c]
+		if reflect.DeepEqual(a, b) || (vuoto(a) && vuoto(b)) {
+			continue
+		}
+		if riservato(c) {
+			a, b = oscura(a), oscura(b)
+		}
+		modifiche[c] = Modifica{Prima: a, Dopo: b}
+	}
+	return modifiche
+}
+
+// vuoto indica un valore assente, una stringa vuota o nessun record collegato
+func vuoto(v interface{}) bool {
+	if righe, ok := v.([]Riga); ok {
+		return len(righe) == 0
+	}
+	return v == nil || v == ""
+}
+
+// oscura nasconde un valore riservato lasciando capire se era impostato
+func oscura(v interface{}) interface{} {
+	if vuoto(v) {
+		return v
+	}
+	return "***"
+}
+
+// Registra scrive una voce nel log delle modifiche
+func Registra(tx Esecutore, autore Autore, entita string, entitaID int64, azione string, modifiche map[string]Modifica) error {
+	dati, err := json.Marshal(modifiche)
+	if err != nil {
+		return err
+	}
+	var utenteID interface{}
+	if autore.UtenteID > 0 {
+		utenteID = autore.UtenteID
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_log (created_at, utente_id, username, ip, entita, entita_id, azione, modifiche, percorso)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, time.Now().UTC().Format(formatoData), utenteID, autore.Username, autore.IP, entita, entitaID, azione, string(dati), autore.Percorso)
+	return err
+}
+
+// RegistraRichiesta scrive la voce generica di una richiesta di scrittura non tracciata
+// dall'handler, con i campi inviati: i valori riservati sono oscurati, quelli lunghi troncati
+func RegistraRichiesta(autore Autore, campi url.Values) error {
+	modifiche := make(map[string]Modifica, len(campi))
+	for nome, valori := range campi {
+		valore := strings.Join(valori, ", ")
+		if campoRiservato(nome) {
+			modifiche[nome] = Modifica{Dopo: oscura(valore)}
+			continue
+		}
+		if utf8.RuneCountInString(valore) > lunghezzaMassimaCampo {
+			valore = string([]rune(valore)[:lunghezzaMassimaCampo]) + "..."
+		}
+		modifiche[nome] = Modifica{Dopo: valore}
+	}
+	return Registra(database.DB, autore, AzioneRichiesta, 0, AzioneRichiesta, modifiche)
+}
+
+// Filtro restringe la ricerca nel log; i campi vuoti non filtrano
+type Filtro struct {
+	Username string
+	Entita   string
+	EntitaID int64
+	Azione   string
+	Dal      time.Time // inclusa
+	Al       time.Time // esclusa
+	Limite   int       // 0: nessun limite
+}
+
+// Cerca restituisce le voci del log che soddisfano il filtro, dalla piu recente
+func Cerca(f Filtro) ([]Voce, error) {
+	query := `SELECT id, created_at, COALESCE(utente_id, 0), username, ip, entita, entita_id, azione, modifiche, percorso
+		FROM audit_log WHERE 1=1`
+	var args []interface{}
+	if f.Username != "" {
+		query += " AND username LIKE ?"
+		args = append(args, "%"+f.Username+"%")
+	}
+	if f.Entita != "" {
+		query += " AND entita = ?"
+		args = append(args, f.Entita)
+	}
+	if f.EntitaID > 0 {
+		query += " AND entita_id = ?"
+		args = append(args, f.EntitaID)
+	}
+	if f.Azione != "" {
+		query += " AND azione = ?"
+		args = append(args, f.Azione)
+	}
+	if !f.Dal.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, f.Dal.UTC().Format(formatoData))
+	}
+	if !f.Al.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, f.Al.UTC().Format(formatoData))
+	}
+	query += " ORDER BY id DESC"
+	if f.Limite > 0 {
+		query += " LIMIT " + strconv.Itoa(f.Limite)
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var voci []Voce
+	for rows.Next() {
+		var v Voce
+		var creata sql.NullTime
+		if err := rows.Scan(&v.ID, &creata, &v.UtenteID, &v.Username, &v.IP, &v.Entita, &v.EntitaID,
+			&v.Azione, &v.Modifiche, &v.Percorso); err != nil {
+			return nil, err
+		}
+		v.CreatedAt = creata.Time.Local()
+		voci = append(voci, v)
+	}
+	return voci, rows.Err()
+}
+
+// Entita restituisce i tipi di record presenti nel log, per il filtro della ricerca
+func Entita() ([]string, error) {
+	rows, err := database.DB.Query("SELECT DISTINCT entita FROM audit_log ORDER BY entita")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entita []string
+	for rows.Next() {
+		var e string
+		if err := rows.Scan(&e); err != nil {
+			return nil, err
+		}
+		entita = append(entita, e)
+	}
+	return entita, rows.Err()
+}
@@ -2,11 +2,13 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"furviogest/internal/database"
 	"furviogest/internal/models"
-	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -18,26 +20,70 @@ var (
 	ErrUserInactive       = errors.New("utente non attivo")
 )
 
+// Durata delle sessioni: la scadenza si sposta in avanti a ogni richiesta
+const (
+	DurataSessione = 24 * time.Hour      // inattivita massima senza "ricorda questo dispositivo"
+	DurataRicorda  = 30 * 24 * time.Hour // inattivita massima con "ricorda questo dispositivo"
+
+	// intervalloRinnovo limita le scritture sul database: l'ultimo accesso
+	// viene aggiornato al massimo una volta per intervallo
+	intervalloRinnovo = time.Minute
+)
+
 // Session rappresenta una sessione utente
 type Session struct {
-	Token     string
-	UserID    int64
-	Username  string
-	Ruolo     models.Ruolo
-	Nome      string
-	Cognome   string
-	Email     string
-	ExpiresAt time.Time
+	ID            int64 // riga della tabella sessioni
+	Token         string
+	UserID        int64
+	Username      string
+	Ruolo         models.Ruolo
+	Nome          string
+	Cognome       string
+	Email         string
+	Ricorda       bool // "ricorda questo dispositivo": cookie persistente e durata estesa
+	IP            string
+	UserAgent     string
+	CreatedAt     time.Time
+	UltimoAccesso time.Time
+	ExpiresAt     time.Time
+	Rinnovata     bool // la scadenza e stata spostata in questa richiesta
+
+	// DeveAttivareTOTP indica che il ruolo richiede il secondo fattore e l'utente
+	// non l'ha ancora configurato: puo solo completare la registrazione
+	DeveAttivareTOTP bool
+
+	// DeveCambiarePassword indica che l'utente usa la password predefinita:
+	// finche non la cambia puo raggiungere solo il cambio password
+	DeveCambiarePassword bool
+
+	RuoloID        int64
+	RuoloNome      string
+	CompagniaID    int64 // se diverso da 0 l'utente vede solo le navi di questa compagnia
+	autorizzazioni map[string]bool
+}
+
+// SessionStore gestisce le sessioni attive, salvate nella tabella sessioni
+type SessionStore struct{}
+
+var Sessions = &SessionStore{}
+
+// hashToken restituisce l'hash del token salvato nel database
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
 }
 
-// SessionStore gestisce le sessioni attive
-type SessionStore struct {
-	sessions map[string]*Session
-	mu       sync.RWMutex
+// formatoOra e il formato UTC delle date delle sessioni, confrontabile come testo
+func formatoOra(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
 }
 
-var Sessions = &SessionStore{
-	sessions: make(map[string]*Session),
+// durata restituisce l'inattivita massima della sessione
+func (s *Session) durata() time.Duration {
+	if s.Ricorda {
+		return DurataRicorda
+	}
+	return DurataSessione
 }
 
 // HashPassword genera l'hash della password
@@ -61,16 +107,16 @@ func GenerateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// Login esegue il login e crea una sessione
-func Login(username, password string) (*Session, error) {
+// VerificaCredenziali controlla username e password senza creare una sessione
+func VerificaCredenziali(username, password string) (*models.Utente, error) {
 	var user models.Utente
 	err := database.DB.QueryRow(`
-		SELECT id, username, password, nome, cognome, email, ruolo, attivo
+		SELECT id, username, password, nome, cognome, email, ruolo, attivo, COALESCE(totp_attivo, 0)
 		FROM utenti WHERE username = ?
 	`, username).Scan(
 		&user.ID, &user.Username, &user.Password,
 		&user.Nome, &user.Cognome, &user.Email,
-		&user.Ruolo, &user.Attivo,
+		&user.Ruolo, &user.Attivo, &user.TOTPAttivo,
 	)
 
 	if err != nil {
@@ -84,24 +130,36 @@ func Login(username, password string) (*Session, error) {
 	if !CheckPassword(password, user.Password) {
 		return nil, ErrInvalidCredentials
 	}
+	return &user, nil
+}
 
+// NuovaSessione crea e salva una sessione per l'utente
+func NuovaSessione(user *models.Utente, ricorda bool, ip, userAgent string) (*Session, error) {
 	token, err := GenerateToken()
 	if err != nil {
 		return nil, err
 	}
 
+	ora := time.Now()
 	session := &Session{
-		Token:     token,
-		UserID:    user.ID,
-		Username:  user.Username,
-		Ruolo:     user.Ruolo,
-		Nome:      user.Nome,
-		Cognome:   user.Cognome,
-		Email:     user.Email,
-		ExpiresAt: time.Now().Add(24 * time.Hour), // Sessione valida 24 ore
+		Token:         token,
+		UserID:        user.ID,
+		Username:      user.Username,
+		Ruolo:         user.Ruolo,
+		Nome:          user.Nome,
+		Cognome:       user.Cognome,
+		Email:         user.Email,
+		Ricorda:       ricorda,
+		IP:            ip,
+		UserAgent:     userAgent,
+		CreatedAt:     ora,
+		UltimoAccesso: ora,
 	}
+	session.ExpiresAt = ora.Add(session.durata())
 
-	Sessions.Set(token, session)
+	if err := Sessions.Set(token, session); err != nil {
+		return nil, err
+	}
 	return session, nil
 }
 
@@ -110,45 +168,111 @@ func Logout(token string) {
 	Sessions.Delete(token)
 }
 
-// Set aggiunge una sessione
-func (s *SessionStore) Set(token string, session *Session) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.sessions[token] = session
+// Set salva una nuova sessione
+func (s *SessionStore) Set(token string, session *Session) error {
+	res, err := database.DB.Exec(`
+		INSERT INTO sessioni (token_hash, utente_id, ricorda, ip, user_agent, created_at, ultimo_accesso, scadenza)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, hashToken(token), session.UserID, session.Ricorda, session.IP, session.UserAgent,
+		formatoOra(session.CreatedAt), formatoOra(session.UltimoAccesso), formatoOra(session.ExpiresAt))
+	if err != nil {
+		return err
+	}
+	session.ID, _ = res.LastInsertId()
+	return nil
 }
 
-// Get recupera una sessione
+// Get recupera una sessione valida e ne sposta in avanti la scadenza.
+// Le sessioni di utenti disattivati non sono valide.
 func (s *SessionStore) Get(token string) (*Session, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	session, ok := s.sessions[token]
-	if !ok {
+	session := &Session{Token: token}
+	var totpAttivo, totpObbligatorio bool
+	err := database.DB.QueryRow(`
+		SELECT s.id, s.utente_id, u.username, COALESCE(r.codice, u.ruolo), u.nome, u.cognome, u.email,
+		       s.ricorda, s.ip, s.user_agent, s.created_at, s.ultimo_accesso, s.scadenza,
+		       COALESCE(u.totp_attivo, 0), COALESCE((SELECT totp_obbligatorio_tecnici FROM impostazioni_azienda WHERE id = 1), 0),
+		       COALESCE(u.cambio_password_obbligatorio, 0),
+		       COALESCE(r.id, 0), COALESCE(r.nome, u.ruolo), COALESCE(u.compagnia_id, 0)
+		FROM sessioni s
+		JOIN utenti u ON s.utente_id = u.id
+		LEFT JOIN ruoli r ON r.id = u.ruolo_id
+		WHERE s.token_hash = ? AND u.attivo = 1
+	`, hashToken(token)).Scan(
+		&session.ID, &session.UserID, &session.Username, &session.Ruolo, &session.Nome, &session.Cognome, &session.Email,
+		&session.Ricorda, &session.IP, &session.UserAgent, &session.CreatedAt, &session.UltimoAccesso, &session.ExpiresAt,
+		&totpAttivo, &totpObbligatorio, &session.DeveCambiarePassword,
+		&session.RuoloID, &session.RuoloNome, &session.CompagniaID,
+	)
+	if err != nil {
 		return nil, false
 	}
-	if time.Now().After(session.ExpiresAt) {
-		go s.Delete(token) // Rimuovi sessione scaduta
+	session.autorizzazioni = caricaAutorizzazioni(session.RuoloID, string(session.Ruolo))
+	session.DeveAttivareTOTP = totpObbligatorio && !totpAttivo && session.richiedeSecondoFattore()
+
+	ora := time.Now()
+	if ora.After(session.ExpiresAt) {
+		s.Delete(token) // Rimuovi sessione scaduta
 		return nil, false
 	}
+
+	if ora.Sub(session.UltimoAccesso) >= intervalloRinnovo {
+		session.UltimoAccesso = ora
+		session.ExpiresAt = ora.Add(session.durata())
+		session.Rinnovata = true
+		database.DB.Exec("UPDATE sessioni SET ultimo_accesso = ?, scadenza = ? WHERE id = ?",
+			formatoOra(session.UltimoAccesso), formatoOra(session.ExpiresAt), session.ID)
+	}
 	return session, true
 }
 
 // Delete rimuove una sessione
 func (s *SessionStore) Delete(token string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.sessions, token)
+	database.DB.Exec("DELETE FROM sessioni WHERE token_hash = ?", hashToken(token))
 }
 
 // CleanExpired rimuove tutte le sessioni scadute
 func (s *SessionStore) CleanExpired() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	now := time.Now()
-	for token, session := range s.sessions {
-		if now.After(session.ExpiresAt) {
-			delete(s.sessions, token)
+	database.DB.Exec("DELETE FROM sessioni WHERE scadenza < ?", formatoOra(time.Now()))
+}
+
+// SessioniUtente restituisce le sessioni attive dell'utente, dalla piu recente
+func (s *SessionStore) SessioniUtente(userID int64) ([]Session, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, utente_id, ricorda, ip, user_agent, created_at, ultimo_accesso, scadenza
+		FROM sessioni
+		WHERE utente_id = ? AND scadenza >= ?
+		ORDER BY ultimo_accesso DESC
+	`, userID, formatoOra(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessioni []Session
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.Ricorda, &session.IP, &session.UserAgent,
+			&session.CreatedAt, &session.UltimoAccesso, &session.ExpiresAt); err != nil {
+			return nil, err
 		}
+		sessioni = append(sessioni, session)
+	}
+	return sessioni, rows.Err()
+}
+
+// Revoca chiude una sessione dell'utente
+func (s *SessionStore) Revoca(userID, sessionID int64) error {
+	_, err := database.DB.Exec("DELETE FROM sessioni WHERE id = ? AND utente_id = ?", sessionID, userID)
+	return err
+}
+
+// RevocaUtente chiude tutte le sessioni dell'utente e restituisce quante erano aperte
+func (s *SessionStore) RevocaUtente(userID int64) (int64, error) {
+	res, err := database.DB.Exec("DELETE FROM sessioni WHERE utente_id = ?", userID)
+	if err != nil {
+		return 0, err
 	}
+	return res.RowsAffected()
 }
 
 // StartCleanupRoutine avvia la routine di pulizia delle sessioni scadute
@@ -157,6 +281,7 @@ func StartCleanupRoutine() {
 		ticker := time.NewTicker(1 * time.Hour)
 		for range ticker.C {
 			Sessions.CleanExpired()
+			pulisciSicurezza()
 		}
 	}()
 }
@@ -192,13 +317,26 @@ func CreateUser(username, password, nome, cognome, email, telefono string, ruolo
 
 // UpdatePassword aggiorna la password di un utente
 func UpdatePassword(userID int64, newPassword string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := UpdatePasswordIn(tx, userID, newPassword); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdatePasswordIn esegue UpdatePassword nella transazione indicata
+func UpdatePasswordIn(tx *sql.Tx, userID int64, newPassword string) error {
 	hashedPassword, err := HashPassword(newPassword)
 	if err != nil {
 		return err
 	}
 
-	_, err = database.DB.Exec(`
-		UPDATE utenti SET password = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	_, err = tx.Exec(`
+		UPDATE utenti SET password = ?, cambio_password_obbligatorio = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?
 	`, hashedPassword, userID)
 
 	return err
@@ -221,21 +359,6 @@ func GetUserByID(id int64) (*models.Utente, error) {
 	return &user, nil
 }
 
-// IsTecnico verifica se l'utente è un tecnico
-func (s *Session) IsTecnico() bool {
-	return s.Ruolo == models.RuoloTecnico
-}
-
-// IsGuest verifica se l'utente è un guest
-// IsAmministrazione verifica se l utente e della contabilita
-func (s *Session) IsAmministrazione() bool {
-	return s.Ruolo == models.RuoloAmministrazione
-}
-
-func (s *Session) IsGuest() bool {
-	return s.Ruolo == models.RuoloGuest
-}
-
 // NomeCompleto restituisce il nome completo dell'utente
 func (s *Session) NomeCompleto() string {
 	return s.Nome + " " + s.Cognome
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"furviogest/internal/database"
+	"furviogest/internal/models"
+)
+
+// ============================================
+// RUOLI E AUTORIZZAZIONI
+// ============================================
+
+// Autorizzazioni controllate dalle rotte (internal/middleware) e dalle pagine
+const (
+	AutAnagraficheVedi   = "anagrafiche.view"
+	AutAnagraficheScrivi = "anagrafiche.write"
+	AutUtentiVedi        = "utenti.view"
+	AutUtentiGestisci    = "utenti.manage"
+	AutNaviVedi          = "navi.view"
+	AutNaviScrivi        = "navi.write"
+	AutGuastiScrivi      = "guasti.write"
+	AutGuastiElimina     = "guasti.elimina"
+	AutReteVedi          = "rete.view"
+	AutReteScrivi        = "rete.write"
+	AutReteBackup        = "rete.backup"
+	AutReteCredenziali   = "rete.credentials.view"
+	AutMonitoraggio      = "monitoraggio.manage"
+	AutMagazzinoVedi     = "magazzino.view"
+	AutMagazzinoScrivi   = "magazzino.write"
+	AutDDTVedi           = "ddt.view"
+	AutDDTScrivi         = "ddt.write"
+	AutDDTAnnulla        = "ddt.annulla"
+	AutPermessiVedi      = "permessi.view"
+	AutPermessiScrivi    = "permessi.write"
+	AutRapportiVedi      = "rapporti.view"
+	AutRapportiScrivi    = "rapporti.write"
+	AutTrasferte         = "trasferte.use"
+	AutTrasferteGestione = "trasferte.manage"
+	AutAmministrazione   = "amministrazione.view"
+	AutAudit             = "audit.view"
+	AutImpostazioni      = "impostazioni.manage"
+	AutBackup            = "backup.manage"
+)
+
+// Autorizzazione descrive un'autorizzazione assegnabile a un ruolo
+type Autorizzazione struct {
+	Codice      string
+	Descrizione string
+	Gruppo      string
+}
+
+// Catalogo elenca le autorizzazioni disponibili, nell'ordine mostrato nella pagina ruoli
+var Catalogo = []Autorizzazione{
+	{AutAnagraficheVedi, "Consultare fornitori, porti, automezzi, compagnie e clienti", "Anagrafiche"},
+	{AutAnagraficheScrivi, "Creare, modificare ed eliminare anagrafiche", "Anagrafiche"},
+	{AutUtentiVedi, "Consultare l'elenco dei tecnici", "Utenti"},
+	{AutUtentiGestisci, "Gestire utenti, ruoli e blocchi di accesso", "Utenti"},
+	{AutNaviVedi, "Consultare navi, orari, storico interventi e guasti", "Navi"},
+	{AutNaviScrivi, "Modificare navi, disegni, server, orari e soste", "Navi"},
+	{AutGuastiScrivi, "Segnalare e aggiornare guasti", "Navi"},
+	{AutGuastiElimina, "Eliminare guasti", "Navi"},
+	{AutReteVedi, "Consultare la rete di navi, uffici e sale server ed eseguire scansioni", "Rete"},
+	{AutReteScrivi, "Modificare apparati di rete, SNMP e piantine", "Rete"},
+	{AutReteBackup, "Eseguire e ripristinare i backup delle configurazioni", "Rete"},
+	{AutReteCredenziali, "Scaricare le configurazioni degli apparati (contengono credenziali)", "Rete"},
+	{AutMonitoraggio, "Configurare pianificazione, regole guasti e notifiche", "Rete"},
+	{AutMagazzinoVedi, "Consultare magazzino, movimenti e attrezzi", "Magazzino"},
+	{AutMagazzinoScrivi, "Modificare prodotti, movimenti e attrezzi", "Magazzino"},
+	{AutDDTVedi, "Consultare DDT, fatture e archivio PDF", "DDT"},
+	{AutDDTScrivi, "Creare, modificare ed eliminare DDT, fatture e PDF", "DDT"},
+	{AutDDTAnnulla, "Annullare DDT in uscita", "DDT"},
+	{AutPermessiVedi, "Consultare i permessi di accesso a bordo", "Permessi"},
+	{AutPermessiScrivi, "Gestire e inviare i permessi di accesso a bordo", "Permessi"},
+	{AutRapportiVedi, "Consultare i rapporti di intervento", "Rapporti"},
+	{AutRapportiScrivi, "Creare, modificare ed eliminare rapporti", "Rapporti"},
+	{AutTrasferte, "Registrare le proprie trasferte e note spese", "Trasferte"},
+	{AutTrasferteGestione, "Gestire trasferte e note spese di tutti i tecnici", "Trasferte"},
+	{AutAmministrazione, "Accedere all'area amministrazione e ai report", "Amministrazione"},
+	{AutAudit, "Consultare ed esportare il registro delle modifiche", "Amministrazione"},
+	{AutImpostazioni, "Modificare le impostazioni aziendali", "Sistema"},
+	{AutBackup, "Gestire backup e ripristino del database", "Sistema"},
+}
+
+// autorizzazioniConsultazione sono quelle che prima erano concesse a ogni utente autenticato
+var autorizzazioniConsultazione = []string{
+	AutAnagraficheVedi, AutUtentiVedi, AutNaviVedi, AutGuastiScrivi, AutReteVedi,
+	AutMagazzinoVedi, AutDDTVedi, AutPermessiVedi, AutRapportiVedi, AutTrasferte,
+}
+
+// ruoliSistema sono i ruoli creati all'avvio. Il tecnico ha sempre tutte le autorizzazioni.
+var ruoliSistema = []struct {
+	codice         models.Ruolo
+	nome           string
+	descrizione    string
+	autorizzazioni []string
+}{
+	{models.RuoloTecnico, "Tecnico", "Accesso completo", nil},
+	{models.RuoloAmministrazione, "Amministrazione", "Contabilita e report", append([]string{AutAmministrazione, AutAudit}, autorizzazioniConsultazione...)},
+	{models.RuoloGuest, "Guest", "Solo visualizzazione", autorizzazioniConsultazione},
+}
+
+var (
+	ErrRuoloSistema  = errors.New("i ruoli di sistema non si possono eliminare")
+	ErrRuoloInUso    = errors.New("il ruolo e assegnato ad almeno un utente")
+	ErrRuoloCompleto = errors.New("le autorizzazioni del ruolo tecnico non sono modificabili")
+)
+
+// RuoloUtente e un ruolo con le sue autorizzazioni
+type RuoloUtente struct {
+	ID             int64
+	Codice         string
+	Nome           string
+	Descrizione    string
+	Sistema        bool
+	Autorizzazioni map[string]bool
+	Utenti         int
+}
+
+// Completo indica il ruolo tecnico, che ha sempre tutte le autorizzazioni
+func (r *RuoloUtente) Completo() bool {
+	return r.Codice == string(models.RuoloTecnico)
+}
+
+// InizializzaRuoli crea i ruoli di sistema mancanti e assegna un ruolo agli utenti che ne
+// sono privi, in base alla vecchia colonna utenti.ruolo
+func InizializzaRuoli() error {
+	for _, rs := range ruoliSistema {
+		res, err := database.DB.Exec("INSERT OR IGNORE INTO ruoli (codice, nome, descrizione, sistema) VALUES (?, ?, ?, 1)",
+			string(rs.codice), rs.nome, rs.descrizione)
+		if err != nil {
+			return err
+		}
+		// Le autorizzazioni predefinite si scrivono solo alla creazione: poi sono modificabili
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		ruoloID, _ := res.LastInsertId()
+		for _, a := range rs.autorizzazioni {
+			if _, err := database.DB.Exec("INSERT INTO ruoli_autorizzazioni (ruolo_id, autorizzazione) VALUES (?, ?)", ruoloID, a); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := database.DB.Exec(`
+		UPDATE utenti SET ruolo_id = COALESCE(
+			(SELECT id FROM ruoli WHERE codice = utenti.ruolo),
+			(SELECT id FROM ruoli WHERE codice = 'guest'))
+		WHERE ruolo_id IS NULL
+	`)
+	return err
+}
+
+// caricaAutorizzazioni restituisce le autorizzazioni del ruolo
+func caricaAutorizzazioni(ruoloID int64, codice string) map[string]bool {
+	autorizzazioni := make(map[string]bool)
+	if codice == string(models.RuoloTecnico) {
+		for _, a := range Catalogo {
+			autorizzazioni[a.Codice] = true
+		}
+		return autorizzazioni
+	}
+	rows, err := database.DB.Query("SELECT autorizzazione FROM ruoli_autorizzazioni WHERE ruolo_id = ?", ruoloID)
+	if err != nil {
+		return autorizzazioni
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a string
+		if rows.Scan(&a) == nil {
+			autorizzazioni[a] = true
+		}
+	}
+	return autorizzazioni
+}
+
+// Puo indica se la sessione ha l'autorizzazione indicata
+func (s *Session) Puo(autorizzazione string) bool {
+	return s != nil && s.autorizzazioni[autorizzazione]
+}
+
+// VedeCompagnia indica se l'utente puo vedere le navi della compagnia: gli utenti
+// associati a una compagnia vedono solo quella
+func (s *Session) VedeCompagnia(compagniaID int64) bool {
+	return s.CompagniaID == 0 || s.CompagniaID == compagniaID
+}
+
+// ElencoRuoli restituisce i ruoli con il numero di utenti assegnati
+func ElencoRuoli() ([]RuoloUtente, error) {
+	rows, err := database.DB.Query(`
+		SELECT r.id, r.codice, r.nome, r.descrizione, r.sistema,
+			(SELECT COUNT(*) FROM utenti u WHERE u.ruolo_id = r.id)
+		FROM ruoli r ORDER BY r.sistema DESC, r.nome
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ruoli []RuoloUtente
+	for rows.Next() {
+		var r RuoloUtente
+		if err := rows.Scan(&r.ID, &r.Codice, &r.Nome, &r.Descrizione, &r.Sistema, &r.Utenti); err != nil {
+			return nil, err
+		}
+		ruoli = append(ruoli, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range ruoli {
+		ruoli[i].Autorizzazioni = caricaAutorizzazioni(ruoli[i].ID, ruoli[i].Codice)
+	}
+	return ruoli, nil
+}
+
+// LeggiRuolo restituisce il ruolo con le sue autorizzazioni
+func LeggiRuolo(id int64) (*RuoloUtente, error) {
+	var r RuoloUtente
+	err := database.DB.QueryRow(`
+		SELECT id, codice, nome, descrizione, sistema, (SELECT COUNT(*) FROM utenti WHERE ruolo_id = ruoli.id)
+		FROM ruoli WHERE id = ?
+	`, id).Scan(&r.ID, &r.Codice, &r.Nome, &r.Descrizione, &r.Sistema, &r.Utenti)
+	if err != nil {
+		return nil, err
+	}
+	r.Autorizzazioni = caricaAutorizzazioni(r.ID, r.Codice)
+	return &r, nil
+}
+
+// SalvaRuolo crea (id = 0) o aggiorna un ruolo nella transazione e ne sostituisce le autorizzazioni.
+// Il codice dei ruoli esistenti non cambia: e il riferimento stabile per quelli di sistema.
+func SalvaRuolo(tx *sql.Tx, id int64, codice, nome, descrizione string, autorizzazioni []string) (int64, error) {
+	validi := make(map[string]bool)
+	for _, a := range Catalogo {
+		validi[a.Codice] = true
+	}
+
+	if id == 0 {
+		codice = strings.ToLower(strings.TrimSpace(codice))
+		if codice == "" {
+			return 0, errors.New("codice obbligatorio")
+		}
+		res, err := tx.Exec("INSERT INTO ruoli (codice, nome, descrizione) VALUES (?, ?, ?)", codice, nome, descrizione)
+		if err != nil {
+			return 0, err
+		}
+		id, _ = res.LastInsertId()
+	} else {
+		var esistente string
+		if err := tx.QueryRow("SELECT codice FROM ruoli WHERE id = ?", id).Scan(&esistente); err != nil {
+			return 0, err
+		}
+		if esistente == string(models.RuoloTecnico) {
+			return 0, ErrRuoloCompleto
+		}
+		if _, err := tx.Exec("UPDATE ruoli SET nome = ?, descrizione = ? WHERE id = ?", nome, descrizione, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM ruoli_autorizzazioni WHERE ruolo_id = ?", id); err != nil {
+		return 0, err
+	}
+	for _, a := range autorizzazioni {
+		if !validi[a] {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO ruoli_autorizzazioni (ruolo_id, autorizzazione) VALUES (?, ?)", id, a); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// EliminaRuolo elimina un ruolo non di sistema e non assegnato
+func EliminaRuolo(tx *sql.Tx, id int64) error {
+	r, err := LeggiRuolo(id)
+	if err != nil {
+		return err
+	}
+	if r.Sistema {
+		return ErrRuoloSistema
+	}
+	if r.Utenti > 0 {
+		return ErrRuoloInUso
+	}
+	_, err = tx.Exec("DELETE FROM ruoli WHERE id = ?", id)
+	return err
+}
+
+// CodiceRuolo restituisce il valore da salvare nella colonna utenti.ruolo, che per
+// vincolo accetta solo tecnico e guest
+func CodiceRuolo(ruoloID int64) models.Ruolo {
+	var codice string
+	database.DB.QueryRow("SELECT codice FROM ruoli WHERE id = ?", ruoloID).Scan(&codice)
+	if codice == string(models.RuoloTecnico) {
+		return models.RuoloTecnico
+	}
+	return models.RuoloGuest
+}
+
+// EmailConAutorizzazione restituisce l'email degli utenti attivi il cui ruolo ha
+// l'autorizzazione indicata (il ruolo tecnico le ha tutte)
+func EmailConAutorizzazione(autorizzazione string) ([]string, error) {
+	rows, err := database.DB.Query(`
+		SELECT TRIM(u.email) FROM utenti u
+		JOIN ruoli r ON r.id = u.ruolo_id
+		WHERE u.attivo = 1 AND TRIM(COALESCE(u.email, '')) != ''
+		  AND (r.codice = ? OR EXISTS (
+			SELECT 1 FROM ruoli_autorizzazioni a WHERE a.ruolo_id = r.id AND a.autorizzazione = ?))
+		ORDER BY u.cognome, u.nome
+	`, string(models.RuoloTecnico), autorizzazione)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var email []string
+	for rows.Next() {
+		var e string
+		if rows.Scan(&e) == nil {
+			email = append(email, e)
+		}
+	}
+	return email, rows.Err()
+}
+
+// CompagniaNave restituisce la compagnia della nave, 0 se non esiste
+func CompagniaNave(naveID int64) int64 {
+	var compagniaID int64
+	database.DB.QueryRow("SELECT COALESCE(compagnia_id, 0) FROM navi WHERE id = ?", naveID).Scan(&compagniaID)
+	return compagniaID
+}
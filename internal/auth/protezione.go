@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/models"
+)
+
+// ============================================
+// PROTEZIONE ACCESSI E REGISTRO DI SICUREZZA
+// ============================================
+
+// Eventi del registro di sicurezza
+const (
+	EventoAccesso               = "accesso"
+	EventoAccessoFallito        = "accesso_fallito"
+	EventoAccessoBloccato       = "accesso_bloccato"
+	EventoSecondoFattoreFallito = "secondo_fattore_fallito"
+	EventoSblocco               = "sblocco"
+	EventoCambioPassword        = "cambio_password"
+)
+
+// Tipi di contatore dei tentativi falliti
+const (
+	BloccoUtente = "utente"
+	BloccoIP     = "ip"
+)
+
+// finestraFallimenti e il tempo dopo cui un contatore senza nuovi errori riparte da zero
+const finestraFallimenti = 24 * time.Hour
+
+// conservazioneLog e per quanto restano gli eventi nel registro di sicurezza
+const conservazioneLog = 365 * 24 * time.Hour
+
+// PasswordPredefinita e la password con cui viene creato l'utente admin
+const PasswordPredefinita = "admin"
+
+// ErrAccessoBloccato indica troppi tentativi falliti per l'utente o l'indirizzo
+var ErrAccessoBloccato = errors.New("troppi tentativi falliti, riprovare piu tardi")
+
+// politicaBlocco definisce l'attesa dopo i tentativi falliti: i primi sono liberi,
+// poi l'attesa raddoppia a ogni errore fino al massimo
+type politicaBlocco struct {
+	tentativiLiberi int
+	attesaBase      time.Duration
+	attesaMassima   time.Duration
+}
+
+// Per indirizzo la soglia e piu alta: a bordo molti utenti escono dallo stesso IP
+var politiche = map[string]politicaBlocco{
+	BloccoUtente: {tentativiLiberi: 3, attesaBase: 15 * time.Second, attesaMassima: 30 * time.Minute},
+	BloccoIP:     {tentativiLiberi: 10, attesaBase: 15 * time.Second, attesaMassima: time.Hour},
+}
+
+// attesa restituisce il blocco dopo il numero di fallimenti indicato
+func (p politicaBlocco) attesa(fallimenti int) time.Duration {
+	oltre := fallimenti - p.tentativiLiberi
+	if oltre <= 0 {
+		return 0
+	}
+	attesa := p.attesaBase
+	for i := 1; i < oltre && attesa < p.attesaMassima; i++ {
+		attesa *= 2
+	}
+	if attesa > p.attesaMassima {
+		attesa = p.attesaMassima
+	}
+	return attesa
+}
+
+// BloccoAccesso e un contatore di tentativi falliti
+type BloccoAccesso struct {
+	Tipo             string
+	Valore           string
+	Fallimenti       int
+	UltimoFallimento time.Time
+	BloccatoFino     time.Time
+	Bloccato         bool
+}
+
+// EventoSicurezza e una riga del registro di sicurezza
+type EventoSicurezza struct {
+	ID        int64
+	Evento    string
+	Username  string
+	IP        string
+	UserAgent string
+	Dettagli  string
+	CreatedAt time.Time
+}
+
+// AttesaAccesso restituisce quanto manca prima che username e indirizzo possano riprovare
+func AttesaAccesso(username, ip string) time.Duration {
+	var fino string
+	database.DB.QueryRow(`
+		SELECT COALESCE(MAX(bloccato_fino), '') FROM blocchi_accesso
+		WHERE (tipo = ? AND valore = ?) OR (tipo = ? AND valore = ?)
+	`, BloccoUtente, username, BloccoIP, ip).Scan(&fino)
+	if fino == "" {
+		return 0
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", fino)
+	if err != nil {
+		return 0
+	}
+	return time.Until(t)
+}
+
+// registraFallimento incrementa i contatori di username e indirizzo e calcola il blocco
+func registraFallimento(username, ip string) {
+	ora := time.Now()
+	for tipo, valore := range map[string]string{BloccoUtente: username, BloccoIP: ip} {
+		if valore == "" {
+			continue
+		}
+		var fallimenti int
+		var ultimo time.Time
+		err := database.DB.QueryRow("SELECT fallimenti, ultimo_fallimento FROM blocchi_accesso WHERE tipo = ? AND valore = ?", tipo, valore).Scan(&fallimenti, &ultimo)
+		if err == nil && ora.Sub(ultimo) > finestraFallimenti {
+			fallimenti = 0
+		}
+		fallimenti++
+
+		var fino interface{}
+		if attesa := politiche[tipo].attesa(fallimenti); attesa > 0 {
+			fino = formatoOra(ora.Add(attesa))
+		}
+		_, err = database.DB.Exec(`
+			INSERT INTO blocchi_accesso (tipo, valore, fallimenti, ultimo_fallimento, bloccato_fino)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(tipo, valore) DO UPDATE SET
+				fallimenti = excluded.fallimenti,
+				ultimo_fallimento = excluded.ultimo_fallimento,
+				bloccato_fino = excluded.bloccato_fino
+		`, tipo, valore, fallimenti, formatoOra(ora), fino)
+		if err != nil {
+			log.Printf("[Sicurezza] Errore registrazione tentativo %s %s: %v", tipo, valore, err)
+		}
+	}
+}
+
+// azzeraFallimenti rimuove il contatore dell'utente dopo un accesso riuscito.
+// Quello dell'indirizzo resta: un account valido non deve sbloccare un IP che prova password.
+func azzeraFallimenti(username string) {
+	database.DB.Exec("DELETE FROM blocchi_accesso WHERE tipo = ? AND valore = ?", BloccoUtente, username)
+}
+
+// Accedi verifica le credenziali applicando il blocco dopo troppi tentativi falliti e
+// registra l'esito. Con il secondo fattore attivo l'accesso si completa con CompletaSecondoFattore.
+func Accedi(username, password, ip, userAgent string) (*models.Utente, error) {
+	if AttesaAccesso(username, ip) > 0 {
+		RegistraEvento(EventoAccessoBloccato, username, 0, ip, userAgent, "")
+		return nil, ErrAccessoBloccato
+	}
+
+	user, err := VerificaCredenziali(username, password)
+	if err != nil {
+		registraFallimento(username, ip)
+		RegistraEvento(EventoAccessoFallito, username, 0, ip, userAgent, err.Error())
+		return nil, err
+	}
+
+	if !user.TOTPAttivo {
+		azzeraFallimenti(username)
+		RegistraEvento(EventoAccesso, username, user.ID, ip, userAgent, "")
+	}
+	return user, nil
+}
+
+// VerificaPasswordAttuale controlla la password di chi e gia collegato (cambio password)
+// con lo stesso blocco di Accedi: gli errori contano per utente e indirizzo e, una volta
+// bloccato, la sessione usata per i tentativi viene chiusa.
+func VerificaPasswordAttuale(session *Session, password, ip, userAgent string) error {
+	if AttesaAccesso(session.Username, ip) > 0 {
+		RegistraEvento(EventoAccessoBloccato, session.Username, session.UserID, ip, userAgent, "cambio password")
+		Sessions.Revoca(session.UserID, session.ID)
+		return ErrAccessoBloccato
+	}
+
+	if _, err := VerificaCredenziali(session.Username, password); err != nil {
+		registraFallimento(session.Username, ip)
+		RegistraEvento(EventoAccessoFallito, session.Username, session.UserID, ip, userAgent, "cambio password")
+		if AttesaAccesso(session.Username, ip) > 0 {
+			Sessions.Revoca(session.UserID, session.ID)
+			return ErrAccessoBloccato
+		}
+		return err
+	}
+
+	azzeraFallimenti(session.Username)
+	return nil
+}
+
+// SbloccaAccesso azzera il contatore dei tentativi falliti di un utente o di un indirizzo
+func SbloccaAccesso(tipo, valore, eseguitoDa, ip, userAgent string) error {
+	_, err := database.DB.Exec("DELETE FROM blocchi_accesso WHERE tipo = ? AND valore = ?", tipo, valore)
+	if err == nil {
+		RegistraEvento(EventoSblocco, eseguitoDa, 0, ip, userAgent, tipo+" "+valore)
+	}
+	return err
+}
+
+// BlocchiAccesso restituisce i contatori attivi, prima quelli bloccati
+func BlocchiAccesso() ([]BloccoAccesso, error) {
+	ora := formatoOra(time.Now())
+	rows, err := database.DB.Query(`
+		SELECT tipo, valore, fallimenti, ultimo_fallimento, COALESCE(bloccato_fino, ''), COALESCE(bloccato_fino > ?, 0)
+		FROM blocchi_accesso
+		WHERE ultimo_fallimento >= ?
+		ORDER BY 6 DESC, ultimo_fallimento DESC
+	`, ora, formatoOra(time.Now().Add(-finestraFallimenti)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocchi []BloccoAccesso
+	for rows.Next() {
+		var b BloccoAccesso
+		var fino string
+		if err := rows.Scan(&b.Tipo, &b.Valore, &b.Fallimenti, &b.UltimoFallimento, &fino, &b.Bloccato); err != nil {
+			return nil, err
+		}
+		if fino != "" {
+			b.BloccatoFino, _ = time.Parse("2006-01-02 15:04:05", fino)
+		}
+		blocchi = append(blocchi, b)
+	}
+	return blocchi, rows.Err()
+}
+
+// RegistraEvento scrive un evento nel registro di sicurezza
+func RegistraEvento(evento, username string, utenteID int64, ip, userAgent, dettagli string) {
+	var id interface{}
+	if utenteID > 0 {
+		id = utenteID
+	}
+	_, err := database.DB.Exec(`
+		INSERT INTO log_sicurezza (evento, username, utente_id, ip, user_agent, dettagli, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, evento, username, id, ip, userAgent, dettagli, formatoOra(time.Now()))
+	if err != nil {
+		log.Printf("[Sicurezza] Errore registro eventi: %v", err)
+	}
+}
+
+// EventiSicurezza restituisce gli ultimi eventi del registro, filtrati per username se indicato
+func EventiSicurezza(username string, limite int) ([]EventoSicurezza, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, evento, username, ip, user_agent, dettagli, created_at
+		FROM log_sicurezza
+		WHERE ? = '' OR username = ?
+		ORDER BY id DESC LIMIT ?
+	`, username, username, limite)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var eventi []EventoSicurezza
+	for rows.Next() {
+		var e EventoSicurezza
+		if err := rows.Scan(&e.ID, &e.Evento, &e.Username, &e.IP, &e.UserAgent, &e.Dettagli, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		eventi = append(eventi, e)
+	}
+	return eventi, rows.Err()
+}
+
+// pulisciSicurezza rimuove i contatori scaduti e gli eventi piu vecchi della conservazione
+func pulisciSicurezza() {
+	ora := time.Now()
+	database.DB.Exec("DELETE FROM blocchi_accesso WHERE ultimo_fallimento < ? AND COALESCE(bloccato_fino, '') < ?",
+		formatoOra(ora.Add(-finestraFallimenti)), formatoOra(ora))
+	database.DB.Exec("DELETE FROM log_sicurezza WHERE created_at < ?", formatoOra(ora.Add(-conservazioneLog)))
+}
+
+// ImponiCambioPasswordPredefinita obbliga al cambio password l'utente admin se usa
+// ancora la password predefinita. Restituisce true se l'obbligo e attivo.
+func ImponiCambioPasswordPredefinita() bool {
+	user, err := VerificaCredenziali("admin", PasswordPredefinita)
+	if err != nil {
+		return false
+	}
+	if _, err := database.DB.Exec("UPDATE utenti SET cambio_password_obbligatorio = 1 WHERE id = ?", user.ID); err != nil {
+		log.Printf("[Sicurezza] Errore impostazione cambio password: %v", err)
+	}
+	return true
+}
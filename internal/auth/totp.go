@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/models"
+	"furviogest/internal/segreti"
+)
+
+// ============================================
+// AUTENTICAZIONE A DUE FATTORI (TOTP, RFC 6238)
+// ============================================
+
+const (
+	cifreTOTP            = 6
+	passoTOTP            = 30 // secondi
+	finestraTOTP         = 1  // passi di tolleranza per l'orologio del telefono
+	EmittenteTOTP        = "FurvioGest"
+	numeroCodiciRecupero = 10
+	durataAttesa         = 5 * time.Minute // tempo per inserire il codice dopo la password
+	tentativiMassimi     = 5
+)
+
+var (
+	ErrCodiceNonValido = errors.New("codice non valido")
+	ErrTOTPNonAttivo   = errors.New("autenticazione a due fattori non attiva")
+	ErrAttesaScaduta   = errors.New("verifica scaduta, ripetere l'accesso")
+)
+
+var codificaBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// StatoTOTP descrive la configurazione a due fattori di un utente
+type StatoTOTP struct {
+	Attivo        bool
+	Obbligatorio  bool // imposto al ruolo dell'utente dalle impostazioni
+	CodiciRimasti int
+}
+
+// GeneraSegretoTOTP restituisce un nuovo segreto di 160 bit in base32
+func GeneraSegretoTOTP() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return codificaBase32.EncodeToString(b), nil
+}
+
+// codiceTOTP calcola il codice HOTP del passo indicato
+func codiceTOTP(segreto []byte, passo int64) string {
+	var contatore [8]byte
+	binary.BigEndian.PutUint64(contatore[:], uint64(passo))
+	mac := hmac.New(sha1.New, segreto)
+	mac.Write(contatore[:])
+	h := mac.Sum(nil)
+	offset := h[len(h)-1] & 0x0f
+	valore := binary.BigEndian.Uint32(h[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", cifreTOTP, valore%1000000)
+}
+
+// verificaCodiceTOTP controlla il codice nella finestra di tolleranza e restituisce
+// il passo corrispondente; un passo gia usato non e piu valido
+func verificaCodiceTOTP(segreto, codice string, ultimoPasso int64, ora time.Time) (int64, bool) {
+	chiave, err := codificaBase32.DecodeString(strings.ToUpper(segreto))
+	if err != nil || len(codice) != cifreTOTP {
+		return 0, false
+	}
+	corrente := ora.Unix() / passoTOTP
+	for passo := corrente - finestraTOTP; passo <= corrente+finestraTOTP; passo++ {
+		if passo <= ultimoPasso {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(codiceTOTP(chiave, passo)), []byte(codice)) == 1 {
+			return passo, true
+		}
+	}
+	return 0, false
+}
+
+// URIProvisioningTOTP restituisce l'URI otpauth:// da mostrare come codice QR
+func URIProvisioningTOTP(account, segreto string) string {
+	etichetta := url.PathEscape(EmittenteTOTP + ":" + account)
+	parametri := url.Values{}
+	parametri.Set("secret", segreto)
+	parametri.Set("issuer", EmittenteTOTP)
+	parametri.Set("algorithm", "SHA1")
+	parametri.Set("digits", fmt.Sprint(cifreTOTP))
+	parametri.Set("period", fmt.Sprint(passoTOTP))
+	return "otpauth://totp/" + etichetta + "?" + parametri.Encode()
+}
+
+// normalizzaCodice toglie spazi e trattini dal codice inserito
+func normalizzaCodice(codice string) string {
+	codice = strings.ToLower(strings.TrimSpace(codice))
+	return strings.NewReplacer(" ", "", "-", "").Replace(codice)
+}
+
+// autorizzazioniSecondoFattore sono le autorizzazioni a cui l'impostazione impone il
+// secondo fattore: modificano la rete o danno accesso alle credenziali degli apparati,
+// agli utenti e al sistema. Il ruolo tecnico le ha tutte.
+var autorizzazioniSecondoFattore = []string{
+	AutReteScrivi, AutReteBackup, AutReteCredenziali, AutMonitoraggio,
+	AutUtentiGestisci, AutImpostazioni, AutBackup,
+}
+
+// richiedeSecondoFattore indica se il ruolo dell'utente ricade nel secondo fattore obbligatorio
+func (s *Session) richiedeSecondoFattore() bool {
+	for _, a := range autorizzazioniSecondoFattore {
+		if s.Puo(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPObbligatorio indica se le impostazioni impongono il secondo fattore all'utente
+func TOTPObbligatorio(s *Session) bool {
+	if !s.richiedeSecondoFattore() {
+		return false
+	}
+	var obbligatorio bool
+	database.DB.QueryRow("SELECT COALESCE(totp_obbligatorio_tecnici, 0) FROM impostazioni_azienda WHERE id = 1").Scan(&obbligatorio)
+	return obbligatorio
+}
+
+// LeggiStatoTOTP restituisce lo stato a due fattori dell'utente
+func LeggiStatoTOTP(s *Session) (*StatoTOTP, error) {
+	stato := &StatoTOTP{Obbligatorio: TOTPObbligatorio(s)}
+	err := database.DB.QueryRow(`
+		SELECT u.totp_attivo, (SELECT COUNT(*) FROM codici_recupero c WHERE c.utente_id = u.id AND c.usato_at IS NULL)
+		FROM utenti u WHERE u.id = ?
+	`, s.UserID).Scan(&stato.Attivo, &stato.CodiciRimasti)
+	return stato, err
+}
+
+// PreparaTOTP restituisce il segreto da registrare nell'app di autenticazione.
+// Fino alla conferma resta in attesa: ricaricando la pagina si ottiene lo stesso.
+func PreparaTOTP(userID int64) (string, error) {
+	var cifrato string
+	var attivo bool
+	if err := database.DB.QueryRow("SELECT totp_segreto, totp_attivo FROM utenti WHERE id = ?", userID).Scan(&cifrato, &attivo); err != nil {
+		return "", err
+	}
+	if attivo {
+		return "", errors.New("autenticazione a due fattori gia attiva")
+	}
+	if cifrato != "" {
+		if segreto, err := segreti.Decifra(cifrato); err == nil {
+			return segreto, nil
+		}
+	}
+
+	segreto, err := GeneraSegretoTOTP()
+	if err != nil {
+		return "", err
+	}
+	if cifrato, err = segreti.Cifra(segreto); err != nil {
+		return "", err
+	}
+	_, err = database.DB.Exec("UPDATE utenti SET totp_segreto = ?, totp_ultimo_passo = 0 WHERE id = ?", cifrato, userID)
+	return segreto, err
+}
+
+// AttivaTOTP conferma la registrazione con un codice dell'app e restituisce i codici di recupero
+func AttivaTOTP(userID int64, codice string) ([]string, error) {
+	var cifrato string
+	if err := database.DB.QueryRow("SELECT totp_segreto FROM utenti WHERE id = ? AND totp_attivo = 0", userID).Scan(&cifrato); err != nil || cifrato == "" {
+		return nil, ErrTOTPNonAttivo
+	}
+	segreto, err := segreti.Decifra(cifrato)
+	if err != nil {
+		return nil, err
+	}
+	passo, ok := verificaCodiceTOTP(segreto, normalizzaCodice(codice), 0, time.Now())
+	if !ok {
+		return nil, ErrCodiceNonValido
+	}
+	if _, err := database.DB.Exec("UPDATE utenti SET totp_attivo = 1, totp_ultimo_passo = ? WHERE id = ?", passo, userID); err != nil {
+		return nil, err
+	}
+	return RigeneraCodiciRecupero(userID)
+}
+
+// DisattivaTOTP rimuove segreto e codici di recupero dell'utente
+func DisattivaTOTP(userID int64) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := DisattivaTOTPIn(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisattivaTOTPIn esegue DisattivaTOTP nella transazione indicata
+func DisattivaTOTPIn(tx *sql.Tx, userID int64) error {
+	if _, err := tx.Exec("UPDATE utenti SET totp_segreto = '', totp_attivo = 0, totp_ultimo_passo = 0 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM codici_recupero WHERE utente_id = ?", userID)
+	return err
+}
+
+// RigeneraCodiciRecupero sostituisce i codici di recupero: quelli precedenti non valgono piu
+func RigeneraCodiciRecupero(userID int64) ([]string, error) {
+	codici := make([]string, numeroCodiciRecupero)
+	for i := range codici {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(codificaBase32.EncodeToString(b)) // 10 caratteri
+		codici[i] = c[:5] + "-" + c[5:]
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM codici_recupero WHERE utente_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, c := range codici {
+		if _, err := tx.Exec("INSERT INTO codici_recupero (utente_id, codice_hash) VALUES (?, ?)", userID, hashToken(normalizzaCodice(c))); err != nil {
+			return nil, err
+		}
+	}
+	return codici, tx.Commit()
+}
+
+// VerificaSecondoFattore accetta un codice dell'app o un codice di recupero non ancora usato
+func VerificaSecondoFattore(userID int64, codice string) error {
+	codice = normalizzaCodice(codice)
+
+	var cifrato string
+	var attivo bool
+	var ultimoPasso int64
+	err := database.DB.QueryRow("SELECT totp_segreto, totp_attivo, totp_ultimo_passo FROM utenti WHERE id = ?", userID).
+		Scan(&cifrato, &attivo, &ultimoPasso)
+	if err != nil || !attivo {
+		return ErrTOTPNonAttivo
+	}
+
+	if len(codice) == cifreTOTP {
+		segreto, err := segreti.Decifra(cifrato)
+		if err != nil {
+			return err
+		}
+		passo, ok := verificaCodiceTOTP(segreto, codice, ultimoPasso, time.Now())
+		if !ok {
+			return ErrCodiceNonValido
+		}
+		// La condizione sul passo evita che due richieste usino lo stesso codice
+		res, err := database.DB.Exec("UPDATE utenti SET totp_ultimo_passo = ? WHERE id = ? AND totp_ultimo_passo < ?", passo, userID, passo)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrCodiceNonValido
+		}
+		return nil
+	}
+
+	res, err := database.DB.Exec(`
+		UPDATE codici_recupero SET usato_at = CURRENT_TIMESTAMP
+		WHERE id = (SELECT id FROM codici_recupero WHERE utente_id = ? AND codice_hash = ? AND usato_at IS NULL LIMIT 1)
+	`, userID, hashToken(codice))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCodiceNonValido
+	}
+	return nil
+}
+
+// attesaSecondoFattore e un accesso con password corretta in attesa del codice
+type attesaSecondoFattore struct {
+	utente    models.Utente
+	ricorda   bool
+	scadenza  time.Time
+	tentativi int
+}
+
+var attese = struct {
+	sync.Mutex
+	m map[string]*attesaSecondoFattore
+}{m: make(map[string]*attesaSecondoFattore)}
+
+// AvviaSecondoFattore registra l'accesso in attesa del codice e restituisce il token
+// da presentare con il codice. Le attese restano in memoria: durano pochi minuti.
+func AvviaSecondoFattore(user *models.Utente, ricorda bool) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	attese.Lock()
+	defer attese.Unlock()
+	ora := time.Now()
+	for t, a := range attese.m {
+		if ora.After(a.scadenza) {
+			delete(attese.m, t)
+		}
+	}
+	attese.m[token] = &attesaSecondoFattore{utente: *user, ricorda: ricorda, scadenza: ora.Add(durataAttesa)}
+	return token, nil
+}
+
+// CompletaSecondoFattore verifica il codice dell'accesso in attesa e crea la sessione.
+// Dopo troppi tentativi errati l'attesa viene annullata.
+func CompletaSecondoFattore(token, codice, ip, userAgent string) (*Session, error) {
+	attese.Lock()
+	a, ok := attese.m[token]
+	if !ok || time.Now().After(a.scadenza) {
+		delete(attese.m, token)
+		attese.Unlock()
+		return nil, ErrAttesaScaduta
+	}
+	a.tentativi++
+	if a.tentativi > tentativiMassimi {
+		delete(attese.m, token)
+		attese.Unlock()
+		return nil, ErrAttesaScaduta
+	}
+	utente, ricorda := a.utente, a.ricorda
+	attese.Unlock()
+
+	// Gli errori sul codice contano per il blocco come le password sbagliate
+	if AttesaAccesso(utente.Username, ip) > 0 {
+		RegistraEvento(EventoAccessoBloccato, utente.Username, utente.ID, ip, userAgent, "secondo fattore")
+		return nil, ErrAccessoBloccato
+	}
+	if err := VerificaSecondoFattore(utente.ID, codice); err != nil {
+		registraFallimento(utente.Username, ip)
+		RegistraEvento(EventoSecondoFattoreFallito, utente.Username, utente.ID, ip, userAgent, "")
+		return nil, err
+	}
+
+	attese.Lock()
+	delete(attese.m, token)
+	attese.Unlock()
+	azzeraFallimenti(utente.Username)
+	RegistraEvento(EventoAccesso, utente.Username, utente.ID, ip, userAgent, "con secondo fattore")
+	return NuovaSessione(&utente, ricorda, ip, userAgent)
+}
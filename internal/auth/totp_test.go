@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// segretoRFC e la chiave dei vettori di RFC 6238 Appendice B (SHA1) in base32
+var segretoRFC = codificaBase32.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodiceTOTPVettoriRFC6238(t *testing.T) {
+	// L'appendice B riporta codici a 8 cifre: il codice a 6 cifre sono le ultime 6
+	casi := []struct {
+		secondi int64
+		codice  string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, c := range casi {
+		if got := codiceTOTP([]byte("12345678901234567890"), c.secondi/passoTOTP); got != c.codice {
+			t.Errorf("codiceTOTP(T=%d) = %s, atteso %s", c.secondi, got, c.codice)
+		}
+		passo, ok := verificaCodiceTOTP(segretoRFC, c.codice, 0, time.Unix(c.secondi, 0))
+		if !ok || passo != c.secondi/passoTOTP {
+			t.Errorf("verificaCodiceTOTP(T=%d) = %d, %v", c.secondi, passo, ok)
+		}
+	}
+}
+
+func TestVerificaCodiceTOTPFinestraERiuso(t *testing.T) {
+	ora := time.Unix(1111111111, 0)
+	corrente := ora.Unix() / passoTOTP
+	chiave := []byte("12345678901234567890")
+
+	casi := []struct {
+		nome        string
+		codice      string
+		ultimoPasso int64
+		passo       int64
+		valido      bool
+	}{
+		{"passo corrente", codiceTOTP(chiave, corrente), 0, corrente, true},
+		{"passo precedente nella tolleranza", codiceTOTP(chiave, corrente-1), 0, corrente - 1, true},
+		{"passo successivo nella tolleranza", codiceTOTP(chiave, corrente+1), 0, corrente + 1, true},
+		{"oltre la tolleranza", codiceTOTP(chiave, corrente-2), 0, 0, false},
+		{"codice gia usato", codiceTOTP(chiave, corrente), corrente, 0, false},
+		{"passo precedente a uno gia usato", codiceTOTP(chiave, corrente-1), corrente, 0, false},
+		{"passo successivo a uno gia usato", codiceTOTP(chiave, corrente+1), corrente, corrente + 1, true},
+		{"lunghezza errata", "12345", 0, 0, false},
+	}
+	for _, c := range casi {
+		t.Run(c.nome, func(t *testing.T) {
+			passo, ok := verificaCodiceTOTP(segretoRFC, c.codice, c.ultimoPasso, ora)
+			if ok != c.valido || passo != c.passo {
+				t.Errorf("verificaCodiceTOTP = %d, %v; atteso %d, %v", passo, ok, c.passo, c.valido)
+			}
+		})
+	}
+}
+
+func TestVerificaCodiceTOTPSegretoNonValido(t *testing.T) {
+	if _, ok := verificaCodiceTOTP("non-base32!", "123456", 0, time.Now()); ok {
+		t.Error("un segreto non decodificabile non deve validare alcun codice")
+	}
+}
@@ -0,0 +1,146 @@
+// Package backupremoto copia gli archivi di backup su destinazioni esterne al
+// server: condivisioni SMB, server SFTP, storage a oggetti compatibile S3 (anche
+// MinIO in rete locale) e percorsi montati (disco USB, NFS).
+package backupremoto
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Tipi di destinazione
+const (
+	TipoSMB    = "smb"
+	TipoSFTP   = "sftp"
+	TipoS3     = "s3"
+	TipoLocale = "locale"
+)
+
+const timeoutDefault = 30 * time.Second
+
+// ErrChiaveHostCambiata indica che il server SFTP presenta una chiave diversa da quella registrata
+var ErrChiaveHostCambiata = errors.New("la chiave del server SFTP e cambiata: verificare il server e ripetere il test")
+
+// Config contiene i parametri di una destinazione. Il significato di Percorso dipende dal tipo:
+// //server/share/cartella per SMB, cartella remota per SFTP, prefisso per S3, cartella locale.
+type Config struct {
+	Tipo     string
+	Percorso string
+	Username string // per S3 e la access key
+	Password string // per S3 e la secret key
+
+	// SFTP
+	Host         string
+	Porta        int
+	ImprontaHost string // SHA256 della chiave del server; vuota = accettata e rilevata al primo test
+
+	// S3
+	Endpoint string // es. http://minio.locale:9000
+	Bucket   string
+	Regione  string
+
+	Timeout time.Duration
+}
+
+// File e un file presente sulla destinazione
+type File struct {
+	Nome         string
+	Dimensione   int64
+	ModificatoIl time.Time
+}
+
+// BackupTarget e una destinazione dei backup. I nomi dei file sono relativi alla
+// radice della destinazione e usano "/" come separatore.
+type BackupTarget interface {
+	// Descrizione identifica la destinazione per log e pagine
+	Descrizione() string
+	// Prova verifica connessione, credenziali e accesso alla radice
+	Prova() error
+	// Carica copia il file locale sulla destinazione, creando le cartelle mancanti
+	Carica(percorsoLocale, nome string) error
+	// Elenca restituisce i file (non le cartelle) contenuti nella cartella
+	Elenca(dir string) ([]File, error)
+	// Elimina rimuove il file
+	Elimina(nome string) error
+}
+
+// ChiaveHost e implementata dalle destinazioni che verificano la chiave del server
+type ChiaveHost interface {
+	// ImprontaHost restituisce l'impronta della chiave presentata all'ultima connessione
+	ImprontaHost() string
+}
+
+// Nuovo crea la destinazione descritta dalla configurazione
+func Nuovo(cfg Config) (BackupTarget, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = timeoutDefault
+	}
+	switch cfg.Tipo {
+	case TipoSMB:
+		if !strings.HasPrefix(cfg.Percorso, "//") {
+			return nil, fmt.Errorf("percorso SMB non valido, formato //server/share/cartella")
+		}
+		return &smb{cfg: cfg}, nil
+	case TipoSFTP:
+		if cfg.Host == "" {
+			return nil, fmt.Errorf("host SFTP mancante")
+		}
+		if cfg.Porta == 0 {
+			cfg.Porta = 22
+		}
+		return &sftp{cfg: cfg}, nil
+	case TipoS3:
+		if cfg.Endpoint == "" || cfg.Bucket == "" {
+			return nil, fmt.Errorf("endpoint e bucket S3 sono obbligatori")
+		}
+		if cfg.Regione == "" {
+			cfg.Regione = "us-east-1"
+		}
+		return &s3{cfg: cfg}, nil
+	case TipoLocale:
+		if cfg.Percorso == "" || !path.IsAbs(cfg.Percorso) {
+			return nil, fmt.Errorf("la cartella deve essere un percorso assoluto")
+		}
+		return &locale{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("tipo di destinazione non supportato: %s", cfg.Tipo)
+}
+
+// NomeTipo restituisce l'etichetta del tipo di destinazione
+func NomeTipo(tipo string) string {
+	switch tipo {
+	case TipoSMB:
+		return "NAS (SMB/CIFS)"
+	case TipoSFTP:
+		return "SFTP"
+	case TipoS3:
+		return "S3 / MinIO"
+	case TipoLocale:
+		return "Cartella locale"
+	}
+	return tipo
+}
+
+// pulisciNome valida un nome relativo alla radice della destinazione
+func pulisciNome(nome string) (string, error) {
+	pulito := path.Clean("/" + strings.ReplaceAll(nome, "\\", "/"))[1:]
+	if pulito == "" || pulito != strings.Trim(nome, "/") {
+		return "", fmt.Errorf("nome file non valido: %s", nome)
+	}
+	return pulito, nil
+}
+
+// unisci aggiunge il nome relativo alla radice della destinazione
+func unisci(radice, nome string) string {
+	radice = strings.TrimRight(radice, "/")
+	if nome == "" {
+		return radice
+	}
+	if radice == "" {
+		return nome
+	}
+	return radice + "/" + nome
+}
@@ -0,0 +1,119 @@
+package backupremoto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// locale copia i backup in una cartella del server, tipicamente un disco esterno
+// o una condivisione NFS montata
+type locale struct {
+	cfg Config
+}
+
+func (l *locale) Descrizione() string {
+	return l.cfg.Percorso
+}
+
+func (l *locale) percorso(nome string) (string, error) {
+	if nome == "" {
+		return l.cfg.Percorso, nil
+	}
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.cfg.Percorso, filepath.FromSlash(pulito)), nil
+}
+
+// Prova verifica che la cartella esista e sia scrivibile. Non la crea: una cartella
+// mancante indica di solito un disco non montato.
+func (l *locale) Prova() error {
+	info, err := os.Stat(l.cfg.Percorso)
+	if err != nil {
+		return fmt.Errorf("cartella non accessibile: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s non e una cartella", l.cfg.Percorso)
+	}
+	prova, err := os.CreateTemp(l.cfg.Percorso, ".furviogest_prova_")
+	if err != nil {
+		return fmt.Errorf("cartella non scrivibile: %v", err)
+	}
+	prova.Close()
+	return os.Remove(prova.Name())
+}
+
+// Carica scrive in un file temporaneo e lo rinomina, cosi un file interrotto non
+// sembra mai un backup completo
+func (l *locale) Carica(percorsoLocale, nome string) error {
+	if err := l.Prova(); err != nil {
+		return err
+	}
+	dest, err := l.percorso(nome)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(percorsoLocale)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".caricamento_")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (l *locale) Elenca(dir string) ([]File, error) {
+	percorso, err := l.percorso(dir)
+	if err != nil {
+		return nil, err
+	}
+	voci, err := os.ReadDir(percorso)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file []File
+	for _, v := range voci {
+		info, err := v.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		file = append(file, File{Nome: v.Name(), Dimensione: info.Size(), ModificatoIl: info.ModTime()})
+	}
+	return file, nil
+}
+
+func (l *locale) Elimina(nome string) error {
+	percorso, err := l.percorso(nome)
+	if err != nil {
+		return err
+	}
+	return os.Remove(percorso)
+}
@@ -0,0 +1,316 @@
+package backupremoto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3 copia i backup su storage a oggetti compatibile S3 (AWS, MinIO, Ceph, ...).
+// Usa indirizzi path-style (endpoint/bucket/chiave), supportati da tutti i server
+// compatibili, e la firma AWS Signature Version 4.
+type s3 struct {
+	cfg Config
+}
+
+// dimensioneMaxS3 e il limite di un PUT singolo; oltre servirebbe l'upload multipart
+const dimensioneMaxS3 = 5 << 30
+
+func (s *s3) Descrizione() string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.cfg.Endpoint, "/"), s.cfg.Bucket, strings.Trim(s.cfg.Percorso, "/"))
+}
+
+// chiave restituisce la chiave dell'oggetto con il prefisso della destinazione
+func (s *s3) chiave(nome string) string {
+	return unisci(strings.Trim(s.cfg.Percorso, "/"), nome)
+}
+
+// richiesta costruisce una richiesta firmata per il bucket
+func (s *s3) richiesta(metodo, chiave string, query url.Values, corpo io.Reader, hashCorpo string) (*http.Request, error) {
+	base, err := url.Parse(strings.TrimRight(s.cfg.Endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("endpoint S3 non valido: %s", s.cfg.Endpoint)
+	}
+	u := *base
+	u.Path = "/" + s.cfg.Bucket
+	if chiave != "" {
+		u.Path += "/" + chiave
+	}
+	u.RawPath = codificaPercorsoS3(u.Path)
+	u.RawQuery = codificaQueryS3(query)
+
+	req, err := http.NewRequest(metodo, u.String(), corpo)
+	if err != nil {
+		return nil, err
+	}
+	firmaS3(req, s.cfg.Username, s.cfg.Password, s.cfg.Regione, hashCorpo, time.Now())
+	return req, nil
+}
+
+// esegui invia la richiesta e trasforma le risposte di errore in errori leggibili
+func (s *s3) esegui(req *http.Request) (*http.Response, error) {
+	client := &http.Client{Timeout: 0}
+	if req.Method != http.MethodPut {
+		client.Timeout = s.cfg.Timeout
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		corpo, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if xml.Unmarshal(corpo, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("s3: risposta %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *s3) Prova() error {
+	query := url.Values{"list-type": {"2"}, "max-keys": {"1"}}
+	if prefisso := s.chiave(""); prefisso != "" {
+		query.Set("prefix", prefisso+"/")
+	}
+	req, err := s.richiesta(http.MethodGet, "", query, nil, hashVuoto)
+	if err != nil {
+		return err
+	}
+	resp, err := s.esegui(req)
+	if err != nil {
+		return fmt.Errorf("accesso al bucket fallito: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Carica invia il file con un PUT singolo, firmando l'impronta del contenuto
+func (s *s3) Carica(percorsoLocale, nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(percorsoLocale)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > dimensioneMaxS3 {
+		return fmt.Errorf("s3: file di %d byte oltre il limite di un caricamento singolo (5 GB)", info.Size())
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := s.richiesta(http.MethodPut, s.chiave(pulito), nil, file, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	resp, err := s.esegui(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3) Elenca(dir string) ([]File, error) {
+	prefisso := s.chiave("")
+	if dir != "" {
+		pulito, err := pulisciNome(dir)
+		if err != nil {
+			return nil, err
+		}
+		prefisso = s.chiave(pulito)
+	}
+	if prefisso != "" {
+		prefisso += "/"
+	}
+
+	var file []File
+	continuazione := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefisso}, "delimiter": {"/"}}
+		if continuazione != "" {
+			query.Set("continuation-token", continuazione)
+		}
+		req, err := s.richiesta(http.MethodGet, "", query, nil, hashVuoto)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.esegui(req)
+		if err != nil {
+			return nil, err
+		}
+		var elenco struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&elenco)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: elenco non valido: %v", err)
+		}
+		for _, c := range elenco.Contents {
+			nome := strings.TrimPrefix(c.Key, prefisso)
+			if nome == "" || strings.Contains(nome, "/") {
+				continue
+			}
+			file = append(file, File{Nome: nome, Dimensione: c.Size, ModificatoIl: c.LastModified})
+		}
+		if !elenco.IsTruncated || elenco.NextContinuationToken == "" {
+			break
+		}
+		continuazione = elenco.NextContinuationToken
+	}
+	return file, nil
+}
+
+func (s *s3) Elimina(nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	req, err := s.richiesta(http.MethodDelete, s.chiave(pulito), nil, nil, hashVuoto)
+	if err != nil {
+		return err
+	}
+	resp, err := s.esegui(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ============================================
+// FIRMA AWS SIGNATURE VERSION 4
+// ============================================
+
+// hashVuoto e lo SHA-256 del corpo vuoto
+const hashVuoto = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// firmaS3 aggiunge alla richiesta le intestazioni x-amz-* e Authorization.
+// Firma host, le intestazioni x-amz-* e quelle di contenuto gia impostate.
+func firmaS3(req *http.Request, accessKey, secretKey, regione, hashCorpo string, ora time.Time) {
+	ora = ora.UTC()
+	dataOra := ora.Format("20060102T150405Z")
+	data := ora.Format("20060102")
+	req.Header.Set("x-amz-date", dataOra)
+	req.Header.Set("x-amz-content-sha256", hashCorpo)
+
+	intestazioni := map[string]string{"host": req.URL.Host}
+	for nome, valori := range req.Header {
+		n := strings.ToLower(nome)
+		if strings.HasPrefix(n, "x-amz-") || n == "range" || n == "content-type" || n == "content-md5" {
+			intestazioni[n] = strings.TrimSpace(strings.Join(valori, ","))
+		}
+	}
+	nomi := make([]string, 0, len(intestazioni))
+	for n := range intestazioni {
+		nomi = append(nomi, n)
+	}
+	sort.Strings(nomi)
+	var canoniche strings.Builder
+	for _, n := range nomi {
+		canoniche.WriteString(n + ":" + intestazioni[n] + "\n")
+	}
+	firmate := strings.Join(nomi, ";")
+
+	richiestaCanonica := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canoniche.String(),
+		firmate,
+		hashCorpo,
+	}, "\n")
+
+	ambito := data + "/" + regione + "/s3/aws4_request"
+	daFirmare := "AWS4-HMAC-SHA256\n" + dataOra + "\n" + ambito + "\n" + hexSHA256(richiestaCanonica)
+
+	chiave := hmacSHA256([]byte("AWS4"+secretKey), data)
+	chiave = hmacSHA256(chiave, regione)
+	chiave = hmacSHA256(chiave, "s3")
+	chiave = hmacSHA256(chiave, "aws4_request")
+	firma := hex.EncodeToString(hmacSHA256(chiave, daFirmare))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, ambito, firmate, firma))
+}
+
+func hmacSHA256(chiave []byte, dati string) []byte {
+	h := hmac.New(sha256.New, chiave)
+	h.Write([]byte(dati))
+	return h.Sum(nil)
+}
+
+func hexSHA256(dati string) string {
+	h := sha256.Sum256([]byte(dati))
+	return hex.EncodeToString(h[:])
+}
+
+// codificaS3 applica la codifica URI di SigV4: restano in chiaro solo i caratteri non riservati
+func codificaS3(s string, mantieniBarra bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && mantieniBarra:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// codificaPercorsoS3 codifica il percorso mantenendo i separatori
+func codificaPercorsoS3(p string) string {
+	return codificaS3(path.Clean(p), true)
+}
+
+// codificaQueryS3 produce la query canonica: parametri ordinati e codificati
+func codificaQueryS3(query url.Values) string {
+	var parti []string
+	for chiave, valori := range query {
+		for _, v := range valori {
+			parti = append(parti, codificaS3(chiave, false)+"="+codificaS3(v, false))
+		}
+	}
+	sort.Strings(parti)
+	return strings.Join(parti, "&")
+}
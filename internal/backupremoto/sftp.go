@@ -0,0 +1,580 @@
+package backupremoto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftp copia i backup con il protocollo SFTP versione 3 (draft-ietf-secsh-filexfer-02),
+// il sottosistema offerto da OpenSSH e dai NAS. Il client implementa solo le
+// operazioni che servono ai backup.
+type sftp struct {
+	cfg      Config
+	impronta string
+}
+
+// Tipi di pacchetto SFTP
+const (
+	sshFxpInit      = 1
+	sshFxpVersion   = 2
+	sshFxpOpen      = 3
+	sshFxpClose     = 4
+	sshFxpWrite     = 6
+	sshFxpOpendir   = 11
+	sshFxpReaddir   = 12
+	sshFxpRemove    = 13
+	sshFxpMkdir     = 14
+	sshFxpStat      = 17
+	sshFxpRename    = 18
+	sshFxpStatus    = 101
+	sshFxpHandle    = 102
+	sshFxpName      = 104
+	sshFxpAttrs     = 105
+	sshFxOK         = 0
+	sshFxEOF        = 1
+	sshFxNoSuchFile = 2
+
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrUIDGID      = 0x02
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+	sshFileXferAttrExtended    = 0x80000000
+
+	// dimensioneBlocco resta sotto i 34000 byte di pacchetto che ogni server deve accettare
+	dimensioneBlocco = 32 * 1024
+	// scrittureInVolo sono le WRITE inviate senza attendere risposta
+	scrittureInVolo = 16
+	// pacchettoMax limita la memoria allocata per una risposta
+	pacchettoMax = 4 << 20
+)
+
+// erroreSFTP e una risposta SSH_FXP_STATUS diversa da OK
+type erroreSFTP struct {
+	codice    uint32
+	messaggio string
+}
+
+func (e *erroreSFTP) Error() string {
+	return fmt.Sprintf("sftp: %s (codice %d)", e.messaggio, e.codice)
+}
+
+func codiceSFTP(err error, codice uint32) bool {
+	e, ok := err.(*erroreSFTP)
+	return ok && e.codice == codice
+}
+
+func (s *sftp) Descrizione() string {
+	return fmt.Sprintf("sftp://%s@%s:%d/%s", s.cfg.Username, s.cfg.Host, s.cfg.Porta, strings.TrimPrefix(s.cfg.Percorso, "/"))
+}
+
+// ImprontaHost restituisce l'impronta SHA256 della chiave presentata dal server
+func (s *sftp) ImprontaHost() string {
+	return s.impronta
+}
+
+// configSSH autentica con password o, se la password contiene una chiave privata PEM, con la chiave
+func (s *sftp) configSSH() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if strings.Contains(s.cfg.Password, "PRIVATE KEY") {
+		firmatario, err := ssh.ParsePrivateKey([]byte(s.cfg.Password))
+		if err != nil {
+			return nil, fmt.Errorf("chiave privata non valida: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(firmatario))
+	} else {
+		password := s.cfg.Password
+		auth = append(auth,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				risposte := make([]string, len(questions))
+				for i := range risposte {
+					risposte[i] = password
+				}
+				return risposte, nil
+			}))
+	}
+
+	return &ssh.ClientConfig{
+		User: s.cfg.Username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			s.impronta = ssh.FingerprintSHA256(key)
+			if s.cfg.ImprontaHost != "" && s.cfg.ImprontaHost != s.impronta {
+				return ErrChiaveHostCambiata
+			}
+			return nil
+		},
+		Timeout: s.cfg.Timeout,
+	}, nil
+}
+
+// sessioneSFTP e un canale SFTP aperto
+type sessioneSFTP struct {
+	client  *ssh.Client
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+// connetti apre la connessione SSH e avvia il sottosistema sftp
+func (s *sftp) connetti() (*sessioneSFTP, error) {
+	config, err := s.configSSH()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Porta)), config)
+	if err != nil {
+		return nil, fmt.Errorf("connessione SSH fallita: %w", err)
+	}
+
+	ss := &sessioneSFTP{client: client}
+	if err := ss.avvia(); err != nil {
+		ss.chiudi()
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *sessioneSFTP) avvia() error {
+	var err error
+	if ss.session, err = ss.client.NewSession(); err != nil {
+		return err
+	}
+	if ss.w, err = ss.session.StdinPipe(); err != nil {
+		return err
+	}
+	if ss.r, err = ss.session.StdoutPipe(); err != nil {
+		return err
+	}
+	if err := ss.session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("sottosistema sftp non disponibile: %v", err)
+	}
+
+	// INIT non ha id: il campo e la versione del protocollo
+	if err := ss.invia(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+	tipo, _, err := ss.ricevi()
+	if err != nil {
+		return err
+	}
+	if tipo != sshFxpVersion {
+		return fmt.Errorf("sftp: risposta inattesa all'avvio (%d)", tipo)
+	}
+	return nil
+}
+
+func (ss *sessioneSFTP) chiudi() {
+	if ss.session != nil {
+		ss.session.Close()
+	}
+	ss.client.Close()
+}
+
+// invia scrive un pacchetto: lunghezza, tipo, dati
+func (ss *sessioneSFTP) invia(tipo byte, dati []byte) error {
+	pacchetto := make([]byte, 0, 5+len(dati))
+	pacchetto = binary.BigEndian.AppendUint32(pacchetto, uint32(1+len(dati)))
+	pacchetto = append(pacchetto, tipo)
+	pacchetto = append(pacchetto, dati...)
+	_, err := ss.w.Write(pacchetto)
+	return err
+}
+
+// ricevi legge un pacchetto e ne restituisce tipo e dati
+func (ss *sessioneSFTP) ricevi() (byte, []byte, error) {
+	var intestazione [5]byte
+	if _, err := io.ReadFull(ss.r, intestazione[:]); err != nil {
+		return 0, nil, fmt.Errorf("sftp: connessione interrotta: %v", err)
+	}
+	lunghezza := binary.BigEndian.Uint32(intestazione[:4])
+	if lunghezza < 1 || lunghezza > pacchettoMax {
+		return 0, nil, fmt.Errorf("sftp: pacchetto non valido (%d byte)", lunghezza)
+	}
+	dati := make([]byte, lunghezza-1)
+	if _, err := io.ReadFull(ss.r, dati); err != nil {
+		return 0, nil, fmt.Errorf("sftp: connessione interrotta: %v", err)
+	}
+	return intestazione[4], dati, nil
+}
+
+// richiesta invia un pacchetto con un nuovo id e ne restituisce l'id
+func (ss *sessioneSFTP) richiesta(tipo byte, campi ...interface{}) (uint32, error) {
+	ss.id++
+	dati := binary.BigEndian.AppendUint32(nil, ss.id)
+	for _, c := range campi {
+		switch v := c.(type) {
+		case uint32:
+			dati = binary.BigEndian.AppendUint32(dati, v)
+		case uint64:
+			dati = binary.BigEndian.AppendUint64(dati, v)
+		case string:
+			dati = binary.BigEndian.AppendUint32(dati, uint32(len(v)))
+			dati = append(dati, v...)
+		case []byte:
+			dati = binary.BigEndian.AppendUint32(dati, uint32(len(v)))
+			dati = append(dati, v...)
+		}
+	}
+	return ss.id, ss.invia(tipo, dati)
+}
+
+// risposta legge la risposta alla richiesta id
+func (ss *sessioneSFTP) risposta(id uint32) (byte, *lettore, error) {
+	tipo, dati, err := ss.ricevi()
+	if err != nil {
+		return 0, nil, err
+	}
+	l := &lettore{b: dati}
+	if rid := l.uint32(); rid != id {
+		return 0, nil, fmt.Errorf("sftp: risposta %d inattesa, attesa %d", rid, id)
+	}
+	if tipo == sshFxpStatus {
+		// Il messaggio e facoltativo per alcuni server: si legge solo in caso di errore
+		if codice := l.uint32(); codice != sshFxOK && l.err == nil {
+			messaggio := l.string()
+			if messaggio == "" {
+				messaggio = "operazione fallita"
+			}
+			return tipo, l, &erroreSFTP{codice: codice, messaggio: messaggio}
+		}
+	}
+	return tipo, l, l.err
+}
+
+// esegui invia la richiesta e ne attende la risposta
+func (ss *sessioneSFTP) esegui(tipo byte, campi ...interface{}) (byte, *lettore, error) {
+	id, err := ss.richiesta(tipo, campi...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ss.risposta(id)
+}
+
+// handle esegue OPEN o OPENDIR e restituisce l'handle
+func (ss *sessioneSFTP) handle(tipo byte, campi ...interface{}) (string, error) {
+	rtipo, l, err := ss.esegui(tipo, campi...)
+	if err != nil {
+		return "", err
+	}
+	if rtipo != sshFxpHandle {
+		return "", fmt.Errorf("sftp: risposta inattesa (%d)", rtipo)
+	}
+	return l.string(), l.err
+}
+
+func (ss *sessioneSFTP) chiudiHandle(handle string) error {
+	_, _, err := ss.esegui(sshFxpClose, handle)
+	return err
+}
+
+// esiste indica se il percorso esiste sul server
+func (ss *sessioneSFTP) esiste(percorso string) (bool, error) {
+	_, _, err := ss.esegui(sshFxpStat, percorso)
+	if codiceSFTP(err, sshFxNoSuchFile) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// creaCartelle crea la cartella e quelle superiori mancanti
+func (ss *sessioneSFTP) creaCartelle(dir string) error {
+	if dir == "" || dir == "." || dir == "/" {
+		return nil
+	}
+	cammino := ""
+	if strings.HasPrefix(dir, "/") {
+		cammino = "/"
+	}
+	for _, parte := range strings.Split(strings.Trim(dir, "/"), "/") {
+		cammino = path.Join(cammino, parte)
+		ok, err := ss.esiste(cammino)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if _, _, err := ss.esegui(sshFxpMkdir, cammino, uint32(0)); err != nil {
+				return fmt.Errorf("creazione cartella %s: %w", cammino, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scrivi copia il contenuto nel file remoto, tenendo in volo piu WRITE
+func (ss *sessioneSFTP) scrivi(handle string, src io.Reader) error {
+	inVolo := make(map[uint32]bool)
+	attendi := func() error {
+		tipo, dati, err := ss.ricevi()
+		if err != nil {
+			return err
+		}
+		l := &lettore{b: dati}
+		id := l.uint32()
+		if tipo != sshFxpStatus || !inVolo[id] {
+			return fmt.Errorf("sftp: risposta inattesa alla scrittura")
+		}
+		delete(inVolo, id)
+		if codice := l.uint32(); codice != sshFxOK {
+			return &erroreSFTP{codice: codice, messaggio: l.string()}
+		}
+		return nil
+	}
+
+	buf := make([]byte, dimensioneBlocco)
+	var offset uint64
+	for {
+		n, errLettura := io.ReadFull(src, buf)
+		if n > 0 {
+			id, err := ss.richiesta(sshFxpWrite, handle, offset, buf[:n])
+			if err != nil {
+				return err
+			}
+			inVolo[id] = true
+			offset += uint64(n)
+			if len(inVolo) >= scrittureInVolo {
+				if err := attendi(); err != nil {
+					return err
+				}
+			}
+		}
+		if errLettura == io.EOF || errLettura == io.ErrUnexpectedEOF {
+			break
+		}
+		if errLettura != nil {
+			return errLettura
+		}
+	}
+	for len(inVolo) > 0 {
+		if err := attendi(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftp) Prova() error {
+	ss, err := s.connetti()
+	if err != nil {
+		return err
+	}
+	defer ss.chiudi()
+
+	radice := unisci(s.cfg.Percorso, "")
+	if err := ss.creaCartelle(radice); err != nil {
+		return err
+	}
+	prova := unisci(radice, ".furviogest_prova")
+	handle, err := ss.handle(sshFxpOpen, prova, uint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc), uint32(0))
+	if err != nil {
+		return fmt.Errorf("cartella non scrivibile: %w", err)
+	}
+	ss.chiudiHandle(handle)
+	_, _, err = ss.esegui(sshFxpRemove, prova)
+	return err
+}
+
+// Carica scrive in un file temporaneo e lo rinomina a copia completata
+func (s *sftp) Carica(percorsoLocale, nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(percorsoLocale)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	ss, err := s.connetti()
+	if err != nil {
+		return err
+	}
+	defer ss.chiudi()
+
+	dest := unisci(s.cfg.Percorso, pulito)
+	if err := ss.creaCartelle(path.Dir(dest)); err != nil {
+		return err
+	}
+
+	tmp := dest + ".caricamento"
+	handle, err := ss.handle(sshFxpOpen, tmp, uint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc), uint32(0))
+	if err != nil {
+		return fmt.Errorf("apertura %s: %w", tmp, err)
+	}
+	errScrittura := ss.scrivi(handle, src)
+	errChiusura := ss.chiudiHandle(handle)
+	if errScrittura == nil {
+		errScrittura = errChiusura
+	}
+	if errScrittura != nil {
+		ss.esegui(sshFxpRemove, tmp)
+		return fmt.Errorf("scrittura %s: %w", dest, errScrittura)
+	}
+
+	// In SFTP v3 RENAME non sovrascrive: si elimina prima l'eventuale file esistente
+	ss.esegui(sshFxpRemove, dest)
+	if _, _, err := ss.esegui(sshFxpRename, tmp, dest); err != nil {
+		ss.esegui(sshFxpRemove, tmp)
+		return fmt.Errorf("rinomina %s: %w", dest, err)
+	}
+	return nil
+}
+
+func (s *sftp) Elenca(dir string) ([]File, error) {
+	cartella := unisci(s.cfg.Percorso, dir)
+	if dir != "" {
+		pulito, err := pulisciNome(dir)
+		if err != nil {
+			return nil, err
+		}
+		cartella = unisci(s.cfg.Percorso, pulito)
+	}
+	if cartella == "" {
+		cartella = "."
+	}
+
+	ss, err := s.connetti()
+	if err != nil {
+		return nil, err
+	}
+	defer ss.chiudi()
+
+	handle, err := ss.handle(sshFxpOpendir, cartella)
+	if codiceSFTP(err, sshFxNoSuchFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer ss.chiudiHandle(handle)
+
+	var file []File
+	for {
+		tipo, l, err := ss.esegui(sshFxpReaddir, handle)
+		if codiceSFTP(err, sshFxEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tipo != sshFxpName {
+			return nil, fmt.Errorf("sftp: risposta inattesa all'elenco (%d)", tipo)
+		}
+		for n := l.uint32(); n > 0 && l.err == nil; n-- {
+			nome := l.string()
+			l.string() // longname, formato libero
+			attr := l.attributi()
+			if nome == "." || nome == ".." || (attr.haPermessi && attr.permessi&0170000 != 0100000) {
+				continue
+			}
+			file = append(file, File{Nome: nome, Dimensione: int64(attr.dimensione), ModificatoIl: attr.modificato})
+		}
+		if l.err != nil {
+			return nil, l.err
+		}
+	}
+	return file, nil
+}
+
+func (s *sftp) Elimina(nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	ss, err := s.connetti()
+	if err != nil {
+		return err
+	}
+	defer ss.chiudi()
+
+	_, _, err = ss.esegui(sshFxpRemove, unisci(s.cfg.Percorso, pulito))
+	return err
+}
+
+// lettore decodifica i campi di un pacchetto; il primo errore blocca le letture successive
+type lettore struct {
+	b   []byte
+	err error
+}
+
+func (l *lettore) prendi(n int) []byte {
+	if l.err != nil {
+		return nil
+	}
+	if len(l.b) < n {
+		l.err = fmt.Errorf("sftp: pacchetto troncato")
+		return nil
+	}
+	v := l.b[:n]
+	l.b = l.b[n:]
+	return v
+}
+
+func (l *lettore) uint32() uint32 {
+	if v := l.prendi(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (l *lettore) uint64() uint64 {
+	if v := l.prendi(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (l *lettore) string() string {
+	n := l.uint32()
+	return string(l.prendi(int(n)))
+}
+
+// attributiSFTP sono i campi di ATTRS usati dai backup
+type attributiSFTP struct {
+	dimensione uint64
+	haPermessi bool
+	permessi   uint32
+	modificato time.Time
+}
+
+func (l *lettore) attributi() attributiSFTP {
+	var a attributiSFTP
+	flag := l.uint32()
+	if flag&sshFileXferAttrSize != 0 {
+		a.dimensione = l.uint64()
+	}
+	if flag&sshFileXferAttrUIDGID != 0 {
+		l.uint32()
+		l.uint32()
+	}
+	if flag&sshFileXferAttrPermissions != 0 {
+		a.haPermessi = true
+		a.permessi = l.uint32()
+	}
+	if flag&sshFileXferAttrACModTime != 0 {
+		l.uint32()
+		a.modificato = time.Unix(int64(l.uint32()), 0)
+	}
+	if flag&sshFileXferAttrExtended != 0 {
+		for n := l.uint32(); n > 0 && l.err == nil; n-- {
+			l.string()
+			l.string()
+		}
+	}
+	return a
+}
@@ -0,0 +1,138 @@
+package backupremoto
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smb usa smbclient (non richiede root ne mount della condivisione)
+type smb struct {
+	cfg Config
+}
+
+// reVoceLs riconosce una riga di "ls" di smbclient: nome, attributi, dimensione, data
+var reVoceLs = regexp.MustCompile(`^\s+(.+?)\s+([A-Z]*)\s+(\d+)\s+(\w{3} \w{3}\s+\d+ \d{2}:\d{2}:\d{2} \d{4})$`)
+
+func (s *smb) Descrizione() string {
+	return s.cfg.Percorso
+}
+
+// condivisione separa share e sottocartella dal percorso
+// Input: //192.168.1.100/NAS/backup/furviogest
+// Output: share=//192.168.1.100/NAS, subdir=backup/furviogest
+func (s *smb) condivisione() (share string, subdir string) {
+	parti := strings.SplitN(strings.TrimPrefix(s.cfg.Percorso, "//"), "/", 3) // server, share, resto
+	if len(parti) >= 2 {
+		share = "//" + parti[0] + "/" + parti[1]
+	}
+	if len(parti) >= 3 {
+		subdir = strings.Trim(parti[2], "/")
+	}
+	return
+}
+
+// esegui lancia smbclient con i comandi indicati
+func (s *smb) esegui(comandi string) (string, error) {
+	share, _ := s.condivisione()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*s.cfg.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "smbclient", share, "-U", s.cfg.Username+"%"+s.cfg.Password, "-c", comandi)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if messaggio := strings.TrimSpace(string(output)); messaggio != "" {
+			return string(output), fmt.Errorf("smbclient: %s", messaggio)
+		}
+		return string(output), fmt.Errorf("smbclient: %v", err)
+	}
+	return string(output), nil
+}
+
+// cartella restituisce la cartella sulla share che corrisponde a dir
+func (s *smb) cartella(dir string) string {
+	_, subdir := s.condivisione()
+	return unisci(subdir, dir)
+}
+
+func (s *smb) Prova() error {
+	comandi := "ls"
+	if subdir := s.cartella(""); subdir != "" {
+		comandi = fmt.Sprintf(`cd "%s"; ls`, subdir)
+	}
+	if _, err := s.esegui(comandi); err != nil {
+		return fmt.Errorf("connessione fallita: %v", err)
+	}
+	return nil
+}
+
+func (s *smb) Carica(percorsoLocale, nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	dir, base := path.Split(pulito)
+	dir = strings.Trim(dir, "/")
+
+	// Crea le sottocartelle: mkdir fallisce se esistono gia, quindi gli errori si ignorano
+	if dir != "" {
+		var mkdir []string
+		cammino := ""
+		for _, parte := range strings.Split(dir, "/") {
+			cammino = unisci(cammino, parte)
+			mkdir = append(mkdir, fmt.Sprintf(`mkdir "%s"`, s.cartella(cammino)))
+		}
+		s.esegui(strings.Join(mkdir, "; "))
+	}
+
+	comandi := fmt.Sprintf(`put "%s" "%s"`, percorsoLocale, base)
+	if cartella := s.cartella(dir); cartella != "" {
+		comandi = fmt.Sprintf(`cd "%s"; %s`, cartella, comandi)
+	}
+	if _, err := s.esegui(comandi); err != nil {
+		return fmt.Errorf("copia fallita: %v", err)
+	}
+	return nil
+}
+
+func (s *smb) Elenca(dir string) ([]File, error) {
+	comandi := "ls"
+	if cartella := s.cartella(dir); cartella != "" {
+		comandi = fmt.Sprintf(`cd "%s"; ls`, cartella)
+	}
+	output, err := s.esegui(comandi)
+	if err != nil {
+		return nil, err
+	}
+
+	var file []File
+	for _, riga := range strings.Split(output, "\n") {
+		m := reVoceLs.FindStringSubmatch(strings.TrimRight(riga, "\r"))
+		if m == nil || strings.Contains(m[2], "D") {
+			continue
+		}
+		dimensione, _ := strconv.ParseInt(m[3], 10, 64)
+		data, _ := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(strings.Fields(m[4]), " "), time.Local)
+		file = append(file, File{Nome: m[1], Dimensione: dimensione, ModificatoIl: data})
+	}
+	return file, nil
+}
+
+func (s *smb) Elimina(nome string) error {
+	pulito, err := pulisciNome(nome)
+	if err != nil {
+		return err
+	}
+	dir, base := path.Split(pulito)
+	comandi := fmt.Sprintf(`del "%s"`, base)
+	if cartella := s.cartella(strings.Trim(dir, "/")); cartella != "" {
+		comandi = fmt.Sprintf(`cd "%s"; %s`, cartella, comandi)
+	}
+	_, err = s.esegui(comandi)
+	return err
+}
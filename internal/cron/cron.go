@@ -0,0 +1,224 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Espressione rappresenta un'espressione cron a 5 campi
+// (minuto ora giorno-mese mese giorno-settimana)
+type Espressione struct {
+	testo    string
+	minuti   uint64
+	ore      uint64
+	giorni   uint64
+	mesi     uint64
+	giorniSe uint64
+	// Se entrambi i campi giorno sono vincolati basta che uno dei due corrisponda (come in Vixie cron)
+	giornoLibero    bool
+	settimanaLibera bool
+}
+
+// campo descrive i limiti di un campo dell'espressione
+type campo struct {
+	nome     string
+	min, max int
+	nomi     map[string]int
+}
+
+var (
+	campoMinuto = campo{nome: "minuto", min: 0, max: 59}
+	campoOra    = campo{nome: "ora", min: 0, max: 23}
+	campoGiorno = campo{nome: "giorno del mese", min: 1, max: 31}
+	campoMese   = campo{nome: "mese", min: 1, max: 12, nomi: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 e accettato come sinonimo di domenica
+	campoSettimana = campo{nome: "giorno della settimana", min: 0, max: 7, nomi: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// tutteLeOre e la maschera del campo ora quando ogni ora e ammessa
+const tutteLeOre = 1<<24 - 1
+
+// Abbreviazioni supportate
+var alias = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// Parse interpreta un'espressione cron standard a 5 campi.
+// Sono supportati *, liste (1,3), intervalli (1-5), passi (*/15, 0-30/10),
+// nomi di mesi e giorni in inglese e le abbreviazioni @daily, @weekly...
+func Parse(testo string) (*Espressione, error) {
+	testo = strings.TrimSpace(testo)
+	espanso := testo
+	if a, ok := alias[strings.ToLower(testo)]; ok {
+		espanso = a
+	}
+
+	campi := strings.Fields(espanso)
+	if len(campi) != 5 {
+		return nil, fmt.Errorf("espressione cron non valida %q: servono 5 campi", testo)
+	}
+
+	e := &Espressione{testo: testo}
+	var err error
+	if e.minuti, err = parseCampo(campi[0], campoMinuto); err != nil {
+		return nil, err
+	}
+	if e.ore, err = parseCampo(campi[1], campoOra); err != nil {
+		return nil, err
+	}
+	if e.giorni, err = parseCampo(campi[2], campoGiorno); err != nil {
+		return nil, err
+	}
+	if e.mesi, err = parseCampo(campi[3], campoMese); err != nil {
+		return nil, err
+	}
+	if e.giorniSe, err = parseCampo(campi[4], campoSettimana); err != nil {
+		return nil, err
+	}
+	// Domenica puo essere 0 o 7
+	if e.giorniSe&(1<<7) != 0 {
+		e.giorniSe |= 1
+	}
+	e.giornoLibero = strings.HasPrefix(campi[2], "*")
+	e.settimanaLibera = strings.HasPrefix(campi[4], "*")
+	return e, nil
+}
+
+// String restituisce l'espressione originale
+func (e *Espressione) String() string {
+	return e.testo
+}
+
+// parseCampo converte un campo in una maschera di bit dei valori ammessi
+func parseCampo(s string, c campo) (uint64, error) {
+	var maschera uint64
+	for _, parte := range strings.Split(s, ",") {
+		intervallo, passo := parte, 1
+		if i := strings.Index(parte, "/"); i >= 0 {
+			p, err := strconv.Atoi(parte[i+1:])
+			if err != nil || p <= 0 {
+				return 0, fmt.Errorf("passo non valido %q nel campo %s", parte, c.nome)
+			}
+			intervallo, passo = parte[:i], p
+		}
+
+		var da, a int
+		switch {
+		case intervallo == "*":
+			da, a = c.min, c.max
+		case strings.Contains(intervallo, "-"):
+			estremi := strings.SplitN(intervallo, "-", 2)
+			var err error
+			if da, err = valore(estremi[0], c); err != nil {
+				return 0, err
+			}
+			if a, err = valore(estremi[1], c); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if da, err = valore(intervallo, c); err != nil {
+				return 0, err
+			}
+			a = da
+			// "5/15" equivale a "5-max/15"
+			if passo > 1 {
+				a = c.max
+			}
+		}
+		if da > a {
+			return 0, fmt.Errorf("intervallo non valido %q nel campo %s", parte, c.nome)
+		}
+		for v := da; v <= a; v += passo {
+			maschera |= 1 << uint(v)
+		}
+	}
+	return maschera, nil
+}
+
+// valore converte un singolo valore numerico o simbolico verificandone i limiti
+func valore(s string, c campo) (int, error) {
+	if n, ok := c.nomi[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("valore non valido %q nel campo %s", s, c.nome)
+	}
+	if v < c.min || v > c.max {
+		return 0, fmt.Errorf("valore %d fuori intervallo nel campo %s (%d-%d)", v, c.nome, c.min, c.max)
+	}
+	return v, nil
+}
+
+// Prossima restituisce il primo istante successivo a t che soddisfa l'espressione.
+// Restituisce il tempo zero se non esiste nei prossimi 5 anni (es. 30 febbraio).
+func (e *Espressione) Prossima(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limite := t.AddDate(5, 0, 0)
+
+	for t.Before(limite) {
+		if e.mesi&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !e.giornoValido(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !e.oraValida(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			// Al ritorno all'ora solare un'ora si ripete: si parte dalla prima occorrenza
+			if prima := t.Add(-time.Hour); prima.Hour() == t.Hour() {
+				t = prima
+			}
+			continue
+		}
+		if e.minuti&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// oraValida verifica l'ora tenendo conto dei cambi d'ora: gli orari dell'ora che manca
+// al passaggio all'ora legale scattano nell'ora successiva, mentre nell'ora che si ripete
+// al ritorno all'ora solare solo le espressioni su tutte le ore scattano di nuovo
+func (e *Espressione) oraValida(t time.Time) bool {
+	prec := t.Add(-time.Hour).Hour()
+	if prec == t.Hour() {
+		return e.ore == tutteLeOre
+	}
+	if e.ore&(1<<uint(t.Hour())) != 0 {
+		return true
+	}
+	for h := prec + 1; h < t.Hour(); h++ {
+		if e.ore&(1<<uint(h)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// giornoValido verifica giorno del mese e giorno della settimana
+func (e *Espressione) giornoValido(t time.Time) bool {
+	giorno := e.giorni&(1<<uint(t.Day())) != 0
+	settimana := e.giorniSe&(1<<uint(t.Weekday())) != 0
+	if e.giornoLibero || e.settimanaLibera {
+		return giorno && settimana
+	}
+	return giorno || settimana
+}
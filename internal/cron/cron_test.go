@@ -0,0 +1,185 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNonValida(t *testing.T) {
+	casi := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"30-10 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"1,,2 * * * *",
+		"@ogni_tanto",
+	}
+	for _, testo := range casi {
+		if _, err := Parse(testo); err == nil {
+			t.Errorf("Parse(%q): atteso errore", testo)
+		}
+	}
+}
+
+func TestParseValida(t *testing.T) {
+	casi := []string{
+		"* * * * *",
+		"*/15 0-6,22-23 * * mon-fri",
+		"0 3 1 jan,jul *",
+		"5/20 * * * 7",
+		"@daily",
+		"@Weekly",
+	}
+	for _, testo := range casi {
+		if _, err := Parse(testo); err != nil {
+			t.Errorf("Parse(%q): %v", testo, err)
+		}
+	}
+}
+
+func TestProssima(t *testing.T) {
+	roma, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skipf("fuso orario non disponibile: %v", err)
+	}
+	utc := time.UTC
+
+	casi := []struct {
+		nome   string
+		espr   string
+		da     time.Time
+		attese []time.Time
+	}{
+		{
+			nome: "ogni 15 minuti",
+			espr: "*/15 * * * *",
+			da:   time.Date(2026, 5, 10, 10, 7, 30, 0, utc),
+			attese: []time.Time{
+				time.Date(2026, 5, 10, 10, 15, 0, 0, utc),
+				time.Date(2026, 5, 10, 10, 30, 0, 0, utc),
+			},
+		},
+		{
+			nome: "istante gia corrispondente",
+			espr: "0 12 * * *",
+			da:   time.Date(2026, 5, 10, 12, 0, 0, 0, utc),
+			attese: []time.Time{
+				time.Date(2026, 5, 11, 12, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "fine mese e fine anno",
+			espr: "0 0 1 * *",
+			da:   time.Date(2026, 11, 30, 23, 59, 0, 0, utc),
+			attese: []time.Time{
+				time.Date(2026, 12, 1, 0, 0, 0, 0, utc),
+				time.Date(2027, 1, 1, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "giorno 31 salta i mesi piu corti",
+			espr: "0 6 31 * *",
+			da:   time.Date(2026, 1, 31, 7, 0, 0, 0, utc),
+			attese: []time.Time{
+				time.Date(2026, 3, 31, 6, 0, 0, 0, utc),
+				time.Date(2026, 5, 31, 6, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "29 febbraio",
+			espr: "0 0 29 2 *",
+			da:   time.Date(2026, 3, 1, 0, 0, 0, 0, utc),
+			attese: []time.Time{
+				time.Date(2028, 2, 29, 0, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "giorno del mese o della settimana",
+			espr: "0 8 15 * mon",
+			da:   time.Date(2026, 6, 12, 0, 0, 0, 0, utc), // venerdi
+			attese: []time.Time{
+				time.Date(2026, 6, 15, 8, 0, 0, 0, utc), // lunedi 15
+				time.Date(2026, 6, 22, 8, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "domenica come 7",
+			espr: "0 9 * * 7",
+			da:   time.Date(2026, 6, 12, 0, 0, 0, 0, utc),
+			attese: []time.Time{
+				time.Date(2026, 6, 14, 9, 0, 0, 0, utc),
+			},
+		},
+		{
+			nome: "ora legale: l'orario mancante scatta nell'ora successiva",
+			espr: "30 2 * * *",
+			da:   time.Date(2026, 3, 28, 3, 0, 0, 0, roma),
+			attese: []time.Time{
+				time.Date(2026, 3, 29, 3, 30, 0, 0, roma),
+				time.Date(2026, 3, 30, 2, 30, 0, 0, roma),
+			},
+		},
+		{
+			nome: "ora legale: ogni ora salta quella mancante",
+			espr: "0 * * * *",
+			da:   time.Date(2026, 3, 29, 1, 10, 0, 0, roma),
+			attese: []time.Time{
+				time.Date(2026, 3, 29, 3, 0, 0, 0, roma),
+				time.Date(2026, 3, 29, 4, 0, 0, 0, roma),
+			},
+		},
+		{
+			nome: "ora solare: un orario fisso scatta una sola volta",
+			espr: "30 2 * * *",
+			da:   time.Date(2026, 10, 24, 3, 0, 0, 0, roma),
+			attese: []time.Time{
+				time.Unix(1792888200, 0).In(roma), // 02:30 CEST
+				time.Date(2026, 10, 26, 2, 30, 0, 0, roma),
+			},
+		},
+		{
+			nome: "ora solare: ogni ora ripete quella doppia",
+			espr: "0 * * * *",
+			da:   time.Unix(1792886400, 0).In(roma), // 02:00 CEST
+			attese: []time.Time{
+				time.Unix(1792890000, 0).In(roma), // 02:00 CET
+				time.Unix(1792893600, 0).In(roma), // 03:00 CET
+			},
+		},
+		{
+			nome: "impossibile",
+			espr: "0 0 30 2 *",
+			da:   time.Date(2026, 1, 1, 0, 0, 0, 0, utc),
+			attese: []time.Time{
+				{},
+			},
+		},
+	}
+
+	for _, c := range casi {
+		t.Run(c.nome, func(t *testing.T) {
+			e, err := Parse(c.espr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", c.espr, err)
+			}
+			da := c.da
+			for _, attesa := range c.attese {
+				got := e.Prossima(da)
+				if !got.Equal(attesa) {
+					t.Fatalf("Prossima(%v) = %v, atteso %v", da, got, attesa)
+				}
+				da = got
+			}
+		})
+	}
+}
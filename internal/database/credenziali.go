@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+
+	"furviogest/internal/segreti"
+)
+
+// colonneCredenziali sono le colonne con password e segreti cifrati da internal/segreti.
+// Le community SNMP v2c restano in chiaro: sono visibili e modificabili nella pagina SNMP.
+var colonneCredenziali = []struct{ tabella, colonna string }{
+	{"access_controller", "ssh_pass"},
+	{"switch_nave", "ssh_pass"},
+	{"ac_ufficio", "ssh_pass"},
+	{"switch_ufficio", "ssh_pass"},
+	{"switch_sala_server", "ssh_pass"},
+	{"server_nave", "password"},
+	{"navi", "observium_pass"},
+	{"navi", "observium_ssh_pass"},
+	{"navi", "snmp_auth_password"},
+	{"navi", "snmp_priv_password"},
+	{"utenti", "smtp_password"},
+	{"utenti", "totp_segreto"},
+	{"impostazioni_azienda", "smtp_password"},
+	{"backup_sistema_config", "nas_password"},
+	{"backup_sistema_config", "cifratura_chiave"},
+	{"backup_destinazioni", "password"},
+	{"notifiche_regole", "segreto"},
+}
+
+// credenzialeDaCifrare e un valore in chiaro o cifrato con una chiave non piu attiva
+type credenzialeDaCifrare struct {
+	rowid  int64
+	valore string
+}
+
+// leggiDaCifrare restituisce i valori della colonna che vanno cifrati con la chiave attiva
+func leggiDaCifrare(tabella, colonna string) ([]credenzialeDaCifrare, error) {
+	esiste, err := esisteColonna(DB, tabella, colonna)
+	if err != nil || !esiste {
+		return nil, err
+	}
+	rows, err := DB.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s IS NOT NULL AND %s != ''", colonna, tabella, colonna, colonna))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var valori []credenzialeDaCifrare
+	for rows.Next() {
+		var c credenzialeDaCifrare
+		if err := rows.Scan(&c.rowid, &c.valore); err != nil {
+			return nil, err
+		}
+		if segreti.DaCifrare(c.valore) {
+			valori = append(valori, c)
+		}
+	}
+	return valori, rows.Err()
+}
+
+// ContaCredenzialiDaCifrare conta le credenziali in chiaro o cifrate con una chiave precedente
+func ContaCredenzialiDaCifrare() (int, error) {
+	totale := 0
+	for _, c := range colonneCredenziali {
+		valori, err := leggiDaCifrare(c.tabella, c.colonna)
+		if err != nil {
+			return totale, fmt.Errorf("%s.%s: %w", c.tabella, c.colonna, err)
+		}
+		totale += len(valori)
+	}
+	return totale, nil
+}
+
+// CifraCredenziali cifra con la chiave attiva le credenziali in chiaro e quelle
+// cifrate con una chiave precedente (rotazione). Restituisce i valori aggiornati.
+func CifraCredenziali() (int, error) {
+	type aggiornamento struct {
+		tabella, colonna string
+		credenzialeDaCifrare
+	}
+	var aggiornamenti []aggiornamento
+	for _, c := range colonneCredenziali {
+		valori, err := leggiDaCifrare(c.tabella, c.colonna)
+		if err != nil {
+			return 0, fmt.Errorf("%s.%s: %w", c.tabella, c.colonna, err)
+		}
+		for _, v := range valori {
+			aggiornamenti = append(aggiornamenti, aggiornamento{c.tabella, c.colonna, v})
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, a := range aggiornamenti {
+		testo, err := segreti.Decifra(a.valore)
+		if err != nil {
+			return 0, fmt.Errorf("%s.%s riga %d: %w", a.tabella, a.colonna, a.rowid, err)
+		}
+		cifrato, err := segreti.Cifra(testo)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", a.tabella, a.colonna), cifrato, a.rowid); err != nil {
+			return 0, fmt.Errorf("%s.%s riga %d: %w", a.tabella, a.colonna, a.rowid, err)
+		}
+	}
+	return len(aggiornamenti), tx.Commit()
+}
@@ -6,14 +6,29 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var DB *sql.DB
 
-// InitDB inizializza la connessione al database
+// InitDB apre il database e applica le migrazioni dello schema non ancora eseguite
 func InitDB(dbPath string) error {
+	if err := Apri(dbPath); err != nil {
+		return err
+	}
+
+	if _, err := Migra(); err != nil {
+		return fmt.Errorf("errore migrazione schema: %w", err)
+	}
+
+	log.Println("Database inizializzato correttamente")
+	return nil
+}
+
+// Apri apre la connessione al database senza modificarne lo schema
+func Apri(dbPath string) error {
 	// Crea la directory se non esiste
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -31,12 +46,6 @@ func InitDB(dbPath string) error {
 		return fmt.Errorf("errore connessione database: %w", err)
 	}
 
-	// Crea le tabelle
-	if err = createTables(); err != nil {
-		return fmt.Errorf("errore creazione tabelle: %w", err)
-	}
-
-	log.Println("Database inizializzato correttamente")
 	return nil
 }
 
@@ -47,7 +56,17 @@ func CloseDB() {
 	}
 }
 
-func createTables() error {
+// Istantanea scrive in destPath una copia coerente del database con VACUUM INTO,
+// senza fermare le scritture in corso. destPath non deve esistere.
+func Istantanea(destPath string) error {
+	if _, err := DB.Exec("VACUUM INTO ?", destPath); err != nil {
+		return fmt.Errorf("errore istantanea database: %w", err)
+	}
+	return nil
+}
+
+// createTables crea lo schema iniziale (migrazione 1)
+func createTables(tx *sql.Tx) error {
 	schema := `
 	-- Tabella utenti (tecnici e guest)
 	CREATE TABLE IF NOT EXISTS utenti (
@@ -372,7 +391,7 @@ func createTables() error {
 	CREATE INDEX IF NOT EXISTS idx_righe_ddt_ddt ON righe_ddt(ddt_id);
 	`
 
-	_, err := DB.Exec(schema)
+	_, err := tx.Exec(schema)
 	return err
 }
 
@@ -397,14 +416,14 @@ func CreateDefaultAdmin(hashPassword func(string) (string, error)) error {
 		if err != nil {
 			return err
 		}
-		log.Println("Utente admin predefinito creato (username: admin, password: admin)")
+		log.Println("Utente admin predefinito creato (username: admin, password: admin): al primo accesso sara richiesto il cambio password")
 	}
 
 	return nil
 }
 
-// AddCalendarioTables aggiunge le tabelle per il nuovo calendario trasferte
-func AddCalendarioTables() error {
+// addCalendarioTables aggiunge le tabelle per il nuovo calendario trasferte
+func addCalendarioTables(tx *sql.Tx) error {
 	schema := `
 	-- Tabella calendario giornate (una riga per tecnico per giorno)
 	CREATE TABLE IF NOT EXISTS calendario_giornate (
@@ -443,12 +462,12 @@ func AddCalendarioTables() error {
 	CREATE INDEX IF NOT EXISTS idx_spese_giornata ON spese_giornaliere(giornata_id);
 	`
 
-	_, err := DB.Exec(schema)
+	_, err := tx.Exec(schema)
 	return err
 }
 
-// AddMonitoringTables aggiunge le tabelle per il monitoraggio rete navi
-func AddMonitoringTables() error {
+// addMonitoringTables aggiunge le tabelle per il monitoraggio rete navi
+func addMonitoringTables(tx *sql.Tx) error {
 	schema := `
 	-- Tabella Access Controller (1 per nave)
 	CREATE TABLE IF NOT EXISTS access_controller (
@@ -668,12 +687,12 @@ func AddMonitoringTables() error {
 	CREATE INDEX IF NOT EXISTS idx_guasti_data ON guasti_nave(data_apertura);
 	`
 
-	_, err := DB.Exec(schema)
+	_, err := tx.Exec(schema)
 	return err
 }
 
-// AddClientiTable aggiunge la tabella clienti
-func AddClientiTable() error {
+// addClientiTable aggiunge la tabella clienti
+func addClientiTable(tx *sql.Tx) error {
 	schema := `
 	-- Tabella clienti (destinatari DDT uscita)
 	CREATE TABLE IF NOT EXISTS clienti (
@@ -699,12 +718,12 @@ func AddClientiTable() error {
 	CREATE INDEX IF NOT EXISTS idx_clienti_nome ON clienti(nome);
 	`
 
-	_, err := DB.Exec(schema)
+	_, err := tx.Exec(schema)
 	return err
 }
 
-// AddDDTUscitaTable aggiunge le tabelle per DDT uscita magazzino
-func AddDDTUscitaTable() error {
+// addDDTUscitaTable aggiunge le tabelle per DDT uscita magazzino
+func addDDTUscitaTable(tx *sql.Tx) error {
 	schema := `
 	-- Tabella DDT Uscita (merce in uscita dal magazzino)
 	CREATE TABLE IF NOT EXISTS ddt_uscita (
@@ -747,6 +766,623 @@ func AddDDTUscitaTable() error {
 	CREATE INDEX IF NOT EXISTS idx_righe_ddt_uscita_ddt ON righe_ddt_uscita(ddt_uscita_id);
 	`
 
-	_, err := DB.Exec(schema)
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addSchedulerTables aggiunge le tabelle per la pianificazione dei job di monitoraggio
+func addSchedulerTables(tx *sql.Tx) error {
+	schema := `
+	-- Pianificazione globale per tipo di job (espressione cron a 5 campi)
+	CREATE TABLE IF NOT EXISTS scheduler_job (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tipo TEXT NOT NULL UNIQUE,
+		cron TEXT NOT NULL DEFAULT '0 3 * * 1',
+		abilitato INTEGER NOT NULL DEFAULT 1,
+		ultima_esecuzione DATETIME,
+		ultimo_esito TEXT CHECK(ultimo_esito IN ('ok', 'parziale', 'errore')),
+		ultimo_messaggio TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Override per nave (sostituisce la pianificazione globale per quella nave)
+	CREATE TABLE IF NOT EXISTS scheduler_job_nave (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tipo TEXT NOT NULL,
+		nave_id INTEGER NOT NULL,
+		cron TEXT NOT NULL,
+		abilitato INTEGER NOT NULL DEFAULT 1,
+		ultima_esecuzione DATETIME,
+		ultimo_esito TEXT CHECK(ultimo_esito IN ('ok', 'parziale', 'errore')),
+		ultimo_messaggio TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE,
+		UNIQUE(tipo, nave_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_scheduler_nave ON scheduler_job_nave(nave_id);
+
+	-- Job predefiniti: lunedi alle 03:00 come il vecchio job settimanale
+	INSERT OR IGNORE INTO scheduler_job (tipo) VALUES
+		('scan_ap'), ('scan_mac'), ('backup_config'), ('backup_uffici'), ('backup_sale_server');
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addMonitoringRunTables aggiunge le tabelle per il pool di monitoraggio e il report per apparato
+func addMonitoringRunTables(tx *sql.Tx) error {
+	schema := `
+	-- Limiti di concorrenza e timeout del pool di monitoraggio (riga unica)
+	CREATE TABLE IF NOT EXISTS monitoring_config (
+		id INTEGER PRIMARY KEY CHECK(id = 1),
+		concorrenza_globale INTEGER NOT NULL DEFAULT 8,
+		concorrenza_nave INTEGER NOT NULL DEFAULT 2,
+		timeout_apparato INTEGER NOT NULL DEFAULT 600,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT OR IGNORE INTO monitoring_config (id) VALUES (1);
+
+	-- Esito di ogni operazione su un apparato (una riga per apparato per esecuzione)
+	CREATE TABLE IF NOT EXISTS monitoring_run (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT NOT NULL,
+		job TEXT NOT NULL,
+		sito TEXT,
+		nave_id INTEGER,
+		ufficio_id INTEGER,
+		sala_server_id INTEGER,
+		tipo_apparato TEXT NOT NULL,
+		apparato_id INTEGER NOT NULL,
+		nome_apparato TEXT,
+		ip TEXT,
+		esito TEXT NOT NULL CHECK(esito IN ('ok', 'errore', 'timeout')),
+		messaggio TEXT,
+		inizio DATETIME NOT NULL,
+		fine DATETIME NOT NULL,
+		durata_ms INTEGER,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_monitoring_run_run ON monitoring_run(run_id);
+	CREATE INDEX IF NOT EXISTS idx_monitoring_run_nave ON monitoring_run(nave_id);
+	CREATE INDEX IF NOT EXISTS idx_monitoring_run_inizio ON monitoring_run(inizio);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// esecutore e la connessione o la transazione su cui eseguire le query
+type esecutore interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// esisteColonna indica se la tabella ha la colonna (false se la tabella non esiste)
+func esisteColonna(db esecutore, tabella, colonna string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tabella))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var nome, tipo string
+		var predefinito sql.NullString
+		if err := rows.Scan(&cid, &nome, &tipo, &notNull, &predefinito, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(nome, colonna) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// aggiungiColonna aggiunge una colonna alla tabella solo se non esiste gia
+func aggiungiColonna(db esecutore, tabella, colonna, definizione string) error {
+	esiste, err := esisteColonna(db, tabella, colonna)
+	if err != nil || esiste {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tabella, colonna, definizione))
+	return err
+}
+
+// addConfigDiffColumns aggiunge ai backup configurazione il tracciamento delle modifiche
+// rispetto al backup precedente dello stesso apparato
+func addConfigDiffColumns(tx *sql.Tx) error {
+	colonne := []struct{ nome, definizione string }{
+		{"hash_normalizzato", "TEXT"},
+		{"backup_precedente_id", "INTEGER"},
+		{"cambiato", "INTEGER NOT NULL DEFAULT 0"},
+		{"righe_aggiunte", "INTEGER NOT NULL DEFAULT 0"},
+		{"righe_rimosse", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, tabella := range []string{"config_backup", "config_backup_ufficio"} {
+		for _, c := range colonne {
+			if err := aggiungiColonna(tx, tabella, c.nome, c.definizione); err != nil {
+				return fmt.Errorf("%s.%s: %w", tabella, c.nome, err)
+			}
+		}
+	}
+
+	_, err := tx.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_backup_apparato ON config_backup(tipo_apparato, apparato_id);
+	CREATE INDEX IF NOT EXISTS idx_backup_ufficio_apparato ON config_backup_ufficio(tipo_apparato, apparato_id);
+	`)
+	return err
+}
+
+// addRipristinoConfigTables aggiunge il registro dei ripristini di configurazione sugli apparati
+func addRipristinoConfigTables(tx *sql.Tx) error {
+	schema := `
+	-- Ogni tentativo di ripristino di un backup su un apparato (audit)
+	CREATE TABLE IF NOT EXISTS config_ripristino (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		origine TEXT NOT NULL CHECK(origine IN ('nave', 'ufficio')),
+		backup_id INTEGER NOT NULL,
+		tipo_apparato TEXT NOT NULL,
+		apparato_id INTEGER NOT NULL,
+		nome_apparato TEXT,
+		ip TEXT,
+		modalita TEXT NOT NULL CHECK(modalita IN ('incolla', 'tftp')),
+		righe_aggiunte INTEGER NOT NULL DEFAULT 0,
+		righe_rimosse INTEGER NOT NULL DEFAULT 0,
+		esito TEXT NOT NULL CHECK(esito IN ('ok', 'parziale', 'errore')),
+		messaggio TEXT,
+		output TEXT,
+		utente_id INTEGER,
+		utente TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_config_ripristino_apparato ON config_ripristino(tipo_apparato, apparato_id);
+	`
+
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	// Indirizzo di FurvioGest raggiungibile dagli apparati per il ripristino via TFTP
+	return aggiungiColonna(tx, "monitoring_config", "tftp_server", "TEXT NOT NULL DEFAULT ''")
+}
+
+// addSNMPTables aggiunge i parametri SNMP di navi e apparati e le serie storiche del polling
+func addSNMPTables(tx *sql.Tx) error {
+	// Parametri SNMP della nave, usati da tutti i suoi apparati
+	colonneNave := []struct{ nome, definizione string }{
+		{"snmp_community", "TEXT"},
+		{"snmp_versione", "TEXT NOT NULL DEFAULT 'v2c'"},
+		{"snmp_porta", "INTEGER NOT NULL DEFAULT 161"},
+		{"snmp_utente", "TEXT NOT NULL DEFAULT ''"},
+		{"snmp_auth_protocollo", "TEXT NOT NULL DEFAULT ''"},
+		{"snmp_auth_password", "TEXT NOT NULL DEFAULT ''"},
+		{"snmp_priv_protocollo", "TEXT NOT NULL DEFAULT ''"},
+		{"snmp_priv_password", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range colonneNave {
+		if err := aggiungiColonna(tx, "navi", c.nome, c.definizione); err != nil {
+			return fmt.Errorf("navi.%s: %w", c.nome, err)
+		}
+	}
+	// Community specifica dell'apparato (v2c), se diversa da quella della nave
+	for _, tabella := range []string{"access_controller", "switch_nave"} {
+		if err := aggiungiColonna(tx, tabella, "snmp_community", "TEXT"); err != nil {
+			return fmt.Errorf("%s.snmp_community: %w", tabella, err)
+		}
+	}
+
+	schema := `
+	-- Ultima lettura SNMP di ogni apparato
+	CREATE TABLE IF NOT EXISTS snmp_stato_apparato (
+		tipo_apparato TEXT NOT NULL CHECK(tipo_apparato IN ('ac', 'switch')),
+		apparato_id INTEGER NOT NULL,
+		nave_id INTEGER NOT NULL,
+		sys_name TEXT,
+		sys_descr TEXT,
+		uptime_secondi INTEGER,
+		ultimo_poll DATETIME,
+		ultimo_campione DATETIME,
+		ultimo_errore TEXT,
+		PRIMARY KEY (tipo_apparato, apparato_id),
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	-- Serie storica per apparato: uptime, CPU e memoria (NULL se la marca non li espone)
+	CREATE TABLE IF NOT EXISTS snmp_campioni_apparato (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		tipo_apparato TEXT NOT NULL,
+		apparato_id INTEGER NOT NULL,
+		rilevato_at DATETIME NOT NULL,
+		uptime_secondi INTEGER,
+		cpu_percento INTEGER,
+		memoria_percento INTEGER,
+		riavvio INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	-- Serie storica per interfaccia: contatori grezzi e valori calcolati dal campione precedente
+	CREATE TABLE IF NOT EXISTS snmp_campioni_interfaccia (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		tipo_apparato TEXT NOT NULL,
+		apparato_id INTEGER NOT NULL,
+		if_index INTEGER NOT NULL,
+		nome TEXT,
+		rilevato_at DATETIME NOT NULL,
+		stato_operativo INTEGER NOT NULL,
+		velocita_bps INTEGER,
+		in_ottetti INTEGER,
+		out_ottetti INTEGER,
+		in_errori INTEGER,
+		out_errori INTEGER,
+		in_bps INTEGER,
+		out_bps INTEGER,
+		utilizzo_percento REAL,
+		nuovi_errori INTEGER,
+		cambio_stato INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_snmp_campioni_apparato ON snmp_campioni_apparato(tipo_apparato, apparato_id, rilevato_at);
+	CREATE INDEX IF NOT EXISTS idx_snmp_campioni_interfaccia ON snmp_campioni_interfaccia(tipo_apparato, apparato_id, rilevato_at);
+	CREATE INDEX IF NOT EXISTS idx_snmp_campioni_interfaccia_nave ON snmp_campioni_interfaccia(nave_id, rilevato_at);
+
+	-- Polling ogni 5 minuti: gli apparati delle navi senza SNMP configurato vengono saltati
+	INSERT OR IGNORE INTO scheduler_job (tipo, cron) VALUES ('snmp_poll', '*/5 * * * *');
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addAPStatusLogIndexes prepara ap_status_log per i report di disponibilita
+func addAPStatusLogIndexes(tx *sql.Tx) error {
+	schema := `
+	CREATE INDEX IF NOT EXISTS idx_ap_log_ap_data ON ap_status_log(ap_id, created_at);
+
+	-- Gli AP rilevati prima che i cambi di stato venissero registrati partono
+	-- dallo stato attuale all'ultimo controllo
+	INSERT INTO ap_status_log (ap_id, stato, dettaglio, created_at)
+	SELECT id, stato, 'Stato iniziale', COALESCE(ultimo_check, CURRENT_TIMESTAMP)
+	FROM access_point
+	WHERE id NOT IN (SELECT ap_id FROM ap_status_log);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addRegoleGuastiTables aggiunge le regole di apertura automatica dei guasti
+// e lo stato delle condizioni monitorate per ogni apparato
+func addRegoleGuastiTables(tx *sql.Tx) error {
+	// Apparato a cui si riferisce un guasto automatico
+	colonneGuasti := []struct{ nome, definizione string }{
+		{"tipo_apparato", "TEXT"},
+		{"apparato_id", "INTEGER"},
+		{"occorrenze", "INTEGER NOT NULL DEFAULT 0"},
+		{"ultimo_rilevamento", "DATETIME"},
+	}
+	for _, c := range colonneGuasti {
+		if err := aggiungiColonna(tx, "guasti_nave", c.nome, c.definizione); err != nil {
+			return err
+		}
+	}
+
+	schema := `
+	CREATE TABLE IF NOT EXISTS regole_guasti (
+		condizione TEXT PRIMARY KEY,
+		attiva INTEGER NOT NULL DEFAULT 1,
+		gravita TEXT NOT NULL DEFAULT 'media' CHECK(gravita IN ('bassa', 'media', 'alta')),
+		soglia INTEGER NOT NULL,
+		soglia_escalation INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT OR IGNORE INTO regole_guasti (condizione, gravita, soglia, soglia_escalation) VALUES
+		('apparato_irraggiungibile', 'media', 2, 6),
+		('backup_fallito', 'bassa', 2, 5),
+		('licenze_ac', 'media', 90, 100),
+		('ap_fault', 'alta', 1, 0);
+
+	-- Rilevazioni consecutive della condizione, azzerate quando rientra
+	CREATE TABLE IF NOT EXISTS condizioni_guasto (
+		condizione TEXT NOT NULL,
+		tipo_apparato TEXT NOT NULL,
+		apparato_id INTEGER NOT NULL,
+		nave_id INTEGER NOT NULL,
+		rilevazioni INTEGER NOT NULL DEFAULT 0,
+		valore INTEGER NOT NULL DEFAULT 0,
+		dettaglio TEXT,
+		primo_rilevamento DATETIME NOT NULL,
+		ultimo_rilevamento DATETIME NOT NULL,
+		PRIMARY KEY (condizione, tipo_apparato, apparato_id),
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	-- I guasti AP fault gia aperti sono legati al loro AP
+	UPDATE guasti_nave SET tipo_apparato = 'ap', apparato_id = ap_id
+	WHERE tipo = 'ap_fault' AND apparato_id IS NULL AND ap_id IS NOT NULL;
+
+	-- Un solo guasto automatico aperto per condizione e apparato
+	UPDATE guasti_nave
+	SET stato = 'risolto', data_risoluzione = CURRENT_TIMESTAMP,
+	    descrizione_risoluzione = 'Duplicato - chiuso automaticamente'
+	WHERE tipo != 'manuale' AND stato != 'risolto' AND id NOT IN (
+		SELECT MIN(id) FROM guasti_nave
+		WHERE tipo != 'manuale' AND stato != 'risolto'
+		GROUP BY nave_id, tipo, tipo_apparato, apparato_id
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_guasti_automatici_aperti
+	ON guasti_nave(nave_id, tipo, tipo_apparato, apparato_id)
+	WHERE tipo != 'manuale' AND stato != 'risolto';
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addNotificheTables aggiunge le regole di notifica dei guasti (email e webhook),
+// il registro degli invii e la pianificazione del riepilogo giornaliero
+func addNotificheTables(tx *sql.Tx) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS notifiche_regole (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nome TEXT NOT NULL,
+		canale TEXT NOT NULL CHECK(canale IN ('email', 'webhook')),
+		destinazione TEXT NOT NULL,  -- indirizzi email separati da virgola o URL del webhook
+		segreto TEXT,                -- chiave HMAC per la firma dei webhook
+		compagnia_id INTEGER,        -- NULL = tutte le compagnie
+		nave_id INTEGER,             -- NULL = tutte le navi
+		gravita_minima TEXT NOT NULL DEFAULT 'alta' CHECK(gravita_minima IN ('bassa', 'media', 'alta')),
+		attiva INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (compagnia_id) REFERENCES compagnie(id) ON DELETE CASCADE,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notifiche_invii (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		regola_id INTEGER,
+		guasto_id INTEGER,
+		evento TEXT NOT NULL,  -- aperto, escalation, riepilogo, test
+		canale TEXT NOT NULL,
+		destinazione TEXT NOT NULL,
+		esito TEXT NOT NULL CHECK(esito IN ('ok', 'errore')),
+		messaggio TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (regola_id) REFERENCES notifiche_regole(id) ON DELETE SET NULL,
+		FOREIGN KEY (guasto_id) REFERENCES guasti_nave(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_notifiche_invii_data ON notifiche_invii(created_at);
+
+	-- Riepilogo giornaliero dei guasti aperti inviato ai tecnici
+	CREATE TABLE IF NOT EXISTS notifiche_riepilogo (
+		id INTEGER PRIMARY KEY CHECK(id = 1),
+		abilitato INTEGER NOT NULL DEFAULT 0,
+		cron TEXT NOT NULL DEFAULT '0 7 * * *',
+		ultima_esecuzione DATETIME,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT OR IGNORE INTO notifiche_riepilogo (id) VALUES (1);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addTopologiaTables aggiunge i vicini LLDP rilevati sugli switch di nave,
+// da cui si ricava il grafo della topologia di rete
+func addTopologiaTables(tx *sql.Tx) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS lldp_vicini (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		switch_id INTEGER NOT NULL,
+		porta_locale TEXT NOT NULL,
+		vicino_nome TEXT NOT NULL,  -- system name annunciato dal vicino (switch o AP)
+		porta_vicino TEXT,
+		primo_rilevamento DATETIME NOT NULL,
+		ultimo_rilevamento DATETIME NOT NULL,
+		UNIQUE(switch_id, porta_locale, vicino_nome),
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE,
+		FOREIGN KEY (switch_id) REFERENCES switch_nave(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_lldp_vicini_nave ON lldp_vicini(nave_id);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addPiantinaTables aggiunge le posizioni degli apparati di rete sui disegni della nave
+func addPiantinaTables(tx *sql.Tx) error {
+	schema := `
+	-- Disegni caricati per nave (presente nelle installazioni esistenti, creata se manca)
+	CREATE TABLE IF NOT EXISTS disegni_nave (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		nome TEXT NOT NULL,
+		path TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+
+	-- Posizione di AP, switch e AC sul disegno, in percentuale di larghezza e altezza
+	CREATE TABLE IF NOT EXISTS piantina_posizioni (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		disegno_id INTEGER NOT NULL,
+		tipo_apparato TEXT NOT NULL CHECK(tipo_apparato IN ('ap', 'switch', 'ac')),
+		apparato_id INTEGER NOT NULL,
+		x REAL NOT NULL,
+		y REAL NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(disegno_id, tipo_apparato, apparato_id),
+		FOREIGN KEY (disegno_id) REFERENCES disegni_nave(id) ON DELETE CASCADE
+	);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addSessioniTables crea la tabella delle sessioni di accesso, che sopravvivono al riavvio del server
+func addSessioniTables(tx *sql.Tx) error {
+	schema := `
+	-- Il token resta solo nel cookie: qui se ne salva l'hash SHA-256
+	CREATE TABLE IF NOT EXISTS sessioni (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		utente_id INTEGER NOT NULL,
+		ricorda INTEGER NOT NULL DEFAULT 0,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		ultimo_accesso DATETIME NOT NULL,
+		scadenza DATETIME NOT NULL,
+		FOREIGN KEY (utente_id) REFERENCES utenti(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessioni_utente ON sessioni(utente_id);
+	CREATE INDEX IF NOT EXISTS idx_sessioni_scadenza ON sessioni(scadenza);
+	`
+
+	_, err := tx.Exec(schema)
+	return err
+}
+
+// addTOTPTables aggiunge l'autenticazione a due fattori TOTP: segreto (cifrato) e
+// stato per utente, codici di recupero e obbligo per il ruolo tecnico
+func addTOTPTables(tx *sql.Tx) error {
+	colonne := []struct{ tabella, nome, definizione string }{
+		{"utenti", "totp_segreto", "TEXT NOT NULL DEFAULT ''"},
+		{"utenti", "totp_attivo", "INTEGER NOT NULL DEFAULT 0"},
+		{"utenti", "totp_ultimo_passo", "INTEGER NOT NULL DEFAULT 0"}, // impedisce di riusare lo stesso codice
+		{"impostazioni_azienda", "totp_obbligatorio_tecnici", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range colonne {
+		if err := aggiungiColonna(tx, c.tabella, c.nome, c.definizione); err != nil {
+			return fmt.Errorf("%s.%s: %w", c.tabella, c.nome, err)
+		}
+	}
+
+	_, err := tx.Exec(`
+	-- Codici di recupero monouso, salvati come hash SHA-256
+	CREATE TABLE IF NOT EXISTS codici_recupero (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		utente_id INTEGER NOT NULL,
+		codice_hash TEXT NOT NULL,
+		usato_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (utente_id) REFERENCES utenti(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_codici_recupero_utente ON codici_recupero(utente_id);
+	`)
+	return err
+}
+
+// addSicurezzaTables aggiunge i contatori dei tentativi di accesso falliti, il
+// registro di sicurezza e il cambio password obbligatorio
+func addSicurezzaTables(tx *sql.Tx) error {
+	if err := aggiungiColonna(tx, "utenti", "cambio_password_obbligatorio", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("utenti.cambio_password_obbligatorio: %w", err)
+	}
+
+	_, err := tx.Exec(`
+	-- Tentativi falliti per username e per indirizzo IP (tipo 'utente' o 'ip')
+	CREATE TABLE IF NOT EXISTS blocchi_accesso (
+		tipo TEXT NOT NULL,
+		valore TEXT NOT NULL,
+		fallimenti INTEGER NOT NULL DEFAULT 0,
+		ultimo_fallimento DATETIME NOT NULL,
+		bloccato_fino DATETIME,
+		PRIMARY KEY (tipo, valore)
+	);
+
+	-- Registro degli accessi riusciti e falliti
+	CREATE TABLE IF NOT EXISTS log_sicurezza (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		evento TEXT NOT NULL,
+		username TEXT NOT NULL DEFAULT '',
+		utente_id INTEGER,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		dettagli TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (utente_id) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_log_sicurezza_data ON log_sicurezza(created_at);
+	`)
+	return err
+}
+
+// addRuoliTables aggiunge i ruoli modificabili con le relative autorizzazioni e
+// l'eventuale compagnia a cui e limitato un utente (es. subappaltatori)
+func addRuoliTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- Ruoli: quelli di sistema (tecnico, amministrazione, guest) non si possono eliminare
+	CREATE TABLE IF NOT EXISTS ruoli (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		codice TEXT UNIQUE NOT NULL,
+		nome TEXT NOT NULL,
+		descrizione TEXT NOT NULL DEFAULT '',
+		sistema INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Autorizzazioni concesse a ciascun ruolo (es. rete.backup, magazzino.write)
+	CREATE TABLE IF NOT EXISTS ruoli_autorizzazioni (
+		ruolo_id INTEGER NOT NULL,
+		autorizzazione TEXT NOT NULL,
+		PRIMARY KEY (ruolo_id, autorizzazione),
+		FOREIGN KEY (ruolo_id) REFERENCES ruoli(id) ON DELETE CASCADE
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	colonne := []struct{ nome, definizione string }{
+		{"ruolo_id", "INTEGER REFERENCES ruoli(id)"},
+		{"compagnia_id", "INTEGER REFERENCES compagnie(id) ON DELETE SET NULL"},
+	}
+	for _, c := range colonne {
+		if err := aggiungiColonna(tx, "utenti", c.nome, c.definizione); err != nil {
+			return fmt.Errorf("utenti.%s: %w", c.nome, err)
+		}
+	}
+	return nil
+}
+
+// addAuditTables crea il registro delle modifiche: chi ha creato, modificato o eliminato
+// quale record e con quali valori prima e dopo
+func addAuditTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		utente_id INTEGER,
+		username TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		entita TEXT NOT NULL,
+		entita_id INTEGER NOT NULL DEFAULT 0,
+		azione TEXT NOT NULL CHECK(azione IN ('crea', 'modifica', 'elimina')),
+		modifiche TEXT NOT NULL DEFAULT '{}', -- JSON {campo: {prima, dopo}}
+		percorso TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (utente_id) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_entita ON audit_log(entita, entita_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_data ON audit_log(created_at);
+	`)
 	return err
 }
@@ -0,0 +1,783 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ============================================
+// MIGRAZIONI DELLO SCHEMA
+// ============================================
+
+// migrazione e un passo numerato dello schema, applicato una sola volta in una transazione.
+// Le versioni non si rinumerano mai: ogni modifica allo schema e una nuova voce in fondo.
+type migrazione struct {
+	versione    int
+	descrizione string
+	su          func(tx *sql.Tx) error
+}
+
+// migrazioni e l'elenco ordinato dei passi dello schema. I primi passi riprendono le
+// vecchie funzioni Add*: sono idempotenti e su un database esistente registrano solo
+// la versione.
+var migrazioni = []migrazione{
+	{1, "Schema iniziale", createTables},
+	{2, "Calendario trasferte", addCalendarioTables},
+	{3, "Monitoraggio rete navi", addMonitoringTables},
+	{4, "Pianificazione job di monitoraggio", addSchedulerTables},
+	{5, "Report esecuzioni monitoraggio", addMonitoringRunTables},
+	{6, "Tracciamento modifiche backup configurazione", addConfigDiffColumns},
+	{7, "Registro ripristini configurazione", addRipristinoConfigTables},
+	{8, "Polling SNMP", addSNMPTables},
+	{9, "Storico stati AP per la disponibilita", addAPStatusLogIndexes},
+	{10, "Regole guasti automatici", addRegoleGuastiTables},
+	{11, "Notifiche guasti", addNotificheTables},
+	{12, "Topologia di rete", addTopologiaTables},
+	{13, "Posizioni apparati sui disegni nave", addPiantinaTables},
+	{14, "Sessioni di accesso", addSessioniTables},
+	{15, "Autenticazione a due fattori", addTOTPTables},
+	{16, "Protezione accessi e registro di sicurezza", addSicurezzaTables},
+	{17, "Ruoli e autorizzazioni", addRuoliTables},
+	{18, "Registro delle modifiche", addAuditTables},
+	{19, "Clienti", addClientiTable},
+	{20, "DDT uscita", addDDTUscitaTable},
+	{21, "Colonne anagrafiche compagnie, fornitori, navi e SMTP", addColonneAnagrafiche},
+	{22, "Colonne rapporti, trasferte, permessi, guasti e magazzino", addColonneAttivita},
+	{23, "Colonne apparati di rete", addColonneRete},
+	{24, "Documenti fornitori, DDT entrata e movimenti di acquisto", addDocumentiFornitoriTables},
+	{25, "Attrezzi e materiale descrittivo dei rapporti", addAttrezziTables},
+	{26, "Orari, soste e server delle navi", addOrariNaviTables},
+	{27, "AP degli uffici", addAPUfficioTables},
+	{28, "Backup di sistema", addBackupSistemaTables},
+	{29, "Indice degli allegati per i backup incrementali", addBackupIndiceUploads},
+	{30, "Destinazioni esterne dei backup", addBackupDestinazioni},
+	{31, "Chiave di cifratura dei backup", addBackupCifratura},
+	{32, "Pianificazione del backup automatico", addBackupPianificazione},
+	{33, "Registro dei movimenti di magazzino", addRegistroMagazzino},
+	{34, "Conservazione dello storico esecuzioni monitoraggio", addStoricoMonitoraggio},
+	{35, "Voci generiche nel registro delle modifiche", addAuditRichieste},
+	{36, "Esito delle copie esterne nel log dei backup", addBackupLogDestinazioni},
+}
+
+// StatoMigrazione descrive una migrazione nota al programma o registrata nel database
+type StatoMigrazione struct {
+	Versione    int
+	Descrizione string
+	Applicata   bool
+	ApplicataIl time.Time
+	Sconosciuta bool // registrata nel database ma non presente in questo programma
+}
+
+// creaTabellaMigrazioni crea il registro delle migrazioni applicate
+func creaTabellaMigrazioni() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		versione INTEGER PRIMARY KEY,
+		descrizione TEXT NOT NULL,
+		applicata_il DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// versioniApplicate restituisce le versioni registrate con la data di applicazione
+func versioniApplicate() (map[int]StatoMigrazione, error) {
+	if err := creaTabellaMigrazioni(); err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query("SELECT versione, descrizione, applicata_il FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applicate := make(map[int]StatoMigrazione)
+	for rows.Next() {
+		s := StatoMigrazione{Applicata: true}
+		if err := rows.Scan(&s.Versione, &s.Descrizione, &s.ApplicataIl); err != nil {
+			return nil, err
+		}
+		applicate[s.Versione] = s
+	}
+	return applicate, rows.Err()
+}
+
+// Migra applica in ordine le migrazioni non ancora registrate, ognuna nella propria
+// transazione, e restituisce il numero di migrazioni applicate. Si ferma al primo errore
+// lasciando intatte quelle gia completate.
+func Migra() (int, error) {
+	applicate, err := versioniApplicate()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, m := range migrazioni {
+		if _, ok := applicate[m.versione]; ok {
+			continue
+		}
+		if err := applica(m); err != nil {
+			return n, fmt.Errorf("migrazione %d (%s): %w", m.versione, m.descrizione, err)
+		}
+		log.Printf("Migrazione %d applicata: %s", m.versione, m.descrizione)
+		n++
+	}
+
+	ultima := migrazioni[len(migrazioni)-1].versione
+	for v := range applicate {
+		if v > ultima {
+			log.Printf("Attenzione: il database ha la migrazione %d, sconosciuta a questa versione del programma", v)
+		}
+	}
+	return n, nil
+}
+
+// applica esegue una migrazione e la registra nella stessa transazione
+func applica(m migrazione) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.su(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (versione, descrizione) VALUES (?, ?)",
+		m.versione, m.descrizione); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StatoMigrazioni elenca le migrazioni del programma, applicate e in attesa, seguite da
+// quelle registrate nel database ma sconosciute a questa versione
+func StatoMigrazioni() ([]StatoMigrazione, error) {
+	applicate, err := versioniApplicate()
+	if err != nil {
+		return nil, err
+	}
+
+	var stato []StatoMigrazione
+	note := make(map[int]bool)
+	for _, m := range migrazioni {
+		note[m.versione] = true
+		if s, ok := applicate[m.versione]; ok {
+			s.Descrizione = m.descrizione
+			stato = append(stato, s)
+			continue
+		}
+		stato = append(stato, StatoMigrazione{Versione: m.versione, Descrizione: m.descrizione})
+	}
+	for v, s := range applicate {
+		if !note[v] {
+			s.Sconosciuta = true
+			stato = append(stato, s)
+		}
+	}
+	return stato, nil
+}
+
+// colonna e una colonna da aggiungere a una tabella esistente
+type colonna struct{ tabella, nome, definizione string }
+
+// aggiungiColonne aggiunge le colonne mancanti, indicando nell'errore quella che ha fallito
+func aggiungiColonne(tx *sql.Tx, colonne []colonna) error {
+	for _, c := range colonne {
+		if err := aggiungiColonna(tx, c.tabella, c.nome, c.definizione); err != nil {
+			return fmt.Errorf("%s.%s: %w", c.tabella, c.nome, err)
+		}
+	}
+	return nil
+}
+
+// ============================================
+// COLONNE E TABELLE AGGIUNTE FUORI DAL CODICE
+// ============================================
+
+// Le migrazioni seguenti portano nello schema le colonne e le tabelle usate dagli handler
+// ma finora create a mano sui database in produzione.
+
+// addColonneAnagrafiche aggiunge indirizzi, dati fiscali, foto e contatti delle anagrafiche
+// e le impostazioni SMTP personali e aziendali
+func addColonneAnagrafiche(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"compagnie", "citta", "TEXT"},
+		{"compagnie", "cap", "TEXT"},
+		{"compagnie", "provincia", "TEXT"},
+		{"compagnie", "piva", "TEXT"},
+		{"compagnie", "codice_fiscale", "TEXT"},
+		{"compagnie", "logo", "TEXT"},
+		{"compagnie", "email_destinatari", "TEXT"},
+
+		{"fornitori", "partita_iva", "TEXT"},
+		{"fornitori", "codice_fiscale", "TEXT"},
+		{"fornitori", "cap", "TEXT"},
+		{"fornitori", "citta", "TEXT"},
+		{"fornitori", "provincia", "TEXT"},
+		{"fornitori", "nazione", "TEXT DEFAULT 'Italia'"},
+		{"fornitori", "cellulare", "TEXT"},
+		{"fornitori", "referente", "TEXT"},
+		{"fornitori", "telefono_referente", "TEXT"},
+		{"fornitori", "is_amazon", "INTEGER NOT NULL DEFAULT 0"},
+		{"fornitori", "deleted_at", "DATETIME"},
+
+		{"navi", "sigla", "TEXT"},
+		{"navi", "foto", "TEXT"},
+		{"navi", "piantina_path", "TEXT"},
+		{"navi", "tel_master", "TEXT"},
+		{"navi", "tel_direttore_macchina", "TEXT"},
+		{"navi", "tel_ispettore", "TEXT"},
+		{"navi", "ferma_per_lavori", "INTEGER NOT NULL DEFAULT 0"},
+		{"navi", "data_inizio_lavori", "DATE"},
+		{"navi", "data_fine_lavori_prevista", "DATE"},
+		{"navi", "porto_lavori_id", "INTEGER REFERENCES porti(id) ON DELETE SET NULL"},
+		{"navi", "observium_ip", "TEXT"},
+		{"navi", "observium_user", "TEXT"},
+		{"navi", "observium_pass", "TEXT"},
+		{"navi", "observium_ssh_user", "TEXT"},
+		{"navi", "observium_ssh_pass", "TEXT"},
+		{"navi", "observium_ssh_port", "INTEGER DEFAULT 22"},
+		{"navi", "deleted_at", "DATETIME"},
+
+		{"utenti", "smtp_server", "TEXT"},
+		{"utenti", "smtp_port", "INTEGER DEFAULT 587"},
+		{"utenti", "smtp_user", "TEXT"},
+		{"utenti", "smtp_password", "TEXT"},
+		{"utenti", "deleted_at", "DATETIME"},
+
+		{"automezzi", "deleted_at", "DATETIME"},
+
+		{"impostazioni_azienda", "smtp_server", "TEXT"},
+		{"impostazioni_azienda", "smtp_port", "INTEGER DEFAULT 587"},
+		{"impostazioni_azienda", "smtp_user", "TEXT"},
+		{"impostazioni_azienda", "smtp_password", "TEXT"},
+		{"impostazioni_azienda", "smtp_from_name", "TEXT"},
+		{"impostazioni_azienda", "email_foglio_trasferte", "TEXT"},
+		{"impostazioni_azienda", "email_nota_spese", "TEXT"},
+	})
+}
+
+// addColonneAttivita aggiunge le colonne di rapporti, trasferte, note spese, permessi,
+// guasti, calendario e magazzino usate dagli handler e dalle pagine di amministrazione
+func addColonneAttivita(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"rapporti_intervento", "in_navigazione", "INTEGER NOT NULL DEFAULT 0"},
+		{"rapporti_intervento", "tratta", "TEXT"},
+		{"rapporti_intervento", "deleted_at", "DATETIME"},
+		{"rapporti_intervento", "data_fine", "DATE"},
+		{"rapporti_intervento", "considerazioni_finali", "TEXT"},
+		{"rapporti_intervento", "numero", "TEXT"},
+		{"rapporti_intervento", "tipo_intervento", "TEXT"},
+		{"rapporti_intervento", "stato", "TEXT"},
+		{"rapporti_intervento", "pdf_path", "TEXT"},
+		{"tecnici_rapporto", "ore_lavoro", "REAL NOT NULL DEFAULT 0"},
+
+		{"trasferte", "nave_id", "INTEGER REFERENCES navi(id) ON DELETE SET NULL"},
+		{"trasferte", "automezzo_id", "INTEGER REFERENCES automezzi(id) ON DELETE SET NULL"},
+		{"trasferte", "richiesta_permesso_id", "INTEGER REFERENCES richieste_permesso(id) ON DELETE SET NULL"},
+		{"trasferte", "km_percorsi", "REAL"},
+		{"trasferte", "km_totali", "REAL"},
+		{"trasferte", "indennita_totale", "REAL"},
+		{"trasferte", "motivo", "TEXT"},
+		{"trasferte", "stato", "TEXT"},
+		{"trasferte", "deleted_at", "DATETIME"},
+		{"note_spese", "data_spesa", "DATE"},
+		{"note_spese", "deleted_at", "DATETIME"},
+
+		{"richieste_permesso", "descrizione_intervento", "TEXT"},
+		{"richieste_permesso", "rientro_in_giornata", "INTEGER NOT NULL DEFAULT 0"},
+
+		{"guasti_nave", "tecnico_presa_in_carico_id", "INTEGER REFERENCES utenti(id) ON DELETE SET NULL"},
+		{"guasti_nave", "data_presa_in_carico", "DATETIME"},
+		{"guasti_nave", "note_presa_in_carico", "TEXT"},
+
+		{"calendario_giornate", "ore_permesso", "INTEGER NOT NULL DEFAULT 0"},
+
+		{"movimenti_magazzino", "tipo_movimento", "TEXT"},
+		{"movimenti_magazzino", "data_movimento", "DATE"},
+		{"movimenti_magazzino", "utente_id", "INTEGER REFERENCES utenti(id) ON DELETE SET NULL"},
+		{"prodotti", "quantita", "REAL NOT NULL DEFAULT 0"},
+		{"prodotti", "scorta_minima", "REAL NOT NULL DEFAULT 0"},
+		{"prodotti", "prezzo_acquisto", "REAL"},
+		{"prodotti", "deleted_at", "DATETIME"},
+		{"ddt", "deleted_at", "DATETIME"},
+	})
+}
+
+// addColonneRete aggiunge modello e licenze dei controller, protocollo e porte degli switch
+func addColonneRete(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"access_controller", "modello", "TEXT"},
+		{"access_controller", "protocollo", "TEXT DEFAULT 'ssh'"},
+		{"access_controller", "licenze_totali", "INTEGER"},
+		{"access_controller", "licenze_utilizzate", "INTEGER"},
+
+		{"switch_nave", "protocollo", "TEXT DEFAULT 'ssh'"},
+		{"switch_nave", "porte_totali", "INTEGER"},
+		{"switch_nave", "porte_libere", "INTEGER"},
+		{"switch_ufficio", "porte_totali", "INTEGER"},
+		{"switch_ufficio", "porte_libere", "INTEGER"},
+		{"switch_ufficio", "ultimo_check", "DATETIME"},
+		{"switch_sala_server", "porte_totali", "INTEGER"},
+		{"switch_sala_server", "porte_libere", "INTEGER"},
+		{"switch_sala_server", "ultimo_check", "DATETIME"},
+	})
+}
+
+// addDocumentiFornitoriTables aggiunge DDT e fatture dei fornitori con i movimenti di
+// acquisto collegati, l'archivio PDF e i DDT in entrata
+func addDocumentiFornitoriTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	-- DDT, fatture e ordini ricevuti dai fornitori
+	CREATE TABLE IF NOT EXISTS ddt_fatture (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fornitore_id INTEGER NOT NULL,
+		tipo TEXT NOT NULL CHECK(tipo IN ('ddt', 'fattura', 'ordine')),
+		numero TEXT NOT NULL,
+		data_documento DATE NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (fornitore_id) REFERENCES fornitori(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ddt_fatture_fornitore ON ddt_fatture(fornitore_id);
+
+	-- Prodotti caricati a magazzino con un documento del fornitore
+	CREATE TABLE IF NOT EXISTS movimenti_acquisto (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		prodotto_id INTEGER NOT NULL,
+		ddt_fattura_id INTEGER,
+		quantita INTEGER NOT NULL,
+		note TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (prodotto_id) REFERENCES prodotti(id) ON DELETE CASCADE,
+		FOREIGN KEY (ddt_fattura_id) REFERENCES ddt_fatture(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_movimenti_acquisto_prodotto ON movimenti_acquisto(prodotto_id);
+	CREATE INDEX IF NOT EXISTS idx_movimenti_acquisto_documento ON movimenti_acquisto(ddt_fattura_id);
+
+	-- PDF dei documenti dei fornitori
+	CREATE TABLE IF NOT EXISTS archivio_pdf (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fornitore_id INTEGER NOT NULL,
+		tipo TEXT NOT NULL,
+		numero TEXT,
+		data_documento DATE,
+		file_path TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (fornitore_id) REFERENCES fornitori(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_archivio_pdf_fornitore ON archivio_pdf(fornitore_id);
+
+	-- DDT e fatture in entrata con le righe caricate a magazzino
+	CREATE TABLE IF NOT EXISTS ddt_entrata (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tipo TEXT NOT NULL,
+		numero TEXT NOT NULL,
+		data_documento DATE NOT NULL,
+		fornitore_id INTEGER,
+		pdf_path TEXT,
+		note TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (fornitore_id) REFERENCES fornitori(id) ON DELETE SET NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS ddt_entrata_righe (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ddt_entrata_id INTEGER NOT NULL,
+		prodotto_id INTEGER NOT NULL,
+		quantita INTEGER NOT NULL,
+		prodotto_creato_da_ddt INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (ddt_entrata_id) REFERENCES ddt_entrata(id) ON DELETE CASCADE,
+		FOREIGN KEY (prodotto_id) REFERENCES prodotti(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ddt_entrata_righe_ddt ON ddt_entrata_righe(ddt_entrata_id);
+	`)
+	return err
+}
+
+// addAttrezziTables aggiunge gli attrezzi assegnati ai tecnici con i loro movimenti e il
+// materiale dei rapporti descritto a testo libero
+func addAttrezziTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS attrezzi (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		codice TEXT,
+		nome TEXT NOT NULL,
+		descrizione TEXT,
+		categoria TEXT NOT NULL DEFAULT 'attrezzo' CHECK(categoria IN ('attrezzo', 'consumabile')),
+		marca TEXT,
+		modello TEXT,
+		numero_serie TEXT,
+		data_acquisto TEXT,
+		prezzo_acquisto REAL,
+		fornitore_id INTEGER,
+		stato TEXT NOT NULL DEFAULT 'disponibile' CHECK(stato IN ('disponibile', 'in_uso', 'perso', 'usurato', 'dismesso')),
+		assegnato_a INTEGER,
+		note TEXT,
+		documento_acquisto_path TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		deleted_at DATETIME,
+		FOREIGN KEY (fornitore_id) REFERENCES fornitori(id) ON DELETE SET NULL,
+		FOREIGN KEY (assegnato_a) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_attrezzi_assegnato ON attrezzi(assegnato_a);
+
+	CREATE TABLE IF NOT EXISTS movimenti_attrezzi (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		attrezzo_id INTEGER NOT NULL,
+		tecnico_id INTEGER,
+		tipo TEXT NOT NULL,
+		motivo TEXT,
+		nuovo_stato TEXT,
+		documento_path TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (attrezzo_id) REFERENCES attrezzi(id) ON DELETE CASCADE,
+		FOREIGN KEY (tecnico_id) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_movimenti_attrezzi_attrezzo ON movimenti_attrezzi(attrezzo_id);
+
+	-- Materiale utilizzato o recuperato non presente in magazzino
+	CREATE TABLE IF NOT EXISTS materiale_rapporto_desc (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rapporto_id INTEGER NOT NULL,
+		tipo TEXT NOT NULL CHECK(tipo IN ('utilizzato', 'recuperato')),
+		descrizione_prodotto TEXT NOT NULL,
+		quantita REAL NOT NULL DEFAULT 1,
+		unita TEXT DEFAULT 'pz',
+		FOREIGN KEY (rapporto_id) REFERENCES rapporti_intervento(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_materiale_rapporto_desc ON materiale_rapporto_desc(rapporto_id);
+
+	CREATE TABLE IF NOT EXISTS storico_interventi_nave (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER,
+		rapporto_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE,
+		FOREIGN KEY (rapporto_id) REFERENCES rapporti_intervento(id) ON DELETE CASCADE
+	);
+	`)
+	return err
+}
+
+// addOrariNaviTables aggiunge orari e soste programmate delle navi, i file orari caricati
+// per compagnia e i server di bordo
+func addOrariNaviTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS orari_navi (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		data DATE NOT NULL,
+		porto_partenza_id INTEGER,
+		porto_arrivo_id INTEGER,
+		porto_partenza_nome TEXT,
+		porto_arrivo_nome TEXT,
+		ora_partenza TEXT,
+		ora_arrivo TEXT,
+		note TEXT,
+		fonte TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE,
+		FOREIGN KEY (porto_partenza_id) REFERENCES porti(id) ON DELETE SET NULL,
+		FOREIGN KEY (porto_arrivo_id) REFERENCES porti(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_orari_navi_nave_data ON orari_navi(nave_id, data);
+
+	CREATE TABLE IF NOT EXISTS soste_navi (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		porto_id INTEGER,
+		porto_nome TEXT,
+		data_inizio DATE NOT NULL,
+		data_fine DATE,
+		ora_arrivo TEXT,
+		ora_partenza TEXT,
+		motivo TEXT,
+		note TEXT,
+		fonte TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE,
+		FOREIGN KEY (porto_id) REFERENCES porti(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_soste_navi_nave ON soste_navi(nave_id, data_inizio);
+
+	CREATE TABLE IF NOT EXISTS upload_orari (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		compagnia_id INTEGER NOT NULL,
+		nome_file TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		data_upload DATETIME DEFAULT CURRENT_TIMESTAMP,
+		caricato_da INTEGER,
+		note TEXT,
+		attivo INTEGER NOT NULL DEFAULT 1,
+		FOREIGN KEY (compagnia_id) REFERENCES compagnie(id) ON DELETE CASCADE,
+		FOREIGN KEY (caricato_da) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS server_nave (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nave_id INTEGER NOT NULL,
+		nome TEXT NOT NULL,
+		indirizzo_ip TEXT NOT NULL DEFAULT '',
+		porta INTEGER NOT NULL DEFAULT 443,
+		protocollo TEXT NOT NULL DEFAULT 'https',
+		username TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (nave_id) REFERENCES navi(id) ON DELETE CASCADE
+	);
+	`)
+	return err
+}
+
+// addAPUfficioTables aggiunge gli access point rilevati negli uffici
+func addAPUfficioTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS ap_ufficio (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ufficio_id INTEGER NOT NULL,
+		nome TEXT NOT NULL,
+		mac TEXT,
+		ip TEXT,
+		modello TEXT,
+		stato TEXT DEFAULT 'online',
+		ultimo_scan DATETIME,
+		note TEXT,
+		FOREIGN KEY (ufficio_id) REFERENCES uffici(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ap_ufficio_ufficio ON ap_ufficio(ufficio_id, mac);
+	`)
+	return err
+}
+
+// addBackupSistemaTables aggiunge la configurazione (riga unica) e il registro dei backup
+// di sistema
+func addBackupSistemaTables(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS backup_sistema_config (
+		id INTEGER PRIMARY KEY CHECK(id = 1),
+		nas_abilitato INTEGER NOT NULL DEFAULT 0,
+		nas_path TEXT,
+		nas_username TEXT,
+		nas_password TEXT,
+		retention_days INTEGER NOT NULL DEFAULT 7,
+		ora_backup TEXT DEFAULT '00:00',
+		nas_config_abilitato INTEGER NOT NULL DEFAULT 0,
+		nas_config_retention INTEGER NOT NULL DEFAULT 3,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT OR IGNORE INTO backup_sistema_config (id) VALUES (1);
+
+	CREATE TABLE IF NOT EXISTS backup_sistema_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT NOT NULL,
+		tipo TEXT NOT NULL,
+		dimensione INTEGER NOT NULL DEFAULT 0,
+		locale_ok INTEGER NOT NULL DEFAULT 0,
+		nas_ok INTEGER NOT NULL DEFAULT 0,
+		errore TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backup_sistema_log_data ON backup_sistema_log(created_at);
+	`)
+	return err
+}
+
+// addBackupIndiceUploads crea l'indice degli allegati gia archiviati: per ogni file
+// l'impronta SHA-256 e l'archivio che ne contiene il contenuto
+func addBackupIndiceUploads(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS backup_uploads_indice (
+		percorso TEXT PRIMARY KEY,
+		sha256 TEXT NOT NULL,
+		dimensione INTEGER NOT NULL,
+		modificato_il INTEGER NOT NULL,
+		archivio TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)
+	`)
+	return err
+}
+
+// addBackupDestinazioni crea le destinazioni esterne dei backup (SMB, SFTP, S3, cartella
+// locale) con il registro degli invii, e vi trasferisce il NAS gia configurato
+func addBackupDestinazioni(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS backup_destinazioni (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		nome TEXT NOT NULL,
+		tipo TEXT NOT NULL,
+		abilitata INTEGER NOT NULL DEFAULT 1,
+		percorso TEXT NOT NULL DEFAULT '',
+		host TEXT NOT NULL DEFAULT '',
+		porta INTEGER NOT NULL DEFAULT 0,
+		endpoint TEXT NOT NULL DEFAULT '',
+		bucket TEXT NOT NULL DEFAULT '',
+		regione TEXT NOT NULL DEFAULT '',
+		username TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		impronta_host TEXT NOT NULL DEFAULT '',
+		retention_days INTEGER NOT NULL DEFAULT 7,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS backup_destinazioni_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		destinazione_id INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		ok INTEGER NOT NULL DEFAULT 0,
+		errore TEXT,
+		durata_ms INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (destinazione_id) REFERENCES backup_destinazioni(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backup_destinazioni_log_dest ON backup_destinazioni_log(destinazione_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_backup_destinazioni_log_file ON backup_destinazioni_log(filename);
+
+	INSERT INTO backup_destinazioni (nome, tipo, abilitata, percorso, username, password, retention_days)
+	SELECT 'NAS', 'smb', nas_abilitato, nas_path, COALESCE(nas_username, ''), COALESCE(nas_password, ''), retention_days
+	FROM backup_sistema_config
+	WHERE id = 1 AND COALESCE(nas_path, '') != '';
+	`)
+	return err
+}
+
+// addBackupCifratura aggiunge la passphrase con cui vengono cifrati gli archivi di backup
+// (a sua volta cifrata da internal/segreti; vuota se la cifratura e disattivata)
+func addBackupCifratura(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"backup_sistema_config", "cifratura_chiave", "TEXT DEFAULT ''"},
+	})
+}
+
+// addBackupPianificazione aggiunge lo stato dello scheduler del backup automatico: ultima
+// esecuzione pianificata, tentativi falliti e avvisi via email. L'ultima esecuzione parte
+// dall'ultimo backup automatico, cosi l'aggiornamento non ne avvia subito un altro.
+func addBackupPianificazione(tx *sql.Tx) error {
+	if err := aggiungiColonne(tx, []colonna{
+		{"backup_sistema_config", "ultima_esecuzione", "DATETIME"},
+		{"backup_sistema_config", "tentativi_falliti", "INTEGER NOT NULL DEFAULT 0"},
+		{"backup_sistema_config", "prossimo_tentativo", "DATETIME"},
+		{"backup_sistema_config", "giorni_avviso", "INTEGER NOT NULL DEFAULT 2"},
+		{"backup_sistema_config", "errore_dal", "DATETIME"},
+		{"backup_sistema_config", "ultimo_avviso", "DATETIME"},
+	}); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE backup_sistema_config
+		SET ultima_esecuzione = (SELECT MAX(created_at) FROM backup_sistema_log WHERE tipo = 'automatico')
+		WHERE id = 1
+	`)
+	return err
+}
+
+// addRegistroMagazzino rende movimenti_magazzino il registro da cui deriva la giacenza:
+// aggiunge causale e documento di origine e registra per ogni prodotto un movimento di
+// apertura pari alla differenza tra la giacenza attuale e i movimenti gia presenti.
+// L'apertura e attribuita al primo tecnico (tecnico_id e obbligatorio).
+func addRegistroMagazzino(tx *sql.Tx) error {
+	if err := aggiungiColonne(tx, []colonna{
+		{"movimenti_magazzino", "causale", "TEXT"},
+		{"movimenti_magazzino", "documento_tipo", "TEXT"},
+		{"movimenti_magazzino", "documento_id", "INTEGER"},
+	}); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_movimenti_documento ON movimenti_magazzino(documento_tipo, documento_id)
+	`); err != nil {
+		return err
+	}
+
+	var utenteID int64
+	err := tx.QueryRow(`
+		SELECT id FROM utenti ORDER BY CASE WHEN ruolo = 'tecnico' THEN 0 ELSE 1 END, id LIMIT 1
+	`).Scan(&utenteID)
+	if err == sql.ErrNoRows {
+		return nil // database vuoto: nessuna giacenza da aprire
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO movimenti_magazzino (prodotto_id, tecnico_id, utente_id, quantita, tipo, causale, motivo, data_movimento)
+		SELECT id, ?, ?, ABS(differenza), CASE WHEN differenza > 0 THEN 'carico' ELSE 'scarico' END,
+		       'giacenza_iniziale', 'Apertura del registro di magazzino', DATE('now')
+		FROM (
+			SELECT p.id, p.giacenza - COALESCE(SUM(CASE m.tipo WHEN 'carico' THEN m.quantita ELSE -m.quantita END), 0) AS differenza
+			FROM prodotti p
+			LEFT JOIN movimenti_magazzino m ON m.prodotto_id = p.id
+			GROUP BY p.id
+		)
+		WHERE ABS(differenza) > 0.000001
+	`, utenteID, utenteID)
+	return err
+}
+
+// addStoricoMonitoraggio aggiunge i giorni di conservazione degli esiti in monitoring_run
+func addStoricoMonitoraggio(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"monitoring_config", "giorni_storico", "INTEGER NOT NULL DEFAULT 30"},
+	})
+}
+
+// addAuditRichieste ammette in audit_log le voci generiche delle richieste di scrittura
+// non tracciate dagli handler. SQLite non modifica un vincolo CHECK: la tabella viene
+// ricreata con il vincolo esteso e le voci copiate.
+func addAuditRichieste(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE audit_log_nuovo (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		utente_id INTEGER,
+		username TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		entita TEXT NOT NULL,
+		entita_id INTEGER NOT NULL DEFAULT 0,
+		azione TEXT NOT NULL CHECK(azione IN ('crea', 'modifica', 'elimina', 'richiesta')),
+		modifiche TEXT NOT NULL DEFAULT '{}', -- JSON {campo: {prima, dopo}}
+		percorso TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (utente_id) REFERENCES utenti(id) ON DELETE SET NULL
+	);
+	INSERT INTO audit_log_nuovo (id, created_at, utente_id, username, ip, entita, entita_id, azione, modifiche, percorso)
+	SELECT id, created_at, utente_id, username, ip, entita, entita_id, azione, modifiche, percorso FROM audit_log;
+	DROP TABLE audit_log;
+	ALTER TABLE audit_log_nuovo RENAME TO audit_log;
+	CREATE INDEX IF NOT EXISTS idx_audit_entita ON audit_log(entita, entita_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_data ON audit_log(created_at);
+	`)
+	return err
+}
+
+// addBackupLogDestinazioni registra per ogni backup quante destinazioni esterne erano
+// abilitate e quali non hanno ricevuto la copia. nas_ok, scritta finche c'era un solo NAS,
+// resta nella tabella per le voci precedenti ma non e piu usata.
+func addBackupLogDestinazioni(tx *sql.Tx) error {
+	return aggiungiColonne(tx, []colonna{
+		{"backup_sistema_log", "destinazioni_abilitate", "INTEGER NOT NULL DEFAULT 0"},
+		{"backup_sistema_log", "destinazioni_fallite", "TEXT NOT NULL DEFAULT ''"},
+	})
+}
@@ -0,0 +1,302 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operazione indica se una riga e invariata, aggiunta o rimossa
+type Operazione int
+
+const (
+	Uguale Operazione = iota
+	Aggiunta
+	Rimozione
+)
+
+// limiteModifiche oltre il quale il confronto riga per riga viene abbandonato
+// e la parte centrale e trattata come completamente sostituita
+const limiteModifiche = 3000
+
+// Riga e una riga del confronto con i numeri di riga (1-based, 0 se assente) nei due testi
+type Riga struct {
+	Op    Operazione
+	Testo string
+	NumA  int
+	NumB  int
+}
+
+// Segno restituisce il prefisso della riga in formato unified diff
+func (r Riga) Segno() string {
+	switch r.Op {
+	case Aggiunta:
+		return "+"
+	case Rimozione:
+		return "-"
+	default:
+		return " "
+	}
+}
+
+// Blocco raggruppa modifiche vicine con le righe di contesto
+type Blocco struct {
+	InizioA, LunghezzaA int
+	InizioB, LunghezzaB int
+	Righe               []Riga
+}
+
+// Intestazione restituisce l'intestazione del blocco in formato unified diff
+func (b Blocco) Intestazione() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", b.InizioA, b.LunghezzaA, b.InizioB, b.LunghezzaB)
+}
+
+// Linee divide un testo in righe ignorando i ritorni a capo Windows e l'ultima riga vuota
+func Linee(testo string) []string {
+	testo = strings.ReplaceAll(testo, "\r\n", "\n")
+	testo = strings.TrimSuffix(testo, "\n")
+	if testo == "" {
+		return nil
+	}
+	return strings.Split(testo, "\n")
+}
+
+// Confronta calcola lo script di modifiche minimo da a verso b (algoritmo di Myers)
+func Confronta(a, b []string) []Riga {
+	// Prefisso e suffisso comuni non partecipano al confronto
+	prefisso := 0
+	for prefisso < len(a) && prefisso < len(b) && a[prefisso] == b[prefisso] {
+		prefisso++
+	}
+	suffisso := 0
+	for suffisso < len(a)-prefisso && suffisso < len(b)-prefisso && a[len(a)-1-suffisso] == b[len(b)-1-suffisso] {
+		suffisso++
+	}
+
+	var righe []Riga
+	for i := 0; i < prefisso; i++ {
+		righe = append(righe, Riga{Op: Uguale, Testo: a[i], NumA: i + 1, NumB: i + 1})
+	}
+	for _, r := range myers(a[prefisso:len(a)-suffisso], b[prefisso:len(b)-suffisso]) {
+		if r.NumA > 0 {
+			r.NumA += prefisso
+		}
+		if r.NumB > 0 {
+			r.NumB += prefisso
+		}
+		righe = append(righe, r)
+	}
+	for i := suffisso; i > 0; i-- {
+		righe = append(righe, Riga{Op: Uguale, Testo: a[len(a)-i], NumA: len(a) - i + 1, NumB: len(b) - i + 1})
+	}
+	return righe
+}
+
+// myers calcola le modifiche tra a e b; oltre limiteModifiche sostituisce tutto il blocco
+func myers(a, b []string) []Riga {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// traccia[d] contiene v[-d..d] al termine del passo d
+	var traccia [][]int
+	fine := -1
+
+	for d := 0; d <= max && d <= limiteModifiche; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				fine = d
+				break
+			}
+		}
+		traccia = append(traccia, append([]int(nil), v[off-d:off+d+1]...))
+		if fine >= 0 {
+			break
+		}
+	}
+
+	if fine < 0 {
+		return sostituzione(a, b)
+	}
+
+	// Ricostruisce il percorso a ritroso
+	var inverso []Riga
+	x, y := n, m
+	for d := fine; d > 0; d-- {
+		prec := traccia[d-1]
+		val := func(k int) int { return prec[k+d-1] }
+		k := x - y
+		var kPrec int
+		if k == -d || (k != d && val(k-1) < val(k+1)) {
+			kPrec = k + 1
+		} else {
+			kPrec = k - 1
+		}
+		xPrec := val(kPrec)
+		yPrec := xPrec - kPrec
+		for x > xPrec && y > yPrec {
+			inverso = append(inverso, Riga{Op: Uguale, Testo: a[x-1], NumA: x, NumB: y})
+			x--
+			y--
+		}
+		if kPrec == k+1 {
+			inverso = append(inverso, Riga{Op: Aggiunta, Testo: b[y-1], NumB: y})
+		} else {
+			inverso = append(inverso, Riga{Op: Rimozione, Testo: a[x-1], NumA: x})
+		}
+		x, y = xPrec, yPrec
+	}
+	for x > 0 && y > 0 {
+		inverso = append(inverso, Riga{Op: Uguale, Testo: a[x-1], NumA: x, NumB: y})
+		x--
+		y--
+	}
+
+	righe := make([]Riga, len(inverso))
+	for i, r := range inverso {
+		righe[len(inverso)-1-i] = r
+	}
+	return righe
+}
+
+// sostituzione rappresenta a come interamente rimosso e b come interamente aggiunto
+func sostituzione(a, b []string) []Riga {
+	righe := make([]Riga, 0, len(a)+len(b))
+	for i, s := range a {
+		righe = append(righe, Riga{Op: Rimozione, Testo: s, NumA: i + 1})
+	}
+	for i, s := range b {
+		righe = append(righe, Riga{Op: Aggiunta, Testo: s, NumB: i + 1})
+	}
+	return righe
+}
+
+// Conta restituisce il numero di righe aggiunte e rimosse
+func Conta(righe []Riga) (aggiunte, rimosse int) {
+	for _, r := range righe {
+		switch r.Op {
+		case Aggiunta:
+			aggiunte++
+		case Rimozione:
+			rimosse++
+		}
+	}
+	return aggiunte, rimosse
+}
+
+// Blocchi raggruppa le modifiche con il numero di righe di contesto indicato
+func Blocchi(righe []Riga, contesto int) []Blocco {
+	var blocchi []Blocco
+	i := 0
+	for i < len(righe) {
+		// Cerca la prossima modifica
+		for i < len(righe) && righe[i].Op == Uguale {
+			i++
+		}
+		if i >= len(righe) {
+			break
+		}
+
+		inizio := i - contesto
+		if inizio < 0 {
+			inizio = 0
+		}
+		// Estende il blocco finche le modifiche distano meno di 2*contesto righe
+		fine := i
+		for fine < len(righe) {
+			if righe[fine].Op != Uguale {
+				fine++
+				continue
+			}
+			j := fine
+			for j < len(righe) && righe[j].Op == Uguale {
+				j++
+			}
+			if j >= len(righe) || j-fine > 2*contesto {
+				fine += contesto
+				if fine > len(righe) {
+					fine = len(righe)
+				}
+				break
+			}
+			fine = j
+		}
+
+		blocchi = append(blocchi, nuovoBlocco(righe, inizio, fine))
+		i = fine
+	}
+	return blocchi
+}
+
+// nuovoBlocco calcola posizione e lunghezza del blocco nei due testi
+func nuovoBlocco(righe []Riga, inizio, fine int) Blocco {
+	b := Blocco{Righe: righe[inizio:fine]}
+	for _, r := range b.Righe {
+		if r.NumA > 0 {
+			if b.InizioA == 0 {
+				b.InizioA = r.NumA
+			}
+			b.LunghezzaA++
+		}
+		if r.NumB > 0 {
+			if b.InizioB == 0 {
+				b.InizioB = r.NumB
+			}
+			b.LunghezzaB++
+		}
+	}
+	// Un blocco vuoto su un lato indica la riga dopo cui inserire (convenzione unified diff)
+	if b.LunghezzaA == 0 {
+		b.InizioA = precedente(righe[:inizio], func(r Riga) int { return r.NumA })
+	}
+	if b.LunghezzaB == 0 {
+		b.InizioB = precedente(righe[:inizio], func(r Riga) int { return r.NumB })
+	}
+	return b
+}
+
+// precedente restituisce l'ultimo numero di riga valorizzato prima del blocco
+func precedente(righe []Riga, num func(Riga) int) int {
+	for i := len(righe) - 1; i >= 0; i-- {
+		if n := num(righe[i]); n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// Unificato restituisce il confronto in formato unified diff
+func Unificato(nomeA, nomeB string, righe []Riga, contesto int) string {
+	blocchi := Blocchi(righe, contesto)
+	if len(blocchi) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nomeA, nomeB)
+	for _, b := range blocchi {
+		sb.WriteString(b.Intestazione())
+		sb.WriteByte('\n')
+		for _, r := range b.Righe {
+			sb.WriteString(r.Segno())
+			sb.WriteString(r.Testo)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
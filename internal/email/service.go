@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"furviogest/internal/models"
+	"furviogest/internal/segreti"
 )
 
 // SMTPConfig configurazione SMTP
@@ -347,7 +348,7 @@ func ConfigDaImpostazioni(imp *models.ImpostazioniAzienda) SMTPConfig {
 		Server:   imp.SMTPServer,
 		Port:     port,
 		User:     imp.SMTPUser,
-		Password: imp.SMTPPassword,
+		Password: segreti.Leggi(imp.SMTPPassword),
 		FromName: fromName,
 		FromAddr: imp.Email,
 	}
@@ -30,10 +30,14 @@ func DashboardAmministrazione(w http.ResponseWriter, r *http.Request) {
 	// Statistiche per la dashboard
 	var totProdotti, totRapporti, totNoteSpese, totTrasferte, totDDT int
 	database.DB.QueryRow("SELECT COUNT(*) FROM prodotti WHERE deleted_at IS NULL").Scan(&totProdotti)
-	database.DB.QueryRow("SELECT COUNT(*) FROM rapporti_intervento WHERE deleted_at IS NULL").Scan(&totRapporti)
+	database.DB.QueryRow(`
+		SELECT COUNT(*) FROM rapporti_intervento r LEFT JOIN navi n ON r.nave_id = n.id
+		WHERE r.deleted_at IS NULL AND (? = 0 OR n.compagnia_id = ?)
+	`, session.CompagniaID, session.CompagniaID).Scan(&totRapporti)
 	database.DB.QueryRow("SELECT COUNT(*) FROM note_spese WHERE deleted_at IS NULL").Scan(&totNoteSpese)
 	database.DB.QueryRow("SELECT COUNT(*) FROM trasferte WHERE deleted_at IS NULL").Scan(&totTrasferte)
-	database.DB.QueryRow("SELECT COUNT(*) FROM ddt WHERE deleted_at IS NULL").Scan(&totDDT)
+	database.DB.QueryRow("SELECT COUNT(*) FROM ddt WHERE deleted_at IS NULL AND (? = 0 OR compagnia_id = ?)",
+		session.CompagniaID, session.CompagniaID).Scan(&totDDT)
 
 	// Lista tecnici per filtri
 	tecnici, _ := getTecniciList()
@@ -194,10 +198,10 @@ func ListaRapportiAmministrazione(w http.ResponseWriter, r *http.Request) {
 		LEFT JOIN compagnie c ON n.compagnia_id = c.id
 		LEFT JOIN tecnici_rapporto rt ON r.id = rt.rapporto_id
 		LEFT JOIN utenti u ON rt.tecnico_id = u.id
-		WHERE r.deleted_at IS NULL
+		WHERE r.deleted_at IS NULL AND (? = 0 OR n.compagnia_id = ?)
 	`
 
-	var args []interface{}
+	args := []interface{}{session.CompagniaID, session.CompagniaID}
 	if tecnicoFilter != "" {
 		query += " AND rt.tecnico_id = ?"
 		args = append(args, tecnicoFilter)
@@ -696,10 +700,10 @@ func DDTAmministrazione(w http.ResponseWriter, r *http.Request) {
 		LEFT JOIN navi n ON d.nave_id = n.id
 		LEFT JOIN compagnie c ON d.compagnia_id = c.id
 		LEFT JOIN porti p ON d.porto_id = p.id
-		WHERE 1=1
+		WHERE (? = 0 OR d.compagnia_id = ?)
 	`
 
-	var args []interface{}
+	args := []interface{}{session.CompagniaID, session.CompagniaID}
 	if meseFilter != "" && annoFilter != "" {
 		query += " AND strftime('%m', d.data_emissione) = ? AND strftime('%Y', d.data_emissione) = ?"
 		args = append(args, meseFilter, annoFilter)
@@ -846,10 +850,10 @@ func ExportDDTCSV(w http.ResponseWriter, r *http.Request) {
 		LEFT JOIN navi n ON d.nave_id = n.id
 		LEFT JOIN compagnie c ON d.compagnia_id = c.id
 		LEFT JOIN porti p ON d.porto_id = p.id
-		WHERE 1=1
+		WHERE (? = 0 OR d.compagnia_id = ?)
 	`
 
-	var args []interface{}
+	args := []interface{}{session.CompagniaID, session.CompagniaID}
 	if meseFilter != "" && annoFilter != "" {
 		query += " AND strftime('%m', d.data_emissione) = ? AND strftime('%Y', d.data_emissione) = ?"
 		args = append(args, meseFilter, annoFilter)
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
 	"furviogest/internal/models"
 	"io"
@@ -121,7 +122,7 @@ func NuovoFornitore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := database.DB.Exec(`
+	_, err := creaConAudit(r, "fornitori", `
 		INSERT INTO fornitori (nome, partita_iva, codice_fiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefono_referente, note)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, nome, partitaIVA, codiceFiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefonoReferente, note)
@@ -234,7 +235,7 @@ func ModificaFornitore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "fornitori", id, `
 		UPDATE fornitori SET nome = ?, partita_iva = ?, codice_fiscale = ?, indirizzo = ?, cap = ?, citta = ?, provincia = ?, nazione = ?, telefono = ?, cellulare = ?, email = ?, referente = ?, telefono_referente = ?, note = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`, nome, partitaIVA, codiceFiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefonoReferente, note, id)
@@ -270,6 +271,10 @@ func EliminaFornitore(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/fornitori", http.StatusSeeOther)
 		return
 	}
+	traccia := audit.Nuova(r, tx)
+	traccia.Elimina("fornitori", id)
+	traccia.Righe("ddt_fatture", "fornitore_id = ?", id)
+	traccia.Righe("archivio_pdf", "fornitore_id = ?", id)
 
 	// 1. Trova tutti i DDT di questo fornitore
 	ddtRows, _ := tx.Query(`SELECT id FROM ddt_fatture WHERE fornitore_id = ?`, id)
@@ -284,19 +289,15 @@ func EliminaFornitore(w http.ResponseWriter, r *http.Request) {
 	// 2. Per ogni DDT, trova prodotti collegati e ricalcola giacenze
 	var prodottiDaVerificare []int64
 	for _, ddtID := range ddtIDs {
-		movRows, _ := tx.Query(`SELECT prodotto_id, quantita FROM movimenti_acquisto WHERE ddt_fattura_id = ?`, ddtID)
-		
-		for movRows.Next() {
-			var prodID int64
-			var qta int
-			movRows.Scan(&prodID, &qta)
-			
-			// Sottrai giacenza
-			tx.Exec(`UPDATE prodotti SET giacenza = giacenza - ? WHERE id = ?`, qta, prodID)
-			prodottiDaVerificare = append(prodottiDaVerificare, prodID)
-		}
-		movRows.Close()
-		
+		// Sottrai giacenza
+		prodotti, err := stornaAcquistiDDTFattura(tx, ddtID, utenteMovimento(r))
+		if err != nil {
+			tx.Rollback()
+			http.Redirect(w, r, "/fornitori", http.StatusSeeOther)
+			return
+		}
+		prodottiDaVerificare = append(prodottiDaVerificare, prodotti...)
+
 		// Elimina movimenti_acquisto del DDT
 		tx.Exec(`DELETE FROM movimenti_acquisto WHERE ddt_fattura_id = ?`, ddtID)
 	}
@@ -322,6 +323,7 @@ func EliminaFornitore(w http.ResponseWriter, r *http.Request) {
 		tx.QueryRow(`SELECT COUNT(*) FROM movimenti_acquisto WHERE prodotto_id = ?`, prodID).Scan(&countMov)
 		if countMov == 0 {
 			// Nessun altro movimento, elimina prodotto non-spare
+			traccia.Elimina("prodotti", prodID)
 			tx.Exec(`DELETE FROM prodotti WHERE id = ? AND origine = 'nuovo'`, prodID)
 		}
 	}
@@ -329,6 +331,11 @@ func EliminaFornitore(w http.ResponseWriter, r *http.Request) {
 	// 6. Elimina il fornitore
 	tx.Exec(`DELETE FROM fornitori WHERE id = ?`, id)
 
+	if err := traccia.Concludi(); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/fornitori", http.StatusSeeOther)
+		return
+	}
 	tx.Commit()
 	http.Redirect(w, r, "/fornitori", http.StatusSeeOther)
 }
@@ -450,7 +457,7 @@ func NuovoPorto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := database.DB.Exec(`
+	_, err := creaConAudit(r, "porti", `
 		INSERT INTO porti (nome, citta, paese, nome_agenzia, email_agenzia, telefono_agenzia, note)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`, nome, citta, paese, nomeAgenzia, emailAgenzia, telefonoAgenzia, note)
@@ -534,7 +541,7 @@ func ModificaPorto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "porti", id, `
 		UPDATE porti SET nome = ?, citta = ?, paese = ?, nome_agenzia = ?, email_agenzia = ?, telefono_agenzia = ?, note = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`, nome, citta, paese, nomeAgenzia, emailAgenzia, telefonoAgenzia, note, id)
@@ -556,7 +563,7 @@ func EliminaPorto(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
-	database.DB.Exec("DELETE FROM porti WHERE id = ?", id)
+	eliminaConAudit(r, "porti", id, "DELETE FROM porti WHERE id = ?", id)
 	http.Redirect(w, r, "/porti", http.StatusSeeOther)
 }
 
@@ -657,7 +664,7 @@ func NuovoAutomezzo(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	_, err = database.DB.Exec(`
+	_, err = creaConAudit(r, "automezzi", `
 		INSERT INTO automezzi (targa, marca, modello, note, libretto_path)
 		VALUES (?, ?, ?, ?, ?)
 	`, targa, marca, modello, note, librettoPath)
@@ -755,7 +762,7 @@ func ModificaAutomezzo(w http.ResponseWriter, r *http.Request) {
 			io.Copy(dst, file)
 			librettoPath := "uploads/libretti/" + newFileName
 			// Aggiorna con nuovo libretto
-			_, err = database.DB.Exec(`
+			err = modificaConAudit(r, "automezzi", id, `
 				UPDATE automezzi SET targa = ?, marca = ?, modello = ?, note = ?, libretto_path = ?, updated_at = CURRENT_TIMESTAMP
 				WHERE id = ?
 			`, targa, marca, modello, note, librettoPath, id)
@@ -770,7 +777,7 @@ func ModificaAutomezzo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Aggiorna senza modificare libretto
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "automezzi", id, `
 		UPDATE automezzi SET targa = ?, marca = ?, modello = ?, note = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`, targa, marca, modello, note, id)
@@ -792,7 +799,7 @@ func EliminaAutomezzo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
-	database.DB.Exec("DELETE FROM automezzi WHERE id = ?", id)
+	eliminaConAudit(r, "automezzi", id, "DELETE FROM automezzi WHERE id = ?", id)
 	http.Redirect(w, r, "/automezzi", http.StatusSeeOther)
 }
 
@@ -805,8 +812,8 @@ func ListaCompagnie(w http.ResponseWriter, r *http.Request) {
 
 	rows, err := database.DB.Query(`
 		SELECT id, nome, indirizzo, telefono, email, note, created_at
-		FROM compagnie ORDER BY nome
-	`)
+		FROM compagnie WHERE ? = 0 OR id = ? ORDER BY nome
+	`, data.Session.CompagniaID, data.Session.CompagniaID)
 	if err != nil {
 		data.Error = "Errore nel recupero delle compagnie"
 		renderTemplate(w, "compagnie_lista.html", data)
@@ -872,7 +879,7 @@ func NuovaCompagnia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisci compagnia
-	result, err := database.DB.Exec(`
+	compagniaID, err := creaConAudit(r, "compagnie", `
 		INSERT INTO compagnie (nome, indirizzo, citta, cap, provincia, piva, codice_fiscale, telefono, email, note, email_destinatari)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, nome, indirizzo, citta, cap, provincia, piva, codiceFiscale, telefono, emailVal, note, emailDestinatari)
@@ -887,10 +894,9 @@ func NuovaCompagnia(w http.ResponseWriter, r *http.Request) {
 	file, header, err := r.FormFile("logo")
 	if err == nil && header != nil {
 		defer file.Close()
-		compagniaID, _ := result.LastInsertId()
 		logoPath := saveCompagniaLogo(compagniaID, file, header)
 		if logoPath != "" {
-			database.DB.Exec("UPDATE compagnie SET logo = ? WHERE id = ?", logoPath, compagniaID)
+			modificaConAudit(r, "compagnie", compagniaID, "UPDATE compagnie SET logo = ? WHERE id = ?", logoPath, compagniaID)
 		}
 	}
 
@@ -965,7 +971,7 @@ func ModificaCompagnia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "compagnie", id, `
 		UPDATE compagnie SET nome = ?, indirizzo = ?, citta = ?, cap = ?, provincia = ?, 
 		       piva = ?, codice_fiscale = ?, telefono = ?, email = ?, note = ?, 
 		       email_destinatari = ?, updated_at = CURRENT_TIMESTAMP
@@ -984,7 +990,7 @@ func ModificaCompagnia(w http.ResponseWriter, r *http.Request) {
 		defer file.Close()
 		logoPath := saveCompagniaLogo(id, file, header)
 		if logoPath != "" {
-			database.DB.Exec("UPDATE compagnie SET logo = ? WHERE id = ?", logoPath, id)
+			modificaConAudit(r, "compagnie", id, "UPDATE compagnie SET logo = ? WHERE id = ?", logoPath, id)
 		}
 	}
 
@@ -1050,7 +1056,7 @@ func EliminaCompagnia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
-	database.DB.Exec("DELETE FROM compagnie WHERE id = ?", id)
+	eliminaConAudit(r, "compagnie", id, "DELETE FROM compagnie WHERE id = ?", id)
 	http.Redirect(w, r, "/compagnie", http.StatusSeeOther)
 }
 
@@ -1079,8 +1085,9 @@ func ListaNavi(w http.ResponseWriter, r *http.Request) {
 		       c.id as cid, COALESCE(c.logo, '') as logo
 		FROM navi n
 		JOIN compagnie c ON n.compagnia_id = c.id
+		WHERE ? = 0 OR n.compagnia_id = ?
 		ORDER BY c.nome, n.nome
-	`)
+	`, data.Session.CompagniaID, data.Session.CompagniaID)
 	if err != nil {
 		data.Error = "Errore nel recupero delle navi"
 		renderTemplate(w, "navi_lista.html", data)
@@ -1243,7 +1250,7 @@ func NuovaNave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := database.DB.Exec(`
+	lastID, err := creaConAudit(r, "navi", `
 		INSERT INTO navi (compagnia_id, nome, imo, email_master, email_direttore_macchina, sigla,
 		                  email_ispettore, tel_master, tel_direttore_macchina, tel_ispettore,
 		                  note, ferma_per_lavori, data_inizio_lavori, data_fine_lavori_prevista)
@@ -1260,14 +1267,12 @@ func NuovaNave(w http.ResponseWriter, r *http.Request) {
 
 
 	// Gestione upload foto
-	var lastID int64
-	database.DB.QueryRow("SELECT last_insert_rowid()").Scan(&lastID)
 	file, header, fotoErr := r.FormFile("foto")
 	if fotoErr == nil && header.Size > 0 {
 		defer file.Close()
 		fotoPath := saveNaveFoto(lastID, file, header)
 		if fotoPath != "" {
-			database.DB.Exec("UPDATE navi SET foto = ? WHERE id = ?", fotoPath, lastID)
+			modificaConAudit(r, "navi", lastID, "UPDATE navi SET foto = ? WHERE id = ?", fotoPath, lastID)
 		}
 	}
 
@@ -1384,7 +1389,7 @@ func ModificaNave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "navi", id, `
 		UPDATE navi SET compagnia_id = ?, nome = ?, imo = ?, sigla = ?, email_master = ?,
 		       email_direttore_macchina = ?, email_ispettore = ?,
 		       tel_master = ?, tel_direttore_macchina = ?, tel_ispettore = ?,
@@ -1408,7 +1413,7 @@ func ModificaNave(w http.ResponseWriter, r *http.Request) {
 		defer file.Close()
 		fotoPath := saveNaveFoto(id, file, header)
 		if fotoPath != "" {
-			database.DB.Exec("UPDATE navi SET foto = ? WHERE id = ?", fotoPath, id)
+			modificaConAudit(r, "navi", id, "UPDATE navi SET foto = ? WHERE id = ?", fotoPath, id)
 		}
 	}
 
@@ -1423,7 +1428,7 @@ func EliminaNave(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
-	database.DB.Exec("DELETE FROM navi WHERE id = ?", id)
+	eliminaConAudit(r, "navi", id, "DELETE FROM navi WHERE id = ?", id)
 	http.Redirect(w, r, "/navi", http.StatusSeeOther)
 }
 
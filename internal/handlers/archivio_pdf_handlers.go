@@ -180,7 +180,7 @@ func NuovoArchivioPDF(w http.ResponseWriter, r *http.Request) {
 	io.Copy(dst, file)
 
 	// Inserisci record nel database
-	_, err = database.DB.Exec(`
+	_, err = creaConAudit(r, "archivio_pdf", `
 		INSERT INTO archivio_pdf (fornitore_id, tipo, numero, data_documento, file_path, note)
 		VALUES (?, ?, ?, ?, ?, ?)
 	`, fornitoreID, tipo, numero, dataDoc, filename, note)
@@ -282,7 +282,7 @@ func EliminaArchivioPDF(w http.ResponseWriter, r *http.Request) {
 	database.DB.QueryRow(`SELECT file_path FROM archivio_pdf WHERE id = ?`, id).Scan(&filePath)
 
 	// Elimina record
-	database.DB.Exec(`DELETE FROM archivio_pdf WHERE id = ?`, id)
+	eliminaConAudit(r, "archivio_pdf", id, `DELETE FROM archivio_pdf WHERE id = ?`, id)
 
 	// Elimina file
 	if filePath != "" {
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
 	"furviogest/internal/middleware"
 	"furviogest/internal/models"
@@ -193,12 +195,25 @@ func NuovoAttrezzo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisce attrezzo
-	result, err := database.DB.Exec(`
-		INSERT INTO attrezzi (codice, nome, descrizione, categoria, marca, modello, numero_serie,
-		                      data_acquisto, prezzo_acquisto, fornitore_id, note, documento_acquisto_path)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, codice, nome, descrizione, categoria, marca, modello, numeroSerie,
-		dataAcquisto, prezzo, fornitoreID, note, documentoPath)
+	session := middleware.GetSession(r)
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		attrezzoID, err := t.Inserisci("attrezzi", `
+			INSERT INTO attrezzi (codice, nome, descrizione, categoria, marca, modello, numero_serie,
+			                      data_acquisto, prezzo_acquisto, fornitore_id, note, documento_acquisto_path)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, codice, nome, descrizione, categoria, marca, modello, numeroSerie,
+			dataAcquisto, prezzo, fornitoreID, note, documentoPath)
+		if err != nil {
+			return err
+		}
+
+		// Registra movimento carico
+		_, err = t.Inserisci("movimenti_attrezzi", `
+			INSERT INTO movimenti_attrezzi (attrezzo_id, tecnico_id, tipo, motivo, nuovo_stato, documento_path)
+			VALUES (?, ?, 'carico', 'Nuovo acquisto', 'disponibile', ?)
+		`, attrezzoID, session.UserID, documentoPath)
+		return err
+	})
 	if err != nil {
 		data.Error = "Errore durante il salvataggio"
 		data.Data = formData
@@ -206,14 +221,6 @@ func NuovoAttrezzo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Registra movimento carico
-	attrezzoID, _ := result.LastInsertId()
-	session := middleware.GetSession(r)
-	database.DB.Exec(`
-		INSERT INTO movimenti_attrezzi (attrezzo_id, tecnico_id, tipo, motivo, nuovo_stato, documento_path)
-		VALUES (?, ?, 'carico', 'Nuovo acquisto', 'disponibile', ?)
-	`, attrezzoID, session.UserID, documentoPath)
-
 	http.Redirect(w, r, "/attrezzi", http.StatusSeeOther)
 }
 
@@ -285,7 +292,7 @@ func ModificaAttrezzo(w http.ResponseWriter, r *http.Request) {
 		fornitoreID = &fid
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "attrezzi", attrezzoID, `
 		UPDATE attrezzi SET codice = ?, nome = ?, descrizione = ?, categoria = ?, marca = ?,
 		       modello = ?, numero_serie = ?, data_acquisto = ?, prezzo_acquisto = ?,
 		       fornitore_id = ?, note = ?, updated_at = CURRENT_TIMESTAMP
@@ -311,7 +318,13 @@ func EliminaAttrezzo(w http.ResponseWriter, r *http.Request) {
 	}
 	attrezzoID, _ := strconv.ParseInt(pathParts[3], 10, 64)
 
-	database.DB.Exec("UPDATE attrezzi SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", attrezzoID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("attrezzi", attrezzoID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE attrezzi SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", attrezzoID)
+		return err
+	})
 	http.Redirect(w, r, "/attrezzi", http.StatusSeeOther)
 }
 
@@ -409,16 +422,25 @@ func MovimentoAttrezzoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Aggiorna attrezzo
-	database.DB.Exec(`
-		UPDATE attrezzi SET stato = ?, assegnato_a = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
-	`, nuovoStato, nuovoAssegnato, attrezzoID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica("attrezzi", attrezzoID); err != nil {
+			return err
+		}
+
+		// Aggiorna attrezzo
+		if _, err := tx.Exec(`
+			UPDATE attrezzi SET stato = ?, assegnato_a = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+		`, nuovoStato, nuovoAssegnato, attrezzoID); err != nil {
+			return err
+		}
 
-	// Registra movimento
-	database.DB.Exec(`
-		INSERT INTO movimenti_attrezzi (attrezzo_id, tecnico_id, tipo, motivo, nuovo_stato)
-		VALUES (?, ?, ?, ?, ?)
-	`, attrezzoID, session.UserID, tipoMov, motivo, nuovoStato)
+		// Registra movimento
+		_, err := t.Inserisci("movimenti_attrezzi", `
+			INSERT INTO movimenti_attrezzi (attrezzo_id, tecnico_id, tipo, motivo, nuovo_stato)
+			VALUES (?, ?, ?, ?, ?)
+		`, attrezzoID, session.UserID, tipoMov, motivo, nuovoStato)
+		return err
+	})
 
 	http.Redirect(w, r, "/attrezzi/movimento/"+strconv.FormatInt(attrezzoID, 10), http.StatusSeeOther)
 }
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/database"
+)
+
+// vociAuditMostrate e il numero massimo di voci del registro mostrate nella pagina;
+// l'esportazione CSV non ha limiti
+const vociAuditMostrate = 500
+
+// filtroAudit legge i filtri della ricerca dalla query string. Le date sono giorni
+// interi: "al" comprende tutto il giorno indicato.
+func filtroAudit(r *http.Request) audit.Filtro {
+	q := r.URL.Query()
+	f := audit.Filtro{
+		Username: strings.TrimSpace(q.Get("utente")),
+		Entita:   q.Get("entita"),
+		Azione:   q.Get("azione"),
+	}
+	f.EntitaID, _ = strconv.ParseInt(q.Get("id"), 10, 64)
+	if dal, err := time.ParseInLocation("2006-01-02", q.Get("dal"), time.Local); err == nil {
+		f.Dal = dal
+	}
+	if al, err := time.ParseInLocation("2006-01-02", q.Get("al"), time.Local); err == nil {
+		f.Al = al.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+// RegistroModifiche mostra il registro delle modifiche con i filtri di ricerca
+func RegistroModifiche(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Registro modifiche - FurvioGest", r)
+
+	filtro := filtroAudit(r)
+	filtro.Limite = vociAuditMostrate + 1
+	voci, err := audit.Cerca(filtro)
+	if err != nil {
+		data.Error = "Errore nel recupero del registro delle modifiche"
+	}
+	troncato := len(voci) > vociAuditMostrate
+	if troncato {
+		voci = voci[:vociAuditMostrate]
+	}
+	entita, _ := audit.Entita()
+
+	q := r.URL.Query()
+	data.Data = map[string]interface{}{
+		"Voci":     voci,
+		"Entita":   entita,
+		"Troncato": troncato,
+		"Limite":   vociAuditMostrate,
+		"Filtri": map[string]string{
+			"utente": q.Get("utente"),
+			"entita": q.Get("entita"),
+			"id":     q.Get("id"),
+			"azione": q.Get("azione"),
+			"dal":    q.Get("dal"),
+			"al":     q.Get("al"),
+		},
+	}
+	renderTemplate(w, "audit.html", data)
+}
+
+// ExportRegistroModificheCSV esporta le voci filtrate, una riga per campo modificato
+func ExportRegistroModificheCSV(w http.ResponseWriter, r *http.Request) {
+	voci, err := audit.Cerca(filtroAudit(r))
+	if err != nil {
+		http.Error(w, "Errore esportazione", http.StatusInternalServerError)
+		return
+	}
+
+	// Imposta header per download CSV
+	filename := fmt.Sprintf("registro_modifiche_%s.csv", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	// BOM per Excel
+	w.Write([]byte{0xEF, 0xBB, 0xBF})
+
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+
+	// Header
+	writer.Write([]string{"Data", "Utente", "Indirizzo IP", "Entita", "ID", "Azione", "Campo", "Prima", "Dopo", "Richiesta"})
+
+	for _, v := range voci {
+		base := []string{
+			v.CreatedAt.Format("02/01/2006 15:04:05"),
+			v.Username,
+			v.IP,
+			v.Entita,
+			strconv.FormatInt(v.EntitaID, 10),
+			v.Azione,
+		}
+		for _, c := range v.Campi() {
+			riga := append(append([]string{}, base...), c.Nome, c.Prima, c.Dopo, v.Percorso)
+			writer.Write(riga)
+		}
+	}
+
+	writer.Flush()
+}
+
+// ============================================
+// SCRITTURE REGISTRATE NEL LOG
+// ============================================
+
+// Righe collegate che fanno parte del record nel registro delle modifiche
+var (
+	figliDDT        = []audit.Figlio{{Tabella: "righe_ddt", Colonna: "ddt_id"}}
+	figliDDTUscita  = []audit.Figlio{{Tabella: "righe_ddt_uscita", Colonna: "ddt_uscita_id"}}
+	figliRapporto   = []audit.Figlio{{Tabella: "tecnici_rapporto", Colonna: "rapporto_id"}, {Tabella: "materiale_rapporto_desc", Colonna: "rapporto_id"}, {Tabella: "foto_rapporto", Colonna: "rapporto_id"}}
+	figliPermesso   = []audit.Figlio{{Tabella: "tecnici_permesso", Colonna: "richiesta_permesso_id"}}
+	figliRuolo      = []audit.Figlio{{Tabella: "ruoli_autorizzazioni", Colonna: "ruolo_id"}}
+	figliGiornata   = []audit.Figlio{{Tabella: "spese_giornaliere", Colonna: "giornata_id"}}
+	figliDDTFattura = []audit.Figlio{{Tabella: "movimenti_acquisto", Colonna: "ddt_fattura_id"}}
+)
+
+// conAudit esegue scrivi in una transazione e vi registra le modifiche annotate nella
+// traccia: un errore annulla insieme la scrittura e le voci del log
+func conAudit(r *http.Request, scrivi func(tx *sql.Tx, t *audit.Traccia) error) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t := audit.Nuova(r, tx)
+	if err := scrivi(tx, t); err != nil {
+		return err
+	}
+	if err := t.Concludi(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// creaConAudit esegue l'INSERT e registra il record creato nella stessa transazione
+func creaConAudit(r *http.Request, tabella, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		var err error
+		id, err = t.Inserisci(tabella, query, args...)
+		return err
+	})
+	return id, err
+}
+
+// modificaConAudit esegue la query sul record indicato e registra le differenze nella
+// stessa transazione
+func modificaConAudit(r *http.Request, tabella string, id int64, query string, args ...interface{}) error {
+	return conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica(tabella, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(query, args...)
+		return err
+	})
+}
+
+// eliminaConAudit elimina il record con la query indicata e registra l'eliminazione
+// nella stessa transazione
+func eliminaConAudit(r *http.Request, tabella string, id int64, query string, args ...interface{}) error {
+	return conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina(tabella, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(query, args...)
+		return err
+	})
+}
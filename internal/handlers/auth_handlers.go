@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -38,6 +39,7 @@ func InitTemplates(templatesDir string) error {
 			"sub": func(a, b int) int { return a - b },
 			"mod": func(a, b int) int { return a % b },
 			"lower": strings.ToLower,
+			"hasSuffix": strings.HasSuffix,
 			"slugify": func(s string) string {
 				return strings.ReplaceAll(strings.ToLower(s), " ", "-")
 			},
@@ -109,27 +111,103 @@ func LoginPage(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	session, err := auth.Login(username, password)
+	ricorda := r.FormValue("ricorda") == "1"
+
+	user, err := auth.Accedi(username, password, middleware.IndirizzoRichiesta(r), r.UserAgent())
+	if err == auth.ErrAccessoBloccato {
+		data.Error = "Troppi tentativi falliti: riprova tra " + descriviAttesa(auth.AttesaAccesso(username, middleware.IndirizzoRichiesta(r)))
+		renderTemplate(w, "login.html", data)
+		return
+	}
 	if err != nil {
 		data.Error = "Credenziali non valide"
 		renderTemplate(w, "login.html", data)
 		return
 	}
 
+	// Con il secondo fattore attivo la sessione nasce solo dopo il codice
+	if user.TOTPAttivo {
+		token, err := auth.AvviaSecondoFattore(user, ricorda)
+		if err != nil {
+			data.Error = "Errore durante l'accesso"
+			renderTemplate(w, "login.html", data)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "login_verifica",
+			Value:    token,
+			Path:     "/login",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   300,
+		})
+		http.Redirect(w, r, "/login/verifica", http.StatusSeeOther)
+		return
+	}
+
+	session, err := auth.NuovaSessione(user, ricorda, middleware.IndirizzoRichiesta(r), r.UserAgent())
+	if err != nil {
+		data.Error = "Errore durante l'accesso"
+		renderTemplate(w, "login.html", data)
+		return
+	}
+
 	// Imposta il cookie di sessione
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    session.Token,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Mettere true in produzione con HTTPS
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400, // 24 ore
-	})
+	middleware.ImpostaCookieSessione(w, session)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// VerificaLogin chiede il codice dell'app di autenticazione (o un codice di recupero)
+// dopo la password, per gli utenti con il secondo fattore attivo
+func VerificaLogin(w http.ResponseWriter, r *http.Request) {
+	data := PageData{
+		Title:       "Verifica accesso - FurvioGest",
+		CurrentYear: time.Now().Year(),
+	}
+
+	cookie, err := r.Cookie("login_verifica")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderTemplate(w, "login_verifica.html", data)
+		return
+	}
+
+	session, err := auth.CompletaSecondoFattore(cookie.Value, r.FormValue("codice"), middleware.IndirizzoRichiesta(r), r.UserAgent())
+	if err != nil {
+		if err == auth.ErrAttesaScaduta || err == auth.ErrAccessoBloccato {
+			http.SetCookie(w, &http.Cookie{Name: "login_verifica", Value: "", Path: "/login", MaxAge: -1})
+			data.Error = "Verifica scaduta o troppi tentativi: ripetere l'accesso"
+			renderTemplate(w, "login.html", data)
+			return
+		}
+		data.Error = "Codice non valido"
+		renderTemplate(w, "login_verifica.html", data)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "login_verifica", Value: "", Path: "/login", MaxAge: -1})
+	middleware.ImpostaCookieSessione(w, session)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// descriviAttesa restituisce la durata del blocco in forma leggibile
+func descriviAttesa(d time.Duration) string {
+	if d < time.Minute {
+		secondi := int(d.Seconds()) + 1
+		if secondi == 1 {
+			return "1 secondo"
+		}
+		return fmt.Sprintf("%d secondi", secondi)
+	}
+	minuti := int(d.Minutes()) + 1
+	return fmt.Sprintf("%d minuti", minuti)
+}
+
 // Logout esegue il logout
 func Logout(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("session_token")
@@ -158,7 +236,7 @@ func Dashboard(w http.ResponseWriter, r *http.Request) {
 	data := NewPageData("Dashboard - FurvioGest", r)
 
 	// Mostra avviso backup solo per tecnici
-	if data.Session != nil && data.Session.IsTecnico() {
+	if data.Session != nil && data.Session.Puo(auth.AutBackup) {
 		erroreBackup := GetUltimoBackupErrore()
 		if erroreBackup != "" {
 			data.Data = map[string]interface{}{
@@ -191,7 +269,13 @@ func CambioPassword(w http.ResponseWriter, r *http.Request) {
 	confermaPassword := r.FormValue("conferma_password")
 
 	// Verifica password attuale
-	_, err := auth.Login(session.Username, passwordAttuale)
+	err := auth.VerificaPasswordAttuale(session, passwordAttuale, middleware.IndirizzoRichiesta(r), r.UserAgent())
+	if err == auth.ErrAccessoBloccato {
+		// La sessione e gia stata chiusa: si torna al login, che mostra l'attesa
+		http.SetCookie(w, &http.Cookie{Name: "session_token", Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		data.Error = "Password attuale non corretta"
 		renderTemplate(w, "cambio_password.html", data)
@@ -212,6 +296,12 @@ func CambioPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if nuovaPassword == passwordAttuale || nuovaPassword == auth.PasswordPredefinita {
+		data.Error = "Scegli una password diversa da quella attuale e da quella predefinita"
+		renderTemplate(w, "cambio_password.html", data)
+		return
+	}
+
 	// Aggiorna la password
 	err = auth.UpdatePassword(session.UserID, nuovaPassword)
 	if err != nil {
@@ -220,6 +310,120 @@ func CambioPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Chi conosceva la vecchia password non resta collegato sugli altri dispositivi
+	if sessioni, err := auth.Sessions.SessioniUtente(session.UserID); err == nil {
+		for _, s := range sessioni {
+			if s.ID != session.ID {
+				auth.Sessions.Revoca(session.UserID, s.ID)
+			}
+		}
+	}
+
+	auth.RegistraEvento(auth.EventoCambioPassword, session.Username, session.UserID, middleware.IndirizzoRichiesta(r), r.UserAgent(), "")
+
+	// Completato il cambio obbligatorio l'applicazione torna raggiungibile
+	if session.DeveCambiarePassword {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
 	data.Success = "Password aggiornata con successo"
 	renderTemplate(w, "cambio_password.html", data)
 }
+
+// sessioneUtente e una riga della pagina sessioni attive
+type sessioneUtente struct {
+	ID            int64
+	Dispositivo   string
+	UserAgent     string
+	IP            string
+	Accesso       string
+	UltimoAccesso string
+	Scadenza      string
+	Ricorda       bool
+	Corrente      bool
+}
+
+// descriviDispositivo riassume il user agent in browser e sistema operativo
+func descriviDispositivo(userAgent string) string {
+	browser := "Browser sconosciuto"
+	for _, b := range []struct{ chiave, nome string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.chiave) {
+			browser = b.nome
+			break
+		}
+	}
+	sistema := ""
+	for _, o := range []struct{ chiave, nome string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.chiave) {
+			sistema = o.nome
+			break
+		}
+	}
+	if sistema == "" {
+		return browser
+	}
+	return browser + " su " + sistema
+}
+
+// SessioniAttive mostra le sessioni aperte dell'utente e permette di chiuderle
+func SessioniAttive(w http.ResponseWriter, r *http.Request) {
+	session := middleware.GetSession(r)
+	if session == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("azione") {
+		case "altre":
+			// Chiude tutte le sessioni tranne quella in uso
+			sessioni, _ := auth.Sessions.SessioniUtente(session.UserID)
+			for _, s := range sessioni {
+				if s.ID != session.ID {
+					auth.Sessions.Revoca(session.UserID, s.ID)
+				}
+			}
+		default:
+			id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			auth.Sessions.Revoca(session.UserID, id)
+			if id == session.ID {
+				Logout(w, r)
+				return
+			}
+		}
+		http.Redirect(w, r, "/sessioni?success=revocata", http.StatusSeeOther)
+		return
+	}
+
+	data := NewPageData("Sessioni attive - FurvioGest", r)
+	if r.URL.Query().Get("success") == "revocata" {
+		data.Success = "Sessione chiusa"
+	}
+
+	sessioni, err := auth.Sessions.SessioniUtente(session.UserID)
+	if err != nil {
+		data.Error = "Errore nel recupero delle sessioni"
+	}
+	var righe []sessioneUtente
+	for _, s := range sessioni {
+		righe = append(righe, sessioneUtente{
+			ID:            s.ID,
+			Dispositivo:   descriviDispositivo(s.UserAgent),
+			UserAgent:     s.UserAgent,
+			IP:            s.IP,
+			Accesso:       s.CreatedAt.Local().Format("02/01/2006 15:04"),
+			UltimoAccesso: s.UltimoAccesso.Local().Format("02/01/2006 15:04"),
+			Scadenza:      s.ExpiresAt.Local().Format("02/01/2006 15:04"),
+			Ricorda:       s.Ricorda,
+			Corrente:      s.ID == session.ID,
+		})
+	}
+	data.Data = righe
+	renderTemplate(w, "sessioni.html", data)
+}
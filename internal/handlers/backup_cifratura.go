@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/database"
+	"furviogest/internal/segreti"
+)
+
+// ============================================
+// CIFRATURA DEGLI ARCHIVI DI BACKUP
+// ============================================
+
+// lunghezzaMinimaChiave e la lunghezza minima della passphrase dei backup
+const lunghezzaMinimaChiave = 12
+
+// errChiaveMancante indica un archivio cifrato senza una chiave con cui provare a leggerlo
+var errChiaveMancante = errors.New("archivio cifrato: serve la chiave di cifratura dei backup")
+
+// chiaveBackup restituisce la passphrase configurata, vuota se la cifratura e disattivata
+func chiaveBackup() string {
+	var cifrata string
+	database.DB.QueryRow("SELECT COALESCE(cifratura_chiave, '') FROM backup_sistema_config WHERE id = 1").Scan(&cifrata)
+	if cifrata == "" {
+		return ""
+	}
+	return segreti.Leggi(cifrata)
+}
+
+// chiaviBackup restituisce le passphrase da provare su un archivio: quella indicata
+// dall'utente, poi quella configurata
+func chiaviBackup(indicata string) []string {
+	var chiavi []string
+	if indicata != "" {
+		chiavi = append(chiavi, indicata)
+	}
+	if configurata := chiaveBackup(); configurata != "" && configurata != indicata {
+		chiavi = append(chiavi, configurata)
+	}
+	return chiavi
+}
+
+// erroreChiave indica se l'archivio non si e potuto aprire per la chiave di cifratura
+func erroreChiave(err error) bool {
+	return errors.Is(err, errChiaveMancante) || errors.Is(err, segreti.ErrChiaveFlusso)
+}
+
+// apriArchivio restituisce il contenuto tar.gz dell'archivio: gli archivi cifrati
+// vengono decifrati con la prima chiave che funziona. Il file va chiuso dal chiamante.
+func apriArchivio(archivePath string, chiavi []string) (io.Reader, *os.File, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cifrato, err := segreti.FlussoCifrato(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !cifrato {
+		return file, file, nil
+	}
+	if len(chiavi) == 0 {
+		file.Close()
+		return nil, nil, errChiaveMancante
+	}
+
+	err = segreti.ErrChiaveFlusso
+	for _, chiave := range chiavi {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+		var chiaro io.Reader
+		if chiaro, err = segreti.DecifraFlusso(file, chiave); err == nil {
+			return chiaro, file, nil
+		}
+	}
+	file.Close()
+	return nil, nil, err
+}
+
+// archivioCifrato indica se il file di backup e cifrato
+func archivioCifrato(archivePath string) bool {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	cifrato, _ := segreti.FlussoCifrato(file)
+	return cifrato
+}
+
+// SalvaCifraturaBackup imposta o disattiva la passphrase dei backup. Cambiando chiave
+// l'indice degli allegati si svuota: il backup successivo li archivia tutti con la
+// nuova chiave invece di rimandare ad archivi cifrati con la precedente.
+func SalvaCifraturaBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+
+	chiave := ""
+	if r.FormValue("disattiva") != "1" {
+		chiave = strings.TrimSpace(r.FormValue("chiave"))
+		if len(chiave) < lunghezzaMinimaChiave {
+			http.Redirect(w, r, "/backup?error=cifratura&detail="+url.QueryEscape("la chiave deve avere almeno 12 caratteri"), http.StatusSeeOther)
+			return
+		}
+		if chiave != strings.TrimSpace(r.FormValue("conferma_chiave")) {
+			http.Redirect(w, r, "/backup?error=cifratura&detail="+url.QueryEscape("le due chiavi non coincidono"), http.StatusSeeOther)
+			return
+		}
+	}
+
+	cifrata, err := segreti.Cifra(chiave)
+	if err != nil {
+		log.Printf("Errore cifratura chiave backup: %v", err)
+		http.Redirect(w, r, "/backup?error=config", http.StatusSeeOther)
+		return
+	}
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica("backup_sistema_config", 1); err != nil {
+			return err
+		}
+		return scriviChiaveBackup(tx, cifrata)
+	})
+	if err != nil {
+		log.Printf("Errore salvataggio chiave backup: %v", err)
+		http.Redirect(w, r, "/backup?error=config", http.StatusSeeOther)
+		return
+	}
+
+	if chiave == "" {
+		http.Redirect(w, r, "/backup?success=cifratura_disattivata", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/backup?success=cifratura", http.StatusSeeOther)
+}
+
+// impostaChiaveBackup salva la passphrase (gia cifrata) e svuota l'indice degli allegati
+func impostaChiaveBackup(cifrata string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := scriviChiaveBackup(tx, cifrata); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scriviChiaveBackup esegue nella transazione le scritture di impostaChiaveBackup
+func scriviChiaveBackup(tx *sql.Tx, cifrata string) error {
+	if _, err := tx.Exec(`
+		UPDATE backup_sistema_config SET cifratura_chiave = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1
+	`, cifrata); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM backup_uploads_indice")
+	return err
+}
@@ -0,0 +1,585 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/backupremoto"
+	"furviogest/internal/database"
+	"furviogest/internal/segreti"
+)
+
+// ============================================
+// DESTINAZIONI ESTERNE DEI BACKUP
+// ============================================
+
+// DestinazioneBackup e una copia esterna dei backup (NAS, SFTP, S3, cartella montata)
+type DestinazioneBackup struct {
+	ID            int64
+	Nome          string
+	Tipo          string
+	Abilitata     bool
+	Percorso      string
+	Host          string
+	Porta         int
+	Endpoint      string
+	Bucket        string
+	Regione       string
+	Username      string
+	Password      string // cifrata
+	ImprontaHost  string
+	RetentionDays int
+	UltimoInvio   *InvioDestinazione
+}
+
+// InvioDestinazione e l'esito della copia di un archivio su una destinazione
+type InvioDestinazione struct {
+	Destinazione string
+	Filename     string
+	OK           bool
+	Errore       string
+	DurataMs     int64
+	CreatedAt    time.Time
+}
+
+// tipiDestinazione sono i tipi proposti nel modulo della pagina backup
+var tipiDestinazione = []struct{ Valore, Nome string }{
+	{backupremoto.TipoSMB, backupremoto.NomeTipo(backupremoto.TipoSMB)},
+	{backupremoto.TipoSFTP, backupremoto.NomeTipo(backupremoto.TipoSFTP)},
+	{backupremoto.TipoS3, backupremoto.NomeTipo(backupremoto.TipoS3)},
+	{backupremoto.TipoLocale, backupremoto.NomeTipo(backupremoto.TipoLocale)},
+}
+
+// Tipi restituisce i tipi di destinazione proposti nel modulo
+func (d DestinazioneBackup) Tipi() []struct{ Valore, Nome string } {
+	return tipiDestinazione
+}
+
+// NomeTipo restituisce l'etichetta del tipo di destinazione
+func (d DestinazioneBackup) NomeTipo() string {
+	return backupremoto.NomeTipo(d.Tipo)
+}
+
+// config restituisce la configurazione della destinazione con la password decifrata
+func (d DestinazioneBackup) config() backupremoto.Config {
+	return backupremoto.Config{
+		Tipo:         d.Tipo,
+		Percorso:     d.Percorso,
+		Username:     d.Username,
+		Password:     segreti.Leggi(d.Password),
+		Host:         d.Host,
+		Porta:        d.Porta,
+		ImprontaHost: d.ImprontaHost,
+		Endpoint:     d.Endpoint,
+		Bucket:       d.Bucket,
+		Regione:      d.Regione,
+	}
+}
+
+// Descrizione identifica la destinazione nella pagina backup
+func (d DestinazioneBackup) Descrizione() string {
+	t, err := backupremoto.Nuovo(d.config())
+	if err != nil {
+		return err.Error()
+	}
+	return t.Descrizione()
+}
+
+const selectDestinazione = `
+	SELECT id, nome, tipo, abilitata, percorso, host, porta, endpoint, bucket, regione,
+	       username, password, impronta_host, retention_days
+	FROM backup_destinazioni`
+
+func scanDestinazione(row interface{ Scan(...interface{}) error }) (DestinazioneBackup, error) {
+	var d DestinazioneBackup
+	err := row.Scan(&d.ID, &d.Nome, &d.Tipo, &d.Abilitata, &d.Percorso, &d.Host, &d.Porta,
+		&d.Endpoint, &d.Bucket, &d.Regione, &d.Username, &d.Password, &d.ImprontaHost, &d.RetentionDays)
+	return d, err
+}
+
+// getDestinazioniBackup elenca le destinazioni con l'esito dell'ultimo invio
+func getDestinazioniBackup(soloAbilitate bool) []DestinazioneBackup {
+	query := selectDestinazione
+	if soloAbilitate {
+		query += " WHERE abilitata = 1"
+	}
+	rows, err := database.DB.Query(query + " ORDER BY nome")
+	if err != nil {
+		log.Printf("Errore lettura destinazioni backup: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var destinazioni []DestinazioneBackup
+	for rows.Next() {
+		d, err := scanDestinazione(rows)
+		if err != nil {
+			continue
+		}
+		destinazioni = append(destinazioni, d)
+	}
+	rows.Close()
+
+	for i := range destinazioni {
+		var invio InvioDestinazione
+		err := database.DB.QueryRow(`
+			SELECT filename, ok, COALESCE(errore,''), durata_ms, created_at
+			FROM backup_destinazioni_log WHERE destinazione_id = ?
+			ORDER BY id DESC LIMIT 1
+		`, destinazioni[i].ID).Scan(&invio.Filename, &invio.OK, &invio.Errore, &invio.DurataMs, &invio.CreatedAt)
+		if err == nil {
+			invio.Destinazione = destinazioni[i].Nome
+			destinazioni[i].UltimoInvio = &invio
+		}
+	}
+	return destinazioni
+}
+
+func getDestinazioneBackup(id int64) (DestinazioneBackup, error) {
+	return scanDestinazione(database.DB.QueryRow(selectDestinazione+" WHERE id = ?", id))
+}
+
+// getInviiPerArchivio restituisce gli invii alle destinazioni raggruppati per archivio
+func getInviiPerArchivio() map[string][]InvioDestinazione {
+	invii := make(map[string][]InvioDestinazione)
+	rows, err := database.DB.Query(`
+		SELECT d.nome, l.filename, l.ok, COALESCE(l.errore,''), l.durata_ms, l.created_at
+		FROM backup_destinazioni_log l
+		JOIN backup_destinazioni d ON d.id = l.destinazione_id
+		ORDER BY d.nome, l.id
+	`)
+	if err != nil {
+		return invii
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i InvioDestinazione
+		if err := rows.Scan(&i.Destinazione, &i.Filename, &i.OK, &i.Errore, &i.DurataMs, &i.CreatedAt); err != nil {
+			continue
+		}
+		// Un nuovo tentativo sulla stessa destinazione sostituisce il precedente
+		elenco := invii[i.Filename]
+		if n := len(elenco); n > 0 && elenco[n-1].Destinazione == i.Destinazione {
+			elenco[n-1] = i
+		} else {
+			elenco = append(elenco, i)
+		}
+		invii[i.Filename] = elenco
+	}
+	return invii
+}
+
+func logInvio(destinazioneID int64, filename string, durata time.Duration, err error) {
+	errore := ""
+	if err != nil {
+		errore = err.Error()
+	}
+	database.DB.Exec(`
+		INSERT INTO backup_destinazioni_log (destinazione_id, filename, ok, errore, durata_ms)
+		VALUES (?, ?, ?, ?, ?)
+	`, destinazioneID, filename, err == nil, errore, durata.Milliseconds())
+}
+
+// esitoCopie riassume la copia di un archivio sulle destinazioni abilitate
+type esitoCopie struct {
+	Abilitate int
+	Fallite   []string // nomi delle destinazioni senza copia
+	Errori    []string // "nome: errore" per ogni destinazione fallita
+}
+
+// copiaSuDestinazioni copia l'archivio su tutte le destinazioni abilitate
+func copiaSuDestinazioni(localPath string) esitoCopie {
+	var esito esitoCopie
+	for _, d := range getDestinazioniBackup(true) {
+		esito.Abilitate++
+		if err := inviaADestinazione(d, localPath); err != nil {
+			log.Printf("Errore copia backup su %s: %v", d.Nome, err)
+			esito.Fallite = append(esito.Fallite, d.Nome)
+			esito.Errori = append(esito.Errori, d.Nome+": "+err.Error())
+		}
+	}
+	return esito
+}
+
+// inviaADestinazione copia l'archivio e gli archivi a cui rimanda, se mancano sulla
+// destinazione, poi applica la retention della destinazione
+func inviaADestinazione(d DestinazioneBackup, localPath string) error {
+	filename := filepath.Base(localPath)
+	inizio := time.Now()
+
+	t, err := backupremoto.Nuovo(d.config())
+	if err != nil {
+		logInvio(d.ID, filename, 0, err)
+		return err
+	}
+	presenti, err := t.Elenca("")
+	if err != nil {
+		logInvio(d.ID, filename, time.Since(inizio), err)
+		return err
+	}
+	suDestinazione := make(map[string]bool)
+	for _, f := range presenti {
+		suDestinazione[f.Nome] = true
+	}
+
+	// Un backup incrementale e ripristinabile solo con gli archivi che contengono i suoi allegati
+	riferiti, _ := riferimentiArchivio(filename)
+	for _, riferito := range riferiti {
+		if suDestinazione[riferito] {
+			continue
+		}
+		percorso, ok := percorsoBackup(riferito)
+		if !ok {
+			continue
+		}
+		if err := t.Carica(percorso, riferito); err != nil {
+			err = fmt.Errorf("copia di %s, a cui rimanda il backup: %v", riferito, err)
+			logInvio(d.ID, filename, time.Since(inizio), err)
+			return err
+		}
+		suDestinazione[riferito] = true
+	}
+
+	err = t.Carica(localPath, filename)
+	logInvio(d.ID, filename, time.Since(inizio), err)
+	if err != nil {
+		return err
+	}
+
+	pulisciDestinazione(t, d, append(presenti, backupremoto.File{Nome: filename}))
+	return nil
+}
+
+// pulisciDestinazione elimina gli archivi oltre la retention della destinazione,
+// tranne quelli che contengono allegati di backup incrementali conservati
+func pulisciDestinazione(t backupremoto.BackupTarget, d DestinazioneBackup, presenti []backupremoto.File) {
+	cutoffDate := time.Now().AddDate(0, 0, -d.RetentionDays)
+
+	var scaduti, conservati []string
+	for _, f := range presenti {
+		if !strings.HasPrefix(f.Nome, "furviogest_") || !strings.HasSuffix(f.Nome, ".tar.gz") {
+			continue
+		}
+		data, ok := dataArchivio(f.Nome)
+		if !ok {
+			continue
+		}
+		if data.Before(cutoffDate) {
+			scaduti = append(scaduti, f.Nome)
+		} else {
+			conservati = append(conservati, f.Nome)
+		}
+	}
+
+	protetti := archiviProtetti(conservati, scaduti)
+	for _, nome := range scaduti {
+		if protetti[nome] {
+			continue
+		}
+		if err := t.Elimina(nome); err != nil {
+			log.Printf("Errore eliminazione %s da %s: %v", nome, d.Nome, err)
+		}
+	}
+}
+
+// ============================================
+// GESTIONE DESTINAZIONI
+// ============================================
+
+// destinazioneDaForm legge la destinazione dal form; la password vuota mantiene quella salvata
+func destinazioneDaForm(r *http.Request, esistente DestinazioneBackup) DestinazioneBackup {
+	d := esistente
+	d.Nome = strings.TrimSpace(r.FormValue("nome"))
+	d.Tipo = r.FormValue("tipo")
+	d.Percorso = strings.TrimSpace(r.FormValue("percorso"))
+	d.Host = strings.TrimSpace(r.FormValue("host"))
+	d.Porta, _ = strconv.Atoi(r.FormValue("porta"))
+	d.Endpoint = strings.TrimSpace(r.FormValue("endpoint"))
+	d.Bucket = strings.TrimSpace(r.FormValue("bucket"))
+	d.Regione = strings.TrimSpace(r.FormValue("regione"))
+	d.Username = strings.TrimSpace(r.FormValue("username"))
+	if password := r.FormValue("password"); password != "" {
+		d.Password = password
+	} else {
+		d.Password = segreti.Leggi(esistente.Password)
+	}
+	d.RetentionDays, _ = strconv.Atoi(r.FormValue("retention_days"))
+	if d.RetentionDays < 1 {
+		d.RetentionDays = 7
+	}
+	if d.Nome == "" {
+		d.Nome = backupremoto.NomeTipo(d.Tipo)
+	}
+
+	// La chiave del server si registra di nuovo se cambia il server o se richiesto
+	if d.Host != esistente.Host || d.Porta != esistente.Porta || r.FormValue("accetta_chiave") == "1" {
+		d.ImprontaHost = ""
+	}
+	return d
+}
+
+// provaDestinazione verifica la destinazione e registra la chiave del server SFTP
+func provaDestinazione(d *DestinazioneBackup) error {
+	t, err := backupremoto.Nuovo(d.config())
+	if err != nil {
+		return err
+	}
+	if err := t.Prova(); err != nil {
+		return err
+	}
+	if ch, ok := t.(backupremoto.ChiaveHost); ok && d.ImprontaHost == "" {
+		d.ImprontaHost = ch.ImprontaHost()
+	}
+	return nil
+}
+
+// SalvaDestinazioneBackup prova la destinazione e, se raggiungibile, la salva.
+// Gestisce /backup/destinazioni/nuova e /backup/destinazioni/modifica/{id}.
+func SalvaDestinazioneBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+
+	var esistente DestinazioneBackup
+	esistente.Abilitata = true
+	if idStr := strings.TrimPrefix(r.URL.Path, "/backup/destinazioni/modifica/"); idStr != r.URL.Path {
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		var err error
+		if esistente, err = getDestinazioneBackup(id); err != nil {
+			http.Redirect(w, r, "/backup?error=destinazione_assente", http.StatusSeeOther)
+			return
+		}
+	}
+
+	d := destinazioneDaForm(r, esistente)
+	if err := provaDestinazione(&d); err != nil {
+		http.Redirect(w, r, "/backup?error=destinazione&detail="+url.QueryEscape(d.Nome+": "+err.Error()), http.StatusSeeOther)
+		return
+	}
+
+	password, err := segreti.Cifra(d.Password)
+	if err != nil {
+		log.Printf("Errore cifratura password destinazione: %v", err)
+		http.Redirect(w, r, "/backup?error=config", http.StatusSeeOther)
+		return
+	}
+
+	if d.ID == 0 {
+		_, err = creaConAudit(r, "backup_destinazioni", `
+			INSERT INTO backup_destinazioni (nome, tipo, abilitata, percorso, host, porta, endpoint, bucket,
+			                                 regione, username, password, impronta_host, retention_days)
+			VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, d.Nome, d.Tipo, d.Percorso, d.Host, d.Porta, d.Endpoint, d.Bucket, d.Regione,
+			d.Username, password, d.ImprontaHost, d.RetentionDays)
+	} else {
+		err = modificaConAudit(r, "backup_destinazioni", d.ID, `
+			UPDATE backup_destinazioni
+			SET nome = ?, tipo = ?, percorso = ?, host = ?, porta = ?, endpoint = ?, bucket = ?, regione = ?,
+			    username = ?, password = ?, impronta_host = ?, retention_days = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, d.Nome, d.Tipo, d.Percorso, d.Host, d.Porta, d.Endpoint, d.Bucket, d.Regione,
+			d.Username, password, d.ImprontaHost, d.RetentionDays, d.ID)
+	}
+	if err != nil {
+		log.Printf("Errore salvataggio destinazione backup: %v", err)
+		http.Redirect(w, r, "/backup?error=config", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/backup?success=destinazione&detail="+url.QueryEscape(d.Nome), http.StatusSeeOther)
+}
+
+// idDestinazione legge l'ID dal percorso dopo il prefisso
+func idDestinazione(r *http.Request, prefisso string) (DestinazioneBackup, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, prefisso), 10, 64)
+	if err != nil {
+		return DestinazioneBackup{}, sql.ErrNoRows
+	}
+	return getDestinazioneBackup(id)
+}
+
+// ProvaDestinazioneBackup verifica una destinazione salvata
+func ProvaDestinazioneBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+	d, err := idDestinazione(r, "/backup/destinazioni/prova/")
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=destinazione_assente", http.StatusSeeOther)
+		return
+	}
+
+	impronta := d.ImprontaHost
+	if err := provaDestinazione(&d); err != nil {
+		http.Redirect(w, r, "/backup?error=destinazione_test&detail="+url.QueryEscape(d.Nome+": "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	if d.ImprontaHost != impronta {
+		modificaConAudit(r, "backup_destinazioni", d.ID, "UPDATE backup_destinazioni SET impronta_host = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", d.ImprontaHost, d.ID)
+	}
+	http.Redirect(w, r, "/backup?success=destinazione_test&detail="+url.QueryEscape(d.Nome), http.StatusSeeOther)
+}
+
+// AbilitaDestinazioneBackup abilita o sospende le copie su una destinazione
+func AbilitaDestinazioneBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+	d, err := idDestinazione(r, "/backup/destinazioni/abilita/")
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=destinazione_assente", http.StatusSeeOther)
+		return
+	}
+	modificaConAudit(r, "backup_destinazioni", d.ID, "UPDATE backup_destinazioni SET abilitata = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		r.FormValue("abilitata") == "1", d.ID)
+	http.Redirect(w, r, "/backup", http.StatusSeeOther)
+}
+
+// EliminaDestinazioneBackup rimuove una destinazione; i file gia copiati restano
+func EliminaDestinazioneBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+	d, err := idDestinazione(r, "/backup/destinazioni/elimina/")
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=destinazione_assente", http.StatusSeeOther)
+		return
+	}
+	eliminaConAudit(r, "backup_destinazioni", d.ID, "DELETE FROM backup_destinazioni WHERE id = ?", d.ID)
+	http.Redirect(w, r, "/backup?success=destinazione_eliminata&detail="+url.QueryEscape(d.Nome), http.StatusSeeOther)
+}
+
+// ============================================
+// BACKUP CONFIGURAZIONI RETE SULLE DESTINAZIONI
+// ============================================
+
+// cartellaConfigRete restituisce la cartella sulle destinazioni per una directory dei
+// backup configurazioni (nave_N, ufficio_N, sala_server_N); vuota se non riconosciuta
+func cartellaConfigRete(dirName string) string {
+	switch {
+	case strings.HasPrefix(dirName, "nave_"):
+		return "config_navi"
+	case strings.HasPrefix(dirName, "ufficio_"):
+		return "config_uffici"
+	case strings.HasPrefix(dirName, "sala_server_"):
+		return "config_sale_server"
+	}
+	return ""
+}
+
+// eseguiBackupConfigDestinazioni copia i backup delle configurazioni di rete su tutte
+// le destinazioni abilitate, mantenendo gli ultimi N file per apparato
+func eseguiBackupConfigDestinazioni(config BackupConfig) {
+	log.Println("[BACKUP CONFIG] Avvio copia configurazioni rete sulle destinazioni")
+
+	// Directory locale dei backup configurazioni
+	configBackupDir := filepath.Join(dataDir, "backups")
+	entries, err := os.ReadDir(configBackupDir)
+	if err != nil {
+		log.Printf("[BACKUP CONFIG] Errore lettura directory: %v", err)
+		return
+	}
+
+	for _, d := range getDestinazioniBackup(true) {
+		t, err := backupremoto.Nuovo(d.config())
+		if err != nil {
+			log.Printf("[BACKUP CONFIG] %s: %v", d.Nome, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			dirName := entry.Name()
+			cartella := cartellaConfigRete(dirName)
+			if cartella == "" {
+				continue
+			}
+
+			// Salta navi ferme per lavori
+			if naveIDStr, ok := strings.CutPrefix(dirName, "nave_"); ok {
+				naveID, err := strconv.ParseInt(naveIDStr, 10, 64)
+				if err != nil {
+					continue
+				}
+				var ferma int
+				database.DB.QueryRow("SELECT ferma_per_lavori FROM navi WHERE id = ?", naveID).Scan(&ferma)
+				if ferma == 1 {
+					log.Printf("[BACKUP CONFIG] Nave %d ferma per lavori, skip", naveID)
+					continue
+				}
+			}
+
+			dirRemota := cartella + "/" + dirName
+			presenti, _ := t.Elenca(dirRemota)
+			giaCopiati := make(map[string]int64)
+			for _, f := range presenti {
+				giaCopiati[f.Nome] = f.Dimensione
+			}
+
+			// I file gia presenti con la stessa dimensione non vengono ricopiati
+			files, _ := os.ReadDir(filepath.Join(configBackupDir, dirName))
+			for _, f := range files {
+				info, err := f.Info()
+				if err != nil || f.IsDir() {
+					continue
+				}
+				if dim, ok := giaCopiati[f.Name()]; ok && dim == info.Size() {
+					continue
+				}
+				if err := t.Carica(filepath.Join(configBackupDir, dirName, f.Name()), dirRemota+"/"+f.Name()); err != nil {
+					log.Printf("[BACKUP CONFIG] %s: copia %s/%s fallita: %v", d.Nome, dirName, f.Name(), err)
+					continue
+				}
+				presenti = append(presenti, backupremoto.File{Nome: f.Name()})
+			}
+
+			applicaRetentionConfig(t, dirRemota, presenti, config.NasConfigRetention)
+		}
+		log.Printf("[BACKUP CONFIG] Copia completata su %s", d.Nome)
+	}
+}
+
+// applicaRetentionConfig mantiene sulla destinazione solo gli ultimi N backup per apparato
+func applicaRetentionConfig(t backupremoto.BackupTarget, dir string, presenti []backupremoto.File, retention int) {
+	// Raggruppa per prefisso (es. "ac_AC" o "switch_SW-CAN29-229")
+	gruppi := make(map[string][]string)
+	visti := make(map[string]bool)
+	for _, f := range presenti {
+		if !strings.HasSuffix(f.Nome, ".cfg") || visti[f.Nome] {
+			continue
+		}
+		visti[f.Nome] = true
+		parti := strings.Split(f.Nome, "_")
+		if len(parti) >= 2 {
+			prefisso := parti[0] + "_" + parti[1]
+			gruppi[prefisso] = append(gruppi[prefisso], f.Nome)
+		}
+	}
+
+	// Ordine alfabetico = cronologico, dato il formato data nel nome
+	for _, nomi := range gruppi {
+		if len(nomi) <= retention {
+			continue
+		}
+		sort.Strings(nomi)
+		for _, nome := range nomi[:len(nomi)-retention] {
+			t.Elimina(dir + "/" + nome)
+		}
+	}
+}
@@ -3,14 +3,17 @@ package handlers
 import (
 	"archive/tar"
 	"compress/gzip"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"furviogest/internal/backupremoto"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -19,29 +22,35 @@ import (
 )
 
 // BackupConfig rappresenta la configurazione del sistema di backup
+// Le copie esterne sono in backup_destinazioni: le colonne nas_* della configurazione
+// restano nel database ma non sono piu usate.
 type BackupConfig struct {
-	ID            int64
-	NasAbilitato  bool
-	NasPath       string
-	NasUsername   string
-	NasPassword   string
-	RetentionDays int
-	OraBackup     string
+	ID                 int64
+	RetentionDays      int
+	OraBackup          string
 	UpdatedAt          time.Time
 	NasConfigAbilitato bool
 	NasConfigRetention int
+	Cifratura          bool
+	GiorniAvviso       int
 }
 
 // BackupLog rappresenta un log di backup
 type BackupLog struct {
-	ID        int64
-	Filename  string
-	Tipo      string
-	Dimensione int64
-	LocaleOK  bool
-	NasOK     bool
-	Errore    string
-	CreatedAt time.Time
+	ID                    int64
+	Filename              string
+	Tipo                  string
+	Dimensione            int64
+	LocaleOK              bool
+	DestinazioniAbilitate int    // destinazioni esterne abilitate al momento del backup
+	DestinazioniFallite   string // nomi, separati da virgola, di quelle senza copia
+	Errore                string
+	CreatedAt             time.Time
+}
+
+// CopieFallite indica se almeno una destinazione esterna abilitata non ha ricevuto la copia
+func (b BackupLog) CopieFallite() bool {
+	return b.DestinazioniAbilitate > 0 && b.DestinazioniFallite != ""
 }
 
 // BackupInfo rappresenta le informazioni su un file di backup
@@ -50,6 +59,8 @@ type BackupInfo struct {
 	Dimensione int64
 	DataOra    time.Time
 	Tipo       string
+	Cifrato    bool
+	Invii      []InvioDestinazione
 }
 
 const (
@@ -73,24 +84,35 @@ func BackupPage(w http.ResponseWriter, r *http.Request) {
 	// Carica ultimo log backup
 	var ultimoBackup BackupLog
 	database.DB.QueryRow(`
-		SELECT id, filename, tipo, dimensione, locale_ok, nas_ok, COALESCE(errore,''), created_at
+		SELECT id, filename, tipo, dimensione, locale_ok, destinazioni_abilitate, destinazioni_fallite,
+			COALESCE(errore,''), created_at
 		FROM backup_sistema_log
+		WHERE tipo != 'pre_ripristino'
 		ORDER BY created_at DESC LIMIT 1
 	`).Scan(&ultimoBackup.ID, &ultimoBackup.Filename, &ultimoBackup.Tipo,
-		&ultimoBackup.Dimensione, &ultimoBackup.LocaleOK, &ultimoBackup.NasOK,
-		&ultimoBackup.Errore, &ultimoBackup.CreatedAt)
+		&ultimoBackup.Dimensione, &ultimoBackup.LocaleOK, &ultimoBackup.DestinazioniAbilitate,
+		&ultimoBackup.DestinazioniFallite, &ultimoBackup.Errore, &ultimoBackup.CreatedAt)
 
 	// Verifica errore backup per mostrare alert
 	erroreBackup := ""
-	if ultimoBackup.ID > 0 && (!ultimoBackup.LocaleOK || (config.NasAbilitato && !ultimoBackup.NasOK)) {
+	if ultimoBackup.ID > 0 && (!ultimoBackup.LocaleOK || ultimoBackup.CopieFallite()) {
 		erroreBackup = ultimoBackup.Errore
 	}
 
+	pianificazione, _ := caricaPianificazioneBackup()
+
 	data.Data = map[string]interface{}{
 		"Config":        config,
 		"Backups":       backups,
 		"UltimoBackup":  ultimoBackup,
 		"ErroreBackup":  erroreBackup,
+		"Destinazioni":  getDestinazioniBackup(false),
+		"Pianificazione": pianificazione,
+		"NuovaDestinazione": DestinazioneBackup{
+			Tipo:          backupremoto.TipoSMB,
+			Abilitata:     true,
+			RetentionDays: config.RetentionDays,
+		},
 	}
 
 	// Messaggi dalla query string
@@ -100,14 +122,23 @@ func BackupPage(w http.ResponseWriter, r *http.Request) {
 			data.Success = "Backup completato con successo"
 		case "restore":
 			data.Success = "Ripristino completato con successo. Il server verra riavviato."
+			if d := r.URL.Query().Get("detail"); d != "" {
+				data.Success += " Lo stato precedente e salvato in " + d + ": ripristinarlo per annullare."
+			}
+		case "verifica":
+			data.Success = "Verifica superata: " + r.URL.Query().Get("detail")
 		case "config":
 			data.Success = "Configurazione salvata"
-		case "nas_test":
-			data.Success = "Connessione NAS riuscita"
-		case "nas_saved":
-			data.Success = "Connessione NAS testata e configurazione salvata con successo"
-		case "nas_disabled":
-			data.Success = "Backup su NAS disabilitato"
+		case "destinazione":
+			data.Success = "Destinazione " + r.URL.Query().Get("detail") + " testata e salvata"
+		case "destinazione_test":
+			data.Success = "Destinazione " + r.URL.Query().Get("detail") + " raggiungibile"
+		case "cifratura":
+			data.Success = "Chiave di cifratura salvata: i prossimi backup saranno cifrati"
+		case "cifratura_disattivata":
+			data.Success = "Cifratura disattivata: i prossimi backup non saranno cifrati"
+		case "destinazione_eliminata":
+			data.Success = "Destinazione " + r.URL.Query().Get("detail") + " eliminata: i file gia copiati restano"
 		}
 	}
 	if msg := r.URL.Query().Get("error"); msg != "" {
@@ -116,8 +147,21 @@ func BackupPage(w http.ResponseWriter, r *http.Request) {
 			data.Error = "Errore durante il backup"
 		case "restore":
 			data.Error = "Errore durante il ripristino"
-		case "nas_test":
-			data.Error = "Connessione NAS fallita: " + r.URL.Query().Get("detail")
+			if d := r.URL.Query().Get("detail"); d != "" {
+				data.Error += ": " + d
+			}
+		case "verifica":
+			data.Error = "Verifica fallita: " + r.URL.Query().Get("detail")
+		case "destinazione":
+			data.Error = "Destinazione non raggiungibile, configurazione non salvata: " + r.URL.Query().Get("detail")
+		case "destinazione_test":
+			data.Error = "Destinazione non raggiungibile: " + r.URL.Query().Get("detail")
+		case "destinazione_assente":
+			data.Error = "Destinazione non trovata"
+		case "cifratura":
+			data.Error = "Chiave di cifratura non salvata: " + r.URL.Query().Get("detail")
+		case "config":
+			data.Error = "Errore salvataggio configurazione"
 		case "upload":
 			data.Error = "Errore upload file"
 		case "invalid":
@@ -160,31 +204,23 @@ func eseguiBackupInterno(tipo string) error {
 	filename := fmt.Sprintf("furviogest_%s.tar.gz", timestamp)
 	filepath := filepath.Join(backupDir, filename)
 
-	// Crea archivio tar.gz
-	dimensione, err := creaArchivioBackup(filepath)
+	// Crea archivio tar.gz: il backup manuale e completo, da scaricare e conservare
+	// altrove; gli altri copiano solo gli allegati cambiati
+	dimensione, err := creaArchivioBackup(filepath, tipo != "manuale")
 	if err != nil {
-		logBackup(filename, tipo, 0, false, false, err.Error())
+		logBackup(filename, tipo, 0, false, esitoCopie{}, err.Error())
 		return err
 	}
 
-	// Copia su NAS se abilitato
+	// Copia sulle destinazioni esterne abilitate
 	config := getBackupConfig()
-	nasOK := true
-	nasErr := ""
-	if config.NasAbilitato && config.NasPath != "" {
-		if err := copiaSuNAS(filepath, config); err != nil {
-			nasOK = false
-			nasErr = err.Error()
-			log.Printf("Errore copia NAS: %v", err)
-		}
-	}
-
-	// Log del backup
 	errLog := ""
-	if !nasOK {
-		errLog = "Backup locale OK, errore NAS: " + nasErr
+	copie := copiaSuDestinazioni(filepath)
+	if len(copie.Errori) > 0 {
+		errLog = "Backup locale OK, errore copia su " + strings.Join(copie.Errori, "; ")
 	}
-	logBackup(filename, tipo, dimensione, true, nasOK, errLog)
+
+	logBackup(filename, tipo, dimensione, true, copie, errLog)
 
 	// Pulizia vecchi backup
 	pulisciVecchiBackup(config.RetentionDays)
@@ -192,48 +228,96 @@ func eseguiBackupInterno(tipo string) error {
 	return nil
 }
 
-// creaArchivioBackup crea il file tar.gz con DB e uploads
-func creaArchivioBackup(destPath string) (int64, error) {
-	file, err := os.Create(destPath)
+// creaArchivioBackup crea il file tar.gz con DB e uploads. Il database e un'istantanea
+// coerente; se incrementale, gli allegati gia archiviati e invariati non vengono copiati.
+// Con la cifratura attiva il tar.gz viene cifrato con la chiave dei backup.
+func creaArchivioBackup(destPath string, incrementale bool) (int64, error) {
+	// Istantanea del database presa mentre il server continua a scrivere
+	tempDir, err := os.MkdirTemp(filepath.Dir(destPath), ".istantanea_")
 	if err != nil {
 		return 0, err
 	}
+	defer os.RemoveAll(tempDir)
+	dbIstantanea := filepath.Join(tempDir, "furviogest.db")
+	if err := database.Istantanea(dbIstantanea); err != nil {
+		return 0, err
+	}
+
+	// L'archivio si scrive in un file temporaneo rinominato solo a scrittura completata:
+	// un errore non lascia tra i backup un archivio troncato
+	temporaneo := destPath + ".tmp"
+	file, err := os.Create(temporaneo)
+	if err != nil {
+		return 0, err
+	}
+	completato := false
+	defer func() {
+		if !completato {
+			os.Remove(temporaneo)
+		}
+	}()
 	defer file.Close()
 
-	gzWriter := gzip.NewWriter(file)
+	var out io.Writer = file
+	var cifratore io.WriteCloser
+	if chiave := chiaveBackup(); chiave != "" {
+		if cifratore, err = segreti.CifraFlusso(file, chiave); err != nil {
+			return 0, fmt.Errorf("errore cifratura: %v", err)
+		}
+		defer cifratore.Close()
+		out = cifratore
+	}
+
+	gzWriter := gzip.NewWriter(out)
 	defer gzWriter.Close()
 
 	tarWriter := tar.NewWriter(gzWriter)
 	defer tarWriter.Close()
 
 	// Aggiungi database
-	dbPath := filepath.Join(dataDir, "furviogest.db")
-	if err := aggiungiFileATar(tarWriter, dbPath, "furviogest.db"); err != nil {
+	var manifest []FileManifest
+	voce, err := aggiungiFileATar(tarWriter, dbIstantanea, "furviogest.db")
+	if err != nil {
 		return 0, fmt.Errorf("errore aggiunta database: %v", err)
 	}
+	manifest = append(manifest, voce)
 
 	// Aggiungi cartella uploads se esiste
-	uploadsDir := filepath.Join(dataDir, "uploads")
-	if _, err := os.Stat(uploadsDir); err == nil {
-		err = filepath.Walk(uploadsDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			relPath, _ := filepath.Rel(dataDir, path)
-			return aggiungiFileATar(tarWriter, path, relPath)
-		})
-		if err != nil {
-			return 0, fmt.Errorf("errore aggiunta uploads: %v", err)
-		}
+	uploads, indice, err := aggiungiUploads(tarWriter, filepath.Base(destPath), incrementale)
+	if err != nil {
+		return 0, fmt.Errorf("errore aggiunta uploads: %v", err)
+	}
+	manifest = append(manifest, uploads...)
+
+	// Manifest con l'impronta SHA-256 di ogni file, controllato da verifica e ripristino
+	if err := scriviManifest(tarWriter, manifest); err != nil {
+		return 0, fmt.Errorf("errore scrittura manifest: %v", err)
 	}
 
 	// Chiudi tutto per ottenere dimensione corretta
-	tarWriter.Close()
-	gzWriter.Close()
-	file.Close()
+	if err := tarWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return 0, err
+	}
+	if cifratore != nil {
+		if err := cifratore.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(temporaneo, destPath); err != nil {
+		return 0, err
+	}
+	completato = true
+
+	// L'indice si aggiorna solo ad archivio completo
+	if err := salvaIndiceUploads(indice); err != nil {
+		log.Printf("Errore aggiornamento indice allegati: %v", err)
+	}
 
 	// Ottieni dimensione file
 	info, err := os.Stat(destPath)
@@ -244,30 +328,34 @@ func creaArchivioBackup(destPath string) (int64, error) {
 	return info.Size(), nil
 }
 
-func aggiungiFileATar(tw *tar.Writer, filePath, nameInArchive string) error {
+// aggiungiFileATar copia il file nell'archivio e ne restituisce la voce per il manifest
+func aggiungiFileATar(tw *tar.Writer, filePath, nameInArchive string) (FileManifest, error) {
+	voce := FileManifest{Nome: nameInArchive}
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return voce, err
 	}
 	defer file.Close()
 
 	info, err := file.Stat()
 	if err != nil {
-		return err
+		return voce, err
 	}
 
 	header, err := tar.FileInfoHeader(info, "")
 	if err != nil {
-		return err
+		return voce, err
 	}
 	header.Name = nameInArchive
 
 	if err := tw.WriteHeader(header); err != nil {
-		return err
+		return voce, err
 	}
 
-	_, err = io.Copy(tw, file)
-	return err
+	hash := sha256.New()
+	voce.Dimensione, err = io.Copy(io.MultiWriter(tw, hash), file)
+	voce.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return voce, err
 }
 
 // ============================================
@@ -280,27 +368,22 @@ func RipristinaBackup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := r.FormValue("filename")
-	if filename == "" {
-		http.Redirect(w, r, "/backup?error=invalid", http.StatusSeeOther)
-		return
-	}
-
 	// Verifica che il file esista
-	backupPath := filepath.Join(backupDir, filename)
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+	backupPath, ok := percorsoBackup(r.FormValue("filename"))
+	if !ok {
 		http.Redirect(w, r, "/backup?error=invalid", http.StatusSeeOther)
 		return
 	}
 
 	// Esegui restore
-	if err := eseguiRestore(backupPath); err != nil {
+	istantanea, err := eseguiRestore(backupPath, r.FormValue("chiave"))
+	if err != nil {
 		log.Printf("Errore restore: %v", err)
-		http.Redirect(w, r, "/backup?error=restore", http.StatusSeeOther)
+		http.Redirect(w, r, "/backup?error=restore&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
 		return
 	}
 
-	http.Redirect(w, r, "/backup?success=restore", http.StatusSeeOther)
+	http.Redirect(w, r, "/backup?success=restore&detail="+url.QueryEscape(istantanea), http.StatusSeeOther)
 }
 
 // UploadBackup gestisce l'upload di un file di backup
@@ -345,81 +428,80 @@ func UploadBackup(w http.ResponseWriter, r *http.Request) {
 
 	// Esegui restore
 	if r.FormValue("restore_now") == "1" {
-		if err := eseguiRestore(destPath); err != nil {
+		istantanea, err := eseguiRestore(destPath, r.FormValue("chiave"))
+		if err != nil {
 			log.Printf("Errore restore da upload: %v", err)
-			http.Redirect(w, r, "/backup?error=restore", http.StatusSeeOther)
+			http.Redirect(w, r, "/backup?error=restore&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
 			return
 		}
-		http.Redirect(w, r, "/backup?success=restore", http.StatusSeeOther)
+		http.Redirect(w, r, "/backup?success=restore&detail="+url.QueryEscape(istantanea), http.StatusSeeOther)
 		return
 	}
 
 	http.Redirect(w, r, "/backup?success=backup", http.StatusSeeOther)
 }
 
-func eseguiRestore(archivePath string) error {
-	// Apri archivio
-	file, err := os.Open(archivePath)
+// eseguiRestore verifica l'archivio, salva un'istantanea dello stato attuale e
+// sostituisce database e allegati. Restituisce il nome dell'archivio pre-ripristino.
+// Un archivio cifrato si apre con la chiave indicata o con quella configurata.
+func eseguiRestore(archivePath, chiave string) (string, error) {
+	// Directory temporanea per estrazione
+	tempDir, err := os.MkdirTemp("", "furviogest_restore_")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer file.Close()
+	defer os.RemoveAll(tempDir)
 
-	gzReader, err := gzip.NewReader(file)
+	// Estrai file e verifica impronte e integrita del database prima di toccare i dati
+	estratti, err := estraiBackup(archivePath, tempDir, chiaviBackup(chiave))
 	if err != nil {
-		return fmt.Errorf("file non valido: %v", err)
+		return "", err
+	}
+	if esito := verificaEstratto(tempDir, estratti); !esito.OK() {
+		return "", fmt.Errorf("verifica fallita: %s", esito.Riepilogo())
 	}
-	defer gzReader.Close()
-
-	tarReader := tar.NewReader(gzReader)
 
-	// Directory temporanea per estrazione
-	tempDir, err := os.MkdirTemp("", "furviogest_restore_")
+	// Istantanea dello stato attuale, per annullare il ripristino
+	istantanea, err := istantaneaPreRipristino()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("istantanea pre-ripristino fallita, ripristino annullato: %v", err)
 	}
-	defer os.RemoveAll(tempDir)
 
-	// Estrai file
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+	// La chiave dei backup e dell'installazione, non dei dati: resta quella attuale
+	var chiavePrima string
+	database.DB.QueryRow("SELECT COALESCE(cifratura_chiave, '') FROM backup_sistema_config WHERE id = 1").Scan(&chiavePrima)
 
-		targetPath := filepath.Join(tempDir, header.Name)
+	// Chiudi connessione database prima di sovrascrivere
+	database.DB.Close()
+	err = sostituisciDati(tempDir)
 
-		// Crea directory parent se necessario
-		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return err
-		}
+	// Riapri connessione database anche se la copia e fallita: le migrazioni portano il
+	// backup allo schema corrente
+	if errDB := database.InitDB(filepath.Join(dataDir, "furviogest.db")); errDB != nil && err == nil {
+		err = errDB
+	}
 
-		if header.Typeflag == tar.TypeReg {
-			outFile, err := os.Create(targetPath)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return err
-			}
-			outFile.Close()
+	if err == nil && chiaveBackup() != segreti.Leggi(chiavePrima) {
+		if errChiave := impostaChiaveBackup(chiavePrima); errChiave != nil {
+			log.Printf("Errore ripristino chiave backup: %v", errChiave)
 		}
 	}
 
-	// Chiudi connessione database prima di sovrascrivere
-	database.DB.Close()
+	// Il registro dei backup e nel database appena ripristinato: vi si riporta l'istantanea
+	if info, errStat := os.Stat(filepath.Join(backupDir, istantanea)); errStat == nil {
+		logBackup(istantanea, tipoPreRipristino, info.Size(), true, esitoCopie{}, "")
+	}
+
+	return istantanea, err
+}
 
+// sostituisciDati copia database e allegati estratti nella directory dei dati
+func sostituisciDati(tempDir string) error {
 	// Copia database
 	tempDB := filepath.Join(tempDir, "furviogest.db")
-	if _, err := os.Stat(tempDB); err == nil {
-		destDB := filepath.Join(dataDir, "furviogest.db")
-		if err := copyFile(tempDB, destDB); err != nil {
-			return fmt.Errorf("errore copia database: %v", err)
-		}
+	destDB := filepath.Join(dataDir, "furviogest.db")
+	if err := copyFile(tempDB, destDB); err != nil {
+		return fmt.Errorf("errore copia database: %v", err)
 	}
 
 	// Copia uploads se presenti
@@ -432,9 +514,6 @@ func eseguiRestore(archivePath string) error {
 		}
 	}
 
-	// Riapri connessione database
-	database.InitDB(filepath.Join(dataDir, "furviogest.db"))
-
 	return nil
 }
 
@@ -482,100 +561,25 @@ func SalvaConfigBackup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nasAbilitato := r.FormValue("nas_abilitato") == "1"
-	nasPath := strings.TrimSpace(r.FormValue("nas_path"))
-	nasUsername := strings.TrimSpace(r.FormValue("nas_username"))
-	nasPassword := r.FormValue("nas_password")
 	retentionDays, _ := strconv.Atoi(r.FormValue("retention_days"))
 	if retentionDays < 1 {
 		retentionDays = 7
 	}
-
-	// Se la password è vuota, mantieni quella esistente
-	if nasPassword == "" {
-		var oldPassword string
-		database.DB.QueryRow("SELECT nas_password FROM backup_sistema_config WHERE id = 1").Scan(&oldPassword)
-		nasPassword = oldPassword
-	}
-
-	_, err := database.DB.Exec(`
-		UPDATE backup_sistema_config
-		SET nas_abilitato = ?, nas_path = ?, nas_username = ?, nas_password = ?,
-		    retention_days = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = 1
-	`, nasAbilitato, nasPath, nasUsername, nasPassword, retentionDays)
-
-	if err != nil {
-		log.Printf("Errore salvataggio config backup: %v", err)
+	oraBackup := strings.TrimSpace(r.FormValue("ora_backup"))
+	if _, err := cronOraBackup(oraBackup); err != nil {
 		http.Redirect(w, r, "/backup?error=config", http.StatusSeeOther)
 		return
 	}
-
-	http.Redirect(w, r, "/backup?success=config", http.StatusSeeOther)
-}
-
-func TestNAS(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/backup", http.StatusSeeOther)
-		return
-	}
-
-	nasPath := strings.TrimSpace(r.FormValue("nas_path"))
-	nasUsername := strings.TrimSpace(r.FormValue("nas_username"))
-	nasPassword := r.FormValue("nas_password")
-
-	// Se password vuota, usa quella salvata
-	if nasPassword == "" {
-		var savedPassword string
-		database.DB.QueryRow("SELECT nas_password FROM backup_sistema_config WHERE id = 1").Scan(&savedPassword)
-		nasPassword = savedPassword
-	}
-
-	err := testConnessioneNAS(nasPath, nasUsername, nasPassword)
-	if err != nil {
-		http.Redirect(w, r, "/backup?error=nas_test&detail="+err.Error(), http.StatusSeeOther)
-		return
-	}
-
-	http.Redirect(w, r, "/backup?success=nas_test", http.StatusSeeOther)
-}
-
-// TestAndSaveNAS testa la connessione e se ok salva la configurazione
-func TestAndSaveNAS(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/backup", http.StatusSeeOther)
-		return
-	}
-
-	nasPath := strings.TrimSpace(r.FormValue("nas_path"))
-	nasUsername := strings.TrimSpace(r.FormValue("nas_username"))
-	nasPassword := r.FormValue("nas_password")
-	retentionDays, _ := strconv.Atoi(r.FormValue("retention_days"))
-	if retentionDays < 1 {
-		retentionDays = 7
-	}
-
-	// Se password vuota, usa quella salvata
-	if nasPassword == "" {
-		var savedPassword string
-		database.DB.QueryRow("SELECT nas_password FROM backup_sistema_config WHERE id = 1").Scan(&savedPassword)
-		nasPassword = savedPassword
-	}
-
-	// Prima testa la connessione
-	err := testConnessioneNAS(nasPath, nasUsername, nasPassword)
-	if err != nil {
-		http.Redirect(w, r, "/backup?error=nas_test&detail="+err.Error(), http.StatusSeeOther)
-		return
+	giorniAvviso, _ := strconv.Atoi(r.FormValue("giorni_avviso"))
+	if giorniAvviso < 1 {
+		giorniAvviso = 2
 	}
 
-	// Test OK, salva la configurazione con NAS abilitato
-	_, err = database.DB.Exec(`
+	err := modificaConAudit(r, "backup_sistema_config", 1, `
 		UPDATE backup_sistema_config
-		SET nas_abilitato = 1, nas_path = ?, nas_username = ?, nas_password = ?,
-		    retention_days = ?, updated_at = CURRENT_TIMESTAMP
+		SET retention_days = ?, ora_backup = ?, giorni_avviso = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = 1
-	`, nasPath, nasUsername, nasPassword, retentionDays)
+	`, retentionDays, oraBackup, giorniAvviso)
 
 	if err != nil {
 		log.Printf("Errore salvataggio config backup: %v", err)
@@ -583,137 +587,7 @@ func TestAndSaveNAS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.Redirect(w, r, "/backup?success=nas_saved", http.StatusSeeOther)
-}
-
-// DisableNAS disabilita il backup su NAS
-func DisableNAS(w http.ResponseWriter, r *http.Request) {
-	database.DB.Exec("UPDATE backup_sistema_config SET nas_abilitato = 0, updated_at = CURRENT_TIMESTAMP WHERE id = 1")
-	http.Redirect(w, r, "/backup?success=nas_disabled", http.StatusSeeOther)
-}
-
-// parseNASPath separa share e sottocartella dal percorso NAS
-// Input: //192.168.1.100/NAS/backup/furviogest
-// Output: share=//192.168.1.100/NAS, subdir=backup/furviogest
-func parseNASPath(fullPath string) (share string, subdir string) {
-	// Rimuovi // iniziale per il parsing
-	path := strings.TrimPrefix(fullPath, "//")
-	parts := strings.SplitN(path, "/", 3) // server, share, resto
-
-	if len(parts) >= 2 {
-		share = "//" + parts[0] + "/" + parts[1]
-	}
-	if len(parts) >= 3 {
-		subdir = parts[2]
-	}
-	return
-}
-
-func testConnessioneNAS(path, username, password string) error {
-	// Usa smbclient per testare la connessione (non richiede root)
-	share, subdir := parseNASPath(path)
-
-	// Prima testa connessione alla share
-	var cmd *exec.Cmd
-	if subdir != "" {
-		// Se c'è sottocartella, prova a listare quella
-		cmd = exec.Command("smbclient", share, "-U", username+"%"+password, "-c", fmt.Sprintf("cd %s; ls", subdir))
-	} else {
-		cmd = exec.Command("smbclient", share, "-U", username+"%"+password, "-c", "ls")
-	}
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("connessione fallita: %s", string(output))
-	}
-
-	return nil
-}
-
-func copiaSuNAS(localPath string, config BackupConfig) error {
-	// Usa smbclient per copiare il file (non richiede root)
-	filename := filepath.Base(localPath)
-	share, subdir := parseNASPath(config.NasPath)
-
-	var cmdStr string
-	if subdir != "" {
-		// cd nella sottocartella e poi put
-		cmdStr = fmt.Sprintf("cd %s; put %s %s", subdir, localPath, filename)
-	} else {
-		cmdStr = fmt.Sprintf("put %s %s", localPath, filename)
-	}
-
-	cmd := exec.Command("smbclient", share,
-		"-U", config.NasUsername+"%"+config.NasPassword,
-		"-c", cmdStr)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("copia NAS fallita: %s", string(output))
-	}
-
-	// Pulizia vecchi backup su NAS
-	pulisciVecchiBackupNAS(config)
-
-	return nil
-}
-
-func pulisciVecchiBackupNAS(config BackupConfig) {
-	share, subdir := parseNASPath(config.NasPath)
-
-	// Lista file su NAS
-	var cmdStr string
-	if subdir != "" {
-		cmdStr = fmt.Sprintf("cd %s; ls furviogest_*.tar.gz", subdir)
-	} else {
-		cmdStr = "ls furviogest_*.tar.gz"
-	}
-
-	cmd := exec.Command("smbclient", share,
-		"-U", config.NasUsername+"%"+config.NasPassword,
-		"-c", cmdStr)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return
-	}
-
-	// Parse output e trova file vecchi da eliminare
-	cutoffDate := time.Now().AddDate(0, 0, -config.RetentionDays)
-	lines := strings.Split(string(output), "\n")
-
-	var filesToDelete []string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "furviogest_") && strings.Contains(line, ".tar.gz") {
-			// Estrai nome file (prima colonna)
-			parts := strings.Fields(line)
-			if len(parts) > 0 {
-				filename := parts[0]
-				// Estrai data dal nome: furviogest_2025-12-12_15-31-34.tar.gz
-				namePart := strings.TrimPrefix(filename, "furviogest_")
-				namePart = strings.TrimSuffix(namePart, ".tar.gz")
-				if fileDate, err := time.Parse("2006-01-02_15-04-05", namePart); err == nil {
-					if fileDate.Before(cutoffDate) {
-						filesToDelete = append(filesToDelete, filename)
-					}
-				}
-			}
-		}
-	}
-
-	// Elimina file vecchi
-	for _, f := range filesToDelete {
-		var delCmd string
-		if subdir != "" {
-			delCmd = fmt.Sprintf("cd %s; del %s", subdir, f)
-		} else {
-			delCmd = fmt.Sprintf("del %s", f)
-		}
-		exec.Command("smbclient", share,
-			"-U", config.NasUsername+"%"+config.NasPassword,
-			"-c", delCmd).Run()
-	}
+	http.Redirect(w, r, "/backup?success=config", http.StatusSeeOther)
 }
 
 // ============================================
@@ -724,15 +598,15 @@ func getBackupConfig() BackupConfig {
 	var config BackupConfig
 	config.RetentionDays = 7 // default
 	config.NasConfigRetention = 3 // default
+	config.GiorniAvviso = 2 // default
 
 	database.DB.QueryRow(`
-		SELECT id, nas_abilitato, COALESCE(nas_path,''), COALESCE(nas_username,''),
-		       COALESCE(nas_password,''), retention_days, COALESCE(ora_backup,'00:00'), updated_at,
-		       COALESCE(nas_config_abilitato, 0), COALESCE(nas_config_retention, 3)
+		SELECT id, retention_days, COALESCE(ora_backup,'00:00'), updated_at,
+		       COALESCE(nas_config_abilitato, 0), COALESCE(nas_config_retention, 3),
+		       COALESCE(cifratura_chiave, '') != '', giorni_avviso
 		FROM backup_sistema_config WHERE id = 1
-	`).Scan(&config.ID, &config.NasAbilitato, &config.NasPath, &config.NasUsername,
-		&config.NasPassword, &config.RetentionDays, &config.OraBackup, &config.UpdatedAt,
-		&config.NasConfigAbilitato, &config.NasConfigRetention)
+	`).Scan(&config.ID, &config.RetentionDays, &config.OraBackup, &config.UpdatedAt,
+		&config.NasConfigAbilitato, &config.NasConfigRetention, &config.Cifratura, &config.GiorniAvviso)
 
 	return config
 }
@@ -744,6 +618,7 @@ func getBackupList() []BackupInfo {
 	if err != nil {
 		return backups
 	}
+	invii := getInviiPerArchivio()
 
 	for _, f := range files {
 		if strings.HasPrefix(f.Name(), "furviogest_") && strings.HasSuffix(f.Name(), ".tar.gz") {
@@ -767,6 +642,8 @@ func getBackupList() []BackupInfo {
 				Dimensione: info.Size(),
 				DataOra:    dataOra,
 				Tipo:       tipo,
+				Cifrato:    archivioCifrato(filepath.Join(backupDir, f.Name())),
+				Invii:      invii[f.Name()],
 			})
 		}
 	}
@@ -779,11 +656,12 @@ func getBackupList() []BackupInfo {
 	return backups
 }
 
-func logBackup(filename, tipo string, dimensione int64, localeOK, nasOK bool, errore string) {
+// logBackup registra l'esito del backup e delle sue copie esterne
+func logBackup(filename, tipo string, dimensione int64, localeOK bool, copie esitoCopie, errore string) {
 	database.DB.Exec(`
-		INSERT INTO backup_sistema_log (filename, tipo, dimensione, locale_ok, nas_ok, errore)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, filename, tipo, dimensione, localeOK, nasOK, errore)
+		INSERT INTO backup_sistema_log (filename, tipo, dimensione, locale_ok, destinazioni_abilitate, destinazioni_fallite, errore)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, filename, tipo, dimensione, localeOK, copie.Abilitate, strings.Join(copie.Fallite, ", "), errore)
 }
 
 func pulisciVecchiBackup(retentionDays int) {
@@ -794,6 +672,7 @@ func pulisciVecchiBackup(retentionDays int) {
 		return
 	}
 
+	var scaduti, conservati []string
 	for _, f := range files {
 		if strings.HasPrefix(f.Name(), "furviogest_") && strings.HasSuffix(f.Name(), ".tar.gz") {
 			info, err := f.Info()
@@ -801,42 +680,29 @@ func pulisciVecchiBackup(retentionDays int) {
 				continue
 			}
 			if info.ModTime().Before(cutoffDate) {
-				os.Remove(filepath.Join(backupDir, f.Name()))
-				// Rimuovi anche dal log
-				database.DB.Exec("DELETE FROM backup_sistema_log WHERE filename = ?", f.Name())
+				scaduti = append(scaduti, f.Name())
+			} else {
+				conservati = append(conservati, f.Name())
 			}
 		}
 	}
+
+	// Gli archivi che contengono allegati di backup incrementali conservati restano
+	protetti := archiviProtetti(conservati, scaduti)
+	for _, nome := range scaduti {
+		if protetti[nome] {
+			continue
+		}
+		os.Remove(filepath.Join(backupDir, nome))
+		// Rimuovi anche dal log
+		database.DB.Exec("DELETE FROM backup_sistema_log WHERE filename = ?", nome)
+	}
 }
 
 // ============================================
-// API PER BACKUP AUTOMATICO (chiamato da cron)
+// DOWNLOAD BACKUP
 // ============================================
 
-func APIBackupAutomatico(w http.ResponseWriter, r *http.Request) {
-	// Verifica che sia una richiesta locale
-	if !strings.HasPrefix(r.RemoteAddr, "127.0.0.1") && !strings.HasPrefix(r.RemoteAddr, "[::1]") {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return
-	}
-
-	err := eseguiBackupInterno("automatico")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-		return
-	}
-
-	// Backup configurazioni rete su NAS se abilitato
-	config := getBackupConfig()
-	if config.NasConfigAbilitato {
-		go eseguiBackupConfigNAS(config)
-	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-}
-
 // DownloadBackup serve un file di backup per il download
 func DownloadBackup(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
@@ -866,17 +732,13 @@ func DownloadBackup(w http.ResponseWriter, r *http.Request) {
 // GetUltimoBackupErrore ritorna l'errore dell'ultimo backup se presente
 // Usato per mostrare il banner al login
 func GetUltimoBackupErrore() string {
-	config := getBackupConfig()
-
-	var localeOK, nasOK bool
-	var errore string
-	var createdAt time.Time
-
+	var ultimo BackupLog
 	err := database.DB.QueryRow(`
-		SELECT locale_ok, nas_ok, COALESCE(errore,''), created_at
+		SELECT locale_ok, destinazioni_abilitate, destinazioni_fallite, COALESCE(errore,''), created_at
 		FROM backup_sistema_log
+		WHERE tipo != 'pre_ripristino'
 		ORDER BY created_at DESC LIMIT 1
-	`).Scan(&localeOK, &nasOK, &errore, &createdAt)
+	`).Scan(&ultimo.LocaleOK, &ultimo.DestinazioniAbilitate, &ultimo.DestinazioniFallite, &ultimo.Errore, &ultimo.CreatedAt)
 
 	if err != nil {
 		// Nessun backup mai eseguito
@@ -884,17 +746,18 @@ func GetUltimoBackupErrore() string {
 	}
 
 	// Controlla se il backup è più vecchio di 25 ore (margine per backup giornaliero)
-	if time.Since(createdAt) > 25*time.Hour {
+	if time.Since(ultimo.CreatedAt) > 25*time.Hour {
 		return fmt.Sprintf("Ultimo backup eseguito il %s. Verificare il sistema di backup automatico.",
-			createdAt.Format("02/01/2006 15:04"))
+			ultimo.CreatedAt.Format("02/01/2006 15:04"))
 	}
 
-	if !localeOK {
-		return "Ultimo backup locale FALLITO: " + errore
+	if !ultimo.LocaleOK {
+		return "Ultimo backup locale FALLITO: " + ultimo.Errore
 	}
 
-	if config.NasAbilitato && !nasOK {
-		return "Ultimo backup su NAS FALLITO: " + errore
+	if ultimo.CopieFallite() {
+		return fmt.Sprintf("Ultima copia del backup FALLITA su %s (%d destinazioni abilitate): %s",
+			ultimo.DestinazioniFallite, ultimo.DestinazioniAbilitate, ultimo.Errore)
 	}
 
 	return ""
@@ -922,7 +785,7 @@ func SalvaConfigBackupNAS(w http.ResponseWriter, r *http.Request) {
 		nasConfigRetention = 30
 	}
 
-	_, err := database.DB.Exec(`
+	err := modificaConAudit(r, "backup_sistema_config", 1, `
 		UPDATE backup_sistema_config 
 		SET nas_config_abilitato = ?, nas_config_retention = ?, updated_at = CURRENT_TIMESTAMP 
 		WHERE id = 1
@@ -937,7 +800,7 @@ func SalvaConfigBackupNAS(w http.ResponseWriter, r *http.Request) {
 
 // DisabilitaConfigBackupNAS disabilita il backup configurazioni rete su NAS
 func DisabilitaConfigBackupNAS(w http.ResponseWriter, r *http.Request) {
-	_, err := database.DB.Exec(`
+	err := modificaConAudit(r, "backup_sistema_config", 1, `
 		UPDATE backup_sistema_config 
 		SET nas_config_abilitato = 0, updated_at = CURRENT_TIMESTAMP 
 		WHERE id = 1
@@ -950,152 +813,6 @@ func DisabilitaConfigBackupNAS(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/backup", http.StatusSeeOther)
 }
 
-// eseguiBackupConfigNAS copia i backup delle configurazioni di rete su NAS via smbclient
-func eseguiBackupConfigNAS(config BackupConfig) {
-	log.Println("[BACKUP CONFIG NAS] Avvio backup configurazioni rete su NAS")
-
-	// Directory locale dei backup configurazioni
-	configBackupDir := filepath.Join(dataDir, "backups")
-
-	// Parse NAS path per ottenere share e subdir
-	share, subdir := parseNASPath(config.NasPath)
-
-	// Trova tutte le sottodirectory
-	entries, err := os.ReadDir(configBackupDir)
-	if err != nil {
-		log.Printf("[BACKUP CONFIG NAS] Errore lettura directory: %v", err)
-		return
-	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		dirName := entry.Name()
-		var nasSubdir string
-		var skipBackup bool
-
-		// Determina tipo directory e sottocartella NAS
-		if strings.HasPrefix(dirName, "nave_") {
-			// Estrai ID nave e verifica se ferma
-			naveIDStr := strings.TrimPrefix(dirName, "nave_")
-			naveID, err := strconv.ParseInt(naveIDStr, 10, 64)
-			if err != nil {
-				continue
-			}
-			
-			// Salta navi ferme per lavori
-			var ferma int
-			database.DB.QueryRow("SELECT ferma_per_lavori FROM navi WHERE id = ?", naveID).Scan(&ferma)
-			if ferma == 1 {
-				log.Printf("[BACKUP CONFIG NAS] Nave %d ferma per lavori, skip", naveID)
-				skipBackup = true
-			}
-			if subdir != "" {
-				nasSubdir = subdir + "/config_navi"
-			} else {
-				nasSubdir = "config_navi"
-			}
-
-		} else if strings.HasPrefix(dirName, "ufficio_") {
-			if subdir != "" {
-				nasSubdir = subdir + "/config_uffici"
-			} else {
-				nasSubdir = "config_uffici"
-			}
-
-		} else if strings.HasPrefix(dirName, "sala_server_") {
-			if subdir != "" {
-				nasSubdir = subdir + "/config_sale_server"
-			} else {
-				nasSubdir = "config_sale_server"
-			}
-
-		} else {
-			// Directory non riconosciuta, skip
-			continue
-		}
-
-		if skipBackup {
-			continue
-		}
-
-		// Directory sorgente locale
-		srcDir := filepath.Join(configBackupDir, dirName)
-
-		// Copia i file su NAS via smbclient
-		files, _ := os.ReadDir(srcDir)
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-			localPath := filepath.Join(srcDir, f.Name())
-			
-			// Crea directory sul NAS e copia file
-			cmdStr := fmt.Sprintf("mkdir %s; mkdir %s/%s; cd %s/%s; put %s %s", 
-				nasSubdir, nasSubdir, dirName, nasSubdir, dirName, localPath, f.Name())
-			
-			cmd := exec.Command("smbclient", share,
-				"-U", config.NasUsername+"%"+config.NasPassword,
-				"-c", cmdStr)
-			cmd.Run() // Ignora errori mkdir se directory esiste già
-		}
-
-		// Applica retention via smbclient
-		lsCmd := fmt.Sprintf("cd %s/%s; ls *.cfg", nasSubdir, dirName)
-		cmd := exec.Command("smbclient", share,
-			"-U", config.NasUsername+"%"+config.NasPassword,
-			"-c", lsCmd)
-		output, _ := cmd.CombinedOutput()
-		
-		applicaRetentionNASviaSMB(share, nasSubdir, dirName, config.NasUsername, config.NasPassword, string(output), config.NasConfigRetention)
-		log.Printf("[BACKUP CONFIG NAS] Backup completato per %s", dirName)
-	}
-
-	log.Println("[BACKUP CONFIG NAS] Backup completato")
-}
-
-// applicaRetentionNASviaSMB elimina i file vecchi su NAS via smbclient
-func applicaRetentionNASviaSMB(nasShare, nasSubdir, dirName, username, password, lsOutput string, retention int) {
-	// Parse output e raggruppa per apparato
-	lines := strings.Split(lsOutput, "\n")
-	groups := make(map[string][]string)
-	
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if !strings.HasSuffix(line, ".cfg") {
-			continue
-		}
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
-			continue
-		}
-		filename := parts[0]
-		// Estrai prefisso (es. "ac_AC" o "switch_SW-CAN29-229")
-		nameParts := strings.Split(filename, "_")
-		if len(nameParts) >= 2 {
-			prefix := nameParts[0] + "_" + nameParts[1]
-			groups[prefix] = append(groups[prefix], filename)
-		}
-	}
-	
-	// Per ogni gruppo, mantieni solo gli ultimi N (ordinati alfabeticamente = cronologicamente)
-	for _, fileList := range groups {
-		if len(fileList) <= retention {
-			continue
-		}
-		sort.Strings(fileList)
-		// Elimina i più vecchi (primi nell'ordine alfabetico dato il formato data nel nome)
-		for i := 0; i < len(fileList)-retention; i++ {
-			delCmd := fmt.Sprintf("cd %s/%s; del %s", nasSubdir, dirName, fileList[i])
-			exec.Command("smbclient", nasShare,
-				"-U", username+"%"+password,
-				"-c", delCmd).Run()
-		}
-	}
-}
-
 // applicaRetentionNAS mantiene solo gli ultimi N backup per ogni apparato
 func applicaRetentionNAS(dir string, retention int) {
 	files, err := os.ReadDir(dir)
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"furviogest/internal/database"
+)
+
+// ============================================
+// BACKUP INCREMENTALE DEGLI ALLEGATI
+// ============================================
+
+// giorniRiferimentoMax limita l'eta degli archivi a cui un backup incrementale puo
+// rimandare: oltre, il file viene archiviato di nuovo e la catena resta corta
+const giorniRiferimentoMax = 7
+
+// voceIndice e un allegato gia archiviato, con l'archivio che ne contiene il contenuto
+type voceIndice struct {
+	Percorso     string
+	SHA256       string
+	Dimensione   int64
+	ModificatoIl int64
+	Archivio     string
+}
+
+// indiceUploads associa il percorso relativo dell'allegato alla sua voce
+type indiceUploads struct {
+	voci       map[string]voceIndice
+	riferibili map[string]bool
+}
+
+// caricaIndiceUploads legge l'indice degli allegati archiviati
+func caricaIndiceUploads() *indiceUploads {
+	indice := &indiceUploads{voci: make(map[string]voceIndice), riferibili: make(map[string]bool)}
+	rows, err := database.DB.Query(`
+		SELECT percorso, sha256, dimensione, modificato_il, archivio FROM backup_uploads_indice
+	`)
+	if err != nil {
+		log.Printf("Indice allegati non disponibile, backup completo: %v", err)
+		return indice
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v voceIndice
+		if err := rows.Scan(&v.Percorso, &v.SHA256, &v.Dimensione, &v.ModificatoIl, &v.Archivio); err == nil {
+			indice.voci[v.Percorso] = v
+		}
+	}
+	return indice
+}
+
+// riutilizza restituisce la voce dell'indice se il contenuto del file e invariato ed e
+// in un archivio ancora disponibile e abbastanza recente
+func (ix *indiceUploads) riutilizza(rel, path string, info os.FileInfo) (voceIndice, bool) {
+	v, ok := ix.voci[rel]
+	if !ok || v.Dimensione != info.Size() || !ix.riferibile(v.Archivio) {
+		return v, false
+	}
+	// Data di modifica cambiata: si confronta il contenuto
+	if v.ModificatoIl != info.ModTime().UnixNano() {
+		sha, err := improntaFile(path)
+		if err != nil || sha != v.SHA256 {
+			return v, false
+		}
+		v.ModificatoIl = info.ModTime().UnixNano()
+	}
+	return v, true
+}
+
+// riferibile indica se un backup incrementale puo rimandare all'archivio
+func (ix *indiceUploads) riferibile(archivio string) bool {
+	ok, visto := ix.riferibili[archivio]
+	if !visto {
+		_, esiste := percorsoBackup(archivio)
+		data, valida := dataArchivio(archivio)
+		ok = esiste && valida && time.Since(data) < giorniRiferimentoMax*24*time.Hour
+		ix.riferibili[archivio] = ok
+	}
+	return ok
+}
+
+// salvaIndiceUploads sostituisce l'indice con gli allegati dell'ultimo archivio
+func salvaIndiceUploads(voci []voceIndice) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM backup_uploads_indice"); err != nil {
+		return err
+	}
+	for _, v := range voci {
+		if _, err := tx.Exec(`
+			INSERT INTO backup_uploads_indice (percorso, sha256, dimensione, modificato_il, archivio)
+			VALUES (?, ?, ?, ?, ?)
+		`, v.Percorso, v.SHA256, v.Dimensione, v.ModificatoIl, v.Archivio); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// aggiungiUploads aggiunge all'archivio gli allegati. In un backup incrementale i file
+// invariati non vengono copiati: il manifest rimanda all'archivio che li contiene.
+func aggiungiUploads(tw *tar.Writer, archivio string, incrementale bool) ([]FileManifest, []voceIndice, error) {
+	var manifest []FileManifest
+	var voci []voceIndice
+
+	uploadsDir := filepath.Join(dataDir, "uploads")
+	if _, err := os.Stat(uploadsDir); err != nil {
+		return nil, nil, nil
+	}
+
+	indice := caricaIndiceUploads()
+	err := filepath.Walk(uploadsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(dataDir, path)
+		rel := filepath.ToSlash(relPath)
+
+		if incrementale {
+			if v, ok := indice.riutilizza(rel, path, info); ok {
+				manifest = append(manifest, FileManifest{Nome: rel, Dimensione: v.Dimensione, SHA256: v.SHA256, Archivio: v.Archivio})
+				voci = append(voci, v)
+				return nil
+			}
+		}
+
+		voce, err := aggiungiFileATar(tw, path, rel)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, voce)
+		voci = append(voci, voceIndice{
+			Percorso:     rel,
+			SHA256:       voce.SHA256,
+			Dimensione:   voce.Dimensione,
+			ModificatoIl: info.ModTime().UnixNano(),
+			Archivio:     archivio,
+		})
+		return nil
+	})
+	return manifest, voci, err
+}
+
+// improntaFile calcola lo SHA-256 del file
+func improntaFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// dataArchivio ricava la data dal nome furviogest_2006-01-02_15-04-05.tar.gz
+func dataArchivio(filename string) (time.Time, bool) {
+	namePart := strings.TrimSuffix(strings.TrimPrefix(filename, "furviogest_"), ".tar.gz")
+	data, err := time.ParseInLocation("2006-01-02_15-04-05", namePart, time.Local)
+	return data, err == nil
+}
+
+// ============================================
+// ARCHIVI RIFERITI DAI BACKUP INCREMENTALI
+// ============================================
+
+// riferimentiArchivi memorizza gli archivi a cui rimanda ogni archivio: gli archivi non
+// cambiano dopo la creazione, quindi ognuno viene letto una sola volta
+var riferimentiArchivi = struct {
+	sync.Mutex
+	perArchivio map[string][]string
+}{perArchivio: make(map[string][]string)}
+
+// archiviProtetti restituisce gli archivi scaduti che contengono allegati di backup
+// incrementali conservati: la pulizia non deve eliminarli. Per un archivio di cui non si
+// puo leggere il manifest (non piu presente in locale o cifrato con un'altra chiave) si
+// proteggono gli archivi dei giorniRiferimentoMax giorni precedenti, gli unici a cui
+// puo rimandare.
+func archiviProtetti(conservati, scaduti []string) map[string]bool {
+	protetti := make(map[string]bool)
+	for _, nome := range conservati {
+		if riferiti, ok := riferimentiArchivio(nome); ok {
+			for _, r := range riferiti {
+				protetti[r] = true
+			}
+			continue
+		}
+		data, ok := dataArchivio(nome)
+		if !ok {
+			continue
+		}
+		limite := data.AddDate(0, 0, -giorniRiferimentoMax)
+		for _, s := range scaduti {
+			if ds, ok := dataArchivio(s); ok && ds.After(limite) && !ds.After(data) {
+				protetti[s] = true
+			}
+		}
+	}
+	return protetti
+}
+
+// riferimentiArchivio elenca gli archivi a cui rimanda il manifest di un backup locale.
+// Restituisce false se l'archivio non e in locale o non si puo decifrare.
+func riferimentiArchivio(nome string) ([]string, bool) {
+	riferimentiArchivi.Lock()
+	defer riferimentiArchivi.Unlock()
+
+	if r, ok := riferimentiArchivi.perArchivio[nome]; ok {
+		return r, true
+	}
+	percorso, ok := percorsoBackup(nome)
+	if !ok {
+		return nil, false
+	}
+	manifest, err := leggiManifestArchivio(percorso, chiaviBackup(""))
+	if erroreChiave(err) {
+		return nil, false
+	}
+	if err != nil {
+		// Archivio senza manifest o illeggibile: non rimanda ad altri archivi
+		riferimentiArchivi.perArchivio[nome] = nil
+		return nil, true
+	}
+
+	visti := make(map[string]bool)
+	var riferiti []string
+	for _, f := range manifest.File {
+		if f.Archivio != "" && !visti[f.Archivio] {
+			visti[f.Archivio] = true
+			riferiti = append(riferiti, f.Archivio)
+		}
+	}
+	riferimentiArchivi.perArchivio[nome] = riferiti
+	return riferiti, true
+}
+
+// leggiManifestArchivio legge il manifest di un archivio senza estrarlo
+func leggiManifestArchivio(archivePath string, chiavi []string) (Manifest, error) {
+	var manifest Manifest
+	contenuto, file, err := apriArchivio(archivePath, chiavi)
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(contenuto)
+	if err != nil {
+		return manifest, err
+	}
+	defer gzReader.Close()
+
+	tarReader := tar.NewReader(gzReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return manifest, fmt.Errorf("manifest assente")
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if header.Name == manifestBackup {
+			err = json.NewDecoder(tarReader).Decode(&manifest)
+			return manifest, err
+		}
+	}
+}
+
+// estraiBackup estrae l'archivio e, se e incrementale, i file che il manifest indica
+// contenuti in archivi precedenti. I file di archivi non disponibili restano mancanti
+// e vengono segnalati dalla verifica. Gli archivi cifrati si aprono con una delle chiavi.
+func estraiBackup(archivePath, destDir string, chiavi []string) (map[string]FileManifest, error) {
+	estratti, err := estraiArchivio(archivePath, destDir, nil, chiavi)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := estratti[manifestBackup]; !ok {
+		return estratti, nil
+	}
+	manifest, err := leggiManifest(filepath.Join(destDir, manifestBackup))
+	if err != nil {
+		return estratti, nil
+	}
+
+	perArchivio := make(map[string]map[string]bool)
+	for _, f := range manifest.File {
+		if f.Archivio == "" {
+			continue
+		}
+		if perArchivio[f.Archivio] == nil {
+			perArchivio[f.Archivio] = make(map[string]bool)
+		}
+		perArchivio[f.Archivio][f.Nome] = true
+	}
+
+	for archivio, nomi := range perArchivio {
+		percorso, ok := percorsoBackup(archivio)
+		if !ok {
+			continue
+		}
+		altri, err := estraiArchivio(percorso, destDir, nomi, chiavi)
+		if err != nil {
+			return nil, fmt.Errorf("archivio %s: %w", archivio, err)
+		}
+		for nome, voce := range altri {
+			estratti[nome] = voce
+		}
+	}
+	return estratti, nil
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"strings"
+	"time"
+
+	"furviogest/internal/auth"
+	"furviogest/internal/cron"
+	"furviogest/internal/database"
+)
+
+// ============================================
+// BACKUP AUTOMATICO PIANIFICATO
+// ============================================
+
+// attesaTentativi sono le attese prima di ripetere un backup automatico fallito.
+// Esauriti i tentativi si avvisano gli amministratori e si attende l'ora pianificata.
+var attesaTentativi = []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour, 3 * time.Hour}
+
+// pianificazioneBackup e lo stato dello scheduler del backup automatico
+type pianificazioneBackup struct {
+	OraBackup         string
+	UltimaEsecuzione  sql.NullTime
+	Modificato        time.Time
+	TentativiFalliti  int
+	ProssimoTentativo sql.NullTime
+	GiorniAvviso      int
+	ErroreDal         sql.NullTime
+	UltimoAvviso      sql.NullTime
+}
+
+// StartBackupScheduler avvia il backup automatico giornaliero all'ora configurata
+func StartBackupScheduler() {
+	go func() {
+		// Primo controllo all'avvio: recupera il backup perso mentre il server era fermo
+		controllaBackupAutomatico()
+
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			controllaBackupAutomatico()
+		}
+	}()
+	log.Println("[Backup] Backup automatico pianificato")
+}
+
+// caricaPianificazioneBackup legge lo stato dello scheduler
+func caricaPianificazioneBackup() (*pianificazioneBackup, error) {
+	p := &pianificazioneBackup{}
+	var modificato sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(ora_backup, '00:00'), ultima_esecuzione, updated_at, tentativi_falliti,
+		       prossimo_tentativo, giorni_avviso, errore_dal, ultimo_avviso
+		FROM backup_sistema_config WHERE id = 1
+	`).Scan(&p.OraBackup, &p.UltimaEsecuzione, &modificato, &p.TentativiFalliti,
+		&p.ProssimoTentativo, &p.GiorniAvviso, &p.ErroreDal, &p.UltimoAvviso)
+	if err != nil {
+		return nil, err
+	}
+	p.Modificato = modificato.Time
+	return p, nil
+}
+
+// cronOraBackup converte l'ora HH:MM nell'espressione cron giornaliera
+func cronOraBackup(ora string) (*cron.Espressione, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(ora))
+	if err != nil {
+		return nil, fmt.Errorf("ora del backup non valida %q", ora)
+	}
+	return cron.Parse(fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()))
+}
+
+// Prossima restituisce il prossimo backup: il tentativo in attesa dopo un errore o
+// l'ora pianificata successiva all'ultima esecuzione (o all'ultima modifica della
+// configurazione, se successiva). Zero se l'ora non e valida.
+func (p *pianificazioneBackup) Prossima() time.Time {
+	if p.ProssimoTentativo.Valid {
+		return p.ProssimoTentativo.Time.Local()
+	}
+	espr, err := cronOraBackup(p.OraBackup)
+	if err != nil {
+		return time.Time{}
+	}
+	riferimento := p.Modificato
+	if p.UltimaEsecuzione.Valid && p.UltimaEsecuzione.Time.After(riferimento) {
+		riferimento = p.UltimaEsecuzione.Time
+	}
+	return espr.Prossima(riferimento.Local())
+}
+
+// controllaBackupAutomatico esegue il backup se e scaduto e controlla gli avvisi
+func controllaBackupAutomatico() {
+	p, err := caricaPianificazioneBackup()
+	if err != nil {
+		log.Printf("[Backup] Errore lettura pianificazione: %v", err)
+		return
+	}
+	if prossima := p.Prossima(); !prossima.IsZero() && !prossima.After(time.Now()) {
+		eseguiBackupPianificato(p)
+		if p, err = caricaPianificazioneBackup(); err != nil {
+			return
+		}
+	}
+	controllaAvvisoBackup(p, time.Now())
+}
+
+// eseguiBackupPianificato esegue il backup automatico e, se fallisce, pianifica il
+// tentativo successivo. Le copie esterne fallite contano come backup fallito.
+func eseguiBackupPianificato(p *pianificazioneBackup) {
+	inizio := time.Now()
+	tentativo := p.TentativiFalliti + 1
+	if !p.ProssimoTentativo.Valid {
+		// Nuova esecuzione pianificata: l'istante di avvio fa da riferimento per la prossima
+		tentativo = 1
+		database.DB.Exec("UPDATE backup_sistema_config SET ultima_esecuzione = ?, tentativi_falliti = 0 WHERE id = 1",
+			inizio.UTC().Format("2006-01-02 15:04:05"))
+	}
+	log.Printf("[Backup] Avvio backup automatico (tentativo %d)", tentativo)
+
+	err := eseguiBackupInterno("automatico")
+	if err == nil {
+		// Backup configurazioni rete sulle destinazioni se abilitato
+		config := getBackupConfig()
+		if config.NasConfigAbilitato {
+			go eseguiBackupConfigDestinazioni(config)
+		}
+		if errore := GetUltimoBackupErrore(); errore != "" {
+			err = errors.New(errore)
+		}
+	}
+
+	if err == nil {
+		database.DB.Exec("UPDATE backup_sistema_config SET tentativi_falliti = 0, prossimo_tentativo = NULL WHERE id = 1")
+		log.Printf("[Backup] Backup automatico completato in %s", time.Since(inizio).Round(time.Second))
+		return
+	}
+
+	log.Printf("[Backup] Backup automatico fallito (tentativo %d): %v", tentativo, err)
+	if tentativo <= len(attesaTentativi) {
+		database.DB.Exec("UPDATE backup_sistema_config SET tentativi_falliti = ?, prossimo_tentativo = ? WHERE id = 1",
+			tentativo, time.Now().Add(attesaTentativi[tentativo-1]).UTC().Format("2006-01-02 15:04:05"))
+		return
+	}
+	database.DB.Exec("UPDATE backup_sistema_config SET tentativi_falliti = ?, prossimo_tentativo = NULL WHERE id = 1", tentativo)
+	avvisaAmministratoriBackup("Backup automatico fallito",
+		fmt.Sprintf("Il backup automatico e fallito %d volte di seguito.", tentativo), err.Error())
+}
+
+// controllaAvvisoBackup avvisa gli amministratori se il backup risulta in errore da piu
+// di giorni_avviso giorni. L'avviso si ripete al massimo una volta al giorno.
+func controllaAvvisoBackup(p *pianificazioneBackup, ora time.Time) {
+	errore := GetUltimoBackupErrore()
+	if errore == "" {
+		if p.ErroreDal.Valid {
+			database.DB.Exec("UPDATE backup_sistema_config SET errore_dal = NULL, ultimo_avviso = NULL WHERE id = 1")
+		}
+		return
+	}
+	if !p.ErroreDal.Valid {
+		database.DB.Exec("UPDATE backup_sistema_config SET errore_dal = ? WHERE id = 1", ora.UTC().Format("2006-01-02 15:04:05"))
+		return
+	}
+	if p.GiorniAvviso < 1 || ora.Sub(p.ErroreDal.Time) < time.Duration(p.GiorniAvviso)*24*time.Hour {
+		return
+	}
+	if p.UltimoAvviso.Valid && ora.Sub(p.UltimoAvviso.Time) < 24*time.Hour {
+		return
+	}
+
+	database.DB.Exec("UPDATE backup_sistema_config SET ultimo_avviso = ? WHERE id = 1", ora.UTC().Format("2006-01-02 15:04:05"))
+	avvisaAmministratoriBackup("Backup in errore",
+		fmt.Sprintf("Il sistema di backup segnala un problema dal %s.", p.ErroreDal.Time.Local().Format("02/01/2006 15:04")), errore)
+}
+
+// avvisaAmministratoriBackup invia l'avviso agli utenti che gestiscono i backup
+func avvisaAmministratoriBackup(oggetto, descrizione, errore string) {
+	destinatari, err := auth.EmailConAutorizzazione(auth.AutBackup)
+	if err != nil {
+		log.Printf("[Backup] Errore lettura destinatari avviso: %v", err)
+		return
+	}
+	if len(destinatari) == 0 {
+		log.Printf("[Backup] Nessun utente con email a cui inviare l'avviso: %s", oggetto)
+		return
+	}
+
+	var corpo bytes.Buffer
+	if err := templateEmailBackup.Execute(&corpo, map[string]string{
+		"Descrizione": descrizione,
+		"Errore":      errore,
+	}); err != nil {
+		log.Printf("[Backup] Errore avviso: %v", err)
+		return
+	}
+	if err := inviaEmailNotifica(destinatari, "[FurvioGest] "+oggetto, corpo.String()); err != nil {
+		log.Printf("[Backup] Errore invio avviso a %s: %v", strings.Join(destinatari, ", "), err)
+		return
+	}
+	log.Printf("[Backup] Avviso \"%s\" inviato a %s", oggetto, strings.Join(destinatari, ", "))
+}
+
+// templateEmailBackup e il corpo delle email di avviso sui backup
+var templateEmailBackup = template.Must(template.New("backup").Parse(`
+<div style="font-family: Arial, sans-serif; font-size: 14px;">
+<p>{{.Descrizione}}</p>
+<p><strong>Errore:</strong> {{.Errore}}</p>
+<p>Controllare la pagina Backup e Ripristino di FurvioGest.</p>
+</div>
+`))
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"furviogest/internal/database"
+)
+
+// ============================================
+// MANIFEST, VERIFICA E ANTEPRIMA RIPRISTINO
+// ============================================
+
+// manifestBackup e il file, scritto per ultimo nell'archivio, con l'impronta di ogni file
+const manifestBackup = "manifest.json"
+
+// tipoPreRipristino e il tipo registrato per l'archivio creato prima di ogni ripristino
+const tipoPreRipristino = "pre_ripristino"
+
+// FileManifest descrive un file del backup. Archivio e valorizzato quando il contenuto
+// e in un archivio precedente (backup incrementale).
+type FileManifest struct {
+	Nome       string `json:"nome"`
+	Dimensione int64  `json:"dimensione"`
+	SHA256     string `json:"sha256"`
+	Archivio   string `json:"archivio,omitempty"`
+}
+
+// Manifest elenca i file contenuti in un archivio di backup
+type Manifest struct {
+	Versione int            `json:"versione"`
+	CreatoIl time.Time      `json:"creato_il"`
+	File     []FileManifest `json:"file"`
+}
+
+// scriviManifest aggiunge il manifest in coda all'archivio
+func scriviManifest(tw *tar.Writer, file []FileManifest) error {
+	contenuto, err := json.MarshalIndent(Manifest{Versione: 2, CreatoIl: time.Now(), File: file}, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:     manifestBackup,
+		Mode:     0644,
+		Size:     int64(len(contenuto)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(contenuto)
+	return err
+}
+
+// estraiArchivio estrae l'archivio nella directory calcolando l'impronta di ogni file;
+// con filtro non nil estrae solo i file indicati.
+// Rifiuta i percorsi che uscirebbero dalla directory di destinazione.
+func estraiArchivio(archivePath, destDir string, filtro map[string]bool, chiavi []string) (map[string]FileManifest, error) {
+	contenuto, file, err := apriArchivio(archivePath, chiavi)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(contenuto)
+	if err != nil {
+		return nil, fmt.Errorf("file non valido: %v", err)
+	}
+	defer gzReader.Close()
+
+	tarReader := tar.NewReader(gzReader)
+	estratti := make(map[string]FileManifest)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archivio danneggiato: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		nome := filepath.ToSlash(filepath.Clean(header.Name))
+		if filepath.IsAbs(nome) || nome == ".." || strings.HasPrefix(nome, "../") {
+			return nil, fmt.Errorf("percorso non valido nell'archivio: %s", header.Name)
+		}
+		if filtro != nil && !filtro[nome] {
+			continue
+		}
+		targetPath := filepath.Join(destDir, nome)
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return nil, err
+		}
+
+		outFile, err := os.Create(targetPath)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(outFile, hash), tarReader)
+		outFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("archivio danneggiato (%s): %v", nome, err)
+		}
+		estratti[nome] = FileManifest{Nome: nome, Dimensione: n, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	}
+	return estratti, nil
+}
+
+// VerificaFile e l'esito del controllo di un file rispetto al manifest
+type VerificaFile struct {
+	Nome     string
+	Problema string
+}
+
+// EsitoVerifica raccoglie i controlli su un archivio estratto
+type EsitoVerifica struct {
+	Manifest       bool           // l'archivio contiene il manifest
+	FileVerificati int            // file con impronta corrispondente al manifest
+	Problemi       []VerificaFile // file mancanti, alterati o non elencati
+	Database       bool           // l'archivio contiene il database
+	Integrita      []string       // risultato di PRAGMA integrity_check ("ok" se integro)
+}
+
+// OK indica se l'archivio puo essere ripristinato
+func (e EsitoVerifica) OK() bool {
+	return len(e.Problemi) == 0 && e.Database && e.DatabaseIntegro()
+}
+
+// DatabaseIntegro indica se integrity_check non ha trovato problemi
+func (e EsitoVerifica) DatabaseIntegro() bool {
+	return len(e.Integrita) == 1 && e.Integrita[0] == "ok"
+}
+
+// Riepilogo descrive l'esito in una riga
+func (e EsitoVerifica) Riepilogo() string {
+	var parti []string
+	if e.Manifest {
+		parti = append(parti, fmt.Sprintf("%d file con impronta corretta", e.FileVerificati))
+	} else {
+		parti = append(parti, "archivio senza manifest (creato da una versione precedente)")
+	}
+	for _, p := range e.Problemi {
+		parti = append(parti, p.Nome+": "+p.Problema)
+	}
+	switch {
+	case !e.Database:
+		parti = append(parti, "database assente")
+	case e.DatabaseIntegro():
+		parti = append(parti, "database integro")
+	default:
+		parti = append(parti, "database danneggiato: "+strings.Join(e.Integrita, "; "))
+	}
+	return strings.Join(parti, ", ")
+}
+
+// verificaEstratto confronta i file estratti con il manifest e controlla il database
+func verificaEstratto(dir string, estratti map[string]FileManifest) EsitoVerifica {
+	var esito EsitoVerifica
+
+	if voce, ok := estratti[manifestBackup]; ok {
+		esito.Manifest = true
+		delete(estratti, manifestBackup)
+
+		manifest, err := leggiManifest(filepath.Join(dir, voce.Nome))
+		if err != nil {
+			esito.Problemi = append(esito.Problemi, VerificaFile{manifestBackup, "illeggibile"})
+		}
+
+		attesi := make(map[string]bool)
+		for _, f := range manifest.File {
+			attesi[f.Nome] = true
+			trovato, ok := estratti[f.Nome]
+			switch {
+			case !ok && f.Archivio != "":
+				esito.Problemi = append(esito.Problemi, VerificaFile{f.Nome, "mancante, contenuto nell'archivio non disponibile " + f.Archivio})
+			case !ok:
+				esito.Problemi = append(esito.Problemi, VerificaFile{f.Nome, "mancante"})
+			case trovato.SHA256 != f.SHA256 || trovato.Dimensione != f.Dimensione:
+				esito.Problemi = append(esito.Problemi, VerificaFile{f.Nome, "impronta SHA-256 diversa"})
+			default:
+				esito.FileVerificati++
+			}
+		}
+		for nome := range estratti {
+			if !attesi[nome] {
+				esito.Problemi = append(esito.Problemi, VerificaFile{nome, "non elencato nel manifest"})
+			}
+		}
+		sort.Slice(esito.Problemi, func(i, j int) bool { return esito.Problemi[i].Nome < esito.Problemi[j].Nome })
+	}
+
+	dbPath := filepath.Join(dir, "furviogest.db")
+	if _, ok := estratti["furviogest.db"]; ok {
+		esito.Database = true
+		esito.Integrita = controllaIntegrita(dbPath)
+	}
+	return esito
+}
+
+// leggiManifest legge il manifest estratto da un archivio
+func leggiManifest(path string) (Manifest, error) {
+	var manifest Manifest
+	contenuto, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(contenuto, &manifest)
+	}
+	return manifest, err
+}
+
+// controllaIntegrita esegue PRAGMA integrity_check sul database in sola lettura
+func controllaIntegrita(dbPath string) []string {
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check(20)")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer rows.Close()
+
+	var messaggi []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return []string{err.Error()}
+		}
+		messaggi = append(messaggi, m)
+	}
+	if err := rows.Err(); err != nil {
+		return []string{err.Error()}
+	}
+	return messaggi
+}
+
+// percorsoBackup restituisce il percorso di un archivio della directory backup,
+// accettando solo nomi di file generati da FurvioGest
+func percorsoBackup(filename string) (string, bool) {
+	if filename != filepath.Base(filename) || !strings.HasPrefix(filename, "furviogest_") || !strings.HasSuffix(filename, ".tar.gz") {
+		return "", false
+	}
+	percorso := filepath.Join(backupDir, filename)
+	if _, err := os.Stat(percorso); err != nil {
+		return "", false
+	}
+	return percorso, true
+}
+
+// VerificaBackup controlla impronte e integrita del database di un archivio
+func VerificaBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/backup", http.StatusSeeOther)
+		return
+	}
+
+	backupPath, ok := percorsoBackup(r.FormValue("filename"))
+	if !ok {
+		http.Redirect(w, r, "/backup?error=invalid", http.StatusSeeOther)
+		return
+	}
+
+	tempDir, err := os.MkdirTemp("", "furviogest_verifica_")
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=verifica&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	estratti, err := estraiBackup(backupPath, tempDir, chiaviBackup(r.FormValue("chiave")))
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=verifica&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	esito := verificaEstratto(tempDir, estratti)
+	dettaglio := url.QueryEscape(filepath.Base(backupPath) + ": " + esito.Riepilogo())
+	if !esito.OK() {
+		http.Redirect(w, r, "/backup?error=verifica&detail="+dettaglio, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/backup?success=verifica&detail="+dettaglio, http.StatusSeeOther)
+}
+
+// ConfrontoTabella confronta il numero di righe di una tabella tra backup e database attuale
+type ConfrontoTabella struct {
+	Nome        string
+	Backup      int64
+	Attuale     int64
+	SoloBackup  bool
+	SoloAttuale bool
+}
+
+// Differenza restituisce le righe in piu (o in meno) che il ripristino portera
+func (c ConfrontoTabella) Differenza() int64 {
+	return c.Backup - c.Attuale
+}
+
+// contaRighe restituisce il numero di righe di ogni tabella del database
+func contaRighe(db *sql.DB) (map[string]int64, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	var tabelle []string
+	for rows.Next() {
+		var nome string
+		if err := rows.Scan(&nome); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tabelle = append(tabelle, nome)
+	}
+	rows.Close()
+
+	conteggi := make(map[string]int64)
+	for _, t := range tabelle {
+		var n int64
+		if err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, t)).Scan(&n); err != nil {
+			return nil, err
+		}
+		conteggi[t] = n
+	}
+	return conteggi, nil
+}
+
+// versioneSchema restituisce l'ultima migrazione registrata (0 se il registro non esiste)
+func versioneSchema(db *sql.DB) int {
+	var versione int
+	db.QueryRow("SELECT COALESCE(MAX(versione), 0) FROM schema_migrations").Scan(&versione)
+	return versione
+}
+
+// contaAllegati conta i file in uploads/ e la loro dimensione totale
+func contaAllegati(dir string) (int, int64) {
+	var n int
+	var totale int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+			totale += info.Size()
+		}
+		return nil
+	})
+	return n, totale
+}
+
+// AnteprimaRipristino verifica un archivio e mostra cosa cambierebbe ripristinandolo,
+// senza toccare il database attuale. Se l'archivio e cifrato con una chiave diversa da
+// quella configurata la pagina la chiede e la passa al ripristino.
+func AnteprimaRipristino(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Anteprima Ripristino - FurvioGest", r)
+
+	filename := r.FormValue("filename")
+	chiave := r.FormValue("chiave")
+	backupPath, ok := percorsoBackup(filename)
+	if !ok {
+		http.Redirect(w, r, "/backup?error=invalid", http.StatusSeeOther)
+		return
+	}
+
+	tempDir, err := os.MkdirTemp("", "furviogest_anteprima_")
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=verifica&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	estratti, err := estraiBackup(backupPath, tempDir, chiaviBackup(chiave))
+	if erroreChiave(err) {
+		if chiave != "" {
+			data.Error = err.Error()
+		}
+		data.Data = map[string]interface{}{
+			"Filename":        filename,
+			"ChiaveRichiesta": true,
+		}
+		renderTemplate(w, "backup_anteprima.html", data)
+		return
+	}
+	if err != nil {
+		http.Redirect(w, r, "/backup?error=verifica&detail="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	esito := verificaEstratto(tempDir, estratti)
+
+	var tabelle []ConfrontoTabella
+	var versioneBackup int
+	if esito.Database && esito.DatabaseIntegro() {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(tempDir, "furviogest.db")+"?mode=ro")
+		if err == nil {
+			defer db.Close()
+			versioneBackup = versioneSchema(db)
+			righeBackup, errB := contaRighe(db)
+			righeAttuali, errA := contaRighe(database.DB)
+			if errB != nil || errA != nil {
+				data.Error = "Errore nel conteggio delle righe"
+			}
+			tabelle = confrontaTabelle(righeBackup, righeAttuali)
+		}
+	}
+
+	allegatiBackup, dimBackup := contaAllegati(filepath.Join(tempDir, "uploads"))
+	allegatiAttuali, dimAttuali := contaAllegati(filepath.Join(dataDir, "uploads"))
+	info, _ := os.Stat(backupPath)
+
+	data.Data = map[string]interface{}{
+		"Filename":        filename,
+		"Chiave":          chiave,
+		"Cifrato":         archivioCifrato(backupPath),
+		"Dimensione":      info.Size(),
+		"Esito":           esito,
+		"Tabelle":         tabelle,
+		"VersioneBackup":  versioneBackup,
+		"VersioneAttuale": versioneSchema(database.DB),
+		"AllegatiBackup":  allegatiBackup,
+		"DimBackup":       dimBackup,
+		"AllegatiAttuali": allegatiAttuali,
+		"DimAttuali":      dimAttuali,
+		"TabelleCambiate": contaCambiate(tabelle),
+	}
+	renderTemplate(w, "backup_anteprima.html", data)
+}
+
+// confrontaTabelle affianca i conteggi, in ordine di nome
+func confrontaTabelle(backup, attuale map[string]int64) []ConfrontoTabella {
+	var tabelle []ConfrontoTabella
+	for nome, n := range backup {
+		c := ConfrontoTabella{Nome: nome, Backup: n}
+		if m, ok := attuale[nome]; ok {
+			c.Attuale = m
+		} else {
+			c.SoloBackup = true
+		}
+		tabelle = append(tabelle, c)
+	}
+	for nome, m := range attuale {
+		if _, ok := backup[nome]; !ok {
+			tabelle = append(tabelle, ConfrontoTabella{Nome: nome, Attuale: m, SoloAttuale: true})
+		}
+	}
+	sort.Slice(tabelle, func(i, j int) bool { return tabelle[i].Nome < tabelle[j].Nome })
+	return tabelle
+}
+
+// contaCambiate conta le tabelle il cui contenuto cambierebbe di numero di righe
+func contaCambiate(tabelle []ConfrontoTabella) int {
+	n := 0
+	for _, t := range tabelle {
+		if t.Differenza() != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// istantaneaPreRipristino archivia database e allegati attuali prima di un ripristino,
+// cosi che un ripristino sbagliato possa essere annullato ripristinando questo archivio
+func istantaneaPreRipristino() (string, error) {
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return "", err
+	}
+	// Il nome segue il formato dei backup (la data e letta dal nome): se un backup
+	// dello stesso secondo esiste gia si usa il secondo successivo
+	quando := time.Now()
+	filename := fmt.Sprintf("furviogest_%s.tar.gz", quando.Format("2006-01-02_15-04-05"))
+	for {
+		if _, err := os.Stat(filepath.Join(backupDir, filename)); os.IsNotExist(err) {
+			break
+		}
+		quando = quando.Add(time.Second)
+		filename = fmt.Sprintf("furviogest_%s.tar.gz", quando.Format("2006-01-02_15-04-05"))
+	}
+	destPath := filepath.Join(backupDir, filename)
+
+	if _, err := creaArchivioBackup(destPath, true); err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+	log.Printf("Istantanea pre-ripristino salvata in %s", destPath)
+	return filename, nil
+}
@@ -3,7 +3,9 @@ package handlers
 import (
 	"bytes"
 	"fmt"
-	"furviogest/internal/database"
+	"furviogest/internal/auth"
+	"furviogest/internal/database"
+	"furviogest/internal/segreti"
 	"furviogest/internal/middleware"
 	"html/template"
 	"net/http"
@@ -47,7 +49,7 @@ func StampaTrasferte(w http.ResponseWriter, r *http.Request) {
 	if tecnicoID == 0 {
 		tecnicoID = session.UserID
 	}
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	}
 
@@ -81,7 +83,7 @@ func StampaNoteSpese(w http.ResponseWriter, r *http.Request) {
 	if tecnicoID == 0 {
 		tecnicoID = session.UserID
 	}
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	}
 
@@ -460,7 +462,7 @@ func inviaEmail(destinatari, subject, htmlBody string) error {
 	msg.WriteString(htmlBody)
 
 	// Invia
-	auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpServer)
+	auth := smtp.PlainAuth("", smtpUser, segreti.Leggi(smtpPassword), smtpServer)
 	addr := fmt.Sprintf("%s:%d", smtpServer, smtpPort)
 
 	return smtp.SendMail(addr, auth, smtpUser, to, msg.Bytes())
@@ -583,7 +585,7 @@ func DownloadPDFTrasferte(w http.ResponseWriter, r *http.Request) {
 	if tecnicoID == 0 {
 		tecnicoID = session.UserID
 	}
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	}
 
@@ -666,7 +668,7 @@ func DownloadPDFNoteSpese(w http.ResponseWriter, r *http.Request) {
 	if tecnicoID == 0 {
 		tecnicoID = session.UserID
 	}
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	}
 
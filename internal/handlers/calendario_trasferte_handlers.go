@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"furviogest/internal/audit"
+	"furviogest/internal/auth"
 	"furviogest/internal/database"
 	"furviogest/internal/middleware"
 	"furviogest/internal/models"
@@ -181,8 +184,8 @@ func CalendarioTrasferte(w http.ResponseWriter, r *http.Request) {
 	database.DB.QueryRow("SELECT cognome || ' ' || nome FROM utenti WHERE id = ?", tecnicoID).Scan(&nomeTecnico)
 
 	// Carica compagnie e navi per modale
-	compagnie := caricaCompagnieCalendario()
-	navi, _ := caricaNavi()
+	compagnie := caricaCompagnieCalendario(session.CompagniaID)
+	navi, _ := caricaNavi(session.CompagniaID)
 
 	// Calcola riepilogo
 	riepilogo := calcolaRiepilogoMese(tecnicoID, anno, mese)
@@ -228,11 +231,11 @@ func CalendarioTrasferte(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "calendario_trasferte.html", pageData)
 }
 
-// caricaCompagnieCalendario carica tutte le compagnie
-func caricaCompagnieCalendario() []models.Compagnia {
+// caricaCompagnieCalendario carica tutte le compagnie, o solo quella indicata se diversa da 0
+func caricaCompagnieCalendario(compagniaID int64) []models.Compagnia {
 	var compagnie []models.Compagnia
 
-	rows, err := database.DB.Query("SELECT id, nome FROM compagnie ORDER BY nome")
+	rows, err := database.DB.Query("SELECT id, nome FROM compagnie WHERE ? = 0 OR id = ? ORDER BY nome", compagniaID, compagniaID)
 	if err != nil {
 		return compagnie
 	}
@@ -558,8 +561,8 @@ func APISalvaGiornata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Se non tecnico, forza proprio ID
-	if !session.IsTecnico() {
+	// Senza gestione trasferte, forza proprio ID
+	if !session.Puo(auth.AutTrasferteGestione) {
 		req.TecnicoID = session.UserID
 	}
 
@@ -570,7 +573,7 @@ func APISalvaGiornata(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		// Insert
-		result, err := database.DB.Exec(`
+		giornataID, err = creaConAudit(r, "calendario_giornate", `
 			INSERT INTO calendario_giornate (tecnico_id, data, tipo_giornata, luogo, compagnia_id, nave_id, note, ore_permesso)
 			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		`, req.TecnicoID, req.Data, req.TipoGiornata, req.Luogo, req.CompagniaID, req.NaveID, req.Note, req.OrePermesso)
@@ -578,10 +581,9 @@ func APISalvaGiornata(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json"); w.WriteHeader(http.StatusInternalServerError); json.NewEncoder(w).Encode(map[string]string{"error": "Errore salvataggio: " + err.Error()})
 			return
 		}
-		giornataID, _ = result.LastInsertId()
 	} else {
 		// Update
-		_, err = database.DB.Exec(`
+		err = modificaConAudit(r, "calendario_giornate", giornataID, `
 			UPDATE calendario_giornate
 			SET tipo_giornata = ?, luogo = ?, compagnia_id = ?, nave_id = ?, note = ?, ore_permesso = ?, updated_at = CURRENT_TIMESTAMP
 			WHERE id = ?
@@ -611,7 +613,7 @@ func APIDettaglioGiornata(w http.ResponseWriter, r *http.Request) {
 	tecnicoID, _ := strconv.ParseInt(r.URL.Query().Get("tecnico_id"), 10, 64)
 	data := r.URL.Query().Get("data")
 
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	}
 
@@ -681,7 +683,7 @@ func APISalvaSpesa(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := database.DB.Exec(`
+	spesaID, err := creaConAudit(r, "spese_giornaliere", `
 		INSERT INTO spese_giornaliere (giornata_id, tipo_spesa, importo, note, metodo_pagamento)
 		VALUES (?, ?, ?, ?, ?)
 	`, req.GiornataID, req.TipoSpesa, req.Importo, req.Note, req.MetodoPagamento)
@@ -693,7 +695,6 @@ func APISalvaSpesa(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	spesaID, _ := result.LastInsertId()
 	totale := calcolaTotaleSpese(req.GiornataID)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -734,7 +735,7 @@ func APIEliminaSpesa(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	database.DB.Exec("DELETE FROM spese_giornaliere WHERE id = ?", req.SpesaID)
+	eliminaConAudit(r, "spese_giornaliere", req.SpesaID, "DELETE FROM spese_giornaliere WHERE id = ?", req.SpesaID)
 
 	totale := calcolaTotaleSpese(req.GiornataID)
 
@@ -748,6 +749,9 @@ func APIEliminaSpesa(w http.ResponseWriter, r *http.Request) {
 // API per navi di una compagnia
 func APINaviCompagnia(w http.ResponseWriter, r *http.Request) {
 	compagniaID, _ := strconv.ParseInt(r.URL.Query().Get("compagnia_id"), 10, 64)
+	if session := middleware.GetSession(r); !session.VedeCompagnia(compagniaID) {
+		compagniaID = session.CompagniaID
+	}
 
 	rows, err := database.DB.Query("SELECT id, nome FROM navi WHERE compagnia_id = ? ORDER BY nome", compagniaID)
 	if err != nil {
@@ -798,11 +802,18 @@ func APIEliminaGiornata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prima elimina le spese associate
-	database.DB.Exec("DELETE FROM spese_giornaliere WHERE giornata_id = ?", req.GiornataID)
-	
-	// Poi elimina la giornata
-	database.DB.Exec("DELETE FROM calendario_giornate WHERE id = ?", req.GiornataID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("calendario_giornate", req.GiornataID, figliGiornata...); err != nil {
+			return err
+		}
+
+		// Prima elimina le spese associate
+		tx.Exec("DELETE FROM spese_giornaliere WHERE giornata_id = ?", req.GiornataID)
+
+		// Poi elimina la giornata
+		_, err := tx.Exec("DELETE FROM calendario_giornate WHERE id = ?", req.GiornataID)
+		return err
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -90,7 +90,7 @@ func NuovoCliente(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := database.DB.Exec(`
+	_, err := creaConAudit(r, "clienti", `
 		INSERT INTO clienti (nome, partita_iva, codice_fiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefono_referente, note)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, nome, partitaIVA, codiceFiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefonoReferente, note)
@@ -174,7 +174,7 @@ func ModificaCliente(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "clienti", id, `
 		UPDATE clienti SET nome=?, partita_iva=?, codice_fiscale=?, indirizzo=?, cap=?, citta=?, provincia=?, nazione=?, telefono=?, cellulare=?, email=?, referente=?, telefono_referente=?, note=?, updated_at=CURRENT_TIMESTAMP
 		WHERE id=?
 	`, nome, partitaIVA, codiceFiscale, indirizzo, cap, citta, provincia, nazione, telefono, cellulare, email, referente, telefonoReferente, note, id)
@@ -210,7 +210,7 @@ func EliminaCliente(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec("DELETE FROM clienti WHERE id = ?", id)
+	err = eliminaConAudit(r, "clienti", id, "DELETE FROM clienti WHERE id = ?", id)
 	if err != nil {
 		http.Redirect(w, r, "/clienti?error=delete", http.StatusSeeOther)
 		return
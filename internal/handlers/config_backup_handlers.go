@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/diff"
+	"furviogest/internal/netdevice"
+)
+
+// ============================================
+// SALVATAGGIO BACKUP CONFIGURAZIONE
+// ============================================
+
+// backupConfig identifica l'apparato di cui salvare la configurazione e dove registrarla
+type backupConfig struct {
+	Tabella      string // config_backup (navi) o config_backup_ufficio (uffici e sale server)
+	NaveID       int64
+	UfficioID    int64
+	SalaServerID int64
+	TipoApparato string // ac o switch
+	ApparatoID   int64
+	Nome         string
+	Marca        string // per le regole di normalizzazione
+}
+
+// esitoBackupConfig riporta il risultato del confronto con il backup precedente
+type esitoBackupConfig struct {
+	ID           int64
+	PrecedenteID int64
+	Invariato    bool // configurazione uguale all'ultimo backup: nessun nuovo file
+	Aggiunte     int
+	Rimosse      int
+}
+
+// messaggio restituisce la descrizione dell'esito per l'utente
+func (e *esitoBackupConfig) messaggio() string {
+	switch {
+	case e.Invariato:
+		return "Configurazione non cambiata dall'ultimo backup"
+	case e.PrecedenteID == 0:
+		return "Backup completato"
+	default:
+		return fmt.Sprintf("Backup completato: +%d/-%d righe rispetto al precedente", e.Aggiunte, e.Rimosse)
+	}
+}
+
+// filtro restituisce la condizione che seleziona i backup dello stesso apparato
+func (b *backupConfig) filtro() (string, []interface{}) {
+	if b.Tabella == "config_backup" {
+		return "nave_id = ? AND tipo_apparato = ? AND apparato_id = ?", []interface{}{b.NaveID, b.TipoApparato, b.ApparatoID}
+	}
+	// I backup piu vecchi usano il tipo esteso (switch_ufficio, switch_sala_server)
+	if b.UfficioID > 0 {
+		return "ufficio_id = ? AND tipo_apparato IN (?, ?) AND apparato_id = ?",
+			[]interface{}{b.UfficioID, b.TipoApparato, b.TipoApparato + "_ufficio", b.ApparatoID}
+	}
+	return "sala_server_id = ? AND tipo_apparato IN (?, ?) AND apparato_id = ?",
+		[]interface{}{b.SalaServerID, b.TipoApparato, b.TipoApparato + "_sala_server", b.ApparatoID}
+}
+
+// cartella restituisce la directory dei file di backup
+func (b *backupConfig) cartella() string {
+	switch {
+	case b.NaveID > 0:
+		return filepath.Join("data", "backups", fmt.Sprintf("nave_%d", b.NaveID))
+	case b.UfficioID > 0:
+		return filepath.Join("data", "backups", fmt.Sprintf("ufficio_%d", b.UfficioID))
+	default:
+		return filepath.Join("data", "backups", fmt.Sprintf("sala_server_%d", b.SalaServerID))
+	}
+}
+
+// hashMD5 restituisce l'hash MD5 esadecimale del testo
+func hashMD5(testo string) string {
+	hash := md5.Sum([]byte(testo))
+	return hex.EncodeToString(hash[:])
+}
+
+// salvaBackupConfig confronta la configurazione con l'ultimo backup dell'apparato
+// dopo aver rimosso le righe volatili: se non e cambiata non crea un nuovo backup,
+// altrimenti salva il file e registra le righe aggiunte e rimosse
+func salvaBackupConfig(b *backupConfig, output string) (*esitoBackupConfig, error) {
+	normalizzata := netdevice.NormalizzaConfig(b.Marca, output)
+	hashNorm := hashMD5(normalizzata)
+	esito := &esitoBackupConfig{}
+
+	where, args := b.filtro()
+	var precPath string
+	var precHash sql.NullString
+	err := database.DB.QueryRow("SELECT id, file_path, hash_normalizzato FROM "+b.Tabella+" WHERE "+where+
+		" ORDER BY created_at DESC, id DESC LIMIT 1", args...).Scan(&esito.PrecedenteID, &precPath, &precHash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("lettura ultimo backup: %w", err)
+	}
+
+	if esito.PrecedenteID > 0 {
+		// Il file precedente viene rinormalizzato: le regole possono essere cambiate
+		if contenuto, err := os.ReadFile(precPath); err == nil {
+			precNorm := netdevice.NormalizzaConfig(b.Marca, string(contenuto))
+			if hashMD5(precNorm) == hashNorm {
+				esito.ID, esito.Invariato = esito.PrecedenteID, true
+				return esito, nil
+			}
+			esito.Aggiunte, esito.Rimosse = diff.Conta(diff.Confronta(diff.Linee(precNorm), diff.Linee(normalizzata)))
+		} else if precHash.Valid && precHash.String == hashNorm {
+			esito.ID, esito.Invariato = esito.PrecedenteID, true
+			return esito, nil
+		}
+	}
+
+	// Salva file
+	backupDir := b.cartella()
+	os.MkdirAll(backupDir, 0755)
+
+	timestamp := time.Now().Format("20060102_150405")
+	filename := fmt.Sprintf("%s_%s_%s.cfg", b.TipoApparato, b.Nome, timestamp)
+	filePath := filepath.Join(backupDir, filename)
+	// Due backup nello stesso secondo non devono sovrascriversi: lo storico punta ai file
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			break
+		}
+		filePath = filepath.Join(backupDir, fmt.Sprintf("%s_%s_%s_%d.cfg", b.TipoApparato, b.Nome, timestamp, i))
+	}
+
+	if err := os.WriteFile(filePath, []byte(output), 0644); err != nil {
+		return nil, fmt.Errorf("salvataggio file: %w", err)
+	}
+
+	// Inserisci record DB
+	var res sql.Result
+	if b.Tabella == "config_backup" {
+		res, err = database.DB.Exec(`
+			INSERT INTO config_backup (nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5,
+				hash_normalizzato, backup_precedente_id, cambiato, righe_aggiunte, righe_rimosse)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, b.NaveID, b.TipoApparato, b.ApparatoID, b.Nome, filePath, len(output), hashMD5(output),
+			hashNorm, nullID(esito.PrecedenteID), esito.PrecedenteID > 0, esito.Aggiunte, esito.Rimosse)
+	} else {
+		res, err = database.DB.Exec(`
+			INSERT INTO config_backup_ufficio (ufficio_id, sala_server_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5,
+				hash_normalizzato, backup_precedente_id, cambiato, righe_aggiunte, righe_rimosse)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, nullID(b.UfficioID), nullID(b.SalaServerID), b.TipoApparato, b.ApparatoID, b.Nome, filePath, len(output), hashMD5(output),
+			hashNorm, nullID(esito.PrecedenteID), esito.PrecedenteID > 0, esito.Aggiunte, esito.Rimosse)
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return nil, fmt.Errorf("registrazione backup: %w", err)
+	}
+	esito.ID, _ = res.LastInsertId()
+	return esito, nil
+}
+
+// ============================================
+// STORICO E CONFRONTO BACKUP CONFIGURAZIONE
+// ============================================
+
+// caricaBackupConfig legge un backup e l'apparato a cui appartiene
+func caricaBackupConfig(origine string, id int64) (*backupConfig, *ConfigBackup, error) {
+	b := &backupConfig{}
+	cb := &ConfigBackup{ID: id}
+	var creato sql.NullTime
+	var err error
+	switch origine {
+	case "nave":
+		b.Tabella = "config_backup"
+		err = database.DB.QueryRow(`
+			SELECT nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, created_at
+			FROM config_backup WHERE id = ?
+		`, id).Scan(&b.NaveID, &b.TipoApparato, &b.ApparatoID, &cb.NomeApparato, &cb.FilePath, &creato)
+	case "ufficio":
+		b.Tabella = "config_backup_ufficio"
+		err = database.DB.QueryRow(`
+			SELECT COALESCE(ufficio_id, 0), COALESCE(sala_server_id, 0), tipo_apparato, apparato_id, COALESCE(nome_apparato, ''), file_path, created_at
+			FROM config_backup_ufficio WHERE id = ?
+		`, id).Scan(&b.UfficioID, &b.SalaServerID, &b.TipoApparato, &b.ApparatoID, &cb.NomeApparato, &cb.FilePath, &creato)
+	default:
+		return nil, nil, fmt.Errorf("origine non valida")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if creato.Valid {
+		cb.CreatedAt = creato.Time.Local().Format("02/01/2006 15:04")
+	}
+	b.TipoApparato = strings.TrimSuffix(strings.TrimSuffix(b.TipoApparato, "_ufficio"), "_sala_server")
+	b.Nome = cb.NomeApparato
+	b.Marca = marcaApparato(b)
+	cb.NaveID, cb.TipoApparato, cb.ApparatoID = b.NaveID, b.TipoApparato, b.ApparatoID
+	return b, cb, nil
+}
+
+// marcaApparato restituisce la marca dell'apparato per le regole di normalizzazione
+func marcaApparato(b *backupConfig) string {
+	if b.TipoApparato == "ac" {
+		return "huawei"
+	}
+	tabella := "switch_nave"
+	switch {
+	case b.UfficioID > 0:
+		tabella = "switch_ufficio"
+	case b.SalaServerID > 0:
+		tabella = "switch_sala_server"
+	}
+	var marca string
+	database.DB.QueryRow("SELECT COALESCE(marca, '') FROM "+tabella+" WHERE id = ?", b.ApparatoID).Scan(&marca)
+	return marca
+}
+
+// storicoBackupConfig restituisce tutti i backup dell'apparato, dal piu recente
+func storicoBackupConfig(b *backupConfig) []ConfigBackup {
+	var backups []ConfigBackup
+	where, args := b.filtro()
+	rows, err := database.DB.Query(`
+		SELECT id, apparato_id, COALESCE(nome_apparato, ''), file_path, COALESCE(file_size, 0), COALESCE(hash_md5, ''), created_at,
+		       COALESCE(backup_precedente_id, 0), cambiato, righe_aggiunte, righe_rimosse
+		FROM `+b.Tabella+` WHERE `+where+` ORDER BY created_at DESC, id DESC`, args...)
+	if err != nil {
+		return backups
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cb := ConfigBackup{NaveID: b.NaveID, TipoApparato: b.TipoApparato}
+		var creato sql.NullTime
+		if err := rows.Scan(&cb.ID, &cb.ApparatoID, &cb.NomeApparato, &cb.FilePath, &cb.FileSize, &cb.HashMD5, &creato,
+			&cb.BackupPrecedenteID, &cb.Cambiato, &cb.RigheAggiunte, &cb.RigheRimosse); err != nil {
+			continue
+		}
+		if creato.Valid {
+			cb.CreatedAt = creato.Time.Local().Format("02/01/2006 15:04")
+		}
+		backups = append(backups, cb)
+	}
+	return backups
+}
+
+// StoricoConfig mostra i backup di un apparato e il confronto tra due di essi
+func StoricoConfig(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Storico Configurazione - FurvioGest", r)
+	q := r.URL.Query()
+	origine := q.Get("origine")
+	id, _ := strconv.ParseInt(q.Get("id"), 10, 64)
+	ignoraVolatili := q.Get("completo") != "1"
+
+	b, selezionato, err := caricaBackupConfig(origine, id)
+	if err != nil {
+		http.Error(w, "Backup non trovato", http.StatusNotFound)
+		return
+	}
+	storico := storicoBackupConfig(b)
+
+	// Di default confronta il backup selezionato con il precedente dello stesso apparato
+	daID, _ := strconv.ParseInt(q.Get("da"), 10, 64)
+	aID, _ := strconv.ParseInt(q.Get("a"), 10, 64)
+	if aID == 0 {
+		aID = id
+	}
+	if daID == 0 {
+		for i, cb := range storico {
+			if cb.ID == aID && i+1 < len(storico) {
+				daID = storico[i+1].ID
+			}
+		}
+	}
+
+	var da, a *ConfigBackup
+	for i := range storico {
+		if storico[i].ID == daID {
+			da = &storico[i]
+		}
+		if storico[i].ID == aID {
+			a = &storico[i]
+		}
+	}
+
+	var blocchi []diff.Blocco
+	var aggiunte, rimosse int
+	if da != nil && a != nil {
+		testoDa, errDa := os.ReadFile(da.FilePath)
+		testoA, errA := os.ReadFile(a.FilePath)
+		if errDa != nil || errA != nil {
+			data.Error = "File di backup non trovato su disco"
+		} else {
+			vecchio, nuovo := string(testoDa), string(testoA)
+			if ignoraVolatili {
+				vecchio = netdevice.NormalizzaConfig(b.Marca, vecchio)
+				nuovo = netdevice.NormalizzaConfig(b.Marca, nuovo)
+			}
+			righe := diff.Confronta(diff.Linee(vecchio), diff.Linee(nuovo))
+			aggiunte, rimosse = diff.Conta(righe)
+
+			if q.Get("formato") == "testo" {
+				nomeFile := fmt.Sprintf("%s_%d_%d.diff", selezionato.NomeApparato, da.ID, a.ID)
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", nomeFile))
+				w.Write([]byte(diff.Unificato(filepath.Base(da.FilePath), filepath.Base(a.FilePath), righe, 3)))
+				return
+			}
+			blocchi = diff.Blocchi(righe, 3)
+		}
+	}
+
+	// Pagina di ritorno dell'apparato
+	indietro := fmt.Sprintf("/navi/rete/%d", b.NaveID)
+	if b.UfficioID > 0 {
+		indietro = fmt.Sprintf("/uffici/rete/%d", b.UfficioID)
+	} else if b.SalaServerID > 0 {
+		indietro = fmt.Sprintf("/sale-server/rete/%d", b.SalaServerID)
+	}
+
+	data.Data = map[string]interface{}{
+		"Origine":        origine,
+		"Selezionato":    selezionato,
+		"Storico":        storico,
+		"Da":             da,
+		"A":              a,
+		"Blocchi":        blocchi,
+		"Aggiunte":       aggiunte,
+		"Rimosse":        rimosse,
+		"IgnoraVolatili": ignoraVolatili,
+		"Indietro":       indietro,
+	}
+	renderTemplate(w, "config_storico.html", data)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"furviogest/internal/database"
+	"furviogest/internal/magazzino"
 	"furviogest/internal/models"
 	"io"
 	"net/http"
@@ -188,11 +189,16 @@ func NuovoDDTEntrata(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Aggiorna giacenza prodotto
-		_, err = tx.Exec(`
-			UPDATE prodotti SET giacenza = giacenza + ?, updated_at = CURRENT_TIMESTAMP
-			WHERE id = ?
-		`, quantita, prodottoID)
+		// Carica il prodotto in magazzino
+		err = magazzino.Registra(tx, magazzino.Movimento{
+			ProdottoID:    prodottoID,
+			Quantita:      float64(quantita),
+			Causale:       magazzino.CausaleDDTEntrata,
+			DocumentoTipo: magazzino.DocumentoDDTEntrata,
+			DocumentoID:   ddtID,
+			UtenteID:      utenteMovimento(r),
+			Motivo:        "DDT/Fattura entrata n. " + numero,
+		})
 		if err != nil {
 			tx.Rollback()
 			data.Error = "Errore aggiornamento giacenza: " + err.Error()
@@ -302,15 +308,14 @@ func ModificaDDTEntrata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prima ripristina le giacenze delle vecchie righe
-	rows, _ := tx.Query(`SELECT prodotto_id, quantita FROM ddt_entrata_righe WHERE ddt_entrata_id = ?`, id)
-	for rows.Next() {
-		var prodID int64
-		var qta int
-		rows.Scan(&prodID, &qta)
-		tx.Exec(`UPDATE prodotti SET giacenza = giacenza - ? WHERE id = ?`, qta, prodID)
+	// Prima storna le giacenze delle vecchie righe
+	if err := stornaRigheDDTEntrata(tx, id, utenteMovimento(r)); err != nil {
+		tx.Rollback()
+		data.Error = "Errore aggiornamento giacenza: " + err.Error()
+		data.Data = map[string]interface{}{"Fornitori": fornitori, "Prodotti": prodotti}
+		renderTemplate(w, "ddt_entrata_form.html", data)
+		return
 	}
-	rows.Close()
 
 	// Elimina vecchie righe
 	tx.Exec(`DELETE FROM ddt_entrata_righe WHERE ddt_entrata_id = ?`, id)
@@ -368,7 +373,22 @@ func ModificaDDTEntrata(w http.ResponseWriter, r *http.Request) {
 
 		tx.Exec(`INSERT INTO ddt_entrata_righe (ddt_entrata_id, prodotto_id, quantita, prodotto_creato_da_ddt) VALUES (?, ?, ?, ?)`,
 			id, prodottoID, quantita, prodottoCreato)
-		tx.Exec(`UPDATE prodotti SET giacenza = giacenza + ? WHERE id = ?`, quantita, prodottoID)
+		err = magazzino.Registra(tx, magazzino.Movimento{
+			ProdottoID:    prodottoID,
+			Quantita:      float64(quantita),
+			Causale:       magazzino.CausaleDDTEntrata,
+			DocumentoTipo: magazzino.DocumentoDDTEntrata,
+			DocumentoID:   id,
+			UtenteID:      utenteMovimento(r),
+			Motivo:        "DDT/Fattura entrata n. " + numero,
+		})
+		if err != nil {
+			tx.Rollback()
+			data.Error = "Errore aggiornamento giacenza: " + err.Error()
+			data.Data = map[string]interface{}{"Fornitori": fornitori, "Prodotti": prodotti}
+			renderTemplate(w, "ddt_entrata_form.html", data)
+			return
+		}
 	}
 
 	tx.Commit()
@@ -391,7 +411,14 @@ func EliminaDDTEntrata(w http.ResponseWriter, r *http.Request) {
 
 	tx, _ := database.DB.Begin()
 
-	// Ripristina giacenze e eventualmente elimina prodotti creati solo da questo DDT
+	// Storna le giacenze
+	if err := stornaRigheDDTEntrata(tx, id, utenteMovimento(r)); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/ddt-entrata", http.StatusSeeOther)
+		return
+	}
+
+	// Eventualmente elimina prodotti creati solo da questo DDT
 	rows, _ := tx.Query(`
 		SELECT prodotto_id, quantita, prodotto_creato_da_ddt 
 		FROM ddt_entrata_righe WHERE ddt_entrata_id = ?
@@ -404,9 +431,6 @@ func EliminaDDTEntrata(w http.ResponseWriter, r *http.Request) {
 		var creato bool
 		rows.Scan(&prodID, &qta, &creato)
 		
-		// Sottrai giacenza
-		tx.Exec(`UPDATE prodotti SET giacenza = giacenza - ? WHERE id = ?`, qta, prodID)
-		
 		// Se prodotto creato da questo DDT, verifica se è usato altrove
 		if creato {
 			var count int
@@ -440,6 +464,41 @@ func EliminaDDTEntrata(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/ddt-entrata", http.StatusSeeOther)
 }
 
+// stornaRigheDDTEntrata scarica dal magazzino le quantita caricate dalle righe del DDT
+func stornaRigheDDTEntrata(tx *sql.Tx, ddtID, utenteID int64) error {
+	var numero string
+	tx.QueryRow(`SELECT numero FROM ddt_entrata WHERE id = ?`, ddtID).Scan(&numero)
+
+	rows, err := tx.Query(`SELECT prodotto_id, quantita FROM ddt_entrata_righe WHERE ddt_entrata_id = ?`, ddtID)
+	if err != nil {
+		return err
+	}
+	var movimenti []magazzino.Movimento
+	for rows.Next() {
+		m := magazzino.Movimento{
+			Causale:       magazzino.CausaleStornoDDTEntrata,
+			DocumentoTipo: magazzino.DocumentoDDTEntrata,
+			DocumentoID:   ddtID,
+			UtenteID:      utenteID,
+			Motivo:        "Storno DDT/Fattura entrata n. " + numero,
+		}
+		if err := rows.Scan(&m.ProdottoID, &m.Quantita); err != nil {
+			rows.Close()
+			return err
+		}
+		m.Quantita = -m.Quantita
+		movimenti = append(movimenti, m)
+	}
+	rows.Close()
+
+	for _, m := range movimenti {
+		if err := magazzino.Registra(tx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // APIInfoEliminazioneDDT restituisce info su cosa verrà eliminato
 func APIInfoEliminazioneDDT(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
 	"net/http"
 	"strconv"
@@ -115,7 +116,7 @@ func NuovoDDTFattura(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisci DDT
-	_, err = database.DB.Exec(`
+	_, err = creaConAudit(r, "ddt_fatture", `
 		INSERT INTO ddt_fatture (fornitore_id, tipo, numero, data_documento, note)
 		VALUES (?, ?, ?, ?, ?)
 	`, fornitoreID, tipo, numero, dataDoc, note)
@@ -181,7 +182,7 @@ func ModificaDDTFattura(w http.ResponseWriter, r *http.Request) {
 	fornitoreID, _ := strconv.ParseInt(fornitoreIDStr, 10, 64)
 	dataDoc, _ := time.Parse("2006-01-02", dataDocStr)
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "ddt_fatture", id, `
 		UPDATE ddt_fatture SET fornitore_id=?, tipo=?, numero=?, data_documento=?, note=?, updated_at=CURRENT_TIMESTAMP
 		WHERE id=?
 	`, fornitoreID, tipo, numero, dataDoc, note, id)
@@ -210,22 +211,20 @@ func EliminaDDTFattura(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tx, _ := database.DB.Begin()
+	traccia := audit.Nuova(r, tx)
+	if err := traccia.Elimina("ddt_fatture", id, figliDDTFattura...); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/ddt-fatture", http.StatusSeeOther)
+		return
+	}
 
-	// Trova tutti i prodotti collegati a questo DDT tramite movimenti_acquisto
-	rows, _ := tx.Query(`
-		SELECT prodotto_id, quantita FROM movimenti_acquisto WHERE ddt_fattura_id = ?
-	`, id)
-	
-	var prodottiDaVerificare []int64
-	for rows.Next() {
-		var prodID int64
-		var qta int
-		rows.Scan(&prodID, &qta)
-		// Sottrai la quantità dalla giacenza
-		tx.Exec(`UPDATE prodotti SET giacenza = giacenza - ? WHERE id = ?`, qta, prodID)
-		prodottiDaVerificare = append(prodottiDaVerificare, prodID)
+	// Sottrai dalla giacenza le quantità acquistate con questo DDT
+	prodottiDaVerificare, err := stornaAcquistiDDTFattura(tx, id, utenteMovimento(r))
+	if err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/ddt-fatture", http.StatusSeeOther)
+		return
 	}
-	rows.Close()
 
 	// Elimina movimenti_acquisto collegati
 	tx.Exec(`DELETE FROM movimenti_acquisto WHERE ddt_fattura_id = ?`, id)
@@ -236,6 +235,7 @@ func EliminaDDTFattura(w http.ResponseWriter, r *http.Request) {
 		tx.QueryRow(`SELECT COUNT(*) FROM movimenti_acquisto WHERE prodotto_id = ?`, prodID).Scan(&countMov)
 		if countMov == 0 {
 			// Nessun altro movimento, elimina il prodotto
+			traccia.Elimina("prodotti", prodID)
 			tx.Exec(`DELETE FROM prodotti WHERE id = ? AND origine = 'nuovo'`, prodID)
 		}
 	}
@@ -243,6 +243,11 @@ func EliminaDDTFattura(w http.ResponseWriter, r *http.Request) {
 	// Elimina DDT
 	tx.Exec(`DELETE FROM ddt_fatture WHERE id = ?`, id)
 
+	if err := traccia.Concludi(); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/ddt-fatture", http.StatusSeeOther)
+		return
+	}
 	tx.Commit()
 	http.Redirect(w, r, "/ddt-fatture", http.StatusSeeOther)
 }
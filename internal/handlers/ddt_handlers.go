@@ -1,14 +1,17 @@
 package handlers
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/auth"
 	"furviogest/internal/database"
+	"furviogest/internal/magazzino"
 	"furviogest/internal/middleware"
 )
 
@@ -64,10 +67,10 @@ func ListaDDT(w http.ResponseWriter, r *http.Request) {
 		LEFT JOIN navi n ON d.nave_id = n.id
 		LEFT JOIN compagnie c ON d.compagnia_id = c.id
 		LEFT JOIN porti p ON d.porto_id = p.id
-		WHERE 1=1
+		WHERE (? = 0 OR d.compagnia_id = ?)
 	`
 
-	var args []interface{}
+	args := []interface{}{session.CompagniaID, session.CompagniaID}
 	if meseFilter != "" && annoFilter != "" {
 		query += " AND strftime('%m', d.data_emissione) = ? AND strftime('%Y', d.data_emissione) = ?"
 		args = append(args, meseFilter, annoFilter)
@@ -133,7 +136,7 @@ func NuovoDDT(w http.ResponseWriter, r *http.Request) {
 			portoPtr = &portoID
 		}
 
-		result, err := database.DB.Exec(`
+		ddtID, err := creaConAudit(r, "ddt", `
 			INSERT INTO ddt (numero, tipo_ddt, nave_id, compagnia_id, porto_id, destinatario, indirizzo, vettore, data_emissione, note)
 			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`, numero, tipoDdt, naveID, compagniaID, portoPtr, destinatario, indirizzo, vettore, dataEmissione, note)
@@ -141,18 +144,17 @@ func NuovoDDT(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			pageData := NewPageData("Nuovo DDT", r)
 			pageData.Error = "Errore creazione DDT: " + err.Error()
-			pageData.Data = getDDTFormData(nil)
+			pageData.Data = getDDTFormData(nil, pageData.Session.CompagniaID)
 			renderTemplate(w, "ddt_form.html", pageData)
 			return
 		}
 
-		ddtID, _ := result.LastInsertId()
 		http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d", ddtID), http.StatusSeeOther)
 		return
 	}
 
 	pageData := NewPageData("Nuovo DDT", r)
-	pageData.Data = getDDTFormData(nil)
+	pageData.Data = getDDTFormData(nil, pageData.Session.CompagniaID)
 	renderTemplate(w, "ddt_form.html", pageData)
 }
 
@@ -189,17 +191,23 @@ func ModificaDDT(w http.ResponseWriter, r *http.Request) {
 			portoPtr = &portoID
 		}
 
-		_, err = database.DB.Exec(`
-			UPDATE ddt SET numero=?, tipo_ddt=?, nave_id=?, compagnia_id=?, porto_id=?,
-			       destinatario=?, indirizzo=?, vettore=?, data_emissione=?, note=?
-			WHERE id=?
-		`, numero, tipoDdt, naveID, compagniaID, portoPtr, destinatario, indirizzo, vettore, dataEmissione, note, id)
+		err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			if err := t.Modifica("ddt", id, figliDDT...); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`
+				UPDATE ddt SET numero=?, tipo_ddt=?, nave_id=?, compagnia_id=?, porto_id=?,
+				       destinatario=?, indirizzo=?, vettore=?, data_emissione=?, note=?
+				WHERE id=?
+			`, numero, tipoDdt, naveID, compagniaID, portoPtr, destinatario, indirizzo, vettore, dataEmissione, note, id)
+			return err
+		})
 
 		if err != nil {
 			pageData := NewPageData("Modifica DDT", r)
 			pageData.Error = "Errore modifica DDT: " + err.Error()
 			ddt := getDDTByID(id)
-			pageData.Data = getDDTFormData(ddt)
+			pageData.Data = getDDTFormData(ddt, pageData.Session.CompagniaID)
 			renderTemplate(w, "ddt_form.html", pageData)
 			return
 		}
@@ -215,7 +223,7 @@ func ModificaDDT(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pageData := NewPageData("Modifica DDT", r)
-	pageData.Data = getDDTFormData(ddt)
+	pageData.Data = getDDTFormData(ddt, pageData.Session.CompagniaID)
 	renderTemplate(w, "ddt_form.html", pageData)
 }
 
@@ -256,7 +264,7 @@ func DettaglioDDT(w http.ResponseWriter, r *http.Request) {
 // EliminaDDT elimina DDT
 func EliminaDDT(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutDDTScrivi) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -264,14 +272,20 @@ func EliminaDDT(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/ddt/elimina/")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 
-	database.DB.Exec("DELETE FROM ddt WHERE id = ?", id)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("ddt", id, figliDDT...); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM ddt WHERE id = ?", id)
+		return err
+	})
 	http.Redirect(w, r, "/ddt", http.StatusSeeOther)
 }
 
-// AggiungiRigaDDT aggiunge riga a DDT
+// AggiungiRigaDDT aggiunge riga a DDT e scarica il prodotto dal magazzino
 func AggiungiRigaDDT(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutDDTScrivi) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -282,40 +296,55 @@ func AggiungiRigaDDT(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.ParseForm()
-	ddtID := r.FormValue("ddt_id")
-	prodottoID := r.FormValue("prodotto_id")
-	quantitaStr := r.FormValue("quantita")
+	ddtID, _ := strconv.ParseInt(r.FormValue("ddt_id"), 10, 64)
+	prodottoID, _ := strconv.ParseInt(r.FormValue("prodotto_id"), 10, 64)
 	descrizione := r.FormValue("descrizione")
 
-	quantita, _ := strconv.ParseFloat(quantitaStr, 64)
+	quantita, _ := strconv.ParseFloat(r.FormValue("quantita"), 64)
 	if quantita <= 0 {
 		quantita = 1
 	}
+	if ddtID == 0 || prodottoID == 0 {
+		http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d?error=parametri", ddtID), http.StatusSeeOther)
+		return
+	}
 
-	// Inserisce riga
-	database.DB.Exec(`
-		INSERT INTO righe_ddt (ddt_id, prodotto_id, quantita, descrizione)
-		VALUES (?, ?, ?, ?)
-	`, ddtID, prodottoID, quantita, descrizione)
-
-	// Scarica dal magazzino
-	database.DB.Exec(`
-		UPDATE prodotti SET quantita = quantita - ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
-	`, quantita, prodottoID)
-
-	// Registra movimento
-	database.DB.Exec(`
-		INSERT INTO movimenti_magazzino (prodotto_id, tipo_movimento, quantita, motivo, data_movimento)
-		VALUES (?, 'uscita', ?, 'DDT Uscita', ?)
-	`, prodottoID, quantita, time.Now().Format("2006-01-02"))
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		var giacenza float64
+		if err := tx.QueryRow("SELECT giacenza FROM prodotti WHERE id = ?", prodottoID).Scan(&giacenza); err != nil {
+			return err
+		}
+		if giacenza < quantita {
+			return fmt.Errorf("giacenza insufficiente")
+		}
+		if _, err := t.Inserisci("righe_ddt", `
+			INSERT INTO righe_ddt (ddt_id, prodotto_id, quantita, descrizione)
+			VALUES (?, ?, ?, ?)
+		`, ddtID, prodottoID, quantita, descrizione); err != nil {
+			return err
+		}
+		return magazzino.Registra(tx, magazzino.Movimento{
+			ProdottoID:    prodottoID,
+			Quantita:      -quantita,
+			Causale:       magazzino.CausaleDDT,
+			DocumentoTipo: magazzino.DocumentoDDT,
+			DocumentoID:   ddtID,
+			UtenteID:      session.UserID,
+			Motivo:        descrizioneDDT(tx, ddtID),
+		})
+	})
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d?error=giacenza", ddtID), http.StatusSeeOther)
+		return
+	}
 
-	http.Redirect(w, r, "/ddt/dettaglio/"+ddtID, http.StatusSeeOther)
+	http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d", ddtID), http.StatusSeeOther)
 }
 
-// RimuoviRigaDDT rimuove riga da DDT
+// RimuoviRigaDDT rimuove riga da DDT e ricarica il prodotto in magazzino
 func RimuoviRigaDDT(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutDDTScrivi) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -328,26 +357,46 @@ func RimuoviRigaDDT(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rigaID, _ := strconv.ParseInt(parts[0], 10, 64)
-	ddtID := parts[1]
-
-	// Recupera info riga per ripristinare magazzino
-	var prodottoID int64
-	var quantita float64
-	database.DB.QueryRow("SELECT prodotto_id, quantita FROM righe_ddt WHERE id = ?", rigaID).Scan(&prodottoID, &quantita)
-
-	// Elimina riga
-	database.DB.Exec("DELETE FROM righe_ddt WHERE id = ?", rigaID)
-
-	// Ripristina magazzino
-	database.DB.Exec("UPDATE prodotti SET quantita = quantita + ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", quantita, prodottoID)
+	ddtID, _ := strconv.ParseInt(parts[1], 10, 64)
+
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		// La riga deve appartenere al DDT indicato
+		var prodottoID int64
+		var quantita float64
+		err := tx.QueryRow("SELECT prodotto_id, quantita FROM righe_ddt WHERE id = ? AND ddt_id = ?", rigaID, ddtID).
+			Scan(&prodottoID, &quantita)
+		if err != nil {
+			return err
+		}
+		if err := t.Elimina("righe_ddt", rigaID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM righe_ddt WHERE id = ?", rigaID); err != nil {
+			return err
+		}
+		return magazzino.Registra(tx, magazzino.Movimento{
+			ProdottoID:    prodottoID,
+			Quantita:      quantita,
+			Causale:       magazzino.CausaleStornoDDT,
+			DocumentoTipo: magazzino.DocumentoDDT,
+			DocumentoID:   ddtID,
+			UtenteID:      session.UserID,
+			Motivo:        "Riga rimossa da " + descrizioneDDT(tx, ddtID),
+		})
+	})
+	if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d?error=delete", ddtID), http.StatusSeeOther)
+		return
+	}
 
-	// Registra movimento
-	database.DB.Exec(`
-		INSERT INTO movimenti_magazzino (prodotto_id, tipo_movimento, quantita, motivo, data_movimento)
-		VALUES (?, 'entrata', ?, 'Annullo riga DDT', ?)
-	`, prodottoID, quantita, time.Now().Format("2006-01-02"))
+	http.Redirect(w, r, fmt.Sprintf("/ddt/dettaglio/%d", ddtID), http.StatusSeeOther)
+}
 
-	http.Redirect(w, r, "/ddt/dettaglio/"+ddtID, http.StatusSeeOther)
+// descrizioneDDT descrive il DDT nel motivo dei movimenti di magazzino
+func descrizioneDDT(tx *sql.Tx, ddtID int64) string {
+	var numero string
+	tx.QueryRow("SELECT numero FROM ddt WHERE id = ?", ddtID).Scan(&numero)
+	return "DDT n. " + numero
 }
 
 // GeneraNumDDT genera numero progressivo DDT
@@ -414,9 +463,9 @@ func getRigheDDT(ddtID int64) []RigaDDT {
 }
 
 // getDDTFormData recupera dati per form DDT
-func getDDTFormData(ddt *DDT) map[string]interface{} {
-	navi, _ := getNaviList()
-	compagnie, _ := getCompagnieList()
+func getDDTFormData(ddt *DDT, compagniaID int64) map[string]interface{} {
+	navi, _ := getNaviList(compagniaID)
+	compagnie, _ := getCompagnieList(compagniaID)
 	porti, _ := getPortiList()
 
 	if ddt == nil {
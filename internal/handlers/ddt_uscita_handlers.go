@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
+	"furviogest/internal/magazzino"
 	"furviogest/internal/models"
 	"html/template"
 	"log"
@@ -184,7 +186,7 @@ func NuovoDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisci DDT
-	result, err := database.DB.Exec(`
+	ddtID, err := creaConAudit(r, "ddt_uscita", `
 		INSERT INTO ddt_uscita (numero, anno, data_documento, cliente_id, destinazione, causale, porto, aspetto_beni, nr_colli, peso, data_ora_trasporto, incaricato_trasporto, note)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, numero, anno, dataDoc, clienteID, destinazione, causale, porto, aspettoBeni, nrColli, peso, dataOraTrasporto, incaricatoTrasporto, note)
@@ -197,7 +199,6 @@ func NuovoDDTUscita(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ddtID, _ := result.LastInsertId()
 	http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d", ddtID), http.StatusSeeOther)
 }
 
@@ -354,7 +355,7 @@ func ModificaDDTUscita(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "ddt_uscita", id, `
 		UPDATE ddt_uscita SET data_documento=?, cliente_id=?, destinazione=?, causale=?, porto=?, aspetto_beni=?, nr_colli=?, peso=?, data_ora_trasporto=?, incaricato_trasporto=?, note=?, updated_at=CURRENT_TIMESTAMP
 		WHERE id=?
 	`, dataDoc, clienteID, destinazione, causale, porto, aspettoBeni, nrColli, peso, dataOraTrasporto, incaricatoTrasporto, note, id)
@@ -387,6 +388,12 @@ func AnnullaDDTUscita(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=1", id), http.StatusSeeOther)
 		return
 	}
+	traccia := audit.Nuova(r, tx)
+	if err := traccia.Modifica("ddt_uscita", id, figliDDTUscita...); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=1", id), http.StatusSeeOther)
+		return
+	}
 
 	// Ripristina giacenze per ogni riga
 	rows, err := tx.Query("SELECT prodotto_id, quantita FROM righe_ddt_uscita WHERE ddt_uscita_id = ?", id)
@@ -396,19 +403,37 @@ func AnnullaDDTUscita(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	motivo := "Annullamento " + descrizioneDDTUscita(tx, id)
+	var movimenti []magazzino.Movimento
 	for rows.Next() {
-		var prodottoID int64
-		var quantita float64
-		if err := rows.Scan(&prodottoID, &quantita); err != nil {
+		m := magazzino.Movimento{
+			Causale:       magazzino.CausaleStornoDDTUscita,
+			DocumentoTipo: magazzino.DocumentoDDTUscita,
+			DocumentoID:   id,
+			UtenteID:      utenteMovimento(r),
+			Motivo:        motivo,
+		}
+		if err := rows.Scan(&m.ProdottoID, &m.Quantita); err != nil {
 			continue
 		}
-		// Ripristina giacenza (aggiungi)
-		tx.Exec("UPDATE prodotti SET giacenza = giacenza + ? WHERE id = ?", quantita, prodottoID)
+		movimenti = append(movimenti, m)
 	}
 	rows.Close()
 
+	// Ripristina giacenza (aggiungi)
+	for _, m := range movimenti {
+		if err := magazzino.Registra(tx, m); err != nil {
+			tx.Rollback()
+			http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=giacenza", id), http.StatusSeeOther)
+			return
+		}
+	}
+
 	// Marca DDT come annullato
 	_, err = tx.Exec("UPDATE ddt_uscita SET annullato = 1, data_annullamento = CURRENT_TIMESTAMP WHERE id = ?", id)
+	if err == nil {
+		err = traccia.Concludi()
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=1", id), http.StatusSeeOther)
@@ -464,7 +489,8 @@ func AggiungiRigaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisci riga
-	_, err = tx.Exec("INSERT INTO righe_ddt_uscita (ddt_uscita_id, prodotto_id, quantita) VALUES (?, ?, ?)", ddtID, prodottoID, quantita)
+	traccia := audit.Nuova(r, tx)
+	_, err = traccia.Inserisci("righe_ddt_uscita", "INSERT INTO righe_ddt_uscita (ddt_uscita_id, prodotto_id, quantita) VALUES (?, ?, ?)", ddtID, prodottoID, quantita)
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=insert", ddtID), http.StatusSeeOther)
@@ -472,7 +498,18 @@ func AggiungiRigaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Scala giacenza
-	_, err = tx.Exec("UPDATE prodotti SET giacenza = giacenza - ? WHERE id = ?", quantita, prodottoID)
+	err = magazzino.Registra(tx, magazzino.Movimento{
+		ProdottoID:    prodottoID,
+		Quantita:      -quantita,
+		Causale:       magazzino.CausaleDDTUscita,
+		DocumentoTipo: magazzino.DocumentoDDTUscita,
+		DocumentoID:   ddtID,
+		UtenteID:      utenteMovimento(r),
+		Motivo:        descrizioneDDTUscita(tx, ddtID),
+	})
+	if err == nil {
+		err = traccia.Concludi()
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=giacenza", ddtID), http.StatusSeeOther)
@@ -522,7 +559,11 @@ func RimuoviRigaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Elimina riga
-	_, err = tx.Exec("DELETE FROM righe_ddt_uscita WHERE id = ?", rigaID)
+	traccia := audit.Nuova(r, tx)
+	err = traccia.Elimina("righe_ddt_uscita", rigaID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM righe_ddt_uscita WHERE id = ?", rigaID)
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=delete", ddtID), http.StatusSeeOther)
@@ -530,7 +571,18 @@ func RimuoviRigaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Ripristina giacenza
-	_, err = tx.Exec("UPDATE prodotti SET giacenza = giacenza + ? WHERE id = ?", quantita, prodottoID)
+	err = magazzino.Registra(tx, magazzino.Movimento{
+		ProdottoID:    prodottoID,
+		Quantita:      quantita,
+		Causale:       magazzino.CausaleStornoDDTUscita,
+		DocumentoTipo: magazzino.DocumentoDDTUscita,
+		DocumentoID:   ddtID,
+		UtenteID:      utenteMovimento(r),
+		Motivo:        "Riga rimossa da " + descrizioneDDTUscita(tx, ddtID),
+	})
+	if err == nil {
+		err = traccia.Concludi()
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=giacenza", ddtID), http.StatusSeeOther)
@@ -541,6 +593,14 @@ func RimuoviRigaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d", ddtID), http.StatusSeeOther)
 }
 
+// descrizioneDDTUscita descrive il DDT nel motivo dei movimenti di magazzino
+func descrizioneDDTUscita(tx *sql.Tx, ddtID int64) string {
+	var numero string
+	var anno int
+	tx.QueryRow("SELECT numero, anno FROM ddt_uscita WHERE id = ?", ddtID).Scan(&numero, &anno)
+	return fmt.Sprintf("DDT uscita n. %s/%d", numero, anno)
+}
+
 // API per cercare prodotti
 func APICercaProdottiDDT(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -628,7 +688,11 @@ func EliminaDDTUscita(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Elimina le righe del DDT
-	_, err = tx.Exec("DELETE FROM righe_ddt_uscita WHERE ddt_uscita_id = ?", id)
+	traccia := audit.Nuova(r, tx)
+	err = traccia.Elimina("ddt_uscita", id, figliDDTUscita...)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM righe_ddt_uscita WHERE ddt_uscita_id = ?", id)
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=delete_rows", id), http.StatusSeeOther)
@@ -637,6 +701,9 @@ func EliminaDDTUscita(w http.ResponseWriter, r *http.Request) {
 
 	// Elimina il DDT
 	_, err = tx.Exec("DELETE FROM ddt_uscita WHERE id = ?", id)
+	if err == nil {
+		err = traccia.Concludi()
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Redirect(w, r, fmt.Sprintf("/ddt-uscita/dettaglio/%d?error=delete_ddt", id), http.StatusSeeOther)
@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/middleware"
+	"furviogest/internal/models"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ============================================
+// DISPONIBILITA ACCESS POINT (SLA)
+// ============================================
+
+// misuraDisponibilita accumula i tempi di un AP, o di un gruppo di AP, nel periodo
+type misuraDisponibilita struct {
+	Monitorato      time.Duration // tempo con stato noto (online, offline o fault)
+	Online          time.Duration
+	Interruzioni    int           // passaggi da online a offline/fault nel periodo
+	Ripristini      int           // interruzioni risolte nel periodo
+	TempoRipristino time.Duration // durata complessiva delle interruzioni risolte
+}
+
+func (m *misuraDisponibilita) aggiungi(altra misuraDisponibilita) {
+	m.Monitorato += altra.Monitorato
+	m.Online += altra.Online
+	m.Interruzioni += altra.Interruzioni
+	m.Ripristini += altra.Ripristini
+	m.TempoRipristino += altra.TempoRipristino
+}
+
+// Percentuale restituisce la disponibilita sul tempo monitorato (-1 se non ci sono dati)
+func (m misuraDisponibilita) Percentuale() float64 {
+	if m.Monitorato <= 0 {
+		return -1
+	}
+	return float64(m.Online) * 100 / float64(m.Monitorato)
+}
+
+// MTTR restituisce il tempo medio di ripristino delle interruzioni risolte
+func (m misuraDisponibilita) MTTR() time.Duration {
+	if m.Ripristini == 0 {
+		return 0
+	}
+	return m.TempoRipristino / time.Duration(m.Ripristini)
+}
+
+// PercentualeTesto formatta la disponibilita per pagina ed export
+func (m misuraDisponibilita) PercentualeTesto() string {
+	if m.Monitorato <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", m.Percentuale())
+}
+
+// FermoTesto formatta il tempo non disponibile
+func (m misuraDisponibilita) FermoTesto() string {
+	return formatDurata(int64((m.Monitorato - m.Online).Seconds()))
+}
+
+// MTTRTesto formatta il tempo medio di ripristino
+func (m misuraDisponibilita) MTTRTesto() string {
+	if m.Ripristini == 0 {
+		return "-"
+	}
+	return formatDurata(int64(m.MTTR().Seconds()))
+}
+
+// disponibilitaAP e la disponibilita di un singolo access point
+type disponibilitaAP struct {
+	misuraDisponibilita
+	ID    int64
+	Nome  string
+	MAC   string
+	Stato string
+}
+
+// disponibilitaNave aggrega gli AP di una nave
+type disponibilitaNave struct {
+	misuraDisponibilita
+	ID   int64
+	Nome string
+	AP   []disponibilitaAP
+}
+
+// disponibilitaCompagnia aggrega le navi di una compagnia
+type disponibilitaCompagnia struct {
+	misuraDisponibilita
+	ID   int64
+	Nome string
+	Navi []disponibilitaNave
+}
+
+// filtroDisponibilita contiene periodo e perimetro del report
+type filtroDisponibilita struct {
+	Dal         time.Time // inclusivo
+	Al          time.Time // esclusivo
+	CompagniaID int64
+	NaveID      int64
+}
+
+// eventoStatoAP e una riga di ap_status_log
+type eventoStatoAP struct {
+	Stato  string
+	Quando time.Time
+}
+
+// leggiFiltroDisponibilita legge periodo e filtri dalla richiesta.
+// Il periodo e dato da mese (AAAA-MM) oppure da dal/al (date incluse); di default il mese corrente.
+// Per gli utenti associati a una compagnia il filtro e sempre la loro compagnia: restituisce
+// false se la richiesta ne indica un'altra.
+func leggiFiltroDisponibilita(r *http.Request) (filtroDisponibilita, bool) {
+	ora := time.Now()
+	f := filtroDisponibilita{
+		Dal: time.Date(ora.Year(), ora.Month(), 1, 0, 0, 0, 0, time.Local),
+	}
+	f.Al = f.Dal.AddDate(0, 1, 0)
+
+	if mese, err := time.ParseInLocation("2006-01", r.FormValue("mese"), time.Local); err == nil {
+		f.Dal, f.Al = mese, mese.AddDate(0, 1, 0)
+	} else if dal, err := time.ParseInLocation("2006-01-02", r.FormValue("dal"), time.Local); err == nil {
+		f.Dal = dal
+		f.Al = dal.AddDate(0, 1, 0)
+		if al, err := time.ParseInLocation("2006-01-02", r.FormValue("al"), time.Local); err == nil && !al.Before(dal) {
+			f.Al = al.AddDate(0, 0, 1)
+		}
+	}
+
+	f.CompagniaID, _ = strconv.ParseInt(r.FormValue("compagnia_id"), 10, 64)
+	f.NaveID, _ = strconv.ParseInt(r.FormValue("nave_id"), 10, 64)
+
+	if session := middleware.GetSession(r); session != nil && session.CompagniaID != 0 {
+		if f.CompagniaID != 0 && f.CompagniaID != session.CompagniaID {
+			return f, false
+		}
+		f.CompagniaID = session.CompagniaID
+	}
+	return f, true
+}
+
+// calcolaDisponibilita ricostruisce dallo storico stati la disponibilita di ogni AP
+// nel periodo e la aggrega per nave e compagnia
+func calcolaDisponibilita(f filtroDisponibilita) ([]disponibilitaCompagnia, error) {
+	// Il periodo futuro non e ancora misurabile
+	al := f.Al
+	if ora := time.Now(); al.After(ora) {
+		al = ora
+	}
+	dal := f.Dal.UTC().Format("2006-01-02 15:04:05")
+	alDB := al.UTC().Format("2006-01-02 15:04:05")
+
+	perimetro := `
+		FROM access_point ap
+		JOIN navi n ON ap.nave_id = n.id
+		LEFT JOIN compagnie c ON n.compagnia_id = c.id`
+	filtro := `(? = 0 OR n.compagnia_id = ?) AND (? = 0 OR n.id = ?)`
+
+	// Per ogni AP: l'ultimo stato prima del periodo e tutti i cambi al suo interno
+	rows, err := database.DB.Query(`
+		SELECT l.ap_id, l.stato, l.created_at
+		`+perimetro+`
+		JOIN ap_status_log l ON l.ap_id = ap.id
+		WHERE `+filtro+` AND l.created_at < ? AND l.created_at >= COALESCE(
+			(SELECT MAX(l2.created_at) FROM ap_status_log l2 WHERE l2.ap_id = l.ap_id AND l2.created_at <= ?), ?)
+		ORDER BY l.ap_id, l.created_at, l.id
+	`, f.CompagniaID, f.CompagniaID, f.NaveID, f.NaveID, alDB, dal, dal)
+	if err != nil {
+		return nil, err
+	}
+	eventi := make(map[int64][]eventoStatoAP)
+	for rows.Next() {
+		var apID int64
+		var e eventoStatoAP
+		if err := rows.Scan(&apID, &e.Stato, &e.Quando); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		eventi[apID] = append(eventi[apID], e)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT ap.id, ap.ap_name, ap.ap_mac, ap.stato, n.id, n.nome, COALESCE(c.id, 0), COALESCE(c.nome, '')
+		`+perimetro+`
+		WHERE `+filtro+`
+		ORDER BY COALESCE(c.nome, ''), c.id, n.nome, n.id, ap.ap_name
+	`, f.CompagniaID, f.CompagniaID, f.NaveID, f.NaveID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var compagnie []disponibilitaCompagnia
+	for rows.Next() {
+		var ap disponibilitaAP
+		var naveID, compagniaID int64
+		var naveNome, compagniaNome string
+		if err := rows.Scan(&ap.ID, &ap.Nome, &ap.MAC, &ap.Stato, &naveID, &naveNome, &compagniaID, &compagniaNome); err != nil {
+			return nil, err
+		}
+		ap.misuraDisponibilita = misuraDisponibilitaAP(eventi[ap.ID], f.Dal, al)
+
+		// Le righe sono ordinate per compagnia e nave: si accoda all'ultimo gruppo
+		if len(compagnie) == 0 || compagnie[len(compagnie)-1].ID != compagniaID {
+			compagnie = append(compagnie, disponibilitaCompagnia{ID: compagniaID, Nome: compagniaNome})
+		}
+		c := &compagnie[len(compagnie)-1]
+		if len(c.Navi) == 0 || c.Navi[len(c.Navi)-1].ID != naveID {
+			c.Navi = append(c.Navi, disponibilitaNave{ID: naveID, Nome: naveNome})
+		}
+		n := &c.Navi[len(c.Navi)-1]
+		n.AP = append(n.AP, ap)
+		n.aggiungi(ap.misuraDisponibilita)
+		c.aggiungi(ap.misuraDisponibilita)
+	}
+	return compagnie, rows.Err()
+}
+
+// apFermo indica gli stati che contano come indisponibilita
+func apFermo(stato string) bool {
+	return stato == "offline" || stato == "fault"
+}
+
+// misuraDisponibilitaAP calcola i tempi di un AP nel periodo [dal, al).
+// Il primo evento puo precedere il periodo e ne fornisce lo stato iniziale;
+// il tempo in stato unknown, o prima del primo rilevamento, non e misurato.
+func misuraDisponibilitaAP(eventi []eventoStatoAP, dal, al time.Time) misuraDisponibilita {
+	var m misuraDisponibilita
+	var stato string
+	var inizioStato, inizioFermo time.Time
+
+	accumula := func(fine time.Time) {
+		da, a := inizioStato, fine
+		if da.Before(dal) {
+			da = dal
+		}
+		if a.After(al) {
+			a = al
+		}
+		if !a.After(da) || (stato != "online" && !apFermo(stato)) {
+			return
+		}
+		m.Monitorato += a.Sub(da)
+		if stato == "online" {
+			m.Online += a.Sub(da)
+		}
+	}
+
+	for i, e := range eventi {
+		if i > 0 {
+			accumula(e.Quando)
+		}
+		nelPeriodo := !e.Quando.Before(dal)
+
+		switch {
+		case apFermo(e.Stato) && stato == "online":
+			inizioFermo = e.Quando
+			if nelPeriodo {
+				m.Interruzioni++
+			}
+		case apFermo(e.Stato) && i == 0 && !nelPeriodo:
+			// Fermo gia in corso all'inizio del periodo
+			inizioFermo = e.Quando
+		case e.Stato == "online" && apFermo(stato):
+			if !inizioFermo.IsZero() && nelPeriodo {
+				m.Ripristini++
+				m.TempoRipristino += e.Quando.Sub(inizioFermo)
+			}
+			inizioFermo = time.Time{}
+		case !apFermo(e.Stato):
+			inizioFermo = time.Time{}
+		}
+
+		stato, inizioStato = e.Stato, e.Quando
+	}
+	if len(eventi) > 0 {
+		accumula(al)
+	}
+	return m
+}
+
+// DisponibilitaAP mostra il report di disponibilita degli AP per compagnia, nave e singolo AP
+func DisponibilitaAP(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Disponibilita AP - FurvioGest", r)
+
+	f, ok := leggiFiltroDisponibilita(r)
+	if !ok {
+		http.Error(w, "Non trovato.", http.StatusNotFound)
+		return
+	}
+	compagnie, err := calcolaDisponibilita(f)
+	if err != nil {
+		log.Printf("[Disponibilita] Errore calcolo: %v", err)
+		data.Error = "Errore nel calcolo della disponibilita"
+	}
+
+	var totale misuraDisponibilita
+	for _, c := range compagnie {
+		totale.aggiungi(c.misuraDisponibilita)
+	}
+
+	navi, _ := getNaviList(data.Session.CompagniaID)
+	var elencoCompagnie []models.Compagnia
+	for _, c := range getCompagnie() {
+		if data.Session.VedeCompagnia(c.ID) {
+			elencoCompagnie = append(elencoCompagnie, c)
+		}
+	}
+	ora := time.Now()
+	data.Data = map[string]interface{}{
+		"Compagnie":       compagnie,
+		"Totale":          totale,
+		"Filtro":          f,
+		"Dal":             f.Dal.Format("2006-01-02"),
+		"Al":              f.Al.AddDate(0, 0, -1).Format("2006-01-02"),
+		"MeseCorrente":    ora.Format("2006-01"),
+		"MeseScorso":      time.Date(ora.Year(), ora.Month()-1, 1, 0, 0, 0, 0, time.Local).Format("2006-01"),
+		"ElencoCompagnie": elencoCompagnie,
+		"ElencoNavi":      navi,
+	}
+	renderTemplate(w, "disponibilita_ap.html", data)
+}
+
+// ExportDisponibilitaAP esporta il report di disponibilita in CSV o XLSX
+func ExportDisponibilitaAP(w http.ResponseWriter, r *http.Request) {
+	f, ok := leggiFiltroDisponibilita(r)
+	if !ok {
+		http.Error(w, "Non trovato.", http.StatusNotFound)
+		return
+	}
+	compagnie, err := calcolaDisponibilita(f)
+	if err != nil {
+		log.Printf("[Disponibilita] Errore export: %v", err)
+		http.Error(w, "Errore esportazione", http.StatusInternalServerError)
+		return
+	}
+
+	periodo := fmt.Sprintf("%s_%s", f.Dal.Format("20060102"), f.Al.AddDate(0, 0, -1).Format("20060102"))
+	intestazione := []string{"Livello", "Compagnia", "Nave", "AP", "MAC", "Disponibilita %", "Ore monitorate", "Ore fermo", "Interruzioni", "Ripristini", "MTTR (minuti)"}
+
+	// Una riga per compagnia, nave e AP: il livello consente di filtrare in Excel
+	var righe [][]interface{}
+	riga := func(livello, compagnia, nave, ap, mac string, m misuraDisponibilita) []interface{} {
+		var percentuale, mttr interface{} = "", ""
+		if m.Monitorato > 0 {
+			percentuale = arrotonda(m.Percentuale(), 3)
+		}
+		if m.Ripristini > 0 {
+			mttr = arrotonda(m.MTTR().Minutes(), 1)
+		}
+		return []interface{}{livello, compagnia, nave, ap, mac, percentuale,
+			arrotonda(m.Monitorato.Hours(), 2), arrotonda((m.Monitorato - m.Online).Hours(), 2),
+			m.Interruzioni, m.Ripristini, mttr}
+	}
+	for _, c := range compagnie {
+		righe = append(righe, riga("Compagnia", c.Nome, "", "", "", c.misuraDisponibilita))
+		for _, n := range c.Navi {
+			righe = append(righe, riga("Nave", c.Nome, n.Nome, "", "", n.misuraDisponibilita))
+			for _, ap := range n.AP {
+				righe = append(righe, riga("AP", c.Nome, n.Nome, ap.Nome, ap.MAC, ap.misuraDisponibilita))
+			}
+		}
+	}
+
+	if r.FormValue("formato") == "xlsx" {
+		xlsx := excelize.NewFile()
+		defer xlsx.Close()
+		foglio := "Disponibilita"
+		xlsx.SetSheetName("Sheet1", foglio)
+		intestazioneXLSX := make([]interface{}, len(intestazione))
+		for i, v := range intestazione {
+			intestazioneXLSX[i] = v
+		}
+		xlsx.SetSheetRow(foglio, "A1", &intestazioneXLSX)
+		for i, valori := range righe {
+			cella, _ := excelize.CoordinatesToCellName(1, i+2)
+			xlsx.SetSheetRow(foglio, cella, &valori)
+		}
+		xlsx.SetPanes(foglio, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+		xlsx.AutoFilter(foglio, fmt.Sprintf("A1:K%d", len(righe)+1), nil)
+
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=disponibilita_ap_%s.xlsx", periodo))
+		if err := xlsx.Write(w); err != nil {
+			log.Printf("[Disponibilita] Errore scrittura XLSX: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=disponibilita_ap_%s.csv", periodo))
+
+	// BOM per Excel
+	w.Write([]byte{0xEF, 0xBB, 0xBF})
+
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	writer.Write(intestazione)
+	for _, valori := range righe {
+		campi := make([]string, len(valori))
+		for i, v := range valori {
+			campi[i] = fmt.Sprint(v)
+		}
+		writer.Write(campi)
+	}
+	writer.Flush()
+}
+
+// arrotonda arrotonda un valore al numero di decimali indicato
+func arrotonda(valore float64, decimali int) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(valore, 'f', decimali, 64), 64)
+	return v
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"furviogest/internal/auth"
+	"furviogest/internal/middleware"
+	"furviogest/internal/qrcode"
+)
+
+// registrazioneTOTP contiene i dati per configurare l'app di autenticazione
+type registrazioneTOTP struct {
+	Segreto string
+	URI     string
+	QR      template.HTML
+}
+
+// DueFattori gestisce la registrazione e la disattivazione dell'autenticazione a due fattori
+func DueFattori(w http.ResponseWriter, r *http.Request) {
+	session := middleware.GetSession(r)
+	data := NewPageData("Autenticazione a due fattori - FurvioGest", r)
+
+	var codici []string
+	if r.Method == http.MethodPost {
+		stato, err := auth.LeggiStatoTOTP(session)
+		if err != nil {
+			http.Error(w, "Errore lettura stato", http.StatusInternalServerError)
+			return
+		}
+		codice := r.FormValue("codice")
+
+		switch r.FormValue("azione") {
+		case "attiva":
+			codici, err = auth.AttivaTOTP(session.UserID, codice)
+			if err != nil {
+				data.Error = "Codice non valido: controlla che l'ora del telefono sia corretta e riprova"
+			} else {
+				data.Success = "Autenticazione a due fattori attivata"
+			}
+		case "rigenera":
+			if err := auth.VerificaSecondoFattore(session.UserID, codice); err != nil {
+				data.Error = "Codice non valido"
+			} else if codici, err = auth.RigeneraCodiciRecupero(session.UserID); err != nil {
+				data.Error = "Errore generazione codici di recupero"
+			} else {
+				data.Success = "Nuovi codici di recupero generati: quelli precedenti non sono piu validi"
+			}
+		case "disattiva":
+			if stato.Obbligatorio {
+				data.Error = "L'autenticazione a due fattori e obbligatoria per il tuo ruolo"
+			} else if err := auth.VerificaSecondoFattore(session.UserID, codice); err != nil {
+				data.Error = "Codice non valido"
+			} else if err := auth.DisattivaTOTP(session.UserID); err != nil {
+				data.Error = "Errore disattivazione"
+			} else {
+				data.Success = "Autenticazione a due fattori disattivata"
+			}
+		}
+	}
+
+	stato, err := auth.LeggiStatoTOTP(session)
+	if err != nil {
+		http.Error(w, "Errore lettura stato", http.StatusInternalServerError)
+		return
+	}
+
+	var registrazione *registrazioneTOTP
+	if !stato.Attivo {
+		segreto, err := auth.PreparaTOTP(session.UserID)
+		if err != nil {
+			log.Printf("[2FA] Preparazione segreto utente %d: %v", session.UserID, err)
+			http.Error(w, "Errore preparazione autenticazione a due fattori", http.StatusInternalServerError)
+			return
+		}
+		registrazione = &registrazioneTOTP{
+			Segreto: raggruppaSegreto(segreto),
+			URI:     auth.URIProvisioningTOTP(session.Username, segreto),
+		}
+		if qr, err := qrcode.Codifica(registrazione.URI); err == nil {
+			registrazione.QR = template.HTML(qr.SVG(220))
+		}
+	}
+
+	data.Data = map[string]interface{}{
+		"Stato":          stato,
+		"Registrazione":  registrazione,
+		"CodiciRecupero": codici,
+		"DaAttivare":     stato.Obbligatorio && !stato.Attivo,
+	}
+	renderTemplate(w, "due_fattori.html", data)
+}
+
+// raggruppaSegreto divide il segreto in gruppi di 4 caratteri per l'inserimento manuale
+func raggruppaSegreto(segreto string) string {
+	var gruppi []string
+	for len(segreto) > 4 {
+		gruppi = append(gruppi, segreto[:4])
+		segreto = segreto[4:]
+	}
+	return strings.Join(append(gruppi, segreto), " ")
+}
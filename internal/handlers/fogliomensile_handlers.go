@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 
+	"furviogest/internal/auth"
 	"furviogest/internal/database"
 	"furviogest/internal/middleware"
 )
@@ -48,9 +49,9 @@ func FoglioMensile(w http.ResponseWriter, r *http.Request) {
 	mese, _ := strconv.Atoi(meseStr)
 	anno, _ := strconv.Atoi(annoStr)
 
-	// Se non tecnico, vede solo i propri dati
+	// Senza gestione trasferte, vede solo i propri dati
 	var tecnicoID int64
-	if !session.IsTecnico() {
+	if !session.Puo(auth.AutTrasferteGestione) {
 		tecnicoID = session.UserID
 	} else if tecnicoFilter != "" {
 		tecnicoID, _ = strconv.ParseInt(tecnicoFilter, 10, 64)
@@ -21,7 +21,7 @@ type GuastoNave struct {
 	ID                       int64
 	NaveID                   int64
 	NaveNome                 string
-	Tipo                     string // manuale o ap_fault
+	Tipo                     string // manuale o condizione della regola (ap_fault, ...)
 	APID                     *int64
 	APNome                   string
 	Gravita                  string // bassa, media, alta
@@ -38,6 +38,10 @@ type GuastoNave struct {
 	TecnicoRisoluzioneNome   string
 	DataRisoluzione          string
 	DescrizioneRisoluzione   string
+	Automatico               bool   // aperto da una regola di monitoraggio
+	NomeCondizione           string // condizione della regola, per i guasti automatici
+	Occorrenze               int
+	UltimoRilevamento        string
 }
 
 type NaveGuastiCount struct {
@@ -91,8 +95,9 @@ func ListaNaviGuasti(w http.ResponseWriter, r *http.Request) {
 			(SELECT COUNT(*) FROM access_point ap WHERE ap.nave_id = n.id AND (LOWER(ap.stato) = 'fault' OR LOWER(ap.stato) = 'offline')) as ap_fault
 		FROM navi n
 		LEFT JOIN compagnie c ON n.compagnia_id = c.id
+		WHERE ? = 0 OR n.compagnia_id = ?
 		ORDER BY ap_fault DESC, guasti_alti DESC, guasti_aperti DESC, n.nome
-	`)
+	`, data.Session.CompagniaID, data.Session.CompagniaID)
 	if err != nil {
 		http.Error(w, "Errore caricamento navi", http.StatusInternalServerError)
 		return
@@ -188,7 +193,7 @@ func NuovoGuasto(w http.ResponseWriter, r *http.Request) {
 		tecnicoID = session.UserID
 	}
 
-	_, err := database.DB.Exec(`
+	guastoID, err := creaConAudit(r, "guasti_nave", `
 		INSERT INTO guasti_nave (nave_id, tipo, gravita, descrizione, stato, tecnico_apertura_id)
 		VALUES (?, 'manuale', ?, ?, ?, ?)
 	`, naveID, gravita, descrizione, stato, tecnicoID)
@@ -198,6 +203,8 @@ func NuovoGuasto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go notificaGuasto(guastoID, eventoGuastoAperto, "")
+
 	http.Redirect(w, r, fmt.Sprintf("/guasti-nave/%d", naveID), http.StatusSeeOther)
 }
 
@@ -214,9 +221,10 @@ func ModificaGuasto(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/guasti-nave/modifica/")
 	guastoID, _ := strconv.ParseInt(path, 10, 64)
 
-	// Ottieni nave_id prima di modificare
+	// Ottieni nave_id e gravita prima di modificare
 	var naveID int64
-	database.DB.QueryRow("SELECT nave_id FROM guasti_nave WHERE id = ?", guastoID).Scan(&naveID)
+	var gravitaPrecedente string
+	database.DB.QueryRow("SELECT nave_id, gravita FROM guasti_nave WHERE id = ?", guastoID).Scan(&naveID, &gravitaPrecedente)
 
 	r.ParseForm()
 	stato := r.FormValue("stato")
@@ -233,7 +241,7 @@ func ModificaGuasto(w http.ResponseWriter, r *http.Request) {
 			tecID, _ = strconv.ParseInt(tecnicoPresaInCaricoID, 10, 64)
 		}
 
-		database.DB.Exec(`
+		modificaConAudit(r, "guasti_nave", guastoID, `
 			UPDATE guasti_nave 
 			SET stato = ?, gravita = ?, 
 			    tecnico_presa_in_carico_id = ?, data_presa_in_carico = CURRENT_TIMESTAMP,
@@ -247,7 +255,7 @@ func ModificaGuasto(w http.ResponseWriter, r *http.Request) {
 			tecID, _ = strconv.ParseInt(tecnicoRisoluzioneID, 10, 64)
 		}
 
-		database.DB.Exec(`
+		modificaConAudit(r, "guasti_nave", guastoID, `
 			UPDATE guasti_nave 
 			SET stato = ?, gravita = ?, descrizione_risoluzione = ?, 
 			    tecnico_risoluzione_id = ?, data_risoluzione = CURRENT_TIMESTAMP,
@@ -255,13 +263,17 @@ func ModificaGuasto(w http.ResponseWriter, r *http.Request) {
 			WHERE id = ?
 		`, stato, gravita, descrizioneRisoluzione, tecID, guastoID)
 	} else {
-		database.DB.Exec(`
+		modificaConAudit(r, "guasti_nave", guastoID, `
 			UPDATE guasti_nave 
 			SET stato = ?, gravita = ?, updated_at = CURRENT_TIMESTAMP
 			WHERE id = ?
 		`, stato, gravita, guastoID)
 	}
 
+	if livelliGravita[gravita] > livelliGravita[gravitaPrecedente] {
+		go notificaGuasto(guastoID, eventoGuastoEscalation, gravitaPrecedente)
+	}
+
 	http.Redirect(w, r, fmt.Sprintf("/guasti-nave/%d", naveID), http.StatusSeeOther)
 }
 
@@ -276,7 +288,7 @@ func EliminaGuasto(w http.ResponseWriter, r *http.Request) {
 	var naveID int64
 	database.DB.QueryRow("SELECT nave_id FROM guasti_nave WHERE id = ?", guastoID).Scan(&naveID)
 
-	database.DB.Exec("DELETE FROM guasti_nave WHERE id = ?", guastoID)
+	eliminaConAudit(r, "guasti_nave", guastoID, "DELETE FROM guasti_nave WHERE id = ?", guastoID)
 
 	http.Redirect(w, r, fmt.Sprintf("/guasti-nave/%d", naveID), http.StatusSeeOther)
 }
@@ -312,7 +324,8 @@ func StoricoGuasti(w http.ResponseWriter, r *http.Request) {
 		       g.tecnico_risoluzione_id, 
 		       COALESCE(ur.nome || ' ' || ur.cognome, '') as tecnico_risoluzione,
 		       COALESCE(g.data_risoluzione, '') as data_risoluzione,
-		       COALESCE(g.descrizione_risoluzione, '') as descrizione_risoluzione
+		       COALESCE(g.descrizione_risoluzione, '') as descrizione_risoluzione,
+		       COALESCE(g.occorrenze, 0), COALESCE(g.ultimo_rilevamento, '')
 		FROM guasti_nave g
 		JOIN navi n ON g.nave_id = n.id
 		LEFT JOIN access_point ap ON g.ap_id = ap.id
@@ -322,8 +335,9 @@ func StoricoGuasti(w http.ResponseWriter, r *http.Request) {
 		WHERE g.stato = 'risolto'
 		AND DATE(g.data_risoluzione) >= DATE(?)
 		AND DATE(g.data_risoluzione) <= DATE(?)
+		AND (? = 0 OR n.compagnia_id = ?)
 		ORDER BY g.data_risoluzione DESC
-	`, dataDa, dataA)
+	`, dataDa, dataA, data.Session.CompagniaID, data.Session.CompagniaID)
 	if err != nil {
 		http.Error(w, "Errore caricamento storico", http.StatusInternalServerError)
 		return
@@ -340,10 +354,15 @@ func StoricoGuasti(w http.ResponseWriter, r *http.Request) {
 			&g.DataApertura, &tecPresaInCaricoID, &g.TecnicoPresaInCaricoNome,
 			&g.DataPresaInCarico, &g.NotaPresaInCarico,
 			&tecRisoluzioneID, &g.TecnicoRisoluzioneNome,
-			&g.DataRisoluzione, &g.DescrizioneRisoluzione)
+			&g.DataRisoluzione, &g.DescrizioneRisoluzione,
+			&g.Occorrenze, &g.UltimoRilevamento)
 		if apID.Valid {
 			g.APID = &apID.Int64
 		}
+		if c, ok := condizioniGuasto[g.Tipo]; ok {
+			g.Automatico = true
+			g.NomeCondizione = c.Nome
+		}
 		guasti = append(guasti, g)
 	}
 
@@ -375,7 +394,8 @@ func getGuastiNave(naveID int64, includiRisolti bool) []GuastoNave {
 		       g.tecnico_risoluzione_id, 
 		       COALESCE(ur.nome || ' ' || ur.cognome, '') as tecnico_risoluzione,
 		       COALESCE(g.data_risoluzione, '') as data_risoluzione,
-		       COALESCE(g.descrizione_risoluzione, '') as descrizione_risoluzione
+		       COALESCE(g.descrizione_risoluzione, '') as descrizione_risoluzione,
+		       COALESCE(g.occorrenze, 0), COALESCE(g.ultimo_rilevamento, '')
 		FROM guasti_nave g
 		JOIN navi n ON g.nave_id = n.id
 		LEFT JOIN access_point ap ON g.ap_id = ap.id
@@ -404,10 +424,15 @@ func getGuastiNave(naveID int64, includiRisolti bool) []GuastoNave {
 			&g.DataApertura, &tecPresaInCaricoID, &g.TecnicoPresaInCaricoNome,
 			&g.DataPresaInCarico, &g.NotaPresaInCarico,
 			&tecRisoluzioneID, &g.TecnicoRisoluzioneNome,
-			&g.DataRisoluzione, &g.DescrizioneRisoluzione)
+			&g.DataRisoluzione, &g.DescrizioneRisoluzione,
+			&g.Occorrenze, &g.UltimoRilevamento)
 		if apID.Valid {
 			g.APID = &apID.Int64
 		}
+		if c, ok := condizioniGuasto[g.Tipo]; ok {
+			g.Automatico = true
+			g.NomeCondizione = c.Nome
+		}
 		guasti = append(guasti, g)
 	}
 	return guasti
@@ -429,34 +454,6 @@ func getTecniciSelect() []TecnicoSelect {
 	return tecnici
 }
 
-// CreaGuastoAPFault crea automaticamente un guasto per un AP in fault
-func CreaGuastoAPFault(naveID int64, apID int64, apNome string) {
-	// Verifica se esiste già un guasto aperto per questo AP
-	var existingID int64
-	err := database.DB.QueryRow(`
-		SELECT id FROM guasti_nave 
-		WHERE nave_id = ? AND ap_id = ? AND tipo = 'ap_fault' AND stato != 'risolto'
-	`, naveID, apID).Scan(&existingID)
-
-	if err == sql.ErrNoRows {
-		// Non esiste, crea nuovo guasto
-		database.DB.Exec(`
-			INSERT INTO guasti_nave (nave_id, tipo, ap_id, gravita, descrizione, stato)
-			VALUES (?, 'ap_fault', ?, 'alta', ?, 'aperto')
-		`, naveID, apID, fmt.Sprintf("AP %s in stato FAULT - rilevato automaticamente", apNome))
-	}
-}
-
-// ChiudiGuastoAPFault chiude automaticamente un guasto AP quando torna online
-func ChiudiGuastoAPFault(naveID int64, apID int64) {
-	database.DB.Exec(`
-		UPDATE guasti_nave
-		SET stato = 'risolto', data_risoluzione = CURRENT_TIMESTAMP,
-		    descrizione_risoluzione = 'AP tornato online - chiuso automaticamente'
-		WHERE nave_id = ? AND ap_id = ? AND tipo = 'ap_fault' AND stato != 'risolto'
-	`, naveID, apID)
-}
-
 // getAPFaults restituisce gli AP in stato fault o offline per una nave
 func getAPFaults(naveID int64) []APFaultInfo {
 	var apFaults []APFaultInfo
@@ -9,7 +9,9 @@ import (
 	"strings"
 	"time"
 
+	"furviogest/internal/auth"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
 	"furviogest/internal/middleware"
 	"furviogest/internal/models"
 )
@@ -26,7 +28,7 @@ func ImpostazioniAziendaHandler(w http.ResponseWriter, r *http.Request) {
 // ImpostazioniAzienda mostra il form delle impostazioni azienda
 func ImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutImpostazioni) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -60,7 +62,7 @@ func ImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 // SalvaImpostazioniAzienda salva le impostazioni azienda
 func SalvaImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutImpostazioni) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -104,8 +106,15 @@ func SalvaImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Password SMTP cifrata; se il campo e vuoto resta quella salvata
+	smtpPassword, err := segreti.Cifra(r.FormValue("smtp_password"))
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Aggiorna i dati nel database
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "impostazioni_azienda", 1, `
 		UPDATE impostazioni_azienda SET
 			ragione_sociale = ?,
 			partita_iva = ?,
@@ -128,10 +137,11 @@ func SalvaImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 			smtp_server = ?,
 			smtp_port = ?,
 			smtp_user = ?,
-			smtp_password = ?,
+			smtp_password = CASE WHEN ? = '' THEN smtp_password ELSE ? END,
 			smtp_from_name = ?,
 			email_foglio_trasferte = ?,
 			email_nota_spese = ?,
+			totp_obbligatorio_tecnici = ?,
 			updated_at = ?
 		WHERE id = 1
 	`,
@@ -156,10 +166,11 @@ func SalvaImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 		r.FormValue("smtp_server"),
 		func() int { p, _ := strconv.Atoi(r.FormValue("smtp_port")); if p == 0 { return 587 }; return p }(),
 		r.FormValue("smtp_user"),
-		r.FormValue("smtp_password"),
+		smtpPassword, smtpPassword,
 		r.FormValue("smtp_from_name"),
 		r.FormValue("email_foglio_trasferte"),
 		r.FormValue("email_nota_spese"),
+		r.FormValue("totp_obbligatorio_tecnici") == "1",
 		time.Now(),
 	)
 
@@ -174,7 +185,7 @@ func SalvaImpostazioniAzienda(w http.ResponseWriter, r *http.Request) {
 // EliminaLogo rimuove il logo aziendale
 func EliminaLogo(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutImpostazioni) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -182,7 +193,7 @@ func EliminaLogo(w http.ResponseWriter, r *http.Request) {
 	impostazioni, _ := getImpostazioniAzienda()
 	if impostazioni.LogoPath != "" {
 		os.Remove(impostazioni.LogoPath)
-		database.DB.Exec("UPDATE impostazioni_azienda SET logo_path = '', updated_at = ? WHERE id = 1", time.Now())
+		modificaConAudit(r, "impostazioni_azienda", 1, "UPDATE impostazioni_azienda SET logo_path = '', updated_at = ? WHERE id = 1", time.Now())
 	}
 
 	http.Redirect(w, r, "/impostazioni", http.StatusSeeOther)
@@ -191,7 +202,7 @@ func EliminaLogo(w http.ResponseWriter, r *http.Request) {
 // EliminaFirmaEmail rimuove l'immagine firma email
 func EliminaFirmaEmail(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
-	if session == nil || !session.IsTecnico() {
+	if session == nil || !session.Puo(auth.AutImpostazioni) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -199,7 +210,7 @@ func EliminaFirmaEmail(w http.ResponseWriter, r *http.Request) {
 	impostazioni, _ := getImpostazioniAzienda()
 	if impostazioni.FirmaEmailPath != "" {
 		os.Remove(impostazioni.FirmaEmailPath)
-		database.DB.Exec("UPDATE impostazioni_azienda SET firma_email_path = '', updated_at = ? WHERE id = 1", time.Now())
+		modificaConAudit(r, "impostazioni_azienda", 1, "UPDATE impostazioni_azienda SET firma_email_path = '', updated_at = ? WHERE id = 1", time.Now())
 	}
 
 	http.Redirect(w, r, "/impostazioni", http.StatusSeeOther)
@@ -235,7 +246,8 @@ func getImpostazioniAzienda() (*models.ImpostazioniAzienda, error) {
 			iban, banca, codice_sdi, note,
 			COALESCE(smtp_server, '') as smtp_server, COALESCE(smtp_port, 587) as smtp_port,
 			COALESCE(smtp_user, '') as smtp_user, COALESCE(smtp_password, '') as smtp_password,
-			COALESCE(smtp_from_name, '') as smtp_from_name, COALESCE(email_foglio_trasferte, '') as email_foglio_trasferte, COALESCE(email_nota_spese, '') as email_nota_spese, updated_at
+			COALESCE(smtp_from_name, '') as smtp_from_name, COALESCE(email_foglio_trasferte, '') as email_foglio_trasferte, COALESCE(email_nota_spese, '') as email_nota_spese,
+			COALESCE(totp_obbligatorio_tecnici, 0) as totp_obbligatorio_tecnici, updated_at
 		FROM impostazioni_azienda WHERE id = 1
 	`).Scan(
 		&imp.ID, &imp.RagioneSociale, &imp.PartitaIVA, &imp.CodiceFiscale, &imp.Indirizzo,
@@ -243,7 +255,8 @@ func getImpostazioniAzienda() (*models.ImpostazioniAzienda, error) {
 		&imp.LogoPath, &imp.FirmaEmailPath, &imp.FirmaEmailTesto,
 		&imp.IBAN, &imp.Banca, &imp.CodiceSDI, &imp.Note,
 		&imp.SMTPServer, &imp.SMTPPort, &imp.SMTPUser, &imp.SMTPPassword,
-		&imp.SMTPFromName, &imp.EmailFoglioTrasferte, &imp.EmailNotaSpese, &imp.UpdatedAt,
+		&imp.SMTPFromName, &imp.EmailFoglioTrasferte, &imp.EmailNotaSpese,
+		&imp.TOTPObbligatorioTecnici, &imp.UpdatedAt,
 	)
 	if err != nil {
 		return &models.ImpostazioniAzienda{}, err
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"database/sql"
 	"encoding/json"
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
+	"furviogest/internal/magazzino"
+	"furviogest/internal/middleware"
 	"furviogest/internal/models"
 	"net/http"
 	"strconv"
@@ -139,10 +142,10 @@ func ListaProdotti(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "prodotti_lista.html", data)
 }
 
-// caricaNavi recupera tutte le navi per select
-func caricaNaviMagazzino() []NaveSelect {
+// caricaNaviMagazzino recupera le navi per select, solo della compagnia se diversa da 0
+func caricaNaviMagazzino(compagniaID int64) []NaveSelect {
 	var navi []NaveSelect
-	rows, err := database.DB.Query("SELECT id, nome FROM navi ORDER BY nome")
+	rows, err := database.DB.Query("SELECT id, nome FROM navi WHERE ? = 0 OR compagnia_id = ? ORDER BY nome", compagniaID, compagniaID)
 	if err != nil {
 		return navi
 	}
@@ -197,7 +200,7 @@ func NuovoProdotto(w http.ResponseWriter, r *http.Request) {
 	formData := ProdottoFormData{
 		Fornitori:  caricaFornitoriConAmazon(),
 		DDTFatture: caricaDDTFatture(),
-		Navi:       caricaNaviMagazzino(),
+		Navi:       caricaNaviMagazzino(data.Session.CompagniaID),
 	}
 
 	if r.Method == http.MethodGet {
@@ -290,18 +293,11 @@ func NuovoProdotto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Inserisci prodotto
-	var giacenzaIniziale int
-	if origine == "spare" {
-		giacenzaIniziale = quantita // Per spare la giacenza è diretta
-	} else {
-		giacenzaIniziale = quantita // Verrà anche registrata nel movimento
-	}
-
+	// Inserisci prodotto: la giacenza arriva dal movimento di carico
 	result, err := tx.Exec(`
 		INSERT INTO prodotti (codice, nome, descrizione, categoria, tipo, origine, nave_origine, giacenza, unita_misura, note)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, codice, nome, descrizione, categoria, tipo, origine, naveOrigine, giacenzaIniziale, unitaMisura, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?)
+	`, codice, nome, descrizione, categoria, tipo, origine, naveOrigine, unitaMisura, note)
 
 	if err != nil {
 		tx.Rollback()
@@ -316,10 +312,12 @@ func NuovoProdotto(w http.ResponseWriter, r *http.Request) {
 	}
 
 	prodottoID, _ := result.LastInsertId()
+	traccia := audit.Nuova(r, tx)
+	traccia.Crea("prodotti", prodottoID)
 
 	// Per prodotti nuovi, crea movimento acquisto
 	if origine == "nuovo" && ddtFatturaID > 0 {
-		_, err = tx.Exec(`
+		_, err = traccia.Inserisci("movimenti_acquisto", `
 			INSERT INTO movimenti_acquisto (prodotto_id, ddt_fattura_id, quantita)
 			VALUES (?, ?, ?)
 		`, prodottoID, ddtFatturaID, quantita)
@@ -332,6 +330,38 @@ func NuovoProdotto(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Carico iniziale: acquisto per i prodotti nuovi, giacenza diretta per gli spare
+	carico := magazzino.Movimento{
+		ProdottoID: prodottoID,
+		Quantita:   float64(quantita),
+		Causale:    magazzino.CausaleGiacenzaIniziale,
+		UtenteID:   utenteMovimento(r),
+		Motivo:     "Spare",
+	}
+	if naveOrigine != "" {
+		carico.Motivo = "Spare da " + naveOrigine
+	}
+	if origine == "nuovo" {
+		carico.Causale = magazzino.CausaleAcquisto
+		carico.DocumentoTipo = magazzino.DocumentoDDTFattura
+		carico.DocumentoID = ddtFatturaID
+		carico.Motivo = documentoAcquisto(tx, ddtFatturaID)
+	}
+	if err := magazzino.Registra(tx, carico); err != nil {
+		tx.Rollback()
+		data.Error = "Errore aggiornamento giacenza: " + err.Error()
+		data.Data = map[string]interface{}{"FormData": formData}
+		renderTemplate(w, "prodotti_form.html", data)
+		return
+	}
+	if err := traccia.Concludi(); err != nil {
+		tx.Rollback()
+		data.Error = "Errore durante il salvataggio: " + err.Error()
+		data.Data = map[string]interface{}{"FormData": formData}
+		renderTemplate(w, "prodotti_form.html", data)
+		return
+	}
+
 	tx.Commit()
 	http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
 }
@@ -355,7 +385,7 @@ func ModificaProdotto(w http.ResponseWriter, r *http.Request) {
 	formData := ProdottoFormData{
 		Fornitori:  caricaFornitoriConAmazon(),
 		DDTFatture: caricaDDTFatture(),
-		Navi:       caricaNaviMagazzino(),
+		Navi:       caricaNaviMagazzino(data.Session.CompagniaID),
 	}
 
 	if r.Method == http.MethodGet {
@@ -423,7 +453,7 @@ func ModificaProdotto(w http.ResponseWriter, r *http.Request) {
 		unitaMisura = "m"
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "prodotti", id, `
 		UPDATE prodotti SET codice = ?, nome = ?, descrizione = ?, categoria = ?, tipo = ?,
 		       nave_origine = ?, unita_misura = ?, note = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
@@ -450,11 +480,19 @@ func EliminaProdotto(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
 	
 	tx, _ := database.DB.Begin()
+	defer tx.Rollback()
+	traccia := audit.Nuova(r, tx)
+	if err := traccia.Elimina("prodotti", id); err != nil {
+		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
+		return
+	}
 	// Elimina prima i movimenti collegati
 	tx.Exec("DELETE FROM movimenti_acquisto WHERE prodotto_id = ?", id)
 	// Poi elimina il prodotto
 	tx.Exec("DELETE FROM prodotti WHERE id = ?", id)
-	tx.Commit()
+	if traccia.Concludi() == nil {
+		tx.Commit()
+	}
 	
 	http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
 }
@@ -512,9 +550,10 @@ func AggiungiMovimentoAcquisto(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tx, _ := database.DB.Begin()
+	traccia := audit.Nuova(r, tx)
 
 	// Inserisci movimento
-	_, err := tx.Exec(`
+	_, err := traccia.Inserisci("movimenti_acquisto", `
 		INSERT INTO movimenti_acquisto (prodotto_id, ddt_fattura_id, quantita, note)
 		VALUES (?, ?, ?, ?)
 	`, prodottoID, ddtFatturaID, quantita, note)
@@ -525,7 +564,23 @@ func AggiungiMovimentoAcquisto(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Aggiorna giacenza
-	tx.Exec(`UPDATE prodotti SET giacenza = giacenza + ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, quantita, prodottoID)
+	err = magazzino.Registra(tx, magazzino.Movimento{
+		ProdottoID:    prodottoID,
+		Quantita:      float64(quantita),
+		Causale:       magazzino.CausaleAcquisto,
+		DocumentoTipo: magazzino.DocumentoDDTFattura,
+		DocumentoID:   ddtFatturaID,
+		UtenteID:      utenteMovimento(r),
+		Motivo:        documentoAcquisto(tx, ddtFatturaID),
+	})
+	if err == nil {
+		err = traccia.Concludi()
+	}
+	if err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/magazzino/modifica/"+prodottoIDStr, http.StatusSeeOther)
+		return
+	}
 
 	tx.Commit()
 	http.Redirect(w, r, "/magazzino/modifica/"+prodottoIDStr, http.StatusSeeOther)
@@ -542,21 +597,44 @@ func EliminaMovimentoAcquisto(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.ParseInt(pathParts[4], 10, 64)
 
 	// Recupera info movimento
-	var prodottoID int64
+	var prodottoID, ddtFatturaID int64
 	var quantita int
-	err := database.DB.QueryRow(`SELECT prodotto_id, quantita FROM movimenti_acquisto WHERE id = ?`, id).Scan(&prodottoID, &quantita)
+	err := database.DB.QueryRow(`SELECT prodotto_id, ddt_fattura_id, quantita FROM movimenti_acquisto WHERE id = ?`, id).
+		Scan(&prodottoID, &ddtFatturaID, &quantita)
 	if err != nil {
 		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
 		return
 	}
 
 	tx, _ := database.DB.Begin()
+	traccia := audit.Nuova(r, tx)
+	if err := traccia.Elimina("movimenti_acquisto", id); err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/magazzino/modifica/"+strconv.FormatInt(prodottoID, 10), http.StatusSeeOther)
+		return
+	}
 
 	// Elimina movimento
 	tx.Exec(`DELETE FROM movimenti_acquisto WHERE id = ?`, id)
 
 	// Sottrai dalla giacenza
-	tx.Exec(`UPDATE prodotti SET giacenza = giacenza - ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, quantita, prodottoID)
+	err = magazzino.Registra(tx, magazzino.Movimento{
+		ProdottoID:    prodottoID,
+		Quantita:      -float64(quantita),
+		Causale:       magazzino.CausaleStornoAcquisto,
+		DocumentoTipo: magazzino.DocumentoDDTFattura,
+		DocumentoID:   ddtFatturaID,
+		UtenteID:      utenteMovimento(r),
+		Motivo:        "Storno " + documentoAcquisto(tx, ddtFatturaID),
+	})
+	if err == nil {
+		err = traccia.Concludi()
+	}
+	if err != nil {
+		tx.Rollback()
+		http.Redirect(w, r, "/magazzino/modifica/"+strconv.FormatInt(prodottoID, 10), http.StatusSeeOther)
+		return
+	}
 
 	tx.Commit()
 	http.Redirect(w, r, "/magazzino/modifica/"+strconv.FormatInt(prodottoID, 10), http.StatusSeeOther)
@@ -607,41 +685,101 @@ func APIDettaglioProdotto(w http.ResponseWriter, r *http.Request) {
 }
 
 // ============================================
-// VECCHIE FUNZIONI (mantenute per compatibilità DDT uscita)
+// REGISTRO MOVIMENTI
 // ============================================
 
-// ListaMovimenti mostra lo storico movimenti di un prodotto (vecchio sistema)
-func ListaMovimenti(w http.ResponseWriter, r *http.Request) {
-	data := NewPageData("Movimenti Magazzino - FurvioGest", r)
-
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 5 {
-		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
-		return
+// utenteMovimento restituisce l'utente a cui attribuire i movimenti di magazzino
+func utenteMovimento(r *http.Request) int64 {
+	if session := middleware.GetSession(r); session != nil {
+		return session.UserID
 	}
+	return 0
+}
 
-	prodottoID, err := strconv.ParseInt(pathParts[3], 10, 64)
+// documentoAcquisto descrive il DDT/fattura di acquisto nel motivo dei movimenti
+func documentoAcquisto(tx *sql.Tx, ddtFatturaID int64) string {
+	var tipo, numero string
+	tx.QueryRow(`SELECT tipo, numero FROM ddt_fatture WHERE id = ?`, ddtFatturaID).Scan(&tipo, &numero)
+	switch tipo {
+	case "fattura":
+		return "Fattura n. " + numero
+	case "ordine":
+		return "Ordine n. " + numero
+	}
+	return "DDT n. " + numero
+}
+
+// stornaAcquistiDDTFattura scarica dal magazzino gli acquisti del documento e restituisce
+// i prodotti coinvolti. Non elimina i movimenti_acquisto.
+func stornaAcquistiDDTFattura(tx *sql.Tx, ddtFatturaID, utenteID int64) ([]int64, error) {
+	rows, err := tx.Query(`SELECT prodotto_id, quantita FROM movimenti_acquisto WHERE ddt_fattura_id = ?`, ddtFatturaID)
 	if err != nil {
-		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
-		return
+		return nil, err
 	}
+	motivo := "Storno " + documentoAcquisto(tx, ddtFatturaID)
+	var movimenti []magazzino.Movimento
+	for rows.Next() {
+		m := magazzino.Movimento{
+			Causale:       magazzino.CausaleStornoAcquisto,
+			DocumentoTipo: magazzino.DocumentoDDTFattura,
+			DocumentoID:   ddtFatturaID,
+			UtenteID:      utenteID,
+			Motivo:        motivo,
+		}
+		if err := rows.Scan(&m.ProdottoID, &m.Quantita); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.Quantita = -m.Quantita
+		movimenti = append(movimenti, m)
+	}
+	rows.Close()
 
-	// Recupera info prodotto
+	var prodotti []int64
+	for _, m := range movimenti {
+		if err := magazzino.Registra(tx, m); err != nil {
+			return nil, err
+		}
+		prodotti = append(prodotti, m.ProdottoID)
+	}
+	return prodotti, nil
+}
+
+// caricaProdottoMovimenti recupera il prodotto dal percorso /magazzino/<azione>/<id>
+func caricaProdottoMovimenti(r *http.Request) (models.Prodotto, error) {
 	var prodotto models.Prodotto
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		return prodotto, sql.ErrNoRows
+	}
+	prodottoID, err := strconv.ParseInt(pathParts[3], 10, 64)
+	if err != nil {
+		return prodotto, err
+	}
 	err = database.DB.QueryRow(`
 		SELECT id, codice, nome, categoria, giacenza, unita_misura FROM prodotti WHERE id = ?
 	`, prodottoID).Scan(&prodotto.ID, &prodotto.Codice, &prodotto.Nome, &prodotto.Categoria, &prodotto.Giacenza, &prodotto.UnitaMisura)
+	return prodotto, err
+}
+
+// ListaMovimenti mostra il registro dei movimenti di un prodotto
+func ListaMovimenti(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Movimenti Magazzino - FurvioGest", r)
+
+	prodotto, err := caricaProdottoMovimenti(r)
 	if err != nil {
 		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
 		return
 	}
 
-	// Carica movimenti acquisto
-	movimenti := caricaMovimentiAcquisto(prodottoID)
+	movimenti, err := magazzino.Movimenti(prodotto.ID)
+	if err != nil {
+		data.Error = "Errore nel caricamento dei movimenti: " + err.Error()
+	}
 
 	type MovimentiData struct {
 		Prodotto  models.Prodotto
-		Movimenti []MovimentoAcquisto
+		Movimenti []models.MovimentoMagazzino
 	}
 
 	data.Data = MovimentiData{
@@ -651,7 +789,89 @@ func ListaMovimenti(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "movimenti_lista.html", data)
 }
 
-// NuovoMovimento - placeholder per compatibilità
+// NuovoMovimento registra una rettifica manuale di giacenza (es. dopo un inventario)
 func NuovoMovimento(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
+	data := NewPageData("Nuovo Movimento - FurvioGest", r)
+
+	prodotto, err := caricaProdottoMovimenti(r)
+	if err != nil {
+		http.Redirect(w, r, "/magazzino", http.StatusSeeOther)
+		return
+	}
+	data.Data = map[string]interface{}{"Prodotto": prodotto}
+
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "movimenti_form.html", data)
+		return
+	}
+
+	tipo := r.FormValue("tipo")
+	quantita, _ := strconv.ParseFloat(strings.Replace(r.FormValue("quantita"), ",", ".", 1), 64)
+	motivo := strings.TrimSpace(r.FormValue("motivo"))
+
+	switch {
+	case tipo != magazzino.Carico && tipo != magazzino.Scarico:
+		data.Error = "Seleziona il tipo di movimento"
+	case quantita <= 0:
+		data.Error = "La quantita deve essere maggiore di 0"
+	case tipo == magazzino.Scarico && quantita > prodotto.Giacenza:
+		data.Error = "Quantita superiore alla giacenza disponibile"
+	case motivo == "":
+		data.Error = "Indica il motivo della rettifica"
+	}
+	if data.Error != "" {
+		renderTemplate(w, "movimenti_form.html", data)
+		return
+	}
+	if tipo == magazzino.Scarico {
+		quantita = -quantita
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		data.Error = "Errore database"
+		renderTemplate(w, "movimenti_form.html", data)
+		return
+	}
+	traccia := audit.Nuova(r, tx)
+	err = traccia.Modifica("prodotti", prodotto.ID)
+	if err == nil {
+		err = magazzino.Registra(tx, magazzino.Movimento{
+			ProdottoID: prodotto.ID,
+			Quantita:   quantita,
+			Causale:    magazzino.CausaleRettifica,
+			UtenteID:   utenteMovimento(r),
+			Motivo:     motivo,
+		})
+	}
+	if err == nil {
+		err = traccia.Concludi()
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		data.Error = "Errore registrazione movimento: " + err.Error()
+		renderTemplate(w, "movimenti_form.html", data)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/magazzino/movimenti/%d", prodotto.ID), http.StatusSeeOther)
+}
+
+// RiconciliazioneMagazzino elenca i prodotti la cui giacenza non coincide con il registro
+// dei movimenti (variazioni scritte fuori da internal/magazzino)
+func RiconciliazioneMagazzino(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Riconciliazione Magazzino - FurvioGest", r)
+
+	discrepanze, err := magazzino.Riconcilia()
+	if err != nil {
+		data.Error = "Errore durante la riconciliazione: " + err.Error()
+	}
+	data.Data = map[string]interface{}{
+		"Discrepanze": discrepanze,
+	}
+	renderTemplate(w, "magazzino_riconciliazione.html", data)
 }
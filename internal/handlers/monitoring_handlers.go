@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/netdevice"
+	"furviogest/internal/snmp"
+)
+
+// ============================================
+// POOL ESECUZIONE MONITORAGGIO
+// ============================================
+
+// attivitaApparato rappresenta un'operazione di monitoraggio su un singolo apparato
+type attivitaApparato struct {
+	Sito         string // nome di nave, ufficio o sala server
+	NaveID       int64
+	UfficioID    int64
+	SalaServerID int64
+	TipoApparato string
+	ApparatoID   int64
+	Nome         string
+	IP           string
+	esegui       func(ctx context.Context) error
+}
+
+// chiaveSito identifica la nave, l'ufficio o la sala server dell'apparato
+func (a *attivitaApparato) chiaveSito() string {
+	return fmt.Sprintf("%d/%d/%d", a.NaveID, a.UfficioID, a.SalaServerID)
+}
+
+// configMonitoraggio contiene i limiti del pool di monitoraggio
+type configMonitoraggio struct {
+	ConcorrenzaGlobale int
+	ConcorrenzaNave    int
+	TimeoutApparato    time.Duration
+	GiorniStorico      int // oltre, gli esiti in monitoring_run vengono eliminati
+}
+
+// getConfigMonitoraggio legge i limiti del pool, con valori predefiniti se assenti
+func getConfigMonitoraggio() configMonitoraggio {
+	c := configMonitoraggio{ConcorrenzaGlobale: 8, ConcorrenzaNave: 2, TimeoutApparato: 10 * time.Minute, GiorniStorico: 30}
+
+	var globale, nave, timeout, giorni int
+	err := database.DB.QueryRow("SELECT concorrenza_globale, concorrenza_nave, timeout_apparato, giorni_storico FROM monitoring_config WHERE id = 1").
+		Scan(&globale, &nave, &timeout, &giorni)
+	if err != nil {
+		return c
+	}
+	if globale > 0 {
+		c.ConcorrenzaGlobale = globale
+	}
+	if nave > 0 {
+		c.ConcorrenzaNave = nave
+	}
+	if timeout > 0 {
+		c.TimeoutApparato = time.Duration(timeout) * time.Second
+	}
+	if giorni > 0 {
+		c.GiorniStorico = giorni
+	}
+	return c
+}
+
+// rapportoRun riassume una esecuzione del pool
+type rapportoRun struct {
+	RunID  string
+	Totale int
+	Errori []string
+}
+
+// esito restituisce esito e messaggio da registrare nella pianificazione
+func (r rapportoRun) esito() (string, string) {
+	switch {
+	case r.Totale == 0:
+		return "ok", "Nessun apparato da elaborare"
+	case len(r.Errori) == 0:
+		return "ok", fmt.Sprintf("Run %s: %d apparati elaborati", r.RunID, r.Totale)
+	case len(r.Errori) == r.Totale:
+		return "errore", fmt.Sprintf("Run %s: tutti i %d apparati in errore\n%s", r.RunID, r.Totale, strings.Join(r.Errori, "\n"))
+	default:
+		return "parziale", fmt.Sprintf("Run %s: %d/%d apparati in errore\n%s", r.RunID, len(r.Errori), r.Totale, strings.Join(r.Errori, "\n"))
+	}
+}
+
+// poolMonitoraggio contiene i semafori condivisi da tutte le esecuzioni: job avviati
+// insieme (scheduler, override per nave, polling manuale) rispettano gli stessi limiti
+var poolMonitoraggio struct {
+	mu         sync.Mutex
+	globale    chan struct{}
+	perSito    map[string]chan struct{}
+	limiteSito int
+}
+
+// semaforiPool restituisce il semaforo globale e quello del sito, ricreandoli se i limiti
+// configurati sono cambiati. Le attivita gia avviate rilasciano i semafori precedenti.
+func semaforiPool(cfg configMonitoraggio, sito string) (chan struct{}, chan struct{}) {
+	poolMonitoraggio.mu.Lock()
+	defer poolMonitoraggio.mu.Unlock()
+
+	if cap(poolMonitoraggio.globale) != cfg.ConcorrenzaGlobale {
+		poolMonitoraggio.globale = make(chan struct{}, cfg.ConcorrenzaGlobale)
+	}
+	if poolMonitoraggio.perSito == nil || poolMonitoraggio.limiteSito != cfg.ConcorrenzaNave {
+		poolMonitoraggio.perSito = make(map[string]chan struct{})
+		poolMonitoraggio.limiteSito = cfg.ConcorrenzaNave
+	}
+	semaforo := poolMonitoraggio.perSito[sito]
+	if semaforo == nil {
+		semaforo = make(chan struct{}, cfg.ConcorrenzaNave)
+		poolMonitoraggio.perSito[sito] = semaforo
+	}
+	return poolMonitoraggio.globale, semaforo
+}
+
+// eseguiAttivita esegue le attivita in parallelo rispettando il limite globale
+// e quello per nave (o ufficio/sala server), condivisi con le altre esecuzioni in
+// corso; ogni apparato ha un proprio timeout e il suo esito viene registrato in monitoring_run
+func eseguiAttivita(job string, attivita []attivitaApparato) rapportoRun {
+	rapporto := rapportoRun{
+		RunID:  fmt.Sprintf("%s-%s", job, time.Now().Format("20060102-150405.000")),
+		Totale: len(attivita),
+	}
+	if len(attivita) == 0 {
+		return rapporto
+	}
+
+	cfg := getConfigMonitoraggio()
+	log.Printf("[Monitoring] Run %s: %d apparati (max %d in parallelo, %d per nave)",
+		rapporto.RunID, len(attivita), cfg.ConcorrenzaGlobale, cfg.ConcorrenzaNave)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, a := range attivita {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Prima il posto sulla nave, poi quello globale: una nave satura non occupa posti globali
+			globale, sito := semaforiPool(cfg, a.chiaveSito())
+			sito <- struct{}{}
+			defer func() { <-sito }()
+			globale <- struct{}{}
+			defer func() { <-globale }()
+
+			if err := eseguiAttivitaApparato(rapporto.RunID, job, &a, cfg.TimeoutApparato); err != nil {
+				mu.Lock()
+				rapporto.Errori = append(rapporto.Errori, fmt.Sprintf("%s - %s (%s): %v", a.Sito, a.Nome, a.IP, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(rapporto.Errori)
+	log.Printf("[Monitoring] Run %s completata: %d apparati, %d errori", rapporto.RunID, rapporto.Totale, len(rapporto.Errori))
+	return rapporto
+}
+
+// eseguiAttivitaApparato esegue l'operazione con timeout e ne registra l'esito
+func eseguiAttivitaApparato(runID, job string, a *attivitaApparato, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	inizio := time.Now()
+	defer func() {
+		// Un errore di parsing su un apparato non deve fermare il server
+		if p := recover(); p != nil {
+			err = fmt.Errorf("errore interno: %v", p)
+		}
+
+		esito := "ok"
+		var messaggio string
+		if err != nil {
+			esito = "errore"
+			if errors.Is(err, netdevice.ErrTimeout) || errors.Is(err, snmp.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				esito = "timeout"
+			}
+			messaggio = err.Error()
+		}
+		fine := time.Now()
+		database.DB.Exec(`
+			INSERT INTO monitoring_run (run_id, job, sito, nave_id, ufficio_id, sala_server_id, tipo_apparato, apparato_id,
+				nome_apparato, ip, esito, messaggio, inizio, fine, durata_ms)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, runID, job, a.Sito, nullID(a.NaveID), nullID(a.UfficioID), nullID(a.SalaServerID), a.TipoApparato, a.ApparatoID,
+			a.Nome, a.IP, esito, messaggio, inizio.UTC().Format("2006-01-02 15:04:05"), fine.UTC().Format("2006-01-02 15:04:05"),
+			fine.Sub(inizio).Milliseconds())
+
+		valutaEsitoMonitoraggio(job, a, err)
+	}()
+
+	return a.esegui(ctx)
+}
+
+// conservazionePollingOK e per quanto si conservano gli esiti positivi del polling SNMP:
+// il job gira ogni pochi minuti e il suo storico resta nelle serie SNMP
+const conservazionePollingOK = 24 * time.Hour
+
+// pulisciStoricoRun elimina da monitoring_run gli esiti oltre il periodo di conservazione
+func pulisciStoricoRun() {
+	ora := time.Now().UTC()
+	limite := ora.AddDate(0, 0, -getConfigMonitoraggio().GiorniStorico).Format("2006-01-02 15:04:05")
+	res, err := database.DB.Exec("DELETE FROM monitoring_run WHERE inizio < ?", limite)
+	if err != nil {
+		log.Printf("[Monitoring] Errore pulizia storico esecuzioni: %v", err)
+		return
+	}
+	eliminati, _ := res.RowsAffected()
+
+	limite = ora.Add(-conservazionePollingOK).Format("2006-01-02 15:04:05")
+	if res, err = database.DB.Exec("DELETE FROM monitoring_run WHERE job = 'snmp_poll' AND esito = 'ok' AND inizio < ?", limite); err == nil {
+		n, _ := res.RowsAffected()
+		eliminati += n
+	}
+	if eliminati > 0 {
+		log.Printf("[Monitoring] Storico esecuzioni: eliminati %d esiti", eliminati)
+	}
+}
+
+// nullID converte un ID a zero in NULL
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// ============================================
+// PAGINA ESECUZIONI MONITORAGGIO
+// ============================================
+
+// riepilogoRun rappresenta una esecuzione nella lista
+type riepilogoRun struct {
+	RunID   string
+	Job     string
+	Inizio  string
+	Durata  string
+	Totale  int
+	Errori  int
+	Timeout int
+}
+
+// esitoApparato rappresenta una riga di monitoring_run
+type esitoApparato struct {
+	Sito         string
+	TipoApparato string
+	Nome         string
+	IP           string
+	Esito        string
+	Messaggio    string
+	Inizio       string
+	Durata       string
+}
+
+// EsecuzioniMonitoraggio mostra le ultime esecuzioni del pool e il dettaglio per apparato
+func EsecuzioniMonitoraggio(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Esecuzioni Monitoraggio - FurvioGest", r)
+	runID := r.URL.Query().Get("run")
+	soloErrori := r.URL.Query().Get("errori") == "1"
+
+	var runs []riepilogoRun
+	rows, err := database.DB.Query(`
+		SELECT run_id, job, MIN(inizio), MAX(fine), COUNT(*),
+		       SUM(CASE WHEN esito = 'errore' THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN esito = 'timeout' THEN 1 ELSE 0 END)
+		FROM monitoring_run
+		GROUP BY run_id, job
+		ORDER BY MIN(inizio) DESC
+		LIMIT 50
+	`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var run riepilogoRun
+			var inizio, fine string
+			if err := rows.Scan(&run.RunID, &run.Job, &inizio, &fine, &run.Totale, &run.Errori, &run.Timeout); err != nil {
+				continue
+			}
+			ti, _ := time.Parse("2006-01-02 15:04:05", inizio)
+			tf, _ := time.Parse("2006-01-02 15:04:05", fine)
+			run.Inizio = ti.Local().Format("02/01/2006 15:04")
+			run.Durata = tf.Sub(ti).String()
+			runs = append(runs, run)
+		}
+	}
+
+	var dettaglio []esitoApparato
+	if runID != "" {
+		query := `
+			SELECT COALESCE(sito, ''), tipo_apparato, COALESCE(nome_apparato, ''), COALESCE(ip, ''), esito,
+			       COALESCE(messaggio, ''), inizio, COALESCE(durata_ms, 0)
+			FROM monitoring_run WHERE run_id = ?`
+		if soloErrori {
+			query += " AND esito <> 'ok'"
+		}
+		query += " ORDER BY esito = 'ok', sito, nome_apparato"
+
+		dRows, err := database.DB.Query(query, runID)
+		if err == nil {
+			defer dRows.Close()
+			for dRows.Next() {
+				var e esitoApparato
+				var inizio sql.NullTime
+				var durata int64
+				if err := dRows.Scan(&e.Sito, &e.TipoApparato, &e.Nome, &e.IP, &e.Esito, &e.Messaggio, &inizio, &durata); err != nil {
+					continue
+				}
+				if inizio.Valid {
+					e.Inizio = inizio.Time.Local().Format("15:04:05")
+				}
+				e.Durata = (time.Duration(durata) * time.Millisecond).Round(time.Second).String()
+				dettaglio = append(dettaglio, e)
+			}
+		}
+	}
+
+	data.Data = map[string]interface{}{
+		"Runs":       runs,
+		"RunID":      runID,
+		"SoloErrori": soloErrori,
+		"Dettaglio":  dettaglio,
+	}
+	renderTemplate(w, "monitoraggio_esecuzioni.html", data)
+}
@@ -55,8 +55,8 @@ func ListaNoteSpese(w http.ResponseWriter, r *http.Request) {
 
 	var args []interface{}
 
-	// Se non tecnico, mostra solo le proprie
-	if !session.IsTecnico() {
+	// Senza gestione trasferte, mostra solo le proprie
+	if !session.Puo(auth.AutTrasferteGestione) {
 		query += " AND n.tecnico_id = ?"
 		args = append(args, session.UserID)
 	} else if tecnicoFilter != "" {
@@ -127,7 +127,7 @@ func NuovaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 		metodoPagamento := r.FormValue("metodo_pagamento")
 		note := r.FormValue("note")
 
-		if !session.IsTecnico() {
+		if !session.Puo(auth.AutTrasferteGestione) {
 			tecnicoID = session.UserID
 		}
 
@@ -149,7 +149,7 @@ func NuovaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		_, err = database.DB.Exec(`
+		_, err = creaConAudit(r, "note_spese", `
 			INSERT INTO note_spese (tecnico_id, data, tipo_spesa, descrizione, importo, metodo_pagamento, ricevuta_path, note)
 			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		`, tecnicoID, data, tipoSpesa, descrizione, importo, metodoPagamento, ricevutaPath, note)
@@ -197,7 +197,7 @@ func ModificaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 		metodoPagamento := r.FormValue("metodo_pagamento")
 		note := r.FormValue("note")
 
-		if !session.IsTecnico() {
+		if !session.Puo(auth.AutTrasferteGestione) {
 			tecnicoID = session.UserID
 		}
 
@@ -220,7 +220,7 @@ func ModificaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if ricevutaPath != "" {
-			_, err = database.DB.Exec(`
+			err = modificaConAudit(r, "note_spese", id, `
 				UPDATE note_spese 
 				SET tecnico_id = ?, data = ?, tipo_spesa = ?, descrizione = ?, 
 				    importo = ?, metodo_pagamento = ?, ricevuta_path = ?, note = ?,
@@ -228,7 +228,7 @@ func ModificaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 				WHERE id = ?
 			`, tecnicoID, data, tipoSpesa, descrizione, importo, metodoPagamento, ricevutaPath, note, id)
 		} else {
-			_, err = database.DB.Exec(`
+			err = modificaConAudit(r, "note_spese", id, `
 				UPDATE note_spese 
 				SET tecnico_id = ?, data = ?, tipo_spesa = ?, descrizione = ?, 
 				    importo = ?, metodo_pagamento = ?, note = ?,
@@ -265,7 +265,7 @@ func EliminaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/note-spese/elimina/")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 
-	database.DB.Exec("UPDATE note_spese SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	eliminaConAudit(r, "note_spese", id, "UPDATE note_spese SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
 
 	http.Redirect(w, r, "/note-spese", http.StatusSeeOther)
 }
@@ -273,7 +273,7 @@ func EliminaNotaSpesa(w http.ResponseWriter, r *http.Request) {
 func getNotaSpesaFormData(notaID int64, session *auth.Session) map[string]interface{} {
 	data := make(map[string]interface{})
 
-	if session.IsTecnico() {
+	if session.Puo(auth.AutTrasferteGestione) {
 		tecnici, _ := getTecniciList()
 		data["Tecnici"] = tecnici
 	}
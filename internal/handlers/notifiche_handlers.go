@@ -0,0 +1,713 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/cron"
+	"furviogest/internal/database"
+	"furviogest/internal/email"
+	"furviogest/internal/segreti"
+)
+
+// ============================================
+// NOTIFICHE GUASTI
+// ============================================
+
+// Eventi che generano una notifica
+const (
+	eventoGuastoAperto     = "aperto"
+	eventoGuastoEscalation = "escalation"
+	eventoRiepilogo        = "riepilogo"
+	eventoTest             = "test"
+)
+
+// timeoutWebhook limita l'attesa della risposta di un webhook
+const timeoutWebhook = 10 * time.Second
+
+// regolaNotifica indica a chi inviare i guasti di un perimetro (compagnia, nave)
+// a partire da una gravita minima
+type regolaNotifica struct {
+	ID            int64
+	Nome          string
+	Canale        string // email o webhook
+	Destinazione  string // indirizzi email separati da virgola o URL del webhook
+	Segreto       string // chiave HMAC dei webhook
+	CompagniaID   int64  // 0 = tutte
+	CompagniaNome string
+	NaveID        int64 // 0 = tutte
+	NaveNome      string
+	GravitaMinima string
+	Attiva        bool
+}
+
+// guastoNotifica contiene i dati del guasto inviati nelle notifiche
+type guastoNotifica struct {
+	ID                int64     `json:"id"`
+	NaveID            int64     `json:"nave_id"`
+	Nave              string    `json:"nave"`
+	CompagniaID       int64     `json:"compagnia_id"`
+	Compagnia         string    `json:"compagnia"`
+	Tipo              string    `json:"tipo"`
+	Gravita           string    `json:"gravita"`
+	GravitaPrecedente string    `json:"gravita_precedente,omitempty"`
+	Descrizione       string    `json:"descrizione"`
+	Stato             string    `json:"stato"`
+	DataApertura      time.Time `json:"data_apertura"`
+}
+
+// TipoDescrizione restituisce il nome leggibile del tipo di guasto
+func (g guastoNotifica) TipoDescrizione() string {
+	if c, ok := condizioniGuasto[g.Tipo]; ok {
+		return c.Nome
+	}
+	if g.Tipo == "manuale" {
+		return "Segnalazione manuale"
+	}
+	return g.Tipo
+}
+
+// Apertura restituisce la data di apertura in ora locale
+func (g guastoNotifica) Apertura() string {
+	return g.DataApertura.Local().Format("02/01/2006 15:04")
+}
+
+// payloadWebhook e il corpo JSON inviato ai webhook
+type payloadWebhook struct {
+	Evento    string          `json:"evento"`
+	Timestamp time.Time       `json:"timestamp"`
+	Guasto    *guastoNotifica `json:"guasto,omitempty"`
+}
+
+// corrisponde verifica se la regola copre il guasto per l'evento indicato.
+// Un'escalation viene notificata solo quando supera per la prima volta la gravita minima.
+func (r *regolaNotifica) corrisponde(g *guastoNotifica, evento string) bool {
+	if !r.Attiva {
+		return false
+	}
+	if r.CompagniaID > 0 && r.CompagniaID != g.CompagniaID {
+		return false
+	}
+	if r.NaveID > 0 && r.NaveID != g.NaveID {
+		return false
+	}
+	minima := livelliGravita[r.GravitaMinima]
+	if livelliGravita[g.Gravita] < minima {
+		return false
+	}
+	if evento == eventoGuastoEscalation && livelliGravita[g.GravitaPrecedente] >= minima {
+		return false
+	}
+	return true
+}
+
+// destinatariEmail restituisce gli indirizzi della regola
+func (r *regolaNotifica) destinatariEmail() []string {
+	var indirizzi []string
+	for _, s := range strings.Split(r.Destinazione, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			indirizzi = append(indirizzi, s)
+		}
+	}
+	return indirizzi
+}
+
+// caricaRegoleNotifica legge le regole di notifica configurate
+func caricaRegoleNotifica() []regolaNotifica {
+	rows, err := database.DB.Query(`
+		SELECT r.id, r.nome, r.canale, r.destinazione, COALESCE(r.segreto, ''),
+		       COALESCE(r.compagnia_id, 0), COALESCE(c.nome, ''), COALESCE(r.nave_id, 0), COALESCE(n.nome, ''),
+		       r.gravita_minima, r.attiva
+		FROM notifiche_regole r
+		LEFT JOIN compagnie c ON r.compagnia_id = c.id
+		LEFT JOIN navi n ON r.nave_id = n.id
+		ORDER BY r.nome, r.id
+	`)
+	if err != nil {
+		log.Printf("[Notifiche] Errore lettura regole: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var regole []regolaNotifica
+	for rows.Next() {
+		var r regolaNotifica
+		rows.Scan(&r.ID, &r.Nome, &r.Canale, &r.Destinazione, &r.Segreto,
+			&r.CompagniaID, &r.CompagniaNome, &r.NaveID, &r.NaveNome, &r.GravitaMinima, &r.Attiva)
+		regole = append(regole, r)
+	}
+	return regole
+}
+
+// caricaGuastoNotifica legge un guasto con nave e compagnia
+func caricaGuastoNotifica(guastoID int64) (*guastoNotifica, error) {
+	g := &guastoNotifica{ID: guastoID}
+	err := database.DB.QueryRow(`
+		SELECT g.nave_id, n.nome, COALESCE(n.compagnia_id, 0), COALESCE(c.nome, ''),
+		       g.tipo, g.gravita, g.descrizione, g.stato, g.data_apertura
+		FROM guasti_nave g
+		JOIN navi n ON g.nave_id = n.id
+		LEFT JOIN compagnie c ON n.compagnia_id = c.id
+		WHERE g.id = ?
+	`, guastoID).Scan(&g.NaveID, &g.Nave, &g.CompagniaID, &g.Compagnia,
+		&g.Tipo, &g.Gravita, &g.Descrizione, &g.Stato, &g.DataApertura)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// notificaGuasto invia il guasto alle regole che lo coprono. Va chiamata in una
+// goroutine: SMTP e webhook lenti non devono bloccare la richiesta o il monitoraggio.
+func notificaGuasto(guastoID int64, evento, gravitaPrecedente string) {
+	g, err := caricaGuastoNotifica(guastoID)
+	if err != nil {
+		log.Printf("[Notifiche] Guasto %d non trovato: %v", guastoID, err)
+		return
+	}
+	if g.Stato == "risolto" {
+		return
+	}
+	g.GravitaPrecedente = gravitaPrecedente
+
+	for _, regola := range caricaRegoleNotifica() {
+		if !regola.corrisponde(g, evento) {
+			continue
+		}
+		err := inviaNotificaGuasto(&regola, g, evento)
+		registraInvio(regola.ID, guastoID, evento, regola.Canale, regola.Destinazione, err)
+		if err != nil {
+			log.Printf("[Notifiche] Errore invio %s (%s) per guasto %d: %v", regola.Nome, regola.Canale, guastoID, err)
+		}
+	}
+}
+
+// inviaNotificaGuasto invia un guasto sul canale della regola
+func inviaNotificaGuasto(regola *regolaNotifica, g *guastoNotifica, evento string) error {
+	if regola.Canale == "webhook" {
+		return inviaWebhook(regola.Destinazione, segreti.Leggi(regola.Segreto), payloadWebhook{
+			Evento:    "guasto_" + evento,
+			Timestamp: time.Now().UTC(),
+			Guasto:    g,
+		})
+	}
+
+	var corpo bytes.Buffer
+	if err := templateEmailNotifiche.ExecuteTemplate(&corpo, "guasto", map[string]interface{}{
+		"Evento": evento,
+		"Guasto": g,
+	}); err != nil {
+		return err
+	}
+	oggetto := fmt.Sprintf("[FurvioGest] Guasto gravita %s - %s", strings.ToUpper(g.Gravita), g.Nave)
+	if evento == eventoGuastoEscalation {
+		oggetto = fmt.Sprintf("[FurvioGest] Guasto passato a gravita %s - %s", strings.ToUpper(g.Gravita), g.Nave)
+	}
+	return inviaEmailNotifica(regola.destinatariEmail(), oggetto, corpo.String())
+}
+
+// inviaEmailNotifica invia un'email con l'SMTP delle impostazioni azienda
+func inviaEmailNotifica(destinatari []string, oggetto, corpoHTML string) error {
+	imp, err := getImpostazioniAzienda()
+	if err != nil {
+		return fmt.Errorf("impostazioni azienda non disponibili: %v", err)
+	}
+	return email.InviaEmail(email.ConfigDaImpostazioni(imp), email.EmailData{
+		To:       destinatari,
+		Subject:  oggetto,
+		HTMLBody: corpoHTML,
+	})
+}
+
+// firmaWebhook calcola la firma HMAC-SHA256 di timestamp e corpo: il destinatario
+// la ricalcola con lo stesso segreto e rifiuta i timestamp troppo vecchi
+func firmaWebhook(segreto, timestamp string, corpo []byte) string {
+	mac := hmac.New(sha256.New, []byte(segreto))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(corpo)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// inviaWebhook invia il payload in POST come JSON firmato
+func inviaWebhook(indirizzo, segreto string, payload payloadWebhook) error {
+	corpo, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, indirizzo, bytes.NewReader(corpo))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(payload.Timestamp.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FurvioGest")
+	req.Header.Set("X-FurvioGest-Evento", payload.Evento)
+	req.Header.Set("X-FurvioGest-Timestamp", timestamp)
+	req.Header.Set("X-FurvioGest-Signature", firmaWebhook(segreto, timestamp, corpo))
+
+	client := &http.Client{Timeout: timeoutWebhook}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("risposta HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// registraInvio salva l'esito di un invio
+func registraInvio(regolaID, guastoID int64, evento, canale, destinazione string, errInvio error) {
+	esito, messaggio := "ok", ""
+	if errInvio != nil {
+		esito, messaggio = "errore", errInvio.Error()
+	}
+	var regola, guasto interface{}
+	if regolaID > 0 {
+		regola = regolaID
+	}
+	if guastoID > 0 {
+		guasto = guastoID
+	}
+	database.DB.Exec(`
+		INSERT INTO notifiche_invii (regola_id, guasto_id, evento, canale, destinazione, esito, messaggio)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, regola, guasto, evento, canale, destinazione, esito, messaggio)
+}
+
+// ============================================
+// RIEPILOGO GIORNALIERO
+// ============================================
+
+// guastoRiepilogo e una riga del riepilogo dei guasti aperti
+type guastoRiepilogo struct {
+	guastoNotifica
+	TecnicoCaricoID int64
+}
+
+// StartNotificheScheduler avvia il controllo periodico del riepilogo guasti
+func StartNotificheScheduler() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			controllaRiepilogoGuasti()
+		}
+	}()
+	log.Println("[Notifiche] Riepilogo guasti pianificato")
+}
+
+// caricaPianificazioneRiepilogo legge la pianificazione del riepilogo nella
+// stessa forma dei job di monitoraggio, per riusarne il calcolo delle scadenze
+func caricaPianificazioneRiepilogo() (*pianificazioneJob, error) {
+	p := &pianificazioneJob{Tipo: eventoRiepilogo}
+	var modificato sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT id, abilitato, cron, ultima_esecuzione, updated_at FROM notifiche_riepilogo WHERE id = 1
+	`).Scan(&p.ID, &p.Abilitato, &p.Cron, &p.UltimaEsecuzione, &modificato)
+	if err != nil {
+		return nil, err
+	}
+	p.Modificato = ultimaModifica(sql.NullTime{}, modificato)
+	return p, nil
+}
+
+// controllaRiepilogoGuasti invia il riepilogo se la pianificazione e scaduta
+func controllaRiepilogoGuasti() {
+	p, err := caricaPianificazioneRiepilogo()
+	if err != nil || !p.scaduta(time.Now()) {
+		return
+	}
+	inviati, err := inviaRiepilogoGuasti()
+	if err != nil {
+		log.Printf("[Notifiche] Errore riepilogo guasti: %v", err)
+		return
+	}
+	log.Printf("[Notifiche] Riepilogo guasti inviato a %d tecnici", inviati)
+}
+
+// inviaRiepilogoGuasti invia a ogni tecnico attivo l'elenco dei guasti aperti,
+// con in evidenza quelli che ha preso in carico
+func inviaRiepilogoGuasti() (int, error) {
+	// L'istante di avvio fa da riferimento per la prossima esecuzione, anche in caso di errore
+	database.DB.Exec("UPDATE notifiche_riepilogo SET ultima_esecuzione = ? WHERE id = 1",
+		time.Now().UTC().Format("2006-01-02 15:04:05"))
+
+	rows, err := database.DB.Query(`
+		SELECT g.id, g.nave_id, n.nome, COALESCE(n.compagnia_id, 0), COALESCE(c.nome, ''),
+		       g.tipo, g.gravita, g.descrizione, g.stato, g.data_apertura,
+		       COALESCE(g.tecnico_presa_in_carico_id, 0)
+		FROM guasti_nave g
+		JOIN navi n ON g.nave_id = n.id
+		LEFT JOIN compagnie c ON n.compagnia_id = c.id
+		WHERE g.stato != 'risolto'
+		ORDER BY CASE g.gravita WHEN 'alta' THEN 1 WHEN 'media' THEN 2 ELSE 3 END, g.data_apertura
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var guasti []guastoRiepilogo
+	for rows.Next() {
+		var g guastoRiepilogo
+		rows.Scan(&g.ID, &g.NaveID, &g.Nave, &g.CompagniaID, &g.Compagnia,
+			&g.Tipo, &g.Gravita, &g.Descrizione, &g.Stato, &g.DataApertura, &g.TecnicoCaricoID)
+		guasti = append(guasti, g)
+	}
+	rows.Close()
+	if len(guasti) == 0 {
+		return 0, nil
+	}
+
+	type tecnicoRiepilogo struct {
+		ID    int64
+		Nome  string
+		Email string
+	}
+	var tecnici []tecnicoRiepilogo
+	rows, err = database.DB.Query(`
+		SELECT id, nome, email FROM utenti
+		WHERE ruolo = 'tecnico' AND attivo = 1 AND TRIM(COALESCE(email, '')) != ''
+		ORDER BY cognome, nome
+	`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var t tecnicoRiepilogo
+		rows.Scan(&t.ID, &t.Nome, &t.Email)
+		tecnici = append(tecnici, t)
+	}
+	rows.Close()
+
+	inviati := 0
+	for _, t := range tecnici {
+		var assegnati, altri []guastoRiepilogo
+		for _, g := range guasti {
+			if g.TecnicoCaricoID == t.ID {
+				assegnati = append(assegnati, g)
+			} else {
+				altri = append(altri, g)
+			}
+		}
+
+		var corpo bytes.Buffer
+		if err := templateEmailNotifiche.ExecuteTemplate(&corpo, "riepilogo", map[string]interface{}{
+			"Nome":      t.Nome,
+			"Data":      time.Now().Format("02/01/2006"),
+			"Totale":    len(guasti),
+			"Assegnati": assegnati,
+			"Altri":     altri,
+		}); err != nil {
+			return inviati, err
+		}
+		oggetto := fmt.Sprintf("[FurvioGest] Riepilogo guasti aperti: %d", len(guasti))
+		err := inviaEmailNotifica([]string{strings.TrimSpace(t.Email)}, oggetto, corpo.String())
+		registraInvio(0, 0, eventoRiepilogo, "email", t.Email, err)
+		if err != nil {
+			log.Printf("[Notifiche] Errore invio riepilogo a %s: %v", t.Email, err)
+			continue
+		}
+		inviati++
+	}
+	return inviati, nil
+}
+
+// templateEmailNotifiche contiene i corpi delle email di notifica
+var templateEmailNotifiche = template.Must(template.New("notifiche").Parse(`
+{{define "guasto"}}
+<div style="font-family: Arial, sans-serif; font-size: 14px;">
+<p>{{if eq .Evento "escalation"}}Un guasto e passato a gravita <strong>{{.Guasto.Gravita}}</strong> (era {{.Guasto.GravitaPrecedente}}).{{else}}E stato aperto un guasto con gravita <strong>{{.Guasto.Gravita}}</strong>.{{end}}</p>
+<table cellpadding="4" style="border-collapse: collapse;">
+<tr><td><strong>Nave</strong></td><td>{{.Guasto.Nave}}</td></tr>
+<tr><td><strong>Compagnia</strong></td><td>{{.Guasto.Compagnia}}</td></tr>
+<tr><td><strong>Tipo</strong></td><td>{{.Guasto.TipoDescrizione}}</td></tr>
+<tr><td><strong>Descrizione</strong></td><td>{{.Guasto.Descrizione}}</td></tr>
+<tr><td><strong>Aperto il</strong></td><td>{{.Guasto.Apertura}}</td></tr>
+</table>
+</div>
+{{end}}
+
+{{define "riepilogo"}}
+<div style="font-family: Arial, sans-serif; font-size: 14px;">
+<p>Buongiorno {{.Nome}},</p>
+<p>al {{.Data}} risultano {{.Totale}} guasti aperti.</p>
+{{if .Assegnati}}<h3>Presi in carico da te</h3>{{template "tabellaGuasti" .Assegnati}}{{end}}
+{{if .Altri}}<h3>{{if .Assegnati}}Altri guasti aperti{{else}}Guasti aperti{{end}}</h3>{{template "tabellaGuasti" .Altri}}{{end}}
+</div>
+{{end}}
+
+{{define "tabellaGuasti"}}
+<table cellpadding="4" border="1" style="border-collapse: collapse;">
+<tr><th>Gravita</th><th>Nave</th><th>Tipo</th><th>Descrizione</th><th>Stato</th><th>Aperto il</th></tr>
+{{range .}}<tr><td>{{.Gravita}}</td><td>{{.Nave}}</td><td>{{.TipoDescrizione}}</td><td>{{.Descrizione}}</td><td>{{.Stato}}</td><td>{{.Apertura}}</td></tr>
+{{end}}</table>
+{{end}}
+`))
+
+// ============================================
+// PAGINA NOTIFICHE
+// ============================================
+
+// invioNotifica e una riga del registro invii
+type invioNotifica struct {
+	Data         string
+	Regola       string
+	GuastoID     int64
+	NaveID       int64
+	Evento       string
+	Canale       string
+	Destinazione string
+	Esito        string
+	Messaggio    string
+}
+
+// NotificheGuasti gestisce regole di notifica, riepilogo giornaliero e registro invii
+func NotificheGuasti(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Notifiche Guasti - FurvioGest", r)
+
+	if r.Method == http.MethodPost {
+		msg, err := salvaNotifiche(r)
+		if err == nil {
+			http.Redirect(w, r, "/monitoraggio/notifiche?success="+msg, http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+	}
+
+	switch r.URL.Query().Get("success") {
+	case "salvata":
+		data.Success = "Regola salvata"
+	case "aggiornata":
+		data.Success = "Regola aggiornata"
+	case "eliminata":
+		data.Success = "Regola eliminata"
+	case "prova":
+		data.Success = "Notifica di prova inviata"
+	case "riepilogo":
+		data.Success = "Riepilogo giornaliero salvato"
+	case "inviato":
+		data.Success = "Riepilogo inviato: l'esito per ogni tecnico e nel registro invii"
+	}
+
+	regole := caricaRegoleNotifica()
+	modifica := regolaNotifica{Canale: "email", GravitaMinima: "alta", Attiva: true}
+	if id, _ := strconv.ParseInt(r.URL.Query().Get("modifica"), 10, 64); id > 0 {
+		for _, regola := range regole {
+			if regola.ID == id {
+				// Il segreto serve in chiaro per configurare la verifica della firma sul ricevente
+				modifica = regola
+				modifica.Segreto = segreti.Leggi(regola.Segreto)
+			}
+		}
+	}
+
+	riepilogo, _ := caricaPianificazioneRiepilogo()
+	if riepilogo == nil {
+		riepilogo = &pianificazioneJob{Cron: "0 7 * * *"}
+	}
+
+	var invii []invioNotifica
+	rows, err := database.DB.Query(`
+		SELECT i.created_at, COALESCE(r.nome, ''), COALESCE(i.guasto_id, 0), COALESCE(g.nave_id, 0),
+		       i.evento, i.canale, i.destinazione, i.esito, COALESCE(i.messaggio, '')
+		FROM notifiche_invii i
+		LEFT JOIN notifiche_regole r ON i.regola_id = r.id
+		LEFT JOIN guasti_nave g ON i.guasto_id = g.id
+		ORDER BY i.created_at DESC, i.id DESC
+		LIMIT 50
+	`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var i invioNotifica
+			var quando time.Time
+			rows.Scan(&quando, &i.Regola, &i.GuastoID, &i.NaveID, &i.Evento, &i.Canale, &i.Destinazione, &i.Esito, &i.Messaggio)
+			i.Data = quando.Local().Format("02/01/2006 15:04")
+			invii = append(invii, i)
+		}
+	}
+
+	navi, _ := getNaviList(data.Session.CompagniaID)
+	data.Data = map[string]interface{}{
+		"Regole":    regole,
+		"Modifica":  modifica,
+		"Riepilogo": riepilogo,
+		"Prossimo":  riepilogo.Prossima(),
+		"Invii":     invii,
+		"Compagnie": getCompagnie(),
+		"Navi":      navi,
+	}
+	renderTemplate(w, "notifiche_guasti.html", data)
+}
+
+// salvaNotifiche esegue l'azione richiesta dal form e restituisce il codice di esito
+func salvaNotifiche(r *http.Request) (string, error) {
+	r.ParseForm()
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	switch r.FormValue("azione") {
+	case "salva_regola":
+		regola, err := leggiRegolaNotifica(r)
+		if err != nil {
+			return "", err
+		}
+		regola.ID = id
+		if err := salvaRegolaNotifica(r, regola); err != nil {
+			return "", fmt.Errorf("errore salvataggio regola: %v", err)
+		}
+		return "salvata", nil
+
+	case "attiva_regola":
+		modificaConAudit(r, "notifiche_regole", id, "UPDATE notifiche_regole SET attiva = NOT attiva, updated_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+		return "aggiornata", nil
+
+	case "elimina_regola":
+		eliminaConAudit(r, "notifiche_regole", id, "DELETE FROM notifiche_regole WHERE id = ?", id)
+		return "eliminata", nil
+
+	case "prova_regola":
+		for _, regola := range caricaRegoleNotifica() {
+			if regola.ID == id {
+				if err := inviaProvaNotifica(&regola); err != nil {
+					return "", fmt.Errorf("invio di prova fallito: %v", err)
+				}
+				return "prova", nil
+			}
+		}
+		return "", fmt.Errorf("regola non trovata")
+
+	case "salva_riepilogo":
+		cronStr := strings.TrimSpace(r.FormValue("cron"))
+		if _, err := cron.Parse(cronStr); err != nil {
+			return "", err
+		}
+		err := modificaConAudit(r, "notifiche_riepilogo", 1, "UPDATE notifiche_riepilogo SET abilitato = ?, cron = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1",
+			r.FormValue("abilitato") == "1", cronStr)
+		if err != nil {
+			return "", fmt.Errorf("errore salvataggio riepilogo: %v", err)
+		}
+		return "riepilogo", nil
+
+	case "invia_riepilogo":
+		if _, err := inviaRiepilogoGuasti(); err != nil {
+			return "", fmt.Errorf("errore invio riepilogo: %v", err)
+		}
+		return "inviato", nil
+	}
+	return "", fmt.Errorf("azione non valida")
+}
+
+// leggiRegolaNotifica valida i campi della regola inviati dal form
+func leggiRegolaNotifica(r *http.Request) (regolaNotifica, error) {
+	regola := regolaNotifica{
+		Nome:          strings.TrimSpace(r.FormValue("nome")),
+		Canale:        r.FormValue("canale"),
+		Destinazione:  strings.TrimSpace(r.FormValue("destinazione")),
+		Segreto:       strings.TrimSpace(r.FormValue("segreto")),
+		GravitaMinima: r.FormValue("gravita_minima"),
+		Attiva:        r.FormValue("attiva") == "1",
+	}
+	regola.CompagniaID, _ = strconv.ParseInt(r.FormValue("compagnia_id"), 10, 64)
+	regola.NaveID, _ = strconv.ParseInt(r.FormValue("nave_id"), 10, 64)
+
+	if regola.Nome == "" {
+		return regola, fmt.Errorf("il nome della regola e obbligatorio")
+	}
+	if _, ok := livelliGravita[regola.GravitaMinima]; !ok {
+		return regola, fmt.Errorf("gravita minima non valida")
+	}
+
+	switch regola.Canale {
+	case "email":
+		indirizzi := regola.destinatariEmail()
+		if len(indirizzi) == 0 {
+			return regola, fmt.Errorf("indicare almeno un indirizzo email")
+		}
+		for _, indirizzo := range indirizzi {
+			if _, err := mail.ParseAddress(indirizzo); err != nil {
+				return regola, fmt.Errorf("indirizzo email non valido: %s", indirizzo)
+			}
+		}
+		regola.Destinazione = strings.Join(indirizzi, ", ")
+		regola.Segreto = ""
+	case "webhook":
+		u, err := url.Parse(regola.Destinazione)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return regola, fmt.Errorf("URL del webhook non valido")
+		}
+		if regola.Segreto == "" {
+			b := make([]byte, 32)
+			rand.Read(b)
+			regola.Segreto = hex.EncodeToString(b)
+		}
+	default:
+		return regola, fmt.Errorf("canale non valido")
+	}
+	return regola, nil
+}
+
+// salvaRegolaNotifica inserisce o aggiorna una regola, con il segreto del webhook cifrato
+func salvaRegolaNotifica(r *http.Request, regola regolaNotifica) error {
+	segreto, err := segreti.Cifra(regola.Segreto)
+	if err != nil {
+		return err
+	}
+	var compagniaID, naveID interface{}
+	if regola.CompagniaID > 0 {
+		compagniaID = regola.CompagniaID
+	}
+	if regola.NaveID > 0 {
+		naveID = regola.NaveID
+	}
+	if regola.ID > 0 {
+		return modificaConAudit(r, "notifiche_regole", regola.ID, `
+			UPDATE notifiche_regole
+			SET nome = ?, canale = ?, destinazione = ?, segreto = ?, compagnia_id = ?, nave_id = ?,
+			    gravita_minima = ?, attiva = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, regola.Nome, regola.Canale, regola.Destinazione, segreto, compagniaID, naveID,
+			regola.GravitaMinima, regola.Attiva, regola.ID)
+	}
+	_, err = creaConAudit(r, "notifiche_regole", `
+		INSERT INTO notifiche_regole (nome, canale, destinazione, segreto, compagnia_id, nave_id, gravita_minima, attiva)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, regola.Nome, regola.Canale, regola.Destinazione, segreto, compagniaID, naveID,
+		regola.GravitaMinima, regola.Attiva)
+	return err
+}
+
+// inviaProvaNotifica verifica la configurazione di una regola con un invio di prova
+func inviaProvaNotifica(regola *regolaNotifica) error {
+	var err error
+	if regola.Canale == "webhook" {
+		err = inviaWebhook(regola.Destinazione, segreti.Leggi(regola.Segreto), payloadWebhook{
+			Evento:    eventoTest,
+			Timestamp: time.Now().UTC(),
+		})
+	} else {
+		err = inviaEmailNotifica(regola.destinatariEmail(), "[FurvioGest] Notifica di prova",
+			fmt.Sprintf("<p>Notifica di prova della regola <strong>%s</strong>: la configurazione email funziona.</p>",
+				template.HTMLEscapeString(regola.Nome)))
+	}
+	registraInvio(regola.ID, 0, eventoTest, regola.Canale, regola.Destinazione, err)
+	return err
+}
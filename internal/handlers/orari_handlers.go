@@ -3,8 +3,10 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
 	"furviogest/internal/models"
+	"furviogest/internal/segreti"
 	"github.com/xuri/excelize/v2"
 	"io"
 	"log"
@@ -220,7 +222,7 @@ func NuovoOrario(w http.ResponseWriter, r *http.Request) {
 	oraArrivo := strings.TrimSpace(r.FormValue("ora_arrivo"))
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	_, err := database.DB.Exec(`
+	_, err := creaConAudit(r, "orari_navi", `
 		INSERT INTO orari_navi (nave_id, data, porto_partenza_nome, porto_arrivo_nome, 
 		                        ora_partenza, ora_arrivo, note, fonte)
 		VALUES (?, ?, ?, ?, ?, ?, ?, 'manuale')
@@ -247,7 +249,7 @@ func EliminaOrario(w http.ResponseWriter, r *http.Request) {
 	var naveID int64
 	database.DB.QueryRow("SELECT nave_id FROM orari_navi WHERE id = ?", orarioID).Scan(&naveID)
 
-	database.DB.Exec("DELETE FROM orari_navi WHERE id = ?", orarioID)
+	eliminaConAudit(r, "orari_navi", orarioID, "DELETE FROM orari_navi WHERE id = ?", orarioID)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
@@ -288,7 +290,7 @@ func NuovaSosta(w http.ResponseWriter, r *http.Request) {
 		dataFineVal = dataFine
 	}
 
-	_, err := database.DB.Exec(`
+	_, err := creaConAudit(r, "soste_navi", `
 		INSERT INTO soste_navi (nave_id, porto_id, porto_nome, data_inizio, data_fine,
 		                        ora_arrivo, ora_partenza, motivo, note, fonte)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'manuale')
@@ -315,7 +317,7 @@ func EliminaSosta(w http.ResponseWriter, r *http.Request) {
 	var naveID int64
 	database.DB.QueryRow("SELECT nave_id FROM soste_navi WHERE id = ?", sostaID).Scan(&naveID)
 
-	database.DB.Exec("DELETE FROM soste_navi WHERE id = ?", sostaID)
+	eliminaConAudit(r, "soste_navi", sostaID, "DELETE FROM soste_navi WHERE id = ?", sostaID)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
@@ -341,7 +343,7 @@ func UploadOrariPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	compagnie, _ := getCompagnieList()
+	compagnie, _ := getCompagnieList(data.Session.CompagniaID)
 
 	rows, _ := database.DB.Query(`
 		SELECT u.id, u.compagnia_id, u.nome_file, u.data_upload, u.attivo, 
@@ -422,12 +424,19 @@ func UploadOrariFile(w http.ResponseWriter, r *http.Request) {
 	defer dst.Close()
 	io.Copy(dst, file)
 
-	database.DB.Exec("UPDATE upload_orari SET attivo = 0 WHERE compagnia_id = ?", compagniaID)
-
-	_, err = database.DB.Exec(`
-		INSERT INTO upload_orari (compagnia_id, nome_file, file_path, caricato_da, note, attivo)
-		VALUES (?, ?, ?, ?, ?, 1)
-	`, compagniaID, header.Filename, destPath, data.Session.UserID, note)
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("upload_orari", "compagnia_id = ?", compagniaID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE upload_orari SET attivo = 0 WHERE compagnia_id = ?", compagniaID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO upload_orari (compagnia_id, nome_file, file_path, caricato_da, note, attivo)
+			VALUES (?, ?, ?, ?, ?, 1)
+		`, compagniaID, header.Filename, destPath, data.Session.UserID, note)
+		return err
+	})
 
 	if err != nil {
 		data.Error = "Errore nel salvataggio dei dati"
@@ -447,8 +456,8 @@ func UploadOrariFile(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
 
-func getCompagnieList() ([]models.Compagnia, error) {
-	rows, err := database.DB.Query("SELECT id, nome FROM compagnie ORDER BY nome")
+func getCompagnieList(compagniaID int64) ([]models.Compagnia, error) {
+	rows, err := database.DB.Query("SELECT id, nome FROM compagnie WHERE ? = 0 OR id = ? ORDER BY nome", compagniaID, compagniaID)
 	if err != nil {
 		return nil, err
 	}
@@ -463,7 +472,7 @@ func getCompagnieList() ([]models.Compagnia, error) {
 	return compagnie, nil
 }
 
-// UploadPiantinaNave gestisce l'upload dei disegni PDF della nave
+// UploadPiantinaNave gestisce l'upload dei disegni della nave (PDF o immagini)
 func UploadPiantinaNave(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Redirect(w, r, "/navi", http.StatusSeeOther)
@@ -517,7 +526,7 @@ func UploadPiantinaNave(w http.ResponseWriter, r *http.Request) {
 	io.Copy(dst, file)
 
 	disegnoPath := filepath.Join("uploads", "disegni", newFilename)
-	database.DB.Exec("INSERT INTO disegni_nave (nave_id, nome, path) VALUES (?, ?, ?)", naveID, nomeDisegno, disegnoPath)
+	creaConAudit(r, "disegni_nave", "INSERT INTO disegni_nave (nave_id, nome, path) VALUES (?, ?, ?)", naveID, nomeDisegno, disegnoPath)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
@@ -539,7 +548,7 @@ func EliminaDisegnoNave(w http.ResponseWriter, r *http.Request) {
 		os.Remove(filepath.Join("web", "static", path))
 	}
 
-	database.DB.Exec("DELETE FROM disegni_nave WHERE id = ?", disegnoID)
+	eliminaConAudit(r, "disegni_nave", disegnoID, "DELETE FROM disegni_nave WHERE id = ?", disegnoID)
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
 
@@ -573,10 +582,14 @@ func AggiungiServerNave(w http.ResponseWriter, r *http.Request) {
 		protocollo = "https"
 	}
 	username := strings.TrimSpace(r.FormValue("username"))
-	password := strings.TrimSpace(r.FormValue("password"))
+	password, err := segreti.Cifra(strings.TrimSpace(r.FormValue("password")))
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	database.DB.Exec("INSERT INTO server_nave (nave_id, nome, indirizzo_ip, porta, protocollo, username, password, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	creaConAudit(r, "server_nave", "INSERT INTO server_nave (nave_id, nome, indirizzo_ip, porta, protocollo, username, password, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		naveID, nome, indirizzoIP, porta, protocollo, username, password, note)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
@@ -593,7 +606,7 @@ func EliminaServerNave(w http.ResponseWriter, r *http.Request) {
 	naveID, _ := strconv.ParseInt(pathParts[3], 10, 64)
 	serverID, _ := strconv.ParseInt(pathParts[4], 10, 64)
 
-	database.DB.Exec("DELETE FROM server_nave WHERE id = ? AND nave_id = ?", serverID, naveID)
+	eliminaConAudit(r, "server_nave", serverID, "DELETE FROM server_nave WHERE id = ? AND nave_id = ?", serverID, naveID)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
@@ -622,11 +635,16 @@ func ModificaServerNave(w http.ResponseWriter, r *http.Request) {
 	}
 	protocollo := r.FormValue("protocollo")
 	username := strings.TrimSpace(r.FormValue("username"))
-	password := strings.TrimSpace(r.FormValue("password"))
+	password, err := segreti.Cifra(strings.TrimSpace(r.FormValue("password")))
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	database.DB.Exec("UPDATE server_nave SET nome=?, indirizzo_ip=?, porta=?, protocollo=?, username=?, password=?, note=? WHERE id=? AND nave_id=?",
-		nome, indirizzoIP, porta, protocollo, username, password, note, serverID, naveID)
+	// Password vuota: resta quella salvata
+	modificaConAudit(r, "server_nave", serverID, "UPDATE server_nave SET nome=?, indirizzo_ip=?, porta=?, protocollo=?, username=?, password=CASE WHEN ? = '' THEN password ELSE ? END, note=? WHERE id=? AND nave_id=?",
+		nome, indirizzoIP, porta, protocollo, username, password, password, note, serverID, naveID)
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/dettaglio/%d", naveID), http.StatusSeeOther)
 }
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"log"
 	"html/template"
+	"furviogest/internal/audit"
 	"furviogest/internal/email"
 	"furviogest/internal/middleware"
 	"database/sql"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
 	"furviogest/internal/models"
 	"net/http"
 	"strconv"
@@ -51,8 +53,9 @@ func ListaPermessi(w http.ResponseWriter, r *http.Request) {
 		JOIN navi n ON rp.nave_id = n.id
 		JOIN porti p ON rp.porto_id = p.id
 		JOIN utenti u ON rp.tecnico_creatore = u.id
+		WHERE ? = 0 OR n.compagnia_id = ?
 		ORDER BY rp.data_inizio DESC, rp.created_at DESC
-	`)
+	`, data.Session.CompagniaID, data.Session.CompagniaID)
 	if err != nil {
 		data.Error = "Errore nel recupero dei permessi: " + err.Error()
 		renderTemplate(w, "permessi_lista.html", data)
@@ -107,7 +110,7 @@ func NuovoPermesso(w http.ResponseWriter, r *http.Request) {
 	formData := map[string]interface{}{}
 	
 	// Carica navi con compagnia
-	navi, _ := caricaNavi()
+	navi, _ := caricaNavi(data.Session.CompagniaID)
 	formData["Navi"] = navi
 	formData["NaviPerCompagnia"] = raggruppaNaviPerCompagnia(navi)
 
@@ -201,38 +204,48 @@ func NuovoPermesso(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Inserisci la richiesta permesso
-	result, err := database.DB.Exec(`
-		INSERT INTO richieste_permesso (nave_id, porto_id, tecnico_creatore, automezzo_id, 
-			targa_esterna, tipo_durata, data_inizio, data_fine, note, descrizione_intervento, rientro_in_giornata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, naveID, portoID, tecnicoCreatore, automezzoID, targaEsterna, tipoDurata, dataInizio, dataFine, note, descrizioneIntervento, rientroInGiornata)
+	// Inserisci la richiesta permesso con i tecnici e le navi associate
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		result, err := tx.Exec(`
+			INSERT INTO richieste_permesso (nave_id, porto_id, tecnico_creatore, automezzo_id, 
+				targa_esterna, tipo_durata, data_inizio, data_fine, note, descrizione_intervento, rientro_in_giornata)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, naveID, portoID, tecnicoCreatore, automezzoID, targaEsterna, tipoDurata, dataInizio, dataFine, note, descrizioneIntervento, rientroInGiornata)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		data.Error = "Errore durante il salvataggio: " + err.Error()
-		renderTemplate(w, "permessi_form.html", data)
-		return
-	}
+		permessoID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		t.Crea("richieste_permesso", permessoID, figliPermesso...)
 
-	permessoID, _ := result.LastInsertId()
+		// Inserisci i tecnici associati
+		for _, tecnicoIDStr := range tecniciSelezionati {
+			tecnicoID, err := strconv.ParseInt(tecnicoIDStr, 10, 64)
+			if err == nil {
+				tx.Exec(`
+					INSERT INTO tecnici_permesso (richiesta_permesso_id, tecnico_id)
+					VALUES (?, ?)
+				`, permessoID, tecnicoID)
+			}
+		}
 
-	// Inserisci i tecnici associati
-	for _, tecnicoIDStr := range tecniciSelezionati {
-		tecnicoID, err := strconv.ParseInt(tecnicoIDStr, 10, 64)
-		if err == nil {
-			database.DB.Exec(`
-				INSERT INTO tecnici_permesso (richiesta_permesso_id, tecnico_id)
+		// Inserisci le navi associate (multi-nave)
+		for _, naveIDItem := range naviIDs {
+			tx.Exec(`
+				INSERT INTO navi_permesso (richiesta_permesso_id, nave_id)
 				VALUES (?, ?)
-			`, permessoID, tecnicoID)
+			`, permessoID, naveIDItem)
 		}
-	}
+		return nil
+	})
 
-	// Inserisci le navi associate (multi-nave)
-	for _, naveIDItem := range naviIDs {
-		database.DB.Exec(`
-			INSERT INTO navi_permesso (richiesta_permesso_id, nave_id)
-			VALUES (?, ?)
-		`, permessoID, naveIDItem)
+	if err != nil {
+		data.Error = "Errore durante il salvataggio: " + err.Error()
+		renderTemplate(w, "permessi_form.html", data)
+		return
 	}
 
 
@@ -272,7 +285,7 @@ func ModificaPermesso(w http.ResponseWriter, r *http.Request) {
 
 	// Carica dati per i dropdown
 	formData := map[string]interface{}{}
-	navi, _ := caricaNavi()
+	navi, _ := caricaNavi(data.Session.CompagniaID)
 	formData["Navi"] = navi
 	porti, _ := caricaPorti()
 	formData["Porti"] = porti
@@ -371,14 +384,34 @@ func ModificaPermesso(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Aggiorna il permesso
-	_, err = database.DB.Exec(`
-		UPDATE richieste_permesso SET 
-			nave_id = ?, porto_id = ?, automezzo_id = ?, targa_esterna = ?,
-			tipo_durata = ?, data_inizio = ?, data_fine = ?, note = ?, descrizione_intervento = ?, rientro_in_giornata = ?,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, naveID, portoID, automezzoID, targaEsterna, tipoDurata, dataInizio, dataFine, note, descrizioneIntervento, rientroInGiornata, id)
+	// Aggiorna il permesso e i tecnici associati
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica("richieste_permesso", id, figliPermesso...); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE richieste_permesso SET 
+				nave_id = ?, porto_id = ?, automezzo_id = ?, targa_esterna = ?,
+				tipo_durata = ?, data_inizio = ?, data_fine = ?, note = ?, descrizione_intervento = ?, rientro_in_giornata = ?,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, naveID, portoID, automezzoID, targaEsterna, tipoDurata, dataInizio, dataFine, note, descrizioneIntervento, rientroInGiornata, id)
+		if err != nil {
+			return err
+		}
+
+		tx.Exec("DELETE FROM tecnici_permesso WHERE richiesta_permesso_id = ?", id)
+		for _, tecnicoIDStr := range tecniciSelezionati {
+			tecnicoID, err := strconv.ParseInt(tecnicoIDStr, 10, 64)
+			if err == nil {
+				tx.Exec(`
+					INSERT INTO tecnici_permesso (richiesta_permesso_id, tecnico_id)
+					VALUES (?, ?)
+				`, id, tecnicoID)
+			}
+		}
+		return nil
+	})
 
 	if err != nil {
 		data.Error = "Errore durante il salvataggio"
@@ -387,18 +420,6 @@ func ModificaPermesso(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Aggiorna tecnici associati
-	database.DB.Exec("DELETE FROM tecnici_permesso WHERE richiesta_permesso_id = ?", id)
-	for _, tecnicoIDStr := range tecniciSelezionati {
-		tecnicoID, err := strconv.ParseInt(tecnicoIDStr, 10, 64)
-		if err == nil {
-			database.DB.Exec(`
-				INSERT INTO tecnici_permesso (richiesta_permesso_id, tecnico_id)
-				VALUES (?, ?)
-			`, id, tecnicoID)
-		}
-	}
-
 // 
 // 	// Gestione trasferte in base a rientro_in_giornata
 // 	if rientroInGiornata {
@@ -436,7 +457,7 @@ func SegnaEmailInviata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec(`
+	err = modificaConAudit(r, "richieste_permesso", id, `
 		UPDATE richieste_permesso 
 		SET email_inviata = 1, data_invio_email = CURRENT_TIMESTAMP 
 		WHERE id = ?
@@ -457,7 +478,13 @@ func EliminaPermesso(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.ParseInt(pathParts[3], 10, 64)
-	database.DB.Exec("DELETE FROM richieste_permesso WHERE id = ?", id)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("richieste_permesso", id, figliPermesso...); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM richieste_permesso WHERE id = ?", id)
+		return err
+	})
 	http.Redirect(w, r, "/permessi", http.StatusSeeOther)
 }
 
@@ -604,13 +631,16 @@ func DettaglioPermesso(w http.ResponseWriter, r *http.Request) {
 }
 
 // Funzioni helper per caricare dati dropdown
-func caricaNavi() ([]models.Nave, error) {
+
+// caricaNavi restituisce le navi con la compagnia, solo della compagnia se diversa da 0
+func caricaNavi(compagniaID int64) ([]models.Nave, error) {
 	rows, err := database.DB.Query(`
 		SELECT n.id, n.nome, n.imo, n.compagnia_id, c.nome as nome_compagnia
 		FROM navi n
 		JOIN compagnie c ON n.compagnia_id = c.id
+		WHERE ? = 0 OR n.compagnia_id = ?
 		ORDER BY c.nome, n.nome
-	`)
+	`, compagniaID, compagniaID)
 	if err != nil {
 		return nil, err
 	}
@@ -952,7 +982,7 @@ func InviaEmailPermesso(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	database.DB.Exec(`UPDATE richieste_permesso SET email_inviata = 1, data_invio_email = CURRENT_TIMESTAMP WHERE id = ?`, id)
+	modificaConAudit(r, "richieste_permesso", id, `UPDATE richieste_permesso SET email_inviata = 1, data_invio_email = CURRENT_TIMESTAMP WHERE id = ?`, id)
 
 	http.Redirect(w, r, "/permessi/dettaglio/"+strconv.FormatInt(id, 10)+"?success=email_inviata", http.StatusSeeOther)
 }
@@ -1217,7 +1247,7 @@ func caricaSMTPTecnico(tecnicoID int64) (*email.SMTPConfig, error) {
 		Server:   smtpServer,
 		Port:     smtpPort,
 		User:     smtpUser,
-		Password: smtpPassword,
+		Password: segreti.Leggi(smtpPassword),
 		FromName: nomeTecnico,
 		FromAddr: fromAddr,
 	}, nil
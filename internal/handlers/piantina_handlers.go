@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/database"
+	"furviogest/internal/models"
+)
+
+// ============================================
+// PIANTINA RETE NAVE
+// ============================================
+
+// estensioniPiantina sono i formati di disegno su cui si possono posizionare gli apparati
+var estensioniPiantina = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true}
+
+// elementoPiantina e un apparato di rete con il suo stato e l'eventuale posizione sul disegno
+type elementoPiantina struct {
+	ID          string   `json:"id"` // come nella topologia: ap-N, switch-N, ac-N
+	Tipo        string   `json:"tipo"`
+	ApparatoID  int64    `json:"apparato_id"`
+	Nome        string   `json:"nome"`
+	IP          string   `json:"ip,omitempty"`
+	Modello     string   `json:"modello,omitempty"`
+	Stato       string   `json:"stato"` // online, offline, fault, unknown
+	Switch      string   `json:"switch,omitempty"`
+	Porta       string   `json:"porta,omitempty"`
+	UltimoCheck string   `json:"ultimo_check,omitempty"`
+	Guasti      int      `json:"guasti"` // guasti aperti sull'apparato
+	X           *float64 `json:"x,omitempty"`
+	Y           *float64 `json:"y,omitempty"`
+}
+
+// getDisegnoNave carica un disegno della nave (ID 0 se non trovato)
+func getDisegnoNave(disegnoID int64) models.DisegnoNave {
+	var d models.DisegnoNave
+	database.DB.QueryRow("SELECT id, nave_id, nome, path, created_at FROM disegni_nave WHERE id = ?", disegnoID).
+		Scan(&d.ID, &d.NaveID, &d.Nome, &d.Path, &d.CreatedAt)
+	return d
+}
+
+// disegnoPosizionabile indica se il disegno e un'immagine su cui posizionare gli apparati
+func disegnoPosizionabile(d models.DisegnoNave) bool {
+	return estensioniPiantina[strings.ToLower(filepath.Ext(d.Path))]
+}
+
+// elementiPiantina restituisce gli apparati di rete della nave con lo stato attuale
+// e la posizione sul disegno indicato. Un apparato con guasti aperti e in fault;
+// switch e AC sono offline finche dura la condizione di irraggiungibilita.
+func elementiPiantina(naveID, disegnoID int64) []elementoPiantina {
+	elementi := []elementoPiantina{}
+	formatta := func(t sql.NullTime) string {
+		if !t.Valid {
+			return ""
+		}
+		return t.Time.Local().Format("02/01/2006 15:04")
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT ap.id, ap.ap_name, COALESCE(ap.ap_ip, ''), COALESCE(ap.ap_model, ''), ap.stato,
+		       COALESCE(sw.nome, ''), COALESCE(ap.switch_port, ''), ap.ultimo_check
+		FROM access_point ap
+		LEFT JOIN switch_nave sw ON ap.switch_id = sw.id
+		WHERE ap.nave_id = ?
+		ORDER BY ap.ap_name
+	`, naveID)
+	if err != nil {
+		log.Printf("[Piantina] Errore lettura AP nave %d: %v", naveID, err)
+		return elementi
+	}
+	for rows.Next() {
+		e := elementoPiantina{Tipo: "ap"}
+		var ultimo sql.NullTime
+		if err := rows.Scan(&e.ApparatoID, &e.Nome, &e.IP, &e.Modello, &e.Stato, &e.Switch, &e.Porta, &ultimo); err != nil {
+			continue
+		}
+		e.UltimoCheck = formatta(ultimo)
+		elementi = append(elementi, e)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT id, nome, ip, COALESCE(modello, ''), ultimo_check FROM switch_nave WHERE nave_id = ? ORDER BY nome
+	`, naveID)
+	if err == nil {
+		for rows.Next() {
+			e := elementoPiantina{Tipo: "switch"}
+			var ultimo sql.NullTime
+			if err := rows.Scan(&e.ApparatoID, &e.Nome, &e.IP, &e.Modello, &ultimo); err != nil {
+				continue
+			}
+			e.UltimoCheck = formatta(ultimo)
+			elementi = append(elementi, e)
+		}
+		rows.Close()
+	}
+
+	if ac := getAccessControllerByNave(naveID); ac != nil {
+		e := elementoPiantina{Tipo: "ac", ApparatoID: ac.ID, Nome: "Access Controller", IP: ac.IP, Modello: ac.Modello}
+		var ultimo sql.NullTime
+		database.DB.QueryRow("SELECT ultimo_check FROM access_controller WHERE id = ?", ac.ID).Scan(&ultimo)
+		e.UltimoCheck = formatta(ultimo)
+		elementi = append(elementi, e)
+	}
+
+	// Guasti aperti per apparato (i guasti AP manuali hanno solo ap_id)
+	guasti := make(map[string]int)
+	rows, err = database.DB.Query(`
+		SELECT COALESCE(tipo_apparato, 'ap'), COALESCE(apparato_id, ap_id), COUNT(*)
+		FROM guasti_nave
+		WHERE nave_id = ? AND stato != 'risolto' AND (apparato_id IS NOT NULL OR ap_id IS NOT NULL)
+		GROUP BY 1, 2
+	`, naveID)
+	if err == nil {
+		for rows.Next() {
+			var tipo string
+			var id int64
+			var n int
+			if rows.Scan(&tipo, &id, &n) == nil {
+				guasti[fmt.Sprintf("%s-%d", tipo, id)] = n
+			}
+		}
+		rows.Close()
+	}
+
+	irraggiungibili := make(map[string]bool)
+	rows, err = database.DB.Query(`
+		SELECT tipo_apparato, apparato_id FROM condizioni_guasto
+		WHERE nave_id = ? AND condizione = 'apparato_irraggiungibile'
+	`, naveID)
+	if err == nil {
+		for rows.Next() {
+			var tipo string
+			var id int64
+			if rows.Scan(&tipo, &id) == nil {
+				irraggiungibili[fmt.Sprintf("%s-%d", tipo, id)] = true
+			}
+		}
+		rows.Close()
+	}
+
+	type punto struct{ x, y float64 }
+	posizioni := make(map[string]punto)
+	rows, err = database.DB.Query("SELECT tipo_apparato, apparato_id, x, y FROM piantina_posizioni WHERE disegno_id = ?", disegnoID)
+	if err == nil {
+		for rows.Next() {
+			var tipo string
+			var id int64
+			var p punto
+			if rows.Scan(&tipo, &id, &p.x, &p.y) == nil {
+				posizioni[fmt.Sprintf("%s-%d", tipo, id)] = p
+			}
+		}
+		rows.Close()
+	}
+
+	for i := range elementi {
+		e := &elementi[i]
+		e.ID = fmt.Sprintf("%s-%d", e.Tipo, e.ApparatoID)
+		e.Guasti = guasti[e.ID]
+		switch {
+		case e.Guasti > 0:
+			e.Stato = "fault"
+		case e.Tipo == "ap":
+			// stato letto dall'AC
+		case irraggiungibili[e.ID]:
+			e.Stato = "offline"
+		case e.UltimoCheck != "":
+			e.Stato = "online"
+		default:
+			e.Stato = "unknown"
+		}
+		if p, ok := posizioni[e.ID]; ok {
+			x, y := p.x, p.y
+			e.X, e.Y = &x, &y
+		}
+	}
+	return elementi
+}
+
+// APIPiantinaNave restituisce in JSON gli apparati del disegno con stato e posizione
+func APIPiantinaNave(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	disegnoID, _ := strconv.ParseInt(r.URL.Query().Get("disegno_id"), 10, 64)
+	disegno := getDisegnoNave(disegnoID)
+	if disegno.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Disegno non trovato"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"disegno_id": disegno.ID,
+		"aggiornato": time.Now().Format("15:04:05"),
+		"elementi":   elementiPiantina(disegno.NaveID, disegno.ID),
+	})
+}
+
+// APIPosizionePiantina posiziona un apparato sul disegno o lo rimuove
+func APIPosizionePiantina(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rispondi := func(success bool, message string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "message": message})
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		rispondi(false, "Metodo non consentito")
+		return
+	}
+
+	disegnoID, _ := strconv.ParseInt(r.FormValue("disegno_id"), 10, 64)
+	disegno := getDisegnoNave(disegnoID)
+	if disegno.ID == 0 || !disegnoPosizionabile(disegno) {
+		rispondi(false, "Disegno non trovato o non in formato immagine")
+		return
+	}
+
+	tipo := r.FormValue("tipo")
+	apparatoID, _ := strconv.ParseInt(r.FormValue("apparato_id"), 10, 64)
+	tabelle := map[string]string{"ap": "access_point", "switch": "switch_nave", "ac": "access_controller"}
+	tabella, ok := tabelle[tipo]
+	if !ok {
+		rispondi(false, "Tipo apparato non valido")
+		return
+	}
+	var naveID int64
+	database.DB.QueryRow("SELECT nave_id FROM "+tabella+" WHERE id = ?", apparatoID).Scan(&naveID)
+	if naveID != disegno.NaveID {
+		rispondi(false, "Apparato non trovato su questa nave")
+		return
+	}
+
+	// scriviPosizione esegue la scrittura registrando nel log la posizione dell'apparato sul disegno
+	scriviPosizione := func(query string, args ...interface{}) error {
+		return conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			if err := t.Righe("piantina_posizioni", "disegno_id = ? AND tipo_apparato = ? AND apparato_id = ?", disegno.ID, tipo, apparatoID); err != nil {
+				return err
+			}
+			_, err := tx.Exec(query, args...)
+			return err
+		})
+	}
+
+	if r.FormValue("azione") == "rimuovi" {
+		err := scriviPosizione("DELETE FROM piantina_posizioni WHERE disegno_id = ? AND tipo_apparato = ? AND apparato_id = ?",
+			disegno.ID, tipo, apparatoID)
+		if err != nil {
+			rispondi(false, "Errore rimozione: "+err.Error())
+			return
+		}
+		rispondi(true, "Apparato rimosso dal disegno")
+		return
+	}
+
+	x, errX := strconv.ParseFloat(r.FormValue("x"), 64)
+	y, errY := strconv.ParseFloat(r.FormValue("y"), 64)
+	if errX != nil || errY != nil || x < 0 || x > 100 || y < 0 || y > 100 {
+		rispondi(false, "Posizione non valida")
+		return
+	}
+	err := scriviPosizione(`
+		INSERT INTO piantina_posizioni (disegno_id, tipo_apparato, apparato_id, x, y, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(disegno_id, tipo_apparato, apparato_id) DO UPDATE SET
+			x = excluded.x, y = excluded.y, updated_at = excluded.updated_at
+	`, disegno.ID, tipo, apparatoID, x, y)
+	if err != nil {
+		rispondi(false, "Errore salvataggio: "+err.Error())
+		return
+	}
+	rispondi(true, "Posizione salvata")
+}
+
+// PiantinaReteNave mostra gli apparati di rete posizionati su un disegno della nave
+// con lo stato aggiornato periodicamente
+func PiantinaReteNave(w http.ResponseWriter, r *http.Request) {
+	naveID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/navi/piantina-rete/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+	nave := getNaveInfoByID(naveID)
+	if nave.ID == 0 {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+
+	// Solo i disegni in formato immagine: i PDF restano consultabili dal dettaglio nave
+	var disegni []models.DisegnoNave
+	rows, err := database.DB.Query("SELECT id, nave_id, nome, path, created_at FROM disegni_nave WHERE nave_id = ? ORDER BY nome", naveID)
+	if err == nil {
+		for rows.Next() {
+			var d models.DisegnoNave
+			if rows.Scan(&d.ID, &d.NaveID, &d.Nome, &d.Path, &d.CreatedAt) == nil && disegnoPosizionabile(d) {
+				disegni = append(disegni, d)
+			}
+		}
+		rows.Close()
+	}
+
+	var disegno models.DisegnoNave
+	disegnoID, _ := strconv.ParseInt(r.URL.Query().Get("disegno"), 10, 64)
+	for _, d := range disegni {
+		if d.ID == disegnoID || (disegnoID == 0 && disegno.ID == 0) {
+			disegno = d
+		}
+	}
+
+	data := NewPageData("Piantina "+nave.Nome+" - FurvioGest", r)
+	data.Data = map[string]interface{}{
+		"Nave":     nave,
+		"Disegni":  disegni,
+		"Disegno":  disegno,
+		"Elementi": elementiPiantina(naveID, disegno.ID),
+	}
+	renderTemplate(w, "piantina_rete.html", data)
+}
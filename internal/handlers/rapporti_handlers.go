@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"database/sql"
 	"log"
 	"bytes"
 	"os/exec"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
 	"furviogest/internal/middleware"
 )
@@ -102,10 +104,10 @@ func ListaRapporti(w http.ResponseWriter, r *http.Request) {
 		LEFT JOIN navi n ON r.nave_id = n.id
 		LEFT JOIN compagnie c ON n.compagnia_id = c.id
 		LEFT JOIN porti p ON r.porto_id = p.id
-		WHERE r.deleted_at IS NULL
+		WHERE r.deleted_at IS NULL AND (? = 0 OR n.compagnia_id = ?)
 	`
 
-	var args []interface{}
+	args := []interface{}{session.CompagniaID, session.CompagniaID}
 	argIndex := 1
 
 	if naveFilter != "" {
@@ -155,7 +157,7 @@ func ListaRapporti(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Lista navi per filtro
-	navi, _ := getNaviList()
+	navi, _ := getNaviList(session.CompagniaID)
 
 	pageData := NewPageData("Rapporti Intervento", r)
 	pageData.Data = map[string]interface{}{
@@ -198,46 +200,55 @@ func NuovoRapporto(w http.ResponseWriter, r *http.Request) {
 			tratta = ""
 		}
 
-		// Inserisci rapporto
-		result, err := database.DB.Exec(`
-			INSERT INTO rapporti_intervento (nave_id, porto_id, tipo, data_intervento, descrizione, note, in_navigazione, tratta)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-		`, naveID, portoID, tipo, dataIntervento, descrizione, note, inNavigazione, tratta)
+		// Inserisci rapporto con tecnici, foto e materiale
+		var rapportoID int64
+		err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			result, err := tx.Exec(`
+				INSERT INTO rapporti_intervento (nave_id, porto_id, tipo, data_intervento, descrizione, note, in_navigazione, tratta)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			`, naveID, portoID, tipo, dataIntervento, descrizione, note, inNavigazione, tratta)
+			if err != nil {
+				return err
+			}
+			if rapportoID, err = result.LastInsertId(); err != nil {
+				return err
+			}
+			t.Crea("rapporti_intervento", rapportoID, figliRapporto...)
+
+			// Inserisci tecnici con ore
+			for _, tecID := range tecniciIDs {
+				tid, _ := strconv.ParseInt(tecID, 10, 64)
+				ore, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("ore_%d", tid)), 64)
+				tx.Exec("INSERT INTO tecnici_rapporto (rapporto_id, tecnico_id, ore_lavoro) VALUES (?, ?, ?)", rapportoID, tid, ore)
+			}
+
+			// Upload foto multiple
+			uploadFotoMultiple(tx, r, rapportoID)
+
+			// Salva materiale utilizzato e recuperato
+			salvaMaterialeRapporto(tx, r, rapportoID)
+			return nil
+		})
 
 		if err != nil {
 			pageData := NewPageData("Nuovo Rapporto", r)
 			pageData.Error = "Errore creazione rapporto: " + err.Error()
-			pageData.Data = getRapportoFormData(0)
+			pageData.Data = getRapportoFormData(0, pageData.Session.CompagniaID)
 			renderTemplate(w, "rapporto_form.html", pageData)
 			return
 		}
 
-		rapportoID, _ := result.LastInsertId()
-
-		// Inserisci tecnici con ore
-		for _, tecID := range tecniciIDs {
-			tid, _ := strconv.ParseInt(tecID, 10, 64)
-			ore, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("ore_%d", tid)), 64)
-			database.DB.Exec("INSERT INTO tecnici_rapporto (rapporto_id, tecnico_id, ore_lavoro) VALUES (?, ?, ?)", rapportoID, tid, ore)
-		}
-
-		// Upload foto multiple
-		uploadFotoMultiple(r, rapportoID)
-
-		// Salva materiale utilizzato e recuperato
-		salvaMaterialeRapporto(r, rapportoID)
-
 		http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", rapportoID), http.StatusSeeOther)
 		return
 	}
 
 	pageData := NewPageData("Nuovo Rapporto", r)
-	pageData.Data = getRapportoFormData(0)
+	pageData.Data = getRapportoFormData(0, pageData.Session.CompagniaID)
 	renderTemplate(w, "rapporto_form.html", pageData)
 }
 
 // salvaMaterialeRapporto salva materiale descrittivo (indipendente dal magazzino)
-func salvaMaterialeRapporto(r *http.Request, rapportoID int64) {
+func salvaMaterialeRapporto(tx *sql.Tx, r *http.Request, rapportoID int64) {
 	r.ParseMultipartForm(32 << 20) // Necessario per multipart form
 	// Materiale utilizzato
 	descUtil := r.Form["mat_util_desc[]"]
@@ -256,7 +267,7 @@ func salvaMaterialeRapporto(r *http.Request, rapportoID int64) {
 		if i < len(unitaUtil) {
 			unita = unitaUtil[i]
 		}
-		database.DB.Exec(`INSERT INTO materiale_rapporto_desc (rapporto_id, tipo, descrizione_prodotto, quantita, unita) VALUES (?, 'utilizzato', ?, ?, ?)`,
+		tx.Exec(`INSERT INTO materiale_rapporto_desc (rapporto_id, tipo, descrizione_prodotto, quantita, unita) VALUES (?, 'utilizzato', ?, ?, ?)`,
 			rapportoID, descUtil[i], qty, unita)
 	}
 
@@ -277,13 +288,13 @@ func salvaMaterialeRapporto(r *http.Request, rapportoID int64) {
 		if i < len(unitaRec) {
 			unita = unitaRec[i]
 		}
-		database.DB.Exec(`INSERT INTO materiale_rapporto_desc (rapporto_id, tipo, descrizione_prodotto, quantita, unita) VALUES (?, 'recuperato', ?, ?, ?)`,
+		tx.Exec(`INSERT INTO materiale_rapporto_desc (rapporto_id, tipo, descrizione_prodotto, quantita, unita) VALUES (?, 'recuperato', ?, ?, ?)`,
 			rapportoID, descRec[i], qty, unita)
 	}
 }
 
 // uploadFotoMultiple gestisce upload di foto multiple per un rapporto
-func uploadFotoMultiple(r *http.Request, rapportoID int64) {
+func uploadFotoMultiple(tx *sql.Tx, r *http.Request, rapportoID int64) {
 	err := r.ParseMultipartForm(32 << 20) // 32MB max
 	if err != nil {
 		return
@@ -327,7 +338,7 @@ func uploadFotoMultiple(r *http.Request, rapportoID int64) {
 		}
 
 		// Salva nel database
-		database.DB.Exec(`INSERT INTO foto_rapporto (rapporto_id, file_path, descrizione) VALUES (?, ?, ?)`,
+		tx.Exec(`INSERT INTO foto_rapporto (rapporto_id, file_path, descrizione) VALUES (?, ?, ?)`,
 			rapportoID, fileName, desc)
 	}
 }
@@ -367,55 +378,64 @@ func ModificaRapporto(w http.ResponseWriter, r *http.Request) {
 			tratta = ""
 		}
 
-		_, err := database.DB.Exec(`
-			UPDATE rapporti_intervento
-			SET nave_id = ?, porto_id = ?, tipo = ?, data_intervento = ?,
-			    descrizione = ?, note = ?, in_navigazione = ?, tratta = ?,
-			    updated_at = CURRENT_TIMESTAMP
-			WHERE id = ?
-		`, naveID, portoID, tipo, dataIntervento, descrizione, note, inNavigazione, tratta, id)
+		err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			if err := t.Modifica("rapporti_intervento", id, figliRapporto...); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`
+				UPDATE rapporti_intervento
+				SET nave_id = ?, porto_id = ?, tipo = ?, data_intervento = ?,
+				    descrizione = ?, note = ?, in_navigazione = ?, tratta = ?,
+				    updated_at = CURRENT_TIMESTAMP
+				WHERE id = ?
+			`, naveID, portoID, tipo, dataIntervento, descrizione, note, inNavigazione, tratta, id)
+			if err != nil {
+				return err
+			}
+
+			// Aggiorna tecnici con ore
+			tx.Exec("DELETE FROM tecnici_rapporto WHERE rapporto_id = ?", id)
+			for _, tecID := range tecniciIDs {
+				tid, _ := strconv.ParseInt(tecID, 10, 64)
+				ore, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("ore_%d", tid)), 64)
+				tx.Exec("INSERT INTO tecnici_rapporto (rapporto_id, tecnico_id, ore_lavoro) VALUES (?, ?, ?)", id, tid, ore)
+			}
+
+			// Upload nuove foto
+			uploadFotoMultiple(tx, r, id)
+
+			// Elimina foto marcate per cancellazione
+			deleteFotoIDs := r.Form["delete_foto"]
+			for _, fotoIDStr := range deleteFotoIDs {
+				fotoID, _ := strconv.ParseInt(fotoIDStr, 10, 64)
+				var filePath string
+				tx.QueryRow("SELECT file_path FROM foto_rapporto WHERE id = ?", fotoID).Scan(&filePath)
+				if filePath != "" {
+					os.Remove(filepath.Join("uploads", "rapporti", filePath))
+				}
+				tx.Exec("DELETE FROM foto_rapporto WHERE id = ?", fotoID)
+			}
+
+			// Aggiorna materiale: elimina vecchio e risalva
+			tx.Exec("DELETE FROM materiale_rapporto_desc WHERE rapporto_id = ?", id)
+			salvaMaterialeRapporto(tx, r, id)
+			return nil
+		})
 
 		if err != nil {
 			pageData := NewPageData("Modifica Rapporto", r)
 			pageData.Error = "Errore modifica rapporto: " + err.Error()
-			pageData.Data = getRapportoFormData(id)
+			pageData.Data = getRapportoFormData(id, pageData.Session.CompagniaID)
 			renderTemplate(w, "rapporto_form.html", pageData)
 			return
 		}
 
-		// Aggiorna tecnici con ore
-		database.DB.Exec("DELETE FROM tecnici_rapporto WHERE rapporto_id = ?", id)
-		for _, tecID := range tecniciIDs {
-			tid, _ := strconv.ParseInt(tecID, 10, 64)
-			ore, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("ore_%d", tid)), 64)
-			database.DB.Exec("INSERT INTO tecnici_rapporto (rapporto_id, tecnico_id, ore_lavoro) VALUES (?, ?, ?)", id, tid, ore)
-		}
-
-		// Upload nuove foto
-		uploadFotoMultiple(r, id)
-
-		// Elimina foto marcate per cancellazione
-		deleteFotoIDs := r.Form["delete_foto"]
-		for _, fotoIDStr := range deleteFotoIDs {
-			fotoID, _ := strconv.ParseInt(fotoIDStr, 10, 64)
-			var filePath string
-			database.DB.QueryRow("SELECT file_path FROM foto_rapporto WHERE id = ?", fotoID).Scan(&filePath)
-			if filePath != "" {
-				os.Remove(filepath.Join("uploads", "rapporti", filePath))
-			}
-			database.DB.Exec("DELETE FROM foto_rapporto WHERE id = ?", fotoID)
-		}
-
-		// Aggiorna materiale: elimina vecchio e risalva
-		database.DB.Exec("DELETE FROM materiale_rapporto_desc WHERE rapporto_id = ?", id)
-		salvaMaterialeRapporto(r, id)
-
 		http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", id), http.StatusSeeOther)
 		return
 	}
 
 	pageData := NewPageData("Modifica Rapporto", r)
-	pageData.Data = getRapportoFormData(id)
+	pageData.Data = getRapportoFormData(id, pageData.Session.CompagniaID)
 	renderTemplate(w, "rapporto_form.html", pageData)
 }
 
@@ -492,89 +512,17 @@ func EliminaRapporto(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/rapporti/elimina/")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 
-	database.DB.Exec("UPDATE rapporti_intervento SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("rapporti_intervento", id, figliRapporto...); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE rapporti_intervento SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+		return err
+	})
 
 	http.Redirect(w, r, "/rapporti", http.StatusSeeOther)
 }
 
-// AggiungiMateriale aggiunge materiale al rapporto
-func AggiungiMateriale(w http.ResponseWriter, r *http.Request) {
-	session := middleware.GetSession(r)
-	if session == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-	if r.Method != "POST" {
-		http.Redirect(w, r, "/rapporti", http.StatusSeeOther)
-		return
-	}
-
-	rapportoID, _ := strconv.ParseInt(r.FormValue("rapporto_id"), 10, 64)
-	prodottoID, _ := strconv.ParseInt(r.FormValue("prodotto_id"), 10, 64)
-	quantita, _ := strconv.ParseFloat(r.FormValue("quantita"), 64)
-
-	if quantita <= 0 {
-		http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d?error=quantita", rapportoID), http.StatusSeeOther)
-		return
-	}
-
-	// Verifica giacenza
-	var giacenza float64
-	database.DB.QueryRow("SELECT COALESCE(quantita, 0) FROM prodotti WHERE id = ?", prodottoID).Scan(&giacenza)
-	if quantita > giacenza {
-		http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d?error=giacenza", rapportoID), http.StatusSeeOther)
-		return
-	}
-
-	// Inserisci materiale
-	database.DB.Exec(`INSERT INTO materiale_rapporto (rapporto_id, prodotto_id, quantita) VALUES (?, ?, ?)`,
-		rapportoID, prodottoID, quantita)
-
-	// Scarica da magazzino
-	database.DB.Exec("UPDATE prodotti SET quantita = quantita - ? WHERE id = ?", quantita, prodottoID)
-
-	// Registra movimento magazzino
-	database.DB.Exec(`
-		INSERT INTO movimenti_magazzino (prodotto_id, tipo, quantita, motivo, utente_id)
-		VALUES (?, 'scarico', ?, ?, ?)
-	`, prodottoID, quantita, fmt.Sprintf("Rapporto intervento #%d", rapportoID), session.UserID)
-
-	http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", rapportoID), http.StatusSeeOther)
-}
-
-// RimuoviMateriale rimuove materiale dal rapporto
-func RimuoviMateriale(w http.ResponseWriter, r *http.Request) {
-	session := middleware.GetSession(r)
-	if session == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-	idStr := strings.TrimPrefix(r.URL.Path, "/rapporti/materiale/rimuovi/")
-	id, _ := strconv.ParseInt(idStr, 10, 64)
-
-	// Recupera dati materiale prima di eliminare
-	var rapportoID, prodottoID int64
-	var quantita float64
-	database.DB.QueryRow("SELECT rapporto_id, prodotto_id, quantita FROM materiale_rapporto WHERE id = ?", id).
-		Scan(&rapportoID, &prodottoID, &quantita)
-
-	// Elimina materiale
-	database.DB.Exec("DELETE FROM materiale_rapporto WHERE id = ?", id)
-
-	// Ricarica magazzino
-	database.DB.Exec("UPDATE prodotti SET quantita = quantita + ? WHERE id = ?", quantita, prodottoID)
-
-	// Registra movimento
-	database.DB.Exec(`
-		INSERT INTO movimenti_magazzino (prodotto_id, tipo, quantita, motivo, utente_id)
-		VALUES (?, 'carico', ?, ?, ?)
-	`, prodottoID, quantita, fmt.Sprintf("Reso da rapporto #%d", rapportoID), session.UserID)
-
-	http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", rapportoID), http.StatusSeeOther)
-}
-
 // UploadFotoRapporto carica foto per rapporto
 func UploadFotoRapporto(w http.ResponseWriter, r *http.Request) {
 	session := middleware.GetSession(r)
@@ -626,7 +574,7 @@ func UploadFotoRapporto(w http.ResponseWriter, r *http.Request) {
 
 	// Salva riferimento nel database
 	webPath := "/static/uploads/rapporti/" + fileName
-	database.DB.Exec(`INSERT INTO foto_rapporto (rapporto_id, file_path, descrizione) VALUES (?, ?, ?)`,
+	creaConAudit(r, "foto_rapporto", `INSERT INTO foto_rapporto (rapporto_id, file_path, descrizione) VALUES (?, ?, ?)`,
 		rapportoID, webPath, descrizione)
 
 	http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", rapportoID), http.StatusSeeOther)
@@ -655,22 +603,22 @@ func EliminaFotoRapporto(w http.ResponseWriter, r *http.Request) {
 	os.Remove(realPath)
 
 	// Elimina da database
-	database.DB.Exec("DELETE FROM foto_rapporto WHERE id = ?", id)
+	eliminaConAudit(r, "foto_rapporto", id, "DELETE FROM foto_rapporto WHERE id = ?", id)
 
 	http.Redirect(w, r, fmt.Sprintf("/rapporti/dettaglio/%d", rapportoID), http.StatusSeeOther)
 }
 
 // Funzioni helper
 
-func getRapportoFormData(rapportoID int64) map[string]interface{} {
+func getRapportoFormData(rapportoID, compagniaID int64) map[string]interface{} {
 	data := make(map[string]interface{})
 
 	// Lista compagnie
-	compagnie, _ := getCompagnieListRapporti()
+	compagnie, _ := getCompagnieListRapporti(compagniaID)
 	data["Compagnie"] = compagnie
 
 	// Lista navi
-	navi, _ := getNaviList()
+	navi, _ := getNaviList(compagniaID)
 	data["Navi"] = navi
 
 	// Lista porti
@@ -829,17 +777,17 @@ func getFotoRapporto(rapportoID int64) []FotoRapporto {
 	return foto
 }
 
-// getNaviList restituisce lista navi per select
-func getNaviList() ([]map[string]interface{}, error) {
+// getNaviList restituisce lista navi per select, solo della compagnia se diversa da 0
+func getNaviList(compagniaID int64) ([]map[string]interface{}, error) {
 	var navi []map[string]interface{}
 
 	rows, err := database.DB.Query(`
 		SELECT n.id, n.nome, COALESCE(c.nome, '') as compagnia
 		FROM navi n
 		LEFT JOIN compagnie c ON n.compagnia_id = c.id
-		
+		WHERE ? = 0 OR n.compagnia_id = ?
 		ORDER BY c.nome, n.nome
-	`)
+	`, compagniaID, compagniaID)
 	if err != nil {
 		return navi, err
 	}
@@ -883,10 +831,10 @@ func getPortiList() ([]map[string]interface{}, error) {
 }
 
 // getCompagnieListRapporti restituisce lista compagnie per rapporti (funzione indipendente)
-func getCompagnieListRapporti() ([]map[string]interface{}, error) {
+func getCompagnieListRapporti(compagniaID int64) ([]map[string]interface{}, error) {
 	var compagnie []map[string]interface{}
 
-	rows, err := database.DB.Query("SELECT id, nome FROM compagnie ORDER BY nome")
+	rows, err := database.DB.Query("SELECT id, nome FROM compagnie WHERE ? = 0 OR id = ? ORDER BY nome", compagniaID, compagniaID)
 	if err != nil {
 		return compagnie, err
 	}
@@ -910,9 +858,9 @@ func getProdottiList() ([]map[string]interface{}, error) {
 	var prodotti []map[string]interface{}
 
 	rows, err := database.DB.Query(`
-		SELECT id, codice, nome, COALESCE(quantita, 0), unita_misura
+		SELECT id, codice, nome, giacenza, unita_misura
 		FROM prodotti 
-		WHERE deleted_at IS NULL AND COALESCE(quantita, 0) > 0
+		WHERE deleted_at IS NULL AND giacenza > 0
 		ORDER BY nome
 	`)
 	if err != nil {
@@ -1103,14 +1051,21 @@ func EliminaRapportoDefinitivo(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Elimina record correlati
-	database.DB.Exec("DELETE FROM foto_rapporto WHERE rapporto_id = ?", id)
-	database.DB.Exec("DELETE FROM materiale_rapporto WHERE rapporto_id = ?", id)
-	database.DB.Exec("DELETE FROM tecnici_rapporto WHERE rapporto_id = ?", id)
-	database.DB.Exec("DELETE FROM storico_interventi_nave WHERE rapporto_id = ?", id)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("rapporti_intervento", id, figliRapporto...); err != nil {
+			return err
+		}
+
+		// Elimina record correlati
+		tx.Exec("DELETE FROM foto_rapporto WHERE rapporto_id = ?", id)
+		tx.Exec("DELETE FROM materiale_rapporto WHERE rapporto_id = ?", id)
+		tx.Exec("DELETE FROM tecnici_rapporto WHERE rapporto_id = ?", id)
+		tx.Exec("DELETE FROM storico_interventi_nave WHERE rapporto_id = ?", id)
 
-	// Elimina rapporto
-	database.DB.Exec("DELETE FROM rapporti_intervento WHERE id = ?", id)
+		// Elimina rapporto
+		_, err := tx.Exec("DELETE FROM rapporti_intervento WHERE id = ?", id)
+		return err
+	})
 
 	http.Redirect(w, r, "/rapporti", http.StatusSeeOther)
 }
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/database"
+	"furviogest/internal/netdevice"
+)
+
+// ============================================
+// REGOLE GUASTI AUTOMATICI
+// ============================================
+
+// condizioneGuasto descrive una condizione monitorata che puo aprire un guasto
+type condizioneGuasto struct {
+	Nome  string
+	Unita string // unita di misura di soglie e valori
+	// conteggio indica che il valore confrontato con le soglie e il numero di
+	// rilevazioni consecutive; altrimenti e il valore misurato (es. % licenze)
+	conteggio bool
+}
+
+var condizioniGuasto = map[string]condizioneGuasto{
+	"apparato_irraggiungibile": {Nome: "Apparato irraggiungibile", Unita: "controlli consecutivi", conteggio: true},
+	"backup_fallito":           {Nome: "Backup configurazione fallito", Unita: "backup consecutivi", conteggio: true},
+	"licenze_ac":               {Nome: "Licenze AP in esaurimento", Unita: "% licenze utilizzate"},
+	"ap_fault":                 {Nome: "AP in fault", Unita: "scan consecutivi", conteggio: true},
+}
+
+// Ordine di visualizzazione delle regole
+var ordineCondizioniGuasto = []string{"apparato_irraggiungibile", "backup_fallito", "licenze_ac", "ap_fault"}
+
+// livelliGravita ordina le gravita: l'escalation non abbassa mai quella corrente
+var livelliGravita = map[string]int{"bassa": 1, "media": 2, "alta": 3}
+
+// regolaGuasto contiene soglie e gravita configurate per una condizione
+type regolaGuasto struct {
+	Condizione       string
+	Nome             string
+	Unita            string
+	Attiva           bool
+	Gravita          string
+	Soglia           int
+	SogliaEscalation int // 0 = nessuna escalation
+}
+
+// rilevazioneGuasto e l'esito di un controllo di una condizione su un apparato
+type rilevazioneGuasto struct {
+	NaveID       int64
+	Condizione   string
+	TipoApparato string // ac, switch o ap
+	ApparatoID   int64
+	Nome         string
+	Presente     bool // per le condizioni a conteggio
+	Valore       int  // per le condizioni a soglia: presente se raggiunge la soglia
+	Dettaglio    string
+}
+
+// Le valutazioni arrivano in parallelo dal pool di monitoraggio
+var regoleGuastiMu sync.Mutex
+
+// getRegolaGuasto legge la configurazione di una condizione
+func getRegolaGuasto(condizione string) (regolaGuasto, bool) {
+	c, ok := condizioniGuasto[condizione]
+	if !ok {
+		return regolaGuasto{}, false
+	}
+	r := regolaGuasto{Condizione: condizione, Nome: c.Nome, Unita: c.Unita}
+	err := database.DB.QueryRow(`
+		SELECT attiva, gravita, soglia, soglia_escalation FROM regole_guasti WHERE condizione = ?
+	`, condizione).Scan(&r.Attiva, &r.Gravita, &r.Soglia, &r.SogliaEscalation)
+	if err != nil {
+		return r, false
+	}
+	return r, true
+}
+
+// valutaGuasto aggiorna lo stato della condizione per l'apparato: apre il guasto
+// al raggiungimento della soglia, ne alza la gravita oltre la soglia di escalation
+// e lo chiude quando la condizione rientra. Per ogni condizione e apparato resta
+// aperto al massimo un guasto automatico.
+func valutaGuasto(r rilevazioneGuasto) {
+	regoleGuastiMu.Lock()
+	defer regoleGuastiMu.Unlock()
+
+	regola, ok := getRegolaGuasto(r.Condizione)
+	if !ok || !regola.Attiva || r.NaveID == 0 {
+		return
+	}
+	condizione := condizioniGuasto[r.Condizione]
+	presente := r.Presente
+	if !condizione.conteggio {
+		presente = r.Valore >= regola.Soglia
+	}
+
+	if !presente {
+		database.DB.Exec(`
+			DELETE FROM condizioni_guasto WHERE condizione = ? AND tipo_apparato = ? AND apparato_id = ?
+		`, r.Condizione, r.TipoApparato, r.ApparatoID)
+		res, err := database.DB.Exec(`
+			UPDATE guasti_nave
+			SET stato = 'risolto', data_risoluzione = CURRENT_TIMESTAMP,
+			    descrizione_risoluzione = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE nave_id = ? AND tipo = ? AND tipo_apparato = ? AND apparato_id = ? AND stato != 'risolto'
+		`, condizione.Nome+" rientrata - chiuso automaticamente", r.NaveID, r.Condizione, r.TipoApparato, r.ApparatoID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("[Guasti] Chiuso guasto %s per %s (nave %d)", r.Condizione, r.Nome, r.NaveID)
+			}
+		}
+		return
+	}
+
+	ora := time.Now().UTC().Format("2006-01-02 15:04:05")
+	_, err := database.DB.Exec(`
+		INSERT INTO condizioni_guasto (condizione, tipo_apparato, apparato_id, nave_id, rilevazioni, valore, dettaglio, primo_rilevamento, ultimo_rilevamento)
+		VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT(condizione, tipo_apparato, apparato_id) DO UPDATE SET
+			nave_id = excluded.nave_id, rilevazioni = rilevazioni + 1, valore = excluded.valore,
+			dettaglio = excluded.dettaglio, ultimo_rilevamento = excluded.ultimo_rilevamento
+	`, r.Condizione, r.TipoApparato, r.ApparatoID, r.NaveID, r.Valore, r.Dettaglio, ora, ora)
+	if err != nil {
+		log.Printf("[Guasti] Errore aggiornamento condizione %s: %v", r.Condizione, err)
+		return
+	}
+	var rilevazioni int
+	database.DB.QueryRow(`
+		SELECT rilevazioni FROM condizioni_guasto WHERE condizione = ? AND tipo_apparato = ? AND apparato_id = ?
+	`, r.Condizione, r.TipoApparato, r.ApparatoID).Scan(&rilevazioni)
+
+	valore := r.Valore
+	if condizione.conteggio {
+		valore = rilevazioni
+	}
+	if valore < regola.Soglia {
+		return
+	}
+	gravita := regola.Gravita
+	if regola.SogliaEscalation > 0 && valore >= regola.SogliaEscalation {
+		gravita = "alta"
+	}
+
+	descrizione := fmt.Sprintf("%s: %s", condizione.Nome, r.Nome)
+	if r.Dettaglio != "" {
+		descrizione += " - " + r.Dettaglio
+	}
+	var apID interface{}
+	if r.TipoApparato == "ap" {
+		apID = r.ApparatoID
+	}
+
+	var guastoID int64
+	var gravitaAttuale string
+	err = database.DB.QueryRow(`
+		SELECT id, gravita FROM guasti_nave
+		WHERE nave_id = ? AND tipo = ? AND tipo_apparato = ? AND apparato_id = ? AND stato != 'risolto'
+	`, r.NaveID, r.Condizione, r.TipoApparato, r.ApparatoID).Scan(&guastoID, &gravitaAttuale)
+
+	if err == sql.ErrNoRows {
+		// L'indice univoco sui guasti automatici aperti impedisce i duplicati
+		res, err := database.DB.Exec(`
+			INSERT OR IGNORE INTO guasti_nave (nave_id, tipo, ap_id, tipo_apparato, apparato_id, gravita, descrizione, stato, occorrenze, ultimo_rilevamento)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 'aperto', ?, ?)
+		`, r.NaveID, r.Condizione, apID, r.TipoApparato, r.ApparatoID, gravita, descrizione, rilevazioni, ora)
+		if err != nil {
+			log.Printf("[Guasti] Errore apertura guasto %s: %v", r.Condizione, err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("[Guasti] Aperto guasto %s (%s) per %s (nave %d)", r.Condizione, gravita, r.Nome, r.NaveID)
+			if id, err := res.LastInsertId(); err == nil {
+				go notificaGuasto(id, eventoGuastoAperto, "")
+			}
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if livelliGravita[gravita] <= livelliGravita[gravitaAttuale] {
+		gravita = gravitaAttuale
+	} else {
+		log.Printf("[Guasti] Escalation guasto %d a gravita %s (%s)", guastoID, gravita, r.Nome)
+	}
+	database.DB.Exec(`
+		UPDATE guasti_nave
+		SET gravita = ?, descrizione = ?, occorrenze = ?, ultimo_rilevamento = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, gravita, descrizione, rilevazioni, ora, guastoID)
+	if gravita != gravitaAttuale {
+		go notificaGuasto(guastoID, eventoGuastoEscalation, gravitaAttuale)
+	}
+}
+
+// valutaEsitoMonitoraggio aggiorna le condizioni di raggiungibilita e backup
+// con l'esito di un'attivita del pool su un apparato di nave
+func valutaEsitoMonitoraggio(job string, a *attivitaApparato, err error) {
+	// Il polling SNMP non dice nulla sull'accesso SSH: una community errata produce timeout
+	if a.NaveID == 0 || job == "snmp_poll" {
+		return
+	}
+
+	irraggiungibile := err != nil && (errors.Is(err, netdevice.ErrTimeout) ||
+		errors.Is(err, netdevice.ErrConnessioneRifiutata) || errors.Is(err, context.DeadlineExceeded))
+	var dettaglio string
+	if err != nil {
+		dettaglio = err.Error()
+	}
+	base := rilevazioneGuasto{
+		NaveID:       a.NaveID,
+		TipoApparato: a.TipoApparato,
+		ApparatoID:   a.ApparatoID,
+		Nome:         fmt.Sprintf("%s (%s)", a.Nome, a.IP),
+		Dettaglio:    dettaglio,
+	}
+
+	r := base
+	r.Condizione = "apparato_irraggiungibile"
+	r.Presente = irraggiungibile
+	valutaGuasto(r)
+
+	// Con l'apparato irraggiungibile l'esito del backup non e significativo
+	if job == "backup_config" && !irraggiungibile {
+		r := base
+		r.Condizione = "backup_fallito"
+		r.Presente = err != nil
+		valutaGuasto(r)
+	}
+}
+
+// ============================================
+// PAGINA REGOLE GUASTI
+// ============================================
+
+// condizioneInCorso rappresenta una condizione rilevata su un apparato
+type condizioneInCorso struct {
+	NaveID            int64
+	NaveNome          string
+	Condizione        string
+	TipoApparato      string
+	ApparatoID        int64
+	Rilevazioni       int
+	Valore            int
+	Dettaglio         string
+	PrimoRilevamento  string
+	UltimoRilevamento string
+}
+
+// RegoleGuasti mostra e salva le soglie delle regole di apertura automatica dei guasti
+func RegoleGuasti(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Regole Guasti Automatici - FurvioGest", r)
+
+	if r.Method == http.MethodPost {
+		if err := salvaRegoleGuasti(r); err != nil {
+			data.Error = err.Error()
+		} else {
+			http.Redirect(w, r, "/monitoraggio/regole-guasti?success=salvato", http.StatusSeeOther)
+			return
+		}
+	}
+	if r.URL.Query().Get("success") == "salvato" {
+		data.Success = "Regole salvate"
+	}
+
+	var regole []regolaGuasto
+	for _, condizione := range ordineCondizioniGuasto {
+		if regola, ok := getRegolaGuasto(condizione); ok {
+			regole = append(regole, regola)
+		}
+	}
+
+	var inCorso []condizioneInCorso
+	rows, err := database.DB.Query(`
+		SELECT c.nave_id, COALESCE(n.nome, ''), c.condizione, c.tipo_apparato, c.apparato_id,
+		       c.rilevazioni, c.valore, COALESCE(c.dettaglio, ''), c.primo_rilevamento, c.ultimo_rilevamento
+		FROM condizioni_guasto c
+		LEFT JOIN navi n ON c.nave_id = n.id
+		ORDER BY c.ultimo_rilevamento DESC
+	`)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var c condizioneInCorso
+			var primo, ultimo time.Time
+			rows.Scan(&c.NaveID, &c.NaveNome, &c.Condizione, &c.TipoApparato, &c.ApparatoID,
+				&c.Rilevazioni, &c.Valore, &c.Dettaglio, &primo, &ultimo)
+			c.PrimoRilevamento = primo.Local().Format("02/01/2006 15:04")
+			c.UltimoRilevamento = ultimo.Local().Format("02/01/2006 15:04")
+			if cond, ok := condizioniGuasto[c.Condizione]; ok {
+				c.Condizione = cond.Nome
+			}
+			inCorso = append(inCorso, c)
+		}
+	}
+
+	data.Data = map[string]interface{}{
+		"Regole":  regole,
+		"InCorso": inCorso,
+	}
+	renderTemplate(w, "regole_guasti.html", data)
+}
+
+// salvaRegoleGuasti valida e salva le soglie di tutte le regole
+func salvaRegoleGuasti(r *http.Request) error {
+	r.ParseForm()
+	var regole []regolaGuasto
+	for _, condizione := range ordineCondizioniGuasto {
+		regola := regolaGuasto{
+			Condizione: condizione,
+			Nome:       condizioniGuasto[condizione].Nome,
+			Attiva:     r.FormValue("attiva_"+condizione) == "1",
+			Gravita:    r.FormValue("gravita_" + condizione),
+		}
+		var err error
+		if regola.Soglia, err = strconv.Atoi(r.FormValue("soglia_" + condizione)); err != nil || regola.Soglia < 1 {
+			return fmt.Errorf("%s: la soglia deve essere un numero maggiore di zero", regola.Nome)
+		}
+		if regola.SogliaEscalation, err = strconv.Atoi(r.FormValue("escalation_" + condizione)); err != nil || regola.SogliaEscalation < 0 {
+			return fmt.Errorf("%s: soglia di escalation non valida", regola.Nome)
+		}
+		if regola.SogliaEscalation > 0 && regola.SogliaEscalation < regola.Soglia {
+			return fmt.Errorf("%s: la soglia di escalation non puo essere inferiore a quella di apertura", regola.Nome)
+		}
+		if _, ok := livelliGravita[regola.Gravita]; !ok {
+			return fmt.Errorf("%s: gravita non valida", regola.Nome)
+		}
+		if !condizioniGuasto[condizione].conteggio && (regola.Soglia > 100 || regola.SogliaEscalation > 100) {
+			return fmt.Errorf("%s: le soglie percentuali non possono superare 100", regola.Nome)
+		}
+		regole = append(regole, regola)
+	}
+
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("regole_guasti", "1 = 1"); err != nil {
+			return err
+		}
+		for _, regola := range regole {
+			_, err := tx.Exec(`
+				UPDATE regole_guasti
+				SET attiva = ?, gravita = ?, soglia = ?, soglia_escalation = ?, updated_at = CURRENT_TIMESTAMP
+				WHERE condizione = ?
+			`, regola.Attiva, regola.Gravita, regola.Soglia, regola.SogliaEscalation, regola.Condizione)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("errore salvataggio regole: %v", err)
+	}
+	return nil
+}
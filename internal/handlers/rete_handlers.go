@@ -1,25 +1,24 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
+	"furviogest/internal/netdevice"
 )
 
 // ============================================
@@ -86,6 +85,12 @@ type ConfigBackup struct {
 	FileSize      int64
 	HashMD5       string
 	CreatedAt     string
+
+	// Confronto con il backup precedente dello stesso apparato
+	BackupPrecedenteID int64
+	Cambiato           bool
+	RigheAggiunte      int
+	RigheRimosse       int
 }
 
 type ReteNavePageData struct {
@@ -110,75 +115,139 @@ type NaveInfo struct {
 
 // GestioneReteNave mostra la pagina gestione rete di una nave
 
-// executeSSHCommand esegue un comando SSH usando expect per compatibilità Huawei
-// executeSwitchCommand esegue comando usando il protocollo configurato (ssh o telnet)
-func executeSwitchCommand(sw *SwitchNave, command string) (string, error) {
-	if sw.Protocollo == "telnet" {
-		return executeTelnetCommand(sw.IP, sw.SSHUser, sw.SSHPass, command)
+// ============================================
+// ESECUZIONE COMANDI SU APPARATI
+// ============================================
+
+// configApparato costruisce i parametri di connessione netdevice per un apparato.
+// La password e quella salvata nel database e viene decifrata solo qui.
+func configApparato(ip string, porta int, user, pass, protocollo, marca string) netdevice.Config {
+	return netdevice.Config{
+		IP:             ip,
+		Porta:          porta,
+		Username:       user,
+		Password:       segreti.Leggi(pass),
+		Protocollo:     protocollo,
+		Marca:          marca,
+		TimeoutComando: 300 * time.Second,
 	}
-	// Default: SSH con fallback a telnet
-	return executeSSHBackup(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, command)
 }
 
-func executeSSHCommand(ip string, port int, user, pass, command string) (string, error) {
-	expectScript := fmt.Sprintf(`
-log_user 1
-set timeout 180
-spawn ssh -o StrictHostKeyChecking=no -o KexAlgorithms=+diffie-hellman-group14-sha1,diffie-hellman-group1-sha1,diffie-hellman-group-exchange-sha1 -o HostKeyAlgorithms=+ssh-rsa -o ConnectTimeout=30 -p %d %s@%s
-
-expect {
-    "assword:" {
-        send "%s\r"
-        exp_continue
-    }
-    ">" {
-        send "%s\r"
-    }
-    -re {<[^>]+>} {
-        send "%s\r"
-    }
-    timeout {
-        exit 4
-    }
-    "Permission denied" {
-        exit 1
-    }
+// configRete restituisce i parametri di connessione dello switch
+func (sw *SwitchNave) configRete() netdevice.Config {
+	return configApparato(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, sw.Protocollo, sw.Marca)
 }
 
-expect {
-    -re {---- More ----} {
-        send " "
-        exp_continue
-    }
-    -re {\[Y/N\]} {
-        send "N\r"
-        exp_continue
-    }
-    ">" {
-        send "quit\r"
-    }
-    -re {<[^>]+>} {
-        send "quit\r"
-    }
-    timeout {
-        send "quit\r"
-    }
+// configRete restituisce i parametri di connessione dell'AC (sempre Huawei)
+func (ac *AccessController) configRete() netdevice.Config {
+	return configApparato(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, ac.Protocollo, "huawei")
 }
 
-expect eof
-`, port, user, ip, pass, command, command)
+// apriSessioneApparato apre la sessione via SSH e ritenta via telnet se la sessione SSH non parte
+func apriSessioneApparato(ctx context.Context, cfg netdevice.Config) (*netdevice.Sessione, error) {
+	s, err := netdevice.Connetti(ctx, cfg)
+	if err != nil && cfg.Protocollo != "telnet" && !errors.Is(err, netdevice.ErrAutenticazione) {
+		log.Printf("[SSH] Fallback a telnet per %s: %v", cfg.IP, err)
+		cfg.Protocollo = "telnet"
+		cfg.Porta = 23
+		return netdevice.Connetti(ctx, cfg)
+	}
+	return s, err
+}
 
-	cmd := exec.Command("expect", "-c", expectScript)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// conApparato apre una sessione sull'apparato e invoca fn con il driver della marca configurata
+func conApparato(ctx context.Context, cfg netdevice.Config, fn func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error) error {
+	d, err := netdevice.DriverPer(cfg.Marca)
+	if err != nil {
+		return err
+	}
 
-	err := cmd.Run()
+	s, err := apriSessioneApparato(ctx, cfg)
 	if err != nil {
-		return "", fmt.Errorf("SSH error: %v - %s", err, stderr.String())
+		return err
 	}
+	defer s.Chiudi()
+
+	return fn(ctx, d, s)
+}
 
-	return stdout.String(), nil
+// leggiRunningConfig scarica la configurazione corrente dell'apparato
+func leggiRunningConfig(ctx context.Context, cfg netdevice.Config) (string, error) {
+	var output string
+	err := conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		output, err = d.RunningConfig(ctx, s)
+		return err
+	})
+	return output, err
+}
+
+// leggiPorte conta porte totali e libere dell'apparato
+func leggiPorte(ctx context.Context, cfg netdevice.Config) (totali, libere int, err error) {
+	err = conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		totali, libere, err = d.Porte(ctx, s)
+		return err
+	})
+	return totali, libere, err
+}
+
+// leggiVersione recupera versione firmware e modello dell'apparato
+func leggiVersione(ctx context.Context, cfg netdevice.Config) (versione, modello string, err error) {
+	err = conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		versione, modello, err = d.Versione(ctx, s)
+		return err
+	})
+	return versione, modello, err
+}
+
+// leggiAccessPoint legge l'elenco AP dall'access controller
+func leggiAccessPoint(ctx context.Context, cfg netdevice.Config) ([]netdevice.InfoAP, error) {
+	var aps []netdevice.InfoAP
+	err := conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		aps, err = d.AccessPoint(ctx, s)
+		return err
+	})
+	return aps, err
+}
+
+// associaAPSwitch rileva le porte a cui sono collegati gli AP: via LLDP se supportato, altrimenti dalla tabella MAC
+func associaAPSwitch(ctx context.Context, sw *SwitchNave) (int, error) {
+	var trovati int
+	err := conApparato(ctx, sw.configRete(), func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		vicini, err := d.VicinatoLLDP(ctx, s)
+		if err == nil {
+			salvaVicinatoLLDP(sw, vicini)
+			for _, v := range vicini {
+				// Considera solo i vicini che risultano come AP della nave
+				var count int
+				database.DB.QueryRow("SELECT COUNT(*) FROM access_point WHERE nave_id = ? AND ap_name = ?", sw.NaveID, v.Nome).Scan(&count)
+				if count > 0 {
+					updateAPSwitchPortByName(sw.NaveID, sw.ID, v.Nome, v.PortaLocale)
+					trovati++
+				}
+			}
+			return nil
+		}
+		if !errors.Is(err, netdevice.ErrNonSupportato) {
+			return err
+		}
+
+		voci, err := d.TabellaMAC(ctx, s)
+		if err != nil {
+			return err
+		}
+		// La tabella MAC elenca anche i client: contano solo le voci che corrispondono a un AP
+		for _, v := range voci {
+			if updateAPSwitchPort(sw.NaveID, sw.ID, v.MAC, v.Porta) {
+				trovati++
+			}
+		}
+		return nil
+	})
+	return trovati, err
 }
 
 func GestioneReteNave_OLD(w http.ResponseWriter, r *http.Request) {
@@ -252,24 +321,37 @@ func SalvaAccessController(w http.ResponseWriter, r *http.Request) {
 		protocollo = "ssh"
 	}
 
-	// Verifica se esiste già un AC per questa nave
-	var existingID int64
-	err := database.DB.QueryRow("SELECT id FROM access_controller WHERE nave_id = ?", naveID).Scan(&existingID)
-
-	if err == sql.ErrNoRows {
-		// Inserisci nuovo
-		_, err = database.DB.Exec(`
-			INSERT INTO access_controller (nave_id, ip, ssh_port, ssh_user, ssh_pass, licenze_totali, licenze_utilizzate)
-			VALUES (?, ?, ?, ?, ?, ?, ?)
-		`, naveID, ip, sshPort, sshUser, sshPass, licenzeTotali, licenzeUtilizzate)
-	} else if err == nil {
-		// Aggiorna esistente
-		_, err = database.DB.Exec(`
-			UPDATE access_controller SET ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = ?, licenze_totali = ?, licenze_utilizzate = ?, updated_at = CURRENT_TIMESTAMP
-			WHERE nave_id = ?
-		`, ip, sshPort, sshUser, sshPass, licenzeTotali, licenzeUtilizzate, naveID)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("access_controller", "nave_id = ?", naveID); err != nil {
+			return err
+		}
+
+		// Verifica se esiste già un AC per questa nave
+		var existingID int64
+		err := tx.QueryRow("SELECT id FROM access_controller WHERE nave_id = ?", naveID).Scan(&existingID)
+
+		if err == sql.ErrNoRows {
+			// Inserisci nuovo
+			_, err = tx.Exec(`
+				INSERT INTO access_controller (nave_id, ip, ssh_port, ssh_user, ssh_pass, licenze_totali, licenze_utilizzate)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, naveID, ip, sshPort, sshUser, sshPassCifrata, licenzeTotali, licenzeUtilizzate)
+		} else if err == nil {
+			// Aggiorna esistente
+			_, err = tx.Exec(`
+				UPDATE access_controller SET ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = CASE WHEN ? = '' THEN ssh_pass ELSE ? END, licenze_totali = ?, licenze_utilizzate = ?, updated_at = CURRENT_TIMESTAMP
+				WHERE nave_id = ?
+			`, ip, sshPort, sshUser, sshPassCifrata, sshPassCifrata, licenzeTotali, licenzeUtilizzate, naveID)
+		}
+		return err
+	})
+
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -293,12 +375,22 @@ func EliminaAccessController(w http.ResponseWriter, r *http.Request) {
 			os.Remove(filePath)
 		}
 	}
-	// Elimina i record di backup dal database per AC
-	database.DB.Exec("DELETE FROM config_backup WHERE nave_id = ? AND tipo_apparato = 'ac'", naveID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("access_controller", "nave_id = ?", naveID); err != nil {
+			return err
+		}
+		// Elimina i record di backup dal database per AC
+		if _, err := tx.Exec("DELETE FROM config_backup WHERE nave_id = ? AND tipo_apparato = 'ac'", naveID); err != nil {
+			return err
+		}
 
-	database.DB.Exec("DELETE FROM access_controller WHERE nave_id = ?", naveID)
-	// Elimina anche gli AP associati
-	database.DB.Exec("DELETE FROM access_point WHERE nave_id = ?", naveID)
+		if _, err := tx.Exec("DELETE FROM access_controller WHERE nave_id = ?", naveID); err != nil {
+			return err
+		}
+		// Elimina anche gli AP associati
+		_, err := tx.Exec("DELETE FROM access_point WHERE nave_id = ?", naveID)
+		return err
+	})
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/rete/%d", naveID), http.StatusSeeOther)
 }
@@ -335,14 +427,20 @@ func NuovoSwitch(w http.ResponseWriter, r *http.Request) {
 	if nomeForm != "" {
 		nome = nomeForm
 	} else {
-		nome = getSwitchHostname(ip, sshPort, sshUser, sshPass, marca, protocollo)
+		nome = getSwitchHostname(r.Context(), ip, sshPort, sshUser, sshPass, marca, protocollo)
 	}
 	log.Printf("[NUOVO SWITCH] Nome: %s", nome)
 
-	_, err := database.DB.Exec(`
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = creaConAudit(r, "switch_nave", `
 		INSERT INTO switch_nave (nave_id, nome, marca, modello, ip, ssh_port, ssh_user, ssh_pass, note, protocollo)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, naveID, nome, marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo)
+	`, naveID, nome, marca, modello, ip, sshPort, sshUser, sshPassCifrata, note, protocollo)
 
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -387,10 +485,17 @@ func ModificaSwitch(w http.ResponseWriter, r *http.Request) {
 		protocollo = "ssh"
 	}
 
-	_, err := database.DB.Exec(`
-		UPDATE switch_nave SET nome = CASE WHEN ? = ' THEN nome ELSE ? END, marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = ?, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = modificaConAudit(r, "switch_nave", switchID, `
+		UPDATE switch_nave SET nome = CASE WHEN ? = '' THEN nome ELSE ? END, marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?,
+			ssh_pass = CASE WHEN ? = '' THEN ssh_pass ELSE ? END, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
-	`, nome, nome, marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo, switchID)
+	`, nome, nome, marca, modello, ip, sshPort, sshUser, sshPassCifrata, sshPassCifrata, note, protocollo, switchID)
 
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -418,8 +523,16 @@ func EliminaSwitch(w http.ResponseWriter, r *http.Request) {
 			os.Remove(filePath)
 		}
 	}
-	database.DB.Exec("DELETE FROM config_backup WHERE tipo_apparato = 'switch' AND apparato_id = ?", switchID)
-	database.DB.Exec("DELETE FROM switch_nave WHERE id = ?", switchID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("switch_nave", switchID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM config_backup WHERE tipo_apparato = 'switch' AND apparato_id = ?", switchID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM switch_nave WHERE id = ?", switchID)
+		return err
+	})
 
 	http.Redirect(w, r, fmt.Sprintf("/navi/rete/%d", naveID), http.StatusSeeOther)
 }
@@ -438,7 +551,7 @@ func APIScanAccessPoints(w http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{
 		"success": false,
 		"message": "",
-		"aps":     []map[string]string{},
+		"aps":     []netdevice.InfoAP{},
 	}
 
 	// Verifica che la nave non sia ferma per lavori
@@ -457,18 +570,14 @@ func APIScanAccessPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Esegui comando SSH su AC Huawei usando expect
-	output, err := executeSSHCommand(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, "display ap all")
+	aps, err := leggiAccessPoint(r.Context(), ac.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse output Huawei AC
-	aps := parseHuaweiAPOutput(string(output))
-
-	log.Printf("[SCAN AP] Output raw: %s", string(output))
+	log.Printf("[SCAN AP] Nave %d: trovati %d AP", naveID, len(aps))
 	// Aggiorna database
 	for _, ap := range aps {
 		updateOrCreateAP(naveID, ac.ID, ap)
@@ -484,7 +593,7 @@ func APIScanAccessPoints(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// APIScanMacTable esegue scan tabella MAC da uno switch
+// APIScanMacTable associa gli AP alle porte di uno switch (LLDP o tabella MAC)
 func APIScanMacTable(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -494,7 +603,6 @@ func APIScanMacTable(w http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{
 		"success": false,
 		"message": "",
-		"entries": []map[string]string{},
 	}
 
 	sw := getSwitchByID(switchID)
@@ -504,43 +612,18 @@ func APIScanMacTable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Comando diverso in base alla marca
-	var cmdStr string
-	if sw.Marca == "huawei" {
-		cmdStr = "display lldp neighbor brief"
-	} else { // hp
-		cmdStr = "show mac-address"
-	}
-
-	// Esegui comando SSH usando expect
-	output, err := executeSwitchCommand(sw, cmdStr)
+	trovati, err := associaAPSwitch(r.Context(), sw)
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse output
-	var entries []map[string]string
-	if sw.Marca == "huawei" {
-		entries = parseHuaweiLLDPOutput(string(output), sw.ID, sw.Nome, sw.NaveID)
-	} else {
-		entries = parseHPMacTable(string(output))
-	}
-
-	// Aggiorna porta degli AP in base al MAC
-	for _, entry := range entries {
-		mac := entry["ap_name"]
-		port := entry["port"]
-		updateAPSwitchPort(sw.NaveID, switchID, mac, port)
-	}
-
 	// Aggiorna timestamp
 	database.DB.Exec("UPDATE switch_nave SET ultimo_check = CURRENT_TIMESTAMP WHERE id = ?", switchID)
 
 	result["success"] = true
-	result["message"] = fmt.Sprintf("Trovate %d entry MAC", len(entries))
-	result["entries"] = entries
+	result["message"] = fmt.Sprintf("Trovate %d entry", trovati)
 
 	json.NewEncoder(w).Encode(result)
 }
@@ -567,30 +650,12 @@ func APIScanPorts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Comando diverso in base alla marca
-	var cmdStr string
-	if sw.Marca == "huawei" {
-		cmdStr = "display interface brief"
-	} else { // hp
-		cmdStr = "show interface brief"
-	}
-
-	// Esegui comando SSH
-	output, err := executeSwitchCommand(sw, cmdStr)
+	porteTotali, porteLibere, err := leggiPorte(r.Context(), sw.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
-
-	// Parse output per contare porte
-	log.Printf("[SCAN PORTS] Output ricevuto (len=%d): %s", len(output), output[:min(500, len(output))])
-	var porteTotali, porteLibere int
-	if sw.Marca == "huawei" {
-		porteTotali, porteLibere = parseHuaweiPortsOutput(string(output))
-	} else {
-		porteTotali, porteLibere = parseHPPortsOutput(string(output))
-	}
 	log.Printf("[SCAN PORTS] Risultato: totali=%d, libere=%d", porteTotali, porteLibere)
 
 	// Aggiorna database
@@ -604,44 +669,6 @@ func APIScanPorts(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// parseHuaweiPortsOutput analizza output di display interface brief
-func parseHuaweiPortsOutput(output string) (totali, libere int) {
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Cerca righe che iniziano con GigabitEthernet, 10GigabitEthernet, GE, XGE, MultiGE, 25GE
-		if strings.HasPrefix(line, "GigabitEthernet") || strings.HasPrefix(line, "10GigabitEthernet") ||
-			strings.HasPrefix(line, "GE") || strings.HasPrefix(line, "XGE") || strings.HasPrefix(line, "Eth") ||
-			strings.HasPrefix(line, "MultiGE") || strings.HasPrefix(line, "25GE") || strings.HasPrefix(line, "40GE") ||
-			strings.HasPrefix(line, "100GE") {
-			totali++
-			// Porta libera se stato e down o *down
-			lineLower := strings.ToLower(line)
-			if strings.Contains(lineLower, "down") && !strings.Contains(lineLower, "up") {
-				libere++
-			}
-		}
-	}
-	return totali, libere
-}
-
-// parseHPPortsOutput analizza output di show interface brief HP
-func parseHPPortsOutput(output string) (totali, libere int) {
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// HP usa formato diverso, cerca porte ethernet
-		if strings.Contains(line, "Ethernet") || strings.HasPrefix(line, "1/") || strings.HasPrefix(line, "2/") {
-			totali++
-			lineLower := strings.ToLower(line)
-			if strings.Contains(lineLower, "down") || strings.Contains(lineLower, "disabled") {
-				libere++
-			}
-		}
-	}
-	return totali, libere
-}
-
 // APIBackupConfig esegue backup configurazione
 func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -656,11 +683,10 @@ func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 		"message": "",
 	}
 
-	var ip, sshUser, sshPass, nome string
-	var sshPort int
+	var nome string
 	var currentSwitch *SwitchNave
 	var naveID int64
-	var cmdStr string
+	var cfg netdevice.Config
 
 	if tipoApparato == "ac" {
 		var ac AccessController
@@ -672,13 +698,9 @@ func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(result)
 			return
 		}
-		ip = ac.IP
-		sshUser = ac.SSHUser
-		sshPass = ac.SSHPass
-		sshPort = ac.SSHPort
 		naveID = ac.NaveID
 		nome = "AC"
-		cmdStr = "display current-configuration"
+		cfg = ac.configRete()
 	} else {
 		currentSwitch = getSwitchByID(apparatoID)
 		if currentSwitch == nil {
@@ -686,27 +708,13 @@ func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(result)
 			return
 		}
-		ip = currentSwitch.IP
-		sshUser = currentSwitch.SSHUser
-		sshPass = currentSwitch.SSHPass
-		sshPort = currentSwitch.SSHPort
 		naveID = currentSwitch.NaveID
 		nome = currentSwitch.Nome
-		if currentSwitch.Marca == "huawei" {
-			cmdStr = "display current-configuration"
-		} else {
-			cmdStr = "show running-config"
-		}
+		cfg = currentSwitch.configRete()
 	}
 
-	// Esegui comando backup usando expect
-	var output string
-	var err error
-	if currentSwitch != nil {
-		output, err = executeSwitchCommand(currentSwitch, cmdStr)
-	} else {
-		output, err = executeSSHBackup(ip, sshPort, sshUser, sshPass, cmdStr)
-	}
+	// Scarica la configurazione tramite il driver della marca
+	output, err := leggiRunningConfig(r.Context(), cfg)
 	log.Printf("[BACKUP] Switch %s output len: %d, err: %v", nome, len(output), err)
 	if err != nil {
 		result["message"] = "Errore backup: " + err.Error()
@@ -714,48 +722,17 @@ func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calcola hash MD5
-	hash := md5.Sum([]byte(output))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Verifica se config è cambiata rispetto all'ultimo backup
-	var lastHash string
-	database.DB.QueryRow(`
-		SELECT hash_md5 FROM config_backup
-		WHERE nave_id = ? AND tipo_apparato = ? AND apparato_id = ?
-		ORDER BY created_at DESC LIMIT 1
-	`, naveID, tipoApparato, apparatoID).Scan(&lastHash)
-
-	if lastHash == hashStr {
-		result["success"] = true
-		result["message"] = "Configurazione non cambiata dall'ultimo backup"
-		json.NewEncoder(w).Encode(result)
-		return
-	}
-
-	// Salva file
-	backupDir := filepath.Join("data", "backups", fmt.Sprintf("nave_%d", naveID))
-	os.MkdirAll(backupDir, 0755)
-
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("%s_%s_%s.cfg", tipoApparato, nome, timestamp)
-	filePath := filepath.Join(backupDir, filename)
-
-	err = os.WriteFile(filePath, []byte(output), 0644)
+	// Salva solo se la configurazione e cambiata rispetto all'ultimo backup
+	esito, err := salvaBackupConfig(&backupConfig{
+		Tabella:      "config_backup",
+		NaveID:       naveID,
+		TipoApparato: tipoApparato,
+		ApparatoID:   apparatoID,
+		Nome:         nome,
+		Marca:        cfg.Marca,
+	}, output)
 	if err != nil {
-		result["message"] = "Errore salvataggio file: " + err.Error()
-		json.NewEncoder(w).Encode(result)
-		return
-	}
-
-	// Inserisci record DB
-	_, err = database.DB.Exec(`
-		INSERT INTO config_backup (nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, naveID, tipoApparato, apparatoID, nome, filePath, len(output), hashStr)
-
-	if err != nil {
-		result["message"] = "Errore DB: " + err.Error()
+		result["message"] = "Errore backup: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
@@ -765,24 +742,32 @@ func APIBackupConfig(w http.ResponseWriter, r *http.Request) {
 		database.DB.Exec("UPDATE access_controller SET ultimo_backup = CURRENT_TIMESTAMP WHERE id = ?", apparatoID)
 	} else {
 		database.DB.Exec("UPDATE switch_nave SET ultimo_backup = CURRENT_TIMESTAMP WHERE id = ?", apparatoID)
-		// Estrai e aggiorna modello se non presente
 		// Recupera modello se non presente
-		var currentModello string
-		database.DB.QueryRow("SELECT COALESCE(modello, '') FROM switch_nave WHERE id = ?", apparatoID).Scan(&currentModello)
-		if currentModello == "" {
-			versionOutput, _ := executeSwitchCommand(currentSwitch, "display version")
-			_, model := parseVersionOutput(versionOutput, "huawei")
-			if model != "" {
-				database.DB.Exec("UPDATE switch_nave SET modello = ? WHERE id = ?", model, apparatoID)
-			}
-		}
+		aggiornaModelloSeMancante(r.Context(), "switch_nave", apparatoID, cfg)
 	}
 
 	result["success"] = true
-	result["message"] = "Backup completato"
+	result["message"] = esito.messaggio()
+	result["backup_id"] = esito.ID
+	result["cambiato"] = !esito.Invariato
 	json.NewEncoder(w).Encode(result)
 }
 
+// aggiornaModelloSeMancante legge il modello dall'apparato se non ancora valorizzato
+func aggiornaModelloSeMancante(ctx context.Context, tabella string, apparatoID int64, cfg netdevice.Config) string {
+	var currentModello string
+	database.DB.QueryRow(fmt.Sprintf("SELECT COALESCE(modello, '') FROM %s WHERE id = ?", tabella), apparatoID).Scan(&currentModello)
+	if currentModello != "" {
+		return ""
+	}
+	_, model, err := leggiVersione(ctx, cfg)
+	if err != nil || model == "" {
+		return ""
+	}
+	database.DB.Exec(fmt.Sprintf("UPDATE %s SET modello = ? WHERE id = ?", tabella), model, apparatoID)
+	return model
+}
+
 // APIDownloadConfig serve il download di un backup
 func APIDownloadConfig(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/rete/download-config/")
@@ -814,6 +799,29 @@ func APIDownloadConfig(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, file)
 }
 
+// credenzialiApparatoSSH legge indirizzo e credenziali salvate di un apparato,
+// con la password gia decifrata
+func credenzialiApparatoSSH(tipo string, id int64) (ip string, porta int, user, pass, protocollo string, err error) {
+	query := map[string]string{
+		"ac":                 "SELECT ip, ssh_port, ssh_user, ssh_pass, 'ssh' FROM access_controller WHERE id = ?",
+		"switch":             "SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM switch_nave WHERE id = ?",
+		"ac_ufficio":         "SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM ac_ufficio WHERE id = ?",
+		"switch_ufficio":     "SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM switch_ufficio WHERE id = ?",
+		"switch_sala_server": "SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM switch_sala_server WHERE id = ?",
+	}[tipo]
+	if query == "" {
+		return "", 0, "", "", "", fmt.Errorf("tipo apparato non valido")
+	}
+	if err = database.DB.QueryRow(query, id).Scan(&ip, &porta, &user, &pass, &protocollo); err != nil {
+		return "", 0, "", "", "", fmt.Errorf("apparato non trovato")
+	}
+	pass, err = segreti.Decifra(pass)
+	if err != nil {
+		return "", 0, "", "", "", fmt.Errorf("password non leggibile: %v", err)
+	}
+	return ip, porta, user, pass, protocollo, nil
+}
+
 // APITestSSH testa la connessione SSH
 func APITestSSH(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -824,6 +832,19 @@ func APITestSSH(w http.ResponseWriter, r *http.Request) {
 	pass := r.URL.Query().Get("pass")
 	protocollo := r.URL.Query().Get("protocollo")
 
+	// Con tipo e id si prova un apparato salvato: indirizzo e credenziali
+	// vengono dal database e la password non passa dal browser
+	if id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64); id > 0 {
+		var sshPort int
+		var err error
+		ip, sshPort, user, pass, protocollo, err = credenzialiApparatoSSH(r.URL.Query().Get("tipo"), id)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": err.Error()})
+			return
+		}
+		port = strconv.Itoa(sshPort)
+	}
+
 	if port == "" {
 		if protocollo == "telnet" {
 			port = "23"
@@ -837,72 +858,43 @@ func APITestSSH(w http.ResponseWriter, r *http.Request) {
 		"message": "",
 	}
 
-	var expectScript string
-	if protocollo == "telnet" {
-		// Script expect per Telnet
-		expectScript = fmt.Sprintf(`
-set timeout 60
-spawn telnet %s %s
-expect {
-    "*ogin*" { send "%s\r"; exp_continue }
-    "*sername*" { send "%s\r"; exp_continue }
-    "*assword*" { send "%s\r"; exp_continue }
-    "<*>" { exit 0 }
-    ">" { exit 0 }
-    "Login incorrect" { exit 1 }
-    "Authentication failed" { exit 1 }
-    "Connection refused" { exit 2 }
-    "Unable to connect" { exit 2 }
-    timeout { exit 4 }
-    eof { exit 5 }
-}
-`, ip, port, user, user, pass)
-	} else {
-		// Script expect per SSH
-		expectScript = fmt.Sprintf(`
-set timeout 60
-spawn ssh -o StrictHostKeyChecking=no -o KexAlgorithms=+diffie-hellman-group14-sha1,diffie-hellman-group1-sha1,diffie-hellman-group-exchange-sha1 -o HostKeyAlgorithms=+ssh-rsa -p %s %s@%s
-expect {
-    "*assword*" { send "%s\r"; exp_continue }
-    "<*>" { exit 0 }
-    ">" { exit 0 }
-    "Permission denied" { exit 1 }
-    "Connection refused" { exit 2 }
-    "Connection timed out" { exit 3 }
-    timeout { exit 4 }
-    eof { exit 0 }
-}
-`, port, user, ip, pass)
-	}
+	porta, _ := strconv.Atoi(port)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
 
-	cmd := exec.Command("expect", "-c", expectScript)
-	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
-	
-	log.Printf("[%s TEST] IP: %s, Port: %s, User: %s, ExitCode: %v, Output: %s", 
-		strings.ToUpper(protocollo), ip, port, user, cmd.ProcessState.ExitCode(), outputStr)
+	sessione, err := netdevice.Connetti(ctx, netdevice.Config{
+		IP:                 ip,
+		Porta:              porta,
+		Username:           user,
+		Password:           pass,
+		Protocollo:         protocollo,
+		ComandoPaginazione: "-",
+		TimeoutConnessione: 60 * time.Second,
+	})
+
+	log.Printf("[%s TEST] IP: %s, Port: %s, User: %s, Esito: %v",
+		strings.ToUpper(protocollo), ip, port, user, err)
 
-	exitCode := cmd.ProcessState.ExitCode()
 	protoName := "SSH"
 	if protocollo == "telnet" {
 		protoName = "Telnet"
 	}
-	
-	if exitCode == 0 && (strings.Contains(outputStr, "<") || strings.Contains(outputStr, ">") || strings.Contains(outputStr, "Huawei") || strings.Contains(outputStr, "HUAWEI")) {
+
+	switch {
+	case err == nil:
+		sessione.Chiudi()
 		result["success"] = true
 		result["message"] = fmt.Sprintf("Connessione %s riuscita", protoName)
-	} else if exitCode == 1 || strings.Contains(outputStr, "Permission denied") || strings.Contains(outputStr, "Login incorrect") || strings.Contains(outputStr, "Authentication failed") {
+	case errors.Is(err, netdevice.ErrAutenticazione):
 		result["message"] = "Password errata o utente non valido"
-	} else if exitCode == 2 || strings.Contains(outputStr, "Connection refused") || strings.Contains(outputStr, "Unable to connect") {
+	case errors.Is(err, netdevice.ErrConnessioneRifiutata):
 		result["message"] = fmt.Sprintf("Connessione rifiutata - porta %s chiusa", protoName)
-	} else if exitCode == 3 || exitCode == 4 || strings.Contains(outputStr, "timed out") {
+	case errors.Is(err, netdevice.ErrTimeout):
 		result["message"] = "Timeout - apparato non raggiungibile"
-	} else if exitCode == 5 {
+	case errors.Is(err, netdevice.ErrConnessioneChiusa):
 		result["message"] = "Connessione chiusa inaspettatamente"
-	} else if err != nil {
+	default:
 		result["message"] = "Errore: " + err.Error()
-	} else {
-		result["message"] = "Risposta inattesa"
 	}
 
 	json.NewEncoder(w).Encode(result)
@@ -1025,7 +1017,8 @@ func getAccessPointsByNave(naveID int64) []AccessPoint {
 func getRecentBackups(naveID int64, limit int) []ConfigBackup {
 	var backups []ConfigBackup
 	rows, err := database.DB.Query(`
-		SELECT id, nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at
+		SELECT id, nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at,
+		       COALESCE(backup_precedente_id, 0), cambiato, righe_aggiunte, righe_rimosse
 		FROM config_backup WHERE nave_id = ? ORDER BY created_at DESC LIMIT ?
 	`, naveID, limit)
 	if err != nil {
@@ -1035,7 +1028,8 @@ func getRecentBackups(naveID int64, limit int) []ConfigBackup {
 
 	for rows.Next() {
 		var b ConfigBackup
-		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt)
+		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt,
+			&b.BackupPrecedenteID, &b.Cambiato, &b.RigheAggiunte, &b.RigheRimosse)
 		backups = append(backups, b)
 	}
 	return backups
@@ -1047,134 +1041,16 @@ func countAPByStatus(naveID int64, stato string) int {
 	return count
 }
 
-// parseHuaweiAPOutput parsa l'output di "display ap all" Huawei
-func parseHuaweiAPOutput(output string) []map[string]string {
-	var aps []map[string]string
-
-	lines := strings.Split(output, "\n")
-	// Formato reale output Huawei:
-	// ID    MAC            Name           Group   IP           Type             State  STA  Uptime...
-	// 0     484c-2911-cb30 AP-02          default 10.101.3.102 AirEngine5761-11 nor    2    20D:6H...
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Salta righe vuote, header e separatori
-		if line == "" || strings.HasPrefix(line, "ID") || strings.HasPrefix(line, "-") || 
-		   strings.HasPrefix(line, "Total") || strings.Contains(line, "idle  :") || 
-		   strings.Contains(line, "nor   :") || strings.Contains(line, "ExtraInfo") {
-			continue
-		}
-
-		// Usa regex per il formato: ID MAC Name Group IP Type State STA Uptime...
-		// MAC formato: xxxx-xxxx-xxxx
-		re := regexp.MustCompile(`^(\d+)\s+([0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4})\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+`)
-		matches := re.FindStringSubmatch(line)
-		if len(matches) >= 8 {
-			ip := matches[5]
-			if ip == "-" {
-				ip = ""
-			}
-			ap := map[string]string{
-				"name":   matches[3],
-				"mac":    normalizeMAC(matches[2]),
-				"ip":     ip,
-				"model":  matches[6],
-				"state":  matches[7],
-			}
-			aps = append(aps, ap)
-		}
-	}
-
-	return aps
-}
-
-// parseHuaweiMacTable parsa l'output di "display lldp neighbor brief" Huawei
-func parseHuaweiMacTable(output string) []map[string]string {
-	var entries []map[string]string
-
-	lines := strings.Split(output, "\n")
-	// Formato reale output Huawei:
-	// MAC            VLAN/VSI/BD   Port        Type
-	// 0001-2e7a-df1e 1/-/-         GE0/0/9     dynamic
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Salta righe vuote, header e info
-		if line == "" || strings.Contains(line, "MAC") || strings.HasPrefix(line, "-") ||
-		   strings.HasPrefix(line, "Total") || strings.Contains(line, "Info:") ||
-		   strings.Contains(line, "spawn") || strings.Contains(line, "assword") {
-			continue
-		}
-
-		// Usa regex per estrarre MAC (formato xxxx-xxxx-xxxx) e porta (GE/XGE)
-		re := regexp.MustCompile(`^([0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4})\s+(\S+)\s+((?:GE|XGE|Eth)[0-9/]+)\s+(\S+)`)
-		matches := re.FindStringSubmatch(line)
-		if len(matches) >= 5 {
-			entry := map[string]string{
-				"mac":  normalizeMAC(matches[1]),
-				"vlan": matches[2],
-				"port": matches[3],
-			}
-			entries = append(entries, entry)
-		}
-	}
-
-	return entries
-}
-
-// parseHPMacTable parsa l'output di "show mac-address" HP
-func parseHPMacTable(output string) []map[string]string {
-	var entries []map[string]string
-
-	lines := strings.Split(output, "\n")
-	// HP ha formato leggermente diverso
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.Contains(line, "MAC Address") || strings.HasPrefix(line, "-") {
-			continue
-		}
-
-		fields := strings.Fields(line)
-		if len(fields) >= 3 {
-			entry := map[string]string{
-				"mac":  normalizeMAC(fields[0]),
-				"vlan": fields[1],
-				"port": fields[2],
-			}
-			entries = append(entries, entry)
-		}
-	}
-
-	return entries
-}
-
-// normalizeMAC converte MAC in formato standard (minuscolo, con :)
-func normalizeMAC(mac string) string {
-	// Rimuovi separatori esistenti
-	mac = strings.ReplaceAll(mac, "-", "")
-	mac = strings.ReplaceAll(mac, ":", "")
-	mac = strings.ReplaceAll(mac, ".", "")
-	mac = strings.ToLower(mac)
-
-	// Aggiungi : ogni 2 caratteri
-	if len(mac) == 12 {
-		return fmt.Sprintf("%s:%s:%s:%s:%s:%s",
-			mac[0:2], mac[2:4], mac[4:6], mac[6:8], mac[8:10], mac[10:12])
-	}
-	return mac
-}
-
 // updateOrCreateAP aggiorna o crea un AP nel database
-func updateOrCreateAP(naveID, acID int64, ap map[string]string) {
-	mac := ap["mac"]
-	name := ap["name"]
-	model := ap["model"]
-	ip := ap["ip"]
+func updateOrCreateAP(naveID, acID int64, ap netdevice.InfoAP) {
+	mac := ap.MAC
+	name := ap.Nome
+	model := ap.Modello
+	ip := ap.IP
 
 	// Determina stato
 	stato := "unknown"
-	state := strings.ToLower(ap["state"])
+	state := strings.ToLower(ap.Stato)
 	if state == "run" || state == "online" || state == "normal" || state == "nor" {
 		stato = "online"
 	} else if state == "fault" || state == "error" {
@@ -1183,16 +1059,28 @@ func updateOrCreateAP(naveID, acID int64, ap map[string]string) {
 		stato = "offline"
 	}
 
-	// Verifica se esiste
+	// Verifica se esiste (lo stato precedente va letto prima dell'aggiornamento)
 	var existingID int64
-	err := database.DB.QueryRow("SELECT id FROM access_point WHERE nave_id = ? AND ap_mac = ?", naveID, mac).Scan(&existingID)
+	var oldStato string
+	err := database.DB.QueryRow("SELECT id, stato FROM access_point WHERE nave_id = ? AND ap_mac = ?", naveID, mac).Scan(&existingID, &oldStato)
 
 	if err == sql.ErrNoRows {
 		// Inserisci nuovo
-		database.DB.Exec(`
+		res, err := database.DB.Exec(`
 			INSERT INTO access_point (nave_id, ac_id, ap_name, ap_mac, ap_model, ap_ip, stato, ultimo_check)
 			VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 		`, naveID, acID, name, mac, model, ip, stato)
+		if err != nil {
+			return
+		}
+		// Il primo stato apre lo storico di disponibilita dell'AP
+		newID, _ := res.LastInsertId()
+		database.DB.Exec(`
+			INSERT INTO ap_status_log (ap_id, stato, dettaglio) VALUES (?, ?, ?)
+		`, newID, stato, "Primo rilevamento")
+		if stato == "fault" {
+			valutaGuastoAP(naveID, newID, name, true)
+		}
 	} else {
 		// Aggiorna esistente
 		database.DB.Exec(`
@@ -1201,30 +1089,44 @@ func updateOrCreateAP(naveID, acID int64, ap map[string]string) {
 		`, name, model, ip, stato, existingID)
 
 		// Se stato è cambiato, logga
-		var oldStato string
-		database.DB.QueryRow("SELECT stato FROM access_point WHERE id = ?", existingID).Scan(&oldStato)
 		if oldStato != stato {
 			database.DB.Exec(`
 				INSERT INTO ap_status_log (ap_id, stato, dettaglio) VALUES (?, ?, ?)
 			`, existingID, stato, fmt.Sprintf("Cambio stato: %s -> %s", oldStato, stato))
+		}
 
-			// Gestione automatica guasti
-			if stato == "fault" && oldStato != "fault" {
-				CreaGuastoAPFault(naveID, existingID, name)
-			} else if oldStato == "fault" && stato != "fault" {
-				ChiudiGuastoAPFault(naveID, existingID)
-			}
+		// Gestione automatica guasti: ogni scan in fault conta come rilevazione
+		if stato == "fault" || oldStato == "fault" {
+			valutaGuastoAP(naveID, existingID, name, stato == "fault")
 		}
 	}
 }
 
-// updateAPSwitchPort aggiorna la porta dello switch per un AP dato il MAC
-func updateAPSwitchPort(naveID, switchID int64, mac, port string) {
-	mac = normalizeMAC(mac)
-	database.DB.Exec(`
+// valutaGuastoAP applica la regola ap_fault all'esito dello scan di un AP
+func valutaGuastoAP(naveID, apID int64, nome string, fault bool) {
+	valutaGuasto(rilevazioneGuasto{
+		NaveID:       naveID,
+		Condizione:   "ap_fault",
+		TipoApparato: "ap",
+		ApparatoID:   apID,
+		Nome:         nome,
+		Presente:     fault,
+		Dettaglio:    "stato FAULT sull'Access Controller",
+	})
+}
+
+// updateAPSwitchPort aggiorna la porta dello switch per un AP dato il MAC; false se il MAC non e di un AP della nave
+func updateAPSwitchPort(naveID, switchID int64, mac, port string) bool {
+	mac = netdevice.NormalizzaMAC(mac)
+	res, err := database.DB.Exec(`
 		UPDATE access_point SET switch_id = ?, switch_port = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE nave_id = ? AND ap_mac = ?
 	`, switchID, port, naveID, mac)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
 }
 
 // updateAPSwitchPortByName aggiorna la porta dello switch per un AP dato il nome
@@ -1282,239 +1184,193 @@ func APIGetAPFault(w http.ResponseWriter, r *http.Request) {
 }
 
 // ============================================
-// SCHEDULER MONITORAGGIO SETTIMANALE
+// JOB MONITORAGGIO
 // ============================================
 
-// StartMonitoringScheduler avvia il job di monitoraggio settimanale
-func StartMonitoringScheduler() {
-	go func() {
-		// Calcola prossimo lunedì alle 03:00
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			now := time.Now()
-			// Esegui ogni lunedì alle 03:00
-			if now.Weekday() == time.Monday && now.Hour() == 3 {
-				log.Println("[Monitoring] Avvio job settimanale monitoraggio rete...")
-				RunMonitoringJob()
+// RunMonitoringJob esegue tutti i job di monitoraggio su tutte le navi attive,
+// ignorando la pianificazione. I job sono eseguiti in sequenza, gli apparati
+// di ciascun job in parallelo tramite il pool di monitoraggio.
+func RunMonitoringJob() {
+	navi := getNaviMonitorabili()
+	log.Printf("[Monitoring] Trovate %d navi attive da monitorare", len(navi))
+
+	for _, job := range jobSchedulabili {
+		var attivita []attivitaApparato
+		if job.perNave != nil {
+			for _, nave := range navi {
+				attivita = append(attivita, job.perNave(nave)...)
 			}
+		} else {
+			attivita = job.globale()
 		}
-	}()
-	log.Println("[Monitoring] Scheduler monitoraggio settimanale avviato")
+
+		rapporto := eseguiAttivita(job.tipo, attivita)
+		log.Printf("[Monitoring] %s: %d apparati, %d errori", job.tipo, rapporto.Totale, len(rapporto.Errori))
+	}
+	log.Println("[Monitoring] Job completato")
 }
 
-// RunMonitoringJob esegue il monitoraggio di tutte le navi attive
-func RunMonitoringJob() {
-	// Ottieni tutte le navi non ferme per lavori
+// naveMonitorata identifica una nave soggetta al monitoraggio
+type naveMonitorata struct {
+	ID   int64
+	Nome string
+}
+
+// getNaviMonitorabili restituisce le navi non ferme per lavori
+func getNaviMonitorabili() []naveMonitorata {
 	rows, err := database.DB.Query(`
 		SELECT n.id, n.nome
 		FROM navi n
 		WHERE COALESCE(n.ferma_per_lavori, 0) = 0
+		ORDER BY n.nome
 	`)
 	if err != nil {
 		log.Printf("[Monitoring] Errore query navi: %v", err)
-		return
+		return nil
 	}
 	defer rows.Close()
 
-	type naveData struct {
-		ID   int64
-		Nome string
-	}
-	var navi []naveData
-
+	var navi []naveMonitorata
 	for rows.Next() {
-		var n naveData
+		var n naveMonitorata
 		rows.Scan(&n.ID, &n.Nome)
 		navi = append(navi, n)
 	}
+	return navi
+}
 
-	log.Printf("[Monitoring] Trovate %d navi attive da monitorare", len(navi))
-
-	for _, nave := range navi {
-		log.Printf("[Monitoring] Processando nave: %s (ID: %d)", nave.Nome, nave.ID)
-
-		// Scan AP dall'AC
-		ac := getAccessControllerByNave(nave.ID)
-		if ac != nil {
-			log.Printf("[Monitoring] - Scanning AP da AC %s", ac.IP)
-			runScanAPBatch(nave.ID, ac)
-
-			// Backup configurazione AC
-			log.Printf("[Monitoring] - Backup config AC")
-			runBackupBatch(nave.ID, "ac", ac.ID)
-		}
-
-		// Scan MAC e backup per ogni switch
-		switches := getSwitchesByNave(nave.ID)
-		for _, sw := range switches {
-			log.Printf("[Monitoring] - Scanning MAC da switch %s (%s)", sw.Nome, sw.IP)
-			runScanMACBatch(nave.ID, &sw)
-
-			// Backup configurazione switch
-			log.Printf("[Monitoring] - Backup config switch %s", sw.Nome)
-			runBackupBatch(nave.ID, "switch", sw.ID)
-		}
-
-		// Pausa tra navi per non sovraccaricare
-		time.Sleep(5 * time.Second)
+// attivitaScanAP prepara lo scan degli AP dall'AC della nave
+func attivitaScanAP(nave naveMonitorata) []attivitaApparato {
+	ac := getAccessControllerByNave(nave.ID)
+	if ac == nil {
+		return nil
 	}
-
-
-	// Backup Uffici
-	log.Println("[Monitoring] Backup uffici...")
-	runBackupUffici()
-
-	// Backup Sale Server
-	log.Println("[Monitoring] Backup sale server...")
-	runBackupSaleServer()
-	log.Println("[Monitoring] Job settimanale completato")
+	return []attivitaApparato{{
+		Sito: nave.Nome, NaveID: nave.ID, TipoApparato: "ac", ApparatoID: ac.ID, Nome: "AC", IP: ac.IP,
+		esegui: func(ctx context.Context) error {
+			return runScanAPBatch(ctx, nave.ID, ac)
+		},
+	}}
+}
+
+// attivitaScanMAC prepara l'associazione AP/porte per ogni switch della nave
+func attivitaScanMAC(nave naveMonitorata) []attivitaApparato {
+	var attivita []attivitaApparato
+	for _, sw := range getSwitchesByNave(nave.ID) {
+		attivita = append(attivita, attivitaApparato{
+			Sito: nave.Nome, NaveID: nave.ID, TipoApparato: "switch", ApparatoID: sw.ID, Nome: sw.Nome, IP: sw.IP,
+			esegui: func(ctx context.Context) error {
+				return runScanMACBatch(ctx, nave.ID, &sw)
+			},
+		})
+	}
+	return attivita
+}
+
+// attivitaBackupConfig prepara il backup della configurazione di AC e switch della nave
+func attivitaBackupConfig(nave naveMonitorata) []attivitaApparato {
+	var attivita []attivitaApparato
+	if ac := getAccessControllerByNave(nave.ID); ac != nil {
+		attivita = append(attivita, attivitaApparato{
+			Sito: nave.Nome, NaveID: nave.ID, TipoApparato: "ac", ApparatoID: ac.ID, Nome: "AC", IP: ac.IP,
+			esegui: func(ctx context.Context) error {
+				return runBackupBatch(ctx, nave.ID, "ac", ac.ID)
+			},
+		})
+	}
+	for _, sw := range getSwitchesByNave(nave.ID) {
+		attivita = append(attivita, attivitaApparato{
+			Sito: nave.Nome, NaveID: nave.ID, TipoApparato: "switch", ApparatoID: sw.ID, Nome: sw.Nome, IP: sw.IP,
+			esegui: func(ctx context.Context) error {
+				return runBackupBatch(ctx, nave.ID, "switch", sw.ID)
+			},
+		})
+	}
+	return attivita
 }
 
 // runScanAPBatch esegue scan AP per una nave (versione batch)
-func runScanAPBatch(naveID int64, ac *AccessController) {
-	output, err := executeSSHCommand(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, "display ap all")
+func runScanAPBatch(ctx context.Context, naveID int64, ac *AccessController) error {
+	aps, err := leggiAccessPoint(ctx, ac.configRete())
 	if err != nil {
 		log.Printf("[Monitoring] Errore scan AP nave %d: %v", naveID, err)
-		return
+		return fmt.Errorf("scan AP da AC %s: %w", ac.IP, err)
 	}
 
-	aps := parseHuaweiAPOutput(string(output))
 	for _, ap := range aps {
 		updateOrCreateAP(naveID, ac.ID, ap)
 	}
 
 	database.DB.Exec("UPDATE access_controller SET ultimo_check = CURRENT_TIMESTAMP WHERE id = ?", ac.ID)
 	log.Printf("[Monitoring] Trovati %d AP per nave %d", len(aps), naveID)
+	return nil
 }
 
 // runScanMACBatch esegue scan MAC per uno switch (versione batch)
-func runScanMACBatch(naveID int64, sw *SwitchNave) {
-	var cmdStr string
-	if sw.Marca == "huawei" {
-		cmdStr = "display lldp neighbor brief"
-	} else {
-		cmdStr = "show mac-address"
-	}
-
-	output, err := executeSwitchCommand(sw, cmdStr)
+func runScanMACBatch(ctx context.Context, naveID int64, sw *SwitchNave) error {
+	trovati, err := associaAPSwitch(ctx, sw)
 	if err != nil {
 		log.Printf("[Monitoring] Errore scan MAC switch %d: %v", sw.ID, err)
-		return
-	}
-
-	var entries []map[string]string
-	if sw.Marca == "huawei" {
-		entries = parseHuaweiLLDPOutput(string(output), sw.ID, sw.Nome, sw.NaveID)
-	} else {
-		entries = parseHPMacTable(string(output))
-	}
-
-	for _, entry := range entries {
-		updateAPSwitchPortByName(naveID, sw.ID, entry["ap_name"], entry["port"])
+		return fmt.Errorf("scan MAC switch %s: %w", sw.Nome, err)
 	}
 
 	database.DB.Exec("UPDATE switch_nave SET ultimo_check = CURRENT_TIMESTAMP WHERE id = ?", sw.ID)
-	log.Printf("[Monitoring] Trovate %d entry MAC per switch %d", len(entries), sw.ID)
+	log.Printf("[Monitoring] Trovate %d entry MAC per switch %d", trovati, sw.ID)
+	return nil
 }
 
 // runBackupBatch esegue backup config per un apparato (versione batch)
-func runBackupBatch(naveID int64, tipoApparato string, apparatoID int64) {
-	var ip, sshUser, sshPass, nome string
-	var sshPort int
-	var cmdStr string
+func runBackupBatch(ctx context.Context, naveID int64, tipoApparato string, apparatoID int64) error {
+	var nome string
+	var cfg netdevice.Config
 
 	if tipoApparato == "ac" {
 		ac := getAccessControllerByNave(naveID)
 		if ac == nil {
-			return
+			return nil
 		}
-		ip = ac.IP
-		sshUser = ac.SSHUser
-		sshPass = ac.SSHPass
-		sshPort = ac.SSHPort
 		nome = "AC"
-		cmdStr = "display current-configuration"
+		cfg = ac.configRete()
 	} else {
 		sw := getSwitchByID(apparatoID)
 		if sw == nil {
-			return
+			return nil
 		}
-		ip = sw.IP
-		sshUser = sw.SSHUser
-		sshPass = sw.SSHPass
-		sshPort = sw.SSHPort
 		nome = sw.Nome
-		if sw.Marca == "huawei" {
-			cmdStr = "display current-configuration"
-		} else {
-			cmdStr = "show running-config"
-		}
+		cfg = sw.configRete()
 	}
 
-	output, err := executeSSHBackup(ip, sshPort, sshUser, sshPass, cmdStr)
+	output, err := leggiRunningConfig(ctx, cfg)
 	log.Printf("[BACKUP] Switch %s output len: %d, err: %v", nome, len(output), err)
 	if err != nil {
 		log.Printf("[Monitoring] Errore backup %s %d: %v", tipoApparato, apparatoID, err)
-		return
-	}
-
-	// Calcola hash
-	hash := md5.Sum([]byte(output))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Verifica se cambiata
-	var lastHash string
-	database.DB.QueryRow(`
-		SELECT hash_md5 FROM config_backup
-		WHERE nave_id = ? AND tipo_apparato = ? AND apparato_id = ?
-		ORDER BY created_at DESC LIMIT 1
-	`, naveID, tipoApparato, apparatoID).Scan(&lastHash)
-
-	if lastHash == hashStr {
-		log.Printf("[Monitoring] Config %s %s non cambiata", tipoApparato, nome)
-		return
+		return fmt.Errorf("backup %s %s: %w", tipoApparato, nome, err)
 	}
 
-	// Salva file
-	backupDir := filepath.Join("data", "backups", fmt.Sprintf("nave_%d", naveID))
-	os.MkdirAll(backupDir, 0755)
-
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("%s_%s_%s.cfg", tipoApparato, nome, timestamp)
-	filePath := filepath.Join(backupDir, filename)
-
-	err = os.WriteFile(filePath, []byte(output), 0644)
+	esito, err := salvaBackupConfig(&backupConfig{
+		Tabella:      "config_backup",
+		NaveID:       naveID,
+		TipoApparato: tipoApparato,
+		ApparatoID:   apparatoID,
+		Nome:         nome,
+		Marca:        cfg.Marca,
+	}, output)
 	if err != nil {
 		log.Printf("[Monitoring] Errore salvataggio backup: %v", err)
-		return
+		return fmt.Errorf("salvataggio backup %s: %w", nome, err)
 	}
 
-	database.DB.Exec(`
-		INSERT INTO config_backup (nave_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, naveID, tipoApparato, apparatoID, nome, filePath, len(output), hashStr)
-
 	// Aggiorna timestamp
 	if tipoApparato == "ac" {
 		database.DB.Exec("UPDATE access_controller SET ultimo_backup = CURRENT_TIMESTAMP WHERE id = ?", apparatoID)
 	} else {
 		database.DB.Exec("UPDATE switch_nave SET ultimo_backup = CURRENT_TIMESTAMP WHERE id = ?", apparatoID)
-		// Estrai e aggiorna modello se non presente
 		// Recupera modello se non presente
-		var currentModello string
-		database.DB.QueryRow("SELECT COALESCE(modello, '') FROM switch_nave WHERE id = ?", apparatoID).Scan(&currentModello)
-		if currentModello == "" {
-			versionOutput, _ := executeSSHBackup(ip, sshPort, sshUser, sshPass, "display version")
-			_, model := parseVersionOutput(versionOutput, "huawei")
-			if model != "" {
-				database.DB.Exec("UPDATE switch_nave SET modello = ? WHERE id = ?", model, apparatoID)
-			}
-		}
+		aggiornaModelloSeMancante(ctx, "switch_nave", apparatoID, cfg)
 	}
 
-	log.Printf("[Monitoring] Backup %s %s salvato", tipoApparato, nome)
+	log.Printf("[Monitoring] Backup %s %s: %s", tipoApparato, nome, esito.messaggio())
+	return nil
 }
 
 // GestioneReteNave mostra la pagina gestione rete di una nave
@@ -1643,35 +1499,28 @@ func APIScanLLDP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var totalEntries int
-	var errors []string
+	var errori []string
 
 	for _, sw := range switches {
-		// Esegui comando LLDP
-		output, err := executeSSHBackup(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, "display lldp neighbor brief")
+		// LLDP se supportato dal driver, altrimenti tabella MAC
+		trovati, err := associaAPSwitch(r.Context(), &sw)
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %v", sw.Nome, err))
+			errori = append(errori, fmt.Sprintf("%s: %v", sw.Nome, err))
 			continue
 		}
-
-		// Parse output LLDP
-		entries := parseHuaweiLLDPOutput(string(output), sw.ID, sw.Nome, sw.NaveID)
-		for _, entry := range entries {
-			updateAPSwitchPortByName(naveID, sw.ID, entry["ap_name"], entry["port"])
-		}
-		totalEntries += len(entries)
-		log.Printf("[LLDP] Switch %s: trovati %d AP", sw.Nome, len(entries))
+		totalEntries += trovati
+		log.Printf("[LLDP] Switch %s: trovati %d AP", sw.Nome, trovati)
 
 		// Aggiorna timestamp switch
 		database.DB.Exec("UPDATE switch_nave SET ultimo_check = CURRENT_TIMESTAMP WHERE id = ?", sw.ID)
 	}
 
-
-	result["success"] = len(errors) == 0 || totalEntries > 0
+	result["success"] = len(errori) == 0 || totalEntries > 0
 	result["ap_trovati"] = totalEntries
 	result["dettagli"] = []map[string]string{}
 
-	if len(errors) > 0 {
-		result["message"] = fmt.Sprintf("Trovati %d AP. Errori su: %s", totalEntries, strings.Join(errors, ", "))
+	if len(errori) > 0 {
+		result["message"] = fmt.Sprintf("Trovati %d AP. Errori su: %s", totalEntries, strings.Join(errori, ", "))
 	} else {
 		result["message"] = fmt.Sprintf("Scan LLDP completato. Trovati %d AP su %d switch", totalEntries, len(switches))
 	}
@@ -1679,48 +1528,6 @@ func APIScanLLDP(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// parseHuaweiLLDPOutput parsa output "display lldp neighbor brief" e estrae gli AP
-func parseHuaweiLLDPOutput(output string, switchID int64, switchNome string, naveID int64) []map[string]string {
-	var aps []map[string]string
-
-	lines := strings.Split(output, "\n")
-	// Formato:
-	// Local Intf       Neighbor Dev             Neighbor Intf             Exptime(s)
-	// GE0/0/17         AP-06                    GE0/0/0                   118
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Salta header e righe vuote
-		if line == "" || strings.HasPrefix(line, "Local") || strings.Contains(line, "spawn") ||
-			strings.Contains(line, "assword") || strings.Contains(line, "Info:") {
-			continue
-		}
-
-		// Parse: porta locale, nome neighbor, porta neighbor, expire
-		fields := strings.Fields(line)
-		if len(fields) >= 3 {
-			localPort := fields[0]
-			neighborName := fields[1]
-
-			
-			// Verifica se il neighborName esiste come AP nel database per questa nave
-			var count int
-			database.DB.QueryRow("SELECT COUNT(*) FROM access_point WHERE nave_id = ? AND ap_name = ?", naveID, neighborName).Scan(&count)
-			if count > 0 {
-				ap := map[string]string{
-					"ap_name":     neighborName,
-					"port":        localPort,
-					"switch_id":   fmt.Sprintf("%d", switchID),
-					"switch_nome": switchNome,
-				}
-				aps = append(aps, ap)
-			}
-		}
-	}
-
-	return aps
-}
-
 // APIGetSwitchVersion ottiene la versione firmware di uno switch
 func APIGetSwitchVersion(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -1742,24 +1549,13 @@ func APIGetSwitchVersion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Comando per ottenere versione
-	var cmdStr string
-	if sw.Marca == "huawei" {
-		cmdStr = "display version"
-	} else {
-		cmdStr = "show version"
-	}
-
-	output, err := executeSwitchCommand(sw, cmdStr)
+	version, model, err := leggiVersione(r.Context(), sw.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse versione
-	version, model := parseVersionOutput(string(output), sw.Marca)
-
 	// Aggiorna modello nel DB se trovato
 	if model != "" && sw.Modello == "" {
 		database.DB.Exec("UPDATE switch_nave SET modello = ? WHERE id = ?", model, switchID)
@@ -1773,39 +1569,6 @@ func APIGetSwitchVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// parseVersionOutput estrae versione e modello dall output Huawei
-func parseVersionOutput(output, marca string) (string, string) {
-	var version, model string
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if marca == "huawei" {
-			// Versione: VRP (R) software, Version 5.170 (S5735 V200R021C00SPC100)
-			if strings.Contains(line, "VRP") && strings.Contains(line, "Version") && !strings.HasPrefix(line, "Software") {
-				re := regexp.MustCompile(`\(([A-Z0-9]+)\s+([A-Z0-9]+)\)`)
-				if m := re.FindStringSubmatch(line); len(m) > 2 {
-					version = m[2]
-				}
-			}
-			// Modello: HUAWEI S5735-L24P4S-A1 Routing Switch
-			if strings.Contains(line, "HUAWEI") && strings.Contains(line, "Switch") {
-				re := regexp.MustCompile(`HUAWEI\s+([A-Z0-9-]+)`)
-				if m := re.FindStringSubmatch(line); len(m) > 1 {
-					model = m[1]
-				}
-			}
-		} else {
-			if strings.Contains(line, "Software Version") {
-				parts := strings.Split(line, ":")
-				if len(parts) > 1 {
-					version = strings.TrimSpace(parts[1])
-				}
-			}
-		}
-	}
-	return version, model
-}
-
 
 // APIGetACVersion ottiene la versione firmware dell AC
 func APIGetACVersion(w http.ResponseWriter, r *http.Request) {
@@ -1832,15 +1595,13 @@ func APIGetACVersion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	output, err := executeSSHCommand(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, "display version")
+	version, model, err := leggiVersione(r.Context(), ac.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	version, model := parseACVersionOutput(string(output))
-
 	if model != "" {
 		database.DB.Exec("UPDATE access_controller SET modello = ? WHERE id = ?", model, acID)
 	}
@@ -1853,359 +1614,144 @@ func APIGetACVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// parseACVersionOutput estrae versione e modello dall output AC Huawei
-func parseACVersionOutput(output string) (string, string) {
-	var version, model string
-
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		// VRP (R) software, Version 5.170 (AC6508 V200R019C10SPC800)
-		if strings.Contains(line, "VRP") && strings.Contains(line, "Version") {
-			re := regexp.MustCompile(`Version\s+(\S+)`)
-			if m := re.FindStringSubmatch(line); len(m) > 1 {
-				version = m[1]
-			}
-		}
-		// Huawei AC6508 Wireless Access Controller
-		if strings.Contains(line, "Huawei") && (strings.Contains(line, "AC") || strings.Contains(line, "Controller")) {
-			re := regexp.MustCompile(`Huawei\s+(\S+)`)
-			if m := re.FindStringSubmatch(line); len(m) > 1 {
-				model = m[1]
-			}
-		}
-	}
-
-	return version, model
-}
-
-// parseVersionOutput estrae versione e modello dall output Huawei
-
-// executeSSHBackup esegue comando SSH con paginazione disabilitata per backup lunghi
-func executeSSHBackup(ip string, port int, user, pass, command string) (string, error) {
-	expectScript := fmt.Sprintf(`
-log_user 1
-set timeout 300
-spawn ssh -o StrictHostKeyChecking=no -o KexAlgorithms=+diffie-hellman-group14-sha1,diffie-hellman-group1-sha1,diffie-hellman-group-exchange-sha1 -o HostKeyAlgorithms=+ssh-rsa -o ConnectTimeout=30 -p %d %s@%s
-
-expect {
-    "assword:" {
-        send "%s\r"
-        exp_continue
-    }
-    ">" {
-    }
-    -re {<[^>]+>} {
-    }
-    timeout {
-        exit 4
-    }
-    "Permission denied" {
-        exit 1
-    }
-}
-
-# Disabilita paginazione
-send "screen-length 0 temporary\r"
-expect {
-    ">" {}
-    -re {<[^>]+>} {}
-    timeout {}
-}
-sleep 1
-
-# Esegui comando backup
-send "%s\r"
-expect {
-    ">" {}
-    -re {<[^>]+>} {}
-    timeout {}
-}
-
-send "quit\r"
-expect eof
-`, port, user, ip, pass, command)
-
-	cmd := exec.Command("expect", "-c", expectScript)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	output := stdout.String()
-	// Se SSH fallisce con shell request failed, prova telnet
-	if err != nil || strings.Contains(output, "shell request failed") {
-		log.Printf("[SSH] Fallback a telnet per %s", ip)
-		return executeTelnetCommand(ip, user, pass, command)
-	}
-	return output, nil
-}
-
-// executeTelnetCommand esegue comando via Telnet (fallback per switch senza SSH)
-func executeTelnetCommand(ip string, user, pass, command string) (string, error) {
-	expectScript := fmt.Sprintf(`
-log_user 1
-set timeout 60
-spawn telnet %s
-expect {
-    "Username:" { send "%s\r" }
-    "login:" { send "%s\r" }
-    timeout { exit 4 }
-}
-expect "*assword*" { send "%s\r" }
-expect {
-    ">" {}
-    -re {<[^>]+>} {}
-    timeout { exit 4 }
-}
-
-# Disabilita paginazione
-send "screen-length 0 temporary\r"
-expect {
-    ">" {}
-    -re {<[^>]+>} {}
-}
-sleep 1
-
-send "%s\r"
-expect {
-    ">" {}
-    -re {<[^>]+>} {}
-    timeout {}
-}
-
-send "quit\r"
-expect eof
-`, ip, user, user, pass, command)
-
-	cmd := exec.Command("expect", "-c", expectScript)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("Telnet error: %v - %s", err, stderr.String())
-	}
-
-	return stdout.String(), nil
-}
-
 // getSwitchHostname recupera l'hostname dello switch via SSH/Telnet
-func getSwitchHostname(ip string, port int, user, pass, marca, protocollo string) string {
-	var cmd string
-	if marca == "huawei" {
-		cmd = "display current-configuration | include sysname"
-	} else {
-		cmd = "show running-config | include hostname"
-	}
-
-	var output string
-	var err error
-	if protocollo == "telnet" {
-		output, err = executeTelnetCommand(ip, user, pass, cmd)
-	} else {
-		output, err = executeSSHCommand(ip, port, user, pass, cmd)
-	}
+func getSwitchHostname(ctx context.Context, ip string, port int, user, pass, marca, protocollo string) string {
+	var hostname string
+	err := conApparato(ctx, configApparato(ip, port, user, pass, protocollo, marca), func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		hostname, err = d.Hostname(ctx, s)
+		return err
+	})
 
 	if err != nil {
 		log.Printf("[HOSTNAME] Errore recupero hostname: %v", err)
 		return "Switch-" + ip // Fallback: usa IP come nome
 	}
-
-	// Parse output per estrarre hostname
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// Huawei: sysname SW-PONTE-1
-		if strings.HasPrefix(strings.ToLower(line), "sysname ") {
-			return strings.TrimSpace(strings.TrimPrefix(line, "sysname "))
-		}
-		// HP: hostname SW-PONTE-1
-		if strings.HasPrefix(strings.ToLower(line), "hostname ") {
-			return strings.TrimSpace(strings.TrimPrefix(line, "hostname "))
-		}
+	if hostname == "" {
+		return "Switch-" + ip
 	}
-
-	// Fallback: usa IP
-	return "Switch-" + ip
+	return hostname
 }
 
-// runBackupUffici esegue backup di tutti gli uffici
-func runBackupUffici() {
-	// Ottieni tutti gli uffici
-	rows, err := database.DB.Query("SELECT id, nome FROM uffici")
+// attivitaBackupUffici prepara il backup di AC e switch di tutti gli uffici
+func attivitaBackupUffici() []attivitaApparato {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.nome, 'ac', a.id, 'AC', a.ip FROM uffici u JOIN ac_ufficio a ON a.ufficio_id = u.id
+		UNION ALL
+		SELECT u.id, u.nome, 'switch', s.id, s.nome, s.ip FROM uffici u JOIN switch_ufficio s ON s.ufficio_id = u.id
+	`)
 	if err != nil {
 		log.Printf("[Monitoring] Errore query uffici: %v", err)
-		return
+		return nil
 	}
 	defer rows.Close()
 
+	var attivita []attivitaApparato
 	for rows.Next() {
-		var id int64
-		var nome string
-		rows.Scan(&id, &nome)
-
-		log.Printf("[Monitoring] Backup ufficio: %s", nome)
-
-		// Backup AC ufficio
-		var acID int64
-		err := database.DB.QueryRow("SELECT id FROM ac_ufficio WHERE ufficio_id = ?", id).Scan(&acID)
-		if err == nil {
-			runBackupUfficioBatch(id, 0, "ac", acID)
+		var a attivitaApparato
+		if err := rows.Scan(&a.UfficioID, &a.Sito, &a.TipoApparato, &a.ApparatoID, &a.Nome, &a.IP); err != nil {
+			continue
 		}
-
-		// Backup switch ufficio
-		swRows, _ := database.DB.Query("SELECT id, nome FROM switch_ufficio WHERE ufficio_id = ?", id)
-		if swRows != nil {
-			for swRows.Next() {
-				var swID int64
-				var swNome string
-				swRows.Scan(&swID, &swNome)
-				log.Printf("[Monitoring] - Backup switch %s", swNome)
-				runBackupUfficioBatch(id, 0, "switch", swID)
-			}
-			swRows.Close()
+		a.esegui = func(ctx context.Context) error {
+			return runBackupUfficioBatch(ctx, a.UfficioID, 0, a.TipoApparato, a.ApparatoID)
 		}
-
-		time.Sleep(2 * time.Second)
+		attivita = append(attivita, a)
 	}
+	return attivita
 }
 
-// runBackupSaleServer esegue backup di tutte le sale server
-func runBackupSaleServer() {
-	// Ottieni tutte le sale server
-	rows, err := database.DB.Query("SELECT id, nome FROM sale_server")
+// attivitaBackupSaleServer prepara il backup degli switch di tutte le sale server
+func attivitaBackupSaleServer() []attivitaApparato {
+	rows, err := database.DB.Query(`
+		SELECT ss.id, ss.nome, s.id, s.nome, s.ip
+		FROM sale_server ss JOIN switch_sala_server s ON s.sala_server_id = ss.id
+	`)
 	if err != nil {
 		log.Printf("[Monitoring] Errore query sale server: %v", err)
-		return
+		return nil
 	}
 	defer rows.Close()
 
+	var attivita []attivitaApparato
 	for rows.Next() {
-		var id int64
-		var nome string
-		rows.Scan(&id, &nome)
-
-		log.Printf("[Monitoring] Backup sala server: %s", nome)
-
-		// Backup switch sala server
-		swRows, _ := database.DB.Query("SELECT id, nome FROM switch_sala_server WHERE sala_server_id = ?", id)
-		if swRows != nil {
-			for swRows.Next() {
-				var swID int64
-				var swNome string
-				swRows.Scan(&swID, &swNome)
-				log.Printf("[Monitoring] - Backup switch %s", swNome)
-				runBackupUfficioBatch(0, id, "switch", swID)
-			}
-			swRows.Close()
+		a := attivitaApparato{TipoApparato: "switch"}
+		if err := rows.Scan(&a.SalaServerID, &a.Sito, &a.ApparatoID, &a.Nome, &a.IP); err != nil {
+			continue
 		}
-
-		time.Sleep(2 * time.Second)
+		a.esegui = func(ctx context.Context) error {
+			return runBackupUfficioBatch(ctx, 0, a.SalaServerID, "switch", a.ApparatoID)
+		}
+		attivita = append(attivita, a)
 	}
+	return attivita
 }
 
 // runBackupUfficioBatch esegue backup per un apparato ufficio/sala server
-func runBackupUfficioBatch(ufficioID, salaServerID int64, tipo string, apparatoID int64) {
-	var ip, sshUser, sshPass, nome, protocollo string
-	var sshPort int
-	var cmdStr string
+func runBackupUfficioBatch(ctx context.Context, ufficioID, salaServerID int64, tipo string, apparatoID int64) error {
+	var nome string
 	var tabella string
+	var cfg netdevice.Config
 
 	if ufficioID > 0 {
 		if tipo == "ac" {
 			tabella = "ac_ufficio"
-			err := database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), COALESCE(porte_totali, 0), COALESCE(porte_libere, 0) FROM ac_ufficio WHERE id = ?", apparatoID).
-				Scan(&ip, &sshPort, &sshUser, &sshPass, &protocollo)
+			var ac ACUfficio
+			err := database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM ac_ufficio WHERE id = ?", apparatoID).
+				Scan(&ac.IP, &ac.SSHPort, &ac.SSHUser, &ac.SSHPass, &ac.Protocollo)
 			if err != nil {
-				return
+				return fmt.Errorf("apparato %s %d non trovato: %w", tipo, apparatoID, err)
 			}
 			nome = "AC"
-			cmdStr = "display current-configuration"
+			cfg = ac.configRete()
 		} else {
 			tabella = "switch_ufficio"
-			var marca string
-			err := database.DB.QueryRow("SELECT nome, ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), COALESCE(porte_totali, 0), COALESCE(porte_libere, 0), marca FROM switch_ufficio WHERE id = ?", apparatoID).
-				Scan(&nome, &ip, &sshPort, &sshUser, &sshPass, &protocollo, &marca)
+			var sw SwitchUfficio
+			err := database.DB.QueryRow("SELECT nome, ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), marca FROM switch_ufficio WHERE id = ?", apparatoID).
+				Scan(&sw.Nome, &sw.IP, &sw.SSHPort, &sw.SSHUser, &sw.SSHPass, &sw.Protocollo, &sw.Marca)
 			if err != nil {
-				return
-			}
-			if marca == "huawei" {
-				cmdStr = "display current-configuration"
-			} else {
-				cmdStr = "show running-config"
+				return fmt.Errorf("apparato %s %d non trovato: %w", tipo, apparatoID, err)
 			}
+			nome = sw.Nome
+			cfg = sw.configRete()
 		}
 	} else {
 		tabella = "switch_sala_server"
-		var marca string
-		err := database.DB.QueryRow("SELECT nome, ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), COALESCE(porte_totali, 0), COALESCE(porte_libere, 0), marca FROM switch_sala_server WHERE id = ?", apparatoID).
-			Scan(&nome, &ip, &sshPort, &sshUser, &sshPass, &protocollo, &marca)
+		var sw SwitchSalaServer
+		err := database.DB.QueryRow("SELECT nome, ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), marca FROM switch_sala_server WHERE id = ?", apparatoID).
+			Scan(&sw.Nome, &sw.IP, &sw.SSHPort, &sw.SSHUser, &sw.SSHPass, &sw.Protocollo, &sw.Marca)
 		if err != nil {
-			return
-		}
-		if marca == "huawei" {
-			cmdStr = "display current-configuration"
-		} else {
-			cmdStr = "show running-config"
+			return fmt.Errorf("switch %d non trovato: %w", apparatoID, err)
 		}
+		nome = sw.Nome
+		cfg = sw.configRete()
 	}
 
 	// Esegui backup
-	var output string
-	var err error
-	if protocollo == "telnet" {
-		output, err = executeTelnetCommand(ip, sshUser, sshPass, cmdStr)
-	} else {
-		output, err = executeSSHBackup(ip, sshPort, sshUser, sshPass, cmdStr)
-	}
-
+	output, err := leggiRunningConfig(ctx, cfg)
 	if err != nil {
 		log.Printf("[Monitoring] Errore backup %s: %v", nome, err)
-		return
-	}
-
-	// Calcola hash
-	hash := md5.Sum([]byte(output))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Salva file
-	var backupDir string
-	if ufficioID > 0 {
-		backupDir = filepath.Join("data", "backups", fmt.Sprintf("ufficio_%d", ufficioID))
-	} else {
-		backupDir = filepath.Join("data", "backups", fmt.Sprintf("sala_server_%d", salaServerID))
-	}
-	os.MkdirAll(backupDir, 0755)
-
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("%s_%s_%s.cfg", tipo, nome, timestamp)
-	filePath := filepath.Join(backupDir, filename)
-
-	err = os.WriteFile(filePath, []byte(output), 0644)
+		return fmt.Errorf("backup %s: %w", nome, err)
+	}
+
+	esito, err := salvaBackupConfig(&backupConfig{
+		Tabella:      "config_backup_ufficio",
+		UfficioID:    ufficioID,
+		SalaServerID: salaServerID,
+		TipoApparato: tipo,
+		ApparatoID:   apparatoID,
+		Nome:         nome,
+		Marca:        cfg.Marca,
+	}, output)
 	if err != nil {
 		log.Printf("[Monitoring] Errore salvataggio backup %s: %v", nome, err)
-		return
-	}
-
-	// Inserisci record DB
-	var ufficioIDPtr, salaServerIDPtr interface{}
-	if ufficioID > 0 {
-		ufficioIDPtr = ufficioID
-	}
-	if salaServerID > 0 {
-		salaServerIDPtr = salaServerID
+		return fmt.Errorf("salvataggio backup %s: %w", nome, err)
 	}
 
-	database.DB.Exec("INSERT INTO config_backup_ufficio (ufficio_id, sala_server_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		ufficioIDPtr, salaServerIDPtr, tipo, apparatoID, nome, filePath, len(output), hashStr)
-
 	// Aggiorna timestamp
 	database.DB.Exec(fmt.Sprintf("UPDATE %s SET ultimo_backup = CURRENT_TIMESTAMP WHERE id = ?", tabella), apparatoID)
 
-	log.Printf("[Monitoring] Backup %s salvato", nome)
+	log.Printf("[Monitoring] Backup %s: %s", nome, esito.messaggio())
+	return nil
 }
 
 // APIRilevaLicenzeAC rileva le licenze dall'Access Controller via SSH
@@ -2220,25 +1766,28 @@ func APIRilevaLicenzeAC(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Recupera dati AC dal database
-	var ip, sshUser, sshPass string
-	var sshPort int
-	err = database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass FROM access_controller WHERE id = ?", acID).
-		Scan(&ip, &sshPort, &sshUser, &sshPass)
+	var ac AccessController
+	err = database.DB.QueryRow("SELECT nave_id, ip, ssh_port, ssh_user, ssh_pass FROM access_controller WHERE id = ?", acID).
+		Scan(&ac.NaveID, &ac.IP, &ac.SSHPort, &ac.SSHUser, &ac.SSHPass)
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": "AC non trovato"})
 		return
 	}
 
-	// Esegui comando SSH per ottenere licenze
-	output, err := executeSSHCommandAC(ip, sshPort, sshUser, sshPass, "display license resource usage")
+	// Legge licenze AP tramite il driver dell'AC
+	cfg := ac.configRete()
+	cfg.TimeoutComando = 30 * time.Second
+	var licenzeTotali, licenzeUtilizzate int
+	err = conApparato(r.Context(), cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		licenzeTotali, licenzeUtilizzate, err = d.Licenze(ctx, s)
+		return err
+	})
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Errore connessione SSH: " + err.Error()})
 		return
 	}
 
-	// Parsa output per trovare licenze AP (cerca pattern X/Y)
-	licenzeTotali, licenzeUtilizzate := parseLicenseOutput(output)
-
 	if licenzeTotali == 0 {
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Impossibile rilevare licenze dall'output"})
 		return
@@ -2252,6 +1801,17 @@ func APIRilevaLicenzeAC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Apre o chiude il guasto per licenze in esaurimento
+	valutaGuasto(rilevazioneGuasto{
+		NaveID:       ac.NaveID,
+		Condizione:   "licenze_ac",
+		TipoApparato: "ac",
+		ApparatoID:   acID,
+		Nome:         fmt.Sprintf("AC (%s)", ac.IP),
+		Valore:       licenzeUtilizzate * 100 / licenzeTotali,
+		Dettaglio:    fmt.Sprintf("%d/%d licenze AP utilizzate", licenzeUtilizzate, licenzeTotali),
+	})
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":              "ok",
 		"licenze_totali":      licenzeTotali,
@@ -2259,68 +1819,3 @@ func APIRilevaLicenzeAC(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// parseLicenseOutput estrae licenze totali e utilizzate dall'output del comando
-func parseLicenseOutput(output string) (totali int, utilizzate int) {
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		// Cerca pattern come "46/48" nella riga
-		if strings.Contains(line, "/") && (strings.Contains(line, "LICAC") || strings.Contains(line, "SSAP") || strings.Contains(line, "AP")) {
-			// Trova il pattern X/Y
-			parts := strings.Fields(line)
-			for _, part := range parts {
-				if strings.Contains(part, "/") {
-					var u, t int
-					_, err := fmt.Sscanf(part, "%d/%d", &u, &t)
-					if err == nil && t > 0 {
-						return t, u
-					}
-				}
-			}
-		}
-	}
-	return 0, 0
-}
-
-// executeSSHCommandAC esegue un comando SSH sull'AC e ritorna l'output
-func executeSSHCommandAC(ip string, port int, user, pass, command string) (string, error) {
-	// Crea script expect temporaneo
-	script := fmt.Sprintf(`#!/usr/bin/expect -f
-set timeout 30
-spawn ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o KexAlgorithms=+diffie-hellman-group14-sha1,diffie-hellman-group1-sha1,diffie-hellman-group-exchange-sha1 -o HostKeyAlgorithms=+ssh-rsa -o ConnectTimeout=30 -p %d %s@%s
-expect {
-    "*assword*" { send "%s\r" }
-    timeout { exit 1 }
-}
-expect {
-    "*>*" { send "%s\r" }
-    "*#*" { send "%s\r" }
-    timeout { exit 1 }
-}
-expect {
-    "*>*" { }
-    "*#*" { }
-    timeout { exit 1 }
-}
-send "quit\r"
-expect eof
-`, port, user, ip, pass, command, command)
-
-	// Scrivi script temporaneo
-	tmpFile := fmt.Sprintf("/tmp/ac_license_%d.exp", time.Now().UnixNano())
-	if err := os.WriteFile(tmpFile, []byte(script), 0755); err != nil {
-		return "", err
-	}
-	defer os.Remove(tmpFile)
-
-	// Esegui script
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	
-	cmd := exec.CommandContext(ctx, tmpFile)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return string(output), err
-	}
-
-	return string(output), nil
-}
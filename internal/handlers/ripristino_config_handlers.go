@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/diff"
+	"furviogest/internal/middleware"
+	"furviogest/internal/netdevice"
+)
+
+// ============================================
+// RIPRISTINO CONFIGURAZIONE SU APPARATO
+// ============================================
+
+const (
+	// validitaAnteprima e il tempo entro cui confermare il ripristino dopo il dry-run
+	validitaAnteprima = 10 * time.Minute
+	// timeoutRipristino limita l'intera operazione, indipendente dalla richiesta HTTP
+	timeoutRipristino = 20 * time.Minute
+	// portaTFTP e la porta su cui gli apparati scaricano la configurazione
+	portaTFTP = ":69"
+)
+
+// anteprimaRipristino e un dry-run confermabile una sola volta dallo stesso utente
+type anteprimaRipristino struct {
+	Origine    string
+	BackupID   int64
+	UtenteID   int64
+	Modalita   string
+	TFTPServer string
+	Riavvio    bool // riavvio dell'apparato confermato dall'utente (TFTP)
+	Aggiunte   int
+	Rimosse    int
+	Scadenza   time.Time
+}
+
+var (
+	ripristiniMu        sync.Mutex
+	anteprimeRipristino = make(map[string]anteprimaRipristino)
+	// apparati con un ripristino in corso, per evitare invii sovrapposti
+	ripristiniInCorso = make(map[string]bool)
+)
+
+// ripristinoRegistrato rappresenta una riga di config_ripristino
+type ripristinoRegistrato struct {
+	Data      string
+	Utente    string
+	Modalita  string
+	Aggiunte  int
+	Rimosse   int
+	Esito     string
+	Messaggio string
+}
+
+// nuovaAnteprimaRipristino registra il dry-run e restituisce il token di conferma
+func nuovaAnteprimaRipristino(a anteprimaRipristino) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	ripristiniMu.Lock()
+	defer ripristiniMu.Unlock()
+	for t, vecchia := range anteprimeRipristino {
+		if time.Now().After(vecchia.Scadenza) {
+			delete(anteprimeRipristino, t)
+		}
+	}
+	a.Scadenza = time.Now().Add(validitaAnteprima)
+	anteprimeRipristino[token] = a
+	return token
+}
+
+// usaAnteprimaRipristino consuma il token di conferma verificandone la validita
+func usaAnteprimaRipristino(token, origine string, backupID, utenteID int64) (anteprimaRipristino, bool) {
+	ripristiniMu.Lock()
+	defer ripristiniMu.Unlock()
+	a, ok := anteprimeRipristino[token]
+	delete(anteprimeRipristino, token)
+	if !ok || time.Now().After(a.Scadenza) || a.Origine != origine || a.BackupID != backupID || a.UtenteID != utenteID {
+		return a, false
+	}
+	return a, true
+}
+
+// configApparatoBackup restituisce i parametri di connessione attuali dell'apparato del backup
+// (dopo una sostituzione l'apparato puo avere IP o credenziali diverse da quelle del backup)
+func configApparatoBackup(b *backupConfig) (netdevice.Config, error) {
+	switch {
+	case b.NaveID > 0 && b.TipoApparato == "ac":
+		ac := getAccessControllerByNave(b.NaveID)
+		if ac == nil {
+			return netdevice.Config{}, fmt.Errorf("access controller della nave non configurato")
+		}
+		return ac.configRete(), nil
+	case b.NaveID > 0:
+		sw := getSwitchByID(b.ApparatoID)
+		if sw == nil {
+			return netdevice.Config{}, fmt.Errorf("switch non piu presente in anagrafica")
+		}
+		return sw.configRete(), nil
+	case b.UfficioID > 0 && b.TipoApparato == "ac":
+		var ac ACUfficio
+		err := database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh') FROM ac_ufficio WHERE id = ?", b.ApparatoID).
+			Scan(&ac.IP, &ac.SSHPort, &ac.SSHUser, &ac.SSHPass, &ac.Protocollo)
+		if err != nil {
+			return netdevice.Config{}, fmt.Errorf("access controller non piu presente in anagrafica")
+		}
+		return ac.configRete(), nil
+	case b.UfficioID > 0:
+		var sw SwitchUfficio
+		err := database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), marca FROM switch_ufficio WHERE id = ?", b.ApparatoID).
+			Scan(&sw.IP, &sw.SSHPort, &sw.SSHUser, &sw.SSHPass, &sw.Protocollo, &sw.Marca)
+		if err != nil {
+			return netdevice.Config{}, fmt.Errorf("switch non piu presente in anagrafica")
+		}
+		return sw.configRete(), nil
+	default:
+		var sw SwitchSalaServer
+		err := database.DB.QueryRow("SELECT ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), marca FROM switch_sala_server WHERE id = ?", b.ApparatoID).
+			Scan(&sw.IP, &sw.SSHPort, &sw.SSHUser, &sw.SSHPass, &sw.Protocollo, &sw.Marca)
+		if err != nil {
+			return netdevice.Config{}, fmt.Errorf("switch non piu presente in anagrafica")
+		}
+		return sw.configRete(), nil
+	}
+}
+
+// getTFTPServer restituisce l'ultimo indirizzo TFTP usato per i ripristini
+func getTFTPServer() string {
+	var server string
+	database.DB.QueryRow("SELECT COALESCE(tftp_server, '') FROM monitoring_config WHERE id = 1").Scan(&server)
+	return server
+}
+
+// eseguiRipristino invia la configurazione all'apparato nella modalita scelta
+func eseguiRipristino(ctx context.Context, cfg netdevice.Config, backupID int64, config string, a anteprimaRipristino) (string, error) {
+	if a.Modalita != "tftp" {
+		var output string
+		err := conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+			var err error
+			output, err = d.ApplicaConfig(ctx, s, config)
+			return err
+		})
+		return output, err
+	}
+
+	// L'apparato scarica il file da un server TFTP temporaneo avviato per l'occasione
+	nomeFile := fmt.Sprintf("furviogest_%d.cfg", backupID)
+	srv, err := netdevice.AvviaServerTFTP(portaTFTP, nomeFile, []byte(config))
+	if err != nil {
+		return "", err
+	}
+	defer srv.Chiudi()
+
+	var output string
+	err = conApparato(ctx, cfg, func(ctx context.Context, d netdevice.Driver, s *netdevice.Sessione) error {
+		var err error
+		output, err = d.CaricaConfigTFTP(ctx, s, a.TFTPServer, nomeFile, a.Riavvio)
+		return err
+	})
+	if err != nil {
+		return output, err
+	}
+
+	// Il comando sull'apparato termina dopo il download: il trasferimento deve risultare completo
+	ctxTFTP, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := srv.Attendi(ctxTFTP); err != nil {
+		return output, fmt.Errorf("trasferimento TFTP: %w", err)
+	}
+	return output, nil
+}
+
+// registraRipristino scrive l'audit del ripristino
+func registraRipristino(r *http.Request, b *backupConfig, backup *ConfigBackup, ip string, a anteprimaRipristino, esito, messaggio, output string) {
+	var utenteID int64
+	var utente string
+	if s := middleware.GetSession(r); s != nil {
+		utenteID, utente = s.UserID, s.Username
+	}
+	if len(output) > 200000 {
+		output = output[:200000]
+	}
+	_, err := database.DB.Exec(`
+		INSERT INTO config_ripristino (origine, backup_id, tipo_apparato, apparato_id, nome_apparato, ip, modalita,
+			righe_aggiunte, righe_rimosse, esito, messaggio, output, utente_id, utente)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.Origine, backup.ID, b.TipoApparato, b.ApparatoID, backup.NomeApparato, ip, a.Modalita,
+		a.Aggiunte, a.Rimosse, esito, messaggio, output, nullID(utenteID), utente)
+	if err != nil {
+		log.Printf("[RIPRISTINO] Errore registrazione audit: %v", err)
+	}
+	log.Printf("[RIPRISTINO] %s: backup %d su %s (%s) via %s: %s", utente, backup.ID, backup.NomeApparato, ip, a.Modalita, esito)
+}
+
+// ripristiniApparato restituisce gli ultimi ripristini sull'apparato
+func ripristiniApparato(b *backupConfig, origine string) []ripristinoRegistrato {
+	var elenco []ripristinoRegistrato
+	rows, err := database.DB.Query(`
+		SELECT created_at, COALESCE(utente, ''), modalita, righe_aggiunte, righe_rimosse, esito, COALESCE(messaggio, '')
+		FROM config_ripristino WHERE origine = ? AND tipo_apparato = ? AND apparato_id = ?
+		ORDER BY created_at DESC LIMIT 20
+	`, origine, b.TipoApparato, b.ApparatoID)
+	if err != nil {
+		return elenco
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rr ripristinoRegistrato
+		var data time.Time
+		if err := rows.Scan(&data, &rr.Utente, &rr.Modalita, &rr.Aggiunte, &rr.Rimosse, &rr.Esito, &rr.Messaggio); err != nil {
+			continue
+		}
+		rr.Data = data.Local().Format("02/01/2006 15:04")
+		elenco = append(elenco, rr)
+	}
+	return elenco
+}
+
+// RipristinoConfig gestisce il ripristino di un backup sull'apparato: anteprima delle
+// differenze con la running-config, conferma esplicita e invio
+func RipristinoConfig(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Ripristino Configurazione - FurvioGest", r)
+	origine := r.FormValue("origine")
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+	b, backup, err := caricaBackupConfig(origine, id)
+	if err != nil {
+		http.Error(w, "Backup non trovato", http.StatusNotFound)
+		return
+	}
+	modalita := r.FormValue("modalita")
+	if modalita != "tftp" {
+		modalita = "incolla"
+	}
+	tftpServer := strings.TrimSpace(r.FormValue("tftp_server"))
+	if tftpServer == "" {
+		tftpServer = getTFTPServer()
+	}
+
+	pagina := map[string]interface{}{
+		"Origine":    origine,
+		"Backup":     backup,
+		"Modalita":   modalita,
+		"TFTPServer": tftpServer,
+	}
+	data.Data = pagina
+
+	// Alcuni apparati (switch HP) caricano la configurazione via TFTP riavviandosi subito
+	riavvio := false
+	if d, err := netdevice.DriverPer(b.Marca); err == nil && modalita == "tftp" {
+		riavvio = d.RiavvioConTFTP()
+	}
+	pagina["Riavvio"] = riavvio
+
+	cfg, errApparato := configApparatoBackup(b)
+	pagina["IP"] = cfg.IP
+	contenuto, errFile := os.ReadFile(backup.FilePath)
+	config := netdevice.EstraiConfig(string(contenuto))
+
+	switch {
+	case errApparato != nil:
+		data.Error = "Impossibile ripristinare: " + errApparato.Error()
+	case errFile != nil:
+		data.Error = "File di backup non trovato su disco"
+	case r.Method == http.MethodPost && r.FormValue("azione") == "anteprima":
+		if modalita == "tftp" && net.ParseIP(tftpServer) == nil {
+			data.Error = "Indicare l'indirizzo IP di questo server raggiungibile dall'apparato"
+			break
+		}
+
+		// Dry-run: differenze tra la configurazione attuale e quella del backup
+		attuale, err := leggiRunningConfig(r.Context(), cfg)
+		if err != nil {
+			data.Error = "Errore lettura configurazione attuale: " + err.Error()
+			break
+		}
+		righe := diff.Confronta(
+			diff.Linee(netdevice.NormalizzaConfig(b.Marca, netdevice.EstraiConfig(attuale))),
+			diff.Linee(netdevice.NormalizzaConfig(b.Marca, config)))
+		aggiunte, rimosse := diff.Conta(righe)
+
+		utente := middleware.GetSession(r)
+		pagina["Blocchi"] = diff.Blocchi(righe, 3)
+		pagina["Aggiunte"] = aggiunte
+		pagina["Rimosse"] = rimosse
+		pagina["Token"] = nuovaAnteprimaRipristino(anteprimaRipristino{
+			Origine:    origine,
+			BackupID:   backup.ID,
+			UtenteID:   utente.UserID,
+			Modalita:   modalita,
+			TFTPServer: tftpServer,
+			Aggiunte:   aggiunte,
+			Rimosse:    rimosse,
+		})
+
+	case r.Method == http.MethodPost && r.FormValue("azione") == "applica":
+		utente := middleware.GetSession(r)
+		anteprima, ok := usaAnteprimaRipristino(r.FormValue("token"), origine, backup.ID, utente.UserID)
+		if !ok {
+			data.Error = "Anteprima scaduta o non valida: ripetere il confronto prima di applicare"
+			break
+		}
+		if !strings.EqualFold(strings.TrimSpace(r.FormValue("conferma")), backup.NomeApparato) {
+			data.Error = "Il nome digitato non corrisponde all'apparato: ripristino annullato"
+			break
+		}
+		if anteprima.Modalita == "tftp" && riavvio {
+			if r.FormValue("conferma_riavvio") != "1" {
+				data.Error = "Il caricamento riavvia l'apparato: confermare il riavvio per procedere"
+				break
+			}
+			anteprima.Riavvio = true
+		}
+
+		chiave := fmt.Sprintf("%s/%s/%d", b.Tabella, b.TipoApparato, b.ApparatoID)
+		ripristiniMu.Lock()
+		occupato := ripristiniInCorso[chiave]
+		ripristiniInCorso[chiave] = true
+		ripristiniMu.Unlock()
+		if occupato {
+			data.Error = "Un altro ripristino su questo apparato e gia in corso"
+			break
+		}
+
+		if anteprima.Modalita == "tftp" {
+			database.DB.Exec("UPDATE monitoring_config SET tftp_server = ? WHERE id = 1", anteprima.TFTPServer)
+		}
+
+		// Il ripristino prosegue anche se il browser chiude la richiesta
+		ctx, cancel := context.WithTimeout(context.Background(), timeoutRipristino)
+		output, err := eseguiRipristino(ctx, cfg, backup.ID, config, anteprima)
+		cancel()
+
+		ripristiniMu.Lock()
+		delete(ripristiniInCorso, chiave)
+		ripristiniMu.Unlock()
+
+		esito, messaggio := "ok", "Configurazione applicata e salvata"
+		if anteprima.Modalita == "tftp" {
+			messaggio = "Configurazione caricata come configurazione di avvio: viene applicata al riavvio dell'apparato"
+			if anteprima.Riavvio {
+				messaggio = "Configurazione caricata come configurazione di avvio: l'apparato si sta riavviando"
+			}
+		}
+		switch {
+		case errors.Is(err, netdevice.ErrConfigParziale):
+			esito, messaggio = "parziale", err.Error()
+		case err != nil:
+			esito, messaggio = "errore", err.Error()
+		}
+		registraRipristino(r, b, backup, cfg.IP, anteprima, esito, messaggio, output)
+
+		pagina["Esito"] = esito
+		pagina["Output"] = output
+		if esito == "ok" {
+			data.Success = messaggio
+		} else {
+			data.Error = "Ripristino " + esito + ": " + messaggio
+		}
+	}
+
+	pagina["Ripristini"] = ripristiniApparato(b, origine)
+	renderTemplate(w, "config_ripristino.html", data)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/auth"
+)
+
+// ============================================
+// RUOLI E AUTORIZZAZIONI
+// ============================================
+
+// gruppoAutorizzazioni raccoglie le voci del catalogo di un gruppo per il form
+type gruppoAutorizzazioni struct {
+	Nome string
+	Voci []auth.Autorizzazione
+}
+
+// gruppiAutorizzazioni restituisce il catalogo diviso per gruppo, nell'ordine originale
+func gruppiAutorizzazioni() []gruppoAutorizzazioni {
+	var gruppi []gruppoAutorizzazioni
+	for _, a := range auth.Catalogo {
+		if len(gruppi) == 0 || gruppi[len(gruppi)-1].Nome != a.Gruppo {
+			gruppi = append(gruppi, gruppoAutorizzazioni{Nome: a.Gruppo})
+		}
+		gruppi[len(gruppi)-1].Voci = append(gruppi[len(gruppi)-1].Voci, a)
+	}
+	return gruppi
+}
+
+// ListaRuoli mostra i ruoli con il numero di utenti e di autorizzazioni
+func ListaRuoli(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Ruoli - FurvioGest", r)
+
+	switch r.URL.Query().Get("error") {
+	case "sistema":
+		data.Error = auth.ErrRuoloSistema.Error()
+	case "in_uso":
+		data.Error = auth.ErrRuoloInUso.Error()
+	case "eliminazione":
+		data.Error = "Errore durante l'eliminazione del ruolo"
+	}
+
+	ruoli, err := auth.ElencoRuoli()
+	if err != nil {
+		data.Error = "Errore nel recupero dei ruoli"
+	}
+	data.Data = map[string]interface{}{
+		"Ruoli":  ruoli,
+		"Totale": len(auth.Catalogo),
+	}
+	renderTemplate(w, "ruoli_lista.html", data)
+}
+
+// NuovoRuolo crea un ruolo con le autorizzazioni selezionate
+func NuovoRuolo(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Nuovo Ruolo - FurvioGest", r)
+
+	if r.Method == http.MethodGet {
+		data.Data = map[string]interface{}{
+			"Gruppi":      gruppiAutorizzazioni(),
+			"Selezionate": map[string]bool{},
+		}
+		renderTemplate(w, "ruoli_form.html", data)
+		return
+	}
+
+	r.ParseForm()
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		id, err := auth.SalvaRuolo(tx, 0, r.FormValue("codice"), strings.TrimSpace(r.FormValue("nome")),
+			strings.TrimSpace(r.FormValue("descrizione")), r.Form["autorizzazioni"])
+		if err != nil {
+			return err
+		}
+		t.Crea("ruoli", id, figliRuolo...)
+		return nil
+	})
+	if err != nil {
+		data.Error = "Errore durante il salvataggio: il codice deve essere univoco"
+		data.Data = map[string]interface{}{
+			"Gruppi":      gruppiAutorizzazioni(),
+			"Selezionate": selezionate(r.Form["autorizzazioni"]),
+		}
+		renderTemplate(w, "ruoli_form.html", data)
+		return
+	}
+
+	http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+}
+
+// ModificaRuolo aggiorna nome, descrizione e autorizzazioni di un ruolo
+func ModificaRuolo(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Modifica Ruolo - FurvioGest", r)
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/ruoli/modifica/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+		return
+	}
+	ruolo, err := auth.LeggiRuolo(id)
+	if err != nil {
+		http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost && !ruolo.Completo() {
+		r.ParseForm()
+		nome := strings.TrimSpace(r.FormValue("nome"))
+		if nome == "" {
+			nome = ruolo.Nome
+		}
+		err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			if err := t.Modifica("ruoli", id, figliRuolo...); err != nil {
+				return err
+			}
+			_, err := auth.SalvaRuolo(tx, id, "", nome, strings.TrimSpace(r.FormValue("descrizione")), r.Form["autorizzazioni"])
+			return err
+		})
+		if err != nil {
+			data.Error = "Errore durante il salvataggio"
+		} else {
+			http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data.Data = map[string]interface{}{
+		"Ruolo":       ruolo,
+		"Bloccato":    ruolo.Completo(),
+		"Gruppi":      gruppiAutorizzazioni(),
+		"Selezionate": ruolo.Autorizzazioni,
+	}
+	renderTemplate(w, "ruoli_form.html", data)
+}
+
+// EliminaRuolo elimina un ruolo personalizzato non assegnato
+func EliminaRuolo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+		return
+	}
+	id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/ruoli/elimina/"), 10, 64)
+
+	err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("ruoli", id, figliRuolo...); err != nil {
+			return err
+		}
+		return auth.EliminaRuolo(tx, id)
+	})
+	switch err {
+	case nil:
+		http.Redirect(w, r, "/ruoli", http.StatusSeeOther)
+	case auth.ErrRuoloSistema:
+		http.Redirect(w, r, "/ruoli?error=sistema", http.StatusSeeOther)
+	case auth.ErrRuoloInUso:
+		http.Redirect(w, r, "/ruoli?error=in_uso", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/ruoli?error=eliminazione", http.StatusSeeOther)
+	}
+}
+
+// selezionate trasforma le autorizzazioni inviate dal form in un insieme
+func selezionate(codici []string) map[string]bool {
+	insieme := make(map[string]bool)
+	for _, c := range codici {
+		insieme[c] = true
+	}
+	return insieme
+}
@@ -9,7 +9,10 @@ import (
 	"strconv"
 	"strings"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
+	"furviogest/internal/netdevice"
 )
 
 // ============================================
@@ -93,7 +96,7 @@ func NuovaSalaServer(w http.ResponseWriter, r *http.Request) {
 	email := strings.TrimSpace(r.FormValue("email"))
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	_, err := database.DB.Exec("INSERT INTO sale_server (nome, indirizzo, citta, cap, telefono, email, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	_, err := creaConAudit(r, "sale_server", "INSERT INTO sale_server (nome, indirizzo, citta, cap, telefono, email, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		nome, indirizzo, citta, cap, telefono, email, note)
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -130,7 +133,7 @@ func ModificaSalaServer(w http.ResponseWriter, r *http.Request) {
 	email := strings.TrimSpace(r.FormValue("email"))
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	database.DB.Exec("UPDATE sale_server SET nome = ?, indirizzo = ?, citta = ?, cap = ?, telefono = ?, email = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+	modificaConAudit(r, "sale_server", id, "UPDATE sale_server SET nome = ?, indirizzo = ?, citta = ?, cap = ?, telefono = ?, email = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
 		nome, indirizzo, citta, cap, telefono, email, note, id)
 
 	http.Redirect(w, r, "/sale-server", http.StatusSeeOther)
@@ -140,7 +143,7 @@ func EliminaSalaServer(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/sale-server/elimina/")
 	id, _ := strconv.ParseInt(path, 10, 64)
 
-	database.DB.Exec("DELETE FROM sale_server WHERE id = ?", id)
+	eliminaConAudit(r, "sale_server", id, "DELETE FROM sale_server WHERE id = ?", id)
 	http.Redirect(w, r, "/sale-server", http.StatusSeeOther)
 }
 
@@ -212,11 +215,17 @@ func NuovoSwitchSalaServer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Recupera hostname automaticamente
-	nome := getSwitchHostname(ip, sshPort, sshUser, sshPass, marca, protocollo)
+	nome := getSwitchHostname(r.Context(), ip, sshPort, sshUser, sshPass, marca, protocollo)
 	log.Printf("[NUOVO SWITCH SALA SERVER] Hostname recuperato: %s", nome)
 
-	_, err := database.DB.Exec("INSERT INTO switch_sala_server (sala_server_id, nome, marca, modello, ip, ssh_port, ssh_user, ssh_pass, note, protocollo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		salaServerID, nome, marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = creaConAudit(r, "switch_sala_server", "INSERT INTO switch_sala_server (sala_server_id, nome, marca, modello, ip, ssh_port, ssh_user, ssh_pass, note, protocollo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		salaServerID, nome, marca, modello, ip, sshPort, sshUser, sshPassCifrata, note, protocollo)
 
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -254,8 +263,14 @@ func ModificaSwitchSalaServer(w http.ResponseWriter, r *http.Request) {
 		protocollo = "ssh"
 	}
 
-	database.DB.Exec("UPDATE switch_sala_server SET marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = ?, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-		marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo, switchID)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	modificaConAudit(r, "switch_sala_server", switchID, "UPDATE switch_sala_server SET marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = CASE WHEN ? = '' THEN ssh_pass ELSE ? END, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		marca, modello, ip, sshPort, sshUser, sshPassCifrata, sshPassCifrata, note, protocollo, switchID)
 
 	http.Redirect(w, r, fmt.Sprintf("/sale-server/rete/%d", salaServerID), http.StatusSeeOther)
 }
@@ -279,9 +294,17 @@ func EliminaSwitchSalaServer(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	database.DB.Exec("DELETE FROM config_backup_ufficio WHERE (tipo_apparato = 'switch' OR tipo_apparato = 'switch_sala_server') AND apparato_id = ? AND sala_server_id IS NOT NULL", switchID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("switch_sala_server", switchID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM config_backup_ufficio WHERE (tipo_apparato = 'switch' OR tipo_apparato = 'switch_sala_server') AND apparato_id = ? AND sala_server_id IS NOT NULL", switchID); err != nil {
+			return err
+		}
 
-	database.DB.Exec("DELETE FROM switch_sala_server WHERE id = ?", switchID)
+		_, err := tx.Exec("DELETE FROM switch_sala_server WHERE id = ?", switchID)
+		return err
+	})
 	http.Redirect(w, r, fmt.Sprintf("/sale-server/rete/%d", salaServerID), http.StatusSeeOther)
 }
 
@@ -289,6 +312,11 @@ func EliminaSwitchSalaServer(w http.ResponseWriter, r *http.Request) {
 // FUNZIONI HELPER
 // ============================================
 
+// configRete restituisce i parametri di connessione dello switch sala server
+func (sw *SwitchSalaServer) configRete() netdevice.Config {
+	return configApparato(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, sw.Protocollo, sw.Marca)
+}
+
 func getSwitchesSalaServer(salaServerID int64) []SwitchSalaServer {
 	var switches []SwitchSalaServer
 	rows, err := database.DB.Query("SELECT id, sala_server_id, nome, marca, COALESCE(modello, ''), ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), COALESCE(note, ''), ultimo_backup, COALESCE(porte_totali, 0), COALESCE(porte_libere, 0), ultimo_check FROM switch_sala_server WHERE sala_server_id = ? ORDER BY nome", salaServerID)
@@ -314,7 +342,7 @@ func getSwitchesSalaServer(salaServerID int64) []SwitchSalaServer {
 
 func getBackupsSalaServer(salaServerID int64, limit int) []ConfigBackup {
 	var backups []ConfigBackup
-	rows, err := database.DB.Query("SELECT id, COALESCE(sala_server_id, 0), tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at FROM config_backup_ufficio WHERE sala_server_id = ? ORDER BY created_at DESC LIMIT ?", salaServerID, limit)
+	rows, err := database.DB.Query("SELECT id, COALESCE(sala_server_id, 0), tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at, COALESCE(backup_precedente_id, 0), cambiato, righe_aggiunte, righe_rimosse FROM config_backup_ufficio WHERE sala_server_id = ? ORDER BY created_at DESC LIMIT ?", salaServerID, limit)
 	if err != nil {
 		return backups
 	}
@@ -322,7 +350,8 @@ func getBackupsSalaServer(salaServerID int64, limit int) []ConfigBackup {
 
 	for rows.Next() {
 		var b ConfigBackup
-		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt)
+		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt,
+			&b.BackupPrecedenteID, &b.Cambiato, &b.RigheAggiunte, &b.RigheRimosse)
 		backups = append(backups, b)
 	}
 	return backups
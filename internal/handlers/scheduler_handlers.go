@@ -0,0 +1,578 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/cron"
+	"furviogest/internal/database"
+	"furviogest/internal/middleware"
+)
+
+// ============================================
+// SCHEDULER MONITORAGGIO
+// ============================================
+
+// jobSchedulabile descrive un tipo di job gestito dallo scheduler
+type jobSchedulabile struct {
+	tipo        string
+	descrizione string
+	perNave     func(nave naveMonitorata) []attivitaApparato // job eseguito nave per nave (ammette override per nave)
+	globale     func() []attivitaApparato                    // job non legato alle navi
+}
+
+// jobSchedulabili elenca i job nell'ordine di esecuzione
+var jobSchedulabili = []jobSchedulabile{
+	{tipo: "scan_ap", descrizione: "Scan Access Point", perNave: attivitaScanAP},
+	{tipo: "scan_mac", descrizione: "Scan tabella MAC switch", perNave: attivitaScanMAC},
+	{tipo: "backup_config", descrizione: "Backup configurazioni nave", perNave: attivitaBackupConfig},
+	{tipo: "backup_uffici", descrizione: "Backup uffici", globale: attivitaBackupUffici},
+	{tipo: "backup_sale_server", descrizione: "Backup sale server", globale: attivitaBackupSaleServer},
+	{tipo: "snmp_poll", descrizione: "Polling SNMP", perNave: attivitaPollingSNMP},
+}
+
+// pianificazioneJob rappresenta una riga di scheduler_job o scheduler_job_nave
+type pianificazioneJob struct {
+	ID               int64
+	Tipo             string
+	NaveID           int64 // 0 per la pianificazione globale
+	NaveNome         string
+	Cron             string
+	Abilitato        bool
+	UltimaEsecuzione sql.NullTime
+	UltimoEsito      string
+	UltimoMessaggio  string
+	Modificato       time.Time
+}
+
+var (
+	schedulerMu   sync.Mutex
+	jobInCorso    = make(map[string]bool)
+	ultimaSaltata = make(map[string]time.Time) // per chiave, ultima esecuzione prevista saltata
+)
+
+// StartMonitoringScheduler avvia lo scheduler dei job di monitoraggio
+func StartMonitoringScheduler() {
+	go func() {
+		// Primo controllo all'avvio: recupera le esecuzioni perse mentre il server era fermo
+		controllaJobScaduti()
+		pulisciStoricoRun()
+
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for ora := range ticker.C {
+			controllaJobScaduti()
+			if ora.Minute() == 0 {
+				pulisciStoricoRun()
+			}
+		}
+	}()
+	log.Println("[Scheduler] Scheduler monitoraggio avviato")
+}
+
+// riferimento restituisce l'istante da cui calcolare la prossima esecuzione:
+// l'ultima esecuzione, o l'ultima modifica della pianificazione se successiva
+func (p *pianificazioneJob) riferimento() time.Time {
+	if p.UltimaEsecuzione.Valid && p.UltimaEsecuzione.Time.After(p.Modificato) {
+		return p.UltimaEsecuzione.Time
+	}
+	return p.Modificato
+}
+
+// Prossima restituisce la prossima esecuzione prevista (zero se non calcolabile)
+func (p *pianificazioneJob) Prossima() time.Time {
+	espr, err := cron.Parse(p.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return espr.Prossima(p.riferimento().Local())
+}
+
+// scaduta indica se il job doveva essere eseguito entro l'istante indicato.
+// Piu esecuzioni perse vengono recuperate con un'unica esecuzione.
+func (p *pianificazioneJob) scaduta(ora time.Time) bool {
+	if !p.Abilitato {
+		return false
+	}
+	prossima := p.Prossima()
+	return !prossima.IsZero() && !prossima.After(ora)
+}
+
+// ultimaPrevista restituisce l'ultima esecuzione prevista entro l'istante indicato
+// (zero se non ce ne sono dall'ultima esecuzione)
+func (p *pianificazioneJob) ultimaPrevista(ora time.Time) time.Time {
+	espr, err := cron.Parse(p.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	prevista := espr.Prossima(p.riferimento().Local())
+	if prevista.IsZero() || prevista.After(ora) {
+		return time.Time{}
+	}
+	for {
+		successiva := espr.Prossima(prevista)
+		if successiva.IsZero() || successiva.After(ora) {
+			return prevista
+		}
+		prevista = successiva
+	}
+}
+
+// chiave identifica la pianificazione nella mappa dei job in corso
+func (p *pianificazioneJob) chiave() string {
+	if p.NaveID > 0 {
+		return fmt.Sprintf("%s:%d", p.Tipo, p.NaveID)
+	}
+	return p.Tipo
+}
+
+// controllaJobScaduti avvia i job la cui pianificazione e scaduta.
+// Ogni job gira per conto suo: un backup lungo non ritarda il polling frequente.
+func controllaJobScaduti() {
+	ora := time.Now()
+	for _, job := range jobSchedulabili {
+		globale, err := caricaPianificazione(job.tipo)
+		if err != nil {
+			log.Printf("[Scheduler] Errore lettura pianificazione %s: %v", job.tipo, err)
+			continue
+		}
+		if globale.scaduta(ora) && !avviaPianificazione(job, globale) {
+			segnalaSaltata(globale, ora)
+		}
+		if job.perNave == nil {
+			continue
+		}
+		for _, override := range caricaOverrideNave(job.tipo, 0) {
+			if override.scaduta(ora) && !avviaPianificazione(job, &override) {
+				segnalaSaltata(&override, ora)
+			}
+		}
+	}
+}
+
+// segnalaSaltata registra nel log un'esecuzione saltata perche la precedente e ancora in
+// corso. Il controllo gira ogni minuto: ogni esecuzione prevista viene segnalata una volta.
+func segnalaSaltata(p *pianificazioneJob, ora time.Time) {
+	prevista := p.ultimaPrevista(ora)
+	schedulerMu.Lock()
+	giaSegnalata := ultimaSaltata[p.chiave()].Equal(prevista)
+	ultimaSaltata[p.chiave()] = prevista
+	schedulerMu.Unlock()
+
+	if !giaSegnalata {
+		log.Printf("[Scheduler] Job %s (%s) ancora in corso, esecuzione delle %s saltata",
+			p.Tipo, p.chiave(), prevista.Format("02/01/2006 15:04"))
+	}
+}
+
+// segnaInCorso registra la chiave tra i job in corso. Restituisce false se lo era gia.
+func segnaInCorso(chiave string) bool {
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	if jobInCorso[chiave] {
+		return false
+	}
+	jobInCorso[chiave] = true
+	return true
+}
+
+// liberaInCorso toglie la chiave dai job in corso
+func liberaInCorso(chiave string) {
+	schedulerMu.Lock()
+	delete(jobInCorso, chiave)
+	schedulerMu.Unlock()
+}
+
+// jobInEsecuzione indica se la chiave e tra i job in corso
+func jobInEsecuzione(chiave string) bool {
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	return jobInCorso[chiave]
+}
+
+// avviaPianificazione avvia il job in background, se la stessa pianificazione non e
+// ancora in corso: un'esecuzione piu lunga dell'intervallo non si sovrappone alla successiva
+func avviaPianificazione(job jobSchedulabile, p *pianificazioneJob) bool {
+	if !segnaInCorso(p.chiave()) {
+		return false
+	}
+	go func() {
+		defer liberaInCorso(p.chiave())
+		eseguiPianificazione(job, p)
+	}()
+	return true
+}
+
+// eseguiPianificazione esegue il job per la pianificazione indicata e ne registra l'esito.
+// La pianificazione globale di un job per nave copre le navi senza override.
+func eseguiPianificazione(job jobSchedulabile, p *pianificazioneJob) {
+	inizio := time.Now()
+	log.Printf("[Scheduler] Avvio job %s (%s)", job.tipo, p.chiave())
+
+	var attivita []attivitaApparato
+	if job.globale != nil {
+		attivita = job.globale()
+	} else {
+		for _, nave := range naviPianificazione(p) {
+			attivita = append(attivita, job.perNave(nave)...)
+		}
+	}
+	esito, messaggio := eseguiAttivita(job.tipo, attivita).esito()
+
+	// L'istante di avvio fa da riferimento per la prossima esecuzione
+	if len(messaggio) > 2000 {
+		messaggio = messaggio[:2000] + "..."
+	}
+	tabella := "scheduler_job"
+	if p.NaveID > 0 {
+		tabella = "scheduler_job_nave"
+	}
+	database.DB.Exec(fmt.Sprintf("UPDATE %s SET ultima_esecuzione = ?, ultimo_esito = ?, ultimo_messaggio = ? WHERE id = ?", tabella),
+		inizio.UTC().Format("2006-01-02 15:04:05"), esito, messaggio, p.ID)
+
+	log.Printf("[Scheduler] Job %s (%s) terminato in %s: %s", job.tipo, p.chiave(), time.Since(inizio).Round(time.Second), esito)
+}
+
+// naviPianificazione restituisce le navi coperte dalla pianificazione:
+// la nave dell'override, oppure tutte le navi attive senza override
+func naviPianificazione(p *pianificazioneJob) []naveMonitorata {
+	navi := getNaviMonitorabili()
+	if p.NaveID > 0 {
+		for _, n := range navi {
+			if n.ID == p.NaveID {
+				return []naveMonitorata{n}
+			}
+		}
+		return nil
+	}
+
+	conOverride := make(map[int64]bool)
+	for _, o := range caricaOverrideNave(p.Tipo, 0) {
+		conOverride[o.NaveID] = true
+	}
+	var risultato []naveMonitorata
+	for _, n := range navi {
+		if !conOverride[n.ID] {
+			risultato = append(risultato, n)
+		}
+	}
+	return risultato
+}
+
+// caricaPianificazione legge la pianificazione globale di un tipo di job
+func caricaPianificazione(tipo string) (*pianificazioneJob, error) {
+	p := &pianificazioneJob{Tipo: tipo}
+	var esito, messaggio sql.NullString
+	var creato, modificato sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT id, cron, abilitato, ultima_esecuzione, ultimo_esito, ultimo_messaggio, created_at, updated_at
+		FROM scheduler_job WHERE tipo = ?
+	`, tipo).Scan(&p.ID, &p.Cron, &p.Abilitato, &p.UltimaEsecuzione, &esito, &messaggio, &creato, &modificato)
+	if err != nil {
+		return nil, err
+	}
+	p.UltimoEsito = esito.String
+	p.UltimoMessaggio = messaggio.String
+	p.Modificato = ultimaModifica(creato, modificato)
+	return p, nil
+}
+
+// caricaOverrideNave legge gli override per nave di un tipo di job, solo per le navi
+// della compagnia se diversa da 0
+func caricaOverrideNave(tipo string, compagniaID int64) []pianificazioneJob {
+	rows, err := database.DB.Query(`
+		SELECT s.id, s.nave_id, n.nome, s.cron, s.abilitato, s.ultima_esecuzione, s.ultimo_esito, s.ultimo_messaggio, s.created_at, s.updated_at
+		FROM scheduler_job_nave s
+		JOIN navi n ON n.id = s.nave_id
+		WHERE s.tipo = ? AND (? = 0 OR n.compagnia_id = ?)
+		ORDER BY n.nome
+	`, tipo, compagniaID, compagniaID)
+	if err != nil {
+		log.Printf("[Scheduler] Errore lettura override %s: %v", tipo, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var overrides []pianificazioneJob
+	for rows.Next() {
+		p := pianificazioneJob{Tipo: tipo}
+		var esito, messaggio sql.NullString
+		var creato, modificato sql.NullTime
+		if err := rows.Scan(&p.ID, &p.NaveID, &p.NaveNome, &p.Cron, &p.Abilitato, &p.UltimaEsecuzione, &esito, &messaggio, &creato, &modificato); err != nil {
+			continue
+		}
+		p.UltimoEsito = esito.String
+		p.UltimoMessaggio = messaggio.String
+		p.Modificato = ultimaModifica(creato, modificato)
+		overrides = append(overrides, p)
+	}
+	return overrides
+}
+
+// ultimaModifica restituisce la piu recente tra creazione e aggiornamento
+func ultimaModifica(creato, modificato sql.NullTime) time.Time {
+	if modificato.Valid && modificato.Time.After(creato.Time) {
+		return modificato.Time
+	}
+	return creato.Time
+}
+
+// ============================================
+// PAGINA PIANIFICAZIONE
+// ============================================
+
+// statoPianificazione contiene i dati di una pianificazione per la pagina
+type statoPianificazione struct {
+	ID               int64
+	NaveID           int64
+	NaveNome         string
+	Cron             string
+	Abilitato        bool
+	InCorso          bool
+	Prossima         string
+	InRitardo        bool
+	UltimaEsecuzione string
+	UltimoEsito      string
+	UltimoMessaggio  string
+}
+
+// statoJob contiene lo stato di un tipo di job e dei suoi override
+type statoJob struct {
+	Tipo        string
+	Descrizione string
+	PerNave     bool
+	Globale     statoPianificazione
+	Override    []statoPianificazione
+}
+
+// SchedulerMonitoraggio mostra la pianificazione dei job di monitoraggio e gestisce le modifiche
+func SchedulerMonitoraggio(w http.ResponseWriter, r *http.Request) {
+	data := NewPageData("Pianificazione Monitoraggio - FurvioGest", r)
+
+	if r.Method == http.MethodPost {
+		msg, err := salvaScheduler(r)
+		if err == nil {
+			http.Redirect(w, r, "/monitoraggio/scheduler?success="+msg, http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+	}
+
+	switch r.URL.Query().Get("success") {
+	case "salvato":
+		data.Success = "Pianificazione salvata"
+	case "eliminato":
+		data.Success = "Override eliminato"
+	case "avviato":
+		data.Success = "Job avviato in background"
+	case "config":
+		data.Success = "Limiti di esecuzione salvati"
+	}
+
+	var jobs []statoJob
+	for _, job := range jobSchedulabili {
+		p, err := caricaPianificazione(job.tipo)
+		if err != nil {
+			continue
+		}
+		sj := statoJob{
+			Tipo:        job.tipo,
+			Descrizione: job.descrizione,
+			PerNave:     job.perNave != nil,
+			Globale:     statoDaPianificazione(p),
+		}
+		if sj.PerNave {
+			for _, o := range caricaOverrideNave(job.tipo, data.Session.CompagniaID) {
+				sj.Override = append(sj.Override, statoDaPianificazione(&o))
+			}
+		}
+		jobs = append(jobs, sj)
+	}
+
+	var navi []naveMonitorata
+	rows, err := database.DB.Query("SELECT id, nome FROM navi WHERE ? = 0 OR compagnia_id = ? ORDER BY nome",
+		data.Session.CompagniaID, data.Session.CompagniaID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var n naveMonitorata
+			rows.Scan(&n.ID, &n.Nome)
+			navi = append(navi, n)
+		}
+	}
+
+	data.Data = map[string]interface{}{
+		"Jobs":   jobs,
+		"Navi":   navi,
+		"Config": getConfigMonitoraggio(),
+	}
+	renderTemplate(w, "scheduler_monitoraggio.html", data)
+}
+
+// statoDaPianificazione prepara una pianificazione per la visualizzazione
+func statoDaPianificazione(p *pianificazioneJob) statoPianificazione {
+	s := statoPianificazione{
+		ID:              p.ID,
+		NaveID:          p.NaveID,
+		NaveNome:        p.NaveNome,
+		Cron:            p.Cron,
+		Abilitato:       p.Abilitato,
+		UltimoEsito:     p.UltimoEsito,
+		UltimoMessaggio: p.UltimoMessaggio,
+	}
+	s.InCorso = jobInEsecuzione(p.chiave())
+
+	if p.UltimaEsecuzione.Valid {
+		s.UltimaEsecuzione = p.UltimaEsecuzione.Time.Local().Format("02/01/2006 15:04")
+	}
+	if p.Abilitato {
+		if prossima := p.Prossima(); !prossima.IsZero() {
+			s.Prossima = prossima.Format("02/01/2006 15:04")
+			s.InRitardo = prossima.Before(time.Now())
+		}
+	}
+	return s
+}
+
+// salvaScheduler applica l'azione richiesta dal form e restituisce il codice del messaggio
+func salvaScheduler(r *http.Request) (string, error) {
+	// Pianificazioni globali e limiti valgono per tutte le navi: chi e associato a una
+	// compagnia gestisce solo gli override delle sue navi
+	session := middleware.GetSession(r)
+	naveID, _ := strconv.ParseInt(r.FormValue("nave_id"), 10, 64)
+	if session.CompagniaID != 0 {
+		if naveID == 0 || r.FormValue("azione") == "config" {
+			return "", fmt.Errorf("le pianificazioni globali sono riservate agli utenti non associati a una compagnia")
+		}
+		var compagniaID int64
+		database.DB.QueryRow("SELECT compagnia_id FROM navi WHERE id = ?", naveID).Scan(&compagniaID)
+		if !session.VedeCompagnia(compagniaID) {
+			return "", fmt.Errorf("nave non trovata")
+		}
+	}
+
+	if r.FormValue("azione") == "config" {
+		return salvaConfigMonitoraggio(r)
+	}
+
+	tipo := r.FormValue("tipo")
+	var job *jobSchedulabile
+	for i := range jobSchedulabili {
+		if jobSchedulabili[i].tipo == tipo {
+			job = &jobSchedulabili[i]
+		}
+	}
+	if job == nil {
+		return "", fmt.Errorf("tipo di job non valido")
+	}
+
+	cronStr := strings.TrimSpace(r.FormValue("cron"))
+	abilitato := r.FormValue("abilitato") == "1"
+
+	switch r.FormValue("azione") {
+	case "salva":
+		if _, err := cron.Parse(cronStr); err != nil {
+			return "", err
+		}
+		if naveID > 0 {
+			if job.perNave == nil {
+				return "", fmt.Errorf("il job %s non ammette override per nave", job.descrizione)
+			}
+			err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+				if err := t.Righe("scheduler_job_nave", "tipo = ? AND nave_id = ?", tipo, naveID); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`
+					INSERT INTO scheduler_job_nave (tipo, nave_id, cron, abilitato) VALUES (?, ?, ?, ?)
+					ON CONFLICT(tipo, nave_id) DO UPDATE SET cron = excluded.cron, abilitato = excluded.abilitato, updated_at = CURRENT_TIMESTAMP
+				`, tipo, naveID, cronStr, abilitato)
+				return err
+			})
+			if err != nil {
+				return "", fmt.Errorf("errore salvataggio override: %v", err)
+			}
+		} else {
+			err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+				if err := t.Righe("scheduler_job", "tipo = ?", tipo); err != nil {
+					return err
+				}
+				_, err := tx.Exec("UPDATE scheduler_job SET cron = ?, abilitato = ?, updated_at = CURRENT_TIMESTAMP WHERE tipo = ?",
+					cronStr, abilitato, tipo)
+				return err
+			})
+			if err != nil {
+				return "", fmt.Errorf("errore salvataggio pianificazione: %v", err)
+			}
+		}
+		return "salvato", nil
+
+	case "elimina":
+		err := conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+			if err := t.Righe("scheduler_job_nave", "tipo = ? AND nave_id = ?", tipo, naveID); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM scheduler_job_nave WHERE tipo = ? AND nave_id = ?", tipo, naveID)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("errore eliminazione override: %v", err)
+		}
+		return "eliminato", nil
+
+	case "esegui":
+		p, err := caricaPianificazione(tipo)
+		if err != nil {
+			return "", err
+		}
+		if naveID > 0 {
+			p = nil
+			for _, o := range caricaOverrideNave(tipo, session.CompagniaID) {
+				if o.NaveID == naveID {
+					p = &o
+				}
+			}
+			if p == nil {
+				return "", fmt.Errorf("override non trovato")
+			}
+		}
+		if !avviaPianificazione(*job, p) {
+			return "", fmt.Errorf("il job %s e gia in esecuzione", job.descrizione)
+		}
+		return "avviato", nil
+	}
+	return "", fmt.Errorf("azione non valida")
+}
+
+// salvaConfigMonitoraggio salva i limiti di concorrenza e il timeout per apparato
+func salvaConfigMonitoraggio(r *http.Request) (string, error) {
+	globale, _ := strconv.Atoi(r.FormValue("concorrenza_globale"))
+	nave, _ := strconv.Atoi(r.FormValue("concorrenza_nave"))
+	timeout, _ := strconv.Atoi(r.FormValue("timeout_apparato"))
+	giorniStorico, _ := strconv.Atoi(r.FormValue("giorni_storico"))
+	if globale < 1 || nave < 1 || nave > globale {
+		return "", fmt.Errorf("limiti di concorrenza non validi: servono valori positivi e il limite per nave non puo superare quello globale")
+	}
+	if timeout < 30 {
+		return "", fmt.Errorf("il timeout per apparato deve essere di almeno 30 secondi")
+	}
+	if giorniStorico < 1 {
+		return "", fmt.Errorf("lo storico delle esecuzioni va conservato per almeno un giorno")
+	}
+
+	err := modificaConAudit(r, "monitoring_config", 1, `
+		UPDATE monitoring_config SET concorrenza_globale = ?, concorrenza_nave = ?, timeout_apparato = ?, giorni_storico = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = 1
+	`, globale, nave, timeout, giorniStorico)
+	if err != nil {
+		return "", fmt.Errorf("errore salvataggio limiti: %v", err)
+	}
+	return "config", nil
+}
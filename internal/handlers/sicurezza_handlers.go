@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+
+	"furviogest/internal/auth"
+	"furviogest/internal/middleware"
+)
+
+// eventiSicurezzaMostrati e il numero di eventi del registro mostrati nella pagina
+const eventiSicurezzaMostrati = 200
+
+// Sicurezza mostra account e indirizzi bloccati per troppi tentativi falliti e il
+// registro degli accessi. In POST sblocca un utente o un indirizzo.
+func Sicurezza(w http.ResponseWriter, r *http.Request) {
+	session := middleware.GetSession(r)
+	data := NewPageData("Sicurezza accessi - FurvioGest", r)
+
+	if r.Method == http.MethodPost {
+		tipo := r.FormValue("tipo")
+		if tipo != auth.BloccoUtente && tipo != auth.BloccoIP {
+			http.Redirect(w, r, "/sicurezza", http.StatusSeeOther)
+			return
+		}
+		if err := auth.SbloccaAccesso(tipo, r.FormValue("valore"), session.Username, middleware.IndirizzoRichiesta(r), r.UserAgent()); err != nil {
+			http.Redirect(w, r, "/sicurezza?error=sblocco", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/sicurezza?success=sbloccato", http.StatusSeeOther)
+		return
+	}
+
+	switch {
+	case r.URL.Query().Get("success") == "sbloccato":
+		data.Success = "Sblocco eseguito"
+	case r.URL.Query().Get("error") == "sblocco":
+		data.Error = "Errore durante lo sblocco"
+	}
+
+	blocchi, err := auth.BlocchiAccesso()
+	if err != nil {
+		data.Error = "Errore nel recupero dei blocchi"
+	}
+	filtro := r.URL.Query().Get("username")
+	eventi, err := auth.EventiSicurezza(filtro, eventiSicurezzaMostrati)
+	if err != nil {
+		data.Error = "Errore nel recupero del registro di sicurezza"
+	}
+
+	data.Data = map[string]interface{}{
+		"Blocchi": blocchi,
+		"Eventi":  eventi,
+		"Filtro":  filtro,
+	}
+	renderTemplate(w, "sicurezza.html", data)
+}
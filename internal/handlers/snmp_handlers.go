@@ -0,0 +1,704 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/auth"
+	"furviogest/internal/database"
+	"furviogest/internal/middleware"
+	"furviogest/internal/segreti"
+	"furviogest/internal/snmp"
+)
+
+// ============================================
+// POLLING SNMP
+// ============================================
+
+const (
+	conservazioneSNMP = 30 * 24 * time.Hour // oltre, i campioni vengono eliminati
+	sogliaCambiStato  = 3                   // cambi di stato nel periodo oltre cui la porta e instabile
+	sogliaSaturazione = 80.0                // utilizzo percentuale oltre cui il link e saturo
+)
+
+// configSNMPNave contiene i parametri SNMP comuni agli apparati della nave
+type configSNMPNave struct {
+	Versione     string
+	Porta        int
+	Community    string
+	Utente       string
+	Auth         string
+	AuthPassword string
+	Priv         string
+	PrivPassword string
+}
+
+// configurata indica se la nave ha i parametri minimi per il polling
+func (c configSNMPNave) configurata() bool {
+	if c.Versione == "v3" {
+		return c.Utente != ""
+	}
+	return c.Community != ""
+}
+
+// perApparato compone i parametri di accesso dell'apparato, con le password v3 decifrate:
+// una community propria dell'apparato prevale sulla configurazione della nave (in v2c)
+func (c configSNMPNave) perApparato(a apparatoSNMP) snmp.Config {
+	cfg := snmp.Config{
+		Indirizzo:    a.IP,
+		Porta:        c.Porta,
+		Versione:     c.Versione,
+		Community:    c.Community,
+		Utente:       c.Utente,
+		Auth:         c.Auth,
+		AuthPassword: segreti.Leggi(c.AuthPassword),
+		Priv:         c.Priv,
+		PrivPassword: segreti.Leggi(c.PrivPassword),
+	}
+	if a.Community != "" {
+		cfg.Versione = "v2c"
+		cfg.Community = a.Community
+	}
+	return cfg
+}
+
+// getConfigSNMPNave legge i parametri SNMP della nave
+func getConfigSNMPNave(naveID int64) configSNMPNave {
+	c := configSNMPNave{Versione: "v2c", Porta: 161}
+	database.DB.QueryRow(`
+		SELECT COALESCE(snmp_versione, 'v2c'), COALESCE(snmp_porta, 161), COALESCE(snmp_community, ''), COALESCE(snmp_utente, ''),
+			COALESCE(snmp_auth_protocollo, ''), COALESCE(snmp_auth_password, ''), COALESCE(snmp_priv_protocollo, ''), COALESCE(snmp_priv_password, '')
+		FROM navi WHERE id = ?
+	`, naveID).Scan(&c.Versione, &c.Porta, &c.Community, &c.Utente, &c.Auth, &c.AuthPassword, &c.Priv, &c.PrivPassword)
+	return c
+}
+
+// apparatoSNMP e un apparato della nave interrogabile via SNMP
+type apparatoSNMP struct {
+	TipoApparato string
+	ID           int64
+	Nome         string
+	IP           string
+	Marca        string
+	Community    string
+}
+
+// getApparatiSNMPNave restituisce AC e switch della nave
+func getApparatiSNMPNave(naveID int64) []apparatoSNMP {
+	rows, err := database.DB.Query(`
+		SELECT 'ac', id, 'AC', ip, 'huawei', COALESCE(snmp_community, '') FROM access_controller WHERE nave_id = ?
+		UNION ALL
+		SELECT 'switch', id, nome, ip, marca, COALESCE(snmp_community, '') FROM switch_nave WHERE nave_id = ?
+		ORDER BY 1, 3
+	`, naveID, naveID)
+	if err != nil {
+		log.Printf("[SNMP] Errore lettura apparati nave %d: %v", naveID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var apparati []apparatoSNMP
+	for rows.Next() {
+		var a apparatoSNMP
+		if err := rows.Scan(&a.TipoApparato, &a.ID, &a.Nome, &a.IP, &a.Marca, &a.Community); err != nil {
+			continue
+		}
+		apparati = append(apparati, a)
+	}
+	return apparati
+}
+
+// attivitaPollingSNMP prepara il polling SNMP degli apparati della nave.
+// Gli apparati senza parametri SNMP (ne della nave ne propri) vengono saltati.
+func attivitaPollingSNMP(nave naveMonitorata) []attivitaApparato {
+	cfg := getConfigSNMPNave(nave.ID)
+	var attivita []attivitaApparato
+	for _, a := range getApparatiSNMPNave(nave.ID) {
+		if !cfg.configurata() && a.Community == "" {
+			continue
+		}
+		attivita = append(attivita, attivitaApparato{
+			Sito: nave.Nome, NaveID: nave.ID, TipoApparato: a.TipoApparato, ApparatoID: a.ID, Nome: a.Nome, IP: a.IP,
+			esegui: func(ctx context.Context) error {
+				return pollingSNMP(ctx, nave.ID, a, cfg.perApparato(a))
+			},
+		})
+	}
+	return attivita
+}
+
+// pollingSNMP interroga l'apparato e registra l'esito nello stato SNMP
+func pollingSNMP(ctx context.Context, naveID int64, a apparatoSNMP, cfg snmp.Config) error {
+	ora := time.Now().UTC()
+	err := leggiCampioniSNMP(ctx, naveID, a, cfg, ora)
+
+	var messaggio string
+	if err != nil {
+		messaggio = err.Error()
+	}
+	database.DB.Exec(`
+		INSERT INTO snmp_stato_apparato (tipo_apparato, apparato_id, nave_id, ultimo_poll, ultimo_errore)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(tipo_apparato, apparato_id) DO UPDATE SET
+			nave_id = excluded.nave_id, ultimo_poll = excluded.ultimo_poll, ultimo_errore = excluded.ultimo_errore
+	`, a.TipoApparato, a.ID, naveID, ora.Format("2006-01-02 15:04:05"), messaggio)
+	return err
+}
+
+// leggiCampioniSNMP legge sistema, interfacce e risorse dell'apparato e salva i campioni
+func leggiCampioniSNMP(ctx context.Context, naveID int64, a apparatoSNMP, cfg snmp.Config, ora time.Time) error {
+	c, err := snmp.Connetti(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Chiudi()
+
+	sistema, err := c.Sistema(ctx)
+	if err != nil {
+		return err
+	}
+	interfacce, err := c.Interfacce(ctx)
+	if err != nil {
+		return fmt.Errorf("lettura interfacce: %w", err)
+	}
+	risorse, err := c.Risorse(ctx, a.Marca)
+	if err != nil {
+		return fmt.Errorf("lettura CPU/memoria: %w", err)
+	}
+	return salvaCampioniSNMP(naveID, a, sistema, interfacce, risorse, ora)
+}
+
+// campioneInterfacciaPrecedente contiene i contatori dell'ultimo campione di un'interfaccia
+type campioneInterfacciaPrecedente struct {
+	Stato      int
+	InOttetti  uint64
+	OutOttetti uint64
+	InErrori   uint64
+	OutErrori  uint64
+}
+
+// salvaCampioniSNMP salva i campioni calcolando traffico, utilizzo, nuovi errori e cambi di stato
+// rispetto al campione precedente, ed elimina i campioni oltre il periodo di conservazione
+func salvaCampioniSNMP(naveID int64, a apparatoSNMP, sistema snmp.Sistema, interfacce []snmp.Interfaccia, risorse snmp.Risorse, ora time.Time) error {
+	istante := ora.Format("2006-01-02 15:04:05")
+	uptime := int64(sistema.Uptime / time.Second)
+
+	var uptimePrecedente sql.NullInt64
+	var campionePrecedente sql.NullTime
+	database.DB.QueryRow("SELECT uptime_secondi, ultimo_campione FROM snmp_stato_apparato WHERE tipo_apparato = ? AND apparato_id = ?",
+		a.TipoApparato, a.ID).Scan(&uptimePrecedente, &campionePrecedente)
+
+	// Dopo un riavvio i contatori ripartono da zero: il traffico non e calcolabile
+	riavvio := uptimePrecedente.Valid && uptime < uptimePrecedente.Int64
+	precedenti := make(map[int]campioneInterfacciaPrecedente)
+	var secondi float64
+	if campionePrecedente.Valid {
+		precedenti = getCampioniInterfacciaPrecedenti(a, campionePrecedente.Time)
+		secondi = ora.Sub(campionePrecedente.Time).Seconds()
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO snmp_campioni_apparato (nave_id, tipo_apparato, apparato_id, rilevato_at, uptime_secondi, cpu_percento, memoria_percento, riavvio)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, naveID, a.TipoApparato, a.ID, istante, uptime, nullPercento(risorse.CPU), nullPercento(risorse.Memoria), riavvio)
+	if err != nil {
+		return fmt.Errorf("salvataggio campione: %w", err)
+	}
+
+	for _, i := range interfacce {
+		var inBps, outBps, utilizzo, nuoviErrori interface{}
+		cambioStato := false
+		if p, ok := precedenti[i.Indice]; ok {
+			cambioStato = p.Stato != i.StatoOperativo
+			if !riavvio && secondi > 0 {
+				dIn, okIn := deltaContatore(i.InOttetti, p.InOttetti, i.Contatori64)
+				dOut, okOut := deltaContatore(i.OutOttetti, p.OutOttetti, i.Contatori64)
+				if okIn && okOut {
+					in := int64(float64(dIn) * 8 / secondi)
+					out := int64(float64(dOut) * 8 / secondi)
+					inBps, outBps = in, out
+					if i.VelocitaBps > 0 {
+						utilizzo = math.Round(float64(max(in, out))*1000/float64(i.VelocitaBps)) / 10
+					}
+				}
+				dErrIn, okErrIn := deltaContatore(i.InErrori, p.InErrori, false)
+				dErrOut, okErrOut := deltaContatore(i.OutErrori, p.OutErrori, false)
+				if okErrIn && okErrOut {
+					nuoviErrori = int64(dErrIn + dErrOut)
+				}
+			}
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO snmp_campioni_interfaccia (nave_id, tipo_apparato, apparato_id, if_index, nome, rilevato_at, stato_operativo, velocita_bps,
+				in_ottetti, out_ottetti, in_errori, out_errori, in_bps, out_bps, utilizzo_percento, nuovi_errori, cambio_stato)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, naveID, a.TipoApparato, a.ID, i.Indice, i.Nome, istante, i.StatoOperativo, int64(i.VelocitaBps),
+			int64(i.InOttetti), int64(i.OutOttetti), int64(i.InErrori), int64(i.OutErrori), inBps, outBps, utilizzo, nuoviErrori, cambioStato)
+		if err != nil {
+			return fmt.Errorf("salvataggio interfaccia %s: %w", i.Nome, err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO snmp_stato_apparato (tipo_apparato, apparato_id, nave_id, sys_name, sys_descr, uptime_secondi, ultimo_campione)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(tipo_apparato, apparato_id) DO UPDATE SET
+			nave_id = excluded.nave_id, sys_name = excluded.sys_name, sys_descr = excluded.sys_descr,
+			uptime_secondi = excluded.uptime_secondi, ultimo_campione = excluded.ultimo_campione
+	`, a.TipoApparato, a.ID, naveID, sistema.Nome, sistema.Descrizione, uptime, istante)
+	if err != nil {
+		return fmt.Errorf("aggiornamento stato SNMP: %w", err)
+	}
+
+	limite := ora.Add(-conservazioneSNMP).Format("2006-01-02 15:04:05")
+	tx.Exec("DELETE FROM snmp_campioni_apparato WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at < ?", a.TipoApparato, a.ID, limite)
+	tx.Exec("DELETE FROM snmp_campioni_interfaccia WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at < ?", a.TipoApparato, a.ID, limite)
+
+	return tx.Commit()
+}
+
+// getCampioniInterfacciaPrecedenti legge i contatori delle interfacce nel campione indicato
+func getCampioniInterfacciaPrecedenti(a apparatoSNMP, istante time.Time) map[int]campioneInterfacciaPrecedente {
+	precedenti := make(map[int]campioneInterfacciaPrecedente)
+	rows, err := database.DB.Query(`
+		SELECT if_index, stato_operativo, COALESCE(in_ottetti, 0), COALESCE(out_ottetti, 0), COALESCE(in_errori, 0), COALESCE(out_errori, 0)
+		FROM snmp_campioni_interfaccia
+		WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at = ?
+	`, a.TipoApparato, a.ID, istante.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return precedenti
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var indice int
+		var p campioneInterfacciaPrecedente
+		var in, out, errIn, errOut int64
+		if err := rows.Scan(&indice, &p.Stato, &in, &out, &errIn, &errOut); err != nil {
+			continue
+		}
+		p.InOttetti, p.OutOttetti, p.InErrori, p.OutErrori = uint64(in), uint64(out), uint64(errIn), uint64(errOut)
+		precedenti[indice] = p
+	}
+	return precedenti
+}
+
+// deltaContatore calcola l'incremento di un contatore, gestendo il giro dei contatori a 32 bit.
+// Un contatore a 64 bit che diminuisce e stato azzerato: l'incremento non e calcolabile.
+func deltaContatore(attuale, precedente uint64, bit64 bool) (uint64, bool) {
+	if attuale >= precedente {
+		return attuale - precedente, true
+	}
+	if !bit64 && precedente <= math.MaxUint32 {
+		return attuale + (math.MaxUint32 + 1) - precedente, true
+	}
+	return 0, false
+}
+
+// nullPercento converte una percentuale non disponibile (-1) in NULL
+func nullPercento(p int) interface{} {
+	if p < 0 {
+		return nil
+	}
+	return p
+}
+
+// ============================================
+// PAGINA SNMP NAVE
+// ============================================
+
+// statoSNMPApparato riassume le letture SNMP di un apparato nel periodo
+type statoSNMPApparato struct {
+	TipoApparato   string
+	ID             int64
+	Nome           string
+	IP             string
+	Community      string
+	SysName        string
+	SysDescr       string
+	Uptime         string
+	CPU            int
+	Memoria        int
+	UltimoPoll     string
+	UltimoCampione string
+	Errore         string
+	Riavvii        int
+	Interfacce     []statoSNMPInterfaccia
+	Nascoste       int
+}
+
+// statoSNMPInterfaccia riassume le letture di un'interfaccia nel periodo
+type statoSNMPInterfaccia struct {
+	Indice        int
+	Nome          string
+	Stato         int
+	Velocita      string
+	In            string
+	Out           string
+	Utilizzo      float64 // -1 se non calcolabile
+	UtilizzoPicco float64
+	CambiStato    int
+	Errori        int64
+	Instabile     bool
+	Satura        bool
+}
+
+// rigaStoricoInterfaccia e un campione dello storico di un'interfaccia
+type rigaStoricoInterfaccia struct {
+	Data        string
+	Stato       int
+	In          string
+	Out         string
+	Utilizzo    float64
+	Errori      int64
+	CambioStato bool
+}
+
+// SNMPNave mostra le letture SNMP degli apparati di una nave e ne gestisce la configurazione
+func SNMPNave(w http.ResponseWriter, r *http.Request) {
+	naveID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/navi/snmp/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+	nave := getNaveInfoByID(naveID)
+	if nave.ID == 0 {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+
+	data := NewPageData("SNMP "+nave.Nome+" - FurvioGest", r)
+
+	if r.Method == http.MethodPost {
+		session := middleware.GetSession(r)
+		if session == nil || !session.Puo(auth.AutReteScrivi) {
+			http.Error(w, "Non autorizzato", http.StatusForbidden)
+			return
+		}
+		switch r.FormValue("azione") {
+		case "config":
+			if err := salvaConfigSNMPNave(r, naveID); err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Success = "Configurazione SNMP salvata"
+			}
+		case "poll":
+			if nave.FermaPerLavori {
+				data.Error = "Nave ferma per lavori - monitoraggio disabilitato"
+				break
+			}
+			attivita := attivitaPollingSNMP(naveMonitorata{ID: nave.ID, Nome: nave.Nome})
+			if len(attivita) == 0 {
+				data.Error = "Nessun apparato con parametri SNMP configurati"
+				break
+			}
+			// Il polling manuale non si sovrappone a quello pianificato della stessa nave
+			chiave := fmt.Sprintf("snmp_poll:%d", nave.ID)
+			if jobInEsecuzione("snmp_poll") || !segnaInCorso(chiave) {
+				data.Error = "Polling SNMP gia in esecuzione, riprovare tra poco"
+				break
+			}
+			esito, messaggio := eseguiAttivita("snmp_poll", attivita).esito()
+			liberaInCorso(chiave)
+			if esito == "ok" {
+				data.Success = messaggio
+			} else {
+				data.Error = messaggio
+			}
+		}
+	}
+
+	ore, _ := strconv.Atoi(r.FormValue("ore"))
+	if ore != 1 && ore != 6 && ore != 168 {
+		ore = 24
+	}
+	dal := time.Now().UTC().Add(-time.Duration(ore) * time.Hour)
+	tutte := r.FormValue("tutte") == "1"
+
+	apparati := getStatoSNMPNave(naveID, dal, tutte)
+	var instabili, sature []string
+	for _, a := range apparati {
+		for _, i := range a.Interfacce {
+			if i.Instabile {
+				instabili = append(instabili, fmt.Sprintf("%s %s (%d cambi di stato)", a.Nome, i.Nome, i.CambiStato))
+			}
+			if i.Satura {
+				sature = append(sature, fmt.Sprintf("%s %s (picco %.1f%%)", a.Nome, i.Nome, i.UtilizzoPicco))
+			}
+		}
+	}
+
+	cfg := getConfigSNMPNave(naveID)
+	pagina := map[string]interface{}{
+		"Nave":              nave,
+		"Config":            cfg,
+		"AuthImpostata":     cfg.AuthPassword != "",
+		"PrivImpostata":     cfg.PrivPassword != "",
+		"Apparati":          apparati,
+		"Instabili":         instabili,
+		"Sature":            sature,
+		"Ore":               ore,
+		"Tutte":             tutte,
+		"SogliaCambiStato":  sogliaCambiStato,
+		"SogliaSaturazione": sogliaSaturazione,
+	}
+
+	// Storico di una singola interfaccia
+	if tipo, id, indice := r.FormValue("apparato"), r.FormValue("id"), r.FormValue("if"); tipo != "" && id != "" && indice != "" {
+		apparatoID, _ := strconv.ParseInt(id, 10, 64)
+		ifIndex, _ := strconv.Atoi(indice)
+		for _, a := range apparati {
+			if a.TipoApparato == tipo && a.ID == apparatoID {
+				nome, storico := getStoricoInterfacciaSNMP(tipo, apparatoID, ifIndex, dal)
+				pagina["StoricoApparato"] = a.Nome
+				pagina["StoricoInterfaccia"] = nome
+				pagina["Storico"] = storico
+			}
+		}
+	}
+
+	data.Data = pagina
+	renderTemplate(w, "snmp_nave.html", data)
+}
+
+// salvaConfigSNMPNave salva i parametri SNMP della nave e le community dei singoli apparati.
+// Le password lasciate vuote non vengono modificate.
+func salvaConfigSNMPNave(r *http.Request, naveID int64) error {
+	attuale := getConfigSNMPNave(naveID)
+	c := configSNMPNave{
+		Versione:     r.FormValue("versione"),
+		Community:    strings.TrimSpace(r.FormValue("community")),
+		Utente:       strings.TrimSpace(r.FormValue("utente")),
+		Auth:         r.FormValue("auth"),
+		AuthPassword: r.FormValue("auth_password"),
+		Priv:         r.FormValue("priv"),
+		PrivPassword: r.FormValue("priv_password"),
+	}
+	c.Porta, _ = strconv.Atoi(r.FormValue("porta"))
+	if c.Porta <= 0 || c.Porta > 65535 {
+		c.Porta = 161
+	}
+	if c.AuthPassword == "" {
+		c.AuthPassword = attuale.AuthPassword
+	}
+	if c.PrivPassword == "" {
+		c.PrivPassword = attuale.PrivPassword
+	}
+	if c.Auth == "" {
+		c.AuthPassword = ""
+	}
+	if c.Priv == "" {
+		c.PrivPassword = ""
+	}
+
+	// Con i campi vuoti il polling della nave e disattivato; altrimenti i parametri devono essere coerenti
+	if c.configurata() {
+		verifica := c.perApparato(apparatoSNMP{})
+		if err := verifica.Valida(); err != nil {
+			return err
+		}
+	}
+
+	// Le password v3 vengono salvate cifrate (quelle mantenute lo sono gia)
+	var err error
+	if c.AuthPassword, err = segreti.Cifra(c.AuthPassword); err != nil {
+		return fmt.Errorf("errore cifratura credenziali SNMP: %v", err)
+	}
+	if c.PrivPassword, err = segreti.Cifra(c.PrivPassword); err != nil {
+		return fmt.Errorf("errore cifratura credenziali SNMP: %v", err)
+	}
+
+	_, err = database.DB.Exec(`
+		UPDATE navi SET snmp_versione = ?, snmp_porta = ?, snmp_community = ?, snmp_utente = ?,
+			snmp_auth_protocollo = ?, snmp_auth_password = ?, snmp_priv_protocollo = ?, snmp_priv_password = ?
+		WHERE id = ?
+	`, c.Versione, c.Porta, c.Community, c.Utente, c.Auth, c.AuthPassword, c.Priv, c.PrivPassword, naveID)
+	if err != nil {
+		return fmt.Errorf("errore salvataggio configurazione SNMP: %v", err)
+	}
+
+	for _, a := range getApparatiSNMPNave(naveID) {
+		community := strings.TrimSpace(r.FormValue(fmt.Sprintf("community_%s_%d", a.TipoApparato, a.ID)))
+		tabella := "switch_nave"
+		if a.TipoApparato == "ac" {
+			tabella = "access_controller"
+		}
+		database.DB.Exec(fmt.Sprintf("UPDATE %s SET snmp_community = ? WHERE id = ?", tabella), community, a.ID)
+	}
+	return nil
+}
+
+// getStatoSNMPNave riassume per ogni apparato della nave l'ultima lettura e il periodo indicato.
+// Senza tutte vengono mostrate solo le interfacce attive o con eventi nel periodo.
+func getStatoSNMPNave(naveID int64, dal time.Time, tutte bool) []statoSNMPApparato {
+	var apparati []statoSNMPApparato
+	for _, a := range getApparatiSNMPNave(naveID) {
+		s := statoSNMPApparato{TipoApparato: a.TipoApparato, ID: a.ID, Nome: a.Nome, IP: a.IP, Community: a.Community, CPU: -1, Memoria: -1}
+
+		var sysName, sysDescr, errore sql.NullString
+		var uptime sql.NullInt64
+		var ultimoPoll, ultimoCampione sql.NullTime
+		err := database.DB.QueryRow(`
+			SELECT sys_name, sys_descr, uptime_secondi, ultimo_poll, ultimo_campione, ultimo_errore
+			FROM snmp_stato_apparato WHERE tipo_apparato = ? AND apparato_id = ?
+		`, a.TipoApparato, a.ID).Scan(&sysName, &sysDescr, &uptime, &ultimoPoll, &ultimoCampione, &errore)
+		if err != nil {
+			apparati = append(apparati, s)
+			continue
+		}
+		s.SysName, s.SysDescr, s.Errore = sysName.String, sysDescr.String, errore.String
+		if uptime.Valid {
+			s.Uptime = formatDurata(uptime.Int64)
+		}
+		if ultimoPoll.Valid {
+			s.UltimoPoll = ultimoPoll.Time.Local().Format("02/01/2006 15:04")
+		}
+		if ultimoCampione.Valid {
+			s.UltimoCampione = ultimoCampione.Time.Local().Format("02/01/2006 15:04")
+			istante := ultimoCampione.Time.UTC().Format("2006-01-02 15:04:05")
+
+			var cpu, memoria sql.NullInt64
+			database.DB.QueryRow(`
+				SELECT cpu_percento, memoria_percento FROM snmp_campioni_apparato
+				WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at = ?
+			`, a.TipoApparato, a.ID, istante).Scan(&cpu, &memoria)
+			if cpu.Valid {
+				s.CPU = int(cpu.Int64)
+			}
+			if memoria.Valid {
+				s.Memoria = int(memoria.Int64)
+			}
+			database.DB.QueryRow(`
+				SELECT COUNT(*) FROM snmp_campioni_apparato
+				WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at >= ? AND riavvio = 1
+			`, a.TipoApparato, a.ID, dal.Format("2006-01-02 15:04:05")).Scan(&s.Riavvii)
+
+			s.Interfacce, s.Nascoste = getStatoInterfacceSNMP(a, istante, dal, tutte)
+		}
+		apparati = append(apparati, s)
+	}
+	return apparati
+}
+
+// getStatoInterfacceSNMP unisce l'ultimo campione di ogni interfaccia con i totali del periodo
+func getStatoInterfacceSNMP(a apparatoSNMP, ultimo string, dal time.Time, tutte bool) ([]statoSNMPInterfaccia, int) {
+	rows, err := database.DB.Query(`
+		SELECT u.if_index, COALESCE(u.nome, ''), u.stato_operativo, COALESCE(u.velocita_bps, 0),
+			COALESCE(u.in_bps, -1), COALESCE(u.out_bps, -1), COALESCE(u.utilizzo_percento, -1),
+			COALESCE(p.cambi, 0), COALESCE(p.errori, 0), COALESCE(p.picco, -1)
+		FROM snmp_campioni_interfaccia u
+		LEFT JOIN (
+			SELECT if_index, SUM(cambio_stato) AS cambi, SUM(COALESCE(nuovi_errori, 0)) AS errori, MAX(utilizzo_percento) AS picco
+			FROM snmp_campioni_interfaccia
+			WHERE tipo_apparato = ? AND apparato_id = ? AND rilevato_at >= ?
+			GROUP BY if_index
+		) p ON p.if_index = u.if_index
+		WHERE u.tipo_apparato = ? AND u.apparato_id = ? AND u.rilevato_at = ?
+		ORDER BY u.if_index
+	`, a.TipoApparato, a.ID, dal.Format("2006-01-02 15:04:05"), a.TipoApparato, a.ID, ultimo)
+	if err != nil {
+		log.Printf("[SNMP] Errore lettura interfacce %s %d: %v", a.TipoApparato, a.ID, err)
+		return nil, 0
+	}
+	defer rows.Close()
+
+	var interfacce []statoSNMPInterfaccia
+	nascoste := 0
+	for rows.Next() {
+		var i statoSNMPInterfaccia
+		var velocita, in, out int64
+		if err := rows.Scan(&i.Indice, &i.Nome, &i.Stato, &velocita, &in, &out, &i.Utilizzo, &i.CambiStato, &i.Errori, &i.UtilizzoPicco); err != nil {
+			continue
+		}
+		i.Velocita = formatBpsSNMP(velocita)
+		i.In = formatBpsSNMP(in)
+		i.Out = formatBpsSNMP(out)
+		i.Instabile = i.CambiStato >= sogliaCambiStato
+		i.Satura = i.UtilizzoPicco >= sogliaSaturazione
+
+		if !tutte && i.Stato != snmp.StatoUp && i.CambiStato == 0 && i.Errori == 0 {
+			nascoste++
+			continue
+		}
+		interfacce = append(interfacce, i)
+	}
+
+	// Prima le interfacce che richiedono attenzione
+	sort.SliceStable(interfacce, func(x, y int) bool {
+		return (interfacce[x].Instabile || interfacce[x].Satura) && !(interfacce[y].Instabile || interfacce[y].Satura)
+	})
+	return interfacce, nascoste
+}
+
+// getStoricoInterfacciaSNMP restituisce i campioni di un'interfaccia dal piu recente
+func getStoricoInterfacciaSNMP(tipo string, apparatoID int64, ifIndex int, dal time.Time) (string, []rigaStoricoInterfaccia) {
+	rows, err := database.DB.Query(`
+		SELECT COALESCE(nome, ''), rilevato_at, stato_operativo, COALESCE(in_bps, -1), COALESCE(out_bps, -1),
+			COALESCE(utilizzo_percento, -1), COALESCE(nuovi_errori, 0), cambio_stato
+		FROM snmp_campioni_interfaccia
+		WHERE tipo_apparato = ? AND apparato_id = ? AND if_index = ? AND rilevato_at >= ?
+		ORDER BY rilevato_at DESC
+	`, tipo, apparatoID, ifIndex, dal.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return "", nil
+	}
+	defer rows.Close()
+
+	var nome string
+	var storico []rigaStoricoInterfaccia
+	for rows.Next() {
+		var riga rigaStoricoInterfaccia
+		var rilevato time.Time
+		var in, out int64
+		if err := rows.Scan(&nome, &rilevato, &riga.Stato, &in, &out, &riga.Utilizzo, &riga.Errori, &riga.CambioStato); err != nil {
+			continue
+		}
+		riga.Data = rilevato.Local().Format("02/01/2006 15:04")
+		riga.In = formatBpsSNMP(in)
+		riga.Out = formatBpsSNMP(out)
+		storico = append(storico, riga)
+	}
+	return nome, storico
+}
+
+// formatBpsSNMP formatta una velocita in bit/s (trattino se non disponibile)
+func formatBpsSNMP(bps int64) string {
+	switch {
+	case bps < 0:
+		return "-"
+	case bps >= 1000000000:
+		return fmt.Sprintf("%.1f Gbit/s", float64(bps)/1e9)
+	case bps >= 1000000:
+		return fmt.Sprintf("%.1f Mbit/s", float64(bps)/1e6)
+	case bps >= 1000:
+		return fmt.Sprintf("%.1f kbit/s", float64(bps)/1e3)
+	default:
+		return fmt.Sprintf("%d bit/s", bps)
+	}
+}
+
+// formatDurata formatta una durata in giorni, ore e minuti
+func formatDurata(secondi int64) string {
+	giorni := secondi / 86400
+	ore := secondi % 86400 / 3600
+	minuti := secondi % 3600 / 60
+	if giorni > 0 {
+		return fmt.Sprintf("%dg %dh %dm", giorni, ore, minuti)
+	}
+	return fmt.Sprintf("%dh %dm", ore, minuti)
+}
@@ -3,10 +3,12 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"furviogest/internal/audit"
 	"furviogest/internal/auth"
 	"furviogest/internal/database"
 	"furviogest/internal/middleware"
 	"furviogest/internal/models"
+	"furviogest/internal/segreti"
 	"io"
 	"net/http"
 	"os"
@@ -16,13 +18,53 @@ import (
 	"time"
 )
 
+// TecnicoFormData contiene i dati per il form tecnico
+type TecnicoFormData struct {
+	Tecnico   *models.Utente
+	Ruoli     []auth.RuoloUtente
+	Compagnie []models.Compagnia
+}
+
+// nuovoTecnicoFormData prepara il form con gli elenchi di ruoli e compagnie
+func nuovoTecnicoFormData(t *models.Utente) TecnicoFormData {
+	ruoli, _ := auth.ElencoRuoli()
+	return TecnicoFormData{Tecnico: t, Ruoli: ruoli, Compagnie: getCompagnie()}
+}
+
+// ruoloECompagniaDaForm legge ruolo e compagnia scelti nel form. La compagnia vuota
+// diventa NULL: l'utente vede tutte le navi.
+func ruoloECompagniaDaForm(r *http.Request) (int64, interface{}) {
+	ruoloID, _ := strconv.ParseInt(r.FormValue("ruolo_id"), 10, 64)
+	if _, err := auth.LeggiRuolo(ruoloID); err != nil {
+		database.DB.QueryRow("SELECT id FROM ruoli WHERE codice = ?", models.RuoloGuest).Scan(&ruoloID)
+	}
+	var compagniaID interface{}
+	if id, err := strconv.ParseInt(r.FormValue("compagnia_id"), 10, 64); err == nil && id > 0 {
+		compagniaID = id
+	}
+	return ruoloID, compagniaID
+}
+
 // ListaTecnici mostra la lista dei tecnici
 func ListaTecnici(w http.ResponseWriter, r *http.Request) {
 	data := NewPageData("Tecnici - FurvioGest", r)
+	if r.URL.Query().Get("success") == "disconnesso" {
+		data.Success = "Utente disconnesso da tutti i dispositivi"
+	}
+	if r.URL.Query().Get("success") == "2fa" {
+		data.Success = "Autenticazione a due fattori reimpostata: l'utente potra configurarla di nuovo"
+	}
+	if r.URL.Query().Get("error") == "movimenti" {
+		data.Error = "L'utente ha registrato movimenti di magazzino e non puo essere eliminato: disattivarlo"
+	}
 
 	rows, err := database.DB.Query(`
-		SELECT id, username, nome, cognome, email, telefono, ruolo, attivo, documento_path, created_at
-		FROM utenti ORDER BY cognome, nome
+		SELECT u.id, u.username, u.nome, u.cognome, u.email, u.telefono, u.ruolo, u.attivo, u.documento_path, u.created_at,
+			COALESCE(u.totp_attivo, 0), COALESCE(r.nome, u.ruolo), COALESCE(c.nome, '')
+		FROM utenti u
+		LEFT JOIN ruoli r ON r.id = u.ruolo_id
+		LEFT JOIN compagnie c ON c.id = u.compagnia_id
+		ORDER BY u.cognome, u.nome
 	`)
 	if err != nil {
 		data.Error = "Errore nel recupero dei tecnici"
@@ -35,7 +77,7 @@ func ListaTecnici(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var t models.Utente
 		var docPath sql.NullString
-		err := rows.Scan(&t.ID, &t.Username, &t.Nome, &t.Cognome, &t.Email, &t.Telefono, &t.Ruolo, &t.Attivo, &docPath, &t.CreatedAt)
+		err := rows.Scan(&t.ID, &t.Username, &t.Nome, &t.Cognome, &t.Email, &t.Telefono, &t.Ruolo, &t.Attivo, &docPath, &t.CreatedAt, &t.TOTPAttivo, &t.RuoloNome, &t.CompagniaNome)
 		if err != nil {
 			continue
 		}
@@ -53,6 +95,8 @@ func ListaTecnici(w http.ResponseWriter, r *http.Request) {
 func NuovoTecnico(w http.ResponseWriter, r *http.Request) {
 	data := NewPageData("Nuovo Tecnico - FurvioGest", r)
 
+	data.Data = nuovoTecnicoFormData(nil)
+
 	if r.Method == http.MethodGet {
 		renderTemplate(w, "tecnici_form.html", data)
 		return
@@ -69,7 +113,7 @@ func NuovoTecnico(w http.ResponseWriter, r *http.Request) {
 	cognome := strings.TrimSpace(r.FormValue("cognome"))
 	email := strings.TrimSpace(r.FormValue("email"))
 	telefono := strings.TrimSpace(r.FormValue("telefono"))
-	ruolo := models.Ruolo(r.FormValue("ruolo"))
+	ruoloID, compagniaID := ruoloECompagniaDaForm(r)
 
 	// Validazione
 	if username == "" || password == "" || nome == "" || cognome == "" || email == "" {
@@ -78,10 +122,6 @@ func NuovoTecnico(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ruolo != models.RuoloTecnico && ruolo != models.RuoloGuest {
-		ruolo = models.RuoloGuest
-	}
-
 	// Hash password
 	hashedPassword, err := auth.HashPassword(password)
 	if err != nil {
@@ -115,10 +155,10 @@ func NuovoTecnico(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Inserisci nel database
-	_, err = database.DB.Exec(`
-		INSERT INTO utenti (username, password, nome, cognome, email, telefono, ruolo, attivo, documento_path)
-		VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)
-	`, username, hashedPassword, nome, cognome, email, telefono, ruolo, documentoPath)
+	_, err = creaConAudit(r, "utenti", `
+		INSERT INTO utenti (username, password, nome, cognome, email, telefono, ruolo, ruolo_id, compagnia_id, attivo, documento_path)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?)
+	`, username, hashedPassword, nome, cognome, email, telefono, auth.CodiceRuolo(ruoloID), ruoloID, compagniaID, documentoPath)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
@@ -156,10 +196,11 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 		var telefono sql.NullString
 		err := database.DB.QueryRow(`
 			SELECT id, username, nome, cognome, email, telefono, ruolo, attivo, documento_path,
-			COALESCE(smtp_server, ''), COALESCE(smtp_port, 587), COALESCE(smtp_user, ''), COALESCE(smtp_password, '')
+			COALESCE(smtp_server, ''), COALESCE(smtp_port, 587), COALESCE(smtp_user, ''), COALESCE(smtp_password, ''),
+			COALESCE(ruolo_id, 0), COALESCE(compagnia_id, 0)
 			FROM utenti WHERE id = ?
 		`, id).Scan(&t.ID, &t.Username, &t.Nome, &t.Cognome, &t.Email, &telefono, &t.Ruolo, &t.Attivo, &docPath,
-			&t.SMTPServer, &t.SMTPPort, &t.SMTPUser, &t.SMTPPassword)
+			&t.SMTPServer, &t.SMTPPort, &t.SMTPUser, &t.SMTPPassword, &t.RuoloID, &t.CompagniaID)
 
 		if err != nil {
 			http.Redirect(w, r, "/tecnici", http.StatusSeeOther)
@@ -172,7 +213,7 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 			t.Telefono = telefono.String
 		}
 
-		data.Data = t
+		data.Data = nuovoTecnicoFormData(&t)
 		renderTemplate(w, "tecnici_form.html", data)
 		return
 	}
@@ -186,7 +227,7 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 	cognome := strings.TrimSpace(r.FormValue("cognome"))
 	email := strings.TrimSpace(r.FormValue("email"))
 	telefono := strings.TrimSpace(r.FormValue("telefono"))
-	ruolo := models.Ruolo(r.FormValue("ruolo"))
+	ruoloID, compagniaID := ruoloECompagniaDaForm(r)
 	attivo := r.FormValue("attivo") == "on"
 	nuovaPassword := r.FormValue("nuova_password")
 
@@ -198,7 +239,19 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 		smtpPort = p
 	}
 	smtpUser := strings.TrimSpace(r.FormValue("smtp_user"))
-	smtpPassword := r.FormValue("smtp_password")
+	smtpPassword, err := segreti.Cifra(r.FormValue("smtp_password"))
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// In caso di errore il form si ripresenta con i dati inviati
+	t := &models.Utente{ID: id, Username: r.FormValue("username"), Nome: nome, Cognome: cognome, Email: email, Telefono: telefono,
+		RuoloID: ruoloID, Attivo: attivo, SMTPServer: smtpServer, SMTPPort: smtpPort, SMTPUser: smtpUser}
+	if c, ok := compagniaID.(int64); ok {
+		t.CompagniaID = c
+	}
+	data.Data = nuovoTecnicoFormData(t)
 
 	// Validazione
 	if nome == "" || cognome == "" || email == "" {
@@ -207,13 +260,20 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verifica che non si stia disattivando se stesso
+	// Verifica che non si stia disattivando se stesso o togliendo la gestione utenti
 	session := middleware.GetSession(r)
 	if session != nil && session.UserID == id && !attivo {
 		data.Error = "Non puoi disattivare il tuo stesso account"
 		renderTemplate(w, "tecnici_form.html", data)
 		return
 	}
+	if session != nil && session.UserID == id {
+		if ruolo, err := auth.LeggiRuolo(ruoloID); err != nil || !ruolo.Autorizzazioni[auth.AutUtentiGestisci] {
+			data.Error = "Non puoi assegnarti un ruolo senza la gestione utenti"
+			renderTemplate(w, "tecnici_form.html", data)
+			return
+		}
+	}
 
 	// Gestione upload nuovo documento
 	var updateDocumento bool
@@ -239,17 +299,32 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Aggiorna nel database
-	if updateDocumento {
-		_, err = database.DB.Exec(`
-			UPDATE utenti SET nome = ?, cognome = ?, email = ?, telefono = ?, ruolo = ?, attivo = ?, documento_path = ?, smtp_server = ?, smtp_port = ?, smtp_user = ?, smtp_password = ?, updated_at = CURRENT_TIMESTAMP
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica("utenti", id); err != nil {
+			return err
+		}
+		var err error
+		if updateDocumento {
+			_, err = tx.Exec(`
+			UPDATE utenti SET nome = ?, cognome = ?, email = ?, telefono = ?, ruolo = ?, ruolo_id = ?, compagnia_id = ?, attivo = ?, documento_path = ?, smtp_server = ?, smtp_port = ?, smtp_user = ?, smtp_password = CASE WHEN ? = '' THEN smtp_password ELSE ? END, updated_at = CURRENT_TIMESTAMP
 			WHERE id = ?
-		`, nome, cognome, email, telefono, ruolo, attivo, documentoPath, smtpServer, smtpPort, smtpUser, smtpPassword, id)
-	} else {
-		_, err = database.DB.Exec(`
-			UPDATE utenti SET nome = ?, cognome = ?, email = ?, telefono = ?, ruolo = ?, attivo = ?, smtp_server = ?, smtp_port = ?, smtp_user = ?, smtp_password = ?, updated_at = CURRENT_TIMESTAMP
+		`, nome, cognome, email, telefono, auth.CodiceRuolo(ruoloID), ruoloID, compagniaID, attivo, documentoPath, smtpServer, smtpPort, smtpUser, smtpPassword, smtpPassword, id)
+		} else {
+			_, err = tx.Exec(`
+			UPDATE utenti SET nome = ?, cognome = ?, email = ?, telefono = ?, ruolo = ?, ruolo_id = ?, compagnia_id = ?, attivo = ?, smtp_server = ?, smtp_port = ?, smtp_user = ?, smtp_password = CASE WHEN ? = '' THEN smtp_password ELSE ? END, updated_at = CURRENT_TIMESTAMP
 			WHERE id = ?
-		`, nome, cognome, email, telefono, ruolo, attivo, smtpServer, smtpPort, smtpUser, smtpPassword, id)
-	}
+		`, nome, cognome, email, telefono, auth.CodiceRuolo(ruoloID), ruoloID, compagniaID, attivo, smtpServer, smtpPort, smtpUser, smtpPassword, smtpPassword, id)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Aggiorna password se specificata
+		if nuovaPassword != "" {
+			return auth.UpdatePasswordIn(tx, id, nuovaPassword)
+		}
+		return nil
+	})
 
 	if err != nil {
 		data.Error = "Errore durante il salvataggio"
@@ -257,11 +332,6 @@ func ModificaTecnico(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Aggiorna password se specificata
-	if nuovaPassword != "" {
-		auth.UpdatePassword(id, nuovaPassword)
-	}
-
 	http.Redirect(w, r, "/tecnici?success=modificato", http.StatusSeeOther)
 }
 
@@ -286,6 +356,15 @@ func EliminaTecnico(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// I movimenti di magazzino sono legati all'utente con ON DELETE CASCADE: eliminandolo
+	// sparirebbero dal registro da cui deriva la giacenza
+	var movimenti int
+	database.DB.QueryRow("SELECT COUNT(*) FROM movimenti_magazzino WHERE tecnico_id = ?", id).Scan(&movimenti)
+	if movimenti > 0 {
+		http.Redirect(w, r, "/tecnici?error=movimenti", http.StatusSeeOther)
+		return
+	}
+
 	// Elimina documento se esiste
 	var docPath sql.NullString
 	database.DB.QueryRow("SELECT documento_path FROM utenti WHERE id = ?", id).Scan(&docPath)
@@ -293,7 +372,7 @@ func EliminaTecnico(w http.ResponseWriter, r *http.Request) {
 		os.Remove(filepath.Join("web", "static", docPath.String))
 	}
 
-	_, err = database.DB.Exec("DELETE FROM utenti WHERE id = ?", id)
+	err = eliminaConAudit(r, "utenti", id, "DELETE FROM utenti WHERE id = ?", id)
 	if err != nil {
 		http.Redirect(w, r, "/tecnici?error=delete_failed", http.StatusSeeOther)
 		return
@@ -301,3 +380,51 @@ func EliminaTecnico(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/tecnici?success=eliminato", http.StatusSeeOther)
 }
+
+// DisconnettiTecnico chiude tutte le sessioni di un utente, che dovra accedere di nuovo
+func DisconnettiTecnico(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/tecnici", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/tecnici/disconnetti/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/tecnici", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := auth.Sessions.RevocaUtente(id); err != nil {
+		http.Redirect(w, r, "/tecnici?error=disconnessione", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/tecnici?success=disconnesso", http.StatusSeeOther)
+}
+
+// ReimpostaDueFattoriTecnico disattiva il secondo fattore di un utente che ha perso
+// l'app di autenticazione e i codici di recupero, e chiude le sue sessioni
+func ReimpostaDueFattoriTecnico(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/tecnici", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/tecnici/reimposta-2fa/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/tecnici", http.StatusSeeOther)
+		return
+	}
+
+	err = conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Modifica("utenti", id); err != nil {
+			return err
+		}
+		return auth.DisattivaTOTPIn(tx, id)
+	})
+	if err != nil {
+		http.Redirect(w, r, "/tecnici?error=2fa", http.StatusSeeOther)
+		return
+	}
+	auth.Sessions.RevocaUtente(id)
+	http.Redirect(w, r, "/tecnici?success=2fa", http.StatusSeeOther)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"furviogest/internal/database"
+	"furviogest/internal/netdevice"
+)
+
+// ============================================
+// TOPOLOGIA DI RETE NAVE
+// ============================================
+
+// nodoTopologia e un apparato del grafo: switch, AP o vicino LLDP non censito
+type nodoTopologia struct {
+	ID      string `json:"id"`
+	Tipo    string `json:"tipo"` // switch, ap o altro
+	Nome    string `json:"nome"`
+	IP      string `json:"ip,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+	Modello string `json:"modello,omitempty"`
+	Stato   string `json:"stato,omitempty"` // solo AP: online, offline, fault, unknown
+}
+
+// collegamentoTopologia e un cavo tra due apparati con le porte ai due capi
+type collegamentoTopologia struct {
+	Da         string `json:"da"`
+	A          string `json:"a"`
+	PortaDa    string `json:"porta_da"`
+	PortaA     string `json:"porta_a,omitempty"`
+	Origine    string `json:"origine"` // lldp o mac (porta AP ricavata dalla tabella MAC)
+	Rilevato   string `json:"rilevato,omitempty"`
+	Bilaterale bool   `json:"bilaterale,omitempty"` // switch-switch visto da entrambi i lati
+}
+
+// grafoTopologia e la topologia di rete di una nave
+type grafoTopologia struct {
+	NaveID       int64                   `json:"nave_id"`
+	Nodi         []nodoTopologia         `json:"nodi"`
+	Collegamenti []collegamentoTopologia `json:"collegamenti"`
+	Aggiornato   string                  `json:"aggiornato,omitempty"` // ultimo rilevamento LLDP
+}
+
+// salvaVicinatoLLDP registra i vicini LLDP letti da uno switch: aggiorna quelli
+// gia noti e rimuove quelli non piu annunciati
+func salvaVicinatoLLDP(sw *SwitchNave, vicini []netdevice.VicinoLLDP) {
+	ora := time.Now().UTC().Format("2006-01-02 15:04:05")
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("[LLDP] Errore salvataggio vicini %s: %v", sw.Nome, err)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, v := range vicini {
+		_, err := tx.Exec(`
+			INSERT INTO lldp_vicini (nave_id, switch_id, porta_locale, vicino_nome, porta_vicino, primo_rilevamento, ultimo_rilevamento)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(switch_id, porta_locale, vicino_nome) DO UPDATE SET
+				nave_id = excluded.nave_id, porta_vicino = excluded.porta_vicino, ultimo_rilevamento = excluded.ultimo_rilevamento
+		`, sw.NaveID, sw.ID, v.PortaLocale, v.Nome, v.PortaVicino, ora, ora)
+		if err != nil {
+			log.Printf("[LLDP] Errore salvataggio vicini %s: %v", sw.Nome, err)
+			return
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM lldp_vicini WHERE switch_id = ? AND ultimo_rilevamento < ?", sw.ID, ora); err != nil {
+		log.Printf("[LLDP] Errore pulizia vicini %s: %v", sw.Nome, err)
+		return
+	}
+	tx.Commit()
+}
+
+// costruisciTopologia ricava il grafo della nave dai vicini LLDP. Gli AP senza
+// vicino LLDP vengono collegati alla porta associata dallo scan della tabella MAC.
+func costruisciTopologia(naveID int64) grafoTopologia {
+	g := grafoTopologia{NaveID: naveID, Nodi: []nodoTopologia{}, Collegamenti: []collegamentoTopologia{}}
+
+	// Indici per nome (case-insensitive) per riconoscere i vicini LLDP
+	switchPerNome := make(map[string]string)
+	apPerNome := make(map[string]string)
+	for _, sw := range getSwitchesByNave(naveID) {
+		id := fmt.Sprintf("switch-%d", sw.ID)
+		g.Nodi = append(g.Nodi, nodoTopologia{ID: id, Tipo: "switch", Nome: sw.Nome, IP: sw.IP, Modello: sw.Modello})
+		switchPerNome[strings.ToLower(strings.TrimSpace(sw.Nome))] = id
+	}
+	aps := getAccessPointsByNave(naveID)
+	sort.Slice(aps, func(i, j int) bool { return aps[i].APName < aps[j].APName })
+	for _, ap := range aps {
+		id := fmt.Sprintf("ap-%d", ap.ID)
+		g.Nodi = append(g.Nodi, nodoTopologia{ID: id, Tipo: "ap", Nome: ap.APName, IP: ap.APIP, MAC: ap.APMAC, Modello: ap.APModel, Stato: ap.Stato})
+		apPerNome[strings.ToLower(strings.TrimSpace(ap.APName))] = id
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT switch_id, porta_locale, vicino_nome, COALESCE(porta_vicino, ''), ultimo_rilevamento
+		FROM lldp_vicini WHERE nave_id = ?
+		ORDER BY switch_id, porta_locale
+	`, naveID)
+	if err != nil {
+		log.Printf("[Topologia] Errore lettura vicini nave %d: %v", naveID, err)
+		return g
+	}
+	defer rows.Close()
+
+	altri := make(map[string]bool)
+	collegati := make(map[string]bool)
+	// Un link tra switch compare due volte (una per lato): si indicizza per capi ordinati
+	tratte := make(map[string]int)
+	var ultimo time.Time
+	for rows.Next() {
+		var switchID int64
+		var porta, vicino, portaVicino string
+		var rilevato time.Time
+		if err := rows.Scan(&switchID, &porta, &vicino, &portaVicino, &rilevato); err != nil {
+			continue
+		}
+		if rilevato.After(ultimo) {
+			ultimo = rilevato
+		}
+		da := fmt.Sprintf("switch-%d", switchID)
+		chiave := strings.ToLower(strings.TrimSpace(vicino))
+		a, ok := apPerNome[chiave]
+		if !ok {
+			a, ok = switchPerNome[chiave]
+		}
+		if !ok {
+			a = "altro-" + chiave
+			if !altri[a] {
+				altri[a] = true
+				g.Nodi = append(g.Nodi, nodoTopologia{ID: a, Tipo: "altro", Nome: vicino})
+			}
+		}
+		if a == da {
+			continue
+		}
+
+		c := collegamentoTopologia{Da: da, A: a, PortaDa: porta, PortaA: portaVicino, Origine: "lldp",
+			Rilevato: rilevato.Local().Format("02/01/2006 15:04")}
+		if strings.HasPrefix(a, "switch-") {
+			capoDa, capoA := da+"|"+porta, a+"|"+portaVicino
+			if capoA < capoDa {
+				capoDa, capoA = capoA, capoDa
+			}
+			if i, visto := tratte[capoDa+"|"+capoA]; visto {
+				g.Collegamenti[i].Bilaterale = true
+				continue
+			}
+			tratte[capoDa+"|"+capoA] = len(g.Collegamenti)
+		}
+		collegati[a] = true
+		g.Collegamenti = append(g.Collegamenti, c)
+	}
+	if !ultimo.IsZero() {
+		g.Aggiornato = ultimo.Local().Format("02/01/2006 15:04")
+	}
+
+	for _, ap := range aps {
+		id := fmt.Sprintf("ap-%d", ap.ID)
+		if collegati[id] || ap.SwitchID == nil || ap.SwitchPort == "" {
+			continue
+		}
+		g.Collegamenti = append(g.Collegamenti, collegamentoTopologia{
+			Da: fmt.Sprintf("switch-%d", *ap.SwitchID), A: id, PortaDa: ap.SwitchPort, Origine: "mac",
+		})
+	}
+	return g
+}
+
+// APITopologiaNave restituisce il grafo della topologia di rete della nave in JSON
+func APITopologiaNave(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	naveID, _ := strconv.ParseInt(r.URL.Query().Get("nave_id"), 10, 64)
+	if getNaveInfoByID(naveID).ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Nave non trovata"})
+		return
+	}
+	json.NewEncoder(w).Encode(costruisciTopologia(naveID))
+}
+
+// TopologiaNave mostra il grafo della rete di bordo: switch, AP e porte di collegamento
+func TopologiaNave(w http.ResponseWriter, r *http.Request) {
+	naveID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/navi/topologia/"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+	nave := getNaveInfoByID(naveID)
+	if nave.ID == 0 {
+		http.Redirect(w, r, "/navi", http.StatusSeeOther)
+		return
+	}
+
+	data := NewPageData("Topologia "+nave.Nome+" - FurvioGest", r)
+	grafo := costruisciTopologia(naveID)
+
+	// Porte per switch, per la tabella di pianificazione dei cavi
+	nomi := make(map[string]string)
+	for _, n := range grafo.Nodi {
+		nomi[n.ID] = n.Nome
+	}
+	type rigaPorta struct {
+		Switch  string
+		Porta   string
+		Vicino  string
+		Tipo    string
+		PortaA  string
+		Origine string
+	}
+	var porte []rigaPorta
+	for _, c := range grafo.Collegamenti {
+		tipo := strings.SplitN(c.A, "-", 2)[0]
+		porte = append(porte, rigaPorta{Switch: nomi[c.Da], Porta: c.PortaDa, Vicino: nomi[c.A], Tipo: tipo, PortaA: c.PortaA, Origine: c.Origine})
+	}
+	sort.SliceStable(porte, func(i, j int) bool {
+		if porte[i].Switch != porte[j].Switch {
+			return porte[i].Switch < porte[j].Switch
+		}
+		return portaPrecede(porte[i].Porta, porte[j].Porta)
+	})
+
+	data.Data = map[string]interface{}{
+		"Nave":  nave,
+		"Grafo": grafo,
+		"Porte": porte,
+	}
+	renderTemplate(w, "topologia_nave.html", data)
+}
+
+// portaPrecede ordina i nomi di porta confrontando numericamente le parti
+// numeriche, cosi GE0/0/2 precede GE0/0/10
+func portaPrecede(a, b string) bool {
+	for a != "" && b != "" {
+		na, ra := prefissoNumerico(a)
+		nb, rb := prefissoNumerico(b)
+		if na >= 0 && nb >= 0 {
+			if na != nb {
+				return na < nb
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// prefissoNumerico restituisce il numero all'inizio di s (-1 se assente) e il resto
+func prefissoNumerico(s string) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return -1, s
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n, s[i:]
+}
@@ -60,8 +60,8 @@ func ListaTrasferte(w http.ResponseWriter, r *http.Request) {
 
 	var args []interface{}
 
-	// Se non tecnico, mostra solo le proprie
-	if !session.IsTecnico() {
+	// Senza gestione trasferte, mostra solo le proprie
+	if !session.Puo(auth.AutTrasferteGestione) {
 		query += " AND t.tecnico_id = ?"
 		args = append(args, session.UserID)
 	} else if tecnicoFilter != "" {
@@ -135,8 +135,8 @@ func NuovaTrasferta(w http.ResponseWriter, r *http.Request) {
 		automezzoIDStr := r.FormValue("automezzo_id")
 		note := r.FormValue("note")
 
-		// Se guest, forza tecnico_id al proprio
-		if !session.IsTecnico() {
+		// Senza gestione trasferte, forza tecnico_id al proprio
+		if !session.Puo(auth.AutTrasferteGestione) {
 			tecnicoID = session.UserID
 		}
 
@@ -157,7 +157,7 @@ func NuovaTrasferta(w http.ResponseWriter, r *http.Request) {
 			pernInt = 1
 		}
 
-		_, err := database.DB.Exec(`
+		_, err := creaConAudit(r, "trasferte", `
 			INSERT INTO trasferte (tecnico_id, rapporto_id, destinazione, data_partenza, data_rientro,
 			                      pernottamento, numero_notti, nave_id, automezzo_id, note)
 			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
@@ -208,7 +208,7 @@ func ModificaTrasferta(w http.ResponseWriter, r *http.Request) {
 		automezzoIDStr := r.FormValue("automezzo_id")
 		note := r.FormValue("note")
 
-		if !session.IsTecnico() {
+		if !session.Puo(auth.AutTrasferteGestione) {
 			tecnicoID = session.UserID
 		}
 
@@ -229,7 +229,7 @@ func ModificaTrasferta(w http.ResponseWriter, r *http.Request) {
 			pernInt = 1
 		}
 
-		_, err := database.DB.Exec(`
+		err := modificaConAudit(r, "trasferte", id, `
 			UPDATE trasferte 
 			SET tecnico_id = ?, rapporto_id = ?, destinazione = ?, data_partenza = ?, data_rientro = ?,
 			    pernottamento = ?, numero_notti = ?, nave_id = ?, automezzo_id = ?, note = ?,
@@ -266,7 +266,7 @@ func EliminaTrasferta(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/trasferte/elimina/")
 	id, _ := strconv.ParseInt(idStr, 10, 64)
 
-	database.DB.Exec("UPDATE trasferte SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	eliminaConAudit(r, "trasferte", id, "UPDATE trasferte SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
 
 	http.Redirect(w, r, "/trasferte", http.StatusSeeOther)
 }
@@ -274,8 +274,8 @@ func EliminaTrasferta(w http.ResponseWriter, r *http.Request) {
 func getTrasfertaFormData(trasfertaID int64, session *auth.Session) map[string]interface{} {
 	data := make(map[string]interface{})
 
-	// Lista tecnici (solo se tecnico)
-	if session.IsTecnico(){
+	// Lista tecnici (solo con gestione trasferte)
+	if session.Puo(auth.AutTrasferteGestione){
 		tecnici, _ := getTecniciList()
 		data["Tecnici"] = tecnici
 	}
@@ -285,11 +285,11 @@ func getTrasfertaFormData(trasfertaID int64, session *auth.Session) map[string]i
 	data["Automezzi"] = automezzi
 
 	// Lista rapporti recenti
-	rapporti := getRapportiRecenti()
+	rapporti := getRapportiRecenti(session.CompagniaID)
 	data["Rapporti"] = rapporti
 
 	// Lista navi
-	navi, _ := caricaNavi()
+	navi, _ := caricaNavi(session.CompagniaID)
 	data["Navi"] = navi
 
 	// Trasferta esistente
@@ -344,17 +344,18 @@ func getAutomezziList() ([]map[string]interface{}, error) {
 	return automezzi, nil
 }
 
-func getRapportiRecenti() []map[string]interface{} {
+// getRapportiRecenti restituisce gli ultimi rapporti, solo della compagnia se diversa da 0
+func getRapportiRecenti(compagniaID int64) []map[string]interface{} {
 	var rapporti []map[string]interface{}
 
 	rows, err := database.DB.Query(`
 		SELECT r.id, r.data_intervento, COALESCE(n.nome, '')
 		FROM rapporti_intervento r
 		LEFT JOIN navi n ON r.nave_id = n.id
-		WHERE r.deleted_at IS NULL
+		WHERE r.deleted_at IS NULL AND (? = 0 OR n.compagnia_id = ?)
 		ORDER BY r.data_intervento DESC
 		LIMIT 50
-	`)
+	`, compagniaID, compagniaID)
 	if err != nil {
 		return rapporti
 	}
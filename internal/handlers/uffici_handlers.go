@@ -3,20 +3,20 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"html/template"
 	"io"
 	"os"
 	"path/filepath"
-	"time"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"furviogest/internal/audit"
 	"furviogest/internal/database"
+	"furviogest/internal/segreti"
+	"furviogest/internal/netdevice"
 )
 
 // ============================================
@@ -127,7 +127,7 @@ func NuovoUfficio(w http.ResponseWriter, r *http.Request) {
 	email := strings.TrimSpace(r.FormValue("email"))
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	_, err := database.DB.Exec("INSERT INTO uffici (nome, indirizzo, citta, cap, telefono, email, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	_, err := creaConAudit(r, "uffici", "INSERT INTO uffici (nome, indirizzo, citta, cap, telefono, email, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		nome, indirizzo, citta, cap, telefono, email, note)
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -164,7 +164,7 @@ func ModificaUfficio(w http.ResponseWriter, r *http.Request) {
 	email := strings.TrimSpace(r.FormValue("email"))
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	database.DB.Exec("UPDATE uffici SET nome = ?, indirizzo = ?, citta = ?, cap = ?, telefono = ?, email = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+	modificaConAudit(r, "uffici", id, "UPDATE uffici SET nome = ?, indirizzo = ?, citta = ?, cap = ?, telefono = ?, email = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
 		nome, indirizzo, citta, cap, telefono, email, note, id)
 
 	http.Redirect(w, r, "/uffici", http.StatusSeeOther)
@@ -174,7 +174,7 @@ func EliminaUfficio(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/uffici/elimina/")
 	id, _ := strconv.ParseInt(path, 10, 64)
 
-	database.DB.Exec("DELETE FROM uffici WHERE id = ?", id)
+	eliminaConAudit(r, "uffici", id, "DELETE FROM uffici WHERE id = ?", id)
 	http.Redirect(w, r, "/uffici", http.StatusSeeOther)
 }
 
@@ -251,17 +251,30 @@ func SalvaACUfficio(w http.ResponseWriter, r *http.Request) {
 	}
 	note := strings.TrimSpace(r.FormValue("note"))
 
-	var existingID int64
-	err := database.DB.QueryRow("SELECT id FROM ac_ufficio WHERE ufficio_id = ?", ufficioID).Scan(&existingID)
-
-	if err == sql.ErrNoRows {
-		_, err = database.DB.Exec("INSERT INTO ac_ufficio (ufficio_id, ip, ssh_port, ssh_user, ssh_pass, protocollo, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
-			ufficioID, ip, sshPort, sshUser, sshPass, protocollo, note)
-	} else if err == nil {
-		_, err = database.DB.Exec("UPDATE ac_ufficio SET ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = ?, protocollo = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE ufficio_id = ?",
-			ip, sshPort, sshUser, sshPass, protocollo, note, ufficioID)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("ac_ufficio", "ufficio_id = ?", ufficioID); err != nil {
+			return err
+		}
+
+		var existingID int64
+		err := tx.QueryRow("SELECT id FROM ac_ufficio WHERE ufficio_id = ?", ufficioID).Scan(&existingID)
+
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec("INSERT INTO ac_ufficio (ufficio_id, ip, ssh_port, ssh_user, ssh_pass, protocollo, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				ufficioID, ip, sshPort, sshUser, sshPassCifrata, protocollo, note)
+		} else if err == nil {
+			_, err = tx.Exec("UPDATE ac_ufficio SET ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = CASE WHEN ? = '' THEN ssh_pass ELSE ? END, protocollo = ?, note = ?, updated_at = CURRENT_TIMESTAMP WHERE ufficio_id = ?",
+				ip, sshPort, sshUser, sshPassCifrata, sshPassCifrata, protocollo, note, ufficioID)
+		}
+		return err
+	})
+
 	http.Redirect(w, r, fmt.Sprintf("/uffici/rete/%d", ufficioID), http.StatusSeeOther)
 }
 
@@ -269,7 +282,13 @@ func EliminaACUfficio(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/uffici/ac/elimina/")
 	ufficioID, _ := strconv.ParseInt(path, 10, 64)
 
-	database.DB.Exec("DELETE FROM ac_ufficio WHERE ufficio_id = ?", ufficioID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Righe("ac_ufficio", "ufficio_id = ?", ufficioID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM ac_ufficio WHERE ufficio_id = ?", ufficioID)
+		return err
+	})
 	http.Redirect(w, r, fmt.Sprintf("/uffici/rete/%d", ufficioID), http.StatusSeeOther)
 }
 
@@ -303,11 +322,17 @@ func NuovoSwitchUfficio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Recupera hostname automaticamente
-	nome := getSwitchHostname(ip, sshPort, sshUser, sshPass, marca, protocollo)
+	nome := getSwitchHostname(r.Context(), ip, sshPort, sshUser, sshPass, marca, protocollo)
 	log.Printf("[NUOVO SWITCH UFFICIO] Hostname recuperato: %s", nome)
 
-	_, err := database.DB.Exec("INSERT INTO switch_ufficio (ufficio_id, nome, marca, modello, ip, ssh_port, ssh_user, ssh_pass, note, protocollo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		ufficioID, nome, marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = creaConAudit(r, "switch_ufficio", "INSERT INTO switch_ufficio (ufficio_id, nome, marca, modello, ip, ssh_port, ssh_user, ssh_pass, note, protocollo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		ufficioID, nome, marca, modello, ip, sshPort, sshUser, sshPassCifrata, note, protocollo)
 
 	if err != nil {
 		http.Error(w, "Errore salvataggio: "+err.Error(), http.StatusInternalServerError)
@@ -345,8 +370,14 @@ func ModificaSwitchUfficio(w http.ResponseWriter, r *http.Request) {
 		protocollo = "ssh"
 	}
 
-	database.DB.Exec("UPDATE switch_ufficio SET marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = ?, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-		marca, modello, ip, sshPort, sshUser, sshPass, note, protocollo, switchID)
+	sshPassCifrata, err := segreti.Cifra(sshPass)
+	if err != nil {
+		http.Error(w, "Errore cifratura credenziali: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	modificaConAudit(r, "switch_ufficio", switchID, "UPDATE switch_ufficio SET marca = ?, modello = ?, ip = ?, ssh_port = ?, ssh_user = ?, ssh_pass = CASE WHEN ? = '' THEN ssh_pass ELSE ? END, note = ?, protocollo = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		marca, modello, ip, sshPort, sshUser, sshPassCifrata, sshPassCifrata, note, protocollo, switchID)
 
 	http.Redirect(w, r, fmt.Sprintf("/uffici/rete/%d", ufficioID), http.StatusSeeOther)
 }
@@ -370,9 +401,17 @@ func EliminaSwitchUfficio(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	database.DB.Exec("DELETE FROM config_backup_ufficio WHERE (tipo_apparato = 'switch' OR tipo_apparato = 'switch_ufficio') AND apparato_id = ? AND ufficio_id IS NOT NULL", switchID)
+	conAudit(r, func(tx *sql.Tx, t *audit.Traccia) error {
+		if err := t.Elimina("switch_ufficio", switchID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM config_backup_ufficio WHERE (tipo_apparato = 'switch' OR tipo_apparato = 'switch_ufficio') AND apparato_id = ? AND ufficio_id IS NOT NULL", switchID); err != nil {
+			return err
+		}
 
-	database.DB.Exec("DELETE FROM switch_ufficio WHERE id = ?", switchID)
+		_, err := tx.Exec("DELETE FROM switch_ufficio WHERE id = ?", switchID)
+		return err
+	})
 	http.Redirect(w, r, fmt.Sprintf("/uffici/rete/%d", ufficioID), http.StatusSeeOther)
 }
 
@@ -380,6 +419,16 @@ func EliminaSwitchUfficio(w http.ResponseWriter, r *http.Request) {
 // FUNZIONI HELPER
 // ============================================
 
+// configRete restituisce i parametri di connessione dell'AC ufficio (sempre Huawei)
+func (ac *ACUfficio) configRete() netdevice.Config {
+	return configApparato(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, ac.Protocollo, "huawei")
+}
+
+// configRete restituisce i parametri di connessione dello switch ufficio
+func (sw *SwitchUfficio) configRete() netdevice.Config {
+	return configApparato(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, sw.Protocollo, sw.Marca)
+}
+
 func getACUfficioByID(ufficioID int64) *ACUfficio {
 	var ac ACUfficio
 	var ultimoBackup sql.NullString
@@ -419,7 +468,7 @@ func getSwitchesUfficio(ufficioID int64) []SwitchUfficio {
 
 func getBackupsUfficio(ufficioID int64, limit int) []ConfigBackup {
 	var backups []ConfigBackup
-	rows, err := database.DB.Query("SELECT id, COALESCE(ufficio_id, 0), tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at FROM config_backup_ufficio WHERE ufficio_id = ? ORDER BY created_at DESC LIMIT ?", ufficioID, limit)
+	rows, err := database.DB.Query("SELECT id, COALESCE(ufficio_id, 0), tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5, created_at, COALESCE(backup_precedente_id, 0), cambiato, righe_aggiunte, righe_rimosse FROM config_backup_ufficio WHERE ufficio_id = ? ORDER BY created_at DESC LIMIT ?", ufficioID, limit)
 	if err != nil {
 		return backups
 	}
@@ -427,7 +476,8 @@ func getBackupsUfficio(ufficioID int64, limit int) []ConfigBackup {
 
 	for rows.Next() {
 		var b ConfigBackup
-		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt)
+		rows.Scan(&b.ID, &b.NaveID, &b.TipoApparato, &b.ApparatoID, &b.NomeApparato, &b.FilePath, &b.FileSize, &b.HashMD5, &b.CreatedAt,
+			&b.BackupPrecedenteID, &b.Cambiato, &b.RigheAggiunte, &b.RigheRimosse)
 		backups = append(backups, b)
 	}
 	return backups
@@ -453,10 +503,9 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 		"message": "",
 	}
 
-	var ip, sshUser, sshPass, nome, protocollo string
-	var sshPort int
+	var nome string
 	var ufficioID, salaServerID int64
-	var cmdStr string
+	var cfg netdevice.Config
 
 	switch tipoApparato {
 	case "ac_ufficio":
@@ -468,14 +517,9 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(result)
 			return
 		}
-		ip = ac.IP
-		sshUser = ac.SSHUser
-		sshPass = ac.SSHPass
-		sshPort = ac.SSHPort
-		protocollo = ac.Protocollo
 		ufficioID = ac.UfficioID
 		nome = "AC"
-		cmdStr = "display current-configuration"
+		cfg = ac.configRete()
 
 	case "switch_ufficio":
 		var sw SwitchUfficio
@@ -486,18 +530,9 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(result)
 			return
 		}
-		ip = sw.IP
-		sshUser = sw.SSHUser
-		sshPass = sw.SSHPass
-		sshPort = sw.SSHPort
-		protocollo = sw.Protocollo
 		ufficioID = sw.UfficioID
 		nome = sw.Nome
-		if sw.Marca == "huawei" {
-			cmdStr = "display current-configuration"
-		} else {
-			cmdStr = "show running-config"
-		}
+		cfg = sw.configRete()
 
 	case "switch_sala_server":
 		var sw SwitchSalaServer
@@ -508,18 +543,9 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(result)
 			return
 		}
-		ip = sw.IP
-		sshUser = sw.SSHUser
-		sshPass = sw.SSHPass
-		sshPort = sw.SSHPort
-		protocollo = sw.Protocollo
 		salaServerID = sw.SalaServerID
 		nome = sw.Nome
-		if sw.Marca == "huawei" {
-			cmdStr = "display current-configuration"
-		} else {
-			cmdStr = "show running-config"
-		}
+		cfg = sw.configRete()
 
 	default:
 		result["message"] = "Tipo apparato non valido"
@@ -528,60 +554,27 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Esegui backup
-	var output string
-	var err error
-	if protocollo == "telnet" {
-		output, err = executeTelnetCommand(ip, sshUser, sshPass, cmdStr)
-	} else {
-		output, err = executeSSHBackup(ip, sshPort, sshUser, sshPass, cmdStr)
-	}
-
+	output, err := leggiRunningConfig(r.Context(), cfg)
 	if err != nil {
 		result["message"] = "Errore backup: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Calcola hash MD5
-	hash := md5.Sum([]byte(output))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Salva file
-	var backupDir string
-	if ufficioID > 0 {
-		backupDir = filepath.Join("data", "backups", fmt.Sprintf("ufficio_%d", ufficioID))
-	} else {
-		backupDir = filepath.Join("data", "backups", fmt.Sprintf("sala_server_%d", salaServerID))
-	}
-	os.MkdirAll(backupDir, 0755)
-
-	timestamp := time.Now().Format("20060102_150405")
+	// Salva solo se la configurazione e cambiata rispetto all'ultimo backup
 	tipoShort := strings.Replace(tipoApparato, "_ufficio", "", 1)
 	tipoShort = strings.Replace(tipoShort, "_sala_server", "", 1)
-	filename := fmt.Sprintf("%s_%s_%s.cfg", tipoShort, nome, timestamp)
-	filePath := filepath.Join(backupDir, filename)
-
-	err = os.WriteFile(filePath, []byte(output), 0644)
-	if err != nil {
-		result["message"] = "Errore salvataggio file: " + err.Error()
-		json.NewEncoder(w).Encode(result)
-		return
-	}
-
-	// Inserisci record DB
-	var ufficioIDPtr, salaServerIDPtr interface{}
-	if ufficioID > 0 {
-		ufficioIDPtr = ufficioID
-	}
-	if salaServerID > 0 {
-		salaServerIDPtr = salaServerID
-	}
-
-	_, err = database.DB.Exec("INSERT INTO config_backup_ufficio (ufficio_id, sala_server_id, tipo_apparato, apparato_id, nome_apparato, file_path, file_size, hash_md5) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		ufficioIDPtr, salaServerIDPtr, tipoShort, apparatoID, nome, filePath, len(output), hashStr)
-
+	esito, err := salvaBackupConfig(&backupConfig{
+		Tabella:      "config_backup_ufficio",
+		UfficioID:    ufficioID,
+		SalaServerID: salaServerID,
+		TipoApparato: tipoShort,
+		ApparatoID:   apparatoID,
+		Nome:         nome,
+		Marca:        cfg.Marca,
+	}, output)
 	if err != nil {
-		result["message"] = "Errore DB: " + err.Error()
+		result["message"] = "Errore backup: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
@@ -597,7 +590,9 @@ func APIBackupConfigUfficio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result["success"] = true
-	result["message"] = "Backup completato"
+	result["message"] = esito.messaggio()
+	result["backup_id"] = esito.ID
+	result["cambiato"] = !esito.Invariato
 	json.NewEncoder(w).Encode(result)
 }
 
@@ -650,7 +645,7 @@ func APIEliminaBackupUfficio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Elimina record dal database
-	database.DB.Exec("DELETE FROM config_backup_ufficio WHERE id = ?", backupID)
+	eliminaConAudit(r, "config_backup_ufficio", backupID, "DELETE FROM config_backup_ufficio WHERE id = ?", backupID)
 
 	// Redirect alla pagina giusta
 	if ufficioID.Valid && ufficioID.Int64 > 0 {
@@ -682,13 +677,13 @@ func getAPsUfficio(ufficioID int64) []APUfficio {
 	return aps
 }
 
-func updateOrCreateAPUfficio(ufficioID int64, apData map[string]string) {
-	mac := apData["mac"]
-	nome := apData["name"]
-	ip := apData["ip"]
-	modello := apData["model"]
+func updateOrCreateAPUfficio(ufficioID int64, apData netdevice.InfoAP) {
+	mac := apData.MAC
+	nome := apData.Nome
+	ip := apData.IP
+	modello := apData.Modello
 	stato := "online"
-	if apData["state"] != "nor" && apData["state"] != "normal" {
+	if apData.Stato != "nor" && apData.Stato != "normal" {
 		stato = "offline"
 	}
 
@@ -714,7 +709,7 @@ func APIScanAPUfficio(w http.ResponseWriter, r *http.Request) {
 	result := map[string]interface{}{
 		"success": false,
 		"message": "",
-		"aps":     []map[string]string{},
+		"aps":     []netdevice.InfoAP{},
 	}
 
 	// Ottieni AC
@@ -725,17 +720,14 @@ func APIScanAPUfficio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Esegui comando SSH su AC Huawei
-	output, err := executeSSHCommand(ac.IP, ac.SSHPort, ac.SSHUser, ac.SSHPass, "display ap all")
+	// Legge gli AP dall'AC tramite il driver Huawei
+	aps, err := leggiAccessPoint(r.Context(), ac.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse output Huawei AC (usa la funzione esistente in rete_handlers.go)
-	aps := parseHuaweiAPOutput(string(output))
-
 	log.Printf("[SCAN AP UFFICIO] Ufficio %d - Trovati %d AP", ufficioID, len(aps))
 
 	// Aggiorna database
@@ -774,46 +766,21 @@ func APIScanPortsUfficio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Comando diverso in base alla marca
-	var cmdStr string
-	if sw.Marca == "huawei" {
-		cmdStr = "display interface brief"
-	} else {
-		cmdStr = "show interface brief"
-	}
-
-	// Esegui comando SSH
-	output, err := executeSSHCommand(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, cmdStr)
+	// Conta porte tramite il driver della marca
+	porteTotali, porteLibere, err := leggiPorte(r.Context(), sw.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse output per contare porte
-	var porteTotali, porteLibere int
-	if sw.Marca == "huawei" {
-		porteTotali, porteLibere = parseHuaweiPortsOutput(output)
-	} else {
-		porteTotali, porteLibere = parseHPPortsOutput(output)
-	}
-
 	// Aggiorna database
 	database.DB.Exec("UPDATE switch_ufficio SET porte_totali = ?, porte_libere = ?, ultimo_check = CURRENT_TIMESTAMP WHERE id = ?",
 		porteTotali, porteLibere, switchID)
 
 	// Recupera modello se non presente
-	var currentModello string
-	database.DB.QueryRow("SELECT COALESCE(modello, '') FROM switch_ufficio WHERE id = ?", switchID).Scan(&currentModello)
-	if currentModello == "" && sw.Marca == "huawei" {
-		versionOutput, verr := executeSSHCommand(sw.IP, sw.SSHPort, sw.SSHUser, sw.SSHPass, "display version")
-		if verr == nil {
-			_, model := parseVersionOutput(versionOutput, "huawei")
-			if model != "" {
-				database.DB.Exec("UPDATE switch_ufficio SET modello = ? WHERE id = ?", model, switchID)
-				result["modello"] = model
-			}
-		}
+	if model := aggiornaModelloSeMancante(r.Context(), "switch_ufficio", switchID, sw.configRete()); model != "" {
+		result["modello"] = model
 	}
 
 	result["success"] = true
@@ -838,57 +805,30 @@ func APIScanPortsSalaServer(w http.ResponseWriter, r *http.Request) {
 		"porte_libere": 0,
 	}
 
-	var ip, sshUser, sshPass, protocollo, marca string
-	var sshPort int
-	var salaServerID int64
+	var sw SwitchSalaServer
 	err := database.DB.QueryRow("SELECT id, sala_server_id, ip, ssh_port, ssh_user, ssh_pass, COALESCE(protocollo, 'ssh'), marca FROM switch_sala_server WHERE id = ?", switchID).
-		Scan(&switchID, &salaServerID, &ip, &sshPort, &sshUser, &sshPass, &protocollo, &marca)
+		Scan(&sw.ID, &sw.SalaServerID, &sw.IP, &sw.SSHPort, &sw.SSHUser, &sw.SSHPass, &sw.Protocollo, &sw.Marca)
 	if err != nil {
 		result["message"] = "Switch non trovato"
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Comando diverso in base alla marca
-	var cmdStr string
-	if marca == "huawei" {
-		cmdStr = "display interface brief"
-	} else {
-		cmdStr = "show interface brief"
-	}
-
-	// Esegui comando SSH
-	output, err := executeSSHCommand(ip, sshPort, sshUser, sshPass, cmdStr)
+	// Conta porte tramite il driver della marca
+	porteTotali, porteLibere, err := leggiPorte(r.Context(), sw.configRete())
 	if err != nil {
 		result["message"] = "Errore connessione SSH: " + err.Error()
 		json.NewEncoder(w).Encode(result)
 		return
 	}
 
-	// Parse output per contare porte
-	var porteTotali, porteLibere int
-	if marca == "huawei" {
-		porteTotali, porteLibere = parseHuaweiPortsOutput(output)
-	} else {
-		porteTotali, porteLibere = parseHPPortsOutput(output)
-	}
-
 	// Aggiorna database
 	database.DB.Exec("UPDATE switch_sala_server SET porte_totali = ?, porte_libere = ?, ultimo_check = CURRENT_TIMESTAMP WHERE id = ?",
 		porteTotali, porteLibere, switchID)
 
 	// Recupera modello se non presente
-	var currentModello string
-	database.DB.QueryRow("SELECT COALESCE(modello, '') FROM switch_sala_server WHERE id = ?", switchID).Scan(&currentModello)
-	if currentModello == "" && marca == "huawei" {
-		versionOutput, verr := executeSSHCommand(ip, sshPort, sshUser, sshPass, "display version")
-		if verr == nil {
-			_, model := parseVersionOutput(versionOutput, "huawei")
-			if model != "" {
-				database.DB.Exec("UPDATE switch_sala_server SET modello = ? WHERE id = ?", model, switchID)
-				result["modello"] = model
-			}
-		}
+	if model := aggiornaModelloSeMancante(r.Context(), "switch_sala_server", switchID, sw.configRete()); model != "" {
+		result["modello"] = model
 	}
 
 	result["success"] = true
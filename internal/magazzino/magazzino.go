@@ -0,0 +1,186 @@
+package magazzino
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+
+	"furviogest/internal/database"
+	"furviogest/internal/models"
+)
+
+// ============================================
+// REGISTRO DEI MOVIMENTI DI MAGAZZINO
+// ============================================
+
+// La giacenza di un prodotto e la somma dei suoi movimenti in movimenti_magazzino. Ogni
+// variazione passa da Registra, che scrive il movimento e ricalcola prodotti.giacenza dal
+// registro nella stessa transazione: la colonna resta una copia letta da liste e report.
+
+// Tipi di movimento (vincolo CHECK della tabella)
+const (
+	Carico  = "carico"
+	Scarico = "scarico"
+)
+
+// Causali dei movimenti
+const (
+	CausaleGiacenzaIniziale = "giacenza_iniziale"
+	CausaleAcquisto         = "acquisto"
+	CausaleStornoAcquisto   = "storno_acquisto"
+	CausaleDDTEntrata       = "ddt_entrata"
+	CausaleStornoDDTEntrata = "storno_ddt_entrata"
+	CausaleDDTUscita        = "ddt_uscita"
+	CausaleStornoDDTUscita  = "storno_ddt_uscita"
+	CausaleDDT              = "ddt"
+	CausaleStornoDDT        = "storno_ddt"
+	CausaleRettifica        = "rettifica"
+)
+
+// Documenti da cui nascono i movimenti
+const (
+	DocumentoDDTFattura = "ddt_fattura"
+	DocumentoDDTEntrata = "ddt_entrata"
+	DocumentoDDTUscita  = "ddt_uscita"
+	DocumentoDDT        = "ddt"
+)
+
+// tolleranza sotto la quale giacenza e registro coincidono (le quantita sono REAL)
+const tolleranza = 0.000001
+
+// sommaRegistro calcola la giacenza di un prodotto dai suoi movimenti
+const sommaRegistro = `
+	SELECT COALESCE(SUM(CASE tipo WHEN 'carico' THEN quantita ELSE -quantita END), 0)
+	FROM movimenti_magazzino WHERE prodotto_id = ?`
+
+// ErrUtenteMancante indica un movimento senza l'utente che lo ha eseguito
+var ErrUtenteMancante = errors.New("movimento di magazzino senza utente")
+
+// Movimento e una variazione di giacenza da registrare
+type Movimento struct {
+	ProdottoID    int64
+	Quantita      float64 // positiva per un carico, negativa per uno scarico
+	Causale       string
+	DocumentoTipo string // vuoto se il movimento non nasce da un documento
+	DocumentoID   int64
+	UtenteID      int64
+	Motivo        string
+}
+
+// Registra scrive il movimento e aggiorna la giacenza del prodotto dal registro.
+// Un movimento a quantita zero non viene registrato.
+func Registra(tx *sql.Tx, m Movimento) error {
+	if m.UtenteID == 0 {
+		return ErrUtenteMancante
+	}
+	if m.Quantita == 0 {
+		return nil
+	}
+
+	tipo, quantita := Carico, m.Quantita
+	if quantita < 0 {
+		tipo, quantita = Scarico, -quantita
+	}
+	_, err := tx.Exec(`
+		INSERT INTO movimenti_magazzino (prodotto_id, tecnico_id, utente_id, quantita, tipo, causale, motivo,
+		                                 documento_tipo, documento_id, data_movimento)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), DATE('now'))
+	`, m.ProdottoID, m.UtenteID, m.UtenteID, quantita, tipo, m.Causale, m.Motivo, m.DocumentoTipo, m.DocumentoID)
+	if err != nil {
+		return fmt.Errorf("movimento prodotto %d: %w", m.ProdottoID, err)
+	}
+	return ricalcola(tx, m.ProdottoID)
+}
+
+// ricalcola riporta la giacenza del prodotto alla somma dei suoi movimenti
+func ricalcola(tx *sql.Tx, prodottoID int64) error {
+	res, err := tx.Exec(`
+		UPDATE prodotti SET giacenza = (`+sommaRegistro+`), updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, prodottoID, prodottoID)
+	if err != nil {
+		return fmt.Errorf("giacenza prodotto %d: %w", prodottoID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("prodotto %d non trovato", prodottoID)
+	}
+	return nil
+}
+
+// Movimenti restituisce i movimenti di un prodotto, dal piu recente
+func Movimenti(prodottoID int64) ([]models.MovimentoMagazzino, error) {
+	rows, err := database.DB.Query(`
+		SELECT m.id, m.prodotto_id, m.tecnico_id, m.quantita, m.tipo, COALESCE(m.motivo, ''),
+		       COALESCE(m.causale, ''), COALESCE(m.documento_tipo, ''), COALESCE(m.documento_id, 0), m.created_at,
+		       COALESCE(u.nome || ' ' || u.cognome, ''), COALESCE(p.unita_misura, 'pz')
+		FROM movimenti_magazzino m
+		LEFT JOIN utenti u ON u.id = m.tecnico_id
+		LEFT JOIN prodotti p ON p.id = m.prodotto_id
+		WHERE m.prodotto_id = ?
+		ORDER BY m.created_at DESC, m.id DESC
+	`, prodottoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movimenti []models.MovimentoMagazzino
+	for rows.Next() {
+		var m models.MovimentoMagazzino
+		if err := rows.Scan(&m.ID, &m.ProdottoID, &m.TecnicoID, &m.Quantita, &m.Tipo, &m.Motivo,
+			&m.Causale, &m.DocumentoTipo, &m.DocumentoID, &m.CreatedAt, &m.NomeTecnico, &m.UnitaMisura); err != nil {
+			return nil, err
+		}
+		movimenti = append(movimenti, m)
+	}
+	return movimenti, rows.Err()
+}
+
+// ============================================
+// RICONCILIAZIONE
+// ============================================
+
+// Discrepanza e un prodotto la cui giacenza salvata non coincide con il registro
+type Discrepanza struct {
+	ProdottoID  int64
+	Codice      string
+	Nome        string
+	UnitaMisura string
+	Giacenza    float64 // valore in prodotti.giacenza
+	Registro    float64 // somma dei movimenti
+	Movimenti   int
+}
+
+// Differenza restituisce di quanto la giacenza salvata supera il registro
+func (d Discrepanza) Differenza() float64 {
+	return d.Giacenza - d.Registro
+}
+
+// Riconcilia confronta la giacenza di ogni prodotto con la somma dei suoi movimenti e
+// restituisce i prodotti che non coincidono
+func Riconcilia() ([]Discrepanza, error) {
+	rows, err := database.DB.Query(`
+		SELECT p.id, p.codice, p.nome, COALESCE(p.unita_misura, 'pz'), p.giacenza,
+		       COALESCE(SUM(CASE m.tipo WHEN 'carico' THEN m.quantita ELSE -m.quantita END), 0), COUNT(m.id)
+		FROM prodotti p
+		LEFT JOIN movimenti_magazzino m ON m.prodotto_id = p.id
+		GROUP BY p.id
+		ORDER BY p.codice
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discrepanze []Discrepanza
+	for rows.Next() {
+		var d Discrepanza
+		if err := rows.Scan(&d.ProdottoID, &d.Codice, &d.Nome, &d.UnitaMisura, &d.Giacenza, &d.Registro, &d.Movimenti); err != nil {
+			return nil, err
+		}
+		if math.Abs(d.Differenza()) > tolleranza {
+			discrepanze = append(discrepanze, d)
+		}
+	}
+	return discrepanze, rows.Err()
+}
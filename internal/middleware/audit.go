@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+
+	"furviogest/internal/audit"
+	"furviogest/internal/auth"
+)
+
+// IndirizzoRichiesta restituisce l'IP da cui arriva la richiesta: lo stesso valore finisce
+// nel registro delle modifiche e nei controlli sui tentativi di accesso
+func IndirizzoRichiesta(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// eseguiConAudit esegue l'handler con l'autore delle modifiche nel contesto: gli handler
+// che scrivono nel database registrano con audit.Traccia, nella loro transazione, i
+// record creati, modificati o eliminati. Una richiesta di scrittura che non passa da
+// una Traccia viene comunque registrata, con i campi inviati.
+func eseguiConAudit(next http.Handler, w http.ResponseWriter, r *http.Request, session *auth.Session) {
+	autore := &audit.Autore{
+		UtenteID: session.UserID,
+		Username: session.Username,
+		IP:       IndirizzoRichiesta(r),
+		Percorso: r.Method + " " + r.URL.Path,
+	}
+	r = r.WithContext(audit.ConAutore(r.Context(), autore))
+	next.ServeHTTP(w, r)
+
+	if !richiestaDiScrittura(r) || autore.Tracciata() {
+		return
+	}
+	if err := audit.RegistraRichiesta(*autore, campiInviati(r)); err != nil {
+		log.Printf("[Audit] Errore registrazione %s: %v", autore.Percorso, err)
+	}
+}
+
+// richiestaDiScrittura indica i metodi che possono modificare i dati
+func richiestaDiScrittura(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// campiInviati restituisce i campi letti dall'handler (o quelli della query se non ha
+// letto il form) e, per i file caricati, il nome del file
+func campiInviati(r *http.Request) url.Values {
+	campi := url.Values{}
+	sorgente := r.Form
+	if sorgente == nil {
+		sorgente = r.URL.Query()
+	}
+	for nome, valori := range sorgente {
+		campi[nome] = valori
+	}
+	if r.MultipartForm != nil {
+		for nome, file := range r.MultipartForm.File {
+			for _, f := range file {
+				campi.Add(nome, f.Filename)
+			}
+		}
+	}
+	return campi
+}
@@ -0,0 +1,366 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"furviogest/internal/auth"
+	"furviogest/internal/database"
+)
+
+// libera indica le rotte aperte a ogni utente autenticato
+const libera = ""
+
+// autorizzazioniRotte associa ogni rotta protetta registrata in main.go all'autorizzazione
+// richiesta. Come in http.ServeMux i percorsi che finiscono con "/" valgono per tutto il
+// sottoalbero e vince il piu lungo; "/" vale solo per la dashboard. Le rotte non elencate
+// rispondono 404: una nuova pagina va aggiunta qui.
+var autorizzazioniRotte = map[string]string{
+	// Dashboard e account
+	"/":                libera,
+	"/cambio-password": libera,
+	"/sessioni":        libera,
+	"/due-fattori":     libera,
+	"/azienda/logo":    libera,
+	"/azienda/firma":   libera,
+
+	// Utenti, ruoli e sicurezza
+	"/tecnici":                auth.AutUtentiVedi,
+	"/tecnici/":               auth.AutUtentiGestisci,
+	"/ruoli":                  auth.AutUtentiGestisci,
+	"/ruoli/":                 auth.AutUtentiGestisci,
+	"/sicurezza":              auth.AutUtentiGestisci,
+	"/tecnici/reimposta-2fa/": auth.AutUtentiGestisci,
+
+	// Anagrafiche
+	"/fornitori":                       auth.AutAnagraficheVedi,
+	"/fornitori/":                      auth.AutAnagraficheScrivi,
+	"/api/verifica-piva":               auth.AutAnagraficheVedi,
+	"/api/fornitore/info-eliminazione": auth.AutAnagraficheVedi,
+	"/porti":                           auth.AutAnagraficheVedi,
+	"/porti/":                          auth.AutAnagraficheScrivi,
+	"/automezzi":                       auth.AutAnagraficheVedi,
+	"/automezzi/":                      auth.AutAnagraficheScrivi,
+	"/compagnie":                       auth.AutAnagraficheVedi,
+	"/compagnie/":                      auth.AutAnagraficheScrivi,
+	"/compagnie/logo/":                 auth.AutNaviVedi,
+	"/clienti":                         auth.AutAnagraficheVedi,
+	"/clienti/":                        auth.AutAnagraficheScrivi,
+
+	// Navi
+	"/navi":               auth.AutNaviVedi,
+	"/navi/":              auth.AutNaviScrivi,
+	"/navi/foto/":         auth.AutNaviVedi,
+	"/navi/dettaglio/":    auth.AutNaviVedi,
+	"/navi/storico/":      auth.AutNaviVedi,
+	"/api/navi-compagnia": auth.AutNaviVedi,
+	"/orari/upload":       auth.AutNaviScrivi,
+
+	// Guasti
+	"/guasti-nave":           auth.AutNaviVedi,
+	"/guasti-nave/":          auth.AutNaviVedi,
+	"/guasti-nave/storico":   auth.AutNaviVedi,
+	"/guasti-nave/nuovo/":    auth.AutGuastiScrivi,
+	"/guasti-nave/modifica/": auth.AutGuastiScrivi,
+	"/guasti-nave/elimina/":  auth.AutGuastiElimina,
+	"/api/guasti-nave":       auth.AutNaviVedi,
+
+	// Rete di navi, uffici e sale server
+	"/navi/rete/":                        auth.AutReteVedi,
+	"/navi/snmp/":                        auth.AutReteVedi,
+	"/navi/topologia/":                   auth.AutReteVedi,
+	"/navi/piantina-rete/":               auth.AutReteVedi,
+	"/navi/ac/":                          auth.AutReteScrivi,
+	"/navi/switch/":                      auth.AutReteScrivi,
+	"/uffici":                            auth.AutReteVedi,
+	"/uffici/":                           auth.AutReteScrivi,
+	"/uffici/rete/":                      auth.AutReteVedi,
+	"/sale-server":                       auth.AutReteVedi,
+	"/sale-server/":                      auth.AutReteScrivi,
+	"/sale-server/rete/":                 auth.AutReteVedi,
+	"/api/rete/":                         auth.AutReteVedi,
+	"/api/uffici/":                       auth.AutReteVedi,
+	"/api/sale-server/":                  auth.AutReteVedi,
+	"/api/rete/piantina-posizione":       auth.AutReteScrivi,
+	"/api/rete/backup-config":            auth.AutReteBackup,
+	"/api/rete/backup-config-ufficio":    auth.AutReteBackup,
+	"/api/rete/elimina-backup-ufficio/":  auth.AutReteBackup,
+	"/rete/ripristino-config":            auth.AutReteBackup,
+	"/api/rete/download-config/":         auth.AutReteCredenziali,
+	"/api/rete/download-backup-ufficio/": auth.AutReteCredenziali,
+	"/rete/storico-config":               auth.AutReteCredenziali,
+	"/monitoraggio/":                     auth.AutMonitoraggio,
+	"/monitoraggio/disponibilita":        auth.AutAmministrazione,
+	"/monitoraggio/disponibilita/export": auth.AutAmministrazione,
+
+	// Magazzino e attrezzi
+	"/magazzino":                 auth.AutMagazzinoVedi,
+	"/magazzino/":                auth.AutMagazzinoScrivi,
+	"/magazzino/movimenti/":      auth.AutMagazzinoVedi,
+	"/magazzino/riconciliazione": auth.AutMagazzinoVedi,
+	"/api/prodotto/dettaglio":    auth.AutMagazzinoVedi,
+	"/attrezzi":                  auth.AutMagazzinoVedi,
+	"/attrezzi/":                 auth.AutMagazzinoScrivi,
+	"/attrezzi/storico/":         auth.AutMagazzinoVedi,
+
+	// DDT, fatture e archivio PDF
+	"/ddt-fatture":                       auth.AutDDTVedi,
+	"/ddt-fatture/":                      auth.AutDDTScrivi,
+	"/api/ddt-fatture/info-eliminazione": auth.AutDDTVedi,
+	"/api/ddt-fatture/cerca":             auth.AutDDTVedi,
+	"/archivio-pdf":                      auth.AutDDTVedi,
+	"/archivio-pdf/":                     auth.AutDDTScrivi,
+	"/archivio-pdf/download/":            auth.AutDDTVedi,
+	"/archivio-pdf/visualizza/":          auth.AutDDTVedi,
+	"/ddt-uscita":                        auth.AutDDTVedi,
+	"/ddt-uscita/":                       auth.AutDDTScrivi,
+	"/ddt-uscita/dettaglio/":             auth.AutDDTVedi,
+	"/ddt-uscita/pdf/":                   auth.AutDDTVedi,
+	"/ddt-uscita/annulla/":               auth.AutDDTAnnulla,
+	"/api/ddt-uscita/cerca-prodotti":     auth.AutDDTVedi,
+	"/ddt":                               auth.AutDDTVedi,
+	"/ddt/":                              auth.AutDDTScrivi,
+	"/ddt/dettaglio/":                    auth.AutDDTVedi,
+	"/ddt/genera-numero":                 auth.AutDDTVedi,
+	"/uploads/ddt_entrata/":              auth.AutDDTVedi,
+
+	// Permessi di accesso a bordo
+	"/permessi":            auth.AutPermessiVedi,
+	"/permessi/":           auth.AutPermessiScrivi,
+	"/permessi/dettaglio/": auth.AutPermessiVedi,
+
+	// Rapporti
+	"/rapporti":               auth.AutRapportiVedi,
+	"/rapporti/":              auth.AutRapportiScrivi,
+	"/rapporti/dettaglio/":    auth.AutRapportiVedi,
+	"/rapporti/pdf/":          auth.AutRapportiVedi,
+	"/rapporti/download-pdf/": auth.AutRapportiVedi,
+	"/uploads/rapporti/":      auth.AutRapportiVedi,
+
+	// Trasferte e note spese
+	"/trasferte":               auth.AutTrasferte,
+	"/trasferte/":              auth.AutTrasferte,
+	"/trasferte/elimina/":      auth.AutTrasferteGestione,
+	"/note-spese":              auth.AutTrasferte,
+	"/note-spese/":             auth.AutTrasferte,
+	"/note-spese/elimina/":     auth.AutTrasferteGestione,
+	"/foglio-mensile":          auth.AutTrasferte,
+	"/calendario-trasferte":    auth.AutTrasferte,
+	"/api/calendario/":         auth.AutTrasferte,
+	"/stampa-trasferte":        auth.AutTrasferte,
+	"/stampa-note-spese":       auth.AutTrasferte,
+	"/email-trasferte":         auth.AutTrasferte,
+	"/email-note-spese":        auth.AutTrasferte,
+	"/download-pdf-trasferte":  auth.AutTrasferte,
+	"/download-pdf-note-spese": auth.AutTrasferte,
+
+	// Amministrazione e sistema
+	"/amministrazione":  auth.AutAmministrazione,
+	"/amministrazione/": auth.AutAmministrazione,
+	"/impostazioni":     auth.AutImpostazioni,
+	"/impostazioni/":    auth.AutImpostazioni,
+	"/backup":           auth.AutBackup,
+	"/backup/":          auth.AutBackup,
+	"/audit":            auth.AutAudit,
+	"/audit/export":     auth.AutAudit,
+}
+
+// autorizzazioneRotta restituisce l'autorizzazione richiesta dal percorso
+func autorizzazioneRotta(percorso string) (string, bool) {
+	if a, ok := autorizzazioniRotte[percorso]; ok {
+		return a, true
+	}
+	migliore := ""
+	for rotta := range autorizzazioniRotte {
+		if len(rotta) > 1 && strings.HasSuffix(rotta, "/") && strings.HasPrefix(percorso, rotta) && len(rotta) > len(migliore) {
+			migliore = rotta
+		}
+	}
+	if migliore == "" {
+		return "", false
+	}
+	return autorizzazioniRotte[migliore], true
+}
+
+// Query che risalgono alla compagnia dall'ID della nave o di un suo oggetto
+const (
+	compagniaDaNave     = "SELECT compagnia_id FROM navi WHERE id = ?"
+	compagniaDaSwitch   = "SELECT n.compagnia_id FROM switch_nave s JOIN navi n ON n.id = s.nave_id WHERE s.id = ?"
+	compagniaDaAC       = "SELECT n.compagnia_id FROM access_controller a JOIN navi n ON n.id = a.nave_id WHERE a.id = ?"
+	compagniaDaBackup   = "SELECT n.compagnia_id FROM config_backup c JOIN navi n ON n.id = c.nave_id WHERE c.id = ?"
+	compagniaDaDisegno  = "SELECT n.compagnia_id FROM disegni_nave d JOIN navi n ON n.id = d.nave_id WHERE d.id = ?"
+	compagniaDaRapporto = "SELECT n.compagnia_id FROM rapporti_intervento r JOIN navi n ON n.id = r.nave_id WHERE r.id = ?"
+	compagniaDaDDT      = "SELECT compagnia_id FROM ddt WHERE id = ?"
+	compagniaDaPermesso = "SELECT n.compagnia_id FROM richieste_permesso p JOIN navi n ON n.id = p.nave_id WHERE p.id = ?"
+)
+
+// rotteNave indicano come risalire alla compagnia dal primo ID dopo il prefisso, per
+// limitare gli utenti associati a una compagnia alle sue navi
+var rotteNave = map[string]string{
+	"/navi/dettaglio/":           compagniaDaNave,
+	"/navi/modifica/":            compagniaDaNave,
+	"/navi/elimina/":             compagniaDaNave,
+	"/navi/foto/":                compagniaDaNave,
+	"/navi/storico/":             compagniaDaNave,
+	"/navi/rete/":                compagniaDaNave,
+	"/navi/snmp/":                compagniaDaNave,
+	"/navi/topologia/":           compagniaDaNave,
+	"/navi/piantina-rete/":       compagniaDaNave,
+	"/navi/piantina/":            compagniaDaNave,
+	"/navi/elimina-disegno/":     compagniaDaNave,
+	"/navi/server/":              compagniaDaNave,
+	"/navi/elimina-server/":      compagniaDaNave,
+	"/navi/orario/nuovo/":        compagniaDaNave,
+	"/navi/sosta/nuovo/":         compagniaDaNave,
+	"/navi/ac/salva/":            compagniaDaNave,
+	"/navi/ac/elimina/":          compagniaDaNave,
+	"/navi/switch/nuovo/":        compagniaDaNave,
+	"/guasti-nave/":              compagniaDaNave,
+	"/guasti-nave/nuovo/":        compagniaDaNave,
+	"/navi/switch/modifica/":     compagniaDaSwitch,
+	"/navi/switch/elimina/":      compagniaDaSwitch,
+	"/guasti-nave/modifica/":     "SELECT n.compagnia_id FROM guasti_nave g JOIN navi n ON n.id = g.nave_id WHERE g.id = ?",
+	"/guasti-nave/elimina/":      "SELECT n.compagnia_id FROM guasti_nave g JOIN navi n ON n.id = g.nave_id WHERE g.id = ?",
+	"/api/rete/download-config/": compagniaDaBackup,
+	"/rapporti/dettaglio/":       compagniaDaRapporto,
+	"/rapporti/modifica/":        compagniaDaRapporto,
+	"/rapporti/elimina/":         compagniaDaRapporto,
+	"/rapporti/pdf/":             compagniaDaRapporto,
+	"/rapporti/download-pdf/":    compagniaDaRapporto,
+	"/ddt/dettaglio/":            compagniaDaDDT,
+	"/ddt/modifica/":             compagniaDaDDT,
+	"/ddt/elimina/":              compagniaDaDDT,
+	"/amministrazione/ddt/":      compagniaDaDDT,
+	"/permessi/dettaglio/":       compagniaDaPermesso,
+	"/permessi/modifica/":        compagniaDaPermesso,
+	"/permessi/elimina/":         compagniaDaPermesso,
+	"/permessi/segna-inviata/":   compagniaDaPermesso,
+	"/permessi/anteprima-email/": compagniaDaPermesso,
+	"/permessi/invia-email/":     compagniaDaPermesso,
+	"/permessi/download-eml/":    compagniaDaPermesso,
+}
+
+// parametriNave indicano, per le rotte che ricevono l'oggetto nei parametri invece che
+// nel percorso, la query per risalire alla compagnia e il valore dell'ID. Una query
+// vuota indica che la richiesta non riguarda una nave (uffici, sale server).
+var parametriNave = map[string]func(r *http.Request) (string, string){
+	"/api/rete/backup-config": func(r *http.Request) (string, string) {
+		return compagniaDaApparato(r.FormValue("tipo")), r.FormValue("id")
+	},
+	"/api/rete/test-ssh": func(r *http.Request) (string, string) {
+		return compagniaDaApparato(r.FormValue("tipo")), r.FormValue("id")
+	},
+	"/api/rete/scan-ports": func(r *http.Request) (string, string) {
+		return compagniaDaSwitch, r.FormValue("switch_id")
+	},
+	"/api/rete/switch-version": func(r *http.Request) (string, string) {
+		return compagniaDaSwitch, r.FormValue("switch_id")
+	},
+	"/api/rete/ac-version": func(r *http.Request) (string, string) {
+		return compagniaDaAC, r.FormValue("ac_id")
+	},
+	"/api/rete/ac-licenze": func(r *http.Request) (string, string) {
+		return compagniaDaAC, r.FormValue("ac_id")
+	},
+	"/api/rete/piantina": func(r *http.Request) (string, string) {
+		return compagniaDaDisegno, r.FormValue("disegno_id")
+	},
+	"/api/rete/piantina-posizione": func(r *http.Request) (string, string) {
+		return compagniaDaDisegno, r.FormValue("disegno_id")
+	},
+	"/rete/storico-config":    backupDaOrigine,
+	"/rete/ripristino-config": backupDaOrigine,
+}
+
+// compagniaDaApparato restituisce la query per l'apparato di nave del tipo indicato
+func compagniaDaApparato(tipo string) string {
+	switch tipo {
+	case "ac":
+		return compagniaDaAC
+	case "switch":
+		return compagniaDaSwitch
+	}
+	return ""
+}
+
+// backupDaOrigine risale alla compagnia dal backup di configurazione di una nave
+func backupDaOrigine(r *http.Request) (string, string) {
+	if r.FormValue("origine") != "nave" {
+		return "", ""
+	}
+	return compagniaDaBackup, r.FormValue("id")
+}
+
+// compagniaVisibile indica se l'utente vede la compagnia dell'oggetto indicato dalla
+// query. Un ID non valido non limita la richiesta, un oggetto inesistente si.
+func compagniaVisibile(session *auth.Session, query, valore string) bool {
+	id, err := strconv.ParseInt(valore, 10, 64)
+	if err != nil {
+		return true
+	}
+	var compagniaID int64
+	database.DB.QueryRow(query, id).Scan(&compagniaID)
+	return session.VedeCompagnia(compagniaID)
+}
+
+// naveVisibile indica se la richiesta riguarda una nave della compagnia dell'utente
+func naveVisibile(r *http.Request, session *auth.Session) bool {
+	if session.CompagniaID == 0 {
+		return true
+	}
+
+	if !compagniaVisibile(session, compagniaDaNave, r.URL.Query().Get("nave_id")) {
+		return false
+	}
+
+	if parametro, ok := parametriNave[r.URL.Path]; ok {
+		if query, valore := parametro(r); query != "" && !compagniaVisibile(session, query, valore) {
+			return false
+		}
+	}
+
+	prefisso := ""
+	for p := range rotteNave {
+		if strings.HasPrefix(r.URL.Path, p) && len(p) > len(prefisso) {
+			prefisso = p
+		}
+	}
+	if prefisso == "" {
+		return true
+	}
+	segmento := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefisso), "/", 2)[0]
+	return compagniaVisibile(session, rotteNave[prefisso], segmento)
+}
+
+// autorizzaRotta verifica autorizzazione e compagnia della richiesta. Se l'accesso e
+// negato scrive la risposta e restituisce false.
+func autorizzaRotta(w http.ResponseWriter, r *http.Request, session *auth.Session, isAPI bool) bool {
+	autorizzazione, ok := autorizzazioneRotta(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return false
+	}
+	if autorizzazione != libera && !session.Puo(autorizzazione) {
+		negaAccesso(w, isAPI, http.StatusForbidden, "Accesso non autorizzato")
+		return false
+	}
+	// Le navi di altre compagnie rispondono come inesistenti
+	if !naveVisibile(r, session) {
+		negaAccesso(w, isAPI, http.StatusNotFound, "Non trovato")
+		return false
+	}
+	return true
+}
+
+// negaAccesso scrive la risposta di accesso negato, in JSON per le API
+func negaAccesso(w http.ResponseWriter, isAPI bool, stato int, messaggio string) {
+	if isAPI {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(stato)
+		json.NewEncoder(w).Encode(map[string]string{"error": messaggio})
+		return
+	}
+	http.Error(w, messaggio+".", stato)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"furviogest/internal/auth"
-	"furviogest/internal/models"
 	"net/http"
 	"strings"
 )
@@ -22,6 +21,23 @@ func GetSession(r *http.Request) *auth.Session {
 	return session
 }
 
+// ImpostaCookieSessione scrive il cookie di sessione: persistente se l'utente ha scelto
+// "ricorda questo dispositivo", altrimenti valido fino alla chiusura del browser
+func ImpostaCookieSessione(w http.ResponseWriter, session *auth.Session) {
+	cookie := &http.Cookie{
+		Name:     "session_token",
+		Value:    session.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Mettere true in produzione con HTTPS
+		SameSite: http.SameSiteLaxMode,
+	}
+	if session.Ricorda {
+		cookie.MaxAge = int(auth.DurataRicorda.Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
 // RequireAuth middleware che richiede autenticazione
 func RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -62,27 +78,42 @@ func RequireAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		// Aggiungi la sessione al contesto
-		ctx := context.WithValue(r.Context(), SessionKey, session)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
+		// Il cookie persistente segue la scadenza della sessione
+		if session.Rinnovata && session.Ricorda {
+			ImpostaCookieSessione(w, session)
+		}
 
-// RequireTecnico middleware che richiede ruolo tecnico
-func RequireTecnico(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session := GetSession(r)
-		if session == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		// Con la password predefinita si puo solo cambiarla
+		if session.DeveCambiarePassword && r.URL.Path != "/cambio-password" {
+			if isAPI {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Cambiare la password predefinita"})
+				return
+			}
+			http.Redirect(w, r, "/cambio-password", http.StatusSeeOther)
+			return
+		}
+
+		// Con il secondo fattore obbligatorio e non configurato si puo solo completare la registrazione
+		if session.DeveAttivareTOTP && !session.DeveCambiarePassword && r.URL.Path != "/due-fattori" {
+			if isAPI {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Configurare l'autenticazione a due fattori"})
+				return
+			}
+			http.Redirect(w, r, "/due-fattori", http.StatusSeeOther)
 			return
 		}
 
-		if session.Ruolo != models.RuoloTecnico {
-			http.Error(w, "Accesso non autorizzato. Solo i tecnici possono eseguire questa operazione.", http.StatusForbidden)
+		if !autorizzaRotta(w, r, session, isAPI) {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		// Aggiungi la sessione al contesto
+		ctx := context.WithValue(r.Context(), SessionKey, session)
+		eseguiConAudit(next, w, r.WithContext(ctx), session)
 	})
 }
 
@@ -106,39 +137,3 @@ func Logging(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-// RequireAmministrazione middleware che richiede ruolo amministrazione
-func RequireAmministrazione(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session := GetSession(r)
-		if session == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		if session.Ruolo != models.RuoloAmministrazione {
-			http.Error(w, "Accesso non autorizzato. Solo l'amministrazione puo' accedere.", http.StatusForbidden)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// RequireTecnicoOrAmministrazione permette tecnici e amministrazione
-func RequireTecnicoOrAmministrazione(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session := GetSession(r)
-		if session == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		if session.Ruolo != models.RuoloTecnico && session.Ruolo != models.RuoloAmministrazione {
-			http.Error(w, "Accesso non autorizzato.", http.StatusForbidden)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
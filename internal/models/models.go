@@ -23,6 +23,10 @@ type Utente struct {
 	Email         string    `json:"email"`
 	Telefono      string    `json:"telefono"`
 	Ruolo         Ruolo     `json:"ruolo"`
+	RuoloID       int64     `json:"ruolo_id"`
+	RuoloNome     string    `json:"ruolo_nome"`
+	CompagniaID   int64     `json:"compagnia_id"` // Se valorizzato l'utente vede solo le navi di questa compagnia
+	CompagniaNome string    `json:"compagnia_nome"`
 	Attivo        bool      `json:"attivo"`
 	DocumentoPath string    `json:"documento_path"` // Path al documento di identità
 	// Impostazioni SMTP personali
@@ -30,6 +34,7 @@ type Utente struct {
 	SMTPPort      int       `json:"smtp_port"`
 	SMTPUser      string    `json:"smtp_user"`
 	SMTPPassword  string    `json:"-"` // Non esporre in JSON
+	TOTPAttivo    bool      `json:"totp_attivo"` // Autenticazione a due fattori attiva
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
 }
@@ -190,19 +195,22 @@ type Prodotto struct {
 
 // MovimentoMagazzino rappresenta un movimento di carico/scarico
 type MovimentoMagazzino struct {
-	ID          int64     `json:"id"`
-	ProdottoID  int64     `json:"prodotto_id"`
-	TecnicoID   int64     `json:"tecnico_id"`
-	Quantita    float64   `json:"quantita"` // float per supportare metri decimali
-	Tipo        string    `json:"tipo"`     // "carico" o "scarico"
-	Motivo      string    `json:"motivo"`   // es. "Intervento su nave X", "Acquisto", ecc.
-	RapportoID  *int64    `json:"rapporto_id,omitempty"`
-	DDTID       *int64    `json:"ddt_id,omitempty"` // Collegamento al DDT se spedizione
-	CreatedAt   time.Time `json:"created_at"`
+	ID            int64     `json:"id"`
+	ProdottoID    int64     `json:"prodotto_id"`
+	TecnicoID     int64     `json:"tecnico_id"`
+	Quantita      float64   `json:"quantita"` // float per supportare metri decimali
+	Tipo          string    `json:"tipo"`     // "carico" o "scarico"
+	Motivo        string    `json:"motivo"`   // es. "Intervento su nave X", "Acquisto", ecc.
+	RapportoID    *int64    `json:"rapporto_id,omitempty"`
+	DDTID         *int64    `json:"ddt_id,omitempty"` // Collegamento al DDT se spedizione
+	Causale       string    `json:"causale"`          // es. "ddt_uscita", "rettifica" (vedi internal/magazzino)
+	DocumentoTipo string    `json:"documento_tipo,omitempty"`
+	DocumentoID   int64     `json:"documento_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
 	// Campi virtuali
-	NomeProdotto  string  `json:"nome_prodotto,omitempty"`
-	NomeTecnico   string  `json:"nome_tecnico,omitempty"`
-	UnitaMisura   string  `json:"unita_misura,omitempty"`
+	NomeProdotto string `json:"nome_prodotto,omitempty"`
+	NomeTecnico  string `json:"nome_tecnico,omitempty"`
+	UnitaMisura  string `json:"unita_misura,omitempty"`
 }
 
 // TipoDurataPermesso indica la durata del permesso
@@ -422,6 +430,7 @@ type ImpostazioniAzienda struct {
 	SMTPFromName      string    `json:"smtp_from_name"`
 	EmailFoglioTrasferte string    `json:"email_foglio_trasferte"` // Email destinatari foglio trasferte
 	EmailNotaSpese       string    `json:"email_nota_spese"`       // Email destinatari nota spese
+	TOTPObbligatorioTecnici bool   `json:"totp_obbligatorio_tecnici"` // Secondo fattore obbligatorio per i tecnici
 	UpdatedAt         time.Time `json:"updated_at"`
 }
 
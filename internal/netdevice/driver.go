@@ -0,0 +1,156 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrDriverNonTrovato = errors.New("marca apparato non supportata")
+	ErrNonSupportato    = errors.New("operazione non supportata da questo apparato")
+)
+
+// Esecutore esegue comandi su un apparato (implementato da Sessione)
+type Esecutore interface {
+	Esegui(ctx context.Context, comando string) (string, error)
+}
+
+// VoceMAC rappresenta una riga della tabella MAC di uno switch
+type VoceMAC struct {
+	MAC   string
+	VLAN  string
+	Porta string
+}
+
+// VicinoLLDP rappresenta un vicino rilevato via LLDP
+type VicinoLLDP struct {
+	PortaLocale string
+	Nome        string
+	PortaVicino string
+}
+
+// InfoAP rappresenta un access point letto dall'access controller
+type InfoAP struct {
+	Nome    string
+	MAC     string
+	IP      string
+	Modello string
+	Stato   string // stato grezzo riportato dall'AC (nor, fault, idle...)
+}
+
+// Driver raccoglie le operazioni specifiche di una marca di apparati
+type Driver interface {
+	// Marca restituisce il valore del campo marca gestito dal driver
+	Marca() string
+	// ComandoPaginazione restituisce il comando che disabilita la paginazione
+	ComandoPaginazione() string
+	// RigheVolatili restituisce le righe di configurazione che cambiano senza
+	// modifiche reali (timestamp di salvataggio, orologio...), ignorate nei confronti
+	RigheVolatili() []*regexp.Regexp
+
+	Versione(ctx context.Context, e Esecutore) (versione, modello string, err error)
+	Hostname(ctx context.Context, e Esecutore) (string, error)
+	RunningConfig(ctx context.Context, e Esecutore) (string, error)
+	Porte(ctx context.Context, e Esecutore) (totali, libere int, err error)
+	TabellaMAC(ctx context.Context, e Esecutore) ([]VoceMAC, error)
+	VicinatoLLDP(ctx context.Context, e Esecutore) ([]VicinoLLDP, error)
+	AccessPoint(ctx context.Context, e Esecutore) ([]InfoAP, error)
+	Licenze(ctx context.Context, e Esecutore) (totali, utilizzate int, err error)
+
+	// ApplicaConfig invia la configurazione riga per riga in modalita configurazione
+	// (unita a quella corrente) e la salva
+	ApplicaConfig(ctx context.Context, c Configuratore, config string) (string, error)
+	// CaricaConfigTFTP fa scaricare all'apparato il file dal server TFTP indicato
+	// e lo imposta come configurazione di avvio. riavvio indica che l'utente ha
+	// confermato il riavvio, necessario se RiavvioConTFTP e vero.
+	CaricaConfigTFTP(ctx context.Context, c Configuratore, server, file string, riavvio bool) (string, error)
+	// RiavvioConTFTP indica se il caricamento via TFTP riavvia subito l'apparato
+	RiavvioConTFTP() bool
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Registra aggiunge un driver al registro, indicizzato per marca
+func Registra(d Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[strings.ToLower(d.Marca())] = d
+}
+
+// DriverPer restituisce il driver registrato per la marca indicata
+func DriverPer(marca string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[strings.ToLower(strings.TrimSpace(marca))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrDriverNonTrovato, marca)
+	}
+	return d, nil
+}
+
+// Marche restituisce l'elenco ordinato delle marche registrate
+func Marche() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var marche []string
+	for m := range drivers {
+		marche = append(marche, m)
+	}
+	sort.Strings(marche)
+	return marche
+}
+
+// NormalizzaMAC converte un MAC in formato standard (minuscolo, con :)
+func NormalizzaMAC(mac string) string {
+	mac = strings.ReplaceAll(mac, "-", "")
+	mac = strings.ReplaceAll(mac, ":", "")
+	mac = strings.ReplaceAll(mac, ".", "")
+	mac = strings.ToLower(mac)
+
+	if len(mac) == 12 {
+		return fmt.Sprintf("%s:%s:%s:%s:%s:%s",
+			mac[0:2], mac[2:4], mac[4:6], mac[6:8], mac[8:10], mac[10:12])
+	}
+	return mac
+}
+
+// Righe volatili comuni a tutte le marche
+var righeVolatiliComuni = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^\s*ntp[- ]clock-period\b`),
+	regexp.MustCompile(`(?i)^\s*!?\s*current configuration\s*:\s*\d+ bytes`),
+	regexp.MustCompile(`(?i)^\s*!\s*(last configuration change|nvram config last updated)\b`),
+}
+
+// NormalizzaConfig rimuove dalla configurazione le righe volatili della marca
+// e gli spazi finali, per confrontare backup successivi senza falsi cambiamenti
+func NormalizzaConfig(marca, config string) string {
+	regole := righeVolatiliComuni
+	if d, err := DriverPer(marca); err == nil {
+		regole = append(append([]*regexp.Regexp(nil), regole...), d.RigheVolatili()...)
+	}
+
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(config, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		volatile := false
+		for _, re := range regole {
+			if re.MatchString(line) {
+				volatile = true
+				break
+			}
+		}
+		if !volatile {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
@@ -0,0 +1,172 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	reHPErrore = regexp.MustCompile(`(?mi)^\s*(Invalid input|Incomplete input|Error|Unable to)`)
+	// reHPRiavvio e la domanda di "copy tftp startup-config" prima del riavvio
+	reHPRiavvio = regexp.MustCompile(`(?i)reboot`)
+)
+
+// hpDriver gestisce switch HP/Aruba (ProCurve / ArubaOS-Switch)
+type hpDriver struct{}
+
+func init() {
+	Registra(hpDriver{})
+}
+
+func (hpDriver) Marca() string { return "hp" }
+
+func (hpDriver) ComandoPaginazione() string { return "no page" }
+
+// RigheVolatili: la running-config ProCurve non contiene timestamp, bastano le regole comuni
+func (hpDriver) RigheVolatili() []*regexp.Regexp { return nil }
+
+// Versione esegue "show version" ed estrae la versione software
+func (hpDriver) Versione(ctx context.Context, e Esecutore) (string, string, error) {
+	output, err := e.Esegui(ctx, "show version")
+	if err != nil {
+		return "", "", err
+	}
+	var versione string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "Software Version") || strings.HasPrefix(line, "Software revision") {
+			if parts := strings.SplitN(line, ":", 2); len(parts) > 1 {
+				versione = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	return versione, "", nil
+}
+
+// Hostname legge l'hostname dalla running-config
+func (hpDriver) Hostname(ctx context.Context, e Esecutore) (string, error) {
+	output, err := e.Esegui(ctx, "show running-config | include hostname")
+	if err != nil {
+		return "", err
+	}
+	return cercaValore(output, "hostname "), nil
+}
+
+func (hpDriver) RunningConfig(ctx context.Context, e Esecutore) (string, error) {
+	return e.Esegui(ctx, "show running-config")
+}
+
+// Porte conta le porte e quelle libere da "show interface brief"
+func (hpDriver) Porte(ctx context.Context, e Esecutore) (int, int, error) {
+	output, err := e.Esegui(ctx, "show interface brief")
+	if err != nil {
+		return 0, 0, err
+	}
+	var totali, libere int
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// HP usa formato diverso, cerca porte ethernet
+		if strings.Contains(line, "Ethernet") || strings.HasPrefix(line, "1/") || strings.HasPrefix(line, "2/") {
+			totali++
+			lineLower := strings.ToLower(line)
+			if strings.Contains(lineLower, "down") || strings.Contains(lineLower, "disabled") {
+				libere++
+			}
+		}
+	}
+	return totali, libere, nil
+}
+
+// TabellaMAC parsa l'output di "show mac-address"
+func (hpDriver) TabellaMAC(ctx context.Context, e Esecutore) ([]VoceMAC, error) {
+	output, err := e.Esegui(ctx, "show mac-address")
+	if err != nil {
+		return nil, err
+	}
+	var voci []VoceMAC
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, "MAC Address") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 3 {
+			voci = append(voci, VoceMAC{MAC: NormalizzaMAC(fields[0]), VLAN: fields[1], Porta: fields[2]})
+		}
+	}
+	return voci, nil
+}
+
+func (hpDriver) VicinatoLLDP(ctx context.Context, e Esecutore) ([]VicinoLLDP, error) {
+	return nil, ErrNonSupportato
+}
+
+func (hpDriver) AccessPoint(ctx context.Context, e Esecutore) ([]InfoAP, error) {
+	return nil, ErrNonSupportato
+}
+
+func (hpDriver) Licenze(ctx context.Context, e Esecutore) (int, int, error) {
+	return 0, 0, ErrNonSupportato
+}
+
+// ApplicaConfig invia la configurazione da "configure terminal" e la salva con "write memory"
+func (hpDriver) ApplicaConfig(ctx context.Context, c Configuratore, config string) (string, error) {
+	var righe []string
+	for _, riga := range strings.Split(EstraiConfig(config), "\n") {
+		comando := strings.TrimSpace(riga)
+		// Commenti e intestazione di "show running-config"
+		if comando == "" || strings.HasPrefix(comando, ";") || comando == "Running configuration:" {
+			continue
+		}
+		righe = append(righe, strings.TrimRight(riga, " \t"))
+	}
+
+	if _, err := c.EseguiConfigurazione(ctx, "configure terminal"); err != nil {
+		return "", err
+	}
+	output, errIncolla := incolla(ctx, c, righe, "exit", reHPErrore)
+	if errIncolla != nil && !errors.Is(errIncolla, ErrConfigParziale) {
+		return output, errIncolla
+	}
+
+	if _, err := c.EseguiConfigurazione(ctx, "end"); err != nil {
+		return output, err
+	}
+	salvataggio, err := c.EseguiConfigurazione(ctx, "write memory")
+	output += "write memory\n" + salvataggio + "\n"
+	if err != nil {
+		return output, err
+	}
+	if reHPErrore.MatchString(salvataggio) {
+		return output, fmt.Errorf("salvataggio configurazione fallito")
+	}
+	return output, errIncolla
+}
+
+// CaricaConfigTFTP copia il file nella startup-config: lo switch chiede conferma, si
+// riavvia subito e chiude la sessione, che in questo caso indica il successo. Senza il
+// riavvio confermato dall'utente il comando non viene inviato.
+func (hpDriver) CaricaConfigTFTP(ctx context.Context, c Configuratore, server, file string, riavvio bool) (string, error) {
+	if !riavvio {
+		return "", ErrRiavvioNonConfermato
+	}
+	output, err := c.EseguiConfigurazione(ctx, fmt.Sprintf("copy tftp startup-config %s %s", server, file), reHPRiavvio)
+	if errors.Is(err, ErrConnessioneChiusa) {
+		return output + "\nRiavvio dello switch in corso", nil
+	}
+	if err != nil {
+		return output, err
+	}
+	// Una domanda diversa da quella del riavvio e stata rifiutata: la copia non e avvenuta
+	if reHPErrore.MatchString(output) || (reDomanda.MatchString(output) && !reHPRiavvio.MatchString(output)) {
+		return output, fmt.Errorf("copia TFTP fallita")
+	}
+	return output, nil
+}
+
+func (hpDriver) RiavvioConTFTP() bool {
+	return true
+}
@@ -0,0 +1,322 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// huaweiDriver gestisce switch e access controller Huawei (VRP)
+type huaweiDriver struct{}
+
+func init() {
+	Registra(huaweiDriver{})
+}
+
+var (
+	reHuaweiAP          = regexp.MustCompile(`^(\d+)\s+([0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4})\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+`)
+	reHuaweiMAC         = regexp.MustCompile(`^([0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4})\s+(\S+)\s+((?:GE|XGE|Eth)[0-9/]+)\s+(\S+)`)
+	reHuaweiVersione    = regexp.MustCompile(`\(([A-Z0-9]+)\s+([A-Z0-9]+)\)`)
+	reHuaweiModello     = regexp.MustCompile(`HUAWEI\s+([A-Z0-9-]+)`)
+	reHuaweiModelloAC   = regexp.MustCompile(`Huawei\s+(\S+)`)
+	reHuaweiVersioneVRP = regexp.MustCompile(`Version\s+(\S+)`)
+
+	reHuaweiErrore   = regexp.MustCompile(`(?m)^\s*Error:`)
+	reHuaweiVolatili = []*regexp.Regexp{
+		regexp.MustCompile(`^!Last configuration was (updated|saved) at`),
+		regexp.MustCompile(`^!Time:`),
+		// Informazioni ultimo accesso del banner di login (presenti nei backup meno recenti)
+		regexp.MustCompile(`^\s*(Access Type|IP-Address)\s*:`),
+		regexp.MustCompile(`^\s*Time\s*:\s*\d{4}-\d{2}-\d{2}`),
+	}
+
+	// reHuaweiSalva riconosce le domande di "save" (scrittura e sovrascrittura del file)
+	reHuaweiSalva = regexp.MustCompile(`(?i)(configuration will be written|overwrite)`)
+	// reHuaweiSovrascrivi e la domanda del download TFTP se il file esiste gia in flash
+	reHuaweiSovrascrivi = regexp.MustCompile(`(?i)overwrite`)
+)
+
+func (huaweiDriver) Marca() string { return "huawei" }
+
+func (huaweiDriver) ComandoPaginazione() string { return "screen-length 0 temporary" }
+
+func (huaweiDriver) RigheVolatili() []*regexp.Regexp { return reHuaweiVolatili }
+
+// Versione esegue "display version" ed estrae versione e modello
+func (huaweiDriver) Versione(ctx context.Context, e Esecutore) (string, string, error) {
+	output, err := e.Esegui(ctx, "display version")
+	if err != nil {
+		return "", "", err
+	}
+	versione, modello := parseHuaweiVersione(output)
+	return versione, modello, nil
+}
+
+// Hostname legge il sysname dalla configurazione corrente
+func (huaweiDriver) Hostname(ctx context.Context, e Esecutore) (string, error) {
+	output, err := e.Esegui(ctx, "display current-configuration | include sysname")
+	if err != nil {
+		return "", err
+	}
+	return cercaValore(output, "sysname "), nil
+}
+
+func (huaweiDriver) RunningConfig(ctx context.Context, e Esecutore) (string, error) {
+	return e.Esegui(ctx, "display current-configuration")
+}
+
+// Porte conta le porte fisiche e quelle libere da "display interface brief"
+func (huaweiDriver) Porte(ctx context.Context, e Esecutore) (int, int, error) {
+	output, err := e.Esegui(ctx, "display interface brief")
+	if err != nil {
+		return 0, 0, err
+	}
+	totali, libere := parseHuaweiPorte(output)
+	return totali, libere, nil
+}
+
+func (huaweiDriver) TabellaMAC(ctx context.Context, e Esecutore) ([]VoceMAC, error) {
+	output, err := e.Esegui(ctx, "display mac-address")
+	if err != nil {
+		return nil, err
+	}
+	return parseHuaweiMAC(output), nil
+}
+
+func (huaweiDriver) VicinatoLLDP(ctx context.Context, e Esecutore) ([]VicinoLLDP, error) {
+	output, err := e.Esegui(ctx, "display lldp neighbor brief")
+	if err != nil {
+		return nil, err
+	}
+	return parseHuaweiLLDP(output), nil
+}
+
+func (huaweiDriver) AccessPoint(ctx context.Context, e Esecutore) ([]InfoAP, error) {
+	output, err := e.Esegui(ctx, "display ap all")
+	if err != nil {
+		return nil, err
+	}
+	return parseHuaweiAP(output), nil
+}
+
+func (huaweiDriver) Licenze(ctx context.Context, e Esecutore) (int, int, error) {
+	output, err := e.Esegui(ctx, "display license resource usage")
+	if err != nil {
+		return 0, 0, err
+	}
+	totali, utilizzate := parseHuaweiLicenze(output)
+	return totali, utilizzate, nil
+}
+
+// ApplicaConfig entra in system-view, invia la configurazione seguendo le viste e la salva
+func (huaweiDriver) ApplicaConfig(ctx context.Context, c Configuratore, config string) (string, error) {
+	var righe []string
+	for _, riga := range strings.Split(EstraiConfig(config), "\n") {
+		comando := strings.TrimSpace(riga)
+		// Separatori, commenti e "return" (riporterebbe alla vista utente)
+		if comando == "" || comando == "#" || comando == "return" || strings.HasPrefix(comando, "!") {
+			continue
+		}
+		righe = append(righe, strings.TrimRight(riga, " \t"))
+	}
+
+	if _, err := c.EseguiConfigurazione(ctx, "system-view"); err != nil {
+		return "", err
+	}
+	output, errIncolla := incolla(ctx, c, righe, "quit", reHuaweiErrore)
+	if errIncolla != nil && !errors.Is(errIncolla, ErrConfigParziale) {
+		return output, errIncolla
+	}
+
+	if _, err := c.EseguiConfigurazione(ctx, "return"); err != nil {
+		return output, err
+	}
+	salvataggio, err := c.EseguiConfigurazione(ctx, "save", reHuaweiSalva)
+	output += "save\n" + salvataggio + "\n"
+	if err != nil {
+		return output, err
+	}
+	if reHuaweiErrore.MatchString(salvataggio) {
+		return output, fmt.Errorf("salvataggio configurazione fallito")
+	}
+	return output, errIncolla
+}
+
+// CaricaConfigTFTP scarica il file in flash e lo imposta come configurazione di avvio
+// (applicata al prossimo riavvio, che resta a carico dell'utente)
+func (huaweiDriver) CaricaConfigTFTP(ctx context.Context, c Configuratore, server, file string, riavvio bool) (string, error) {
+	output, err := c.EseguiConfigurazione(ctx, fmt.Sprintf("tftp %s get %s", server, file), reHuaweiSovrascrivi)
+	if err != nil {
+		return output, err
+	}
+	if reHuaweiErrore.MatchString(output) {
+		return output, fmt.Errorf("download TFTP fallito")
+	}
+
+	avvio, err := c.EseguiConfigurazione(ctx, "startup saved-configuration "+file)
+	output += "\n" + avvio
+	if err != nil {
+		return output, err
+	}
+	if reHuaweiErrore.MatchString(avvio) {
+		return output, fmt.Errorf("impostazione configurazione di avvio fallita")
+	}
+	return output, nil
+}
+
+func (huaweiDriver) RiavvioConTFTP() bool {
+	return false
+}
+
+// ============================================
+// PARSER OUTPUT HUAWEI
+// ============================================
+
+// parseHuaweiVersione estrae versione e modello da switch e AC Huawei
+func parseHuaweiVersione(output string) (versione, modello string) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// VRP (R) software, Version 5.170 (S5735 V200R021C00SPC100)
+		if strings.Contains(line, "VRP") && strings.Contains(line, "Version") && !strings.HasPrefix(line, "Software") {
+			if m := reHuaweiVersione.FindStringSubmatch(line); len(m) > 2 {
+				versione = m[2]
+			} else if m := reHuaweiVersioneVRP.FindStringSubmatch(line); len(m) > 1 {
+				versione = m[1]
+			}
+		}
+		// Switch: HUAWEI S5735-L24P4S-A1 Routing Switch
+		if strings.Contains(line, "HUAWEI") && strings.Contains(line, "Switch") {
+			if m := reHuaweiModello.FindStringSubmatch(line); len(m) > 1 {
+				modello = m[1]
+			}
+		}
+		// AC: Huawei AC6508 Wireless Access Controller
+		if modello == "" && strings.Contains(line, "Huawei") && (strings.Contains(line, "AC") || strings.Contains(line, "Controller")) {
+			if m := reHuaweiModelloAC.FindStringSubmatch(line); len(m) > 1 {
+				modello = m[1]
+			}
+		}
+	}
+	return versione, modello
+}
+
+// parseHuaweiPorte analizza output di display interface brief
+func parseHuaweiPorte(output string) (totali, libere int) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// Cerca righe che iniziano con GigabitEthernet, 10GigabitEthernet, GE, XGE, MultiGE, 25GE
+		if strings.HasPrefix(line, "GigabitEthernet") || strings.HasPrefix(line, "10GigabitEthernet") ||
+			strings.HasPrefix(line, "GE") || strings.HasPrefix(line, "XGE") || strings.HasPrefix(line, "Eth") ||
+			strings.HasPrefix(line, "MultiGE") || strings.HasPrefix(line, "25GE") || strings.HasPrefix(line, "40GE") ||
+			strings.HasPrefix(line, "100GE") {
+			totali++
+			// Porta libera se stato e down o *down
+			lineLower := strings.ToLower(line)
+			if strings.Contains(lineLower, "down") && !strings.Contains(lineLower, "up") {
+				libere++
+			}
+		}
+	}
+	return totali, libere
+}
+
+// parseHuaweiAP parsa l'output di "display ap all"
+func parseHuaweiAP(output string) []InfoAP {
+	var aps []InfoAP
+	// Formato reale output Huawei:
+	// ID    MAC            Name           Group   IP           Type             State  STA  Uptime...
+	// 0     484c-2911-cb30 AP-02          default 10.101.3.102 AirEngine5761-11 nor    2    20D:6H...
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "ID") || strings.HasPrefix(line, "-") ||
+			strings.HasPrefix(line, "Total") || strings.Contains(line, "idle  :") ||
+			strings.Contains(line, "nor   :") || strings.Contains(line, "ExtraInfo") {
+			continue
+		}
+
+		m := reHuaweiAP.FindStringSubmatch(line)
+		if len(m) < 8 {
+			continue
+		}
+		ip := m[5]
+		if ip == "-" {
+			ip = ""
+		}
+		aps = append(aps, InfoAP{
+			Nome:    m[3],
+			MAC:     NormalizzaMAC(m[2]),
+			IP:      ip,
+			Modello: m[6],
+			Stato:   m[7],
+		})
+	}
+	return aps
+}
+
+// parseHuaweiMAC parsa l'output di "display mac-address"
+func parseHuaweiMAC(output string) []VoceMAC {
+	var voci []VoceMAC
+	// MAC            VLAN/VSI/BD   Port        Type
+	// 0001-2e7a-df1e 1/-/-         GE0/0/9     dynamic
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, "MAC") || strings.HasPrefix(line, "-") ||
+			strings.HasPrefix(line, "Total") || strings.Contains(line, "Info:") {
+			continue
+		}
+		if m := reHuaweiMAC.FindStringSubmatch(line); len(m) >= 5 {
+			voci = append(voci, VoceMAC{MAC: NormalizzaMAC(m[1]), VLAN: m[2], Porta: m[3]})
+		}
+	}
+	return voci
+}
+
+// parseHuaweiLLDP parsa l'output di "display lldp neighbor brief"
+func parseHuaweiLLDP(output string) []VicinoLLDP {
+	var vicini []VicinoLLDP
+	// Local Intf       Neighbor Dev             Neighbor Intf             Exptime(s)
+	// GE0/0/17         AP-06                    GE0/0/0                   118
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Local") || strings.Contains(line, "Info:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 3 {
+			vicini = append(vicini, VicinoLLDP{PortaLocale: fields[0], Nome: fields[1], PortaVicino: fields[2]})
+		}
+	}
+	return vicini
+}
+
+// parseHuaweiLicenze estrae licenze totali e utilizzate (pattern X/Y sulle righe AP)
+func parseHuaweiLicenze(output string) (totali, utilizzate int) {
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, "/") || !(strings.Contains(line, "LICAC") || strings.Contains(line, "SSAP") || strings.Contains(line, "AP")) {
+			continue
+		}
+		for _, part := range strings.Fields(line) {
+			if !strings.Contains(part, "/") {
+				continue
+			}
+			var u, t int
+			if _, err := fmt.Sscanf(part, "%d/%d", &u, &t); err == nil && t > 0 {
+				return t, u
+			}
+		}
+	}
+	return 0, 0
+}
+
+// cercaValore restituisce il valore della prima riga che inizia con il prefisso indicato
+func cercaValore(output, prefisso string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(strings.ToLower(line), prefisso) {
+			return strings.Trim(strings.TrimSpace(line[len(prefisso):]), `"`)
+		}
+	}
+	return ""
+}
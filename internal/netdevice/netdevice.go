@@ -0,0 +1,371 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAutenticazione       = errors.New("autenticazione fallita")
+	ErrConnessioneRifiutata = errors.New("connessione rifiutata")
+	ErrTimeout              = errors.New("timeout")
+	ErrConnessioneChiusa    = errors.New("connessione chiusa dall'apparato")
+)
+
+const (
+	timeoutConnessioneDefault = 30 * time.Second
+	timeoutComandoDefault     = 180 * time.Second
+)
+
+// Config contiene i parametri di connessione a un apparato di rete
+type Config struct {
+	IP         string
+	Porta      int
+	Username   string
+	Password   string
+	Protocollo string // ssh o telnet
+	Marca      string // huawei, hp, ...
+
+	// ComandoPaginazione sovrascrive il comando per disabilitare la paginazione
+	// (vuoto = dedotto dalla marca, "-" = nessun comando)
+	ComandoPaginazione string
+
+	TimeoutConnessione time.Duration
+	TimeoutComando     time.Duration
+}
+
+// Sessione rappresenta una shell interattiva aperta su un apparato
+type Sessione struct {
+	cfg    Config
+	w      io.Writer
+	chiudi func() error
+	acapo  string
+
+	dati    chan []byte
+	fine    chan struct{}
+	errLett error
+	buf     []byte
+	prompt  string
+}
+
+var (
+	reANSI        = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	reCancella    = regexp.MustCompile(`\x1b\[\d+D\s*\x1b\[\d+D`)
+	rePrompt      = regexp.MustCompile(`^(<[^<>\s][^<>]*>|\[[^\[\]\s][^\[\]]*\]|[A-Za-z0-9][\w.\-()/:@]*[>#])$`)
+	reMore        = regexp.MustCompile(`(?i)-+\s*more\s*-+`)
+	reConferma    = regexp.MustCompile(`(?i)\[y/n\]\s*[:?]?$`)
+	reDomanda     = regexp.MustCompile(`(?i)\[y/n\]`)
+	reNomeFile    = regexp.MustCompile(`(?i)file\s*name.*:$`)
+	reTasto       = regexp.MustCompile(`(?i)press any key to continue`)
+	reUsername    = regexp.MustCompile(`(?i)(username|login)\s*:$`)
+	rePassword    = regexp.MustCompile(`(?i)password\s*:$`)
+	reAuthFallita = regexp.MustCompile(`(?i)(login incorrect|authentication fail|access denied|permission denied|invalid password)`)
+)
+
+// Connetti apre una sessione sull'apparato, esegue il login e disabilita la paginazione
+func Connetti(ctx context.Context, cfg Config) (*Sessione, error) {
+	if cfg.TimeoutConnessione == 0 {
+		cfg.TimeoutConnessione = timeoutConnessioneDefault
+	}
+	if cfg.TimeoutComando == 0 {
+		cfg.TimeoutComando = timeoutComandoDefault
+	}
+
+	ctxLogin, cancel := context.WithTimeout(ctx, cfg.TimeoutConnessione)
+	defer cancel()
+
+	var s *Sessione
+	var err error
+	if strings.ToLower(cfg.Protocollo) == "telnet" {
+		s, err = apriTelnet(ctxLogin, cfg)
+	} else {
+		s, err = apriSSH(ctxLogin, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.accedi(ctxLogin); err != nil {
+		s.Chiudi()
+		return nil, err
+	}
+
+	if paginazione := comandoPaginazione(cfg); paginazione != "" {
+		if _, err := s.Esegui(ctx, paginazione); err != nil {
+			s.Chiudi()
+			return nil, fmt.Errorf("errore disabilitazione paginazione: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// EseguiComando apre una sessione, esegue un singolo comando e chiude la connessione
+func EseguiComando(ctx context.Context, cfg Config, comando string) (string, error) {
+	s, err := Connetti(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer s.Chiudi()
+
+	return s.Esegui(ctx, comando)
+}
+
+// Prompt restituisce il prompt rilevato dopo il login
+func (s *Sessione) Prompt() string {
+	return s.prompt
+}
+
+// Esegui invia un comando e attende il ritorno del prompt, gestendo paginazione e conferme
+func (s *Sessione) Esegui(ctx context.Context, comando string) (string, error) {
+	return s.esegui(ctx, comando, false, nil)
+}
+
+// EseguiConfigurazione invia un comando che puo cambiare vista (system-view, interface...):
+// accetta qualsiasi prompt, che diventa quello della sessione. Alle richieste [Y/N] risponde
+// Y solo se il testo della domanda corrisponde a una delle conferme attese, altrimenti N.
+func (s *Sessione) EseguiConfigurazione(ctx context.Context, comando string, conferme ...*regexp.Regexp) (string, error) {
+	return s.esegui(ctx, comando, true, conferme)
+}
+
+// esegui invia il comando e legge l'output fino al prompt
+func (s *Sessione) esegui(ctx context.Context, comando string, configurazione bool, conferme []*regexp.Regexp) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.TimeoutComando)
+	defer cancel()
+
+	// Scarta eventuali residui del comando precedente
+	s.buf = nil
+	if err := s.invia(comando); err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	for {
+		if err := s.leggi(ctx); err != nil {
+			out.Write(s.buf)
+			return pulisciOutput(out.String(), comando, s.prompt), err
+		}
+
+		ultima := ultimaRiga(s.buf)
+		switch {
+		case reMore.MatchString(ultima):
+			// Tronca il marcatore di paginazione e chiedi la pagina successiva
+			idx := strings.LastIndex(string(s.buf), "\n") + 1
+			out.Write(s.buf[:idx])
+			s.buf = nil
+			if _, err := io.WriteString(s.w, " "); err != nil {
+				return pulisciOutput(out.String(), comando, s.prompt), err
+			}
+		case reConferma.MatchString(ultima):
+			// Si accettano solo le domande attese dal comando: le altre vengono rifiutate
+			risposta := "N"
+			for _, re := range conferme {
+				if re.Match(s.buf) {
+					risposta = "Y"
+					break
+				}
+			}
+			out.Write(s.buf)
+			s.buf = nil
+			if err := s.invia(risposta); err != nil {
+				return pulisciOutput(out.String(), comando, s.prompt), err
+			}
+		case configurazione && reNomeFile.MatchString(ultima):
+			// Nome file proposto dal comando save: accetta il predefinito
+			out.Write(s.buf)
+			s.buf = nil
+			if err := s.invia(""); err != nil {
+				return pulisciOutput(out.String(), comando, s.prompt), err
+			}
+		case s.eUnPrompt(ultima) || (configurazione && rePrompt.MatchString(ultima)):
+			idx := strings.LastIndex(string(s.buf), "\n") + 1
+			out.Write(s.buf[:idx])
+			s.buf = nil
+			s.prompt = ultima
+			return pulisciOutput(out.String(), comando, s.prompt), nil
+		}
+	}
+}
+
+// Chiudi termina la sessione
+func (s *Sessione) Chiudi() error {
+	if s.chiudi == nil {
+		return nil
+	}
+	err := s.chiudi()
+	s.chiudi = nil
+	if s.fine != nil {
+		close(s.fine)
+	}
+	return err
+}
+
+// ============================================
+// FUNZIONI INTERNE
+// ============================================
+
+// avviaLettura legge in background dal trasporto e inoltra i dati sul canale
+func (s *Sessione) avviaLettura(r io.Reader) {
+	s.dati = make(chan []byte, 64)
+	s.fine = make(chan struct{})
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := r.Read(b)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, b[:n])
+				select {
+				case s.dati <- chunk:
+				case <-s.fine:
+					return
+				}
+			}
+			if err != nil {
+				s.errLett = err
+				close(s.dati)
+				return
+			}
+		}
+	}()
+}
+
+// leggi attende nuovi dati dall'apparato e li accoda al buffer
+func (s *Sessione) leggi(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%w: nessuna risposta da %s", ErrTimeout, s.cfg.IP)
+	case chunk, ok := <-s.dati:
+		if !ok {
+			if s.errLett != nil && s.errLett != io.EOF {
+				return fmt.Errorf("%w: %v", ErrConnessioneChiusa, s.errLett)
+			}
+			return ErrConnessioneChiusa
+		}
+		s.buf = append(s.buf, chunk...)
+		return nil
+	}
+}
+
+// invia scrive una riga verso l'apparato
+func (s *Sessione) invia(testo string) error {
+	_, err := io.WriteString(s.w, testo+s.acapo)
+	return err
+}
+
+// accedi gestisce username/password (telnet) e attende il primo prompt
+func (s *Sessione) accedi(ctx context.Context) error {
+	passwordInviata := false
+	for {
+		if err := s.leggi(ctx); err != nil {
+			if passwordInviata && errors.Is(err, ErrConnessioneChiusa) {
+				return ErrAutenticazione
+			}
+			return err
+		}
+
+		ultima := ultimaRiga(s.buf)
+		switch {
+		case passwordInviata && reAuthFallita.Match(s.buf):
+			return ErrAutenticazione
+		case reUsername.MatchString(ultima):
+			if passwordInviata {
+				return ErrAutenticazione
+			}
+			s.buf = nil
+			if err := s.invia(s.cfg.Username); err != nil {
+				return err
+			}
+		case rePassword.MatchString(ultima):
+			if passwordInviata {
+				return ErrAutenticazione
+			}
+			passwordInviata = true
+			s.buf = nil
+			if err := s.invia(s.cfg.Password); err != nil {
+				return err
+			}
+		case reConferma.MatchString(ultima):
+			// Es. richiesta cambio password al primo accesso
+			s.buf = nil
+			if err := s.invia("N"); err != nil {
+				return err
+			}
+		case reTasto.MatchString(ultima):
+			s.buf = nil
+			if err := s.invia(""); err != nil {
+				return err
+			}
+		case rePrompt.MatchString(ultima):
+			s.prompt = ultima
+			s.buf = nil
+			return nil
+		}
+	}
+}
+
+// eUnPrompt verifica se la riga corrisponde al prompt della sessione
+func (s *Sessione) eUnPrompt(riga string) bool {
+	if s.prompt != "" {
+		return riga == s.prompt
+	}
+	return rePrompt.MatchString(riga)
+}
+
+// comandoPaginazione restituisce il comando per disabilitare la paginazione
+func comandoPaginazione(cfg Config) string {
+	if cfg.ComandoPaginazione == "-" {
+		return ""
+	}
+	if cfg.ComandoPaginazione != "" {
+		return cfg.ComandoPaginazione
+	}
+	if d, err := DriverPer(cfg.Marca); err == nil {
+		return d.ComandoPaginazione()
+	}
+	// Marca non indicata (es. AC): comportamento Huawei
+	return "screen-length 0 temporary"
+}
+
+// ultimaRiga restituisce l'ultima riga del buffer ripulita da escape e spazi
+func ultimaRiga(buf []byte) string {
+	testo := string(buf)
+	if idx := strings.LastIndexAny(testo, "\r\n"); idx >= 0 {
+		// Se il buffer termina con un a capo la riga corrente e vuota
+		testo = testo[idx+1:]
+	}
+	testo = reANSI.ReplaceAllString(testo, "")
+	return strings.TrimSpace(testo)
+}
+
+// pulisciOutput rimuove eco del comando, sequenze di escape e residui di paginazione
+func pulisciOutput(output, comando, prompt string) string {
+	// Huawei cancella il marcatore "---- More ----" con spazi tra due escape
+	output = reCancella.ReplaceAllString(output, "")
+	output = reANSI.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, "\b", "")
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+
+	righe := strings.Split(output, "\n")
+	var pulite []string
+	for i, riga := range righe {
+		// Un \r isolato riporta il cursore a inizio riga: conta solo l'ultimo segmento
+		if idx := strings.LastIndex(riga, "\r"); idx >= 0 {
+			riga = riga[idx+1:]
+		}
+		riga = strings.TrimRight(riga, " \t")
+		if i == 0 && strings.HasSuffix(strings.TrimSpace(riga), comando) {
+			continue
+		}
+		if prompt != "" && strings.TrimSpace(riga) == prompt {
+			continue
+		}
+		pulite = append(pulite, riga)
+	}
+	return strings.Join(pulite, "\n")
+}
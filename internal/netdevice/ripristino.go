@@ -0,0 +1,119 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrConfigParziale indica che l'apparato ha rifiutato alcune righe della configurazione
+	ErrConfigParziale = errors.New("alcune righe di configurazione sono state rifiutate")
+	// ErrRiavvioNonConfermato indica un caricamento che riavvierebbe l'apparato senza
+	// che l'utente abbia confermato il riavvio
+	ErrRiavvioNonConfermato = errors.New("il caricamento riavvia l'apparato: serve la conferma del riavvio")
+)
+
+// Configuratore e un Esecutore che puo inviare comandi in modalita configurazione
+type Configuratore interface {
+	Esecutore
+	EseguiConfigurazione(ctx context.Context, comando string, conferme ...*regexp.Regexp) (string, error)
+}
+
+// reInizioConfig riconosce la prima riga di una configurazione (Huawei "#"/"!", HP ";")
+var reInizioConfig = regexp.MustCompile(`^(#|!|;|Running configuration:|Current configuration)`)
+
+// EstraiConfig rimuove da un backup cio che non fa parte della configurazione:
+// banner di login ed eco del comando iniziali, prompt e righe vuote finali
+func EstraiConfig(testo string) string {
+	righe := strings.Split(strings.ReplaceAll(testo, "\r\n", "\n"), "\n")
+
+	inizio := 0
+	for i, riga := range righe {
+		if reInizioConfig.MatchString(strings.TrimSpace(riga)) {
+			inizio = i
+			break
+		}
+	}
+	fine := len(righe)
+	for fine > inizio {
+		ultima := strings.TrimSpace(righe[fine-1])
+		if ultima != "" && !rePrompt.MatchString(ultima) {
+			break
+		}
+		fine--
+	}
+	return strings.Join(righe[inizio:fine], "\n") + "\n"
+}
+
+// rientro restituisce il numero di spazi iniziali della riga
+func rientro(riga string) int {
+	return len(riga) - len(strings.TrimLeft(riga, " "))
+}
+
+// incolla invia le righe in modalita configurazione seguendo l'annidamento delle viste
+// indicato dall'indentazione: quando il rientro diminuisce esce dalla vista con il comando esci.
+// Le righe rifiutate (reErrore) non interrompono l'invio ma vengono riportate nell'errore,
+// come quelle che chiedono una conferma [Y/N]: la richiesta viene rifiutata.
+func incolla(ctx context.Context, c Configuratore, righe []string, esci string, reErrore *regexp.Regexp) (string, error) {
+	var log strings.Builder
+	var rifiutate []string
+	var viste []int
+
+	invia := func(comando string) error {
+		output, err := c.EseguiConfigurazione(ctx, comando)
+		fmt.Fprintf(&log, "%s\n", comando)
+		if strings.TrimSpace(output) != "" {
+			fmt.Fprintf(&log, "%s\n", output)
+		}
+		if err != nil {
+			return err
+		}
+		if reErrore.MatchString(output) || reDomanda.MatchString(output) {
+			rifiutate = append(rifiutate, comando)
+		}
+		return nil
+	}
+
+	for i, riga := range righe {
+		comando := strings.TrimSpace(riga)
+		livello := rientro(riga)
+
+		// "exit" esplicito nella configurazione (HP): chiude la vista corrente
+		if comando == esci {
+			if len(viste) > 0 {
+				viste = viste[:len(viste)-1]
+				if err := invia(esci); err != nil {
+					return log.String(), err
+				}
+			}
+			continue
+		}
+
+		for len(viste) > 0 && viste[len(viste)-1] >= livello {
+			viste = viste[:len(viste)-1]
+			if err := invia(esci); err != nil {
+				return log.String(), err
+			}
+		}
+		if err := invia(comando); err != nil {
+			return log.String(), err
+		}
+		// Le righe successive piu rientrate appartengono alla vista aperta da questo comando
+		if i+1 < len(righe) && rientro(righe[i+1]) > livello {
+			viste = append(viste, livello)
+		}
+	}
+	for range viste {
+		if err := invia(esci); err != nil {
+			return log.String(), err
+		}
+	}
+
+	if len(rifiutate) > 0 {
+		return log.String(), fmt.Errorf("%w (%d): %s", ErrConfigParziale, len(rifiutate), strings.Join(rifiutate, "; "))
+	}
+	return log.String(), nil
+}
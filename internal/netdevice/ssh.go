@@ -0,0 +1,142 @@
+package netdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// configSSH restituisce la configurazione client con gli algoritmi legacy
+// ancora usati da AC e switch Huawei/HP (equivalente a KexAlgorithms=+... e HostKeyAlgorithms=+ssh-rsa)
+func configSSH(cfg Config) *ssh.ClientConfig {
+	supportati := ssh.SupportedAlgorithms()
+	legacy := ssh.InsecureAlgorithms()
+
+	password := cfg.Password
+	return &ssh.ClientConfig{
+		User: cfg.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				risposte := make([]string, len(questions))
+				for i := range questions {
+					risposte[i] = password
+				}
+				return risposte, nil
+			}),
+		},
+		Config: ssh.Config{
+			KeyExchanges: append(supportati.KeyExchanges, legacy.KeyExchanges...),
+			Ciphers:      append(supportati.Ciphers, legacy.Ciphers...),
+			MACs:         append(supportati.MACs, legacy.MACs...),
+		},
+		HostKeyAlgorithms: append(supportati.HostKeys, legacy.HostKeys...),
+		// Gli apparati di bordo vengono sostituiti spesso: nessuna verifica della chiave host
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         cfg.TimeoutConnessione,
+	}
+}
+
+// apriSSH stabilisce la connessione SSH e apre una shell interattiva con PTY
+func apriSSH(ctx context.Context, cfg Config) (*Sessione, error) {
+	porta := cfg.Porta
+	if porta == 0 {
+		porta = 22
+	}
+	indirizzo := net.JoinHostPort(cfg.IP, strconv.Itoa(porta))
+
+	conn, err := dial(ctx, indirizzo)
+	if err != nil {
+		return nil, err
+	}
+
+	// L'handshake SSH non accetta un context: usa la deadline sulla connessione
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, indirizzo, configSSH(cfg))
+	if err != nil {
+		conn.Close()
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, ErrAutenticazione
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, fmt.Errorf("%w: handshake SSH con %s", ErrTimeout, indirizzo)
+		}
+		return nil, fmt.Errorf("errore handshake SSH: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("errore apertura sessione SSH: %w", err)
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	// Terminale largo per evitare il wrap delle righe di configurazione
+	if err := session.RequestPty("vt100", 24, 512, modes); err != nil {
+		session.Close()
+		client.Close()
+		return nil, fmt.Errorf("errore richiesta PTY: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+
+	if err := session.Shell(); err != nil {
+		session.Close()
+		client.Close()
+		return nil, fmt.Errorf("errore avvio shell SSH: %w", err)
+	}
+
+	s := &Sessione{
+		cfg:   cfg,
+		w:     stdin,
+		acapo: "\r",
+		chiudi: func() error {
+			session.Close()
+			return client.Close()
+		},
+	}
+	s.avviaLettura(stdout)
+	return s, nil
+}
+
+// dial apre la connessione TCP classificando gli errori piu comuni
+func dial(ctx context.Context, indirizzo string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", indirizzo)
+	if err == nil {
+		return conn, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, fmt.Errorf("%w: %s", ErrConnessioneRifiutata, indirizzo)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %s non raggiungibile", ErrTimeout, indirizzo)
+	}
+	return nil, fmt.Errorf("errore connessione a %s: %w", indirizzo, err)
+}
@@ -0,0 +1,137 @@
+package netdevice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+)
+
+// Comandi e opzioni Telnet (RFC 854/857/858)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho = 1
+	telnetOptSGA  = 3
+)
+
+// telnetConn filtra le negoziazioni IAC e restituisce solo i dati del terminale
+type telnetConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// apriTelnet stabilisce la connessione Telnet verso l'apparato
+func apriTelnet(ctx context.Context, cfg Config) (*Sessione, error) {
+	porta := cfg.Porta
+	if porta == 0 || porta == 22 {
+		porta = 23
+	}
+
+	conn, err := dial(ctx, net.JoinHostPort(cfg.IP, strconv.Itoa(porta)))
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &telnetConn{Conn: conn, r: bufio.NewReader(conn)}
+	s := &Sessione{
+		cfg:    cfg,
+		w:      tc,
+		acapo:  "\r\n",
+		chiudi: conn.Close,
+	}
+	s.avviaLettura(tc)
+	return s, nil
+}
+
+// Read restituisce i byte di dati saltando le sequenze di negoziazione
+func (t *telnetConn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && t.r.Buffered() == 0 {
+			break
+		}
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+		literal, err := t.negozia()
+		if err != nil {
+			return n, err
+		}
+		if literal {
+			p[n] = telnetIAC
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Write effettua l'escape del byte IAC nei dati in uscita
+func (t *telnetConn) Write(p []byte) (int, error) {
+	if _, err := t.Conn.Write(bytes.ReplaceAll(p, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// negozia gestisce un comando IAC: accetta ECHO e SGA dal server, rifiuta il resto
+func (t *telnetConn) negozia() (literal bool, err error) {
+	cmd, err := t.r.ReadByte()
+	if err != nil {
+		return false, err
+	}
+
+	switch cmd {
+	case telnetIAC:
+		return true, nil
+	case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+		opt, err := t.r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		var risposta byte
+		switch cmd {
+		case telnetDO:
+			risposta = telnetWONT
+			if opt == telnetOptSGA {
+				risposta = telnetWILL
+			}
+		case telnetWILL:
+			risposta = telnetDONT
+			if opt == telnetOptEcho || opt == telnetOptSGA {
+				risposta = telnetDO
+			}
+		default:
+			return false, nil
+		}
+		_, err = t.Conn.Write([]byte{telnetIAC, risposta, opt})
+		return false, err
+	case telnetSB:
+		// Salta la sotto-negoziazione fino a IAC SE
+		var prec byte
+		for {
+			b, err := t.r.ReadByte()
+			if err != nil {
+				return false, err
+			}
+			if prec == telnetIAC && b == telnetSE {
+				return false, nil
+			}
+			prec = b
+		}
+	}
+	return false, nil
+}
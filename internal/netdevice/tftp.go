@@ -0,0 +1,177 @@
+package netdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"time"
+)
+
+// Codici operazione TFTP (RFC 1350)
+const (
+	tftpRRQ   = 1
+	tftpWRQ   = 2
+	tftpDATA  = 3
+	tftpACK   = 4
+	tftpERROR = 5
+)
+
+const (
+	tftpBlocco    = 512
+	tftpTentativi = 5
+	tftpAttesaACK = 3 * time.Second
+)
+
+// ServerTFTP serve in sola lettura un singolo file, il tempo necessario
+// perche un apparato lo scarichi (es. configurazione da ripristinare)
+type ServerTFTP struct {
+	conn   *net.UDPConn
+	nome   string
+	dati   []byte
+	fatto  chan error
+	chiuso chan struct{}
+}
+
+// AvviaServerTFTP mette in ascolto il server sull'indirizzo indicato (es. ":69")
+func AvviaServerTFTP(indirizzo, nome string, dati []byte) (*ServerTFTP, error) {
+	addr, err := net.ResolveUDPAddr("udp", indirizzo)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("avvio server TFTP su %s: %w", indirizzo, err)
+	}
+
+	s := &ServerTFTP{conn: conn, nome: nome, dati: dati, fatto: make(chan error, 1), chiuso: make(chan struct{})}
+	go s.ascolta()
+	return s, nil
+}
+
+// Attendi aspetta la fine del primo trasferimento del file
+func (s *ServerTFTP) Attendi(ctx context.Context) error {
+	select {
+	case err := <-s.fatto:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: l'apparato non ha scaricato il file via TFTP", ErrTimeout)
+	}
+}
+
+// Chiudi ferma il server
+func (s *ServerTFTP) Chiudi() {
+	select {
+	case <-s.chiuso:
+	default:
+		close(s.chiuso)
+		s.conn.Close()
+	}
+}
+
+// ascolta riceve le richieste e avvia un trasferimento per ogni lettura valida
+func (s *ServerTFTP) ascolta() {
+	buf := make([]byte, 1500)
+	for {
+		n, client, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 {
+			continue
+		}
+
+		opcode := binary.BigEndian.Uint16(buf[:2])
+		campi := bytes.Split(buf[2:n], []byte{0})
+		switch {
+		case opcode == tftpWRQ:
+			s.conn.WriteToUDP(pacchettoErrore(2, "sola lettura"), client)
+		case opcode != tftpRRQ || len(campi) < 2:
+			s.conn.WriteToUDP(pacchettoErrore(4, "operazione non valida"), client)
+		case path.Base(string(campi[0])) != s.nome:
+			s.conn.WriteToUDP(pacchettoErrore(1, "file non trovato"), client)
+		default:
+			log.Printf("[TFTP] %s richiede %s", client, s.nome)
+			go s.trasferisci(client)
+		}
+	}
+}
+
+// trasferisci invia il file al client da una porta dedicata, un blocco alla volta
+func (s *ServerTFTP) trasferisci(client *net.UDPAddr) {
+	err := s.invia(client)
+	if err != nil {
+		log.Printf("[TFTP] Trasferimento a %s fallito: %v", client, err)
+	}
+	select {
+	case s.fatto <- err:
+	default:
+	}
+}
+
+// invia trasmette i blocchi attendendo la conferma di ciascuno, con ritrasmissione
+func (s *ServerTFTP) invia(client *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp", nil, client)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ack := make([]byte, 1500)
+	// L'ultimo blocco e piu corto di 512 byte (eventualmente vuoto)
+	for blocco := 1; (blocco-1)*tftpBlocco <= len(s.dati); blocco++ {
+		inizio := (blocco - 1) * tftpBlocco
+		fine := inizio + tftpBlocco
+		if fine > len(s.dati) {
+			fine = len(s.dati)
+		}
+		pacchetto := make([]byte, 4+fine-inizio)
+		binary.BigEndian.PutUint16(pacchetto[0:2], tftpDATA)
+		binary.BigEndian.PutUint16(pacchetto[2:4], uint16(blocco))
+		copy(pacchetto[4:], s.dati[inizio:fine])
+
+		confermato := false
+		for tentativo := 0; tentativo < tftpTentativi && !confermato; tentativo++ {
+			select {
+			case <-s.chiuso:
+				return errors.New("server TFTP chiuso")
+			default:
+			}
+			if _, err := conn.Write(pacchetto); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(tftpAttesaACK))
+			for {
+				n, err := conn.Read(ack)
+				if err != nil {
+					break // timeout: ritrasmette
+				}
+				if n >= 4 && binary.BigEndian.Uint16(ack[:2]) == tftpERROR {
+					return fmt.Errorf("errore dal client: %s", bytes.TrimRight(ack[4:n], "\x00"))
+				}
+				if n >= 4 && binary.BigEndian.Uint16(ack[:2]) == tftpACK && binary.BigEndian.Uint16(ack[2:4]) == uint16(blocco) {
+					confermato = true
+					break
+				}
+			}
+		}
+		if !confermato {
+			return fmt.Errorf("%w: nessuna conferma per il blocco %d", ErrTimeout, blocco)
+		}
+	}
+	log.Printf("[TFTP] Inviati %d byte a %s", len(s.dati), client)
+	return nil
+}
+
+// pacchettoErrore costruisce un pacchetto ERROR
+func pacchettoErrore(codice uint16, messaggio string) []byte {
+	p := make([]byte, 4, 5+len(messaggio))
+	binary.BigEndian.PutUint16(p[0:2], tftpERROR)
+	binary.BigEndian.PutUint16(p[2:4], codice)
+	p = append(p, messaggio...)
+	return append(p, 0)
+}
@@ -0,0 +1,445 @@
+// Package qrcode genera codici QR (ISO/IEC 18004) in modalita byte con
+// correzione d'errore M, versioni da 1 a 10: sufficiente per gli URI di
+// provisioning TOTP e per brevi link. Il risultato si disegna in SVG.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTroppoLungo indica un testo che non entra nella versione massima gestita
+var ErrTroppoLungo = errors.New("testo troppo lungo per il codice QR")
+
+// blocchiVersione descrive la struttura dei blocchi di correzione (livello M)
+type blocchiVersione struct {
+	ecPerBlocco  int
+	gruppi       [][2]int // coppie (numero blocchi, codeword dati per blocco)
+	allineamento []int
+}
+
+var versioni = []blocchiVersione{
+	1:  {10, [][2]int{{1, 16}}, nil},
+	2:  {16, [][2]int{{1, 28}}, []int{6, 18}},
+	3:  {26, [][2]int{{1, 44}}, []int{6, 22}},
+	4:  {18, [][2]int{{2, 32}}, []int{6, 26}},
+	5:  {24, [][2]int{{2, 43}}, []int{6, 30}},
+	6:  {16, [][2]int{{4, 27}}, []int{6, 34}},
+	7:  {18, [][2]int{{4, 31}}, []int{6, 22, 38}},
+	8:  {22, [][2]int{{2, 38}, {2, 39}}, []int{6, 24, 42}},
+	9:  {22, [][2]int{{3, 36}, {2, 37}}, []int{6, 26, 46}},
+	10: {26, [][2]int{{4, 43}, {1, 44}}, []int{6, 28, 50}},
+}
+
+// codewordDati restituisce il numero di codeword dati della versione
+func (b blocchiVersione) codewordDati() int {
+	n := 0
+	for _, g := range b.gruppi {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+// Codice e la matrice di moduli: true indica un modulo scuro
+type Codice struct {
+	Dimensione int
+	moduli     [][]bool
+	funzione   [][]bool // moduli riservati a pattern e informazioni di formato
+}
+
+// Scuro indica se il modulo alla riga y e colonna x e scuro
+func (c *Codice) Scuro(x, y int) bool {
+	return c.moduli[y][x]
+}
+
+// Codifica genera il codice QR del testo scegliendo la versione piu piccola
+func Codifica(testo string) (*Codice, error) {
+	dati := []byte(testo)
+	versione := 0
+	for v := 1; v < len(versioni); v++ {
+		// 4 bit di modalita e 8 (16 dalla versione 10) di lunghezza
+		bitLunghezza := 8
+		if v >= 10 {
+			bitLunghezza = 16
+		}
+		if 4+bitLunghezza+8*len(dati) <= 8*versioni[v].codewordDati() {
+			versione = v
+			break
+		}
+	}
+	if versione == 0 {
+		return nil, ErrTroppoLungo
+	}
+
+	c := nuovoCodice(versione)
+	c.disegnaPattern(versione)
+	c.disegnaCodeword(interlaccia(versione, codificaDati(versione, dati)))
+
+	// Maschera con la penalita minima
+	migliore, penalitaMigliore := 0, -1
+	for m := 0; m < 8; m++ {
+		c.applicaMaschera(m)
+		c.disegnaFormato(m)
+		if p := c.penalita(); penalitaMigliore < 0 || p < penalitaMigliore {
+			migliore, penalitaMigliore = m, p
+		}
+		c.applicaMaschera(m) // lo XOR ripristina i moduli
+	}
+	c.applicaMaschera(migliore)
+	c.disegnaFormato(migliore)
+	return c, nil
+}
+
+func nuovoCodice(versione int) *Codice {
+	dim := versione*4 + 17
+	c := &Codice{Dimensione: dim, moduli: make([][]bool, dim), funzione: make([][]bool, dim)}
+	for i := range c.moduli {
+		c.moduli[i] = make([]bool, dim)
+		c.funzione[i] = make([]bool, dim)
+	}
+	return c
+}
+
+// imposta scrive un modulo di funzione (non soggetto a maschera)
+func (c *Codice) imposta(x, y int, scuro bool) {
+	c.moduli[y][x] = scuro
+	c.funzione[y][x] = true
+}
+
+// disegnaPattern disegna finder, timing, allineamento e riserva le aree di formato e versione
+func (c *Codice) disegnaPattern(versione int) {
+	dim := c.Dimensione
+	for i := 0; i < dim; i++ {
+		c.imposta(6, i, i%2 == 0)
+		c.imposta(i, 6, i%2 == 0)
+	}
+
+	// Finder con separatore bianco
+	for _, centro := range [][2]int{{3, 3}, {dim - 4, 3}, {3, dim - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := centro[0]+dx, centro[1]+dy
+				if x < 0 || y < 0 || x >= dim || y >= dim {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				c.imposta(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	pos := versioni[versione].allineamento
+	for i, cx := range pos {
+		for j, cy := range pos {
+			// Salta le posizioni sovrapposte ai finder
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.imposta(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	c.disegnaFormato(0) // riserva l'area, riscritta dopo la scelta della maschera
+
+	if versione >= 7 {
+		resto := versione
+		for i := 0; i < 12; i++ {
+			resto = (resto << 1) ^ ((resto >> 11) * 0x1F25)
+		}
+		bits := versione<<12 | resto
+		for i := 0; i < 18; i++ {
+			scuro := (bits>>i)&1 != 0
+			a, b := dim-11+i%3, i/3
+			c.imposta(a, b, scuro)
+			c.imposta(b, a, scuro)
+		}
+	}
+}
+
+// disegnaFormato scrive le due copie dei bit di formato (livello M e maschera)
+func (c *Codice) disegnaFormato(maschera int) {
+	dati := maschera // i due bit del livello M valgono 00
+	resto := dati
+	for i := 0; i < 10; i++ {
+		resto = (resto << 1) ^ ((resto >> 9) * 0x537)
+	}
+	bits := (dati<<10 | resto) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	dim := c.Dimensione
+	for i := 0; i <= 5; i++ {
+		c.imposta(8, i, bit(i))
+	}
+	c.imposta(8, 7, bit(6))
+	c.imposta(8, 8, bit(7))
+	c.imposta(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.imposta(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.imposta(dim-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.imposta(8, dim-15+i, bit(i))
+	}
+	c.imposta(8, dim-8, true) // modulo sempre scuro
+}
+
+// codificaDati compone il flusso di bit in modalita byte con terminatore e riempimento
+func codificaDati(versione int, dati []byte) []byte {
+	var bits []bool
+	aggiungi := func(valore, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (valore>>i)&1 != 0)
+		}
+	}
+	aggiungi(0x4, 4)
+	if versione >= 10 {
+		aggiungi(len(dati), 16)
+	} else {
+		aggiungi(len(dati), 8)
+	}
+	for _, b := range dati {
+		aggiungi(int(b), 8)
+	}
+
+	capacita := versioni[versione].codewordDati() * 8
+	aggiungi(0, min(4, capacita-len(bits)))
+	aggiungi(0, (8-len(bits)%8)%8)
+	for riempimento := 0xEC; len(bits) < capacita; riempimento ^= 0xEC ^ 0x11 {
+		aggiungi(riempimento, 8)
+	}
+
+	risultato := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			risultato[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return risultato
+}
+
+// interlaccia divide i dati in blocchi, aggiunge la correzione Reed-Solomon e
+// alterna le codeword dei blocchi
+func interlaccia(versione int, dati []byte) []byte {
+	v := versioni[versione]
+	divisore := divisoreRS(v.ecPerBlocco)
+
+	var blocchiDati, blocchiEC [][]byte
+	for _, g := range v.gruppi {
+		for i := 0; i < g[0]; i++ {
+			blocco := dati[:g[1]]
+			dati = dati[g[1]:]
+			blocchiDati = append(blocchiDati, blocco)
+			blocchiEC = append(blocchiEC, restoRS(blocco, divisore))
+		}
+	}
+
+	var risultato []byte
+	for i := 0; ; i++ {
+		aggiunti := false
+		for _, b := range blocchiDati {
+			if i < len(b) {
+				risultato = append(risultato, b[i])
+				aggiunti = true
+			}
+		}
+		if !aggiunti {
+			break
+		}
+	}
+	for i := 0; i < v.ecPerBlocco; i++ {
+		for _, b := range blocchiEC {
+			risultato = append(risultato, b[i])
+		}
+	}
+	return risultato
+}
+
+// disegnaCodeword dispone i bit a zig-zag dal basso a destra, due colonne alla volta
+func (c *Codice) disegnaCodeword(dati []byte) {
+	dim := c.Dimensione
+	i := 0
+	for destra := dim - 1; destra >= 1; destra -= 2 {
+		if destra == 6 {
+			destra = 5 // la colonna del timing non contiene dati
+		}
+		for vert := 0; vert < dim; vert++ {
+			for j := 0; j < 2; j++ {
+				x := destra - j
+				y := vert
+				if (destra+1)&2 == 0 {
+					y = dim - 1 - vert // colonne percorse verso l'alto
+				}
+				if !c.funzione[y][x] && i < len(dati)*8 {
+					c.moduli[y][x] = (dati[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applicaMaschera inverte i moduli dati secondo il pattern di maschera
+func (c *Codice) applicaMaschera(maschera int) {
+	for y := 0; y < c.Dimensione; y++ {
+		for x := 0; x < c.Dimensione; x++ {
+			if c.funzione[y][x] {
+				continue
+			}
+			var inverti bool
+			switch maschera {
+			case 0:
+				inverti = (x+y)%2 == 0
+			case 1:
+				inverti = y%2 == 0
+			case 2:
+				inverti = x%3 == 0
+			case 3:
+				inverti = (x+y)%3 == 0
+			case 4:
+				inverti = (x/3+y/2)%2 == 0
+			case 5:
+				inverti = x*y%2+x*y%3 == 0
+			case 6:
+				inverti = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				inverti = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if inverti {
+				c.moduli[y][x] = !c.moduli[y][x]
+			}
+		}
+	}
+}
+
+// penalita calcola il punteggio delle quattro regole dello standard: piu basso e, piu il codice e leggibile
+func (c *Codice) penalita() int {
+	dim := c.Dimensione
+	punti := 0
+	modulo := func(x, y int, orizzontale bool) bool {
+		if orizzontale {
+			return c.moduli[y][x]
+		}
+		return c.moduli[x][y]
+	}
+
+	for _, orizzontale := range []bool{true, false} {
+		for y := 0; y < dim; y++ {
+			// Sequenze di 5 o piu moduli dello stesso colore
+			serie := 1
+			for x := 1; x < dim; x++ {
+				if modulo(x, y, orizzontale) == modulo(x-1, y, orizzontale) {
+					serie++
+					continue
+				}
+				if serie >= 5 {
+					punti += serie - 2
+				}
+				serie = 1
+			}
+			if serie >= 5 {
+				punti += serie - 2
+			}
+
+			// Sequenze simili ai finder: 1011101 con quattro moduli chiari su un lato
+			for x := 0; x+11 <= dim; x++ {
+				var finestra [11]bool
+				for k := range finestra {
+					finestra[k] = modulo(x+k, y, orizzontale)
+				}
+				if finestra == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					finestra == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					punti += 40
+				}
+			}
+		}
+	}
+
+	scuri := 0
+	for y := 0; y < dim; y++ {
+		for x := 0; x < dim; x++ {
+			if c.moduli[y][x] {
+				scuri++
+			}
+			if x+1 < dim && y+1 < dim {
+				m := c.moduli[y][x]
+				if c.moduli[y][x+1] == m && c.moduli[y+1][x] == m && c.moduli[y+1][x+1] == m {
+					punti += 3
+				}
+			}
+		}
+	}
+	totale := dim * dim
+	punti += abs(scuri*20-totale*10) / totale * 10
+	return punti
+}
+
+// SVG disegna il codice con il margine di 4 moduli previsto dallo standard
+func (c *Codice) SVG(lato int) string {
+	n := c.Dimensione + 8
+	var percorso strings.Builder
+	for y := 0; y < c.Dimensione; y++ {
+		for x := 0; x < c.Dimensione; x++ {
+			if c.moduli[y][x] {
+				fmt.Fprintf(&percorso, "M%d,%dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		lato, lato, n, n, percorso.String())
+}
+
+// divisoreRS calcola il polinomio generatore Reed-Solomon di grado n
+func divisoreRS(n int) []byte {
+	risultato := make([]byte, n)
+	risultato[n-1] = 1
+	radice := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			risultato[j] = moltiplicaGF(risultato[j], radice)
+			if j+1 < n {
+				risultato[j] ^= risultato[j+1]
+			}
+		}
+		radice = moltiplicaGF(radice, 0x02)
+	}
+	return risultato
+}
+
+// restoRS restituisce le codeword di correzione del blocco
+func restoRS(dati, divisore []byte) []byte {
+	risultato := make([]byte, len(divisore))
+	for _, b := range dati {
+		fattore := b ^ risultato[0]
+		copy(risultato, risultato[1:])
+		risultato[len(risultato)-1] = 0
+		for i := range risultato {
+			risultato[i] ^= moltiplicaGF(divisore[i], fattore)
+		}
+	}
+	return risultato
+}
+
+// moltiplicaGF moltiplica in GF(256) con polinomio 0x11D
+func moltiplicaGF(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,225 @@
+package segreti
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ============================================
+// CIFRATURA A FLUSSO DEGLI ARCHIVI
+// ============================================
+
+// Formato di un flusso cifrato:
+//
+//	"FGCIFRA1" | log2 N di scrypt (1 byte) | sale (16 byte) | blocchi
+//
+// La chiave AES-256 deriva dalla passphrase con scrypt. Il contenuto e diviso in
+// blocchi di dimensioneBlocco byte cifrati con AES-GCM; il nonce e il numero del blocco
+// con un byte che segna l'ultimo, quindi blocchi riordinati, mancanti o un flusso
+// troncato non superano l'autenticazione.
+
+// intestazioneFlusso apre ogni flusso cifrato
+const intestazioneFlusso = "FGCIFRA1"
+
+const (
+	dimensioneBlocco = 64 << 10
+	dimensioneSale   = 16
+	logNScrypt       = 15
+)
+
+// ErrChiaveFlusso indica una passphrase errata o un flusso danneggiato
+var ErrChiaveFlusso = errors.New("chiave di cifratura errata o archivio danneggiato")
+
+// FlussoCifrato indica se il contenuto inizia con l'intestazione dei flussi cifrati.
+// Riporta la lettura all'inizio.
+func FlussoCifrato(r io.ReadSeeker) (bool, error) {
+	inizio := make([]byte, len(intestazioneFlusso))
+	n, err := io.ReadFull(r, inizio)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return n == len(inizio) && string(inizio) == intestazioneFlusso, nil
+}
+
+// aeadFlusso deriva la chiave dalla passphrase
+func aeadFlusso(passphrase string, sale []byte, logN uint8) (cipher.AEAD, error) {
+	if logN < 10 || logN > 20 {
+		return nil, ErrChiaveFlusso
+	}
+	chiave, err := scrypt.Key([]byte(passphrase), sale, 1<<logN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	blocco, err := aes.NewCipher(chiave)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blocco)
+}
+
+// nonceBlocco restituisce il nonce del blocco n
+func nonceBlocco(n uint64, ultimo bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if ultimo {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// scrittoreCifrato cifra quanto riceve a blocchi
+type scrittoreCifrato struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	blocco uint64
+	chiuso bool
+}
+
+// CifraFlusso restituisce un writer che cifra con la passphrase quanto vi si scrive.
+// Close scrive l'ultimo blocco e non chiude w.
+func CifraFlusso(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase vuota")
+	}
+	sale := make([]byte, dimensioneSale)
+	if _, err := rand.Read(sale); err != nil {
+		return nil, err
+	}
+	aead, err := aeadFlusso(passphrase, sale, logNScrypt)
+	if err != nil {
+		return nil, err
+	}
+	intestazione := append([]byte(intestazioneFlusso), logNScrypt)
+	if _, err := w.Write(append(intestazione, sale...)); err != nil {
+		return nil, err
+	}
+	return &scrittoreCifrato{w: w, aead: aead, buf: make([]byte, 0, dimensioneBlocco)}, nil
+}
+
+func (s *scrittoreCifrato) Write(p []byte) (int, error) {
+	if s.chiuso {
+		return 0, errors.New("flusso cifrato gia chiuso")
+	}
+	scritti := 0
+	for len(p) > 0 {
+		// Un blocco pieno si cifra solo quando arrivano altri dati: l'ultimo blocco
+		// resta in sospeso fino a Close, che lo segna come tale
+		if len(s.buf) == dimensioneBlocco {
+			if err := s.scriviBlocco(false); err != nil {
+				return scritti, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):dimensioneBlocco], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		scritti += n
+	}
+	return scritti, nil
+}
+
+func (s *scrittoreCifrato) scriviBlocco(ultimo bool) error {
+	cifrato := s.aead.Seal(nil, nonceBlocco(s.blocco, ultimo), s.buf, nil)
+	if _, err := s.w.Write(cifrato); err != nil {
+		return err
+	}
+	s.blocco++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+func (s *scrittoreCifrato) Close() error {
+	if s.chiuso {
+		return nil
+	}
+	s.chiuso = true
+	return s.scriviBlocco(true)
+}
+
+// lettoreCifrato decifra un flusso scritto da CifraFlusso
+type lettoreCifrato struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	blocco uint64
+	chiaro []byte
+	fine   bool
+	err    error
+}
+
+// DecifraFlusso restituisce un reader con il contenuto in chiaro del flusso. Il primo
+// blocco viene decifrato subito: una passphrase errata restituisce ErrChiaveFlusso.
+func DecifraFlusso(r io.Reader, passphrase string) (io.Reader, error) {
+	intestazione := make([]byte, len(intestazioneFlusso)+1+dimensioneSale)
+	if _, err := io.ReadFull(r, intestazione); err != nil {
+		return nil, ErrChiaveFlusso
+	}
+	if string(intestazione[:len(intestazioneFlusso)]) != intestazioneFlusso {
+		return nil, errors.New("archivio non cifrato")
+	}
+	logN := intestazione[len(intestazioneFlusso)]
+	aead, err := aeadFlusso(passphrase, intestazione[len(intestazioneFlusso)+1:], logN)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lettoreCifrato{r: bufio.NewReaderSize(r, dimensioneBlocco+aead.Overhead()), aead: aead}
+	if err := l.leggiBlocco(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *lettoreCifrato) leggiBlocco() error {
+	cifrato := make([]byte, dimensioneBlocco+l.aead.Overhead())
+	n, err := io.ReadFull(l.r, cifrato)
+	ultimo := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		ultimo = true
+	case err == io.EOF:
+		return ErrChiaveFlusso // il flusso deve finire con un blocco segnato come ultimo
+	case err != nil:
+		return err
+	default:
+		if _, errPeek := l.r.Peek(1); errPeek == io.EOF {
+			ultimo = true
+		}
+	}
+
+	chiaro, err := l.aead.Open(cifrato[:0], nonceBlocco(l.blocco, ultimo), cifrato[:n], nil)
+	if err != nil {
+		return ErrChiaveFlusso
+	}
+	l.blocco++
+	l.chiaro = chiaro
+	l.fine = ultimo
+	return nil
+}
+
+func (l *lettoreCifrato) Read(p []byte) (int, error) {
+	for len(l.chiaro) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		if l.fine {
+			return 0, io.EOF
+		}
+		if err := l.leggiBlocco(); err != nil {
+			l.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, l.chiaro)
+	l.chiaro = l.chiaro[n:]
+	return n, nil
+}
@@ -0,0 +1,126 @@
+package segreti
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// cifraTest cifra il contenuto con la passphrase indicata
+func cifraTest(t *testing.T, contenuto []byte, passphrase string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := CifraFlusso(&buf, passphrase)
+	if err != nil {
+		t.Fatalf("CifraFlusso: %v", err)
+	}
+	if _, err := w.Write(contenuto); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decifraTest restituisce il contenuto in chiaro o il primo errore incontrato
+func decifraTest(cifrato []byte, passphrase string) ([]byte, error) {
+	r, err := DecifraFlusso(bytes.NewReader(cifrato), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func casuale(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFlussoAndataRitorno(t *testing.T) {
+	casi := []struct {
+		nome string
+		n    int
+	}{
+		{"vuoto", 0},
+		{"un byte", 1},
+		{"blocco esatto", dimensioneBlocco},
+		{"blocco e un byte", dimensioneBlocco + 1},
+		{"piu blocchi", 3*dimensioneBlocco + 123},
+	}
+	for _, c := range casi {
+		t.Run(c.nome, func(t *testing.T) {
+			contenuto := casuale(t, c.n)
+			cifrato := cifraTest(t, contenuto, "segreta")
+			if bytes.Contains(cifrato, contenuto) && c.n > 0 {
+				t.Fatal("il contenuto in chiaro compare nel flusso cifrato")
+			}
+			ok, err := FlussoCifrato(bytes.NewReader(cifrato))
+			if err != nil || !ok {
+				t.Fatalf("FlussoCifrato = %v, %v", ok, err)
+			}
+			chiaro, err := decifraTest(cifrato, "segreta")
+			if err != nil {
+				t.Fatalf("decifratura: %v", err)
+			}
+			if !bytes.Equal(chiaro, contenuto) {
+				t.Fatalf("contenuto diverso: %d byte invece di %d", len(chiaro), len(contenuto))
+			}
+		})
+	}
+}
+
+func TestFlussoManomesso(t *testing.T) {
+	contenuto := casuale(t, 3*dimensioneBlocco+500)
+	cifrato := cifraTest(t, contenuto, "segreta")
+
+	testata := len(intestazioneFlusso) + 1 + dimensioneSale
+	blocco := dimensioneBlocco + 16 // overhead di AES-GCM
+
+	riordinato := append([]byte(nil), cifrato...)
+	copy(riordinato[testata:], cifrato[testata+blocco:testata+2*blocco])
+	copy(riordinato[testata+blocco:], cifrato[testata:testata+blocco])
+
+	alterato := append([]byte(nil), cifrato...)
+	alterato[testata+blocco+10] ^= 1
+
+	casi := []struct {
+		nome       string
+		dati       []byte
+		passphrase string
+	}{
+		{"passphrase errata", cifrato, "sbagliata"},
+		{"troncato a fine blocco", cifrato[:testata+3*blocco], "segreta"},
+		{"troncato a meta blocco", cifrato[:testata+2*blocco+100], "segreta"},
+		{"senza blocchi", cifrato[:testata], "segreta"},
+		{"intestazione troncata", cifrato[:testata-1], "segreta"},
+		{"ultimo blocco ripetuto", append(append([]byte(nil), cifrato...), cifrato[testata+3*blocco:]...), "segreta"},
+		{"blocchi riordinati", riordinato, "segreta"},
+		{"byte alterato", alterato, "segreta"},
+	}
+	for _, c := range casi {
+		t.Run(c.nome, func(t *testing.T) {
+			if _, err := decifraTest(c.dati, c.passphrase); err != ErrChiaveFlusso {
+				t.Fatalf("errore = %v, atteso ErrChiaveFlusso", err)
+			}
+		})
+	}
+}
+
+func TestFlussoNonCifrato(t *testing.T) {
+	ok, err := FlussoCifrato(bytes.NewReader([]byte("PK\x03\x04 archivio zip")))
+	if err != nil || ok {
+		t.Fatalf("FlussoCifrato = %v, %v", ok, err)
+	}
+	if _, err := decifraTest([]byte("PK\x03\x04 archivio zip qualunque"), "segreta"); err == nil {
+		t.Fatal("atteso errore per un archivio non cifrato")
+	}
+	if _, err := CifraFlusso(io.Discard, ""); err == nil {
+		t.Fatal("atteso errore per la passphrase vuota")
+	}
+}
@@ -0,0 +1,210 @@
+// Package segreti cifra le credenziali salvate nel database (password di
+// apparati, caselle email e NAS) con AES-256-GCM. La chiave non sta nel
+// database: viene letta dalla variabile d'ambiente FURVIOGEST_CHIAVE o da un
+// file dedicato, quindi i backup del database non contengono credenziali in chiaro.
+package segreti
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// VariabileChiave e la variabile d'ambiente con le chiavi, separate da virgola:
+// la prima cifra, le altre servono solo a leggere i valori durante una rotazione
+const VariabileChiave = "FURVIOGEST_CHIAVE"
+
+// prefisso identifica i valori cifrati: enc:v1:<id chiave>:<base64 di nonce e testo cifrato>
+const prefisso = "enc:v1:"
+
+// ErrNonInizializzato indica che nessuna chiave e stata caricata
+var ErrNonInizializzato = errors.New("chiave di cifratura non caricata")
+
+type chiave struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	mu     sync.RWMutex
+	chiavi []chiave // la prima e la chiave attiva
+)
+
+// Inizializza carica le chiavi dalla variabile d'ambiente o, se assente, dal
+// file indicato. Se il file non esiste viene creato con una nuova chiave.
+func Inizializza(percorsoFile string) error {
+	if valore := strings.TrimSpace(os.Getenv(VariabileChiave)); valore != "" {
+		return caricaChiavi(strings.Split(valore, ","))
+	}
+
+	contenuto, err := os.ReadFile(percorsoFile)
+	if os.IsNotExist(err) {
+		if _, err := AggiungiChiave(percorsoFile); err != nil {
+			return err
+		}
+		contenuto, err = os.ReadFile(percorsoFile)
+	}
+	if err != nil {
+		return fmt.Errorf("lettura file chiave: %w", err)
+	}
+	return caricaChiavi(strings.Split(string(contenuto), "\n"))
+}
+
+// caricaChiavi decodifica le chiavi in base64 (32 byte), ignorando righe vuote e commenti
+func caricaChiavi(righe []string) error {
+	var caricate []chiave
+	for _, riga := range righe {
+		riga = strings.TrimSpace(riga)
+		if riga == "" || strings.HasPrefix(riga, "#") {
+			continue
+		}
+		grezza, err := base64.StdEncoding.DecodeString(riga)
+		if err != nil || len(grezza) != 32 {
+			return errors.New("chiave non valida: servono 32 byte in base64")
+		}
+		blocco, err := aes.NewCipher(grezza)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(blocco)
+		if err != nil {
+			return err
+		}
+		impronta := sha256.Sum256(grezza)
+		caricate = append(caricate, chiave{id: hex.EncodeToString(impronta[:4]), aead: aead})
+	}
+	if len(caricate) == 0 {
+		return errors.New("nessuna chiave di cifratura trovata")
+	}
+
+	mu.Lock()
+	chiavi = caricate
+	mu.Unlock()
+	return nil
+}
+
+// GeneraChiave restituisce una nuova chiave casuale in base64
+func GeneraChiave() (string, error) {
+	grezza := make([]byte, 32)
+	if _, err := rand.Read(grezza); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(grezza), nil
+}
+
+// AggiungiChiave genera una nuova chiave e la scrive in testa al file, che viene
+// creato se manca. Le chiavi precedenti restano per leggere i valori gia cifrati.
+func AggiungiChiave(percorsoFile string) (string, error) {
+	nuova, err := GeneraChiave()
+	if err != nil {
+		return "", err
+	}
+	precedenti, err := os.ReadFile(percorsoFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("lettura file chiave: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(percorsoFile), 0700); err != nil {
+		return "", err
+	}
+	contenuto := nuova + "\n" + string(precedenti)
+	if err := os.WriteFile(percorsoFile, []byte(contenuto), 0600); err != nil {
+		return "", fmt.Errorf("scrittura file chiave: %w", err)
+	}
+	return nuova, nil
+}
+
+// Cifrato indica se il valore e stato cifrato da Cifra
+func Cifrato(valore string) bool {
+	return strings.HasPrefix(valore, prefisso)
+}
+
+// DaCifrare indica se il valore va (ri)cifrato con la chiave attiva: e in
+// chiaro oppure e cifrato con una chiave precedente
+func DaCifrare(valore string) bool {
+	if valore == "" {
+		return false
+	}
+	if !Cifrato(valore) {
+		return true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(chiavi) > 0 && !strings.HasPrefix(valore, prefisso+chiavi[0].id+":")
+}
+
+// Cifra cifra il testo con la chiave attiva. Il testo vuoto resta vuoto e un
+// valore gia cifrato non viene cifrato due volte.
+func Cifra(testo string) (string, error) {
+	if testo == "" || Cifrato(testo) {
+		return testo, nil
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(chiavi) == 0 {
+		return "", ErrNonInizializzato
+	}
+	attiva := chiavi[0]
+	nonce := make([]byte, attiva.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cifrato := attiva.aead.Seal(nonce, nonce, []byte(testo), nil)
+	return prefisso + attiva.id + ":" + base64.StdEncoding.EncodeToString(cifrato), nil
+}
+
+// Decifra restituisce il testo in chiaro. I valori non cifrati (salvati prima
+// della migrazione) vengono restituiti invariati.
+func Decifra(valore string) (string, error) {
+	if !Cifrato(valore) {
+		return valore, nil
+	}
+	parti := strings.SplitN(strings.TrimPrefix(valore, prefisso), ":", 2)
+	if len(parti) != 2 {
+		return "", errors.New("valore cifrato non valido")
+	}
+	dati, err := base64.StdEncoding.DecodeString(parti[1])
+	if err != nil {
+		return "", errors.New("valore cifrato non valido")
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(chiavi) == 0 {
+		return "", ErrNonInizializzato
+	}
+	for _, c := range chiavi {
+		if c.id != parti[0] {
+			continue
+		}
+		if len(dati) < c.aead.NonceSize() {
+			return "", errors.New("valore cifrato non valido")
+		}
+		testo, err := c.aead.Open(nil, dati[:c.aead.NonceSize()], dati[c.aead.NonceSize():], nil)
+		if err != nil {
+			return "", errors.New("valore cifrato non leggibile con la chiave " + c.id)
+		}
+		return string(testo), nil
+	}
+	return "", fmt.Errorf("chiave %s non disponibile", parti[0])
+}
+
+// Leggi decifra il valore e restituisce una stringa vuota se non e leggibile:
+// per i punti d'uso in cui una credenziale mancante equivale a un errore di accesso
+func Leggi(valore string) string {
+	testo, err := Decifra(valore)
+	if err != nil {
+		log.Printf("[Segreti] %v", err)
+		return ""
+	}
+	return testo
+}
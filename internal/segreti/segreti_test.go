@@ -0,0 +1,185 @@
+package segreti
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// caricaTest carica le chiavi indicate, la prima attiva
+func caricaTest(t *testing.T, righe ...string) {
+	t.Helper()
+	if err := caricaChiavi(righe); err != nil {
+		t.Fatalf("caricaChiavi: %v", err)
+	}
+}
+
+func nuovaChiaveTest(t *testing.T) string {
+	t.Helper()
+	k, err := GeneraChiave()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestCifraDecifra(t *testing.T) {
+	caricaTest(t, nuovaChiaveTest(t))
+
+	casi := []string{"password", "p@ss:w0rd con spazi", "àèìòù €", strings.Repeat("x", 4096)}
+	for _, testo := range casi {
+		cifrato, err := Cifra(testo)
+		if err != nil {
+			t.Fatalf("Cifra(%q): %v", testo, err)
+		}
+		if !Cifrato(cifrato) || !strings.HasPrefix(cifrato, prefisso) || strings.Contains(cifrato, testo) {
+			t.Fatalf("Cifra(%q) = %q", testo, cifrato)
+		}
+		if DaCifrare(cifrato) {
+			t.Errorf("DaCifrare(%q) con la chiave attiva", cifrato)
+		}
+		chiaro, err := Decifra(cifrato)
+		if err != nil || chiaro != testo {
+			t.Errorf("Decifra = %q, %v; atteso %q", chiaro, err, testo)
+		}
+		if diNuovo, _ := Cifra(cifrato); diNuovo != cifrato {
+			t.Errorf("un valore gia cifrato non deve essere cifrato due volte")
+		}
+	}
+
+	// Lo stesso testo cifrato due volte usa nonce diversi
+	a, _ := Cifra("ripetuto")
+	b, _ := Cifra("ripetuto")
+	if a == b {
+		t.Error("due cifrature dello stesso testo coincidono")
+	}
+}
+
+func TestValoriInChiaro(t *testing.T) {
+	caricaTest(t, nuovaChiaveTest(t))
+
+	casi := []struct {
+		valore     string
+		daCifrare  bool
+		cifraVuoto bool
+	}{
+		{"", false, true},
+		{"password in chiaro", true, false},
+		{"enc:v2:non nostro", true, false},
+	}
+	for _, c := range casi {
+		chiaro, err := Decifra(c.valore)
+		if err != nil || chiaro != c.valore {
+			t.Errorf("Decifra(%q) = %q, %v; atteso invariato", c.valore, chiaro, err)
+		}
+		if Leggi(c.valore) != c.valore {
+			t.Errorf("Leggi(%q) deve restituire il valore invariato", c.valore)
+		}
+		if got := DaCifrare(c.valore); got != c.daCifrare {
+			t.Errorf("DaCifrare(%q) = %v", c.valore, got)
+		}
+		if cifrato, _ := Cifra(c.valore); (cifrato == "") != c.cifraVuoto {
+			t.Errorf("Cifra(%q) = %q", c.valore, cifrato)
+		}
+	}
+}
+
+func TestValoriCifratiNonValidi(t *testing.T) {
+	caricaTest(t, nuovaChiaveTest(t))
+	valido, _ := Cifra("segreto")
+	parti := strings.SplitN(strings.TrimPrefix(valido, prefisso), ":", 2)
+
+	casi := []string{
+		prefisso + "senza-separatore",
+		prefisso + parti[0] + ":non base64!",
+		prefisso + parti[0] + ":QUJD",
+		prefisso + parti[0] + ":" + strings.Repeat("A", len(parti[1])),
+		prefisso + "deadbeef:" + parti[1],
+	}
+	for _, valore := range casi {
+		if _, err := Decifra(valore); err == nil {
+			t.Errorf("Decifra(%q): atteso errore", valore)
+		}
+		if Leggi(valore) != "" {
+			t.Errorf("Leggi(%q) deve restituire una stringa vuota", valore)
+		}
+	}
+}
+
+func TestRotazioneChiave(t *testing.T) {
+	t.Setenv(VariabileChiave, "")
+	file := filepath.Join(t.TempDir(), "chiave")
+
+	// Senza file viene creata una chiave
+	if err := Inizializza(file); err != nil {
+		t.Fatalf("Inizializza: %v", err)
+	}
+	vecchio, err := Cifra("credenziale")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vecchiaChiave, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AggiungiChiave(file); err != nil {
+		t.Fatalf("AggiungiChiave: %v", err)
+	}
+	if err := Inizializza(file); err != nil {
+		t.Fatalf("Inizializza dopo la rotazione: %v", err)
+	}
+
+	if !DaCifrare(vecchio) {
+		t.Error("un valore cifrato con la chiave precedente va ricifrato")
+	}
+	chiaro, err := Decifra(vecchio)
+	if err != nil || chiaro != "credenziale" {
+		t.Fatalf("Decifra con la chiave precedente = %q, %v", chiaro, err)
+	}
+	nuovo, err := Cifra(chiaro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DaCifrare(nuovo) || strings.SplitN(nuovo, ":", 4)[2] == strings.SplitN(vecchio, ":", 4)[2] {
+		t.Errorf("il valore ricifrato %q deve usare la nuova chiave", nuovo)
+	}
+
+	// Tolta la chiave precedente, i valori vecchi non sono piu leggibili
+	contenuto, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	righe := strings.Split(strings.TrimSpace(string(contenuto)), "\n")
+	caricaTest(t, righe[0])
+	if _, err := Decifra(vecchio); err == nil {
+		t.Error("atteso errore senza la chiave precedente")
+	}
+	if chiaro, err := Decifra(nuovo); err != nil || chiaro != "credenziale" {
+		t.Errorf("Decifra con la nuova chiave = %q, %v", chiaro, err)
+	}
+
+	// La variabile d'ambiente ha la precedenza sul file
+	t.Setenv(VariabileChiave, strings.TrimSpace(string(vecchiaChiave))+", "+righe[0])
+	if err := Inizializza(filepath.Join(t.TempDir(), "assente")); err != nil {
+		t.Fatalf("Inizializza da variabile: %v", err)
+	}
+	if DaCifrare(vecchio) || !DaCifrare(nuovo) {
+		t.Error("la prima chiave della variabile deve essere quella attiva")
+	}
+}
+
+func TestChiaviNonValide(t *testing.T) {
+	casi := [][]string{
+		{},
+		{"", "# solo commenti"},
+		{"non base64!"},
+		{"QUJD"},
+	}
+	for _, righe := range casi {
+		if err := caricaChiavi(righe); err == nil {
+			t.Errorf("caricaChiavi(%q): atteso errore", righe)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tipi BER usati da SNMP (RFC 1905, RFC 2578)
+const (
+	tipoIntero       = 0x02
+	tipoOctetString  = 0x04
+	tipoNull         = 0x05
+	tipoOID          = 0x06
+	tipoSequenza     = 0x30
+	tipoIPAddress    = 0x40
+	tipoCounter32    = 0x41
+	tipoGauge32      = 0x42
+	tipoTimeTicks    = 0x43
+	tipoOpaque       = 0x44
+	tipoCounter64    = 0x46
+	tipoNoSuchObject = 0x80
+	tipoNoSuchInst   = 0x81
+	tipoEndOfMibView = 0x82
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduGetBulk  = 0xa5
+	pduReport   = 0xa8
+)
+
+var errBER = errors.New("pacchetto SNMP malformato")
+
+// Variabile e una coppia OID/valore restituita dall'agente
+type Variabile struct {
+	OID  string
+	Tipo byte
+	// Valore contiene int64 (Integer), uint64 (Counter32/64, Gauge32, TimeTicks),
+	// []byte (OctetString, Opaque), string (OID, IpAddress) o nil (Null ed eccezioni)
+	Valore interface{}
+}
+
+// Assente indica che l'agente non ha l'oggetto richiesto
+func (v Variabile) Assente() bool {
+	return v.Tipo == tipoNoSuchObject || v.Tipo == tipoNoSuchInst || v.Tipo == tipoEndOfMibView || v.Tipo == tipoNull
+}
+
+// Numero restituisce il valore numerico (0 se la variabile non e numerica)
+func (v Variabile) Numero() uint64 {
+	switch n := v.Valore.(type) {
+	case int64:
+		return uint64(n)
+	case uint64:
+		return n
+	}
+	return 0
+}
+
+// Testo restituisce il valore come stringa
+func (v Variabile) Testo() string {
+	switch t := v.Valore.(type) {
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case uint64:
+		return strconv.FormatUint(t, 10)
+	}
+	return ""
+}
+
+// ============================================
+// CODIFICA
+// ============================================
+
+// tlv codifica un elemento tipo-lunghezza-valore
+func tlv(tipo byte, valore []byte) []byte {
+	b := []byte{tipo}
+	n := len(valore)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, valore...)
+}
+
+// sequenza concatena gli elementi in un contenitore del tipo indicato
+func sequenza(tipo byte, elementi ...[]byte) []byte {
+	var contenuto []byte
+	for _, e := range elementi {
+		contenuto = append(contenuto, e...)
+	}
+	return tlv(tipo, contenuto)
+}
+
+// intero codifica un INTEGER in complemento a due con il minimo numero di byte
+func intero(v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return tlv(tipoIntero, b)
+}
+
+// stringa codifica un OCTET STRING
+func stringa(b []byte) []byte {
+	return tlv(tipoOctetString, b)
+}
+
+// codificaOID codifica un OID in notazione puntata
+func codificaOID(oid string) ([]byte, error) {
+	parti := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parti) < 2 {
+		return nil, fmt.Errorf("OID non valido: %s", oid)
+	}
+	numeri := make([]uint64, len(parti))
+	for i, p := range parti {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("OID non valido: %s", oid)
+		}
+		numeri[i] = n
+	}
+	if numeri[0] > 2 || (numeri[0] < 2 && numeri[1] >= 40) {
+		return nil, fmt.Errorf("OID non valido: %s", oid)
+	}
+
+	b := []byte{}
+	b = appendBase128(b, numeri[0]*40+numeri[1])
+	for _, n := range numeri[2:] {
+		b = appendBase128(b, n)
+	}
+	return tlv(tipoOID, b), nil
+}
+
+// appendBase128 aggiunge un sub-identificatore in base 128
+func appendBase128(b []byte, n uint64) []byte {
+	var tmp []byte
+	tmp = append(tmp, byte(n&0x7f))
+	for n >>= 7; n > 0; n >>= 7 {
+		tmp = append([]byte{byte(n&0x7f) | 0x80}, tmp...)
+	}
+	return append(b, tmp...)
+}
+
+// ============================================
+// DECODIFICA
+// ============================================
+
+// elemento e un TLV decodificato; Valore punta nel buffer originale
+type elemento struct {
+	Tipo   byte
+	Valore []byte
+}
+
+// leggiElemento decodifica il primo TLV del buffer e restituisce il resto
+func leggiElemento(b []byte) (elemento, []byte, error) {
+	if len(b) < 2 {
+		return elemento{}, nil, errBER
+	}
+	tipo := b[0]
+	n := int(b[1])
+	pos := 2
+	if n&0x80 != 0 {
+		byteLunghezza := n & 0x7f
+		if byteLunghezza == 0 || byteLunghezza > 4 || len(b) < 2+byteLunghezza {
+			return elemento{}, nil, errBER
+		}
+		n = 0
+		for _, c := range b[2 : 2+byteLunghezza] {
+			n = n<<8 | int(c)
+		}
+		pos += byteLunghezza
+	}
+	if n < 0 || len(b) < pos+n {
+		return elemento{}, nil, errBER
+	}
+	return elemento{Tipo: tipo, Valore: b[pos : pos+n]}, b[pos+n:], nil
+}
+
+// leggiElementi decodifica tutti i TLV contenuti in un valore
+func leggiElementi(b []byte) ([]elemento, error) {
+	var elementi []elemento
+	for len(b) > 0 {
+		e, resto, err := leggiElemento(b)
+		if err != nil {
+			return nil, err
+		}
+		elementi = append(elementi, e)
+		b = resto
+	}
+	return elementi, nil
+}
+
+// leggiSequenza decodifica un contenitore del tipo atteso e ne restituisce gli elementi
+func leggiSequenza(b []byte, tipo byte, minimo int) ([]elemento, error) {
+	e, _, err := leggiElemento(b)
+	if err != nil {
+		return nil, err
+	}
+	if e.Tipo != tipo {
+		return nil, fmt.Errorf("%w: atteso tipo 0x%02x, ricevuto 0x%02x", errBER, tipo, e.Tipo)
+	}
+	elementi, err := leggiElementi(e.Valore)
+	if err != nil {
+		return nil, err
+	}
+	if len(elementi) < minimo {
+		return nil, errBER
+	}
+	return elementi, nil
+}
+
+// decodificaIntero decodifica un INTEGER con segno
+func decodificaIntero(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errBER
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
+
+// decodificaSenzaSegno decodifica i tipi applicativi senza segno (contatori, gauge, timeticks)
+func decodificaSenzaSegno(b []byte) (uint64, error) {
+	if len(b) == 0 || len(b) > 9 || (len(b) == 9 && b[0] != 0) {
+		return 0, errBER
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// decodificaOID decodifica un OID in notazione puntata
+func decodificaOID(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errBER
+	}
+	var numeri []uint64
+	var n uint64
+	for i, c := range b {
+		n = n<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return "", errBER
+			}
+			continue
+		}
+		numeri = append(numeri, n)
+		n = 0
+	}
+
+	var sb strings.Builder
+	switch primo := numeri[0]; {
+	case primo < 40:
+		fmt.Fprintf(&sb, "0.%d", primo)
+	case primo < 80:
+		fmt.Fprintf(&sb, "1.%d", primo-40)
+	default:
+		fmt.Fprintf(&sb, "2.%d", primo-80)
+	}
+	for _, n := range numeri[1:] {
+		fmt.Fprintf(&sb, ".%d", n)
+	}
+	return sb.String(), nil
+}
+
+// decodificaValore converte il valore di una variabile nel tipo Go corrispondente
+func decodificaValore(e elemento) (interface{}, error) {
+	switch e.Tipo {
+	case tipoIntero:
+		return decodificaIntero(e.Valore)
+	case tipoOctetString, tipoOpaque:
+		return append([]byte(nil), e.Valore...), nil
+	case tipoOID:
+		return decodificaOID(e.Valore)
+	case tipoIPAddress:
+		if len(e.Valore) != 4 {
+			return nil, errBER
+		}
+		return fmt.Sprintf("%d.%d.%d.%d", e.Valore[0], e.Valore[1], e.Valore[2], e.Valore[3]), nil
+	case tipoCounter32, tipoGauge32, tipoTimeTicks, tipoCounter64:
+		return decodificaSenzaSegno(e.Valore)
+	default:
+		return nil, nil
+	}
+}
+
+// confrontaOID confronta due OID numericamente (-1, 0, 1)
+func confrontaOID(a, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, _ := strconv.ParseUint(pa[i], 10, 32)
+		nb, _ := strconv.ParseUint(pb[i], 10, 32)
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
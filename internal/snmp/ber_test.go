@@ -0,0 +1,147 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestIntero(t *testing.T) {
+	casi := []struct {
+		v      int64
+		atteso string
+	}{
+		{0, "020100"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{256, "02020100"},
+		{-1, "0201ff"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+		{2147483647, "02047fffffff"},
+	}
+	for _, c := range casi {
+		codificato := intero(c.v)
+		if got := hex.EncodeToString(codificato); got != c.atteso {
+			t.Errorf("intero(%d) = %s, atteso %s", c.v, got, c.atteso)
+		}
+		e, resto, err := leggiElemento(codificato)
+		if err != nil || len(resto) != 0 || e.Tipo != tipoIntero {
+			t.Fatalf("leggiElemento(%x): %v", codificato, err)
+		}
+		if v, err := decodificaIntero(e.Valore); err != nil || v != c.v {
+			t.Errorf("decodificaIntero(%x) = %d, %v", e.Valore, v, err)
+		}
+	}
+}
+
+func TestLunghezzaTLV(t *testing.T) {
+	casi := []struct {
+		n        int
+		prefisso string
+	}{
+		{0, "0400"},
+		{127, "047f"},
+		{128, "048180"},
+		{255, "0481ff"},
+		{256, "04820100"},
+		{65536, "0483010000"},
+	}
+	for _, c := range casi {
+		valore := bytes.Repeat([]byte{0xaa}, c.n)
+		codificato := stringa(valore)
+		if got := hex.EncodeToString(codificato[:len(codificato)-c.n]); got != c.prefisso {
+			t.Errorf("stringa di %d byte: intestazione %s, attesa %s", c.n, got, c.prefisso)
+		}
+		e, resto, err := leggiElemento(codificato)
+		if err != nil || len(resto) != 0 || !bytes.Equal(e.Valore, valore) {
+			t.Errorf("leggiElemento di %d byte: %v", c.n, err)
+		}
+	}
+}
+
+func TestOID(t *testing.T) {
+	casi := []struct {
+		oid    string
+		atteso string
+	}{
+		{"1.3.6.1.2.1.1.1.0", "06082b06010201010100"},
+		{".1.3.6.1.4.1.14988.1", "06082b06010401f50c01"},
+		{"2.999.3", "0603883703"}, // esempio di X.690 8.19.5
+		{"0.0", "060100"},
+	}
+	for _, c := range casi {
+		codificato, err := codificaOID(c.oid)
+		if err != nil {
+			t.Fatalf("codificaOID(%q): %v", c.oid, err)
+		}
+		if got := hex.EncodeToString(codificato); got != c.atteso {
+			t.Errorf("codificaOID(%q) = %s, atteso %s", c.oid, got, c.atteso)
+		}
+		e, _, _ := leggiElemento(codificato)
+		oid, err := decodificaOID(e.Valore)
+		if want := c.oid[len(c.oid)-len(oid):]; err != nil || oid != want {
+			t.Errorf("decodificaOID(%x) = %q, %v", e.Valore, oid, err)
+		}
+	}
+
+	for _, oid := range []string{"", "1", "1.x.3", "3.1", "1.40", "1.3.4294967296"} {
+		if _, err := codificaOID(oid); err == nil {
+			t.Errorf("codificaOID(%q): atteso errore", oid)
+		}
+	}
+}
+
+func TestDecodificaMalformata(t *testing.T) {
+	casi := []struct {
+		nome string
+		dati string
+	}{
+		{"vuoto", ""},
+		{"solo tipo", "30"},
+		{"valore troncato", "300501020304"},
+		{"lunghezza lunga troncata", "3082ff"},
+		{"lunghezza indefinita", "3080"},
+		{"lunghezza oltre 4 byte", "3085ffffffffff"},
+	}
+	for _, c := range casi {
+		dati, _ := hex.DecodeString(c.dati)
+		if _, _, err := leggiElemento(dati); err == nil {
+			t.Errorf("%s: atteso errore", c.nome)
+		}
+	}
+
+	if _, err := leggiSequenza([]byte{0x02, 0x01, 0x00}, tipoSequenza, 0); err == nil {
+		t.Error("leggiSequenza: atteso errore sul tipo")
+	}
+	if _, err := leggiSequenza(sequenza(tipoSequenza, intero(1)), tipoSequenza, 2); err == nil {
+		t.Error("leggiSequenza: atteso errore sul numero di elementi")
+	}
+	if _, err := decodificaOID([]byte{0x2b, 0x86}); err == nil {
+		t.Error("decodificaOID: atteso errore su un sub-identificatore troncato")
+	}
+	if _, err := decodificaIntero(make([]byte, 9)); err == nil {
+		t.Error("decodificaIntero: atteso errore oltre 8 byte")
+	}
+	if v, err := decodificaSenzaSegno([]byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}); err != nil || v != 1<<64-1 {
+		t.Errorf("decodificaSenzaSegno Counter64 massimo = %d, %v", v, err)
+	}
+}
+
+func TestConfrontaOID(t *testing.T) {
+	casi := []struct {
+		a, b   string
+		atteso int
+	}{
+		{"1.3.6.1", "1.3.6.1", 0},
+		{"1.3.6.1.2", "1.3.6.1.10", -1},
+		{"1.3.6.1.10", "1.3.6.1.2", 1},
+		{"1.3.6", "1.3.6.1", -1},
+		{"1.3.6.1", "1.3.6", 1},
+	}
+	for _, c := range casi {
+		if got := confrontaOID(c.a, c.b); got != c.atteso {
+			t.Errorf("confrontaOID(%q, %q) = %d, atteso %d", c.a, c.b, got, c.atteso)
+		}
+	}
+}
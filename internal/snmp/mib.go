@@ -0,0 +1,215 @@
+package snmp
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OID di SNMPv2-MIB e IF-MIB
+const (
+	oidSysDescr  = "1.3.6.1.2.1.1.1.0"
+	oidSysUpTime = "1.3.6.1.2.1.1.3.0"
+	oidSysName   = "1.3.6.1.2.1.1.5.0"
+
+	oidIfDescr      = "1.3.6.1.2.1.2.2.1.2"
+	oidIfSpeed      = "1.3.6.1.2.1.2.2.1.5"
+	oidIfOperStatus = "1.3.6.1.2.1.2.2.1.8"
+	oidIfInOctets   = "1.3.6.1.2.1.2.2.1.10"
+	oidIfInErrors   = "1.3.6.1.2.1.2.2.1.14"
+	oidIfOutOctets  = "1.3.6.1.2.1.2.2.1.16"
+	oidIfOutErrors  = "1.3.6.1.2.1.2.2.1.20"
+
+	oidIfName        = "1.3.6.1.2.1.31.1.1.1.1"
+	oidIfHCInOctets  = "1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets = "1.3.6.1.2.1.31.1.1.1.10"
+	oidIfHighSpeed   = "1.3.6.1.2.1.31.1.1.1.15"
+)
+
+// OID proprietari per CPU e memoria
+const (
+	// HUAWEI-ENTITY-EXTENT-MIB: utilizzo per entita (schede, MPU)
+	oidHuaweiCPU     = "1.3.6.1.4.1.2011.5.25.31.1.1.1.1.5"
+	oidHuaweiMemoria = "1.3.6.1.4.1.2011.5.25.31.1.1.1.1.7"
+
+	// HP ProCurve / Aruba: STATISTICS-MIB e NETSWITCH-MIB
+	oidHPCPU           = "1.3.6.1.4.1.11.2.14.11.5.1.9.6.1.0"
+	oidHPMemoriaTotale = "1.3.6.1.4.1.11.2.14.11.5.1.1.2.1.1.1.5"
+	oidHPMemoriaLibera = "1.3.6.1.4.1.11.2.14.11.5.1.1.2.1.1.1.6"
+)
+
+// Stati operativi IF-MIB (ifOperStatus)
+const (
+	StatoUp   = 1
+	StatoDown = 2
+)
+
+// Sistema contiene le informazioni generali dell'apparato
+type Sistema struct {
+	Descrizione string
+	Nome        string
+	Uptime      time.Duration
+}
+
+// Interfaccia contiene lo stato e i contatori di una porta
+type Interfaccia struct {
+	Indice         int
+	Nome           string
+	StatoOperativo int
+	VelocitaBps    uint64
+	InOttetti      uint64
+	OutOttetti     uint64
+	InErrori       uint64
+	OutErrori      uint64
+	Contatori64    bool // ottetti da ifHCInOctets/ifHCOutOctets
+}
+
+// Risorse contiene l'utilizzo percentuale di CPU e memoria (-1 se non disponibile)
+type Risorse struct {
+	CPU     int
+	Memoria int
+}
+
+// Sistema legge sysDescr, sysName e sysUpTime
+func (c *Client) Sistema(ctx context.Context) (Sistema, error) {
+	variabili, err := c.Get(ctx, oidSysDescr, oidSysUpTime, oidSysName)
+	if err != nil {
+		return Sistema{}, err
+	}
+	var s Sistema
+	for _, v := range variabili {
+		switch v.OID {
+		case oidSysDescr:
+			s.Descrizione = strings.TrimSpace(v.Testo())
+		case oidSysName:
+			s.Nome = strings.TrimSpace(v.Testo())
+		case oidSysUpTime:
+			// sysUpTime e in centesimi di secondo
+			s.Uptime = time.Duration(v.Numero()) * 10 * time.Millisecond
+		}
+	}
+	return s, nil
+}
+
+// Interfacce legge stato, velocita e contatori di tutte le interfacce.
+// Se l'agente espone ifXTable usa i nomi brevi e i contatori a 64 bit.
+func (c *Client) Interfacce(ctx context.Context) ([]Interfaccia, error) {
+	stati, err := c.colonna(ctx, oidIfOperStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	colonne := make(map[string]map[int]Variabile)
+	for _, oid := range []string{oidIfDescr, oidIfSpeed, oidIfInOctets, oidIfOutOctets, oidIfInErrors, oidIfOutErrors,
+		oidIfName, oidIfHCInOctets, oidIfHCOutOctets, oidIfHighSpeed} {
+		valori, err := c.colonna(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+		colonne[oid] = valori
+	}
+
+	var interfacce []Interfaccia
+	for indice, stato := range stati {
+		i := Interfaccia{
+			Indice:         indice,
+			StatoOperativo: int(stato.Numero()),
+			VelocitaBps:    colonne[oidIfSpeed][indice].Numero(),
+			InOttetti:      colonne[oidIfInOctets][indice].Numero(),
+			OutOttetti:     colonne[oidIfOutOctets][indice].Numero(),
+			InErrori:       colonne[oidIfInErrors][indice].Numero(),
+			OutErrori:      colonne[oidIfOutErrors][indice].Numero(),
+		}
+		i.Nome = colonne[oidIfName][indice].Testo()
+		if i.Nome == "" {
+			i.Nome = colonne[oidIfDescr][indice].Testo()
+		}
+		if in, ok := colonne[oidIfHCInOctets][indice]; ok {
+			if out, ok := colonne[oidIfHCOutOctets][indice]; ok {
+				i.InOttetti, i.OutOttetti, i.Contatori64 = in.Numero(), out.Numero(), true
+			}
+		}
+		// ifSpeed satura a ~4.3 Gbit/s: oltre si usa ifHighSpeed (Mbit/s)
+		if alta := colonne[oidIfHighSpeed][indice].Numero(); alta*1000000 > i.VelocitaBps {
+			i.VelocitaBps = alta * 1000000
+		}
+		interfacce = append(interfacce, i)
+	}
+	sort.Slice(interfacce, func(a, b int) bool { return interfacce[a].Indice < interfacce[b].Indice })
+	return interfacce, nil
+}
+
+// Risorse legge l'utilizzo di CPU e memoria con gli OID proprietari della marca
+func (c *Client) Risorse(ctx context.Context, marca string) (Risorse, error) {
+	r := Risorse{CPU: -1, Memoria: -1}
+	switch strings.ToLower(marca) {
+	case "huawei":
+		// Piu entita (chassis, schede) riportano l'utilizzo: conta la piu carica
+		cpu, err := c.colonna(ctx, oidHuaweiCPU)
+		if err != nil {
+			return r, err
+		}
+		memoria, err := c.colonna(ctx, oidHuaweiMemoria)
+		if err != nil {
+			return r, err
+		}
+		r.CPU = massimo(cpu)
+		r.Memoria = massimo(memoria)
+
+	case "hp":
+		variabili, err := c.Get(ctx, oidHPCPU)
+		if err != nil {
+			return r, err
+		}
+		if len(variabili) > 0 && !variabili[0].Assente() {
+			r.CPU = int(variabili[0].Numero())
+		}
+		totali, err := c.colonna(ctx, oidHPMemoriaTotale)
+		if err != nil {
+			return r, err
+		}
+		libere, err := c.colonna(ctx, oidHPMemoriaLibera)
+		if err != nil {
+			return r, err
+		}
+		var totale, libera uint64
+		for indice, t := range totali {
+			totale += t.Numero()
+			libera += libere[indice].Numero()
+		}
+		if totale > 0 && libera <= totale {
+			r.Memoria = int((totale - libera) * 100 / totale)
+		}
+	}
+	return r, nil
+}
+
+// colonna legge una colonna di tabella indicizzata per l'ultimo sub-identificatore
+func (c *Client) colonna(ctx context.Context, radice string) (map[int]Variabile, error) {
+	variabili, err := c.Walk(ctx, radice)
+	if err != nil {
+		return nil, err
+	}
+	valori := make(map[int]Variabile, len(variabili))
+	for _, v := range variabili {
+		indice, err := strconv.Atoi(v.OID[strings.LastIndex(v.OID, ".")+1:])
+		if err != nil {
+			continue
+		}
+		valori[indice] = v
+	}
+	return valori, nil
+}
+
+// massimo restituisce il valore piu alto della colonna (-1 se vuota)
+func massimo(valori map[int]Variabile) int {
+	m := -1
+	for _, v := range valori {
+		if n := int(v.Numero()); n > m {
+			m = n
+		}
+	}
+	return m
+}
@@ -0,0 +1,604 @@
+// Package snmp implementa un client SNMP v2c/v3 minimale per il polling degli apparati di rete
+package snmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTimeout indica che l'agente non ha risposto entro il tempo previsto
+	ErrTimeout = errors.New("timeout SNMP")
+	// ErrAutenticazione indica credenziali v3 o community rifiutate
+	ErrAutenticazione = errors.New("autenticazione SNMP fallita")
+)
+
+// Contatori USM restituiti nei report (RFC 3414)
+var reportUSM = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "livello di sicurezza non supportato",
+	"1.3.6.1.6.3.15.1.1.2.0": "fuori dalla finestra temporale",
+	"1.3.6.1.6.3.15.1.1.3.0": "utente sconosciuto",
+	"1.3.6.1.6.3.15.1.1.4.0": "engine ID sconosciuto",
+	"1.3.6.1.6.3.15.1.1.5.0": "digest errato (password di autenticazione)",
+	"1.3.6.1.6.3.15.1.1.6.0": "errore di decifratura (password privacy)",
+}
+
+const (
+	oidFuoriFinestra  = "1.3.6.1.6.3.15.1.1.2.0"
+	oidEngineIgnoto   = "1.3.6.1.6.3.15.1.1.4.0"
+	ripetizioniBulk   = 25
+	massimoVariabili  = 20000
+	dimensioneMassima = 65507
+)
+
+// Config contiene i parametri di accesso SNMP a un apparato
+type Config struct {
+	Indirizzo    string
+	Porta        int    // default 161
+	Versione     string // "v2c" (default) o "v3"
+	Community    string // solo v2c
+	Utente       string // solo v3
+	Auth         string // v3: "" (nessuna), "MD5", "SHA", "SHA256"
+	AuthPassword string
+	Priv         string // v3: "" (nessuna), "DES", "AES"
+	PrivPassword string
+	Timeout      time.Duration // per tentativo, default 3 secondi
+	Tentativi    int           // default 3
+}
+
+// Client e una sessione SNMP verso un agente
+type Client struct {
+	cfg  Config
+	conn net.Conn
+	mu   sync.Mutex
+	id   uint32
+
+	// Stato v3 dell'engine autoritativo
+	engineID   []byte
+	boots      uint32
+	tempo      uint32
+	tempoRif   time.Time
+	auth       *protocolloAuth
+	chiaveAuth []byte
+	chiavePriv []byte
+}
+
+// pdu e una PDU decodificata
+type pdu struct {
+	tipo      byte
+	id        int64
+	errStato  int64
+	errIndice int64
+	variabili []Variabile
+}
+
+// parametriUSM sono i parametri di sicurezza di un messaggio v3 ricevuto
+type parametriUSM struct {
+	engineID []byte
+	boots    int64
+	tempo    int64
+}
+
+// Connetti prepara la sessione e, per v3, scopre l'engine dell'agente
+func Connetti(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.Porta == 0 {
+		cfg.Porta = 161
+	}
+	if cfg.Versione == "" {
+		cfg.Versione = "v2c"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	if cfg.Tentativi == 0 {
+		cfg.Tentativi = 3
+	}
+	if err := cfg.Valida(); err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(cfg.Indirizzo, strconv.Itoa(cfg.Porta)))
+	if err != nil {
+		return nil, fmt.Errorf("connessione SNMP a %s: %w", cfg.Indirizzo, err)
+	}
+
+	var b [4]byte
+	rand.Read(b[:])
+	c := &Client{cfg: cfg, conn: conn, id: binary.BigEndian.Uint32(b[:]) & 0x3fffffff}
+	if cfg.Versione == "v3" {
+		if err := c.scopri(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Valida controlla la coerenza dei parametri
+func (cfg *Config) Valida() error {
+	switch cfg.Versione {
+	case "v2c":
+		if cfg.Community == "" {
+			return fmt.Errorf("community SNMP non configurata")
+		}
+	case "v3":
+		if cfg.Utente == "" {
+			return fmt.Errorf("utente SNMPv3 non configurato")
+		}
+		if cfg.Auth != "" {
+			if _, ok := protocolliAuth[cfg.Auth]; !ok {
+				return fmt.Errorf("protocollo di autenticazione SNMP non supportato: %s", cfg.Auth)
+			}
+			if len(cfg.AuthPassword) < 8 {
+				return fmt.Errorf("la password di autenticazione SNMPv3 deve avere almeno 8 caratteri")
+			}
+		}
+		if cfg.Priv != "" {
+			if cfg.Priv != "DES" && cfg.Priv != "AES" {
+				return fmt.Errorf("protocollo privacy SNMP non supportato: %s", cfg.Priv)
+			}
+			if cfg.Auth == "" {
+				return fmt.Errorf("la privacy SNMPv3 richiede l'autenticazione")
+			}
+			if len(cfg.PrivPassword) < 8 {
+				return fmt.Errorf("la password privacy SNMPv3 deve avere almeno 8 caratteri")
+			}
+		}
+	default:
+		return fmt.Errorf("versione SNMP non supportata: %s", cfg.Versione)
+	}
+	return nil
+}
+
+// Chiudi chiude la sessione
+func (c *Client) Chiudi() error {
+	return c.conn.Close()
+}
+
+// Get legge i valori degli OID indicati
+func (c *Client) Get(ctx context.Context, oids ...string) ([]Variabile, error) {
+	return c.richiedi(ctx, pduGet, oids, 0, 0)
+}
+
+// Walk legge tutto il sottoalbero dell'OID indicato con richieste GetBulk
+func (c *Client) Walk(ctx context.Context, radice string) ([]Variabile, error) {
+	radice = strings.TrimPrefix(radice, ".")
+	var risultato []Variabile
+	ultimo := radice
+	for {
+		variabili, err := c.richiedi(ctx, pduGetBulk, []string{ultimo}, 0, ripetizioniBulk)
+		if err != nil {
+			return risultato, err
+		}
+		if len(variabili) == 0 {
+			return risultato, nil
+		}
+		for _, v := range variabili {
+			if v.Tipo == tipoEndOfMibView || !strings.HasPrefix(v.OID, radice+".") {
+				return risultato, nil
+			}
+			if confrontaOID(v.OID, ultimo) <= 0 {
+				return risultato, fmt.Errorf("l'agente restituisce OID non crescenti (%s)", v.OID)
+			}
+			risultato = append(risultato, v)
+			ultimo = v.OID
+		}
+		if len(risultato) > massimoVariabili {
+			return risultato, fmt.Errorf("sottoalbero %s troppo grande", radice)
+		}
+	}
+}
+
+// prossimoID restituisce un nuovo identificativo di richiesta
+func (c *Client) prossimoID() int64 {
+	c.id = (c.id + 1) & 0x3fffffff
+	return int64(c.id)
+}
+
+// richiedi invia la PDU con ritrasmissione e restituisce le variabili della risposta.
+// Per GetBulk nonRipetitori e ripetizioni occupano i campi error-status ed error-index.
+func (c *Client) richiedi(ctx context.Context, tipo byte, oids []string, nonRipetitori, ripetizioni int) ([]Variabile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var variabili [][]byte
+	for _, oid := range oids {
+		o, err := codificaOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		variabili = append(variabili, sequenza(tipoSequenza, o, tlv(tipoNull, nil)))
+	}
+
+	risincronizzato := false
+	for tentativo := 0; tentativo < c.cfg.Tentativi; tentativo++ {
+		id := c.prossimoID()
+		p := sequenza(tipo, intero(id), intero(int64(nonRipetitori)), intero(int64(ripetizioni)), sequenza(tipoSequenza, variabili...))
+
+		risposta, usm, err := c.scambia(ctx, id, p, c.livelloSicurezza()|flagReportable)
+		if errors.Is(err, ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if risposta.tipo == pduReport {
+			// L'agente si e riavviato o l'orologio e cambiato: si riallinea una volta e si riprova
+			if len(risposta.variabili) > 0 && risposta.variabili[0].OID == oidFuoriFinestra && !risincronizzato && usm != nil {
+				c.sincronizza(usm)
+				risincronizzato = true
+				tentativo--
+				continue
+			}
+			return nil, erroreReport(risposta)
+		}
+		if risposta.errStato != 0 {
+			return nil, fmt.Errorf("l'agente ha risposto con errore %s (variabile %d)", nomeErrore(risposta.errStato), risposta.errIndice)
+		}
+		return risposta.variabili, nil
+	}
+	return nil, fmt.Errorf("%w: nessuna risposta da %s dopo %d tentativi", ErrTimeout, c.cfg.Indirizzo, c.cfg.Tentativi)
+}
+
+// scambia invia il messaggio e attende la risposta con lo stesso identificativo
+func (c *Client) scambia(ctx context.Context, id int64, p []byte, flags byte) (*pdu, *parametriUSM, error) {
+	messaggio, err := c.codifica(id, p, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	scadenza := time.Now().Add(c.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(scadenza) {
+		scadenza = d
+	}
+	c.conn.SetDeadline(scadenza)
+	if _, err := c.conn.Write(messaggio); err != nil {
+		return nil, nil, fmt.Errorf("invio richiesta SNMP: %w", err)
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if ctx.Err() != nil {
+					return nil, nil, ctx.Err()
+				}
+				return nil, nil, ErrTimeout
+			}
+			return nil, nil, fmt.Errorf("lettura risposta SNMP: %w", err)
+		}
+		// Le risposte a richieste precedenti (ritrasmesse) vengono scartate
+		risposta, usm, err := c.decodifica(buf[:n], id)
+		if errors.Is(err, errRispostaAltrui) {
+			continue
+		}
+		return risposta, usm, err
+	}
+}
+
+var errRispostaAltrui = errors.New("risposta a un'altra richiesta")
+
+// codifica costruisce il messaggio v2c o v3 che contiene la PDU
+func (c *Client) codifica(id int64, p []byte, flags byte) ([]byte, error) {
+	if c.cfg.Versione == "v2c" {
+		return sequenza(tipoSequenza, intero(1), stringa([]byte(c.cfg.Community)), p), nil
+	}
+	return c.codificaV3(id, p, flags)
+}
+
+// decodifica interpreta un messaggio ricevuto e ne verifica identificativo e sicurezza
+func (c *Client) decodifica(b []byte, id int64) (*pdu, *parametriUSM, error) {
+	if c.cfg.Versione == "v2c" {
+		elementi, err := leggiSequenza(b, tipoSequenza, 3)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(elementi[1].Valore, []byte(c.cfg.Community)) {
+			return nil, nil, errRispostaAltrui
+		}
+		risposta, err := decodificaPDU(elementi[2])
+		if err != nil {
+			return nil, nil, err
+		}
+		if risposta.id != id {
+			return nil, nil, errRispostaAltrui
+		}
+		return risposta, nil, nil
+	}
+	return c.decodificaV3(b, id)
+}
+
+// decodificaPDU interpreta una PDU e le sue variabili
+func decodificaPDU(e elemento) (*pdu, error) {
+	if e.Tipo != pduResponse && e.Tipo != pduReport {
+		return nil, fmt.Errorf("%w: PDU inattesa 0x%02x", errBER, e.Tipo)
+	}
+	campi, err := leggiElementi(e.Valore)
+	if err != nil || len(campi) < 4 {
+		return nil, errBER
+	}
+	p := &pdu{tipo: e.Tipo}
+	if p.id, err = decodificaIntero(campi[0].Valore); err != nil {
+		return nil, err
+	}
+	if p.errStato, err = decodificaIntero(campi[1].Valore); err != nil {
+		return nil, err
+	}
+	if p.errIndice, err = decodificaIntero(campi[2].Valore); err != nil {
+		return nil, err
+	}
+
+	coppie, err := leggiElementi(campi[3].Valore)
+	if err != nil {
+		return nil, err
+	}
+	for _, coppia := range coppie {
+		parti, err := leggiElementi(coppia.Valore)
+		if err != nil || len(parti) != 2 || parti[0].Tipo != tipoOID {
+			return nil, errBER
+		}
+		oid, err := decodificaOID(parti[0].Valore)
+		if err != nil {
+			return nil, err
+		}
+		valore, err := decodificaValore(parti[1])
+		if err != nil {
+			return nil, err
+		}
+		p.variabili = append(p.variabili, Variabile{OID: oid, Tipo: parti[1].Tipo, Valore: valore})
+	}
+	return p, nil
+}
+
+// ============================================
+// SNMPv3
+// ============================================
+
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+	modelloUSM     = 3
+)
+
+// livelloSicurezza restituisce i flag di autenticazione e privacy configurati
+func (c *Client) livelloSicurezza() byte {
+	var flags byte
+	if c.auth != nil {
+		flags |= flagAuth
+		if c.chiavePriv != nil {
+			flags |= flagPriv
+		}
+	}
+	return flags
+}
+
+// scopri ricava engine ID, boots e tempo dell'agente e calcola le chiavi localizzate
+func (c *Client) scopri(ctx context.Context) error {
+	var ultimoErr error = ErrTimeout
+	for tentativo := 0; tentativo < c.cfg.Tentativi; tentativo++ {
+		id := c.prossimoID()
+		p := sequenza(pduGet, intero(id), intero(0), intero(0), sequenza(tipoSequenza))
+		risposta, usm, err := c.scambia(ctx, id, p, flagReportable)
+		if errors.Is(err, ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if usm == nil || len(usm.engineID) == 0 {
+			ultimoErr = fmt.Errorf("l'agente non ha comunicato l'engine ID")
+			continue
+		}
+		if risposta.tipo == pduReport && len(risposta.variabili) > 0 && risposta.variabili[0].OID != oidEngineIgnoto {
+			return erroreReport(risposta)
+		}
+
+		c.engineID = usm.engineID
+		c.sincronizza(usm)
+		if c.cfg.Auth != "" {
+			a := protocolliAuth[c.cfg.Auth]
+			c.auth = &a
+			c.chiaveAuth = chiaveLocalizzata(a.hash, c.cfg.AuthPassword, c.engineID)
+			if c.cfg.Priv != "" {
+				// La chiave privacy si ricava con l'hash del protocollo di autenticazione
+				c.chiavePriv = chiaveLocalizzata(a.hash, c.cfg.PrivPassword, c.engineID)
+			}
+		}
+		return nil
+	}
+	if errors.Is(ultimoErr, ErrTimeout) {
+		return fmt.Errorf("%w: nessuna risposta da %s", ErrTimeout, c.cfg.Indirizzo)
+	}
+	return ultimoErr
+}
+
+// sincronizza allinea boots e tempo dell'engine autoritativo
+func (c *Client) sincronizza(usm *parametriUSM) {
+	c.boots = uint32(usm.boots)
+	c.tempo = uint32(usm.tempo)
+	c.tempoRif = time.Now()
+}
+
+// tempoMotore stima il tempo corrente dell'engine autoritativo
+func (c *Client) tempoMotore() uint32 {
+	if c.tempoRif.IsZero() {
+		return c.tempo
+	}
+	return c.tempo + uint32(time.Since(c.tempoRif)/time.Second)
+}
+
+// codificaV3 costruisce il messaggio v3, cifrando e firmando la PDU se richiesto
+func (c *Client) codificaV3(id int64, p []byte, flags byte) ([]byte, error) {
+	boots, tempo := c.boots, c.tempoMotore()
+	dati := sequenza(tipoSequenza, stringa(c.engineID), stringa(nil), p)
+
+	var privParams []byte
+	if flags&flagPriv != 0 {
+		var cifrato []byte
+		var err error
+		if c.cfg.Priv == "DES" {
+			cifrato, privParams, err = cifraDES(c.chiavePriv, boots, dati)
+		} else {
+			cifrato, privParams, err = cifraAES(c.chiavePriv, boots, tempo, dati)
+		}
+		if err != nil {
+			return nil, err
+		}
+		dati = stringa(cifrato)
+	}
+
+	var authParams []byte
+	utente := []byte(nil)
+	if len(c.engineID) > 0 {
+		utente = []byte(c.cfg.Utente)
+	}
+	if flags&flagAuth != 0 {
+		authParams = make([]byte, c.auth.lunghezzaMAC)
+	}
+	usm := sequenza(tipoSequenza, stringa(c.engineID), intero(int64(boots)), intero(int64(tempo)),
+		stringa(utente), stringa(authParams), stringa(privParams))
+	globali := sequenza(tipoSequenza, intero(id), intero(dimensioneMassima), stringa([]byte{flags}), intero(modelloUSM))
+	messaggio := sequenza(tipoSequenza, intero(3), globali, stringa(usm), dati)
+
+	if flags&flagAuth != 0 {
+		// Il digest si calcola sul messaggio con il campo a zero e poi si scrive al suo posto
+		campo, err := campoAuth(messaggio)
+		if err != nil {
+			return nil, err
+		}
+		copy(campo, c.auth.firma(c.chiaveAuth, messaggio))
+	}
+	return messaggio, nil
+}
+
+// campoAuth restituisce msgAuthenticationParameters come porzione del messaggio stesso
+func campoAuth(messaggio []byte) ([]byte, error) {
+	elementi, err := leggiSequenza(messaggio, tipoSequenza, 4)
+	if err != nil {
+		return nil, err
+	}
+	usm, err := leggiSequenza(elementi[2].Valore, tipoSequenza, 6)
+	if err != nil {
+		return nil, err
+	}
+	return usm[4].Valore, nil
+}
+
+// decodificaV3 verifica e interpreta un messaggio v3
+func (c *Client) decodificaV3(b []byte, id int64) (*pdu, *parametriUSM, error) {
+	elementi, err := leggiSequenza(b, tipoSequenza, 4)
+	if err != nil {
+		return nil, nil, err
+	}
+	globali, err := leggiElementi(elementi[1].Valore)
+	if err != nil || len(globali) < 4 || len(globali[2].Valore) != 1 {
+		return nil, nil, errBER
+	}
+	msgID, err := decodificaIntero(globali[0].Valore)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgID != id {
+		return nil, nil, errRispostaAltrui
+	}
+	flags := globali[2].Valore[0]
+
+	campi, err := leggiSequenza(elementi[2].Valore, tipoSequenza, 6)
+	if err != nil {
+		return nil, nil, err
+	}
+	usm := &parametriUSM{engineID: append([]byte(nil), campi[0].Valore...)}
+	if usm.boots, err = decodificaIntero(campi[1].Valore); err != nil {
+		return nil, nil, err
+	}
+	if usm.tempo, err = decodificaIntero(campi[2].Valore); err != nil {
+		return nil, nil, err
+	}
+
+	if flags&flagAuth != 0 && c.auth != nil {
+		campo := campi[4].Valore
+		if len(campo) != c.auth.lunghezzaMAC {
+			return nil, nil, fmt.Errorf("%w: digest di lunghezza errata", ErrAutenticazione)
+		}
+		ricevuto := append([]byte(nil), campo...)
+		clear(campo)
+		if !hmac.Equal(ricevuto, c.auth.firma(c.chiaveAuth, b)) {
+			return nil, nil, fmt.Errorf("%w: digest della risposta non valido", ErrAutenticazione)
+		}
+	}
+
+	scoped := elementi[3]
+	if flags&flagPriv != 0 {
+		if c.chiavePriv == nil || scoped.Tipo != tipoOctetString {
+			return nil, nil, fmt.Errorf("%w: risposta cifrata inattesa", ErrAutenticazione)
+		}
+		var testo []byte
+		if c.cfg.Priv == "DES" {
+			testo, err = decifraDES(c.chiavePriv, campi[5].Valore, scoped.Valore)
+		} else {
+			testo, err = decifraAES(c.chiavePriv, uint32(usm.boots), uint32(usm.tempo), campi[5].Valore, scoped.Valore)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if scoped, _, err = leggiElemento(testo); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrAutenticazione, reportUSM["1.3.6.1.6.3.15.1.1.6.0"])
+		}
+	}
+	if scoped.Tipo != tipoSequenza {
+		return nil, nil, errBER
+	}
+	parti, err := leggiElementi(scoped.Valore)
+	if err != nil || len(parti) < 3 {
+		return nil, nil, errBER
+	}
+	risposta, err := decodificaPDU(parti[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	// Una risposta vera (non un report) deve avere il livello di sicurezza richiesto
+	if risposta.tipo == pduResponse && flags&c.livelloSicurezza() != c.livelloSicurezza() {
+		return nil, nil, fmt.Errorf("%w: risposta con livello di sicurezza inferiore", ErrAutenticazione)
+	}
+	return risposta, usm, nil
+}
+
+// erroreReport converte un report USM in errore
+func erroreReport(p *pdu) error {
+	if len(p.variabili) == 0 {
+		return fmt.Errorf("%w: report senza variabili", ErrAutenticazione)
+	}
+	if motivo, ok := reportUSM[p.variabili[0].OID]; ok {
+		return fmt.Errorf("%w: %s", ErrAutenticazione, motivo)
+	}
+	return fmt.Errorf("report SNMP inatteso: %s", p.variabili[0].OID)
+}
+
+// nomeErrore restituisce il nome dell'error-status SNMP
+func nomeErrore(stato int64) string {
+	nomi := []string{"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr", "noAccess", "wrongType",
+		"wrongLength", "wrongEncoding", "wrongValue", "noCreation", "inconsistentValue", "resourceUnavailable",
+		"commitFailed", "undoFailed", "authorizationError", "notWritable", "inconsistentName"}
+	if stato >= 0 && int(stato) < len(nomi) {
+		return nomi[stato]
+	}
+	return strconv.FormatInt(stato, 10)
+}
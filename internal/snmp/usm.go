@@ -0,0 +1,169 @@
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync/atomic"
+)
+
+// ============================================
+// USER-BASED SECURITY MODEL (RFC 3414, RFC 3826, RFC 7860)
+// ============================================
+
+// protocolloAuth descrive un protocollo di autenticazione USM
+type protocolloAuth struct {
+	hash         func() hash.Hash
+	lunghezzaMAC int // byte di HMAC trasmessi in msgAuthenticationParameters
+}
+
+var protocolliAuth = map[string]protocolloAuth{
+	"MD5":    {hash: md5.New, lunghezzaMAC: 12},
+	"SHA":    {hash: sha1.New, lunghezzaMAC: 12},
+	"SHA256": {hash: sha256.New, lunghezzaMAC: 24},
+}
+
+// Contatore per i "sale" di cifratura: deve cambiare a ogni messaggio
+var contatoreSale atomic.Uint64
+
+func init() {
+	var b [8]byte
+	rand.Read(b[:])
+	contatoreSale.Store(binary.BigEndian.Uint64(b[:]))
+}
+
+// chiaveLocalizzata ricava dalla password la chiave dell'utente per l'engine indicato (RFC 3414 A.2)
+func chiaveLocalizzata(h func() hash.Hash, password string, engineID []byte) []byte {
+	// Hash di 1 MB ottenuto ripetendo la password
+	hh := h()
+	pw := []byte(password)
+	blocco := make([]byte, 64)
+	indice := 0
+	for totale := 0; totale < 1048576; totale += len(blocco) {
+		for i := range blocco {
+			blocco[i] = pw[indice%len(pw)]
+			indice++
+		}
+		hh.Write(blocco)
+	}
+	ku := hh.Sum(nil)
+
+	hh = h()
+	hh.Write(ku)
+	hh.Write(engineID)
+	hh.Write(ku)
+	return hh.Sum(nil)
+}
+
+// firma calcola l'HMAC troncato del messaggio
+func (p protocolloAuth) firma(chiave, messaggio []byte) []byte {
+	mac := hmac.New(p.hash, chiave)
+	mac.Write(messaggio)
+	return mac.Sum(nil)[:p.lunghezzaMAC]
+}
+
+// cifraDES cifra la scoped PDU in DES-CBC (RFC 3414 8.1.1)
+func cifraDES(chiave []byte, boots uint32, dati []byte) (cifrato, sale []byte, err error) {
+	if len(chiave) < 16 {
+		return nil, nil, fmt.Errorf("chiave privacy DES troppo corta")
+	}
+	blocco, err := des.NewCipher(chiave[:8])
+	if err != nil {
+		return nil, nil, err
+	}
+	sale = make([]byte, 8)
+	binary.BigEndian.PutUint32(sale[0:4], boots)
+	binary.BigEndian.PutUint32(sale[4:8], uint32(contatoreSale.Add(1)))
+	iv := make([]byte, 8)
+	for i := range iv {
+		iv[i] = chiave[8+i] ^ sale[i]
+	}
+
+	// Il testo va completato a multipli di 8 byte: il ricevente ignora i byte oltre la PDU
+	testo := append([]byte(nil), dati...)
+	if resto := len(testo) % 8; resto != 0 {
+		testo = append(testo, make([]byte, 8-resto)...)
+	}
+	cifrato = make([]byte, len(testo))
+	cipher.NewCBCEncrypter(blocco, iv).CryptBlocks(cifrato, testo)
+	return cifrato, sale, nil
+}
+
+// decifraDES decifra una scoped PDU DES-CBC
+func decifraDES(chiave, sale, dati []byte) ([]byte, error) {
+	if len(chiave) < 16 || len(sale) != 8 || len(dati)%8 != 0 {
+		return nil, fmt.Errorf("parametri DES non validi")
+	}
+	blocco, err := des.NewCipher(chiave[:8])
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, 8)
+	for i := range iv {
+		iv[i] = chiave[8+i] ^ sale[i]
+	}
+	testo := make([]byte, len(dati))
+	cipher.NewCBCDecrypter(blocco, iv).CryptBlocks(testo, dati)
+	return testo, nil
+}
+
+// cifraAES cifra la scoped PDU in AES-128-CFB (RFC 3826)
+func cifraAES(chiave []byte, boots, tempo uint32, dati []byte) (cifrato, sale []byte, err error) {
+	sale = make([]byte, 8)
+	binary.BigEndian.PutUint64(sale, contatoreSale.Add(1))
+	cifrato, err = cfbAES(chiave, ivAES(boots, tempo, sale), dati, true)
+	return cifrato, sale, err
+}
+
+// decifraAES decifra una scoped PDU AES-128-CFB
+func decifraAES(chiave []byte, boots, tempo uint32, sale, dati []byte) ([]byte, error) {
+	if len(sale) != 8 {
+		return nil, fmt.Errorf("parametri AES non validi")
+	}
+	return cfbAES(chiave, ivAES(boots, tempo, sale), dati, false)
+}
+
+// ivAES compone il vettore di inizializzazione: engineBoots, engineTime e sale
+func ivAES(boots, tempo uint32, sale []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv[0:4], boots)
+	binary.BigEndian.PutUint32(iv[4:8], tempo)
+	copy(iv[8:], sale)
+	return iv
+}
+
+// cfbAES applica AES in modalita CFB a 128 bit
+func cfbAES(chiave, iv, dati []byte, cifra bool) ([]byte, error) {
+	if len(chiave) < 16 {
+		return nil, fmt.Errorf("chiave privacy AES troppo corta")
+	}
+	blocco, err := aes.NewCipher(chiave[:16])
+	if err != nil {
+		return nil, err
+	}
+	risultato := make([]byte, len(dati))
+	registro := append([]byte(nil), iv...)
+	flusso := make([]byte, aes.BlockSize)
+	for i := 0; i < len(dati); i += aes.BlockSize {
+		blocco.Encrypt(flusso, registro)
+		fine := min(i+aes.BlockSize, len(dati))
+		for j := i; j < fine; j++ {
+			risultato[j] = dati[j] ^ flusso[j-i]
+		}
+		// Il registro successivo e sempre il testo cifrato
+		if cifra {
+			copy(registro, risultato[i:fine])
+		} else {
+			copy(registro, dati[i:fine])
+		}
+	}
+	return risultato, nil
+}
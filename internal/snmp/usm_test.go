@@ -0,0 +1,109 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func daHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestChiaveLocalizzataRFC3414(t *testing.T) {
+	// RFC 3414 Appendice A.3: password "maplesyrup", engine 00...02
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	casi := []struct {
+		protocollo string
+		attesa     string
+	}{
+		{"MD5", "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", "6695febc9288e36282235fc7151f128497b38f3f"},
+	}
+	for _, c := range casi {
+		t.Run(c.protocollo, func(t *testing.T) {
+			chiave := chiaveLocalizzata(protocolliAuth[c.protocollo].hash, "maplesyrup", engineID)
+			if got := hex.EncodeToString(chiave); got != c.attesa {
+				t.Errorf("chiave localizzata = %s, attesa %s", got, c.attesa)
+			}
+		})
+	}
+}
+
+func TestFirmaTroncata(t *testing.T) {
+	for nome, p := range protocolliAuth {
+		chiave := chiaveLocalizzata(p.hash, "maplesyrup", []byte{1, 2, 3})
+		firma := p.firma(chiave, []byte("messaggio"))
+		if len(firma) != p.lunghezzaMAC {
+			t.Errorf("%s: firma di %d byte, attesi %d", nome, len(firma), p.lunghezzaMAC)
+		}
+		if bytes.Equal(firma, p.firma(chiave, []byte("messaggiO"))) {
+			t.Errorf("%s: messaggi diversi con la stessa firma", nome)
+		}
+	}
+}
+
+func TestCifraturaPrivacy(t *testing.T) {
+	chiave := daHex(t, "526f5eed9fcce26f8964c2930787d82b")
+	casi := [][]byte{
+		{},
+		[]byte("x"),
+		[]byte("scoped PDU di esattamente 32 b!!"),
+		bytes.Repeat([]byte{0x30, 0x82}, 37),
+	}
+	for _, dati := range casi {
+		cifrato, sale, err := cifraDES(chiave, 7, dati)
+		if err != nil {
+			t.Fatalf("cifraDES: %v", err)
+		}
+		if len(cifrato)%8 != 0 || len(sale) != 8 {
+			t.Fatalf("cifraDES: %d byte cifrati, sale di %d", len(cifrato), len(sale))
+		}
+		chiaro, err := decifraDES(chiave, sale, cifrato)
+		if err != nil || !bytes.Equal(chiaro[:len(dati)], dati) {
+			t.Errorf("DES andata e ritorno di %d byte: %v", len(dati), err)
+		}
+
+		cifrato, sale, err = cifraAES(chiave, 7, 1234, dati)
+		if err != nil {
+			t.Fatalf("cifraAES: %v", err)
+		}
+		if len(cifrato) != len(dati) {
+			t.Fatalf("cifraAES: %d byte cifrati invece di %d", len(cifrato), len(dati))
+		}
+		chiaro, err = decifraAES(chiave, 7, 1234, sale, cifrato)
+		if err != nil || !bytes.Equal(chiaro, dati) {
+			t.Errorf("AES andata e ritorno di %d byte: %v", len(dati), err)
+		}
+		if len(dati) > 0 {
+			if altro, _ := decifraAES(chiave, 7, 1235, sale, cifrato); bytes.Equal(altro, dati) {
+				t.Errorf("AES: un engineTime diverso deve cambiare il vettore iniziale")
+			}
+		}
+	}
+
+	// Il sale cambia a ogni messaggio
+	_, s1, _ := cifraAES(chiave, 1, 1, []byte("a"))
+	_, s2, _ := cifraAES(chiave, 1, 1, []byte("a"))
+	if bytes.Equal(s1, s2) {
+		t.Error("due messaggi con lo stesso sale")
+	}
+
+	if _, _, err := cifraDES(chiave[:8], 1, []byte("a")); err == nil {
+		t.Error("cifraDES: attesa chiave troppo corta")
+	}
+	if _, err := decifraDES(chiave, []byte{1, 2, 3}, make([]byte, 8)); err == nil {
+		t.Error("decifraDES: atteso errore sul sale")
+	}
+	if _, err := decifraDES(chiave, make([]byte, 8), make([]byte, 7)); err == nil {
+		t.Error("decifraDES: atteso errore sulla lunghezza")
+	}
+	if _, err := decifraAES(chiave[:8], 1, 1, make([]byte, 8), []byte("a")); err == nil {
+		t.Error("decifraAES: attesa chiave troppo corta")
+	}
+}